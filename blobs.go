@@ -172,6 +172,17 @@ type CreateOptions struct {
 	}
 }
 
+// BlobChunkWriter is implemented by the BlobWriters accepting chunks beyond
+// the content written so far, so that the chunks of a blob can be uploaded
+// out of order or in parallel. The chunks are assembled when the writer is
+// committed, which fails if they do not form contiguous content.
+type BlobChunkWriter interface {
+	// ChunkWriter returns a writer for the chunk of size bytes starting at
+	// offset. Closing the writer stores the chunk, unless less or more than
+	// size bytes were written to it.
+	ChunkWriter(ctx context.Context, offset, size int64) (io.WriteCloser, error)
+}
+
 // BlobWriter provides a handle for inserting data into a blob store.
 // Instances should be obtained from BlobWriteService.Writer and
 // BlobWriteService.Resume. If supported by the store, a writer can be
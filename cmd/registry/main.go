@@ -4,18 +4,34 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/distribution/distribution/v3/registry"
+	_ "github.com/distribution/distribution/v3/registry/auth/acl"
+	_ "github.com/distribution/distribution/v3/registry/auth/awsiam"
 	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	_ "github.com/distribution/distribution/v3/registry/auth/kerberos"
+	_ "github.com/distribution/distribution/v3/registry/auth/ldap"
+	_ "github.com/distribution/distribution/v3/registry/auth/plugin"
 	_ "github.com/distribution/distribution/v3/registry/auth/silly"
 	_ "github.com/distribution/distribution/v3/registry/auth/token"
 	_ "github.com/distribution/distribution/v3/registry/proxy"
+	_ "github.com/distribution/distribution/v3/registry/secrets/vault"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/azure"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/b2"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/gcs"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/akamai"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/cloudfront"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/diskcache"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/encrypt"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/fastly"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/ipfs"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/redirect"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/rewrite"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/tier"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/zstd"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/oci"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/s3-aws"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/sftp"
 )
 
 func main() {
@@ -0,0 +1,7 @@
+//go:build include_storj
+
+package main
+
+import (
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/storj"
+)
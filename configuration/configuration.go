@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"reflect"
 	"strings"
 	"time"
@@ -21,6 +22,11 @@ type Configuration struct {
 	// Version is the version which defines the format of the rest of the configuration
 	Version Version `yaml:"version"`
 
+	// ExpandVariables enables the expansion of the references to
+	// environment variables and secrets in parameter values. Without it,
+	// values such as ${NAME} are used as is.
+	ExpandVariables bool `yaml:"expandvariables,omitempty"`
+
 	// Log supports setting various parameters related to the logging
 	// subsystem.
 	Log struct {
@@ -82,6 +88,11 @@ type Configuration struct {
 		// Secret specifies the secret key which HMAC tokens are created with.
 		Secret string `yaml:"secret,omitempty"`
 
+		// StoreSecret stores a generated secret in the storage backend when
+		// Secret is unset, to share it with the registries using the same
+		// storage backend.
+		StoreSecret bool `yaml:"storesecret,omitempty"`
+
 		// RelativeURLs specifies that relative URLs should be returned in
 		// Location headers
 		RelativeURLs bool `yaml:"relativeurls,omitempty"`
@@ -90,6 +101,14 @@ type Configuration struct {
 		// receives a stop signal
 		DrainTimeout time.Duration `yaml:"draintimeout,omitempty"`
 
+		// UploadIdleTimeout is the time after which a blob upload request
+		// sending no data is aborted. Zero disables the timeout.
+		UploadIdleTimeout time.Duration `yaml:"uploadidletimeout,omitempty"`
+
+		// Bandwidth limits the bandwidth of the blob uploads and downloads
+		// served by the registry.
+		Bandwidth Bandwidth `yaml:"bandwidth,omitempty"`
+
 		// TLS instructs the http server to listen with a TLS configuration.
 		// This only support simple tls configuration with a cert and key.
 		// Mostly, this is useful for testing situations or simple deployments
@@ -200,7 +219,68 @@ type Configuration struct {
 			// the class in authorized resources.
 			Classes []string `yaml:"classes"`
 		} `yaml:"repository,omitempty"`
+
+		// OPA configures an Open Policy Agent server authorizing
+		// requests once they have been authenticated.
+		OPA OPAPolicy `yaml:"opa,omitempty"`
 	} `yaml:"policy,omitempty"`
+
+	// Secrets configures a provider fetching the secrets referenced by
+	// parameter values from an external secret store.
+	Secrets Secrets `yaml:"secrets,omitempty"`
+
+	// secretsResolver resolves the secret references of the configuration, and
+	// keeps secret files up to date.
+	secretsResolver *secretsResolver
+}
+
+// Bandwidth configures limits of the bandwidth of blob transfers. The
+// downloads redirected to the storage backend are not limited.
+type Bandwidth struct {
+	// Client identifies the clients the per-client limits apply to, either
+	// "ip", the default, or "user", the authenticated user name, falling
+	// back to the IP for anonymous requests.
+	Client string `yaml:"client,omitempty"`
+
+	// TrustedProxies lists the IP addresses or CIDR ranges of the proxies
+	// whose X-Forwarded-For and X-Real-IP headers carry the client IP.
+	// Without them, the client IP is the peer of the request.
+	TrustedProxies []string `yaml:"trustedproxies,omitempty"`
+
+	// Upload limits the bandwidth of blob uploads.
+	Upload BandwidthLimit `yaml:"upload,omitempty"`
+
+	// Download limits the bandwidth of blob downloads.
+	Download BandwidthLimit `yaml:"download,omitempty"`
+}
+
+// BandwidthLimit is a bandwidth limit in bytes per second, unlimited if zero.
+type BandwidthLimit struct {
+	// Global is the bandwidth shared by all the clients.
+	Global int64 `yaml:"global,omitempty"`
+
+	// PerClient is the bandwidth of each client.
+	PerClient int64 `yaml:"perclient,omitempty"`
+}
+
+// OPAPolicy configures the authorization of requests by a policy hosted by an
+// Open Policy Agent server.
+type OPAPolicy struct {
+	// URL is the URL of the policy decision in the OPA data API, for
+	// instance http://localhost:8181/v1/data/registry/authz.
+	URL string `yaml:"url,omitempty"`
+
+	// Timeout is the timeout of policy evaluations.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// FailOpen allows requests when the policy cannot be evaluated,
+	// instead of rejecting them.
+	FailOpen bool `yaml:"failopen,omitempty"`
+
+	// TrustedProxies lists the IP addresses or CIDR ranges of the proxies
+	// whose X-Forwarded-For and X-Real-IP headers carry the client IP given
+	// to the policy. Without them, the client IP is the peer of the request.
+	TrustedProxies []string `yaml:"trustedproxies,omitempty"`
 }
 
 // Catalog is composed of MaxEntries.
@@ -313,6 +393,20 @@ type Health struct {
 		// Threshold is the number of times a check must fail to trigger an
 		// unhealthy state
 		Threshold int `yaml:"threshold,omitempty"`
+		// Timeout is the duration after which a check is considered failed
+		Timeout time.Duration `yaml:"timeout,omitempty"`
+		// CircuitBreaker configures a circuit breaker failing the calls to
+		// the storage driver fast while its backend is down
+		CircuitBreaker struct {
+			// Enabled turns on the circuit breaker
+			Enabled bool `yaml:"enabled,omitempty"`
+			// Threshold is the number of consecutive failures of the backend
+			// opening the circuit
+			Threshold int `yaml:"threshold,omitempty"`
+			// Cooldown is the duration the circuit stays open before a call
+			// probes the backend again
+			Cooldown time.Duration `yaml:"cooldown,omitempty"`
+		} `yaml:"circuitbreaker,omitempty"`
 	} `yaml:"storagedriver,omitempty"`
 }
 
@@ -400,6 +494,12 @@ func (storage Storage) Type() string {
 			// allow configuration of redirect
 		case "tag":
 			// allow configuration of tag
+		case "inline":
+			// allow configuration of inline blobs
+		case "delta":
+			// allow configuration of deltas
+		case "conversion":
+			// allow configuration of layer conversion
 		default:
 			storageType = append(storageType, k)
 		}
@@ -456,6 +556,12 @@ func (storage *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 					// allow configuration of redirect
 				case "tag":
 					// allow configuration of tag
+				case "inline":
+					// allow configuration of inline blobs
+				case "delta":
+					// allow configuration of deltas
+				case "conversion":
+					// allow configuration of layer conversion
 				default:
 					types = append(types, k)
 				}
@@ -561,20 +667,50 @@ type Notifications struct {
 // Endpoint describes the configuration of an http webhook notification
 // endpoint.
 type Endpoint struct {
-	Name              string        `yaml:"name"`              // identifies the endpoint in the registry instance.
-	Disabled          bool          `yaml:"disabled"`          // disables the endpoint
-	URL               string        `yaml:"url"`               // post url for the endpoint.
-	Headers           http.Header   `yaml:"headers"`           // static headers that should be added to all requests
-	Timeout           time.Duration `yaml:"timeout"`           // HTTP timeout
-	Threshold         int           `yaml:"threshold"`         // circuit breaker threshold before backing off on failure
-	Backoff           time.Duration `yaml:"backoff"`           // backoff duration
-	IgnoredMediaTypes []string      `yaml:"ignoredmediatypes"` // target media types to ignore
-	Ignore            Ignore        `yaml:"ignore"`            // ignore event types
+	Name              string         `yaml:"name"`                     // identifies the endpoint in the registry instance.
+	Disabled          bool           `yaml:"disabled"`                 // disables the endpoint
+	URL               string         `yaml:"url"`                      // post url for the endpoint.
+	Headers           http.Header    `yaml:"headers"`                  // static headers that should be added to all requests
+	Timeout           time.Duration  `yaml:"timeout"`                  // HTTP timeout
+	Threshold         int            `yaml:"threshold"`                // circuit breaker threshold before backing off on failure
+	Backoff           time.Duration  `yaml:"backoff"`                  // backoff duration
+	IgnoredMediaTypes []string       `yaml:"ignoredmediatypes"`        // target media types to ignore
+	Ignore            Ignore         `yaml:"ignore"`                   // ignore event types
+	Concurrency       int            `yaml:"concurrency,omitempty"`    // number of events delivered concurrently
+	QueueSize         int            `yaml:"queuesize,omitempty"`      // maximum number of events queued in memory
+	Overflow          OverflowPolicy `yaml:"overflow,omitempty"`       // policy applied when the queue is full
+	SpillDirectory    string         `yaml:"spilldirectory,omitempty"` // directory events overflow to with the spill policy
+}
+
+// OverflowPolicy is the action taken when an event is written to the full
+// queue of a notification endpoint. This can be block, dropoldest or spill
+type OverflowPolicy string
+
+// UnmarshalYAML implements the yaml.Umarshaler interface
+// Unmarshals a string into an OverflowPolicy option, lowercasing the string and validating that it represents a
+// valid option
+func (policy *OverflowPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var policyString string
+	err := unmarshal(&policyString)
+	if err != nil {
+		return err
+	}
+
+	policyString = strings.ToLower(policyString)
+	switch policyString {
+	case "block", "dropoldest", "spill":
+	default:
+		return fmt.Errorf("invalid overflow policy %s Must be one of [block, dropoldest, spill]", policyString)
+	}
+
+	*policy = OverflowPolicy(policyString)
+	return nil
 }
 
 // Events configures notification events.
 type Events struct {
-	IncludeReferences bool `yaml:"includereferences"` // include reference data in manifest events
+	IncludeReferences bool `yaml:"includereferences"`        // include reference data in manifest events
+	IncludeDenials    bool `yaml:"includedenials,omitempty"` // send events for authorization denials
 }
 
 // Ignore configures mediaTypes and actions of the event, that it won't be propagated
@@ -608,10 +744,120 @@ type Proxy struct {
 	// If set, Username and Password are ignored.
 	Exec *ExecConfig `yaml:"exec,omitempty"`
 
+	// ForwardCredentials forwards the credentials of the client to the
+	// remote registry, instead of the configured credentials, so that the
+	// remote authorization and rate limits apply to each user.
+	ForwardCredentials bool `yaml:"forwardcredentials,omitempty"`
+
 	// TTL is the expiry time of the content and will be cleaned up when it expires
 	// if not set, defaults to 7 * 24 hours
 	// If set to zero, will never expire cache
 	TTL *time.Duration `yaml:"ttl,omitempty"`
+
+	// Repositories overrides the TTL of the content of the repositories
+	// whose name matches a pattern, the first matching pattern applying.
+	Repositories []ProxyRepositoryTTL `yaml:"repositories,omitempty"`
+
+	// MaxSize is the size in bytes the cached content is kept under, by
+	// evicting the least recently pulled blobs and manifests. If zero, the
+	// size of the cache is unbounded.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+
+	// PushThrough accepts the pushes to the registry and forwards them to
+	// the remote registries.
+	PushThrough ProxyPushThrough `yaml:"pushthrough,omitempty"`
+
+	// ServeStale serves the content past its TTL while the remote registry
+	// is unreachable, instead of failing the pulls.
+	ServeStale ProxyServeStale `yaml:"servestale,omitempty"`
+
+	// Pinned lists the images prefetched into the cache on schedule, whose
+	// content never expires nor is evicted.
+	Pinned ProxyPinned `yaml:"pinned,omitempty"`
+
+	// Remotes maps the repositories whose name starts with a prefix to
+	// other remote registries, RemoteURL being the remote registry of the
+	// other repositories, if set.
+	Remotes []ProxyRemote `yaml:"remotes,omitempty"`
+}
+
+// ProxyPushThrough configures the pushes to a pull through cache.
+type ProxyPushThrough struct {
+	// Enabled accepts the pushes of blobs and manifests, which are
+	// forwarded to the remote registry of their repository.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Cache keeps the pushed content in the cache, as if it was pulled.
+	// Otherwise, the blobs are only staged in the cache until forwarded.
+	Cache bool `yaml:"cache,omitempty"`
+}
+
+// ProxyServeStale configures the serving of the expired content of a pull
+// through cache.
+type ProxyServeStale struct {
+	// Enabled keeps the content whose TTL expires, which is revalidated
+	// with the remote registry when pulled, and served with a Warning
+	// header while the remote registry is unreachable.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// MaxStale is how long the expired content is kept. If zero, it is kept
+	// until the remote registry is reachable again.
+	MaxStale time.Duration `yaml:"maxstale,omitempty"`
+}
+
+// ProxyPinned configures the images pinned in a pull through cache.
+type ProxyPinned struct {
+	// References are the references of the images, by tag or by digest,
+	// such as library/ubuntu:24.04. Every platform of an image index is
+	// pinned.
+	References []string `yaml:"references,omitempty"`
+
+	// Schedule is the cron expression of the prefetching of the images,
+	// which are also prefetched on startup. Defaults to @hourly.
+	Schedule string `yaml:"schedule,omitempty"`
+}
+
+// ProxyRepositoryTTL overrides the TTL of the content of the repositories of
+// a pull through cache.
+type ProxyRepositoryTTL struct {
+	// Pattern matches the names of the repositories, in the syntax of
+	// path.Match, such as library/*.
+	Pattern string `yaml:"pattern"`
+
+	// ManifestTTL and BlobTTL are the expiry times of the manifests and
+	// blobs of the repositories. If not set, the TTL of the proxy applies.
+	// If set to zero, the content never expires.
+	ManifestTTL *time.Duration `yaml:"manifestttl,omitempty"`
+	BlobTTL     *time.Duration `yaml:"blobttl,omitempty"`
+}
+
+// ProxyRemote configures a remote registry of the pull through cache.
+type ProxyRemote struct {
+	// Prefix is the leading path components of the names of the
+	// repositories pulled through from the remote registry, such as
+	// docker.io. It is stripped from the names of the repositories in the
+	// remote registry.
+	Prefix string `yaml:"prefix"`
+
+	// RemoteURL is the URL of the remote registry
+	RemoteURL string `yaml:"remoteurl"`
+
+	// Username and Password authenticate with the remote registry
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Exec specifies a custom exec-based command to retrieve credentials.
+	// If set, Username and Password are ignored.
+	Exec *ExecConfig `yaml:"exec,omitempty"`
+
+	// ForwardCredentials forwards the credentials of the client to the
+	// remote registry, instead of the configured credentials.
+	ForwardCredentials bool `yaml:"forwardcredentials,omitempty"`
+}
+
+// Enabled returns whether the registry is configured as a pull through cache.
+func (proxy Proxy) Enabled() bool {
+	return proxy.RemoteURL != "" || len(proxy.Remotes) > 0
 }
 
 type ExecConfig struct {
@@ -648,6 +894,8 @@ type ValidationManifests struct {
 	} `yaml:"urls,omitempty"`
 	// ImageIndexes configures validation of image indexes
 	Indexes ValidationIndexes `yaml:"indexes,omitempty"`
+	// Lint configures checks of pushed manifests against packaging best practices.
+	Lint ValidationLint `yaml:"lint,omitempty"`
 }
 
 type ValidationIndexes struct {
@@ -657,6 +905,48 @@ type ValidationIndexes struct {
 	PlatformList []Platform `yaml:"platformlist,omitempty"`
 }
 
+// ValidationLint configures checks of pushed manifests against packaging best practices.
+type ValidationLint struct {
+	// Policy is the action taken when a pushed manifest fails a check:
+	// warn, the default, or reject.
+	Policy LintPolicy `yaml:"policy,omitempty"`
+	// RequiredAnnotations lists the annotations pushed manifests must carry,
+	// such as org.opencontainers.image.source.
+	RequiredAnnotations []string `yaml:"requiredannotations,omitempty"`
+	// ReproducibleTimestamps flags images whose configuration carries the
+	// time of the build rather than a fixed, reproducible timestamp.
+	ReproducibleTimestamps bool `yaml:"reproducibletimestamps,omitempty"`
+	// CompressedLayers flags images with uncompressed layers.
+	CompressedLayers bool `yaml:"compressedlayers,omitempty"`
+	// MaxLayers flags images with more layers than this, if set.
+	MaxLayers int `yaml:"maxlayers,omitempty"`
+}
+
+// LintPolicy is the action taken when a pushed manifest fails a lint check.
+// This can be warn or reject
+type LintPolicy string
+
+// UnmarshalYAML implements the yaml.Umarshaler interface
+// Unmarshals a string into a LintPolicy option, lowercasing the string and validating that it represents a
+// valid option
+func (policy *LintPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var policyString string
+	err := unmarshal(&policyString)
+	if err != nil {
+		return err
+	}
+
+	policyString = strings.ToLower(policyString)
+	switch policyString {
+	case "warn", "reject":
+	default:
+		return fmt.Errorf("invalid lint policy %s Must be one of [warn, reject]", policyString)
+	}
+
+	*policy = LintPolicy(policyString)
+	return nil
+}
+
 // Platforms configures the validation applies to the platform images included in an image index
 // This can be all, none, or list
 type Platforms string
@@ -689,6 +979,10 @@ func (platforms *Platforms) UnmarshalYAML(unmarshal func(interface{}) error) err
 // following the scheme below:
 // Configuration.Abc may be replaced by the value of REGISTRY_ABC,
 // Configuration.Abc.Xyz may be replaced by the value of REGISTRY_ABC_XYZ, and so forth
+//
+// Storage, auth and middleware parameters, as well as notification endpoint
+// URLs and headers, may also reference environment variables as ${NAME},
+// ${NAME:-default} or ${NAME:?message}.
 func Parse(rd io.Reader) (*Configuration, error) {
 	in, err := io.ReadAll(rd)
 	if err != nil {
@@ -732,6 +1026,15 @@ func Parse(rd io.Reader) (*Configuration, error) {
 		return nil, err
 	}
 
+	if config.ExpandVariables {
+		if err := expandConfiguration(config, os.LookupEnv); err != nil {
+			// the secret files of an invalid configuration are unused
+			return nil, errors.Join(err, config.RemoveSecrets())
+		}
+	} else if len(config.Secrets) > 0 {
+		return nil, errors.New("secrets: secret references are only expanded with expandvariables enabled")
+	}
+
 	return config, nil
 }
 
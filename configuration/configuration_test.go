@@ -2,6 +2,7 @@ package configuration
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"reflect"
 	"strings"
@@ -70,14 +71,17 @@ var configStruct = Configuration{
 		MaxEntries: 1000,
 	},
 	HTTP: struct {
-		Addr         string        `yaml:"addr,omitempty"`
-		Net          string        `yaml:"net,omitempty"`
-		Host         string        `yaml:"host,omitempty"`
-		Prefix       string        `yaml:"prefix,omitempty"`
-		Secret       string        `yaml:"secret,omitempty"`
-		RelativeURLs bool          `yaml:"relativeurls,omitempty"`
-		DrainTimeout time.Duration `yaml:"draintimeout,omitempty"`
-		TLS          struct {
+		Addr              string        `yaml:"addr,omitempty"`
+		Net               string        `yaml:"net,omitempty"`
+		Host              string        `yaml:"host,omitempty"`
+		Prefix            string        `yaml:"prefix,omitempty"`
+		Secret            string        `yaml:"secret,omitempty"`
+		StoreSecret       bool          `yaml:"storesecret,omitempty"`
+		RelativeURLs      bool          `yaml:"relativeurls,omitempty"`
+		DrainTimeout      time.Duration `yaml:"draintimeout,omitempty"`
+		UploadIdleTimeout time.Duration `yaml:"uploadidletimeout,omitempty"`
+		Bandwidth         Bandwidth     `yaml:"bandwidth,omitempty"`
+		TLS               struct {
 			Certificate  string     `yaml:"certificate,omitempty"`
 			Key          string     `yaml:"key,omitempty"`
 			ClientCAs    []string   `yaml:"clientcas,omitempty"`
@@ -432,6 +436,18 @@ func (suite *ConfigSuite) TestParseInvalidLoglevel() {
 	suite.Require().Error(err)
 }
 
+// TestParseInvalidOverflowPolicy validates that the parser will fail to parse
+// a configuration if the overflow policy of an endpoint is unknown
+func (suite *ConfigSuite) TestParseInvalidOverflowPolicy() {
+	configYaml := "version: 0.1\nstorage: inmemory\nnotifications:\n  endpoints:\n    - name: endpoint\n      overflow: %s\n"
+	config, err := Parse(bytes.NewReader([]byte(fmt.Sprintf(configYaml, "Spill"))))
+	suite.Require().NoError(err)
+	suite.Require().Equal(OverflowPolicy("spill"), config.Notifications.Endpoints[0].Overflow)
+
+	_, err = Parse(bytes.NewReader([]byte(fmt.Sprintf(configYaml, "discard"))))
+	suite.Require().Error(err)
+}
+
 // TestParseInvalidVersion validates that the parser will fail to parse a newer configuration
 // version than the CurrentVersion
 func (suite *ConfigSuite) TestParseInvalidVersion() {
@@ -0,0 +1,252 @@
+package configuration
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// expander expands the references of parameter values to environment
+// variables and, when a secrets provider is configured, to secrets.
+type expander struct {
+	lookupEnv func(string) (string, bool)
+	secrets   *secretsResolver
+}
+
+// expandConfiguration expands the environment variable and secret
+// references in the parameters of the storage driver, access controller and
+// middlewares, in the notification endpoints, and in the credentials of the
+// HTTP server, Redis and the proxy. Those are free form, repeated or
+// sensitive values which cannot be overridden with REGISTRY_ environment
+// variables, or had better not be written in the configuration.
+func expandConfiguration(config *Configuration, lookup func(string) (string, bool)) error {
+	e := &expander{lookupEnv: lookup}
+	if len(config.Secrets) > 0 {
+		// the parameters of the secrets provider may only reference
+		// environment variables
+		for name, params := range config.Secrets {
+			if err := e.expandParameters(params); err != nil {
+				return fmt.Errorf("secrets.%s: %v", name, err)
+			}
+		}
+		secrets, err := newSecretsResolver(config.Secrets)
+		if err != nil {
+			return err
+		}
+		e.secrets = secrets
+		config.secretsResolver = secrets
+	}
+
+	for name, params := range config.Storage {
+		if err := e.expandParameters(params); err != nil {
+			return fmt.Errorf("storage.%s: %v", name, err)
+		}
+	}
+	for name, params := range config.Auth {
+		if err := e.expandParameters(params); err != nil {
+			return fmt.Errorf("auth.%s: %v", name, err)
+		}
+	}
+	for kind, middlewares := range config.Middleware {
+		for i := range middlewares {
+			if err := e.expandParameters(middlewares[i].Options); err != nil {
+				return fmt.Errorf("middleware.%s.%s: %v", kind, middlewares[i].Name, err)
+			}
+		}
+	}
+	for i := range config.Notifications.Endpoints {
+		endpoint := &config.Notifications.Endpoints[i]
+		if err := e.expandEndpoint(endpoint); err != nil {
+			return fmt.Errorf("notifications.endpoints.%s: %v", endpoint.Name, err)
+		}
+	}
+
+	for name, value := range map[string]*string{
+		"http.secret":    &config.HTTP.Secret,
+		"redis.username": &config.Redis.Options.Username,
+		"redis.password": &config.Redis.Options.Password,
+		"proxy.username": &config.Proxy.Username,
+		"proxy.password": &config.Proxy.Password,
+	} {
+		expanded, err := e.expand(*value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*value = expanded
+	}
+	return nil
+}
+
+func (e *expander) expandEndpoint(endpoint *Endpoint) error {
+	var err error
+	if endpoint.URL, err = e.expand(endpoint.URL); err != nil {
+		return err
+	}
+	headers := make(http.Header, len(endpoint.Headers))
+	for name, values := range endpoint.Headers {
+		for _, value := range values {
+			value, err := e.expand(value)
+			if err != nil {
+				return err
+			}
+			headers[name] = append(headers[name], value)
+		}
+	}
+	if endpoint.Headers != nil {
+		endpoint.Headers = headers
+	}
+	return nil
+}
+
+func (e *expander) expandParameters(params Parameters) error {
+	for k, v := range params {
+		expanded, err := e.expandValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+		params[k] = expanded
+	}
+	return nil
+}
+
+// expandValue expands the strings held by v, recursing into maps and lists.
+func (e *expander) expandValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return e.expand(v)
+	case []interface{}:
+		for i := range v {
+			expanded, err := e.expandValue(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	case map[interface{}]interface{}:
+		for k := range v {
+			expanded, err := e.expandValue(v[k])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", k, err)
+			}
+			v[k] = expanded
+		}
+	case map[string]interface{}:
+		for k := range v {
+			expanded, err := e.expandValue(v[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+			v[k] = expanded
+		}
+	case Parameters:
+		if err := e.expandParameters(v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// expandEnv replaces the references to environment variables in s.
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	return (&expander{lookupEnv: lookup}).expand(s)
+}
+
+// expand replaces the references in s:
+//
+//   - ${NAME} is replaced by the value of NAME, which must be set,
+//   - ${NAME:-default} is replaced by the value of NAME, or by default if NAME
+//     is unset or empty,
+//   - ${NAME:?message} is replaced by the value of NAME, and fails with
+//     message if NAME is unset or empty,
+//   - ${secret:path#field} is replaced by the value of a secret field, and
+//     ${secretfile:path#field} by the path of a file holding it,
+//   - $${ is replaced by a literal ${.
+//
+// Other dollar signs are left as is.
+func (e *expander) expand(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i])
+			b.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference %q", s[i:])
+		}
+		ref := s[i+2 : i+end]
+		s = s[i+end+1:]
+
+		if kind, secret, ok := strings.Cut(ref, ":"); ok && (kind == "secret" || kind == "secretfile") {
+			if e.secrets == nil {
+				return "", fmt.Errorf("${%s}: %v", ref, errNoSecretsProvider)
+			}
+			value, err := e.secrets.resolve(kind, secret)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			continue
+		}
+
+		name, op, arg := ref, "", ""
+		if j := strings.Index(ref, ":"); j >= 0 {
+			name, op = ref[:j], ref[j:]
+			if len(op) < 2 || (op[1] != '-' && op[1] != '?') {
+				return "", fmt.Errorf("invalid variable reference ${%s}", ref)
+			}
+			op, arg = op[:2], op[2:]
+		}
+		if !validEnvName(name) {
+			return "", fmt.Errorf("invalid variable name in ${%s}", ref)
+		}
+
+		value, ok := e.lookupEnv(name)
+		switch op {
+		case "":
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+		case ":-":
+			if value == "" {
+				value = arg
+			}
+		case ":?":
+			if value == "" {
+				if arg == "" {
+					arg = "not set"
+				}
+				return "", fmt.Errorf("environment variable %s: %s", name, arg)
+			}
+		}
+		b.WriteString(value)
+	}
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package configuration
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{
+		"BUCKET": "images",
+		"EMPTY":  "",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"plain", "plain"},
+		{"$2y$05$hash", "$2y$05$hash"},
+		{"${BUCKET}", "images"},
+		{"s3://${BUCKET}/${BUCKET}", "s3://images/images"},
+		{"${EMPTY}", ""},
+		{"${EMPTY:-fallback}", "fallback"},
+		{"${MISSING:-fall:back}", "fall:back"},
+		{"${BUCKET:?required}", "images"},
+		{"$${BUCKET}", "${BUCKET}"},
+	} {
+		out, err := expandEnv(tc.in, lookup)
+		if err != nil {
+			t.Errorf("unexpected error expanding %q: %v", tc.in, err)
+			continue
+		}
+		if out != tc.out {
+			t.Errorf("expected %q to expand to %q, got %q", tc.in, tc.out, out)
+		}
+	}
+
+	for _, in := range []string{"${MISSING}", "${EMPTY:?bucket is required}", "${BUCKET", "${}", "${1X}", "${BUCKET:+x}"} {
+		if out, err := expandEnv(in, lookup); err == nil {
+			t.Errorf("expected error expanding %q, got %q", in, out)
+		}
+	}
+}
+
+func TestParseExpandEnv(t *testing.T) {
+	t.Setenv("TEST_BUCKET", "images")
+	t.Setenv("TEST_TOKEN", "secret")
+
+	config, err := Parse(bytes.NewReader([]byte(`
+version: 0.1
+expandvariables: true
+storage:
+  s3:
+    bucket: ${TEST_BUCKET}
+    region: ${TEST_REGION:-us-east-1}
+    tags:
+      - ${TEST_BUCKET}-a
+      - name: ${TEST_BUCKET}-b
+auth:
+  htpasswd:
+    realm: basic-realm
+    path: /etc/${TEST_BUCKET}/htpasswd
+notifications:
+  endpoints:
+    - name: first
+      url: https://${TEST_BUCKET}.example.com/events
+      headers:
+        Authorization:
+          - Bearer ${TEST_TOKEN}
+    - name: second
+      url: https://second.example.com/events
+`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Parameters{
+		"bucket": "images",
+		"region": "us-east-1",
+		"tags": []interface{}{
+			"images-a",
+			map[interface{}]interface{}{"name": "images-b"},
+		},
+	}
+	if !reflect.DeepEqual(config.Storage["s3"], expected) {
+		t.Errorf("unexpected storage parameters %#v", config.Storage["s3"])
+	}
+	if path := config.Auth["htpasswd"]["path"]; path != "/etc/images/htpasswd" {
+		t.Errorf("unexpected auth parameter %v", path)
+	}
+	endpoints := config.Notifications.Endpoints
+	if endpoints[0].URL != "https://images.example.com/events" || endpoints[1].URL != "https://second.example.com/events" {
+		t.Errorf("unexpected endpoint URLs %q, %q", endpoints[0].URL, endpoints[1].URL)
+	}
+	if !reflect.DeepEqual(endpoints[0].Headers, http.Header{"Authorization": {"Bearer secret"}}) {
+		t.Errorf("unexpected endpoint headers %v", endpoints[0].Headers)
+	}
+
+	_, err = Parse(bytes.NewReader([]byte(`
+version: 0.1
+expandvariables: true
+storage:
+  s3:
+    bucket: ${TEST_MISSING_BUCKET}
+`)))
+	if err == nil {
+		t.Fatal("expected error referencing an unset variable")
+	}
+}
+
+func TestParseWithoutExpandVariables(t *testing.T) {
+	t.Setenv("TEST_BUCKET", "images")
+
+	config, err := Parse(bytes.NewReader([]byte(`
+version: 0.1
+storage:
+  s3:
+    bucket: ${TEST_BUCKET}
+    prefix: ${TEST_MISSING_PREFIX}
+`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Parameters{
+		"bucket": "${TEST_BUCKET}",
+		"prefix": "${TEST_MISSING_PREFIX}",
+	}
+	if !reflect.DeepEqual(config.Storage["s3"], expected) {
+		t.Errorf("expected the parameters to be left as is, got %#v", config.Storage["s3"])
+	}
+
+	_, err = Parse(bytes.NewReader([]byte(`
+version: 0.1
+storage: inmemory
+secrets:
+  vault:
+    address: https://vault.example.com:8200
+    token: token
+`)))
+	if err == nil {
+		t.Fatal("expected an error configuring secrets without expandvariables")
+	}
+}
@@ -205,6 +205,9 @@ func (p *Parser) overwriteStruct(v reflect.Value, fullpath string, path []string
 	byUpperCase := make(map[string]int)
 	for i := 0; i < v.NumField(); i++ {
 		sf := v.Type().Field(i)
+		if !sf.IsExported() {
+			continue
+		}
 		upper := strings.ToUpper(sf.Name)
 		if _, present := byUpperCase[upper]; present {
 			panic(fmt.Sprintf("field name collision in configuration object: %s", sf.Name))
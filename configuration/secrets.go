@@ -0,0 +1,307 @@
+package configuration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+// secretsRetryInterval is the time waited before retrying to renew the
+// credentials of the secrets provider or to refresh a secret file.
+const secretsRetryInterval = 30 * time.Second
+
+// secretsTimeout bounds each call to the secrets provider, so that an
+// unresponsive secret store does not hang the parsing of the configuration
+// or the renewal of the secrets.
+var secretsTimeout = 30 * time.Second
+
+// errNoSecretsProvider is returned for secret references when no secrets
+// provider is configured.
+var errNoSecretsProvider = errors.New("no secrets provider configured")
+
+// SecretsProvider fetches secrets from an external secret store, such as
+// HashiCorp Vault, so that they need not be written in the configuration.
+//
+// Parameter values reference the field of a secret as ${secret:path#field},
+// replaced by the value of the field, or as ${secretfile:path#field},
+// replaced by the path of a file holding the value of the field. Secret files
+// are kept up to date while the registry runs, for parameters such as an
+// htpasswd file or a certificate bundle which are read again on change, and
+// removed when it stops.
+//
+// The calls to the provider are bounded by a timeout.
+type SecretsProvider interface {
+	// Secret returns the value of a field of the secret at path, and the
+	// duration after which the secret should be fetched again, or zero if
+	// it is not expected to change.
+	Secret(ctx context.Context, path, field string) (string, time.Duration, error)
+
+	// Renew renews the credentials of the provider, and returns the
+	// duration after which they must be renewed again, or zero if they
+	// do not expire. It is called before fetching any secret.
+	Renew(ctx context.Context) (time.Duration, error)
+}
+
+// SecretsProviderFactory creates a secrets provider from its parameters.
+type SecretsProviderFactory func(parameters Parameters) (SecretsProvider, error)
+
+var secretsProviders = make(map[string]SecretsProviderFactory)
+
+// RegisterSecretsProvider makes a secrets provider available by the provided
+// name, to be configured in the secrets section of the configuration.
+// If RegisterSecretsProvider is called twice with the same name or if factory is nil, it
+// panics.
+func RegisterSecretsProvider(name string, factory SecretsProviderFactory) {
+	if factory == nil {
+		panic("Must not provide nil SecretsProviderFactory")
+	}
+	if _, registered := secretsProviders[name]; registered {
+		panic(fmt.Sprintf("SecretsProviderFactory named %s already registered", name))
+	}
+	secretsProviders[name] = factory
+}
+
+// Secrets configures the secrets provider, keyed by provider name.
+type Secrets map[string]Parameters
+
+// Type returns the secrets provider type, such as vault
+func (secrets Secrets) Type() string {
+	for k := range secrets {
+		return k
+	}
+	return ""
+}
+
+// Parameters returns the Parameters map for a Secrets configuration
+func (secrets Secrets) Parameters() Parameters {
+	return secrets[secrets.Type()]
+}
+
+// secretsResolver resolves the secret references of the configuration with
+// the configured provider, and keeps the secret files up to date.
+type secretsResolver struct {
+	provider SecretsProvider
+
+	mu      sync.Mutex
+	renewAt time.Time
+	dir     string
+	files   map[string]*secretFile
+}
+
+// secretFile is a file holding the value of a secret field.
+type secretFile struct {
+	path      string
+	field     string
+	file      string
+	value     string
+	refreshAt time.Time
+}
+
+func newSecretsResolver(secrets Secrets) (*secretsResolver, error) {
+	if len(secrets) != 1 {
+		return nil, fmt.Errorf("secrets: must provide exactly one provider, got %d", len(secrets))
+	}
+	factory, ok := secretsProviders[secrets.Type()]
+	if !ok {
+		return nil, fmt.Errorf("secrets: unknown provider %q", secrets.Type())
+	}
+	provider, err := factory(secrets.Parameters())
+	if err != nil {
+		return nil, fmt.Errorf("secrets.%s: %v", secrets.Type(), err)
+	}
+
+	r := &secretsResolver{provider: provider, files: make(map[string]*secretFile)}
+	ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+	defer cancel()
+	ttl, err := provider.Renew(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("secrets.%s: %v", secrets.Type(), err)
+	}
+	if ttl > 0 {
+		r.renewAt = time.Now().Add(ttl)
+	}
+	return r, nil
+}
+
+// resolve returns the value of a ${secret:path#field} reference, or the path
+// of the file holding the value of a ${secretfile:path#field} reference.
+func (r *secretsResolver) resolve(kind, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("invalid secret reference ${%s:%s}: expected path#field", kind, ref)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+	defer cancel()
+	value, ttl, err := r.provider.Secret(ctx, path, field)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch secret %s: %v", ref, err)
+	}
+	if kind == "secret" {
+		return value, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.files[ref]; ok {
+		return f.file, nil
+	}
+	if r.dir == "" {
+		if r.dir, err = os.MkdirTemp("", "registry-secrets-"); err != nil {
+			return "", fmt.Errorf("unable to create secrets directory: %v", err)
+		}
+	}
+	f := &secretFile{
+		path:  path,
+		field: field,
+		file:  filepath.Join(r.dir, fmt.Sprintf("secret-%d", len(r.files))),
+	}
+	if err := f.write(value); err != nil {
+		return "", err
+	}
+	if ttl > 0 {
+		f.refreshAt = time.Now().Add(ttl)
+	}
+	r.files[ref] = f
+	return f.file, nil
+}
+
+// write atomically replaces the content of the secret file.
+func (f *secretFile) write(value string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.file), ".secret-")
+	if err != nil {
+		return fmt.Errorf("unable to write secret file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(value); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write secret file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write secret file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), f.file); err != nil {
+		return fmt.Errorf("unable to write secret file: %v", err)
+	}
+	f.value = value
+	return nil
+}
+
+// remove removes the secret files.
+func (r *secretsResolver) remove() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(r.dir); err != nil {
+		return fmt.Errorf("unable to remove secrets directory: %v", err)
+	}
+	r.dir = ""
+	r.files = make(map[string]*secretFile)
+	return nil
+}
+
+// RenewSecrets renews the credentials of the secrets provider before they
+// expire, and refreshes the secret files, until ctx is done. Secret values
+// substituted in parameters are fetched once, when the configuration is
+// parsed.
+func (config *Configuration) RenewSecrets(ctx context.Context) {
+	if config.secretsResolver == nil {
+		return
+	}
+	config.secretsResolver.run(ctx)
+}
+
+// RemoveSecrets removes the secret files, once the parameters referencing
+// them are not used anymore.
+func (config *Configuration) RemoveSecrets() error {
+	if config.secretsResolver == nil {
+		return nil
+	}
+	return config.secretsResolver.remove()
+}
+
+func (r *secretsResolver) run(ctx context.Context) {
+	for {
+		next := r.update(ctx, time.Now())
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// update renews the credentials and refreshes the secret files which are
+// due, and returns when it must be called again, or the zero time if
+// nothing expires.
+func (r *secretsResolver) update(ctx context.Context, now time.Time) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	logger := dcontext.GetLogger(ctx)
+
+	var next time.Time
+	schedule := func(t time.Time) {
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	if !r.renewAt.IsZero() && !now.Before(r.renewAt) {
+		renewCtx, cancel := context.WithTimeout(ctx, secretsTimeout)
+		ttl, err := r.provider.Renew(renewCtx)
+		cancel()
+		switch {
+		case err != nil:
+			logger.Errorf("secrets: unable to renew provider credentials: %v", err)
+			r.renewAt = now.Add(secretsRetryInterval)
+		case ttl > 0:
+			r.renewAt = now.Add(ttl)
+		default:
+			r.renewAt = time.Time{}
+		}
+	}
+	schedule(r.renewAt)
+
+	for ref, f := range r.files {
+		if !f.refreshAt.IsZero() && !now.Before(f.refreshAt) {
+			if err := r.refresh(ctx, f, now); err != nil {
+				logger.Errorf("secrets: unable to refresh secret %s: %v", ref, err)
+				f.refreshAt = now.Add(secretsRetryInterval)
+			}
+		}
+		schedule(f.refreshAt)
+	}
+	return next
+}
+
+func (r *secretsResolver) refresh(ctx context.Context, f *secretFile, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, secretsTimeout)
+	defer cancel()
+	value, ttl, err := r.provider.Secret(ctx, f.path, f.field)
+	if err != nil {
+		return err
+	}
+	if value != f.value {
+		if err := f.write(value); err != nil {
+			return err
+		}
+	}
+	f.refreshAt = time.Time{}
+	if ttl > 0 {
+		f.refreshAt = now.Add(ttl)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package configuration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterSecretsProvider("test", func(parameters Parameters) (SecretsProvider, error) {
+		name, _ := parameters["name"].(string)
+		p, ok := testSecretsProviders.Load(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown test secrets provider %q", name)
+		}
+		return p.(*testSecretsProvider), nil
+	})
+}
+
+// testSecretsProviders holds the test secrets providers by test name.
+var testSecretsProviders sync.Map
+
+// testSecretsProvider holds a static secret and a dynamic secret changing on
+// every read, and blocks until ctx is done when hang is set.
+type testSecretsProvider struct {
+	mu          sync.Mutex
+	renewals    int
+	generations int
+	hang        bool
+}
+
+func newTestSecretsProvider(t *testing.T) *testSecretsProvider {
+	p := &testSecretsProvider{}
+	testSecretsProviders.Store(t.Name(), p)
+	t.Cleanup(func() { testSecretsProviders.Delete(t.Name()) })
+	return p
+}
+
+func (p *testSecretsProvider) Renew(ctx context.Context) (time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hang {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	p.renewals++
+	return time.Hour, nil
+}
+
+func (p *testSecretsProvider) Secret(ctx context.Context, path, field string) (string, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case path == "static" && field == "password":
+		return "static-password", 0, nil
+	case path == "dynamic" && field == "password":
+		p.generations++
+		return fmt.Sprintf("generation-%d", p.generations), time.Minute, nil
+	}
+	return "", 0, fmt.Errorf("secret %s has no field %q", path, field)
+}
+
+func TestSecrets(t *testing.T) {
+	p := newTestSecretsProvider(t)
+
+	config, err := Parse(strings.NewReader(fmt.Sprintf(`
+version: 0.1
+expandvariables: true
+storage: inmemory
+redis:
+  addrs: [localhost:6379]
+  password: ${secret:static#password}
+proxy:
+  password: ${secretfile:dynamic#password}
+secrets:
+  test:
+    name: %s
+`, t.Name())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Redis.Options.Password != "static-password" {
+		t.Errorf("unexpected redis password %q", config.Redis.Options.Password)
+	}
+	file := config.Proxy.Password
+	if b, err := os.ReadFile(file); err != nil || string(b) != "generation-1" {
+		t.Errorf("unexpected secret file %q: %v", b, err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("unexpected secret file mode: %v %v", info.Mode(), err)
+	}
+	if p.renewals != 1 {
+		t.Errorf("expected the credentials to be renewed once, got %d", p.renewals)
+	}
+
+	// the credentials are renewed, and leased secrets fetched again,
+	// before they expire
+	next := config.secretsResolver.update(context.Background(), time.Now())
+	if until := time.Until(next); until <= 0 || until > time.Minute {
+		t.Errorf("unexpected next update in %s", until)
+	}
+	config.secretsResolver.update(context.Background(), time.Now().Add(2*time.Hour))
+	if b, err := os.ReadFile(file); err != nil || string(b) != "generation-2" {
+		t.Errorf("expected the secret file to be refreshed, got %q: %v", b, err)
+	}
+	if p.renewals != 2 {
+		t.Errorf("expected the credentials to be renewed again, got %d renewals", p.renewals)
+	}
+
+	if err := config.RemoveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(file)); !os.IsNotExist(err) {
+		t.Errorf("expected the secrets directory to be removed: %v", err)
+	}
+}
+
+func TestSecretReferences(t *testing.T) {
+	for _, in := range []string{
+		"${secret:static#password}",
+		"${secretfile:static#password}",
+	} {
+		if _, err := expandEnv(in, func(string) (string, bool) { return "", false }); err == nil {
+			t.Errorf("expected an error expanding %q without a secrets provider", in)
+		}
+	}
+
+	newTestSecretsProvider(t)
+	config := fmt.Sprintf(`
+version: 0.1
+expandvariables: true
+storage: inmemory
+secrets:
+  test:
+    name: %s
+http:
+  secret: %%s
+`, t.Name())
+	for _, ref := range []string{
+		"${secret:static}",
+		"${secret:#password}",
+		"${secret:static#missing}",
+	} {
+		if _, err := Parse(strings.NewReader(fmt.Sprintf(config, ref))); err == nil {
+			t.Errorf("expected an error parsing %s", ref)
+		}
+	}
+}
+
+func TestSecretsInvalidConfiguration(t *testing.T) {
+	newTestSecretsProvider(t)
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	// the secret files of an invalid configuration are removed
+	_, err := Parse(strings.NewReader(fmt.Sprintf(`
+version: 0.1
+expandvariables: true
+storage:
+  inmemory:
+    password: ${secretfile:dynamic#password}
+secrets:
+  test:
+    name: %s
+redis:
+  password: ${secret:static#missing}
+`, t.Name())))
+	if err == nil {
+		t.Fatal("expected an error referencing a missing secret")
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expected the secret files to be removed, got %v: %v", entries, err)
+	}
+}
+
+func TestSecretsTimeout(t *testing.T) {
+	p := newTestSecretsProvider(t)
+	p.hang = true
+	defer func(timeout time.Duration) { secretsTimeout = timeout }(secretsTimeout)
+	secretsTimeout = 10 * time.Millisecond
+
+	_, err := Parse(strings.NewReader(fmt.Sprintf(`
+version: 0.1
+expandvariables: true
+storage: inmemory
+secrets:
+  test:
+    name: %s
+`, t.Name())))
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("expected the renewal of the credentials to time out, got %v", err)
+	}
+}
@@ -0,0 +1,588 @@
+// Package car reads and writes indexed CARv2 files, the content addressable
+// archives of IPFS, holding blocks identified by their digest.
+//
+// Blocks are stored with raw CIDv1 identifiers, whose multihash is the
+// digest of their content, and the files are indexed with a multihash sorted
+// index, as written by the go-car library, so that blocks can be read
+// without scanning the whole archive.
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// pragma starts CARv2 files: a CARv1 header with version 2.
+	pragma = "\x0a\xa1\x67version\x02"
+
+	// headerSize is the size of the CARv2 header following the pragma.
+	headerSize = 40
+
+	// dataOffset is the offset of the CARv1 payload in the files written.
+	dataOffset = len(pragma) + headerSize
+
+	codecRaw                  = 0x55
+	codecMultihashIndexSorted = 0x0401
+
+	multihashSHA256 = 0x12
+	multihashSHA512 = 0x13
+)
+
+// ErrBlockUnknown is returned when a block is not in the archive.
+var ErrBlockUnknown = errors.New("car: unknown block")
+
+// Writer writes a CARv2 file. The blocks are written as they are put and
+// the index once the writer is closed.
+type Writer struct {
+	w      io.WriteSeeker
+	size   uint64
+	seen   map[digest.Digest]struct{}
+	blocks map[uint64][]indexEntry
+}
+
+type indexEntry struct {
+	digest []byte
+	offset uint64
+}
+
+// NewWriter starts writing a CARv2 file with the given roots to w.
+func NewWriter(w io.WriteSeeker, roots ...digest.Digest) (*Writer, error) {
+	if _, err := w.Write(make([]byte, dataOffset)); err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.Write([]byte{0xa2, 0x65})
+	header.WriteString("roots")
+	writeCBORHead(&header, 4, uint64(len(roots)))
+	for _, root := range roots {
+		cid, err := cidOf(root)
+		if err != nil {
+			return nil, err
+		}
+		// the tag of CIDs, and their bytes prefixed with the identity
+		// multibase
+		header.Write([]byte{0xd8, 0x2a})
+		writeCBORHead(&header, 2, uint64(len(cid)+1))
+		header.WriteByte(0)
+		header.Write(cid)
+	}
+	header.WriteByte(0x67)
+	header.WriteString("version")
+	header.WriteByte(0x01)
+
+	cw := &Writer{
+		w:      w,
+		seen:   make(map[digest.Digest]struct{}),
+		blocks: make(map[uint64][]indexEntry),
+	}
+	if err := cw.write(binary.AppendUvarint(nil, uint64(header.Len())), header.Bytes()); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Put writes the block identified by dgst, of the given size, reading its
+// content from r. The content is not verified against the digest. Blocks
+// already written are skipped.
+func (w *Writer) Put(dgst digest.Digest, size int64, r io.Reader) error {
+	if _, ok := w.seen[dgst]; ok {
+		return nil
+	}
+	cid, err := cidOf(dgst)
+	if err != nil {
+		return err
+	}
+	code, raw, err := multihashOf(dgst)
+	if err != nil {
+		return err
+	}
+
+	w.seen[dgst] = struct{}{}
+	w.blocks[code] = append(w.blocks[code], indexEntry{digest: raw, offset: w.size})
+	if err := w.write(binary.AppendUvarint(nil, uint64(len(cid))+uint64(size)), cid); err != nil {
+		return err
+	}
+	n, err := io.CopyN(w.w, r, size)
+	w.size += uint64(n)
+	if err == io.EOF {
+		return fmt.Errorf("car: content of %s shorter than %d bytes", dgst, size)
+	}
+	return err
+}
+
+// Close writes the index and the header of the file. It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	var index bytes.Buffer
+	index.Write(binary.AppendUvarint(nil, codecMultihashIndexSorted))
+	codes := make([]uint64, 0, len(w.blocks))
+	for code := range w.blocks {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	writeUint32(&index, uint32(len(codes)))
+	for _, code := range codes {
+		entries := w.blocks[code]
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].digest, entries[j].digest) < 0 })
+		width := len(entries[0].digest) + 8
+
+		index.Write(binary.LittleEndian.AppendUint64(nil, code))
+		// a single bucket of digests, since they all have the same width
+		writeUint32(&index, 1)
+		writeUint32(&index, uint32(width))
+		index.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(entries)*width)))
+		for _, e := range entries {
+			index.Write(e.digest)
+			index.Write(binary.LittleEndian.AppendUint64(nil, e.offset))
+		}
+	}
+	if _, err := w.w.Write(index.Bytes()); err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, dataOffset)
+	header = append(header, pragma...)
+	header = append(header, make([]byte, 16)...) // characteristics
+	header = binary.LittleEndian.AppendUint64(header, uint64(dataOffset))
+	header = binary.LittleEndian.AppendUint64(header, w.size)
+	header = binary.LittleEndian.AppendUint64(header, uint64(dataOffset)+w.size)
+	if _, err := w.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.w.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (w *Writer) write(chunks ...[]byte) error {
+	for _, p := range chunks {
+		n, err := w.w.Write(p)
+		w.size += uint64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader reads the blocks of a CARv2 file.
+type Reader struct {
+	r      io.ReaderAt
+	data   int64
+	roots  []digest.Digest
+	blocks map[digest.Digest]int64
+}
+
+// NewReader reads the header and the index of the CARv2 file read from r.
+// Files without an index, or with an index of another kind, are scanned
+// instead.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	header := make([]byte, dataOffset)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("car: reading header: %w", err)
+	}
+	if string(header[:len(pragma)]) != pragma {
+		return nil, errors.New("car: not a CARv2 file")
+	}
+	header = header[len(pragma)+16:]
+	payloadOffset := binary.LittleEndian.Uint64(header)
+	dataSize := binary.LittleEndian.Uint64(header[8:])
+	indexOffset := binary.LittleEndian.Uint64(header[16:])
+
+	cr := &Reader{
+		r:      r,
+		data:   int64(payloadOffset),
+		blocks: make(map[digest.Digest]int64),
+	}
+	data := bufio.NewReader(io.NewSectionReader(r, cr.data, int64(dataSize)))
+	length, err := binary.ReadUvarint(data)
+	if err != nil {
+		return nil, fmt.Errorf("car: reading data header: %w", err)
+	}
+	payloadHeader := make([]byte, length)
+	if _, err := io.ReadFull(data, payloadHeader); err != nil {
+		return nil, fmt.Errorf("car: reading data header: %w", err)
+	}
+	if cr.roots, err = parseRoots(payloadHeader); err != nil {
+		return nil, err
+	}
+
+	if indexOffset != 0 {
+		indexed, err := cr.readIndex(bufio.NewReader(io.NewSectionReader(r, int64(indexOffset), 1<<62)))
+		if err != nil {
+			return nil, err
+		}
+		if indexed {
+			return cr, nil
+		}
+	}
+	if err := cr.scan(data, int64(uvarintSize(length))+int64(length)); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Roots returns the roots of the file.
+func (r *Reader) Roots() []digest.Digest {
+	return r.roots
+}
+
+// Open returns a reader of the content of the block identified by dgst,
+// and its size.
+func (r *Reader) Open(dgst digest.Digest) (io.Reader, int64, error) {
+	offset, ok := r.blocks[dgst]
+	if !ok {
+		return nil, 0, ErrBlockUnknown
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(r.r, r.data+offset, 1<<62))
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, fmt.Errorf("car: reading block %s: %w", dgst, err)
+	}
+	cid, cidSize, err := readCID(br)
+	if err != nil {
+		return nil, 0, fmt.Errorf("car: reading block %s: %w", dgst, err)
+	}
+	if cid != dgst {
+		return nil, 0, fmt.Errorf("car: index points to %s instead of %s", cid, dgst)
+	}
+	start := r.data + offset + int64(uvarintSize(length)+cidSize)
+	size := int64(length) - int64(cidSize)
+	return io.NewSectionReader(r.r, start, size), size, nil
+}
+
+// readIndex reads a multihash sorted index, returning false if the index
+// is of another kind.
+func (r *Reader) readIndex(br *bufio.Reader) (bool, error) {
+	codec, err := binary.ReadUvarint(br)
+	if err != nil {
+		return false, fmt.Errorf("car: reading index: %w", err)
+	}
+	if codec != codecMultihashIndexSorted {
+		return false, nil
+	}
+
+	var codes uint32
+	if err := binary.Read(br, binary.LittleEndian, &codes); err != nil {
+		return false, fmt.Errorf("car: reading index: %w", err)
+	}
+	for ; codes > 0; codes-- {
+		var code uint64
+		var buckets uint32
+		if err := binary.Read(br, binary.LittleEndian, &code); err != nil {
+			return false, fmt.Errorf("car: reading index: %w", err)
+		}
+		if err := binary.Read(br, binary.LittleEndian, &buckets); err != nil {
+			return false, fmt.Errorf("car: reading index: %w", err)
+		}
+		for ; buckets > 0; buckets-- {
+			var width uint32
+			var size uint64
+			if err := binary.Read(br, binary.LittleEndian, &width); err != nil {
+				return false, fmt.Errorf("car: reading index: %w", err)
+			}
+			if err := binary.Read(br, binary.LittleEndian, &size); err != nil {
+				return false, fmt.Errorf("car: reading index: %w", err)
+			}
+			if width <= 8 || size%uint64(width) != 0 {
+				return false, errors.New("car: invalid index")
+			}
+			entry := make([]byte, width)
+			for i := uint64(0); i < size/uint64(width); i++ {
+				if _, err := io.ReadFull(br, entry); err != nil {
+					return false, fmt.Errorf("car: reading index: %w", err)
+				}
+				dgst, ok := digestOf(code, entry[:width-8])
+				if !ok {
+					// blocks hashed with other functions cannot be
+					// retrieved by digest
+					continue
+				}
+				r.blocks[dgst] = int64(binary.LittleEndian.Uint64(entry[width-8:]))
+			}
+		}
+	}
+	return true, nil
+}
+
+// scan indexes the blocks of the data payload, read from br at offset.
+func (r *Reader) scan(br *bufio.Reader, offset int64) error {
+	for {
+		length, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("car: scanning blocks: %w", err)
+		}
+		dgst, cidSize, err := readCID(br)
+		if err != nil && !errors.Is(err, errUnsupportedCID) {
+			return fmt.Errorf("car: scanning blocks: %w", err)
+		}
+		if err == nil {
+			r.blocks[dgst] = offset
+		}
+		if _, err := br.Discard(int(length) - cidSize); err != nil {
+			return fmt.Errorf("car: scanning blocks: %w", err)
+		}
+		offset += int64(uvarintSize(length)) + int64(length)
+	}
+}
+
+var errUnsupportedCID = errors.New("unsupported CID")
+
+// readCID reads a CID, returning the digest of its multihash and its size.
+func readCID(br *bufio.Reader) (digest.Digest, int, error) {
+	var fields []uint64
+	size := 0
+	prefix, err := br.Peek(2)
+	if err != nil {
+		return "", 0, err
+	}
+	// CIDv0 are bare SHA-256 multihashes
+	v0 := prefix[0] == multihashSHA256 && prefix[1] == 32
+	n := 4
+	if v0 {
+		n = 2
+	}
+	for i := 0; i < n; i++ {
+		v, err := binary.ReadUvarint(br)
+		if err != nil {
+			return "", 0, err
+		}
+		fields = append(fields, v)
+		size += uvarintSize(v)
+	}
+	if !v0 && fields[0] != 1 {
+		return "", 0, fmt.Errorf("unsupported CID version %d", fields[0])
+	}
+	code, length := fields[n-2], fields[n-1]
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(br, raw); err != nil {
+		return "", 0, err
+	}
+	size += int(length)
+	dgst, ok := digestOf(code, raw)
+	if !ok {
+		return "", size, errUnsupportedCID
+	}
+	return dgst, size, nil
+}
+
+// parseRoots parses the DAG-CBOR header of the CARv1 payload.
+func parseRoots(header []byte) ([]digest.Digest, error) {
+	d := &cborDecoder{r: bytes.NewReader(header)}
+	major, n, err := d.head()
+	if err != nil || major != 5 {
+		return nil, errors.New("car: invalid data header")
+	}
+
+	var roots []digest.Digest
+	for ; n > 0; n-- {
+		key, err := d.text()
+		if err != nil {
+			return nil, errors.New("car: invalid data header")
+		}
+		switch key {
+		case "roots":
+			major, count, err := d.head()
+			if err != nil || major != 4 {
+				return nil, errors.New("car: invalid roots")
+			}
+			for ; count > 0; count-- {
+				cid, err := d.cid()
+				if err != nil {
+					return nil, errors.New("car: invalid roots")
+				}
+				dgst, _, err := readCID(bufio.NewReader(bytes.NewReader(cid)))
+				if err != nil {
+					return nil, fmt.Errorf("car: invalid root: %w", err)
+				}
+				roots = append(roots, dgst)
+			}
+		case "version":
+			major, version, err := d.head()
+			if err != nil || major != 0 || version != 1 {
+				return nil, errors.New("car: unsupported data version")
+			}
+		default:
+			if err := d.skip(); err != nil {
+				return nil, errors.New("car: invalid data header")
+			}
+		}
+	}
+	return roots, nil
+}
+
+// cidOf returns the raw CIDv1 of the block identified by dgst.
+func cidOf(dgst digest.Digest) ([]byte, error) {
+	code, raw, err := multihashOf(dgst)
+	if err != nil {
+		return nil, err
+	}
+	cid := binary.AppendUvarint(nil, 1)
+	cid = binary.AppendUvarint(cid, codecRaw)
+	cid = binary.AppendUvarint(cid, code)
+	cid = binary.AppendUvarint(cid, uint64(len(raw)))
+	return append(cid, raw...), nil
+}
+
+func multihashOf(dgst digest.Digest) (uint64, []byte, error) {
+	if err := dgst.Validate(); err != nil {
+		return 0, nil, err
+	}
+	var code uint64
+	switch dgst.Algorithm() {
+	case digest.SHA256:
+		code = multihashSHA256
+	case digest.SHA512:
+		code = multihashSHA512
+	default:
+		return 0, nil, fmt.Errorf("car: unsupported digest algorithm %s", dgst.Algorithm())
+	}
+	raw, err := hex.DecodeString(dgst.Encoded())
+	return code, raw, err
+}
+
+func digestOf(code uint64, raw []byte) (digest.Digest, bool) {
+	var algorithm digest.Algorithm
+	switch {
+	case code == multihashSHA256 && len(raw) == 32:
+		algorithm = digest.SHA256
+	case code == multihashSHA512 && len(raw) == 64:
+		algorithm = digest.SHA512
+	default:
+		return "", false
+	}
+	return digest.NewDigestFromEncoded(algorithm, hex.EncodeToString(raw)), true
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= 0xff:
+		buf.Write([]byte{major<<5 | 24, byte(n)})
+	case n <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= 0xffffffff:
+		buf.WriteByte(major<<5 | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func writeUint32(buf *bytes.Buffer, n uint32) {
+	buf.Write(binary.LittleEndian.AppendUint32(nil, n))
+}
+
+func uvarintSize(n uint64) int {
+	return len(binary.AppendUvarint(nil, n))
+}
+
+// cborDecoder decodes the subset of CBOR used by CAR headers.
+type cborDecoder struct {
+	r *bytes.Reader
+}
+
+func (d *cborDecoder) head() (byte, uint64, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if info > 27 {
+		return 0, 0, errors.New("unsupported CBOR item")
+	}
+	p := make([]byte, 1<<(info-24))
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		return 0, 0, err
+	}
+	var n uint64
+	for _, b := range p {
+		n = n<<8 | uint64(b)
+	}
+	return major, n, nil
+}
+
+func (d *cborDecoder) bytes(major byte) ([]byte, error) {
+	m, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if m != major || n > uint64(d.r.Len()) {
+		return nil, errors.New("unexpected CBOR item")
+	}
+	p := make([]byte, n)
+	_, err = io.ReadFull(d.r, p)
+	return p, err
+}
+
+func (d *cborDecoder) text() (string, error) {
+	p, err := d.bytes(3)
+	return string(p), err
+}
+
+func (d *cborDecoder) cid() ([]byte, error) {
+	major, tag, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != 6 || tag != 42 {
+		return nil, errors.New("unexpected CBOR item")
+	}
+	p, err := d.bytes(2)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 || p[0] != 0 {
+		return nil, errors.New("invalid CID multibase")
+	}
+	return p[1:], nil
+}
+
+func (d *cborDecoder) skip() error {
+	major, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case 2, 3:
+		if n > uint64(d.r.Len()) {
+			return io.ErrUnexpectedEOF
+		}
+		_, err = d.r.Seek(int64(n), io.SeekCurrent)
+		return err
+	case 4, 5:
+		if major == 5 {
+			n *= 2
+		}
+		for ; n > 0; n-- {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	case 6:
+		return d.skip()
+	}
+	return nil
+}
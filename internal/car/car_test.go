@@ -0,0 +1,127 @@
+package car
+
+import (
+	"bytes"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func writeTestFile(t *testing.T, blocks map[digest.Digest][]byte, roots ...digest.Digest) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	w, err := NewWriter(f, roots...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dgst, content := range blocks {
+		if err := w.Put(dgst, int64(len(content)), bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		// blocks are only written once
+		if err := w.Put(dgst, int64(len(content)), bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func testBlocks() map[digest.Digest][]byte {
+	blocks := make(map[digest.Digest][]byte)
+	for _, content := range []string{"root", "first block", "second block", ""} {
+		blocks[digest.FromString(content)] = []byte(content)
+	}
+	sha512 := []byte("sha512 block")
+	blocks[digest.SHA512.FromBytes(sha512)] = sha512
+	return blocks
+}
+
+func checkBlocks(t *testing.T, r *Reader, blocks map[digest.Digest][]byte) {
+	t.Helper()
+	for dgst, expected := range blocks {
+		content, size, err := r.Open(dgst)
+		if err != nil {
+			t.Fatalf("unexpected error opening %s: %v", dgst, err)
+		}
+		if size != int64(len(expected)) {
+			t.Errorf("unexpected size of %s: %d != %d", dgst, size, len(expected))
+		}
+		p, err := io.ReadAll(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, expected) {
+			t.Errorf("unexpected content of %s: %q != %q", dgst, p, expected)
+		}
+	}
+	if _, _, err := r.Open(digest.FromString("unknown")); !errors.Is(err, ErrBlockUnknown) {
+		t.Errorf("expected ErrBlockUnknown, got %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	blocks := testBlocks()
+	root := digest.FromString("root")
+	f := writeTestFile(t, blocks, root)
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roots := r.Roots(); len(roots) != 1 || roots[0] != root {
+		t.Fatalf("unexpected roots: %v", roots)
+	}
+	checkBlocks(t, r, blocks)
+}
+
+func TestReadWithoutIndex(t *testing.T) {
+	blocks := testBlocks()
+	f := writeTestFile(t, blocks, digest.FromString("root"))
+
+	// clear the index offset, so that the blocks are scanned
+	if _, err := f.WriteAt(binary.LittleEndian.AppendUint64(nil, 0), int64(len(pragma)+32)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(t, r, blocks)
+}
+
+func TestHeader(t *testing.T) {
+	f := writeTestFile(t, nil, digest.FromString("root"))
+	p := make([]byte, dataOffset+3)
+	if _, err := f.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pragma, characteristics and data offset of CARv2 files
+	expected := append([]byte{0x0a, 0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02}, make([]byte, 16)...)
+	expected = append(expected, 51, 0, 0, 0, 0, 0, 0, 0)
+	if !bytes.Equal(p[:len(expected)], expected) {
+		t.Errorf("unexpected header: %x", p[:len(expected)])
+	}
+	// the CARv1 header, a DAG-CBOR map of the roots and version
+	if !bytes.Equal(p[dataOffset+1:], []byte{0xa2, 0x65}) {
+		t.Errorf("unexpected data header: %x", p[dataOffset+1:])
+	}
+
+	if _, err := NewReader(bytes.NewReader(make([]byte, 100))); err == nil {
+		t.Error("expected an error reading a file which is not a CARv2 file")
+	}
+}
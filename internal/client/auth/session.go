@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -129,14 +130,20 @@ type tokenHandler struct {
 	forceOAuth    bool
 	clientID      string
 	scopes        []Scope
+	refreshBefore time.Duration
 
-	tokenLock       sync.Mutex
-	tokenCache      string
-	tokenExpiration time.Time
+	tokenLock  sync.Mutex
+	tokenCache map[string]cachedToken
 
 	logger Logger
 }
 
+// cachedToken is a token cached for a set of scopes.
+type cachedToken struct {
+	token      string
+	expiration time.Time
+}
+
 // Scope is a type which is serializable to a string
 // using the allow scope grammar.
 type Scope interface {
@@ -198,6 +205,11 @@ type TokenHandlerOptions struct {
 	ClientID      string
 	Scopes        []Scope
 	Logger        Logger
+
+	// RefreshBefore is how long before their expiration tokens are
+	// refreshed. While the refresh fails, the cached token is used until it
+	// expires. Tokens are only refreshed once expired when it is zero.
+	RefreshBefore time.Duration
 }
 
 // An implementation of clock for providing real time data.
@@ -232,6 +244,8 @@ func NewTokenHandlerWithOptions(options TokenHandlerOptions) AuthenticationHandl
 		forceOAuth:    options.ForceOAuth,
 		clientID:      options.ClientID,
 		scopes:        options.Scopes,
+		refreshBefore: options.RefreshBefore,
+		tokenCache:    make(map[string]cachedToken),
 		clock:         realClock{},
 		logger:        options.Logger,
 	}
@@ -276,32 +290,43 @@ func (th *tokenHandler) getToken(ctx context.Context, params map[string]string,
 	for _, scope := range th.scopes {
 		scopes = append(scopes, scope.String())
 	}
-	var addedScopes bool
 	for _, scope := range additionalScopes {
 		if hasScope(scopes, scope) {
 			continue
 		}
 		scopes = append(scopes, scope)
-		addedScopes = true
 	}
 
+	// tokens are cached per challenge and set of scopes
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	key := params["realm"] + " " + params["service"] + " " + strings.Join(sorted, " ")
+
 	now := th.clock.Now()
-	if now.After(th.tokenExpiration) || addedScopes {
-		token, expiration, err := th.fetchToken(ctx, params, scopes)
-		if err != nil {
-			return "", err
-		}
+	cached, ok := th.tokenCache[key]
+	if ok && now.Before(cached.expiration.Add(-th.refreshBefore)) {
+		return cached.token, nil
+	}
 
-		// do not update cache for added scope tokens
-		if !addedScopes {
-			th.tokenCache = token
-			th.tokenExpiration = expiration
+	token, expiration, err := th.fetchToken(ctx, params, scopes)
+	if err != nil {
+		if ok && now.Before(cached.expiration) {
+			// the token is refreshed ahead of its expiration, keep using
+			// it until then
+			logDebugf(th.logger, "Unable to refresh token, using the cached token: %v", err)
+			return cached.token, nil
 		}
+		return "", err
+	}
 
-		return token, nil
+	for k, t := range th.tokenCache {
+		if now.After(t.expiration) {
+			delete(th.tokenCache, k)
+		}
 	}
+	th.tokenCache[key] = cachedToken{token: token, expiration: expiration}
 
-	return th.tokenCache, nil
+	return token, nil
 }
 
 func hasScope(scopes []string, scope string) bool {
@@ -503,12 +528,29 @@ func (th *tokenHandler) fetchToken(ctx context.Context, params map[string]string
 	}
 
 	if refreshToken != "" || th.forceOAuth {
-		return th.fetchTokenWithOAuth(ctx, realmURL, refreshToken, service, scopes)
+		token, expiration, err = th.fetchTokenWithOAuth(ctx, realmURL, refreshToken, service, scopes)
+		if err != nil && refreshToken != "" && th.hasBasicCredentials(realmURL) {
+			// the refresh token may have expired or been revoked, fall back
+			// to the password grant to obtain a new one
+			logDebugf(th.logger, "Refresh token rejected, falling back to password grant: %v", err)
+			return th.fetchTokenWithOAuth(ctx, realmURL, "", service, scopes)
+		}
+		return token, expiration, err
 	}
 
 	return th.fetchTokenWithBasicAuth(ctx, realmURL, service, scopes)
 }
 
+// hasBasicCredentials returns whether a username and password are available
+// for the realm.
+func (th *tokenHandler) hasBasicCredentials(realm *url.URL) bool {
+	if th.creds == nil {
+		return false
+	}
+	username, password := th.creds.Basic(realm)
+	return username != "" && password != ""
+}
+
 type basicHandler struct {
 	creds CredentialStore
 }
@@ -1,11 +1,14 @@
 package auth
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -875,3 +878,108 @@ func TestEndpointAuthorizeBasic(t *testing.T) {
 		t.Fatalf("Unexpected status code: %d, expected %d", resp.StatusCode, http.StatusAccepted)
 	}
 }
+
+// oauthTokenServer serves OAuth2 token requests, rejecting the refresh
+// tokens not issued by it and counting the grants by type.
+type oauthTokenServer struct {
+	mu      sync.Mutex
+	grants  map[string]int
+	fail    bool
+	refresh string
+}
+
+func (s *oauthTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := r.ParseForm(); err != nil || s.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	grantType := r.PostForm.Get("grant_type")
+	switch grantType {
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != s.refresh {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+	case "password":
+		if r.PostForm.Get("username") != "user" || r.PostForm.Get("password") != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	s.grants[grantType]++
+	s.refresh = fmt.Sprintf("refresh-%d", s.grants["password"])
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"access_token":"token-%s-%d","refresh_token":%q,"expires_in":300}`, strings.ReplaceAll(r.PostForm.Get("scope"), " ", "+"), s.grants[grantType], s.refresh)
+}
+
+func TestTokenHandlerCacheAndRefresh(t *testing.T) {
+	server := &oauthTokenServer{grants: make(map[string]int)}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	creds := &testCredentialStore{username: "user", password: "pass", refreshTokens: make(map[string]string)}
+	clock := &fakeClock{current: time.Now()}
+	th := NewTokenHandlerWithOptions(TokenHandlerOptions{
+		Credentials:   creds,
+		ForceOAuth:    true,
+		Scopes:        []Scope{RepositoryScope{Repository: "app", Actions: []string{"pull"}}},
+		RefreshBefore: time.Minute,
+	}).(*tokenHandler)
+	th.clock = clock
+	params := map[string]string{"realm": ts.URL, "service": "registry"}
+
+	getToken := func(additionalScopes ...string) string {
+		t.Helper()
+		token, err := th.getToken(context.Background(), params, additionalScopes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// tokens are cached per set of scopes
+	token := getToken()
+	mountToken := getToken("repository:base:pull")
+	if token == mountToken {
+		t.Fatal("expected a different token for additional scopes")
+	}
+	if getToken() != token || getToken("repository:base:pull") != mountToken {
+		t.Fatal("expected the tokens to be cached")
+	}
+	if server.grants["password"] != 1 || server.grants["refresh_token"] != 1 {
+		t.Fatalf("unexpected grants: %v", server.grants)
+	}
+
+	// tokens are refreshed ahead of their expiration
+	clock.current = clock.current.Add(4*time.Minute + time.Second)
+	refreshed := getToken()
+	if refreshed == token || server.grants["refresh_token"] != 2 {
+		t.Fatalf("expected the token to be refreshed ahead of its expiration, grants: %v", server.grants)
+	}
+
+	// the cached token is used while the token server fails, until it expires
+	server.mu.Lock()
+	server.fail = true
+	server.mu.Unlock()
+	clock.current = clock.current.Add(4*time.Minute + time.Second)
+	if getToken() != refreshed {
+		t.Fatal("expected the cached token to be used while the refresh fails")
+	}
+	clock.current = clock.current.Add(time.Minute)
+	if _, err := th.getToken(context.Background(), params); err == nil {
+		t.Fatal("expected an error once the token expired")
+	}
+	server.mu.Lock()
+	server.fail = false
+	server.mu.Unlock()
+
+	// a rejected refresh token falls back to the password grant
+	creds.refreshTokens["registry"] = "revoked"
+	getToken()
+	if server.grants["password"] != 2 || creds.refreshTokens["registry"] != "refresh-2" {
+		t.Fatalf("expected a password grant after the refresh token was rejected, grants: %v", server.grants)
+	}
+}
@@ -3,6 +3,7 @@ package dcontext
 import (
 	"context"
 	"errors"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
@@ -40,6 +41,16 @@ func WithRequest(ctx context.Context, r *http.Request) context.Context {
 	}
 }
 
+// GetRequest returns the http request in the given context. Returns
+// ErrNoRequestContext if the context does not have an http request associated
+// with it.
+func GetRequest(ctx context.Context) (*http.Request, error) {
+	if r, ok := ctx.Value("http.request").(*http.Request); r != nil && ok {
+		return r, nil
+	}
+	return nil, ErrNoRequestContext
+}
+
 // GetRequestID attempts to resolve the current request id, if possible. An
 // error is return if it is not available on the context.
 func GetRequestID(ctx context.Context) string {
@@ -216,6 +227,28 @@ func (irw *instrumentedResponseWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// ReadFrom copies src to the response with the ReadFrom method of the parent
+// ResponseWriter if implemented, which sends files with sendfile.
+func (irw *instrumentedResponseWriter) ReadFrom(src io.Reader) (n int64, err error) {
+	if rf, ok := irw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(irw.ResponseWriter, src)
+	}
+
+	irw.mu.Lock()
+	irw.written += n
+
+	// Guess the likely status if not set.
+	if irw.status == 0 {
+		irw.status = http.StatusOK
+	}
+
+	irw.mu.Unlock()
+
+	return
+}
+
 func (irw *instrumentedResponseWriter) WriteHeader(status int) {
 	irw.ResponseWriter.WriteHeader(status)
 
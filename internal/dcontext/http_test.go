@@ -1,6 +1,8 @@
 package dcontext
 
 import (
+	"bytes"
+	"io"
 	"net/http"
 	"reflect"
 	"testing"
@@ -160,6 +162,17 @@ func TestWithResponseWriter(t *testing.T) {
 		t.Fatalf("unexpected number reported bytes written: %v != %v", ctx.Value("http.response.written"), 1024)
 	}
 
+	// Make sure the bytes copied with ReadFrom are counted
+	if n, err := rw.(io.ReaderFrom).ReadFrom(bytes.NewReader(make([]byte, 512))); err != nil {
+		t.Fatalf("unexpected error copying: %v", err)
+	} else if n != 512 {
+		t.Fatalf("unexpected number of bytes copied: %v != %v", n, 512)
+	}
+
+	if ctx.Value("http.response.written") != int64(1536) {
+		t.Fatalf("unexpected number reported bytes written: %v != %v", ctx.Value("http.response.written"), 1536)
+	}
+
 	// Make sure flush propagates
 	rw.(http.Flusher).Flush()
 
@@ -0,0 +1,166 @@
+// Package delta reads and writes the deltas of blobs: the instructions
+// rebuilding a blob, the target, from the content of another blob, the base,
+// by copying the ranges they share and inserting the rest.
+//
+// A delta starts with a magic string, followed by a sequence of operations,
+// each made of an opcode byte and unsigned varints:
+//
+//	'c' <offset> <length>    copies length bytes of the base at offset
+//	'i' <length> <data>      inserts the length bytes of data following
+package delta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MediaType is the media type of the deltas.
+const MediaType = "application/vnd.distribution.delta.v1"
+
+// magic starts every delta.
+const magic = "\x00delta1\n"
+
+const (
+	opCopy   = 'c'
+	opInsert = 'i'
+)
+
+// ErrInvalid is returned when applying a malformed delta, or a delta to a
+// base it does not fit.
+var ErrInvalid = errors.New("invalid delta")
+
+// Writer writes a delta.
+type Writer struct {
+	w       *bufio.Writer
+	started bool
+	buf     [binary.MaxVarintLen64]byte
+}
+
+// NewWriter returns a writer writing a delta to w. The delta is complete
+// once the writer is flushed.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Copy appends the copy of length bytes of the base at offset.
+func (dw *Writer) Copy(offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid copy of %d bytes at %d", length, offset)
+	}
+	return dw.op(opCopy, uint64(offset), uint64(length))
+}
+
+// Insert appends the insertion of p.
+func (dw *Writer) Insert(p []byte) error {
+	if err := dw.op(opInsert, uint64(len(p))); err != nil {
+		return err
+	}
+	_, err := dw.w.Write(p)
+	return err
+}
+
+func (dw *Writer) op(code byte, args ...uint64) error {
+	if !dw.started {
+		if _, err := dw.w.WriteString(magic); err != nil {
+			return err
+		}
+		dw.started = true
+	}
+	if err := dw.w.WriteByte(code); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		n := binary.PutUvarint(dw.buf[:], arg)
+		if _, err := dw.w.Write(dw.buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes the buffered operations to the underlying writer.
+func (dw *Writer) Flush() error {
+	if !dw.started {
+		if _, err := dw.w.WriteString(magic); err != nil {
+			return err
+		}
+		dw.started = true
+	}
+	return dw.w.Flush()
+}
+
+// Apply writes to w the target rebuilt by the delta read from r out of base,
+// returning the number of bytes written.
+func Apply(w io.Writer, base io.ReaderAt, r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != magic {
+		return 0, fmt.Errorf("%w: missing header", ErrInvalid)
+	}
+
+	var written int64
+	for {
+		code, err := br.ReadByte()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+
+		switch code {
+		case opCopy:
+			offset, err := readLength(br)
+			if err != nil {
+				return written, err
+			}
+			length, err := readLength(br)
+			if err != nil {
+				return written, err
+			}
+			n, err := io.Copy(w, io.NewSectionReader(base, offset, length))
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if n != length {
+				return written, fmt.Errorf("%w: copy of %d bytes at %d beyond the base", ErrInvalid, length, offset)
+			}
+		case opInsert:
+			length, err := readLength(br)
+			if err != nil {
+				return written, err
+			}
+			n, err := io.CopyN(w, br, length)
+			written += n
+			if err == io.EOF {
+				return written, fmt.Errorf("%w: truncated insertion", ErrInvalid)
+			}
+			if err != nil {
+				return written, err
+			}
+		default:
+			return written, fmt.Errorf("%w: unknown operation %q", ErrInvalid, code)
+		}
+	}
+}
+
+// readLength reads a varint argument of an operation, which must fit in an
+// int64.
+func readLength(br *bufio.Reader) (int64, error) {
+	v, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("%w: truncated operation", ErrInvalid)
+		}
+		return 0, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if v > 1<<63-1 {
+		return 0, fmt.Errorf("%w: argument out of range", ErrInvalid)
+	}
+	return int64(v), nil
+}
@@ -0,0 +1,81 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	base := []byte("the quick brown fox jumps over the lazy dog")
+
+	var buf bytes.Buffer
+	dw := NewWriter(&buf)
+	if err := dw.Copy(0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Insert([]byte("red")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Copy(15, 28); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var target bytes.Buffer
+	n, err := Apply(&target, bytes.NewReader(base), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "the quick red fox jumps over the lazy dog"; target.String() != expected || n != int64(len(expected)) {
+		t.Fatalf("unexpected target %q (%d bytes)", target.String(), n)
+	}
+
+	// an empty delta rebuilds an empty target
+	buf.Reset()
+	if err := NewWriter(&buf).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Apply(&target, bytes.NewReader(base), &buf); n != 0 || err != nil {
+		t.Fatalf("unexpected empty delta: %d, %v", n, err)
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	base := []byte("base")
+
+	for _, tc := range []struct {
+		name  string
+		delta func(dw *Writer) error
+		raw   string
+	}{
+		{name: "no header", raw: "c\x00\x01"},
+		{name: "unknown operation", raw: magic + "x"},
+		{name: "truncated operation", raw: magic + "c\x00"},
+		{name: "truncated insertion", raw: magic + "i\x05abc"},
+		{
+			name: "copy beyond the base",
+			delta: func(dw *Writer) error {
+				return dw.Copy(2, 10)
+			},
+		},
+	} {
+		raw := []byte(tc.raw)
+		if tc.delta != nil {
+			var buf bytes.Buffer
+			dw := NewWriter(&buf)
+			if err := tc.delta(dw); err != nil {
+				t.Fatal(err)
+			}
+			if err := dw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			raw = buf.Bytes()
+		}
+		if _, err := Apply(&bytes.Buffer{}, bytes.NewReader(base), bytes.NewReader(raw)); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected an invalid delta, got %v", tc.name, err)
+		}
+	}
+}
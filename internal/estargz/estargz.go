@@ -0,0 +1,371 @@
+// Package estargz writes eStargz layers: gzip compressed tar archives whose
+// files are compressed in separate gzip members, indexed by a table of
+// contents stored at the end of the layer, so that container runtimes can
+// lazily fetch the files they need with range requests.
+//
+// The layers remain valid gzip compressed tar archives, readable by any
+// client. The format is the one of the stargz-snapshotter project.
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// TOCTarName is the name of the tar entry holding the table of contents.
+	TOCTarName = "stargz.index.json"
+
+	// TOCDigestAnnotation is the annotation of the layer descriptors holding
+	// the digest of their table of contents.
+	TOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// UncompressedSizeAnnotation is the annotation of the layer descriptors
+	// holding the size of their uncompressed content.
+	UncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+
+	// DefaultChunkSize is the size of the chunks large files are split into.
+	DefaultChunkSize = 4 << 20
+
+	// FooterSize is the size of the footer ending the layers.
+	FooterSize = 51
+
+	// noPrefetchLandmark is the entry telling runtimes that no file is to be
+	// prefetched.
+	noPrefetchLandmark = ".no.prefetch.landmark"
+	landmarkContents   = 0xf
+)
+
+// TOC is the table of contents of a layer.
+type TOC struct {
+	Version int         `json:"version"`
+	Entries []*TOCEntry `json:"entries"`
+}
+
+// TOCEntry is an entry of the table of contents: a tar entry, or a chunk of
+// the content of a regular file after the first one.
+type TOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+// Result describes a layer written by Convert.
+type Result struct {
+	// TOCDigest is the digest of the table of contents.
+	TOCDigest digest.Digest
+	// DiffID is the digest of the uncompressed content of the layer.
+	DiffID digest.Digest
+	// UncompressedSize is the size of the uncompressed content.
+	UncompressedSize int64
+}
+
+// Convert writes to w the eStargz layer holding the entries of the tar
+// archive read from r, splitting the regular files into chunks of at most
+// chunkSize bytes.
+func Convert(w io.Writer, r io.Reader, chunkSize int64) (Result, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	cw := &countingWriter{w: w}
+	diffID := digest.Canonical.Digester()
+	sw := &stargzWriter{
+		cw:        cw,
+		diff:      &countingWriter{w: diffID.Hash()},
+		chunkSize: chunkSize,
+		toc:       TOC{Version: 1},
+	}
+
+	landmark := tar.NewReader(landmarkArchive())
+	if err := sw.appendTar(landmark); err != nil {
+		return Result{}, err
+	}
+	if err := sw.appendTar(tar.NewReader(r)); err != nil {
+		return Result{}, err
+	}
+
+	tocJSON, err := json.MarshalIndent(sw.toc, "", "\t")
+	if err != nil {
+		return Result{}, err
+	}
+	if err := sw.closeGz(); err != nil {
+		return Result{}, err
+	}
+	tocOffset := cw.n
+	sw.condOpenGz()
+	tw := tar.NewWriter(sw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     TOCTarName,
+		Mode:     0o444,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return Result{}, err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return Result{}, err
+	}
+	if err := tw.Close(); err != nil {
+		return Result{}, err
+	}
+	if err := sw.closeGz(); err != nil {
+		return Result{}, err
+	}
+
+	if _, err := cw.Write(footer(tocOffset)); err != nil {
+		return Result{}, err
+	}
+	return Result{
+		TOCDigest:        digest.FromBytes(tocJSON),
+		DiffID:           diffID.Digest(),
+		UncompressedSize: sw.diff.n,
+	}, nil
+}
+
+// stargzWriter writes the tar entries of a layer to the current gzip member,
+// opening a new member for every chunk of regular files.
+type stargzWriter struct {
+	cw        *countingWriter
+	gz        *gzip.Writer
+	diff      *countingWriter
+	chunkSize int64
+	toc       TOC
+}
+
+func (sw *stargzWriter) condOpenGz() {
+	if sw.gz == nil {
+		sw.gz = gzip.NewWriter(sw.cw)
+	}
+}
+
+func (sw *stargzWriter) closeGz() error {
+	if sw.gz == nil {
+		return nil
+	}
+	err := sw.gz.Close()
+	sw.gz = nil
+	return err
+}
+
+// Write writes uncompressed content to the current gzip member.
+func (sw *stargzWriter) Write(p []byte) (int, error) {
+	sw.condOpenGz()
+	if _, err := sw.diff.Write(p); err != nil {
+		return 0, err
+	}
+	return sw.gz.Write(p)
+}
+
+func (sw *stargzWriter) appendTar(tr *tar.Reader) error {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar entry: %w", err)
+		}
+		if cleanEntryName(h.Name) == TOCTarName {
+			// a layer already converted: its table of contents is rebuilt
+			continue
+		}
+
+		sw.condOpenGz()
+		tw := tar.NewWriter(sw)
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+
+		ent, err := tocEntry(h)
+		if err != nil {
+			return err
+		}
+		if ent == nil {
+			continue
+		}
+		if h.Typeflag != tar.TypeReg || h.Size == 0 {
+			sw.toc.Entries = append(sw.toc.Entries, ent)
+			continue
+		}
+
+		fileDigest := digest.Canonical.Digester()
+		content := io.TeeReader(tr, fileDigest.Hash())
+		fileEntry := ent
+		for written := int64(0); written < h.Size; {
+			if err := sw.closeGz(); err != nil {
+				return err
+			}
+			size := min(sw.chunkSize, h.Size-written)
+			if size < h.Size {
+				ent.ChunkSize = size
+			}
+			ent.Offset = sw.cw.n
+			ent.ChunkOffset = written
+
+			chunkDigest := digest.Canonical.Digester()
+			sw.condOpenGz()
+			if _, err := io.CopyN(tw, io.TeeReader(content, chunkDigest.Hash()), size); err != nil {
+				return fmt.Errorf("error copying %s: %w", h.Name, err)
+			}
+			ent.ChunkDigest = chunkDigest.Digest().String()
+			sw.toc.Entries = append(sw.toc.Entries, ent)
+			written += size
+			ent = &TOCEntry{Name: fileEntry.Name, Type: "chunk"}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if err := sw.closeGz(); err != nil {
+			return err
+		}
+		fileEntry.Digest = fileDigest.Digest().String()
+	}
+}
+
+// tocEntry returns the entry of the table of contents of the tar header, or
+// nil if it has none.
+func tocEntry(h *tar.Header) (*TOCEntry, error) {
+	ent := &TOCEntry{
+		Name:  cleanEntryName(h.Name),
+		Mode:  h.Mode,
+		UID:   h.Uid,
+		GID:   h.Gid,
+		Uname: h.Uname,
+		Gname: h.Gname,
+	}
+	if !h.ModTime.IsZero() {
+		ent.ModTime3339 = h.ModTime.UTC().Format(time.RFC3339)
+	}
+	for k, v := range h.PAXRecords {
+		if name, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if ent.Xattrs == nil {
+				ent.Xattrs = make(map[string][]byte)
+			}
+			ent.Xattrs[name] = []byte(v)
+		}
+	}
+
+	switch h.Typeflag {
+	case tar.TypeReg:
+		ent.Type = "reg"
+		ent.Size = h.Size
+	case tar.TypeDir:
+		ent.Type = "dir"
+	case tar.TypeSymlink:
+		ent.Type = "symlink"
+		ent.LinkName = h.Linkname
+	case tar.TypeLink:
+		ent.Type = "hardlink"
+		ent.LinkName = h.Linkname
+	case tar.TypeChar:
+		ent.Type = "char"
+		ent.DevMajor, ent.DevMinor = int(h.Devmajor), int(h.Devminor)
+	case tar.TypeBlock:
+		ent.Type = "block"
+		ent.DevMajor, ent.DevMinor = int(h.Devmajor), int(h.Devminor)
+	case tar.TypeFifo:
+		ent.Type = "fifo"
+	case tar.TypeXGlobalHeader:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %q of tar entry %s", h.Typeflag, h.Name)
+	}
+	return ent, nil
+}
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// landmarkArchive returns a tar archive holding the landmark telling that no
+// file is prioritized for prefetching.
+func landmarkArchive() io.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     noPrefetchLandmark,
+		Mode:     0o644,
+		Size:     1,
+	})
+	_, _ = tw.Write([]byte{landmarkContents})
+	_ = tw.Close()
+	return &buf
+}
+
+// footer returns the empty gzip member ending the layers, whose extra field
+// holds the offset of the gzip member of the table of contents. It is built
+// by hand since readers expect the 51 bytes of an empty stored block, which
+// compress/flate does not necessarily write.
+func footer(tocOffset int64) []byte {
+	payload := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	p := make([]byte, 0, FooterSize)
+	// gzip header with an extra field, no modification time and unknown OS
+	p = append(p, 0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff)
+	p = binary.LittleEndian.AppendUint16(p, uint16(4+len(payload)))
+	p = append(p, 'S', 'G')
+	p = binary.LittleEndian.AppendUint16(p, uint16(len(payload)))
+	p = append(p, payload...)
+	// final empty stored block, then the CRC-32 and size of no data
+	p = append(p, 1, 0, 0, 0xff, 0xff)
+	return append(p, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// ParseFooter returns the offset of the gzip member of the table of contents
+// from the footer of a layer.
+func ParseFooter(p []byte) (int64, error) {
+	if len(p) != FooterSize {
+		return 0, fmt.Errorf("invalid footer size %d", len(p))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	extra := zr.Header.Extra
+	if len(extra) != 26 || extra[0] != 'S' || extra[1] != 'G' || !bytes.HasSuffix(extra, []byte("STARGZ")) {
+		return 0, fmt.Errorf("invalid footer extra field %q", extra)
+	}
+	var offset int64
+	if _, err := fmt.Sscanf(string(extra[4:20]), "%016x", &offset); err != nil {
+		return 0, fmt.Errorf("invalid footer offset: %w", err)
+	}
+	return offset, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,153 @@
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func testArchive(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755, ModTime: time.Unix(1700000000, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/empty", "etc/small", "etc/large"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/link", Linkname: "small"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readMember returns the uncompressed content of the gzip member at offset.
+func readMember(t *testing.T, layer []byte, offset int64) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(layer[offset:]))
+	if err != nil {
+		t.Fatalf("no gzip member at %d: %v", offset, err)
+	}
+	zr.Multistream(false)
+	p, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestConvert(t *testing.T) {
+	files := map[string][]byte{
+		"etc/empty": {},
+		"etc/small": []byte("small file"),
+		"etc/large": bytes.Repeat([]byte("0123456789"), 10),
+	}
+	var layer bytes.Buffer
+	result, err := Convert(&layer, bytes.NewReader(testArchive(t, files)), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the layer is a plain tar.gz holding the landmark, the files and the
+	// table of contents
+	zr, err := gzip.NewReader(bytes.NewReader(layer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DiffID != digest.FromBytes(uncompressed) || result.UncompressedSize != int64(len(uncompressed)) {
+		t.Fatalf("unexpected result %+v for %d uncompressed bytes", result, len(uncompressed))
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, ok := files[h.Name]; ok {
+			if p, _ := io.ReadAll(tr); !bytes.Equal(p, content) {
+				t.Fatalf("unexpected content of %s: %q", h.Name, p)
+			}
+		}
+		names = append(names, h.Name)
+	}
+	expected := []string{noPrefetchLandmark, "etc/", "etc/empty", "etc/small", "etc/large", "etc/link", TOCTarName}
+	if len(names) != len(expected) {
+		t.Fatalf("unexpected entries %q", names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("unexpected entries %q", names)
+		}
+	}
+
+	// the footer locates the table of contents
+	p := layer.Bytes()
+	tocOffset, err := ParseFooter(p[len(p)-FooterSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr = tar.NewReader(bytes.NewReader(readMember(t, p, tocOffset)))
+	h, err := tr.Next()
+	if err != nil || h.Name != TOCTarName {
+		t.Fatalf("unexpected table of contents entry %v: %v", h, err)
+	}
+	tocJSON, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(tocJSON) != result.TOCDigest {
+		t.Fatal("unexpected digest of the table of contents")
+	}
+	var toc TOC
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		t.Fatal(err)
+	}
+
+	// each chunk is a gzip member at its offset, starting with its content
+	chunks := make(map[string][]byte)
+	for _, ent := range toc.Entries {
+		if ent.ChunkDigest == "" {
+			continue
+		}
+		size := ent.ChunkSize
+		if size == 0 {
+			size = ent.Size
+		}
+		chunk := readMember(t, p, ent.Offset)[:size]
+		if digest.FromBytes(chunk).String() != ent.ChunkDigest {
+			t.Fatalf("unexpected chunk of %s at %d", ent.Name, ent.ChunkOffset)
+		}
+		chunks[ent.Name] = append(chunks[ent.Name], chunk...)
+	}
+	for _, name := range []string{"etc/small", "etc/large"} {
+		if !bytes.Equal(chunks[name], files[name]) {
+			t.Fatalf("unexpected chunks of %s: %q", name, chunks[name])
+		}
+	}
+	if n := len(toc.Entries); n != 9 {
+		t.Fatalf("expected 9 entries with the 4 chunks of the large file, got %d", n)
+	}
+}
@@ -1,6 +1,7 @@
 package requestutil
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
@@ -49,3 +50,77 @@ func RemoteIP(r *http.Request) string {
 
 	return addr
 }
+
+// ParseTrustedProxies parses the IP addresses or CIDR ranges of the proxies
+// whose headers are trusted to carry the remote address of the requests.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	return trusted, nil
+}
+
+// TrustedRemoteIP extracts the remote IP of the request, taking into
+// account proxy headers only if the request comes from one of the trusted
+// proxies. Since clients can forge these headers, the X-Forwarded-For chain
+// is walked from the closest hop, up to the first one which is not a
+// trusted proxy. Without trusted proxies, this is the peer of the request.
+func TrustedRemoteIP(r *http.Request, trusted []*net.IPNet) string {
+	client := r.RemoteAddr
+	if ip, _, err := net.SplitHostPort(client); err == nil {
+		client = ip
+	}
+	if !isTrusted(client, trusted) {
+		return client
+	}
+
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if parseIP(hop) == nil {
+				break
+			}
+			client = hop
+			if !isTrusted(hop, trusted) {
+				break
+			}
+		}
+		return client
+	}
+	if realIP := r.Header.Get("X-Real-Ip"); realIP != "" && parseIP(realIP) != nil {
+		return realIP
+	}
+	return client
+}
+
+// isTrusted reports whether ip is the address of a trusted proxy.
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package requestutil
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
@@ -74,3 +75,70 @@ func TestRemoteAddr(t *testing.T) {
 	}
 	defer resp.Body.Close()
 }
+
+func TestTrustedRemoteIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTrustedProxies([]string{"10.0.0"}); err == nil {
+		t.Error("expected an error parsing an invalid trusted proxy")
+	}
+
+	for _, tc := range []struct {
+		description string
+		remoteAddr  string
+		headers     http.Header
+		trusted     []*net.IPNet
+		expected    string
+	}{
+		{
+			description: "headers of an untrusted peer",
+			remoteAddr:  "1.2.3.4:5000",
+			headers:     http.Header{"X-Forwarded-For": []string{"5.6.7.8"}, "X-Real-Ip": []string{"5.6.7.8"}},
+			trusted:     trusted,
+			expected:    "1.2.3.4",
+		},
+		{
+			description: "no trusted proxies",
+			remoteAddr:  "10.0.0.1:5000",
+			headers:     http.Header{"X-Forwarded-For": []string{"5.6.7.8"}},
+			expected:    "10.0.0.1",
+		},
+		{
+			description: "forwarded by a trusted proxy",
+			remoteAddr:  "10.0.0.1:5000",
+			headers:     http.Header{"X-Forwarded-For": []string{"5.6.7.8"}},
+			trusted:     trusted,
+			expected:    "5.6.7.8",
+		},
+		{
+			description: "forged hop before the client",
+			remoteAddr:  "10.0.0.1:5000",
+			headers:     http.Header{"X-Forwarded-For": []string{"9.9.9.9, 5.6.7.8", "192.168.1.1"}},
+			trusted:     trusted,
+			expected:    "5.6.7.8",
+		},
+		{
+			description: "invalid hop",
+			remoteAddr:  "10.0.0.1:5000",
+			headers:     http.Header{"X-Forwarded-For": []string{"5.6.7, 10.0.0.2"}},
+			trusted:     trusted,
+			expected:    "10.0.0.2",
+		},
+		{
+			description: "real IP from a trusted proxy",
+			remoteAddr:  "192.168.1.1:5000",
+			headers:     http.Header{"X-Real-Ip": []string{"5.6.7.8"}},
+			trusted:     trusted,
+			expected:    "5.6.7.8",
+		},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header = tc.headers
+		if ip := TrustedRemoteIP(r, tc.trusted); ip != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.description, tc.expected, ip)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+// Package zstdchunked writes zstd:chunked layers: zstd compressed tar
+// archives whose file contents are compressed in separate zstd frames,
+// indexed by a table of contents stored in a skippable frame at the end of
+// the layer, so that container runtimes can lazily fetch the files they need
+// with range requests.
+//
+// The layers remain valid zstd compressed tar archives, readable by any
+// client, and decompress to the original tar archive, whose tar-split is
+// stored along the table of contents so that runtimes can rebuild it. The
+// format is the one of the containers/storage project.
+package zstdchunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// ManifestChecksumAnnotation is the annotation of the layer descriptors
+	// holding the digest of their compressed table of contents.
+	ManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+
+	// ManifestPositionAnnotation is the annotation of the layer descriptors
+	// holding the position of their table of contents, as
+	// offset:compressed size:uncompressed size:type.
+	ManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+
+	// TarSplitPositionAnnotation is the annotation of the layer descriptors
+	// holding the position of their tar-split, as
+	// offset:compressed size:uncompressed size.
+	TarSplitPositionAnnotation = "io.github.containers.zstd-chunked.tarsplit-position"
+
+	// DefaultChunkSize is the size of the chunks large files are split into.
+	DefaultChunkSize = 4 << 20
+
+	// FooterSize is the size of the footer ending the layers.
+	FooterSize = 64
+
+	// manifestTypeCRFS is the type of the tables of contents.
+	manifestTypeCRFS = 1
+
+	// skippableFrameMagic starts the zstd frames skipped by decompressors.
+	skippableFrameMagic = 0x184d2a50
+
+	// skippableFrameHeaderSize is the size of the magic and of the size
+	// starting skippable frames.
+	skippableFrameHeaderSize = 8
+)
+
+// footerMagic ends the footer.
+var footerMagic = []byte("GNUlInUx")
+
+// crcTable is the table of the checksums of the file contents in tar-splits.
+var crcTable = crc64.MakeTable(crc64.ISO)
+
+// TOC is the table of contents of a layer.
+type TOC struct {
+	Version        int           `json:"version"`
+	Entries        []*TOCEntry   `json:"entries"`
+	TarSplitDigest digest.Digest `json:"tarSplitDigest,omitempty"`
+}
+
+// TOCEntry is an entry of the table of contents: a tar entry, or a chunk of
+// the content of a regular file after the first one.
+type TOCEntry struct {
+	Type        string            `json:"type"`
+	Name        string            `json:"name"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	ModTime     *time.Time        `json:"modtime,omitempty"`
+	AccessTime  *time.Time        `json:"accesstime,omitempty"`
+	ChangeTime  *time.Time        `json:"changetime,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	EndOffset   int64             `json:"endOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+	ChunkType   string            `json:"chunkType,omitempty"`
+}
+
+// tarSplitEntry is an entry of a tar-split: raw bytes of the tar archive, or
+// a file whose content is read from the table of contents.
+type tarSplitEntry struct {
+	Type     int    `json:"type"`
+	Name     string `json:"name,omitempty"`
+	NameRaw  []byte `json:"name_raw,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Payload  []byte `json:"payload"`
+	Position int    `json:"position"`
+}
+
+const (
+	tarSplitFile    = 1
+	tarSplitSegment = 2
+)
+
+// Result describes a layer written by Convert.
+type Result struct {
+	// ManifestChecksum is the digest of the compressed table of contents.
+	ManifestChecksum digest.Digest
+	// ManifestPosition is the position of the table of contents.
+	ManifestPosition string
+	// TarSplitPosition is the position of the tar-split.
+	TarSplitPosition string
+	// DiffID is the digest of the uncompressed content of the layer, the
+	// original tar archive.
+	DiffID digest.Digest
+}
+
+// Convert writes to w the zstd:chunked layer holding the tar archive read
+// from r, splitting the regular files into chunks of at most chunkSize
+// bytes.
+func Convert(w io.Writer, r io.Reader, chunkSize int64) (Result, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	cw := &countingWriter{w: w}
+	zw, err := zstd.NewWriter(cw)
+	if err != nil {
+		return Result{}, err
+	}
+	defer zw.Close()
+	diffID := digest.Canonical.Digester()
+	rr := &recordingReader{r: io.TeeReader(r, diffID.Hash())}
+	cc := &chunkedWriter{
+		cw:        cw,
+		zw:        zw,
+		chunkSize: chunkSize,
+		toc:       TOC{Version: 1},
+	}
+	cc.tarSplit = json.NewEncoder(&cc.tarSplitData)
+
+	tr := tar.NewReader(rr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, fmt.Errorf("error reading tar entry: %w", err)
+		}
+		if err := cc.appendEntry(tr, rr, h); err != nil {
+			return Result{}, err
+		}
+	}
+	// the end of the archive and its padding
+	if _, err := io.Copy(io.Discard, rr); err != nil {
+		return Result{}, err
+	}
+	if err := cc.writeSegment(rr.take()); err != nil {
+		return Result{}, err
+	}
+	if err := cc.restartFrame(); err != nil {
+		return Result{}, err
+	}
+
+	result, err := cc.writeManifest()
+	if err != nil {
+		return Result{}, err
+	}
+	result.DiffID = diffID.Digest()
+	return result, nil
+}
+
+// chunkedWriter writes the raw bytes of a tar archive to the current zstd
+// frame, opening new frames for the chunks of regular files, and records
+// the table of contents and the tar-split of the archive.
+type chunkedWriter struct {
+	cw        *countingWriter
+	zw        *zstd.Encoder
+	chunkSize int64
+	toc       TOC
+
+	tarSplit         *json.Encoder
+	tarSplitData     bytes.Buffer
+	tarSplitPosition int
+}
+
+// restartFrame ends the current zstd frame, so that the next bytes are
+// written to a new frame starting at the current offset.
+func (cc *chunkedWriter) restartFrame() error {
+	if err := cc.zw.Close(); err != nil {
+		return err
+	}
+	cc.zw.Reset(cc.cw)
+	return nil
+}
+
+// writeSegment writes raw bytes of the tar archive, recording them in the
+// tar-split.
+func (cc *chunkedWriter) writeSegment(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if _, err := cc.zw.Write(p); err != nil {
+		return err
+	}
+	return cc.appendTarSplit(tarSplitEntry{Type: tarSplitSegment, Payload: p})
+}
+
+func (cc *chunkedWriter) appendTarSplit(e tarSplitEntry) error {
+	if e.Name != "" && !utf8.ValidString(e.Name) {
+		e.NameRaw, e.Name = []byte(e.Name), ""
+	}
+	e.Position = cc.tarSplitPosition
+	cc.tarSplitPosition++
+	return cc.tarSplit.Encode(e)
+}
+
+// appendEntry writes the tar entry whose header h was just read from tr,
+// whose raw bytes are recorded by rr.
+func (cc *chunkedWriter) appendEntry(tr *tar.Reader, rr *recordingReader, h *tar.Header) error {
+	if err := cc.writeSegment(rr.take()); err != nil {
+		return err
+	}
+	if h.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+	ent, err := tocEntry(h)
+	if err != nil {
+		return err
+	}
+	if h.Typeflag != tar.TypeReg {
+		// the content of other entries, if any, is kept in the raw bytes
+		cc.toc.Entries = append(cc.toc.Entries, ent)
+		return cc.appendTarSplit(tarSplitEntry{Type: tarSplitFile, Name: h.Name})
+	}
+
+	fileDigest := digest.Canonical.Digester()
+	crc := crc64.New(crcTable)
+	content := io.TeeReader(tr, io.MultiWriter(fileDigest.Hash(), crc))
+	if h.Size > 0 {
+		if err := cc.restartFrame(); err != nil {
+			return err
+		}
+		ent.Offset = cc.cw.n
+	}
+	chunks := []*TOCEntry{ent}
+	for written := int64(0); written < h.Size; {
+		chunk := ent
+		if written > 0 {
+			if err := cc.restartFrame(); err != nil {
+				return err
+			}
+			chunk = &TOCEntry{Type: "chunk", Name: ent.Name, Offset: cc.cw.n, ChunkOffset: written}
+			chunks = append(chunks, chunk)
+		}
+		size := min(cc.chunkSize, h.Size-written)
+		chunkDigest := digest.Canonical.Digester()
+		if _, err := io.CopyN(io.MultiWriter(cc.zw, chunkDigest.Hash()), content, size); err != nil {
+			return fmt.Errorf("error copying %s: %w", h.Name, err)
+		}
+		chunk.ChunkSize = size
+		chunk.ChunkDigest = chunkDigest.Digest().String()
+		chunk.ChunkType = "data"
+		written += size
+	}
+	if raw := rr.take(); int64(len(raw)) != h.Size {
+		return fmt.Errorf("unsupported sparse file %s", h.Name)
+	}
+	if h.Size > 0 {
+		if err := cc.restartFrame(); err != nil {
+			return err
+		}
+		ent.EndOffset = cc.cw.n
+	}
+	if len(chunks) == 1 {
+		ent.ChunkSize, ent.ChunkDigest, ent.ChunkType = 0, "", ""
+	}
+	ent.Digest = fileDigest.Digest().String()
+	cc.toc.Entries = append(cc.toc.Entries, chunks...)
+
+	var payload []byte
+	if h.Size > 0 {
+		payload = crc.Sum(nil)
+	}
+	return cc.appendTarSplit(tarSplitEntry{Type: tarSplitFile, Name: h.Name, Size: h.Size, Payload: payload})
+}
+
+// writeManifest writes the skippable frames holding the table of contents,
+// the tar-split and the footer.
+func (cc *chunkedWriter) writeManifest() (Result, error) {
+	tarSplit := cc.zw.EncodeAll(cc.tarSplitData.Bytes(), nil)
+	cc.toc.TarSplitDigest = digest.FromBytes(tarSplit)
+	manifest, err := json.Marshal(cc.toc)
+	if err != nil {
+		return Result{}, err
+	}
+	compressedManifest := cc.zw.EncodeAll(manifest, nil)
+
+	manifestOffset := cc.cw.n + skippableFrameHeaderSize
+	if err := writeSkippableFrame(cc.cw, compressedManifest); err != nil {
+		return Result{}, err
+	}
+	tarSplitOffset := cc.cw.n + skippableFrameHeaderSize
+	if err := writeSkippableFrame(cc.cw, tarSplit); err != nil {
+		return Result{}, err
+	}
+
+	footer := make([]byte, 0, FooterSize)
+	for _, v := range []int64{
+		manifestOffset, int64(len(compressedManifest)), int64(len(manifest)), manifestTypeCRFS,
+		tarSplitOffset, int64(len(tarSplit)), int64(cc.tarSplitData.Len()),
+	} {
+		footer = binary.LittleEndian.AppendUint64(footer, uint64(v))
+	}
+	footer = append(footer, footerMagic...)
+	if err := writeSkippableFrame(cc.cw, footer); err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		ManifestChecksum: digest.FromBytes(compressedManifest),
+		ManifestPosition: fmt.Sprintf("%d:%d:%d:%d", manifestOffset, len(compressedManifest), len(manifest), manifestTypeCRFS),
+		TarSplitPosition: fmt.Sprintf("%d:%d:%d", tarSplitOffset, len(tarSplit), cc.tarSplitData.Len()),
+	}, nil
+}
+
+func writeSkippableFrame(w io.Writer, p []byte) error {
+	header := binary.LittleEndian.AppendUint32(nil, skippableFrameMagic)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(p)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// ParseFooter returns the offset and the compressed size of the table of
+// contents from the footer of a layer.
+func ParseFooter(p []byte) (offset, size int64, err error) {
+	if len(p) != FooterSize {
+		return 0, 0, fmt.Errorf("invalid footer size %d", len(p))
+	}
+	if !bytes.Equal(p[FooterSize-len(footerMagic):], footerMagic) {
+		return 0, 0, fmt.Errorf("invalid footer magic %q", p[FooterSize-len(footerMagic):])
+	}
+	if t := binary.LittleEndian.Uint64(p[24:]); t != manifestTypeCRFS {
+		return 0, 0, fmt.Errorf("unsupported table of contents type %d", t)
+	}
+	return int64(binary.LittleEndian.Uint64(p)), int64(binary.LittleEndian.Uint64(p[8:])), nil
+}
+
+// tocEntry returns the entry of the table of contents of the tar header.
+func tocEntry(h *tar.Header) (*TOCEntry, error) {
+	ent := &TOCEntry{
+		Name: h.Name,
+		Mode: h.Mode,
+		UID:  h.Uid,
+		GID:  h.Gid,
+	}
+	for _, t := range []struct {
+		src time.Time
+		dst **time.Time
+	}{
+		{h.ModTime, &ent.ModTime},
+		{h.AccessTime, &ent.AccessTime},
+		{h.ChangeTime, &ent.ChangeTime},
+	} {
+		if !t.src.IsZero() {
+			*t.dst = &t.src
+		}
+	}
+	for k, v := range h.PAXRecords {
+		if name, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if ent.Xattrs == nil {
+				ent.Xattrs = make(map[string]string)
+			}
+			ent.Xattrs[name] = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+	}
+
+	switch h.Typeflag {
+	case tar.TypeReg:
+		ent.Type = "reg"
+		ent.Size = h.Size
+	case tar.TypeDir:
+		ent.Type = "dir"
+	case tar.TypeSymlink:
+		ent.Type = "symlink"
+		ent.LinkName = h.Linkname
+	case tar.TypeLink:
+		ent.Type = "hardlink"
+		ent.LinkName = h.Linkname
+	case tar.TypeChar:
+		ent.Type = "char"
+		ent.DevMajor, ent.DevMinor = h.Devmajor, h.Devminor
+	case tar.TypeBlock:
+		ent.Type = "block"
+		ent.DevMajor, ent.DevMinor = h.Devmajor, h.Devminor
+	case tar.TypeFifo:
+		ent.Type = "fifo"
+	default:
+		return nil, fmt.Errorf("unsupported type %q of tar entry %s", h.Typeflag, h.Name)
+	}
+	return ent, nil
+}
+
+// recordingReader records the bytes read through it until taken, so that
+// the raw bytes of the tar headers read by archive/tar are kept.
+type recordingReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the bytes recorded since the last call.
+func (rr *recordingReader) take() []byte {
+	p := rr.buf
+	rr.buf = nil
+	return p
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,168 @@
+package zstdchunked
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+func testArchive(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755, ModTime: time.Unix(1700000000, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/empty", "etc/small", "etc/large"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/link", Linkname: "small"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// archives are commonly padded to a multiple of 10240 bytes
+	buf.Write(make([]byte, 10240-buf.Len()%10240))
+	return buf.Bytes()
+}
+
+// decompress returns the uncompressed content of the zstd frames of p.
+func decompress(t *testing.T, p []byte) []byte {
+	t.Helper()
+	zr, err := zstd.NewReader(bytes.NewReader(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestConvert(t *testing.T) {
+	files := map[string][]byte{
+		"etc/empty": {},
+		"etc/small": []byte("small file"),
+		"etc/large": bytes.Repeat([]byte("0123456789"), 10),
+	}
+	archive := testArchive(t, files)
+	var layer bytes.Buffer
+	result, err := Convert(&layer, bytes.NewReader(archive), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the layer decompresses to the original archive
+	p := layer.Bytes()
+	if !bytes.Equal(decompress(t, p), archive) {
+		t.Fatal("expected the layer to decompress to the original archive")
+	}
+	if result.DiffID != digest.FromBytes(archive) {
+		t.Fatalf("unexpected diff ID %s", result.DiffID)
+	}
+
+	// the footer and the annotation locate the table of contents
+	offset, size, err := ParseFooter(p[len(p)-FooterSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedManifest := p[offset : offset+size]
+	if digest.FromBytes(compressedManifest) != result.ManifestChecksum {
+		t.Fatal("unexpected digest of the table of contents")
+	}
+	position := strings.Split(result.ManifestPosition, ":")
+	if len(position) != 4 || position[0] != strconv.FormatInt(offset, 10) || position[1] != strconv.FormatInt(size, 10) || position[3] != "1" {
+		t.Fatalf("unexpected position of the table of contents %q", result.ManifestPosition)
+	}
+	if magic := binary.LittleEndian.Uint32(p[offset-skippableFrameHeaderSize:]); magic != skippableFrameMagic {
+		t.Fatalf("expected the table of contents in a skippable frame, got magic %x", magic)
+	}
+	var toc TOC
+	if err := json.Unmarshal(decompress(t, compressedManifest), &toc); err != nil {
+		t.Fatal(err)
+	}
+
+	// each chunk is a zstd frame at its offset, ending at the next chunk or
+	// at the end of the file, holding its content only
+	chunks := make(map[string][]byte)
+	for i, ent := range toc.Entries {
+		if ent.Type != "reg" && ent.Type != "chunk" || ent.Offset == 0 {
+			continue
+		}
+		var end int64
+		for _, next := range toc.Entries[i+1:] {
+			if next.Type == "chunk" {
+				end = next.Offset
+			}
+			break
+		}
+		for _, file := range toc.Entries[:i+1] {
+			if file.Type == "reg" && file.Name == ent.Name && end == 0 {
+				end = file.EndOffset
+			}
+		}
+		chunk := decompress(t, p[ent.Offset:end])
+		if ent.ChunkDigest != "" && digest.FromBytes(chunk).String() != ent.ChunkDigest {
+			t.Fatalf("unexpected chunk of %s at %d", ent.Name, ent.ChunkOffset)
+		}
+		chunks[ent.Name] = append(chunks[ent.Name], chunk...)
+	}
+	for name, content := range files {
+		if !bytes.Equal(chunks[name], content) {
+			t.Fatalf("unexpected chunks of %s: %q", name, chunks[name])
+		}
+	}
+	if n := len(toc.Entries); n != 8 {
+		t.Fatalf("expected 8 entries with the 4 chunks of the large file, got %d", n)
+	}
+
+	// the tar-split rebuilds the original archive from the file contents
+	fields := strings.Split(result.TarSplitPosition, ":")
+	if len(fields) != 3 {
+		t.Fatalf("unexpected position of the tar-split %q", result.TarSplitPosition)
+	}
+	tarSplitOffset, _ := strconv.ParseInt(fields[0], 10, 64)
+	tarSplitSize, _ := strconv.ParseInt(fields[1], 10, 64)
+	tarSplit := p[tarSplitOffset : tarSplitOffset+tarSplitSize]
+	if digest.FromBytes(tarSplit) != toc.TarSplitDigest {
+		t.Fatal("unexpected digest of the tar-split")
+	}
+	var rebuilt bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(decompress(t, tarSplit)))
+	for position := 0; scanner.Scan(); position++ {
+		var e tarSplitEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Position != position {
+			t.Fatalf("unexpected position %d of tar-split entry %d", e.Position, position)
+		}
+		switch e.Type {
+		case tarSplitSegment:
+			rebuilt.Write(e.Payload)
+		case tarSplitFile:
+			rebuilt.Write(files[e.Name][:e.Size])
+		}
+	}
+	if !bytes.Equal(rebuilt.Bytes(), archive) {
+		t.Fatal("expected the tar-split to rebuild the original archive")
+	}
+}
@@ -16,4 +16,7 @@ var (
 
 	// ProxyNamespace is the prometheus namespace of proxy related metrics
 	ProxyNamespace = metrics.NewNamespace(NamespacePrefix, "proxy", nil)
+
+	// AuthNamespace is the prometheus namespace of authentication related metrics
+	AuthNamespace = metrics.NewNamespace(NamespacePrefix, "auth", nil)
 )
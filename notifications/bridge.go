@@ -207,6 +207,49 @@ func (b *bridge) createBlobEvent(action string, repo reference.Named, desc v1.De
 	return event, nil
 }
 
+// NewDeniedEvent returns an event recording the denial of a request on the
+// repository, which is empty for requests not targeting a repository.
+func NewDeniedEvent(source SourceRecord, actor ActorRecord, request RequestRecord, repository string, denial DenialRecord) *Event {
+	event := createEvent(EventActionDenied)
+	event.Source = source
+	event.Actor = actor
+	event.Request = request
+	event.Target.Repository = repository
+	event.Denial = &denial
+
+	return event
+}
+
+// NewCorruptEvent returns an event recording that the content of the blob
+// described by desc, found by a scrub of the storage backend, does not match
+// its digest.
+func NewCorruptEvent(source SourceRecord, desc v1.Descriptor, corruption CorruptionRecord) *Event {
+	event := createEvent(EventActionCorrupt)
+	event.Source = source
+	event.Target.Descriptor = desc
+	event.Target.Length = desc.Size
+	event.Corruption = &corruption
+
+	return event
+}
+
+// NewLintEvent returns an event recording the problems found by the lint
+// checks of the manifest described by desc, pushed to the repository with
+// an optional tag.
+func NewLintEvent(source SourceRecord, actor ActorRecord, request RequestRecord, repository, tag string, desc v1.Descriptor, lint LintRecord) *Event {
+	event := createEvent(EventActionLint)
+	event.Source = source
+	event.Actor = actor
+	event.Request = request
+	event.Target.Descriptor = desc
+	event.Target.Length = desc.Size
+	event.Target.Repository = repository
+	event.Target.Tag = tag
+	event.Lint = &lint
+
+	return event
+}
+
 // createEvent creates an event with actor and source populated.
 func (b *bridge) createEvent(action string) *Event {
 	event := createEvent(action)
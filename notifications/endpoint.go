@@ -6,6 +6,21 @@ import (
 
 	"github.com/distribution/distribution/v3/configuration"
 	events "github.com/docker/go-events"
+	"github.com/sirupsen/logrus"
+)
+
+// Overflow policies, applied when an event is written to the full queue of
+// an endpoint.
+const (
+	// OverflowBlock blocks the writer until the queue has room.
+	OverflowBlock = "block"
+
+	// OverflowDropOldest drops the oldest event of the queue.
+	OverflowDropOldest = "dropoldest"
+
+	// OverflowSpill writes the event to a file, from which it is read back
+	// once the queue has drained.
+	OverflowSpill = "spill"
 )
 
 // EndpointConfig covers the optional configuration parameters for an active
@@ -18,6 +33,16 @@ type EndpointConfig struct {
 	IgnoredMediaTypes []string
 	Transport         *http.Transport `json:"-"`
 	Ignore            configuration.Ignore
+
+	// Concurrency is the number of events delivered concurrently.
+	Concurrency int
+	// QueueSize is the maximum number of events queued in memory, unbounded
+	// if zero.
+	QueueSize int
+	// Overflow is the policy applied when the queue is full.
+	Overflow string
+	// SpillDirectory is where events overflow with the OverflowSpill policy.
+	SpillDirectory string
 }
 
 // defaults set any zero-valued fields to a reasonable default.
@@ -37,6 +62,14 @@ func (ec *EndpointConfig) defaults() {
 	if ec.Transport == nil {
 		ec.Transport = http.DefaultTransport.(*http.Transport)
 	}
+
+	if ec.Concurrency <= 0 {
+		ec.Concurrency = 1
+	}
+
+	if ec.Overflow == "" {
+		ec.Overflow = OverflowDropOldest
+	}
 }
 
 // Endpoint is a reliable, queued, thread-safe sink that notify external http
@@ -66,7 +99,19 @@ func NewEndpoint(name, url string, config EndpointConfig) *Endpoint {
 		endpoint.url, endpoint.Timeout, endpoint.Headers,
 		endpoint.Transport, endpoint.metrics.httpStatusListener())
 	endpoint.Sink = events.NewRetryingSink(endpoint.Sink, events.NewBreaker(endpoint.Threshold, endpoint.Backoff))
-	endpoint.Sink = newEventQueue(endpoint.Sink, endpoint.metrics.eventQueueListener())
+	queue := queueConfig{
+		concurrency: endpoint.Concurrency,
+		size:        endpoint.QueueSize,
+		overflow:    endpoint.Overflow,
+	}
+	if endpoint.QueueSize > 0 && endpoint.Overflow == OverflowSpill {
+		spill, err := newSpillQueue(endpoint.SpillDirectory, name)
+		if err != nil {
+			logrus.Errorf("endpoint %s: unable to spill events to disk, the oldest events will be dropped instead: %v", name, err)
+		}
+		queue.spill = spill
+	}
+	endpoint.Sink = newEventQueue(endpoint.Sink, queue, endpoint.metrics.eventQueueListener())
 	mediaTypes := append(config.Ignore.MediaTypes, config.IgnoredMediaTypes...)
 	endpoint.Sink = newIgnoredSink(endpoint.Sink, mediaTypes, config.Ignore.Actions)
 
@@ -5,15 +5,19 @@ import (
 	"time"
 
 	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // EventAction constants used in action field of Event.
 const (
-	EventActionPull   = "pull"
-	EventActionPush   = "push"
-	EventActionMount  = "mount"
-	EventActionDelete = "delete"
+	EventActionPull    = "pull"
+	EventActionPush    = "push"
+	EventActionMount   = "mount"
+	EventActionDelete  = "delete"
+	EventActionDenied  = "denied"
+	EventActionCorrupt = "corrupt"
+	EventActionLint    = "lint"
 )
 
 const (
@@ -88,6 +92,15 @@ type Event struct {
 	// differently, while the actor "initiates" the event, the source
 	// "generates" it.
 	Source SourceRecord `json:"source,omitempty"`
+
+	// Denial describes why the request was denied, for denied events.
+	Denial *DenialRecord `json:"denial,omitempty"`
+
+	// Corruption describes the corrupt content, for corrupt events.
+	Corruption *CorruptionRecord `json:"corruption,omitempty"`
+
+	// Lint lists the lint problems of a pushed manifest, for lint events.
+	Lint *LintRecord `json:"lint,omitempty"`
 }
 
 // ActorRecord specifies the agent that initiated the event. For most
@@ -129,6 +142,47 @@ type RequestRecord struct {
 	UserAgent string `json:"useragent"`
 }
 
+// DenialRecord describes an authorization denial.
+type DenialRecord struct {
+	// Source is what denied the request, either the access controller or
+	// the policy.
+	Source string `json:"source"`
+
+	// Scopes lists the requested access, in the
+	// "<type>:<name>:<action>" form of token scopes.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Reason explains the denial.
+	Reason string `json:"reason,omitempty"`
+}
+
+// CorruptionRecord describes a blob whose content does not match its digest.
+type CorruptionRecord struct {
+	// Computed is the digest of the content found in the storage backend.
+	Computed digest.Digest `json:"computed"`
+
+	// Quarantined is true if the content was moved out of the blob store,
+	// and is no longer served.
+	Quarantined bool `json:"quarantined"`
+}
+
+// LintRecord describes the problems found by the lint checks of a pushed
+// manifest.
+type LintRecord struct {
+	// Problems lists the failed checks.
+	Problems []string `json:"problems"`
+
+	// Rejected is true if the manifest was rejected because of the
+	// problems, and false if it was accepted with warnings.
+	Rejected bool `json:"rejected"`
+}
+
+// Sources of authorization denials.
+const (
+	DenialSourceAccessController = "accesscontroller"
+	DenialSourcePolicy           = "policy"
+)
+
 // SourceRecord identifies the registry node that generated the event. Put
 // differently, while the actor "initiates" the event, the source "generates"
 // it.
@@ -11,9 +11,10 @@ import (
 	events "github.com/docker/go-events"
 )
 
-// httpSink implements a single-flight, http notification endpoint. This is
-// very lightweight in that it only makes an attempt at an http request.
-// Reliability should be provided by the caller.
+// httpSink implements an http notification endpoint. This is very
+// lightweight in that it only makes an attempt at an http request.
+// Reliability should be provided by the caller. Events may be written
+// concurrently.
 type httpSink struct {
 	url string
 
@@ -26,8 +27,8 @@ type httpSink struct {
 	// sink and choose the serialization based on that.
 }
 
-// newHTTPSink returns an unreliable, single-flight http sink. Wrap in other
-// sinks for increased reliability.
+// newHTTPSink returns an unreliable http sink. Wrap in other sinks for
+// increased reliability.
 func newHTTPSink(u string, timeout time.Duration, headers http.Header, transport *http.Transport, listeners ...httpStatusListener) *httpSink {
 	if transport == nil {
 		transport = http.DefaultTransport.(*http.Transport)
@@ -57,12 +58,12 @@ type httpStatusListener interface {
 // accepted or rejected as a group.
 func (hs *httpSink) Write(event events.Event) error {
 	hs.mu.Lock()
-	defer hs.mu.Unlock()
-	defer hs.client.Transport.(*headerRoundTripper).CloseIdleConnections()
-
-	if hs.closed {
+	closed := hs.closed
+	hs.mu.Unlock()
+	if closed {
 		return ErrSinkClosed
 	}
+	defer hs.client.Transport.(*headerRoundTripper).CloseIdleConnections()
 
 	envelope := Envelope{
 		Events: []events.Event{event},
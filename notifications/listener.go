@@ -241,6 +241,16 @@ func (bwl *blobWriterListener) Commit(ctx context.Context, desc v1.Descriptor) (
 	return committed, err
 }
 
+// ChunkWriter forwards ChunkWriter of the underlying writer, if it is a
+// distribution.BlobChunkWriter.
+func (bwl *blobWriterListener) ChunkWriter(ctx context.Context, offset, size int64) (io.WriteCloser, error) {
+	cw, ok := bwl.BlobWriter.(distribution.BlobChunkWriter)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+	return cw.ChunkWriter(ctx, offset, size)
+}
+
 type tagServiceListener struct {
 	distribution.TagService
 	parent *repositoryListener
@@ -80,6 +80,7 @@ type EndpointMetrics struct {
 	Successes int            // total events written successfully
 	Failures  int            // total events failed
 	Errors    int            // total events errored
+	Dropped   int            // total events dropped from a full queue
 	Statuses  map[string]int // status code histogram, per call event
 }
 
@@ -174,6 +175,16 @@ func (eqc *endpointMetricsEventQueueListener) egress(event events.Event) {
 	pendingGauge.WithValues(eqc.EndpointName).Dec(1)
 }
 
+func (eqc *endpointMetricsEventQueueListener) dropped(event events.Event) {
+	eqc.Lock()
+	defer eqc.Unlock()
+	eqc.Pending--
+	eqc.Dropped++
+
+	eventsCounter.WithValues("Dropped", eqc.EndpointName).Inc(1)
+	pendingGauge.WithValues(eqc.EndpointName).Dec(1)
+}
+
 // register places the endpoint into expvar so that stats are tracked.
 func register(e *Endpoint) {
 	endpoints.mu.Lock()
@@ -10,8 +10,10 @@ import (
 )
 
 // eventQueue accepts all messages into a queue for asynchronous consumption
-// by a sink. It is unbounded and thread safe but the sink must be reliable or
-// events will be dropped.
+// by a sink. It is thread safe but the sink must be reliable or events will
+// be dropped. The queue is unbounded unless a size is configured, in which
+// case the overflow policy decides what happens to events written to a full
+// queue.
 type eventQueue struct {
 	sink      events.Sink
 	events    *list.List
@@ -19,66 +21,166 @@ type eventQueue struct {
 	cond      *sync.Cond
 	mu        sync.Mutex
 	closed    bool
+
+	size     int
+	overflow string
+	spill    *spillQueue
+	workers  sync.WaitGroup
+
+	// spilling is the number of events being written to the spill file,
+	// and unspilling is true while events are read back from it. The
+	// file is accessed without holding mu.
+	spilling   int
+	unspilling bool
 }
 
 // eventQueueListener is called when various events happen on the queue.
 type eventQueueListener interface {
 	ingress(event events.Event)
 	egress(event events.Event)
+	dropped(event events.Event)
+}
+
+// queueConfig configures an eventQueue.
+type queueConfig struct {
+	// concurrency is the number of events written to the sink
+	// concurrently, one if zero.
+	concurrency int
+
+	// size is the maximum number of events held in memory, unbounded if
+	// zero.
+	size int
+
+	// overflow is the policy applied when the queue is full, one of
+	// OverflowBlock, OverflowDropOldest or OverflowSpill.
+	overflow string
+
+	// spill receives overflowing events with the OverflowSpill policy.
+	spill *spillQueue
 }
 
 // newEventQueue returns a queue to the provided sink. If the updater is non-
 // nil, it will be called to update pending metrics on ingress and egress.
-func newEventQueue(sink events.Sink, listeners ...eventQueueListener) *eventQueue {
+func newEventQueue(sink events.Sink, config queueConfig, listeners ...eventQueueListener) *eventQueue {
 	eq := eventQueue{
 		sink:      sink,
 		events:    list.New(),
 		listeners: listeners,
+		size:      config.size,
+		overflow:  config.overflow,
+		spill:     config.spill,
+	}
+	if eq.overflow == OverflowSpill && eq.spill == nil {
+		eq.overflow = OverflowDropOldest
 	}
 
 	eq.cond = sync.NewCond(&eq.mu)
-	go eq.run()
+	concurrency := max(config.concurrency, 1)
+	eq.workers.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go eq.run()
+	}
 	return &eq
 }
 
 // Write accepts the events into the queue, only failing if the queue has
-// beend closed.
+// been closed. When the queue is full, Write blocks, drops the oldest
+// event or spills the event to disk, according to the overflow policy.
 func (eq *eventQueue) Write(event events.Event) error {
 	eq.mu.Lock()
 	defer eq.mu.Unlock()
 
-	if eq.closed {
-		return ErrSinkClosed
+	for {
+		if eq.closed {
+			return ErrSinkClosed
+		}
+		if !eq.full() {
+			break
+		}
+
+		switch eq.overflow {
+		case OverflowBlock:
+			eq.cond.Wait()
+			continue
+		case OverflowSpill:
+			// NOTE: the event is written to disk without holding the
+			// lock, so that the other writes and the deliveries are not
+			// held up by the disk.
+			eq.spilling++
+			eq.mu.Unlock()
+			err := eq.spill.push(event)
+			eq.mu.Lock()
+			eq.spilling--
+			if err == nil {
+				for _, listener := range eq.listeners {
+					listener.ingress(event)
+				}
+				eq.cond.Broadcast()
+				return nil
+			}
+			logrus.Errorf("eventqueue: error spilling event to %s, dropping the oldest event: %v", eq.spill.f.Name(), err)
+			if eq.closed {
+				return ErrSinkClosed
+			}
+		}
+
+		if eq.size > 0 && eq.events.Len() >= eq.size {
+			front := eq.events.Front()
+			eq.events.Remove(front)
+			for _, listener := range eq.listeners {
+				listener.dropped(front.Value.(events.Event))
+			}
+			logrus.Warnf("eventqueue: queue is full, dropped the oldest event")
+		}
+		break
 	}
 
 	for _, listener := range eq.listeners {
 		listener.ingress(event)
 	}
 	eq.events.PushBack(event)
-	eq.cond.Signal() // signal waiters
+	eq.cond.Broadcast() // signal waiters
 
 	return nil
 }
 
+// full returns whether an event written to the queue overflows. Once events
+// have spilled, later ones spill too until the spilled events are back in
+// memory, so that they are delivered in order.
+func (eq *eventQueue) full() bool {
+	if eq.spill != nil && (eq.unspilling || eq.spill.len() > 0) {
+		return true
+	}
+	return eq.size > 0 && eq.events.Len() >= eq.size
+}
+
 // Close shuts down the event queue, flushing
 func (eq *eventQueue) Close() error {
 	eq.mu.Lock()
-	defer eq.mu.Unlock()
-
 	if eq.closed {
+		eq.mu.Unlock()
 		return fmt.Errorf("eventqueue: already closed")
 	}
 
 	// set closed flag
 	eq.closed = true
-	eq.cond.Signal() // signal flushes queue
-	eq.cond.Wait()   // wait for signal from last flush
+	eq.cond.Broadcast() // signal flushes queue
+	eq.mu.Unlock()
+
+	eq.workers.Wait() // wait for the last flush
 
+	if eq.spill != nil {
+		if err := eq.spill.close(); err != nil {
+			logrus.Warnf("eventqueue: error removing spill file: %v", err)
+		}
+	}
 	return eq.sink.Close()
 }
 
-// run is the main goroutine to flush events to the target sink.
+// run is a goroutine flushing events to the target sink.
 func (eq *eventQueue) run() {
+	defer eq.workers.Done()
+
 	for {
 		event := eq.next()
 
@@ -104,8 +206,12 @@ func (eq *eventQueue) next() events.Event {
 	defer eq.mu.Unlock()
 
 	for eq.events.Len() < 1 {
-		if eq.closed {
-			eq.cond.Broadcast()
+		if eq.spill != nil && !eq.unspilling && eq.spill.len() > 0 {
+			eq.unspill()
+			continue
+		}
+
+		if eq.closed && eq.spilling == 0 && !eq.unspilling {
 			return nil
 		}
 
@@ -115,10 +221,34 @@ func (eq *eventQueue) next() events.Event {
 	front := eq.events.Front()
 	block := front.Value.(events.Event)
 	eq.events.Remove(front)
+	eq.cond.Broadcast() // signal blocked writers
 
 	return block
 }
 
+// unspill moves spilled events back to memory. It is called with the lock
+// held, which is released while reading the spill file.
+func (eq *eventQueue) unspill() {
+	eq.unspilling = true
+	eq.mu.Unlock()
+	popped, lost, err := eq.spill.pop(max(eq.size, 1))
+	eq.mu.Lock()
+	eq.unspilling = false
+	defer eq.cond.Broadcast()
+
+	for _, event := range popped {
+		eq.events.PushBack(event)
+	}
+	if err != nil {
+		logrus.Errorf("eventqueue: %d spilled events lost: %v", lost, err)
+		for i := 0; i < lost; i++ {
+			for _, listener := range eq.listeners {
+				listener.dropped(nil)
+			}
+		}
+	}
+}
+
 // ignoredSink discards events with ignored target media types and actions.
 // passes the rest along.
 type ignoredSink struct {
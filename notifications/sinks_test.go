@@ -2,6 +2,7 @@ package notifications
 
 import (
 	"reflect"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -20,7 +21,7 @@ func TestEventQueue(t *testing.T) {
 		&delayedSink{
 			Sink:  &ts,
 			delay: time.Millisecond * 1,
-		}, metrics.eventQueueListener())
+		}, queueConfig{}, metrics.eventQueueListener())
 
 	var wg sync.WaitGroup
 	var event events.Event
@@ -63,6 +64,102 @@ func TestEventQueue(t *testing.T) {
 	}
 }
 
+func TestEventQueueOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		overflow  string
+		delivered []string
+		dropped   int
+	}{
+		{overflow: OverflowDropOldest, delivered: []string{"0", "3", "4"}, dropped: 2},
+		{overflow: OverflowBlock, delivered: []string{"0", "1", "2", "3", "4"}},
+		{overflow: OverflowSpill, delivered: []string{"0", "1", "2", "3", "4"}},
+	} {
+		t.Run(tc.overflow, func(t *testing.T) {
+			sink := &gatedSink{entered: make(chan struct{}, 10), release: make(chan struct{})}
+			config := queueConfig{size: 2, overflow: tc.overflow}
+			if tc.overflow == OverflowSpill {
+				spill, err := newSpillQueue(t.TempDir(), "test endpoint")
+				if err != nil {
+					t.Fatal(err)
+				}
+				config.spill = spill
+			}
+			metrics := newSafeMetrics("")
+			eq := newEventQueue(sink, config, metrics.eventQueueListener())
+
+			written := make(chan struct{}, 5)
+			write := func(i int) {
+				if err := eq.Write(createTestEvent("push", strconv.Itoa(i), "blob")); err != nil {
+					t.Errorf("error writing event: %v", err)
+				}
+				written <- struct{}{}
+			}
+
+			// the sink holds the first event, the next two fill the queue
+			write(0)
+			<-sink.entered
+			write(1)
+			write(2)
+			for i := 0; i < 3; i++ {
+				<-written
+			}
+
+			if tc.overflow == OverflowBlock {
+				go write(3)
+				select {
+				case <-written:
+					t.Fatal("expected write to a full queue to block")
+				case <-time.After(50 * time.Millisecond):
+				}
+				close(sink.release)
+				<-written
+				write(4)
+			} else {
+				write(3)
+				write(4)
+				<-written
+				close(sink.release)
+			}
+			<-written
+
+			checkClose(t, eq)
+
+			if !reflect.DeepEqual(sink.delivered, tc.delivered) {
+				t.Errorf("unexpected events delivered: %v != %v", sink.delivered, tc.delivered)
+			}
+			metrics.Lock()
+			defer metrics.Unlock()
+			if metrics.Dropped != tc.dropped || metrics.Pending != 0 {
+				t.Errorf("unexpected metrics: dropped %d, pending %d", metrics.Dropped, metrics.Pending)
+			}
+		})
+	}
+}
+
+func TestEventQueueConcurrency(t *testing.T) {
+	sink := &gatedSink{entered: make(chan struct{}, 10), release: make(chan struct{})}
+	eq := newEventQueue(sink, queueConfig{concurrency: 3}, newSafeMetrics("").eventQueueListener())
+
+	for i := 0; i < 3; i++ {
+		if err := eq.Write(createTestEvent("push", strconv.Itoa(i), "blob")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-sink.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 3 concurrent deliveries, got %d", i)
+		}
+	}
+	close(sink.release)
+	checkClose(t, eq)
+
+	if len(sink.delivered) != 3 {
+		t.Fatalf("unexpected events delivered: %v", sink.delivered)
+	}
+}
+
 func TestIgnoredSink(t *testing.T) {
 	blob := createTestEvent("push", "library/test", "blob")
 	manifest := createTestEvent("pull", "library/test", "manifest")
@@ -145,6 +242,28 @@ func (ts *testSink) Close() error {
 	return nil
 }
 
+// gatedSink records the repository of the events written to it, once
+// released.
+type gatedSink struct {
+	entered chan struct{}
+	release chan struct{}
+
+	mu        sync.Mutex
+	delivered []string
+}
+
+func (gs *gatedSink) Write(event events.Event) error {
+	gs.entered <- struct{}{}
+	<-gs.release
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.delivered = append(gs.delivered, event.(Event).Target.Repository)
+	return nil
+}
+
+func (gs *gatedSink) Close() error { return nil }
+
 type delayedSink struct {
 	events.Sink
 	delay time.Duration
@@ -0,0 +1,118 @@
+package notifications
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	events "github.com/docker/go-events"
+)
+
+// spillQueue is a first in, first out queue of events stored in a file, to
+// which an endpoint queue overflows. Events are stored as JSON and read
+// back as Event values. The file is removed when the queue is closed: it
+// absorbs bursts, it does not persist events across restarts. It is safe
+// for concurrent use.
+type spillQueue struct {
+	f *os.File
+
+	mu       sync.Mutex
+	readOff  int64
+	writeOff int64
+	n        int
+}
+
+// newSpillQueue creates a spill file for the named endpoint in dir.
+func newSpillQueue(dir, name string) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	f, err := os.CreateTemp(dir, "notifications-"+name+"-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	return &spillQueue{f: f}, nil
+}
+
+// len returns the number of events in the queue.
+func (sq *spillQueue) len() int {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	return sq.n
+}
+
+// push appends an event to the queue.
+func (sq *spillQueue) push(event events.Event) error {
+	p, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	p = append(p, '\n')
+
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if _, err := sq.f.WriteAt(p, sq.writeOff); err != nil {
+		return err
+	}
+	sq.writeOff += int64(len(p))
+	sq.n++
+	return nil
+}
+
+// pop removes up to max events from the head of the queue. The queue is
+// emptied if it cannot be read, and the number of events lost is returned.
+func (sq *spillQueue) pop(max int) ([]events.Event, int, error) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
+	r := bufio.NewReader(io.NewSectionReader(sq.f, sq.readOff, sq.writeOff-sq.readOff))
+
+	var popped []events.Event
+	for len(popped) < max && sq.n > 0 {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			lost := sq.n
+			sq.reset()
+			return popped, lost, fmt.Errorf("reading spilled events: %v", err)
+		}
+		sq.readOff += int64(len(line))
+		sq.n--
+
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			lost := sq.n + 1
+			sq.reset()
+			return popped, lost, fmt.Errorf("decoding spilled event: %v", err)
+		}
+		popped = append(popped, event)
+	}
+
+	if sq.n == 0 {
+		sq.reset()
+	}
+	return popped, 0, nil
+}
+
+// reset empties the queue, reclaiming the space used by the file.
+func (sq *spillQueue) reset() {
+	sq.readOff, sq.writeOff, sq.n = 0, 0, 0
+	_ = sq.f.Truncate(0)
+}
+
+// close removes the spill file.
+func (sq *spillQueue) close() error {
+	sq.f.Close()
+	return os.Remove(sq.f.Name())
+}
@@ -394,6 +394,68 @@ type ParameterDescriptor struct {
 	Examples []string
 }
 
+var (
+	garbageUntaggedParameter = ParameterDescriptor{
+		Name:        "untagged",
+		Type:        "boolean",
+		Format:      "true",
+		Description: "If `true`, the manifests of the repository which are not tagged are eligible for deletion, along with their layers.",
+	}
+
+	referrersArtifactTypeParameter = ParameterDescriptor{
+		Name:        "artifactType",
+		Type:        "string",
+		Format:      "<artifact type>",
+		Description: "If set, only the referrers of this artifact type are listed.",
+	}
+
+	garbageReportBody = `{
+    "entries": [
+        {
+            "kind": "manifest" | "layer" | "blob",
+            "repository": <name>,
+            "digest": <digest>,
+            "size": <size>
+        },
+        ...
+    ],
+    "repositories": [
+        {
+            "name": <name>,
+            "manifests": <count>,
+            "layers": <count>,
+            "bytes": <size>
+        }
+    ],
+    "blobs": <count>,
+    "bytes": <size>
+}`
+
+	garbageUnsupportedResponseDescriptor = ResponseDescriptor{
+		Description: "The registry does not collect garbage, because it is a pull through cache, is read-only or, for deletions, does not allow deletes.",
+		StatusCode:  http.StatusMethodNotAllowed,
+		ErrorCodes: []errcode.ErrorCode{
+			errcode.ErrorCodeUnsupported,
+		},
+		Body: BodyDescriptor{
+			ContentType: "application/json",
+			Format:      errorsBody,
+		},
+	}
+
+	garbageRunningResponseDescriptor = ResponseDescriptor{
+		Description: "Another garbage collection is running on the registry.",
+		StatusCode:  http.StatusServiceUnavailable,
+		ErrorCodes: []errcode.ErrorCode{
+			errcode.ErrorCodeUnavailable,
+		},
+		Body: BodyDescriptor{
+			ContentType: "application/json",
+			Format:      errorsBody,
+		},
+	}
+)
+
 var routeDescriptors = []RouteDescriptor{
 	{
 		Name:        RouteNameBase,
@@ -728,6 +790,71 @@ var routeDescriptors = []RouteDescriptor{
 		},
 	},
 
+	{
+		Name:        RouteNameReferrers,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/referrers/{digest:" + digest.DigestRegexp.String() + "}",
+		Entity:      "Referrers",
+		Description: "List the manifests referring to the manifest identified by `name` and `digest` through their `subject`, such as signatures and SBOMs. Served by pull through caches only, other registries respond with a `404 Not Found`, on which clients fall back to the referrers tag schema.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Fetch the referrers of the manifest identified by `name` and `digest`.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							digestPathParameter,
+						},
+						QueryParameters: []ParameterDescriptor{
+							referrersArtifactTypeParameter,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "The referrers of the manifest, which may be empty, listed in an image index. The `OCI-Filters-Applied` header lists the filters applied.",
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "OCI-Filters-Applied",
+										Type:        "string",
+										Format:      "artifactType",
+										Description: "Set to `artifactType` if the referrers were filtered by artifact type.",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/vnd.oci.image.index.v1+json",
+									Format: `{
+    "schemaVersion": 2,
+    "mediaType": "application/vnd.oci.image.index.v1+json",
+    "manifests": [
+        {
+            "mediaType": <media type>,
+            "digest": <digest>,
+            "size": <size>,
+            "artifactType": <artifact type>,
+            "annotations": {...}
+        },
+        ...
+    ]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+
 	{
 		Name:        RouteNameBlob,
 		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/{digest:" + digest.DigestRegexp.String() + "}",
@@ -962,6 +1089,70 @@ var routeDescriptors = []RouteDescriptor{
 		},
 	},
 
+	{
+		Name:        RouteNameBlobDeltas,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/{digest:" + digest.DigestRegexp.String() + "}/deltas",
+		Entity:      "Blob Deltas",
+		Description: "Retrieve the deltas rebuilding the blob identified by `digest` out of other blobs of the repository, which clients holding one of these blobs can fetch instead of the whole blob.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Fetch the deltas of the blob identified by `name` and `digest`.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							digestPathParameter,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "The deltas of the blob, which may be empty. Each delta is a blob of the repository, fetched by its `digest`.",
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "target": <digest>,
+    "deltas": [
+        {
+            "base": <digest>,
+            "digest": <digest>,
+            "size": <size>,
+            "mediaType": "application/vnd.distribution.delta.v1"
+        },
+        ...
+    ]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "Deltas are not enabled on the registry.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+
 	{
 		Name:        RouteNameBlobUpload,
 		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/uploads/",
@@ -1067,6 +1258,12 @@ var routeDescriptors = []RouteDescriptor{
 									},
 									contentLengthZeroHeader,
 									dockerUploadUUIDHeader,
+									{
+										Name:        "Docker-Mount-Candidates",
+										Type:        "string",
+										Format:      "<name>, <name>",
+										Description: "Optional. The repositories of the same namespace which may hold the blob identified by the `digest` parameter, or by the `mount` parameter without `from`, if the registry has mount hints enabled. Clients may cancel the upload and mount the blob from one of them instead.",
+									},
 								},
 							},
 						},
@@ -1415,6 +1612,20 @@ var routeDescriptors = []RouteDescriptor{
 								Required:    true,
 								Description: `Digest of uploaded blob.`,
 							},
+							{
+								Name:        "delta-base",
+								Type:        "string",
+								Format:      "<digest>",
+								Regexp:      digest.DigestRegexp,
+								Description: "Digest of the blob the uploaded delta applies to. Links the uploaded blob as the delta rebuilding `delta-target` out of this blob, which must be in the repository.",
+							},
+							{
+								Name:        "delta-target",
+								Type:        "string",
+								Format:      "<digest>",
+								Regexp:      digest.DigestRegexp,
+								Description: "Digest of the blob the uploaded delta rebuilds, required along with `delta-base`.",
+							},
 						},
 						Body: BodyDescriptor{
 							ContentType: "application/octet-stream",
@@ -1609,4 +1820,84 @@ var routeDescriptors = []RouteDescriptor{
 			},
 		},
 	},
+	{
+		Name:        RouteNameGarbage,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_garbage",
+		Entity:      "Garbage",
+		Description: "Collect the garbage of a single repository: the manifests and layers it no longer references, and the blobs no other repository links. The rest of the registry is not walked.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Report the content of the repository eligible for deletion, without deleting it. Like deletions, reports require `delete` access to the repository.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							garbageUntaggedParameter,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "The content eligible for deletion.",
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      garbageReportBody,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							garbageUnsupportedResponseDescriptor,
+							garbageRunningResponseDescriptor,
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+			{
+				Method:      http.MethodDelete,
+				Description: "Delete the content of the repository eligible for deletion. Content written within the grace period of the garbage collection of the registry is kept.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							garbageUntaggedParameter,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "The content deleted.",
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      garbageReportBody,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							garbageUnsupportedResponseDescriptor,
+							garbageRunningResponseDescriptor,
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
 }
@@ -11,11 +11,14 @@ import (
 const (
 	RouteNameBase            = "base"
 	RouteNameManifest        = "manifest"
+	RouteNameReferrers       = "referrers"
 	RouteNameTags            = "tags"
 	RouteNameBlob            = "blob"
+	RouteNameBlobDeltas      = "blob-deltas"
 	RouteNameBlobUpload      = "blob-upload"
 	RouteNameBlobUploadChunk = "blob-upload-chunk"
 	RouteNameCatalog         = "catalog"
+	RouteNameGarbage         = "garbage"
 )
 
 var (
@@ -95,6 +95,29 @@ func TestRouter(t *testing.T) {
 				"digest": "sha256:abcdef0919234",
 			},
 		},
+		{
+			RouteName:  RouteNameReferrers,
+			RequestURI: "/v2/foo/bar/referrers/sha256:abcdef0919234",
+			Vars: map[string]string{
+				"name":   "foo/bar",
+				"digest": "sha256:abcdef0919234",
+			},
+		},
+		{
+			RouteName:  RouteNameBlobDeltas,
+			RequestURI: "/v2/foo/bar/blobs/sha256:abcdef0919234/deltas",
+			Vars: map[string]string{
+				"name":   "foo/bar",
+				"digest": "sha256:abcdef0919234",
+			},
+		},
+		{
+			RouteName:  RouteNameGarbage,
+			RequestURI: "/v2/foo/bar/_garbage",
+			Vars: map[string]string{
+				"name": "foo/bar",
+			},
+		},
 		{
 			RouteName:  RouteNameBlobUpload,
 			RequestURI: "/v2/foo/bar/blobs/uploads/",
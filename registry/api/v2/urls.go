@@ -162,6 +162,19 @@ func (ub *URLBuilder) BuildManifestURL(ref reference.Named) (string, error) {
 	return manifestURL.String(), nil
 }
 
+// BuildReferrersURL constructs the url listing the referrers of the manifest
+// identified by name and dgst.
+func (ub *URLBuilder) BuildReferrersURL(ref reference.Canonical, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameReferrers)
+
+	referrersURL, err := route.URL("name", ref.Name(), "digest", ref.Digest().String())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(referrersURL, values...).String(), nil
+}
+
 // BuildBlobURL constructs the url for the blob identified by name and dgst.
 func (ub *URLBuilder) BuildBlobURL(ref reference.Canonical) (string, error) {
 	route := ub.cloneRoute(RouteNameBlob)
@@ -174,6 +187,32 @@ func (ub *URLBuilder) BuildBlobURL(ref reference.Canonical) (string, error) {
 	return layerURL.String(), nil
 }
 
+// BuildBlobDeltasURL constructs the url listing the deltas of the blob
+// identified by name and dgst.
+func (ub *URLBuilder) BuildBlobDeltasURL(ref reference.Canonical) (string, error) {
+	route := ub.cloneRoute(RouteNameBlobDeltas)
+
+	deltasURL, err := route.URL("name", ref.Name(), "digest", ref.Digest().String())
+	if err != nil {
+		return "", err
+	}
+
+	return deltasURL.String(), nil
+}
+
+// BuildGarbageURL constructs the url collecting the garbage of the
+// repository identified by name.
+func (ub *URLBuilder) BuildGarbageURL(name reference.Named, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameGarbage)
+
+	garbageURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(garbageURL, values...).String(), nil
+}
+
 // BuildBlobUploadURL constructs a url to begin a blob upload in the
 // repository identified by name.
 func (ub *URLBuilder) BuildBlobUploadURL(name reference.Named, values ...url.Values) (string, error) {
@@ -0,0 +1,183 @@
+// Package acl provides a simple authorization scheme driven by a YAML file,
+// which lists the accounts allowed to log in with basic authentication and
+// the rules granting users and groups access to repositories. The file is
+// reloaded when it is modified.
+//
+// This authentication method MUST be used under TLS, as simple token-replay attack is possible.
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrInsufficientScope is returned when the rules do not grant the requested
+// access to an authenticated user.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+func init() {
+	if err := auth.Register("acl", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register acl auth: %v", err)
+	}
+}
+
+type accessController struct {
+	realm          string
+	path           string
+	reloadInterval time.Duration
+
+	mu      sync.Mutex
+	modtime time.Time
+	checked time.Time
+	acl     *acl
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	realm, present := options["realm"]
+	if _, ok := realm.(string); !present || !ok {
+		return nil, fmt.Errorf(`"realm" must be set for acl access controller`)
+	}
+
+	pathOpt, present := options["path"]
+	path, ok := pathOpt.(string)
+	if !present || !ok {
+		return nil, fmt.Errorf(`"path" must be set for acl access controller`)
+	}
+
+	var reloadInterval time.Duration
+	if i, present := options["reloadinterval"]; present {
+		s, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("acl auth requires a valid option string: %q", "reloadinterval")
+		}
+		var err error
+		if reloadInterval, err = time.ParseDuration(s); err != nil || reloadInterval < 0 {
+			return nil, fmt.Errorf("unable to parse acl reloadinterval: %q", s)
+		}
+	}
+
+	ac := &accessController{
+		realm:          realm.(string),
+		path:           path,
+		reloadInterval: reloadInterval,
+		checked:        time.Now(),
+	}
+	// an invalid file is reported at startup, later on the last valid
+	// rules are kept until the file is fixed
+	if err := ac.reload(); err != nil {
+		return nil, fmt.Errorf("acl file %s: %v", path, err)
+	}
+	return ac, nil
+}
+
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrInvalidCredential,
+		}
+	}
+
+	acl := ac.current(req.Context())
+	if err := acl.authenticateUser(username, password); err != nil {
+		dcontext.GetLogger(req.Context()).Errorf("error authenticating user %q: %v", username, err)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+
+	if !acl.authorized(username, accessRecords) {
+		dcontext.GetLogger(req.Context()).Infof("acl rules do not grant user %q access to %v", username, accessRecords)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   ErrInsufficientScope,
+		}
+	}
+
+	resources := make([]auth.Resource, 0, len(accessRecords))
+	seen := make(map[auth.Resource]struct{})
+	for _, access := range accessRecords {
+		if _, ok := seen[access.Resource]; !ok {
+			seen[access.Resource] = struct{}{}
+			resources = append(resources, access.Resource)
+		}
+	}
+
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: username},
+		Resources: resources,
+	}, nil
+}
+
+// current returns the latest rules, reloading the file if it changed and was
+// not checked within the reload interval.
+func (ac *accessController) current(ctx context.Context) *acl {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if now := time.Now(); now.Sub(ac.checked) >= ac.reloadInterval {
+		ac.checked = now
+		if err := ac.reload(); err != nil {
+			dcontext.GetLogger(ctx).Errorf("failed to reload acl file, keeping the previous rules: %v", err)
+		}
+	}
+	return ac.acl
+}
+
+// reload parses the file if it was modified since it was last read. It must
+// be called with ac.mu held.
+func (ac *accessController) reload() error {
+	fstat, err := os.Stat(ac.path)
+	if err != nil {
+		return err
+	}
+	lastModified := fstat.ModTime()
+	if ac.acl != nil && ac.modtime.Equal(lastModified) {
+		return nil
+	}
+	// a file failing to parse is only reported once per modification
+	ac.modtime = lastModified
+
+	f, err := os.Open(ac.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	acl, err := parseACL(f)
+	if err != nil {
+		return err
+	}
+	ac.acl = acl
+	return nil
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
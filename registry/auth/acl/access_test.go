@@ -0,0 +1,110 @@
+package acl
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+func TestAccessController(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.yml")
+	writeACL := func(name string) {
+		content := "users:\n  bob:\n    password: " + hashPassword(t, "bob") + "\n" +
+			"rules:\n  - users: [bob]\n    name: " + name + "\n    actions: [pull]\n"
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeACL("bob/*")
+
+	accessController, err := newAccessController(map[string]interface{}{
+		"realm": "test-realm",
+		"path":  path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(username, password, name string) (*auth.Grant, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		return accessController.Authorized(req, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   "pull",
+		})
+	}
+
+	var ch *challenge
+	if _, err := authorize("", "", "bob/app"); !errors.As(err, &ch) || ch.err != auth.ErrInvalidCredential {
+		t.Fatalf("expected invalid credential challenge, got %v", err)
+	}
+	if _, err := authorize("bob", "alice", "bob/app"); !errors.As(err, &ch) || ch.err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected challenge for invalid password, got %v", err)
+	}
+	if _, err := authorize("bob", "bob", "alice/app"); !errors.As(err, &ch) || ch.err != ErrInsufficientScope {
+		t.Fatalf("expected insufficient scope challenge, got %v", err)
+	}
+
+	grant, err := authorize("bob", "bob", "bob/app")
+	if err != nil {
+		t.Fatalf("unexpected error authorizing request: %v", err)
+	}
+	if grant.User.Name != "bob" || len(grant.Resources) != 1 || grant.Resources[0].Name != "bob/app" {
+		t.Fatalf("unexpected grant: %#v", grant)
+	}
+
+	// the rules are reloaded when the file is modified
+	writeACL("alice/*")
+	modtime := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authorize("bob", "bob", "alice/app"); err != nil {
+		t.Fatalf("unexpected error authorizing request after reload: %v", err)
+	}
+
+	// an invalid file keeps the previous rules in use
+	if err := os.WriteFile(path, []byte("rules: invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modtime = modtime.Add(time.Second)
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authorize("bob", "bob", "alice/app"); err != nil {
+		t.Fatalf("unexpected error authorizing request with an invalid file: %v", err)
+	}
+}
+
+func TestAccessControllerOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.yml")
+	if err := os.WriteFile(path, []byte("rules: invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, options := range []map[string]interface{}{
+		{"path": path},
+		{"realm": "test-realm"},
+		{"realm": "test-realm", "path": filepath.Join(t.TempDir(), "missing.yml")},
+		{"realm": "test-realm", "path": path},
+	} {
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected error with options %v", options)
+		}
+	}
+
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAccessController(map[string]interface{}{"realm": "test-realm", "path": path, "reloadinterval": "soon"}); err == nil {
+		t.Error("expected error with an invalid reloadinterval")
+	}
+}
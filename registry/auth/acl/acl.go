@@ -0,0 +1,161 @@
+package acl
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// file is the YAML representation of an ACL file.
+type file struct {
+	Users map[string]struct {
+		Password string   `yaml:"password"`
+		Groups   []string `yaml:"groups"`
+	} `yaml:"users"`
+	Rules []struct {
+		Users   []string `yaml:"users"`
+		Groups  []string `yaml:"groups"`
+		Type    string   `yaml:"type"`
+		Name    string   `yaml:"name"`
+		Actions []string `yaml:"actions"`
+	} `yaml:"rules"`
+}
+
+// acl holds the accounts and rules of an ACL file.
+type acl struct {
+	users map[string]user
+	rules []rule
+}
+
+type user struct {
+	password []byte
+	groups   []string
+}
+
+// rule grants actions on the resources matching a name pattern to users and
+// to the members of groups.
+type rule struct {
+	users   map[string]struct{}
+	groups  map[string]struct{}
+	typ     string
+	name    *regexp.Regexp
+	actions map[string]struct{}
+}
+
+// parseACL parses an ACL file. Passwords must be bcrypt hashes.
+func parseACL(rd io.Reader) (*acl, error) {
+	p, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := yaml.UnmarshalStrict(p, &f); err != nil {
+		return nil, err
+	}
+
+	a := &acl{users: make(map[string]user, len(f.Users))}
+	for name, u := range f.Users {
+		if name == "" || name == "*" {
+			return nil, fmt.Errorf("invalid user name %q", name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return nil, fmt.Errorf("user %q: password must be a bcrypt hash", name)
+		}
+		a.users[name] = user{password: []byte(u.Password), groups: u.Groups}
+	}
+
+	for i, r := range f.Rules {
+		if len(r.Users) == 0 && len(r.Groups) == 0 {
+			return nil, fmt.Errorf("rule %d: users or groups must be set", i)
+		}
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d: name must be set to a resource name pattern", i)
+		}
+		if len(r.Actions) == 0 {
+			return nil, fmt.Errorf("rule %d: actions must be set", i)
+		}
+
+		parsed := rule{
+			users:   make(map[string]struct{}, len(r.Users)),
+			groups:  make(map[string]struct{}, len(r.Groups)),
+			typ:     r.Type,
+			actions: make(map[string]struct{}, len(r.Actions)),
+		}
+		if parsed.typ == "" {
+			parsed.typ = "repository"
+		}
+		for _, u := range r.Users {
+			parsed.users[u] = struct{}{}
+		}
+		for _, g := range r.Groups {
+			parsed.groups[g] = struct{}{}
+		}
+		for _, action := range r.Actions {
+			parsed.actions[action] = struct{}{}
+		}
+		parsed.name = auth.CompilePattern(r.Name)
+		a.rules = append(a.rules, parsed)
+	}
+
+	return a, nil
+}
+
+// authenticateUser checks the password of a user.
+func (a *acl) authenticateUser(username, password string) error {
+	u, ok := a.users[username]
+	if !ok {
+		// timing attack paranoia
+		_ = bcrypt.CompareHashAndPassword([]byte{}, []byte(password))
+		return auth.ErrAuthenticationFailure
+	}
+	if err := bcrypt.CompareHashAndPassword(u.password, []byte(password)); err != nil {
+		return auth.ErrAuthenticationFailure
+	}
+	return nil
+}
+
+// authorized returns whether the rules grant all the requested access to an
+// authenticated user.
+func (a *acl) authorized(username string, accessRecords []auth.Access) bool {
+	groups := a.users[username].groups
+	for _, access := range accessRecords {
+		granted := false
+		for _, r := range a.rules {
+			if r.matches(username, groups, access) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return false
+		}
+	}
+	return true
+}
+
+func (r rule) matches(username string, groups []string, access auth.Access) bool {
+	if r.typ != access.Type || !r.name.MatchString(access.Name) {
+		return false
+	}
+	if _, ok := r.actions[access.Action]; !ok {
+		if _, ok := r.actions["*"]; !ok {
+			return false
+		}
+	}
+	if _, ok := r.users[username]; ok {
+		return true
+	}
+	if _, ok := r.users["*"]; ok {
+		return true
+	}
+	for _, g := range groups {
+		if _, ok := r.groups[g]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestParseACL(t *testing.T) {
+	a, err := parseACL(strings.NewReader(`
+users:
+  alice:
+    password: ` + hashPassword(t, "alice") + `
+    groups: [admins]
+  bob:
+    password: ` + hashPassword(t, "bob") + `
+    groups: [developers]
+  carol:
+    password: ` + hashPassword(t, "carol") + `
+rules:
+  - groups: [admins]
+    name: "**"
+    actions: ["*"]
+  - groups: [admins]
+    type: registry
+    name: catalog
+    actions: ["*"]
+  - users: [bob]
+    groups: [developers]
+    name: "dev/*"
+    actions: [pull, push]
+  - users: ["*"]
+    name: "library/*"
+    actions: [pull]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.authenticateUser("bob", "bob"); err != nil {
+		t.Errorf("unexpected error authenticating bob: %v", err)
+	}
+	for _, credentials := range [][2]string{{"bob", "alice"}, {"dave", "dave"}, {"", ""}} {
+		if err := a.authenticateUser(credentials[0], credentials[1]); err != auth.ErrAuthenticationFailure {
+			t.Errorf("expected authentication failure for %v, got %v", credentials, err)
+		}
+	}
+
+	repository := func(name, action string) auth.Access {
+		return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+	}
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+
+	for _, tc := range []struct {
+		user       string
+		access     []auth.Access
+		authorized bool
+	}{
+		{user: "alice", access: []auth.Access{repository("any/deep/name", "delete"), catalog}, authorized: true},
+		{user: "bob", access: []auth.Access{repository("dev/app", "pull"), repository("dev/app", "push")}, authorized: true},
+		{user: "bob", access: []auth.Access{repository("dev/app", "delete")}},
+		{user: "bob", access: []auth.Access{repository("dev/team/app", "pull")}},
+		{user: "bob", access: []auth.Access{repository("library/alpine", "pull")}, authorized: true},
+		{user: "bob", access: []auth.Access{repository("dev/app", "pull"), repository("other/app", "pull")}},
+		{user: "bob", access: []auth.Access{catalog}},
+		{user: "carol", access: []auth.Access{repository("library/alpine", "pull")}, authorized: true},
+		{user: "carol", access: []auth.Access{repository("library/alpine", "push")}},
+		{user: "carol", access: nil, authorized: true},
+	} {
+		if authorized := a.authorized(tc.user, tc.access); authorized != tc.authorized {
+			t.Errorf("%s %v: expected authorized=%t, got %t", tc.user, tc.access, tc.authorized, authorized)
+		}
+	}
+}
+
+func TestParseACLInvalid(t *testing.T) {
+	hash := hashPassword(t, "password")
+	for _, content := range []string{
+		"users: [alice]",
+		"users:\n  alice:\n    password: plaintext\n",
+		"users:\n  alice:\n    password: " + hash + "\n    group: admins\n",
+		"rules:\n  - name: \"**\"\n    actions: [pull]\n",
+		"rules:\n  - users: [alice]\n    actions: [pull]\n",
+		"rules:\n  - users: [alice]\n    name: \"**\"\n",
+	} {
+		if _, err := parseACL(strings.NewReader(content)); err == nil {
+			t.Errorf("expected error parsing %q", content)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// anonymousOption is the access controller option listing the repository
+// name patterns anonymous clients may pull from. It is handled by
+// GetAccessController for every backend.
+const anonymousOption = "anonymous"
+
+// anonymousAccessController grants pull access to repositories matching a
+// set of patterns to requests carrying no credentials, and defers every
+// other request to the wrapped access controller.
+type anonymousAccessController struct {
+	AccessController
+	patterns []*regexp.Regexp
+}
+
+var (
+	_ AccessController = &anonymousAccessController{}
+	_ HandlerProvider  = &anonymousAccessController{}
+)
+
+// newAnonymousAccessController wraps ac to allow anonymous pulls from the
+// repositories matching the given patterns, where "*" matches any sequence of
+// characters other than "/" and "**" matches any sequence of characters.
+func newAnonymousAccessController(ac AccessController, option interface{}) (AccessController, error) {
+	list, ok := option.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of repository name patterns: %#v", anonymousOption, option)
+	}
+
+	aac := &anonymousAccessController{AccessController: ac}
+	for _, v := range list {
+		pattern, ok := v.(string)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid %s repository name pattern: %#v", anonymousOption, v)
+		}
+		aac.patterns = append(aac.patterns, CompilePattern(pattern))
+	}
+	return aac, nil
+}
+
+// Authorized grants the access anonymously when the request has no
+// credentials and only pulls from matching repositories. The base route,
+// which has no access records, is still challenged so that clients learn
+// how to authenticate for other operations.
+func (aac *anonymousAccessController) Authorized(req *http.Request, accessItems ...Access) (*Grant, error) {
+	if req.Header.Get("Authorization") != "" || len(accessItems) == 0 {
+		return aac.AccessController.Authorized(req, accessItems...)
+	}
+
+	resources := make([]Resource, 0, len(accessItems))
+	for _, access := range accessItems {
+		if access.Type != "repository" || access.Action != "pull" || !aac.matches(access.Name) {
+			return aac.AccessController.Authorized(req, accessItems...)
+		}
+		resources = append(resources, access.Resource)
+	}
+
+	return &Grant{Resources: resources}, nil
+}
+
+// Handlers returns the handlers of the wrapped access controller, if any.
+func (aac *anonymousAccessController) Handlers() map[string]http.Handler {
+	if hp, ok := aac.AccessController.(HandlerProvider); ok {
+		return hp.Handlers()
+	}
+	return nil
+}
+
+// matches returns whether anonymous clients may pull from the repository.
+func (aac *anonymousAccessController) matches(name string) bool {
+	for _, pattern := range aac.patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
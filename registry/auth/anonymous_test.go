@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var errDenied = errors.New("denied")
+
+// denyingAccessController denies every request, recording the options it
+// was created with.
+type denyingAccessController struct {
+	options map[string]interface{}
+}
+
+func (ac *denyingAccessController) Authorized(req *http.Request, access ...Access) (*Grant, error) {
+	return nil, errDenied
+}
+
+func TestAnonymousAccessController(t *testing.T) {
+	var backend *denyingAccessController
+	if err := Register("anonymous-test", func(options map[string]interface{}) (AccessController, error) {
+		backend = &denyingAccessController{options: options}
+		return backend, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := GetAccessController("anonymous-test", map[string]interface{}{
+		"realm":     "test-realm",
+		"anonymous": []interface{}{"public/*", "library/**"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.options["anonymous"]; ok || backend.options["realm"] != "test-realm" {
+		t.Fatalf("unexpected backend options: %v", backend.options)
+	}
+
+	pull := func(name string) Access {
+		return Access{Resource: Resource{Type: "repository", Name: name}, Action: "pull"}
+	}
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		access        []Access
+		anonymous     bool
+	}{
+		{name: "matching repository", access: []Access{pull("public/app")}, anonymous: true},
+		{name: "nested repository", access: []Access{pull("library/tools/app")}, anonymous: true},
+		{name: "several repositories", access: []Access{pull("public/app"), pull("library/app")}, anonymous: true},
+		{name: "unmatched repository", access: []Access{pull("private/app")}},
+		{name: "nested unmatched repository", access: []Access{pull("public/team/app")}},
+		{name: "partly unmatched", access: []Access{pull("public/app"), pull("private/app")}},
+		{
+			name:   "push",
+			access: []Access{{Resource: Resource{Type: "repository", Name: "public/app"}, Action: "push"}},
+		},
+		{
+			name:   "catalog",
+			access: []Access{{Resource: Resource{Type: "registry", Name: "catalog"}, Action: "*"}},
+		},
+		{name: "base route"},
+		{name: "credentials", authorization: "Basic Ym9iOmJvYg==", access: []Access{pull("public/app")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			grant, err := ac.Authorized(req, tc.access...)
+			if !tc.anonymous {
+				if err != errDenied {
+					t.Fatalf("expected the request to be deferred to the backend, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if grant.User.Name != "" || len(grant.Resources) != len(tc.access) {
+				t.Fatalf("unexpected grant: %#v", grant)
+			}
+		})
+	}
+}
+
+func TestAnonymousAccessControllerOptions(t *testing.T) {
+	for _, option := range []interface{}{
+		"public/*",
+		[]interface{}{"public/*", ""},
+		[]interface{}{"public/*", 1},
+	} {
+		if _, err := newAnonymousAccessController(&denyingAccessController{}, option); err == nil {
+			t.Errorf("expected error with option %#v", option)
+		}
+	}
+}
@@ -35,6 +35,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path"
 )
 
 var (
@@ -75,10 +76,39 @@ type Access struct {
 	Action string
 }
 
+// TagConstraint restricts an action granted on a repository to the tags
+// matching one of the patterns, such as "release-*". Patterns use the syntax
+// of path.Match.
+type TagConstraint struct {
+	Access
+	Patterns []string
+}
+
 // Grant describes the permitted level of access for an authorized request.
 type Grant struct {
 	User      UserInfo   // The authenticated user for the request.
 	Resources []Resource // The list of resources which have been authorized for the request.
+
+	// TagConstraints lists the actions only granted on some tags. Actions
+	// without a constraint are granted on all tags.
+	TagConstraints []TagConstraint
+}
+
+// TagAllowed reports whether the constraints allow the action on the tag of
+// the named repository.
+func TagAllowed(constraints []TagConstraint, name, action, tag string) bool {
+	for _, constraint := range constraints {
+		if constraint.Type != "repository" || constraint.Name != name || constraint.Action != action {
+			continue
+		}
+		for _, pattern := range constraint.Patterns {
+			if matched, _ := path.Match(pattern, tag); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return true
 }
 
 // Challenge is a special error type which is used for HTTP 401 Unauthorized
@@ -109,6 +139,13 @@ type AccessController interface {
 	Authorized(r *http.Request, access ...Access) (*Grant, error)
 }
 
+// HandlerProvider may be implemented by an AccessController serving HTTP
+// endpoints of its own, such as a built-in token server. The registry serves
+// each handler at its path, without access control.
+type HandlerProvider interface {
+	Handlers() map[string]http.Handler
+}
+
 // CredentialAuthenticator is an object which is able to authenticate credentials
 type CredentialAuthenticator interface {
 	AuthenticateUser(username, password string) error
@@ -127,11 +164,29 @@ func Register(name string, initFunc InitFunc) error {
 }
 
 // GetAccessController constructs an AccessController
-// with the given options using the named backend.
+// with the given options using the named backend. The "anonymous" option,
+// common to all backends, lists the repository name patterns anonymous
+// clients may pull from.
 func GetAccessController(name string, options map[string]interface{}) (AccessController, error) {
-	if initFunc, exists := accessControllers[name]; exists {
+	initFunc, exists := accessControllers[name]
+	if !exists {
+		return nil, fmt.Errorf("no access controller registered with name: %s", name)
+	}
+
+	anonymous, ok := options[anonymousOption]
+	if !ok {
 		return initFunc(options)
 	}
 
-	return nil, fmt.Errorf("no access controller registered with name: %s", name)
+	backendOptions := make(map[string]interface{}, len(options))
+	for k, v := range options {
+		if k != anonymousOption {
+			backendOptions[k] = v
+		}
+	}
+	ac, err := initFunc(backendOptions)
+	if err != nil {
+		return nil, err
+	}
+	return newAnonymousAccessController(ac, anonymous)
 }
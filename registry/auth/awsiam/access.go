@@ -0,0 +1,511 @@
+// Package awsiam provides an authentication scheme for clients holding AWS
+// IAM credentials, such as EC2 instances, ECS tasks or Lambda functions
+// running with a role, and grants access to repositories based on the ARN of
+// the client.
+//
+// Clients sign an sts:GetCallerIdentity request with AWS Signature Version 4
+// and present the presigned URL as the password of basic authentication. The
+// registry forwards the request to AWS STS, which verifies the signature and
+// returns the identity of the client, so that the registry never needs the
+// secret keys of its clients.
+package awsiam
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+
+	// maxTokenAge is the time a presigned request is accepted for after
+	// being signed, whatever its expiration.
+	maxTokenAge = 15 * time.Minute
+
+	// serverIDHeader is the header binding presigned requests to a
+	// registry, so that requests presigned for another service cannot be
+	// replayed against the registry.
+	serverIDHeader = "X-Registry-Server-Id"
+)
+
+// ErrInsufficientScope is returned when the rules do not grant the requested
+// access to an authenticated client.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+// errInvalidToken is returned when the password is not an acceptable
+// presigned request, or STS rejects it.
+var errInvalidToken = errors.New("invalid presigned sts:GetCallerIdentity request")
+
+// stsHost matches the global and regional AWS STS endpoints.
+var stsHost = regexp.MustCompile(`^sts(-fips)?(\.[a-z0-9-]+)?\.amazonaws\.com(\.cn)?$`)
+
+func init() {
+	if err := auth.Register("awsiam", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register awsiam auth: %v", err)
+	}
+}
+
+type accessController struct {
+	realm    string
+	endpoint *url.URL
+	serverID string
+	accounts map[string]struct{}
+	rules    []arnRule
+	client   *http.Client
+	cache    *identityCache
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+var _ auth.AccessController = &accessController{}
+
+// arnRule grants actions on the resources matching a name pattern to the
+// clients whose ARN matches an ARN pattern.
+type arnRule struct {
+	arn     *regexp.Regexp
+	typ     string
+	name    *regexp.Regexp
+	actions map[string]struct{}
+}
+
+// identity is the identity of a client, as returned by STS.
+type identity struct {
+	ARN     string `xml:"GetCallerIdentityResult>Arn"`
+	Account string `xml:"GetCallerIdentityResult>Account"`
+	UserID  string `xml:"GetCallerIdentityResult>UserId"`
+
+	// principal is the ARN rules are matched against, which is the ARN
+	// of the role for assumed role sessions.
+	principal string
+}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	ac := &accessController{
+		accounts: make(map[string]struct{}),
+		cache:    &identityCache{identities: make(map[string]cachedIdentity)},
+		now:      time.Now,
+	}
+
+	realm, ok := options["realm"].(string)
+	if !ok || realm == "" {
+		return nil, fmt.Errorf("%q must be set for awsiam access controller", "realm")
+	}
+	ac.realm = realm
+
+	// any principal of AWS could sign a request: clients must be
+	// restricted to trusted accounts
+	accounts, ok := options["accounts"].([]interface{})
+	if !ok || len(accounts) == 0 {
+		return nil, fmt.Errorf("%q must be set to a list of AWS account IDs for awsiam access controller", "accounts")
+	}
+	for _, v := range accounts {
+		var account string
+		switch a := v.(type) {
+		case string:
+			account = a
+		case int:
+			// unquoted account IDs are parsed as integers
+			account = fmt.Sprintf("%012d", a)
+		}
+		if len(account) != 12 || strings.Trim(account, "0123456789") != "" {
+			return nil, fmt.Errorf("invalid awsiam account ID: %#v", v)
+		}
+		ac.accounts[account] = struct{}{}
+	}
+
+	// requests presigned for another service must not be accepted: they
+	// are bound to the registry by the server ID, which defaults to the
+	// realm
+	ac.serverID = realm
+	if v, present := options["serverid"]; present {
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("awsiam auth requires a valid option string: %q", "serverid")
+		}
+		ac.serverID = s
+	}
+
+	if v, present := options["stsendpoint"]; present {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("awsiam auth requires a valid option string: %q", "stsendpoint")
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid awsiam stsendpoint: %q", s)
+		}
+		ac.endpoint = u
+	}
+
+	timeout := defaultTimeout
+	if v, present := options["timeout"]; present {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("awsiam auth requires a valid option string: %q", "timeout")
+		}
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("unable to parse awsiam timeout: %q", s)
+		}
+	}
+	ac.client = &http.Client{
+		Timeout: timeout,
+		// the presigned request is only ever sent to STS
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	if rules, present := options["rules"]; present {
+		ruleList, ok := rules.([]interface{})
+		if !ok {
+			return nil, errors.New("awsiam rules must be a list of ARN rules")
+		}
+		for i, r := range ruleList {
+			rule, err := parseARNRule(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid awsiam rule %d: %v", i, err)
+			}
+			ac.rules = append(ac.rules, rule)
+		}
+	}
+
+	return ac, nil
+}
+
+func parseARNRule(v interface{}) (arnRule, error) {
+	options := make(map[string]interface{})
+	switch m := v.(type) {
+	case map[string]interface{}:
+		options = m
+	case map[interface{}]interface{}:
+		for k, val := range m {
+			if key, ok := k.(string); ok {
+				options[key] = val
+			}
+		}
+	default:
+		return arnRule{}, errors.New("ARN rule must be a map")
+	}
+
+	rule := arnRule{typ: "repository", actions: make(map[string]struct{})}
+	pattern, ok := options["arn"].(string)
+	if !ok || pattern == "" {
+		return arnRule{}, errors.New(`"arn" must be set to an ARN pattern`)
+	}
+	rule.arn = auth.CompilePattern(pattern)
+	if typ, present := options["type"]; present {
+		if rule.typ, ok = typ.(string); !ok {
+			return arnRule{}, errors.New(`"type" must be a string`)
+		}
+	}
+
+	name, ok := options["name"].(string)
+	if !ok || name == "" {
+		return arnRule{}, errors.New(`"name" must be set to a resource name pattern`)
+	}
+	rule.name = auth.CompilePattern(name)
+
+	actions, ok := options["actions"].([]interface{})
+	if !ok || len(actions) == 0 {
+		return arnRule{}, errors.New(`"actions" must be a list of actions`)
+	}
+	for _, action := range actions {
+		a, ok := action.(string)
+		if !ok {
+			return arnRule{}, fmt.Errorf("invalid action %#v", action)
+		}
+		rule.actions[a] = struct{}{}
+	}
+
+	return rule, nil
+}
+
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	_, token, ok := req.BasicAuth()
+	if !ok || token == "" {
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrInvalidCredential,
+		}
+	}
+
+	id, err := ac.identity(req.Context(), token)
+	if err != nil {
+		if !errors.Is(err, errInvalidToken) {
+			return nil, err
+		}
+		dcontext.GetLogger(req.Context()).Errorf("error authenticating aws client: %v", err)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+
+	if _, ok := ac.accounts[id.Account]; !ok {
+		dcontext.GetLogger(req.Context()).Errorf("aws client %q belongs to an untrusted account", id.ARN)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+
+	if !ac.authorized(id.principal, accessRecords) {
+		dcontext.GetLogger(req.Context()).Infof("awsiam rules do not grant %q access to %v", id.principal, accessRecords)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   ErrInsufficientScope,
+		}
+	}
+
+	resources := make([]auth.Resource, 0, len(accessRecords))
+	seen := make(map[auth.Resource]struct{})
+	for _, access := range accessRecords {
+		if _, ok := seen[access.Resource]; !ok {
+			seen[access.Resource] = struct{}{}
+			resources = append(resources, access.Resource)
+		}
+	}
+
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: id.ARN},
+		Resources: resources,
+	}, nil
+}
+
+// identity returns the identity of the client which presigned the request.
+// Identities are cached until the presigned request expires, since clients
+// send the same credentials with every request of a pull or push.
+func (ac *accessController) identity(ctx context.Context, token string) (*identity, error) {
+	now := ac.now()
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if id, ok := ac.cache.get(key, now); ok {
+		return id, nil
+	}
+
+	u, expires, err := ac.parseToken(token, now)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(serverIDHeader, ac.serverID)
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach aws sts: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read aws sts response: %v", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return nil, fmt.Errorf("%w: aws sts responded %s: %s", errInvalidToken, resp.Status, body)
+	default:
+		return nil, fmt.Errorf("unexpected aws sts response %s", resp.Status)
+	}
+
+	var id identity
+	if err := xml.Unmarshal(body, &id); err != nil || id.ARN == "" || id.Account == "" {
+		return nil, fmt.Errorf("invalid aws sts response: %s", body)
+	}
+	if id.principal, err = principalARN(id.ARN); err != nil {
+		return nil, fmt.Errorf("invalid aws sts response: %v", err)
+	}
+
+	ac.cache.add(key, &id, expires, now)
+	return &id, nil
+}
+
+// parseToken parses and checks a presigned sts:GetCallerIdentity request,
+// returning the time it expires at.
+func (ac *accessController) parseToken(token string, now time.Time) (*url.URL, time.Time, error) {
+	u, err := url.Parse(token)
+	if err != nil {
+		return nil, time.Time{}, errInvalidToken
+	}
+	if ac.endpoint != nil {
+		if u.Scheme != ac.endpoint.Scheme || u.Host != ac.endpoint.Host {
+			return nil, time.Time{}, fmt.Errorf("%w: unexpected endpoint %s://%s", errInvalidToken, u.Scheme, u.Host)
+		}
+	} else if u.Scheme != "https" || !stsHost.MatchString(u.Host) {
+		return nil, time.Time{}, fmt.Errorf("%w: %s://%s is not an aws sts endpoint", errInvalidToken, u.Scheme, u.Host)
+	}
+	if u.User != nil || u.Fragment != "" {
+		return nil, time.Time{}, errInvalidToken
+	}
+
+	q := u.Query()
+	if q.Get("Action") != "GetCallerIdentity" || q.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" || q.Get("X-Amz-Signature") == "" {
+		return nil, time.Time{}, fmt.Errorf("%w: not a presigned sts:GetCallerIdentity request", errInvalidToken)
+	}
+
+	signedHeaders := strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+	if !contains(signedHeaders, strings.ToLower(serverIDHeader)) {
+		return nil, time.Time{}, fmt.Errorf("%w: the %s header is not signed", errInvalidToken, serverIDHeader)
+	}
+
+	date, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%w: invalid X-Amz-Date", errInvalidToken)
+	}
+	// the presigner of aws-sdk-go-v2 leaves X-Amz-Expires out, in which case
+	// STS accepts the request for 15 minutes
+	age := maxTokenAge
+	if v := q.Get("X-Amz-Expires"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return nil, time.Time{}, fmt.Errorf("%w: invalid X-Amz-Expires", errInvalidToken)
+		}
+		age = min(time.Duration(seconds)*time.Second, maxTokenAge)
+	}
+	expires := date.Add(age)
+	if !now.Before(expires) || date.After(now.Add(maxTokenAge)) {
+		return nil, time.Time{}, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+
+	return u, expires, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// principalARN returns the ARN of the IAM role of assumed role sessions,
+// which include a session name chosen by the client, and the ARN of other
+// identities unchanged.
+func principalARN(s string) (string, error) {
+	a, err := arn.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if a.Service == "sts" && strings.HasPrefix(a.Resource, "assumed-role/") {
+		parts := strings.Split(a.Resource, "/")
+		if len(parts) != 3 {
+			return "", fmt.Errorf("invalid assumed role ARN %q", s)
+		}
+		a.Service = "iam"
+		a.Resource = "role/" + parts[1]
+		return a.String(), nil
+	}
+	return s, nil
+}
+
+// authorized returns whether the rules grant all the requested access.
+// Without rules, the clients of trusted accounts are granted all access.
+func (ac *accessController) authorized(principal string, accessRecords []auth.Access) bool {
+	if len(ac.rules) == 0 {
+		return true
+	}
+
+	for _, access := range accessRecords {
+		granted := false
+		for _, rule := range ac.rules {
+			if rule.matches(principal, access) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return false
+		}
+	}
+	return true
+}
+
+func (r arnRule) matches(principal string, access auth.Access) bool {
+	if !r.arn.MatchString(principal) || r.typ != access.Type || !r.name.MatchString(access.Name) {
+		return false
+	}
+	if _, ok := r.actions[access.Action]; !ok {
+		if _, ok := r.actions["*"]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type cachedIdentity struct {
+	identity *identity
+	expires  time.Time
+}
+
+// identityCache caches the identities returned by STS for presigned
+// requests, keyed by the hash of the request.
+type identityCache struct {
+	mu         sync.Mutex
+	identities map[string]cachedIdentity
+	lastPrune  time.Time
+}
+
+func (c *identityCache) get(key string, now time.Time) (*identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.identities[key]
+	if !ok || !now.Before(cached.expires) {
+		return nil, false
+	}
+	return cached.identity, true
+}
+
+func (c *identityCache) add(key string, id *identity, expires, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastPrune) > time.Minute {
+		for k, cached := range c.identities {
+			if !now.Before(cached.expires) {
+				delete(c.identities, k)
+			}
+		}
+		c.lastPrune = now
+	}
+	c.identities[key] = cachedIdentity{identity: id, expires: expires}
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
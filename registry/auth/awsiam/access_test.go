@@ -0,0 +1,309 @@
+package awsiam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+const testServerID = "registry.example.com"
+
+// testSTS is a fake STS endpoint returning the identity of the access key
+// of presigned requests. Signatures are not verified.
+type testSTS struct {
+	*httptest.Server
+	identities map[string]string
+	calls      atomic.Int32
+}
+
+func newTestSTS(t *testing.T) *testSTS {
+	s := &testSTS{identities: map[string]string{
+		"AKIDROLE":  "arn:aws:sts::123456789012:assumed-role/ci-builder/i-0123456789abcdef0",
+		"AKIDUSER":  "arn:aws:iam::123456789012:user/alice",
+		"AKIDOTHER": "arn:aws:iam::210987654321:user/mallory",
+	}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		accessKey, _, _ := strings.Cut(r.URL.Query().Get("X-Amz-Credential"), "/")
+		arn, ok := s.identities[accessKey]
+		if !ok || r.Header.Get(serverIDHeader) != testServerID {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>SignatureDoesNotMatch</Code></Error></ErrorResponse>`)
+			return
+		}
+		account := strings.Split(arn, ":")[4]
+		fmt.Fprintf(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>%s</Arn>
+    <UserId>AIDAEXAMPLE</UserId>
+    <Account>%s</Account>
+  </GetCallerIdentityResult>
+</GetCallerIdentityResponse>`, arn, account)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// presign returns a presigned sts:GetCallerIdentity request, as generated by
+// clients.
+func presign(t *testing.T, endpoint, accessKey, serverID string) string {
+	t.Helper()
+	client := sts.New(sts.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		Credentials:  credentials.NewStaticCredentialsProvider(accessKey, "secret", ""),
+	})
+	req, err := sts.NewPresignClient(client).PresignGetCallerIdentity(context.Background(), &sts.GetCallerIdentityInput{},
+		sts.WithPresignClientFromClientOptions(func(o *sts.Options) {
+			if serverID != "" {
+				o.APIOptions = append(o.APIOptions, smithyhttp.SetHeaderValue(serverIDHeader, serverID))
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req.URL
+}
+
+func TestAccessController(t *testing.T) {
+	s := newTestSTS(t)
+	acIface, err := newAccessController(map[string]interface{}{
+		"realm":       "test-realm",
+		"accounts":    []interface{}{"123456789012", 210987654321},
+		"serverid":    testServerID,
+		"stsendpoint": s.URL,
+		"rules": []interface{}{
+			map[interface{}]interface{}{
+				"arn":     "arn:aws:iam::123456789012:role/ci-*",
+				"name":    "ci/**",
+				"actions": []interface{}{"pull", "push"},
+			},
+			map[interface{}]interface{}{
+				"arn":     "arn:aws:iam::123456789012:**",
+				"name":    "**",
+				"actions": []interface{}{"pull"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := acIface.(*accessController)
+
+	authorize := func(password, name, action string) (*auth.Grant, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		if password != "" {
+			req.SetBasicAuth("AWS", password)
+		}
+		return ac.Authorized(req, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   action,
+		})
+	}
+	expectChallenge := func(err, expected error) {
+		t.Helper()
+		var ch *challenge
+		if !errors.As(err, &ch) || ch.err != expected {
+			t.Fatalf("expected a challenge for %v, got %v", expected, err)
+		}
+		w := httptest.NewRecorder()
+		ch.SetHeaders(nil, w)
+		if header := w.Header().Get("WWW-Authenticate"); header != `Basic realm="test-realm"` {
+			t.Fatalf("unexpected challenge header: %q", header)
+		}
+	}
+
+	_, err = authorize("", "ci/app", "pull")
+	expectChallenge(err, auth.ErrInvalidCredential)
+
+	role := presign(t, s.URL, "AKIDROLE", testServerID)
+	grant, err := authorize(role, "ci/app", "push")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.User.Name != s.identities["AKIDROLE"] || len(grant.Resources) != 1 || grant.Resources[0].Name != "ci/app" {
+		t.Fatalf("unexpected grant: %#v", grant)
+	}
+
+	// identities are cached for the lifetime of the presigned request
+	calls := s.calls.Load()
+	if _, err := authorize(role, "ci/app", "pull"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.calls.Load() != calls {
+		t.Fatal("expected the identity to be cached")
+	}
+	ac.now = func() time.Time { return time.Now().Add(maxTokenAge + time.Minute) }
+	_, err = authorize(role, "ci/app", "pull")
+	expectChallenge(err, auth.ErrAuthenticationFailure)
+	ac.now = time.Now
+
+	user := presign(t, s.URL, "AKIDUSER", testServerID)
+	if _, err := authorize(user, "library/app", "pull"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = authorize(user, "ci/app", "push")
+	expectChallenge(err, ErrInsufficientScope)
+
+	// mallory's account is trusted, but no rule grants access to it
+	_, err = authorize(presign(t, s.URL, "AKIDOTHER", testServerID), "library/app", "pull")
+	expectChallenge(err, ErrInsufficientScope)
+
+	for name, password := range map[string]string{
+		"rejected by sts":         presign(t, s.URL, "AKIDUNKNOWN", testServerID),
+		"unbound":                 presign(t, s.URL, "AKIDUSER", ""),
+		"other endpoint":          presign(t, "https://sts.amazonaws.com", "AKIDUSER", testServerID),
+		"other action":            strings.Replace(user, "GetCallerIdentity", "GetSessionToken", 1),
+		"not a request":           "secret",
+		"not a presigned request": s.URL + "/?Action=GetCallerIdentity&Version=2011-06-15",
+		"invalid expiry":          user + "&X-Amz-Expires=soon",
+	} {
+		_, err = authorize(password, "library/app", "pull")
+		var ch *challenge
+		if !errors.As(err, &ch) || ch.err != auth.ErrAuthenticationFailure {
+			t.Errorf("%s: expected an authentication failure, got %v", name, err)
+		}
+	}
+}
+
+func TestUntrustedAccount(t *testing.T) {
+	s := newTestSTS(t)
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":       "test-realm",
+		"accounts":    []interface{}{"123456789012"},
+		"serverid":    testServerID,
+		"stsendpoint": s.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.SetBasicAuth("AWS", presign(t, s.URL, "AKIDOTHER", testServerID))
+	_, err = ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "app"}, Action: "pull"})
+	var ch *challenge
+	if !errors.As(err, &ch) || ch.err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected an authentication failure, got %v", err)
+	}
+
+	// without rules, the clients of trusted accounts are granted all access
+	req.SetBasicAuth("AWS", presign(t, s.URL, "AKIDUSER", testServerID))
+	if _, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "app"}, Action: "push"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDefaultServerID(t *testing.T) {
+	s := newTestSTS(t)
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":       testServerID,
+		"accounts":    []interface{}{"123456789012"},
+		"stsendpoint": s.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access := auth.Access{Resource: auth.Resource{Type: "repository", Name: "app"}, Action: "pull"}
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.SetBasicAuth("AWS", presign(t, s.URL, "AKIDUSER", testServerID))
+	if _, err := ac.Authorized(req, access); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// requests presigned without the realm as server ID are rejected
+	req.SetBasicAuth("AWS", presign(t, s.URL, "AKIDUSER", ""))
+	_, err = ac.Authorized(req, access)
+	var ch *challenge
+	if !errors.As(err, &ch) || ch.err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected an authentication failure, got %v", err)
+	}
+}
+
+func TestSTSUnavailable(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":       "test-realm",
+		"accounts":    []interface{}{"123456789012"},
+		"stsendpoint": s.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.SetBasicAuth("AWS", presign(t, s.URL, "AKIDUSER", "test-realm"))
+	_, err = ac.Authorized(req)
+	var ch auth.Challenge
+	if err == nil || errors.As(err, &ch) {
+		t.Fatalf("expected a non-challenge error, got %v", err)
+	}
+}
+
+func TestPrincipalARN(t *testing.T) {
+	for in, expected := range map[string]string{
+		"arn:aws:sts::123456789012:assumed-role/ci-builder/session":  "arn:aws:iam::123456789012:role/ci-builder",
+		"arn:aws-cn:sts::123456789012:assumed-role/ci-builder/i-012": "arn:aws-cn:iam::123456789012:role/ci-builder",
+		"arn:aws:iam::123456789012:user/path/alice":                  "arn:aws:iam::123456789012:user/path/alice",
+		"arn:aws:sts::123456789012:federated-user/bob":               "arn:aws:sts::123456789012:federated-user/bob",
+	} {
+		out, err := principalARN(in)
+		if err != nil || out != expected {
+			t.Errorf("unexpected principal ARN of %s: %s %v", in, out, err)
+		}
+	}
+	if _, err := principalARN("arn:aws:sts::123456789012:assumed-role/ci-builder"); err == nil {
+		t.Error("expected an error with an invalid assumed role ARN")
+	}
+}
+
+func TestSTSHost(t *testing.T) {
+	for host, expected := range map[string]bool{
+		"sts.amazonaws.com":                true,
+		"sts.eu-west-1.amazonaws.com":      true,
+		"sts-fips.us-east-1.amazonaws.com": true,
+		"sts.cn-north-1.amazonaws.com.cn":  true,
+		"sts.amazonaws.com.example.com":    false,
+		"sts.amazonaws.com:8443":           false,
+		"evil.com/sts.amazonaws.com":       false,
+		"s3.amazonaws.com":                 false,
+	} {
+		if stsHost.MatchString(host) != expected {
+			t.Errorf("unexpected match of %q", host)
+		}
+	}
+}
+
+func TestAccessControllerOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"accounts": []interface{}{"123456789012"}},
+		{"realm": "test-realm"},
+		{"realm": "test-realm", "accounts": []interface{}{}},
+		{"realm": "test-realm", "accounts": []interface{}{"1234"}},
+		{"realm": "test-realm", "accounts": []interface{}{"12345678901a"}},
+		{"realm": "test-realm", "accounts": []interface{}{"123456789012"}, "stsendpoint": "sts.amazonaws.com"},
+		{"realm": "test-realm", "accounts": []interface{}{"123456789012"}, "timeout": "soon"},
+		{"realm": "test-realm", "accounts": []interface{}{"123456789012"}, "serverid": ""},
+		{"realm": "test-realm", "accounts": []interface{}{"123456789012"}, "rules": []interface{}{map[interface{}]interface{}{"name": "**", "actions": []interface{}{"pull"}}}},
+	} {
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected error with options %v", options)
+		}
+	}
+}
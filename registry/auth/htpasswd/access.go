@@ -30,10 +30,15 @@ func init() {
 }
 
 type accessController struct {
-	realm    string
-	path     string
-	modtime  time.Time
+	realm          string
+	path           string
+	minCost        int
+	reloadInterval time.Duration
+	guard          *bruteForceGuard
+
 	mu       sync.Mutex
+	modtime  time.Time
+	checked  time.Time
 	htpasswd *htpasswd
 }
 
@@ -50,10 +55,66 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 	if !present || !ok {
 		return nil, fmt.Errorf(`"path" must be set for htpasswd access controller`)
 	}
-	if err := createHtpasswdFile(path); err != nil {
+
+	var minCost int
+	if c, present := options["mincost"]; present {
+		minCost, _ = c.(int)
+		if minCost < bcrypt.MinCost || minCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("htpasswd mincost must be an integer between %d and %d: %#v", bcrypt.MinCost, bcrypt.MaxCost, c)
+		}
+	}
+
+	var reloadInterval time.Duration
+	if i, present := options["reloadinterval"]; present {
+		s, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("htpasswd auth requires a valid option string: %q", "reloadinterval")
+		}
+		var err error
+		if reloadInterval, err = time.ParseDuration(s); err != nil || reloadInterval < 0 {
+			return nil, fmt.Errorf("unable to parse htpasswd reloadinterval: %q", s)
+		}
+	}
+
+	var guard *bruteForceGuard
+	if b, present := options["bruteforce"]; present {
+		var bruteForceOptions map[interface{}]interface{}
+		switch b := b.(type) {
+		case map[interface{}]interface{}:
+			bruteForceOptions = b
+		case map[string]interface{}:
+			bruteForceOptions = make(map[interface{}]interface{}, len(b))
+			for k, v := range b {
+				bruteForceOptions[k] = v
+			}
+		case nil:
+		default:
+			return nil, fmt.Errorf("htpasswd auth requires a valid option map: %q", "bruteforce")
+		}
+		var err error
+		if guard, err = newBruteForceGuard(bruteForceOptions); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := createHtpasswdFile(path, max(bcrypt.DefaultCost, minCost)); err != nil {
+		return nil, err
+	}
+
+	ac := &accessController{
+		realm:          realm.(string),
+		path:           path,
+		minCost:        minCost,
+		reloadInterval: reloadInterval,
+		guard:          guard,
+		checked:        time.Now(),
+	}
+	// an invalid file is reported at startup, later on the last valid
+	// credentials are kept until the file is fixed
+	if err := ac.reload(context.Background()); err != nil {
 		return nil, err
 	}
-	return &accessController{realm: realm.(string), path: path}, nil
+	return ac, nil
 }
 
 func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
@@ -65,45 +126,81 @@ func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.
 		}
 	}
 
-	// Dynamically parsing the latest account list
-	fstat, err := os.Stat(ac.path)
-	if err != nil {
-		return nil, err
-	}
-
-	lastModified := fstat.ModTime()
-	ac.mu.Lock()
-	if ac.htpasswd == nil || !ac.modtime.Equal(lastModified) {
-		ac.modtime = lastModified
-
-		f, err := os.Open(ac.path)
-		if err != nil {
-			ac.mu.Unlock()
-			return nil, err
-		}
-		defer f.Close()
-
-		h, err := newHTPasswd(f)
-		if err != nil {
-			ac.mu.Unlock()
-			return nil, err
+	var ip string
+	if ac.guard != nil {
+		ip = ac.guard.clientIP(req)
+		if remaining := ac.guard.locked(ip, username); remaining > 0 {
+			dcontext.GetLogger(req.Context()).Warnf("rejecting authentication of user %q from %s, locked out for %s after repeated failures", username, ip, remaining.Round(time.Second))
+			return nil, &challenge{
+				realm: ac.realm,
+				err:   auth.ErrAuthenticationFailure,
+			}
 		}
-		ac.htpasswd = h
 	}
-	localHTPasswd := ac.htpasswd
-	ac.mu.Unlock()
 
-	if err := localHTPasswd.authenticateUser(username, password); err != nil {
+	if err := ac.credentials(req.Context()).authenticateUser(username, password); err != nil {
 		dcontext.GetLogger(req.Context()).Errorf("error authenticating user %q: %v", username, err)
+		if ac.guard != nil {
+			sleep(req.Context(), ac.guard.fail(ip, username))
+		}
 		return nil, &challenge{
 			realm: ac.realm,
 			err:   auth.ErrAuthenticationFailure,
 		}
 	}
+	if ac.guard != nil {
+		ac.guard.succeed(username)
+	}
 
 	return &auth.Grant{User: auth.UserInfo{Name: username}}, nil
 }
 
+// credentials returns the latest account list, reloading the file if it
+// changed and was not checked within the reload interval.
+func (ac *accessController) credentials(ctx context.Context) *htpasswd {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if now := time.Now(); now.Sub(ac.checked) >= ac.reloadInterval {
+		ac.checked = now
+		if err := ac.reload(ctx); err != nil {
+			dcontext.GetLogger(ctx).Errorf("failed to reload htpasswd file, keeping the previous credentials: %v", err)
+		}
+	}
+	return ac.htpasswd
+}
+
+// reload parses the file if it was modified since it was last read. It must
+// be called with ac.mu held.
+func (ac *accessController) reload(ctx context.Context) error {
+	fstat, err := os.Stat(ac.path)
+	if err != nil {
+		return err
+	}
+	lastModified := fstat.ModTime()
+	if ac.htpasswd != nil && ac.modtime.Equal(lastModified) {
+		return nil
+	}
+	// a file failing to parse is only reported once per modification
+	ac.modtime = lastModified
+
+	f, err := os.Open(ac.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h, warnings, err := newHTPasswd(f, ac.minCost)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		dcontext.GetLogger(ctx).Warnf("htpasswd: %s", warning)
+	}
+	ac.htpasswd = h
+	return nil
+}
+
 // challenge implements the auth.Challenge interface.
 type challenge struct {
 	realm string
@@ -122,7 +219,7 @@ func (ch challenge) Error() string {
 }
 
 // createHtpasswdFile creates and populates htpasswd file with a new user in case the file is missing
-func createHtpasswdFile(path string) error {
+func createHtpasswdFile(path string, cost int) error {
 	if f, err := os.Open(path); err == nil {
 		f.Close()
 		return nil
@@ -143,7 +240,7 @@ func createHtpasswdFile(path string) error {
 		return err
 	}
 	pass := base64.RawURLEncoding.EncodeToString(secretBytes[:])
-	encryptedPass, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	encryptedPass, err := bcrypt.GenerateFromPassword([]byte(pass), cost)
 	if err != nil {
 		return err
 	}
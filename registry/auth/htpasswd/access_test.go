@@ -2,13 +2,18 @@ package htpasswd
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestBasicAccessController(t *testing.T) {
@@ -154,3 +159,121 @@ func TestCreateHtpasswdFile(t *testing.T) {
 		t.Fatalf("failed to find default user in file %s", string(content))
 	}
 }
+
+func TestReloadHtpasswdFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	modtime := time.Now()
+	writeFile := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// make each version distinguishable on coarse grained filesystems
+		modtime = modtime.Add(time.Second)
+		if err := os.Chtimes(path, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry := func(user, password string, cost int) string {
+		t.Helper()
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%s:%s\n", user, hash)
+	}
+
+	writeFile(entry("bilbo", "baggins", bcrypt.MinCost) + "bilbo")
+	if _, err := newAccessController(map[string]interface{}{"realm": "The-Shire", "path": path}); err == nil {
+		t.Fatal("expected invalid htpasswd file to be rejected")
+	}
+
+	writeFile(entry("bilbo", "baggins", bcrypt.MinCost) + entry("frodo", "baggins", bcrypt.MinCost+1))
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":   "The-Shire",
+		"path":    path,
+		"mincost": bcrypt.MinCost + 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized := func(user, password string) bool {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.SetBasicAuth(user, password)
+		_, err := ac.Authorized(req)
+		var ch *challenge
+		if err != nil && !errors.As(err, &ch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return err == nil
+	}
+
+	if authorized("bilbo", "baggins") {
+		t.Fatal("expected entry below the minimum cost to be ignored")
+	}
+	if !authorized("frodo", "baggins") {
+		t.Fatal("expected frodo to be authorized")
+	}
+
+	writeFile(entry("sam", "gamgee", bcrypt.MinCost+1))
+	if !authorized("sam", "gamgee") || authorized("frodo", "baggins") {
+		t.Fatal("expected credentials to be reloaded")
+	}
+
+	writeFile("invalid")
+	if !authorized("sam", "gamgee") {
+		t.Fatal("expected previous credentials to be kept when the file is invalid")
+	}
+
+	for _, options := range []map[string]interface{}{
+		{"mincost": 2},
+		{"mincost": "10"},
+		{"reloadinterval": "-1s"},
+		{"reloadinterval": 10},
+	} {
+		options["realm"] = "The-Shire"
+		options["path"] = path
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected error with options %v", options)
+		}
+	}
+}
+
+func TestReloadInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":          "The-Shire",
+		"path":           path,
+		"reloadinterval": "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("baggins"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("bilbo:"+string(hash)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.SetBasicAuth("bilbo", "baggins")
+	if _, err := ac.Authorized(req); err == nil {
+		t.Fatal("expected the file not to be reloaded within the reload interval")
+	}
+
+	ac.(*accessController).checked = time.Now().Add(-time.Hour)
+	if _, err := ac.Authorized(req); err != nil {
+		t.Fatalf("expected the file to be reloaded after the reload interval: %v", err)
+	}
+}
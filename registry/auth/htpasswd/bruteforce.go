@@ -0,0 +1,279 @@
+package htpasswd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/requestutil"
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+const (
+	defaultMaxFailures = 5
+	defaultLockout     = time.Minute
+	defaultMaxLockout  = time.Hour
+	defaultDelay       = 100 * time.Millisecond
+	defaultMaxDelay    = 5 * time.Second
+
+	// maxTrackedKeys bounds the memory used to track failures. Past it,
+	// new clients and usernames are not tracked until idle entries expire.
+	maxTrackedKeys = 100000
+)
+
+// Tracking scopes of failed authentication attempts.
+const (
+	scopeIP       = "ip"
+	scopeUsername = "username"
+)
+
+// bruteForceGuard tracks failed authentication attempts per client IP and
+// per username. After maxFailures consecutive failures, the IP or username
+// is locked out for the lockout duration, doubled at each successive lockout
+// up to maxLockout. Failed attempts are answered after a delay, doubled at
+// each consecutive failure up to maxDelay.
+type bruteForceGuard struct {
+	maxFailures int
+	lockout     time.Duration
+	maxLockout  time.Duration
+	delay       time.Duration
+	maxDelay    time.Duration
+	scopes      map[string]bool
+
+	// trustedProxies are the proxies whose forwarding headers carry the
+	// client IP. Without them, the client IP is the peer of the request.
+	trustedProxies []*net.IPNet
+
+	mu      sync.Mutex
+	entries map[trackingKey]*failures
+	now     func() time.Time
+}
+
+// failures is the failure record of a client IP or username.
+type failures struct {
+	count       int
+	lockouts    int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+// newBruteForceGuard configures a guard from the bruteforce option map.
+func newBruteForceGuard(options map[interface{}]interface{}) (*bruteForceGuard, error) {
+	g := &bruteForceGuard{
+		maxFailures: defaultMaxFailures,
+		lockout:     defaultLockout,
+		maxLockout:  defaultMaxLockout,
+		delay:       defaultDelay,
+		maxDelay:    defaultMaxDelay,
+		scopes:      map[string]bool{scopeIP: true, scopeUsername: true},
+		entries:     make(map[trackingKey]*failures),
+		now:         time.Now,
+	}
+
+	for k, v := range options {
+		key, _ := k.(string)
+		switch key {
+		case "maxfailures":
+			n, ok := v.(int)
+			if !ok || n < 1 {
+				return nil, fmt.Errorf("bruteforce maxfailures must be a positive integer: %#v", v)
+			}
+			g.maxFailures = n
+		case "lockout", "maxlockout", "delay", "maxdelay":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("bruteforce %s must be a duration string: %#v", key, v)
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("unable to parse bruteforce %s: %q", key, s)
+			}
+			switch key {
+			case "lockout":
+				g.lockout = d
+			case "maxlockout":
+				g.maxLockout = d
+			case "delay":
+				g.delay = d
+			case "maxdelay":
+				g.maxDelay = d
+			}
+		case "trackby":
+			list, ok := v.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, errors.New("bruteforce trackby must be a list of ip and username")
+			}
+			g.scopes = make(map[string]bool)
+			for _, scope := range list {
+				if scope != scopeIP && scope != scopeUsername {
+					return nil, fmt.Errorf("invalid bruteforce trackby %#v, must be ip or username", scope)
+				}
+				g.scopes[scope.(string)] = true
+			}
+		case "trustedproxies":
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, errors.New("bruteforce trustedproxies must be a list of IP addresses or CIDR ranges")
+			}
+			proxies := make([]string, 0, len(list))
+			for _, proxy := range list {
+				p, ok := proxy.(string)
+				if !ok {
+					return nil, fmt.Errorf("invalid bruteforce trusted proxy %#v", proxy)
+				}
+				proxies = append(proxies, p)
+			}
+			trusted, err := requestutil.ParseTrustedProxies(proxies)
+			if err != nil {
+				return nil, fmt.Errorf("bruteforce: %w", err)
+			}
+			g.trustedProxies = trusted
+		default:
+			return nil, fmt.Errorf("unknown bruteforce option %#v", k)
+		}
+	}
+	if g.maxLockout < g.lockout {
+		g.maxLockout = g.lockout
+	}
+	if g.maxDelay < g.delay {
+		g.maxDelay = g.delay
+	}
+
+	return g, nil
+}
+
+// clientIP returns the client IP of a request.
+func (g *bruteForceGuard) clientIP(req *http.Request) string {
+	return requestutil.TrustedRemoteIP(req, g.trustedProxies)
+}
+
+// trackingKey identifies a tracked client IP or username.
+type trackingKey struct {
+	scope string
+	value string
+}
+
+// keys returns the tracking keys of an attempt.
+func (g *bruteForceGuard) keys(ip, username string) []trackingKey {
+	keys := make([]trackingKey, 0, 2)
+	if g.scopes[scopeIP] && ip != "" {
+		keys = append(keys, trackingKey{scopeIP, ip})
+	}
+	if g.scopes[scopeUsername] && username != "" {
+		keys = append(keys, trackingKey{scopeUsername, username})
+	}
+	return keys
+}
+
+// locked returns how long the client IP or username remains locked out, if
+// either is.
+func (g *bruteForceGuard) locked(ip, username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	var remaining time.Duration
+	for _, key := range g.keys(ip, username) {
+		if f, ok := g.entries[key]; ok {
+			remaining = max(remaining, f.lockedUntil.Sub(now))
+		}
+	}
+	if remaining > 0 {
+		auth.LockedAttempts.WithValues("htpasswd").Inc(1)
+	}
+	return remaining
+}
+
+// fail records a failed attempt and returns how long the response should be
+// delayed.
+func (g *bruteForceGuard) fail(ip, username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	auth.FailedAttempts.WithValues("htpasswd").Inc(1)
+	now := g.now()
+	var delay time.Duration
+	for _, key := range g.keys(ip, username) {
+		f, ok := g.entries[key]
+		if !ok {
+			if len(g.entries) >= maxTrackedKeys {
+				g.prune(now)
+				if len(g.entries) >= maxTrackedKeys {
+					continue
+				}
+			}
+			f = &failures{}
+			g.entries[key] = f
+		}
+		if g.expired(f, now) {
+			*f = failures{}
+		}
+		f.count++
+		f.last = now
+
+		if g.delay > 0 {
+			delay = max(delay, backoff(g.delay, g.maxDelay, f.count-1))
+		}
+
+		if f.count >= g.maxFailures {
+			f.lockedUntil = now.Add(backoff(g.lockout, g.maxLockout, f.lockouts))
+			f.lockouts++
+			f.count = 0
+			auth.Lockouts.WithValues("htpasswd", key.scope).Inc(1)
+		}
+	}
+	return delay
+}
+
+// succeed clears the failures of a username. The failures of the client IP
+// are kept, so that a valid account does not reset the tracking of an
+// attacker sharing its IP.
+func (g *bruteForceGuard) succeed(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, key := range g.keys("", username) {
+		delete(g.entries, key)
+	}
+}
+
+// expired returns whether the failures are forgotten, after being idle for
+// longer than the maximum lockout.
+func (g *bruteForceGuard) expired(f *failures, now time.Time) bool {
+	return now.Sub(f.last) > g.maxLockout && now.After(f.lockedUntil)
+}
+
+// prune drops the expired entries. It must be called with g.mu held.
+func (g *bruteForceGuard) prune(now time.Time) {
+	for key, f := range g.entries {
+		if g.expired(f, now) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// backoff returns base doubled n times, capped to limit.
+func backoff(base, limit time.Duration, n int) time.Duration {
+	d := base
+	for i := 0; i < n && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
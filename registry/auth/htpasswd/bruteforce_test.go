@@ -0,0 +1,216 @@
+package htpasswd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestGuard(t *testing.T, options map[interface{}]interface{}) (*bruteForceGuard, *time.Time) {
+	t.Helper()
+	g, err := newBruteForceGuard(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func TestBruteForceGuardLockout(t *testing.T) {
+	g, now := newTestGuard(t, map[interface{}]interface{}{
+		"maxfailures": 3,
+		"lockout":     "1m",
+		"maxlockout":  "3m",
+	})
+
+	for i := 0; i < 2; i++ {
+		g.fail("10.0.0.1", "bob")
+	}
+	if remaining := g.locked("10.0.0.1", "bob"); remaining != 0 {
+		t.Fatalf("unexpected lockout before the maximum number of failures: %s", remaining)
+	}
+	g.fail("10.0.0.1", "bob")
+
+	// both the IP and the username are locked out
+	if remaining := g.locked("10.0.0.1", "alice"); remaining != time.Minute {
+		t.Fatalf("expected the IP to be locked out for 1m, got %s", remaining)
+	}
+	if remaining := g.locked("10.0.0.2", "bob"); remaining != time.Minute {
+		t.Fatalf("expected the username to be locked out for 1m, got %s", remaining)
+	}
+	if remaining := g.locked("10.0.0.2", "alice"); remaining != 0 {
+		t.Fatalf("unexpected lockout of another IP and username: %s", remaining)
+	}
+
+	// successive lockouts are doubled, up to the maximum lockout
+	for _, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		*now = now.Add(g.locked("10.0.0.1", "bob"))
+		for i := 0; i < 3; i++ {
+			g.fail("10.0.0.1", "bob")
+		}
+		if remaining := g.locked("10.0.0.1", "bob"); remaining != expected {
+			t.Fatalf("expected a lockout of %s, got %s", expected, remaining)
+		}
+	}
+
+	// a successful login clears the username, not the IP
+	*now = now.Add(3 * time.Minute)
+	g.fail("10.0.0.1", "bob")
+	g.succeed("bob")
+	g.fail("10.0.0.1", "bob")
+	g.fail("10.0.0.1", "bob")
+	if remaining := g.locked("10.0.0.3", "bob"); remaining != 0 {
+		t.Fatalf("expected the username failures to be cleared, got a lockout of %s", remaining)
+	}
+	if remaining := g.locked("10.0.0.1", "alice"); remaining != 3*time.Minute {
+		t.Fatalf("expected the IP failures to be kept, got a lockout of %s", remaining)
+	}
+
+	// failures are forgotten once idle for longer than the maximum lockout
+	*now = now.Add(time.Hour)
+	g.fail("10.0.0.1", "bob")
+	g.fail("10.0.0.1", "bob")
+	if remaining := g.locked("10.0.0.1", "bob"); remaining != 0 {
+		t.Fatalf("expected expired failures to be forgotten, got a lockout of %s", remaining)
+	}
+	g.fail("10.0.0.1", "bob")
+	if remaining := g.locked("10.0.0.1", "bob"); remaining != time.Minute {
+		t.Fatalf("expected the lockout to start over at 1m, got %s", remaining)
+	}
+}
+
+func TestBruteForceGuardDelay(t *testing.T) {
+	g, _ := newTestGuard(t, map[interface{}]interface{}{
+		"maxfailures": 100,
+		"delay":       "100ms",
+		"maxdelay":    "1s",
+		"trackby":     []interface{}{"username"},
+	})
+
+	for _, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if delay := g.fail("10.0.0.1", "bob"); delay != expected*time.Millisecond {
+			t.Fatalf("expected a delay of %s, got %s", expected*time.Millisecond, delay)
+		}
+	}
+	// the IP is not tracked
+	if delay := g.fail("10.0.0.1", "alice"); delay != 100*time.Millisecond {
+		t.Fatalf("expected a delay of 100ms for another username, got %s", delay)
+	}
+}
+
+func TestBruteForceGuardDefaultDelay(t *testing.T) {
+	g, _ := newTestGuard(t, map[interface{}]interface{}{})
+
+	// the delay grows with each consecutive failure until the lockout
+	var last time.Duration
+	for i := 1; i < defaultMaxFailures; i++ {
+		delay := g.fail("10.0.0.1", "bob")
+		if delay <= last {
+			t.Fatalf("expected failure %d to be delayed more than %s, got %s", i, last, delay)
+		}
+		last = delay
+	}
+	if last != 800*time.Millisecond {
+		t.Fatalf("expected a delay of 800ms after %d failures, got %s", defaultMaxFailures-1, last)
+	}
+
+	g, _ = newTestGuard(t, map[interface{}]interface{}{"delay": "0s"})
+	if delay := g.fail("10.0.0.1", "bob"); delay != 0 {
+		t.Fatalf("expected no delay when disabled, got %s", delay)
+	}
+}
+
+func TestBruteForceGuardOptions(t *testing.T) {
+	for _, options := range []map[interface{}]interface{}{
+		{"maxfailures": 0},
+		{"maxfailures": "5"},
+		{"lockout": "soon"},
+		{"delay": "-1s"},
+		{"trackby": []interface{}{"ip", "country"}},
+		{"trackby": "ip"},
+		{"trustedproxies": "10.0.0.1"},
+		{"trustedproxies": []interface{}{"10.0.0.1/33"}},
+		{"lockoutafter": 5},
+	} {
+		if _, err := newBruteForceGuard(options); err == nil {
+			t.Errorf("expected error with options %v", options)
+		}
+	}
+}
+
+func TestBruteForceGuardClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+
+	g, err := newBruteForceGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := g.clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("expected the forwarding header to be ignored, got %s", ip)
+	}
+
+	g, err = newBruteForceGuard(map[interface{}]interface{}{
+		"trustedproxies": []interface{}{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := g.clientIP(req); ip != "192.0.2.1" {
+		t.Errorf("expected the client IP forwarded by a trusted proxy, got %s", ip)
+	}
+}
+
+func TestBruteForceAccessController(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	hash, err := bcrypt.GenerateFromPassword([]byte("baggins"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("frodo:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm": "The-Shire",
+		"path":  path,
+		"bruteforce": map[interface{}]interface{}{
+			"maxfailures": 2,
+			"trackby":     []interface{}{"ip"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	authorize := func(password string) error {
+		attempts++
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		// forged forwarding headers do not evade the lockout
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("192.0.2.%d", attempts))
+		req.SetBasicAuth("frodo", password)
+		_, err := ac.Authorized(req)
+		return err
+	}
+
+	if err := authorize("baggins"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := authorize("gollum"); err == nil {
+			t.Fatal("expected an invalid password to be rejected")
+		}
+	}
+	if err := authorize("baggins"); err == nil {
+		t.Fatal("expected a valid password to be rejected during the lockout")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/distribution/distribution/v3/registry/auth"
@@ -17,14 +18,31 @@ type htpasswd struct {
 	entries map[string][]byte // maps username to password byte slice.
 }
 
-// newHTPasswd parses the reader and returns an htpasswd or an error.
-func newHTPasswd(rd io.Reader) (*htpasswd, error) {
+// newHTPasswd parses the reader and returns an htpasswd or an error. Entries
+// which are not bcrypt hashes, or whose cost is below minCost, are left out
+// and described by the returned warnings.
+func newHTPasswd(rd io.Reader, minCost int) (*htpasswd, []string, error) {
 	entries, err := parseHTPasswd(rd)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	var warnings []string
+	for username, credentials := range entries {
+		cost, err := bcrypt.Cost(credentials)
+		switch {
+		case err != nil:
+			warnings = append(warnings, fmt.Sprintf("ignoring entry for user %q: not a bcrypt hash", username))
+		case cost < minCost:
+			warnings = append(warnings, fmt.Sprintf("ignoring entry for user %q: bcrypt cost %d is below the minimum of %d", username, cost, minCost))
+		default:
+			continue
+		}
+		delete(entries, username)
 	}
+	sort.Strings(warnings)
 
-	return &htpasswd{entries: entries}, nil
+	return &htpasswd{entries: entries}, warnings, nil
 }
 
 // AuthenticateUser checks a given user:password credential against the
@@ -0,0 +1,289 @@
+// Package kerberos provides an authentication scheme that verifies the
+// Kerberos service tickets presented by clients through SPNEGO (the HTTP
+// Negotiate authentication scheme of RFC 4559), using the keys of a keytab,
+// and grants access to repositories based on the client principal.
+//
+// This allows clients logged in to a Kerberos realm, such as an Active
+// Directory domain, to authenticate without a password.
+package kerberos
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultMaxClockSkew = 5 * time.Minute
+
+// ErrInsufficientScope is returned when the rules do not grant the requested
+// access to an authenticated principal.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+func init() {
+	if err := auth.Register("kerberos", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register kerberos auth: %v", err)
+	}
+}
+
+type accessController struct {
+	settings *service.Settings
+	rules    []principalRule
+}
+
+var _ auth.AccessController = &accessController{}
+
+// principalRule grants actions on the resources matching a name pattern to
+// the principals matching a principal pattern.
+type principalRule struct {
+	principal *regexp.Regexp
+	typ       string
+	name      *regexp.Regexp
+	actions   map[string]struct{}
+}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	ac := &accessController{}
+
+	path, ok := options["keytab"].(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf("%q must be set for kerberos access controller", "keytab")
+	}
+
+	// the keys of any principal of the keytab are accepted, unless a
+	// service principal is configured
+	var servicePrincipal, serviceRealm string
+	if v, present := options["principal"]; present {
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("kerberos auth requires a valid option string: %q", "principal")
+		}
+		servicePrincipal = s
+		if i := strings.LastIndex(s, "@"); i >= 0 {
+			servicePrincipal, serviceRealm = s[:i], s[i+1:]
+		}
+	}
+
+	kt, err := keytab.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kerberos keytab: %v", err)
+	}
+	entries := kt.Entries[:0]
+	for _, e := range kt.Entries {
+		if servicePrincipal != "" && (strings.Join(e.Principal.Components, "/") != servicePrincipal || (serviceRealm != "" && e.Principal.Realm != serviceRealm)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no keys found in kerberos keytab %s", path)
+	}
+	kt.Entries = entries
+
+	maxClockSkew := defaultMaxClockSkew
+	if v, present := options["maxclockskew"]; present {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("kerberos auth requires a valid option string: %q", "maxclockskew")
+		}
+		if maxClockSkew, err = time.ParseDuration(s); err != nil || maxClockSkew <= 0 {
+			return nil, fmt.Errorf("unable to parse kerberos maxclockskew: %q", s)
+		}
+	}
+	// the PAC of Active Directory tickets is not used for authorization
+	ac.settings = service.NewSettings(kt, service.MaxClockSkew(maxClockSkew), service.DecodePAC(false))
+
+	if rules, present := options["rules"]; present {
+		ruleList, ok := rules.([]interface{})
+		if !ok {
+			return nil, errors.New("kerberos rules must be a list of principal rules")
+		}
+		for i, r := range ruleList {
+			rule, err := parsePrincipalRule(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid kerberos rule %d: %v", i, err)
+			}
+			ac.rules = append(ac.rules, rule)
+		}
+	}
+
+	return ac, nil
+}
+
+func parsePrincipalRule(v interface{}) (principalRule, error) {
+	options := make(map[string]interface{})
+	switch m := v.(type) {
+	case map[string]interface{}:
+		options = m
+	case map[interface{}]interface{}:
+		for k, val := range m {
+			if key, ok := k.(string); ok {
+				options[key] = val
+			}
+		}
+	default:
+		return principalRule{}, errors.New("principal rule must be a map")
+	}
+
+	rule := principalRule{typ: "repository", actions: make(map[string]struct{})}
+	principal, ok := options["principal"].(string)
+	if !ok || principal == "" {
+		return principalRule{}, errors.New(`"principal" must be set to a principal pattern`)
+	}
+	rule.principal = auth.CompilePattern(principal)
+	if typ, present := options["type"]; present {
+		if rule.typ, ok = typ.(string); !ok {
+			return principalRule{}, errors.New(`"type" must be a string`)
+		}
+	}
+
+	name, ok := options["name"].(string)
+	if !ok || name == "" {
+		return principalRule{}, errors.New(`"name" must be set to a resource name pattern`)
+	}
+	rule.name = auth.CompilePattern(name)
+
+	actions, ok := options["actions"].([]interface{})
+	if !ok || len(actions) == 0 {
+		return principalRule{}, errors.New(`"actions" must be a list of actions`)
+	}
+	for _, action := range actions {
+		a, ok := action.(string)
+		if !ok {
+			return principalRule{}, fmt.Errorf("invalid action %#v", action)
+		}
+		rule.actions[a] = struct{}{}
+	}
+
+	return rule, nil
+}
+
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Negotiate") || token == "" {
+		return nil, challenge{err: auth.ErrInvalidCredential}
+	}
+
+	principal, err := ac.authenticate(strings.TrimSpace(token))
+	if err != nil {
+		dcontext.GetLogger(req.Context()).Errorf("error authenticating kerberos client: %v", err)
+		return nil, challenge{err: auth.ErrAuthenticationFailure}
+	}
+
+	if !ac.authorized(principal, accessRecords) {
+		dcontext.GetLogger(req.Context()).Infof("kerberos rules do not grant %q access to %v", principal, accessRecords)
+		return nil, challenge{err: ErrInsufficientScope}
+	}
+
+	resources := make([]auth.Resource, 0, len(accessRecords))
+	seen := make(map[auth.Resource]struct{})
+	for _, access := range accessRecords {
+		if _, ok := seen[access.Resource]; !ok {
+			seen[access.Resource] = struct{}{}
+			resources = append(resources, access.Resource)
+		}
+	}
+
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: principal},
+		Resources: resources,
+	}, nil
+}
+
+// authenticate verifies the AP-REQ carried by a Negotiate token and returns
+// the client principal, as "name@REALM". The ticket is decrypted with the
+// keys of the keytab, and the authenticator is checked for clock skew and
+// replays.
+func (ac *accessController) authenticate(token string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("kerberos: invalid token encoding: %v", err)
+	}
+
+	// clients wrap the Kerberos token in a SPNEGO NegTokenInit, except
+	// those sending it bare
+	mechToken := data
+	var st spnego.SPNEGOToken
+	if err := st.Unmarshal(data); err == nil {
+		if !st.Init {
+			return "", errors.New("kerberos: expected a SPNEGO NegTokenInit")
+		}
+		mechToken = st.NegTokenInit.MechTokenBytes
+	}
+	var kt spnego.KRB5Token
+	if err := kt.Unmarshal(mechToken); err != nil {
+		return "", fmt.Errorf("kerberos: invalid token: %v", err)
+	}
+	if !kt.IsAPReq() {
+		return "", errors.New("kerberos: token is not an AP-REQ")
+	}
+
+	ok, creds, err := service.VerifyAPREQ(&kt.APReq, ac.settings)
+	if err != nil {
+		return "", fmt.Errorf("unable to verify ticket for %s@%s: %v", kt.APReq.Ticket.SName.PrincipalNameString(), kt.APReq.Ticket.Realm, err)
+	}
+	if !ok {
+		return "", fmt.Errorf("invalid ticket for %s@%s", kt.APReq.Ticket.SName.PrincipalNameString(), kt.APReq.Ticket.Realm)
+	}
+	return creds.CName().PrincipalNameString() + "@" + creds.Realm(), nil
+}
+
+// authorized returns whether the rules grant all the requested access.
+// Without rules, any authenticated principal is granted all access.
+func (ac *accessController) authorized(principal string, accessRecords []auth.Access) bool {
+	if len(ac.rules) == 0 {
+		return true
+	}
+
+	for _, access := range accessRecords {
+		granted := false
+		for _, rule := range ac.rules {
+			if rule.matches(principal, access) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return false
+		}
+	}
+	return true
+}
+
+func (r principalRule) matches(principal string, access auth.Access) bool {
+	if !r.principal.MatchString(principal) || r.typ != access.Type || !r.name.MatchString(access.Name) {
+		return false
+	}
+	if _, ok := r.actions[access.Action]; !ok {
+		if _, ok := r.actions["*"]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	err error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the Negotiate challenge header on the response.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Negotiate")
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("negotiate authentication challenge: %s", ch.err)
+}
@@ -0,0 +1,273 @@
+package kerberos
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	testRealm   = "EXAMPLE.COM"
+	testService = "HTTP/registry.example.com"
+)
+
+// testKey is a key of a service principal, derived from a password.
+type testKey struct {
+	principal string
+	realm     string
+	kvno      uint8
+	etype     int32
+	password  string
+}
+
+// newKeytab returns a keytab holding the keys.
+func newKeytab(t *testing.T, keys ...testKey) *keytab.Keytab {
+	t.Helper()
+	kt := keytab.New()
+	for _, k := range keys {
+		if err := kt.AddEntry(k.principal, k.realm, k.password, time.Now(), k.kvno, k.etype); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kt
+}
+
+// writeKeytab writes a keytab holding the keys to a file.
+func writeKeytab(t *testing.T, keys ...testKey) string {
+	t.Helper()
+	b, err := newKeytab(t, keys...).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "registry.keytab")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type testTicket struct {
+	client  string
+	key     testKey
+	endTime time.Time
+	ctime   time.Time
+	bare    bool
+}
+
+// negotiate returns the Negotiate token a client of the test realm sends to
+// the service, with a ticket encrypted in the service key.
+func negotiate(t *testing.T, tt testTicket) string {
+	t.Helper()
+	now := time.Now().UTC()
+	if tt.endTime.IsZero() {
+		tt.endTime = now.Add(10 * time.Hour)
+	}
+
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, tt.client)
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, tt.key.principal)
+	tkt, sessionKey, err := messages.NewTicket(cname, testRealm, sname, tt.key.realm, types.NewKrbFlags(),
+		newKeytab(t, tt.key), tt.key.etype, int(tt.key.kvno), now.Add(-time.Hour), now.Add(-time.Hour), tt.endTime, tt.endTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := types.NewAuthenticator(testRealm, cname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tt.ctime.IsZero() {
+		a.CTime = tt.ctime
+	}
+	req, err := messages.NewAPReq(tkt, sessionKey, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := asn1tools.AddASNAppTag(append(append(oid, 1, 0), b...), 0)
+
+	if !tt.bare {
+		st := spnego.SPNEGOToken{
+			Init: true,
+			NegTokenInit: spnego.NegTokenInit{
+				MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDMSLegacyKRB5.OID(), gssapi.OIDKRB5.OID()},
+				MechTokenBytes: token,
+			},
+		}
+		if token, err = st.Marshal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(token)
+}
+
+func newTestAccessController(t *testing.T, options map[string]interface{}, keys ...testKey) *accessController {
+	t.Helper()
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	options["keytab"] = writeKeytab(t, keys...)
+	ac, err := newAccessController(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac.(*accessController)
+}
+
+func TestAccessController(t *testing.T) {
+	oldKey := testKey{principal: testService, realm: testRealm, kvno: 1, etype: etypeID.AES256_CTS_HMAC_SHA1_96, password: "old"}
+	key := testKey{principal: testService, realm: testRealm, kvno: 2, etype: etypeID.AES256_CTS_HMAC_SHA1_96, password: "secret"}
+	ac := newTestAccessController(t, map[string]interface{}{
+		"principal": testService + "@" + testRealm,
+		"rules": []interface{}{
+			map[interface{}]interface{}{
+				"principal": "*@" + testRealm,
+				"name":      "library/**",
+				"actions":   []interface{}{"pull"},
+			},
+			map[interface{}]interface{}{
+				"principal": "alice@" + testRealm,
+				"name":      "**",
+				"actions":   []interface{}{"*"},
+			},
+		},
+	}, oldKey, key)
+
+	authorize := func(authorization, name, action string) (*auth.Grant, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return ac.Authorized(req, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   action,
+		})
+	}
+	expectChallenge := func(err, expected error) {
+		t.Helper()
+		var ch challenge
+		if !errors.As(err, &ch) || ch.err != expected {
+			t.Fatalf("expected a challenge for %v, got %v", expected, err)
+		}
+		w := httptest.NewRecorder()
+		ch.SetHeaders(nil, w)
+		if header := w.Header().Get("WWW-Authenticate"); header != "Negotiate" {
+			t.Fatalf("unexpected challenge header: %q", header)
+		}
+	}
+
+	_, err := authorize("", "alice/app", "pull")
+	expectChallenge(err, auth.ErrInvalidCredential)
+	_, err = authorize("Basic YWxpY2U6c2VjcmV0", "alice/app", "pull")
+	expectChallenge(err, auth.ErrInvalidCredential)
+
+	grant, err := authorize(negotiate(t, testTicket{client: "alice", key: key}), "alice/app", "push")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.User.Name != "alice@"+testRealm || len(grant.Resources) != 1 || grant.Resources[0].Name != "alice/app" {
+		t.Fatalf("unexpected grant: %#v", grant)
+	}
+
+	// tickets issued before a key rotation are still accepted
+	if _, err := authorize(negotiate(t, testTicket{client: "bob", key: oldKey, bare: true}), "library/app", "pull"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = authorize(negotiate(t, testTicket{client: "bob", key: key}), "alice/app", "pull")
+	expectChallenge(err, ErrInsufficientScope)
+	_, err = authorize(negotiate(t, testTicket{client: "HTTP/host.example.com", key: key}), "library/app", "pull")
+	expectChallenge(err, ErrInsufficientScope)
+
+	for name, tt := range map[string]testTicket{
+		"unknown key": {client: "alice", key: testKey{principal: testService, realm: testRealm, kvno: 3, etype: key.etype, password: key.password}},
+		"wrong key":   {client: "alice", key: testKey{principal: testService, realm: testRealm, kvno: 2, etype: key.etype, password: "wrong"}},
+		"other realm": {client: "alice", key: testKey{principal: testService, realm: "OTHER.COM", kvno: 2, etype: key.etype, password: key.password}},
+		"expired":     {client: "alice", key: key, endTime: time.Now().Add(-time.Hour)},
+		"clock skew":  {client: "alice", key: key, ctime: time.Now().Add(-time.Hour)},
+	} {
+		_, err = authorize(negotiate(t, tt), "alice/app", "pull")
+		var ch challenge
+		if !errors.As(err, &ch) || ch.err != auth.ErrAuthenticationFailure {
+			t.Errorf("%s: expected an authentication failure, got %v", name, err)
+		}
+	}
+
+	// a captured authorization header cannot be replayed
+	authorization := negotiate(t, testTicket{client: "alice", key: key})
+	if _, err := authorize(authorization, "alice/app", "pull"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = authorize(authorization, "alice/app", "pull")
+	expectChallenge(err, auth.ErrAuthenticationFailure)
+
+	_, err = authorize("Negotiate TlRMTVNTUAABAAAAl4II4gAAAAAAAAAAAAAAAAAAAAAKAGFKAAAADw==", "alice/app", "pull")
+	expectChallenge(err, auth.ErrAuthenticationFailure)
+}
+
+func TestAccessControllerWithoutRules(t *testing.T) {
+	key := testKey{principal: testService, realm: testRealm, kvno: 1, etype: etypeID.AES128_CTS_HMAC_SHA1_96, password: "secret"}
+	ac := newTestAccessController(t, nil, key)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set("Authorization", negotiate(t, testTicket{client: "carol", key: key}))
+	grant, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "carol/app"}, Action: "push"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.User.Name != "carol@"+testRealm {
+		t.Fatalf("unexpected user %q", grant.User.Name)
+	}
+}
+
+func TestAccessControllerOptions(t *testing.T) {
+	keytab := writeKeytab(t, testKey{principal: testService, realm: testRealm, kvno: 1, etype: etypeID.AES256_CTS_HMAC_SHA1_96, password: "secret"})
+	empty := writeKeytab(t)
+	invalid := filepath.Join(t.TempDir(), "invalid.keytab")
+	if err := os.WriteFile(invalid, []byte{5, 2, 0, 0, 0, 10, 0}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, options := range []map[string]interface{}{
+		{},
+		{"keytab": filepath.Join(t.TempDir(), "missing.keytab")},
+		{"keytab": invalid},
+		{"keytab": empty},
+		{"keytab": keytab, "principal": "HTTP/other.example.com"},
+		{"keytab": keytab, "principal": testService + "@OTHER.COM"},
+		{"keytab": keytab, "maxclockskew": "soon"},
+		{"keytab": keytab, "rules": "alice"},
+		{"keytab": keytab, "rules": []interface{}{map[interface{}]interface{}{"name": "**", "actions": []interface{}{"pull"}}}},
+		{"keytab": keytab, "rules": []interface{}{map[interface{}]interface{}{"principal": "*", "actions": []interface{}{"pull"}}}},
+		{"keytab": keytab, "rules": []interface{}{map[interface{}]interface{}{"principal": "*", "name": "**"}}},
+	} {
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected error with options %v", options)
+		}
+	}
+
+	if _, err := newAccessController(map[string]interface{}{"keytab": keytab, "principal": testService, "maxclockskew": "1m"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+// Package ldap provides an authentication scheme that checks user
+// credentials against an LDAP directory, such as OpenLDAP or Active
+// Directory, and grants access to repositories based on the groups the user
+// is a member of.
+//
+// Credentials are sent using basic authentication, so this authentication
+// method MUST be used under TLS.
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUserFilter     = "(uid=%s)"
+	defaultGroupAttribute = "memberOf"
+	defaultPoolSize       = 10
+	defaultTimeout        = 10 * time.Second
+)
+
+// ErrInsufficientScope is returned when the groups of an authenticated user
+// do not grant the requested access.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+// errAuthenticationFailed is returned when the user is unknown or the
+// credentials are rejected by the directory.
+var errAuthenticationFailed = errors.New("invalid credentials")
+
+func init() {
+	if err := auth.Register("ldap", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register ldap auth: %v", err)
+	}
+}
+
+type accessController struct {
+	realm          string
+	baseDN         string
+	bindDN         string
+	bindPassword   string
+	userFilter     string
+	groupAttribute string
+	groups         []groupRule
+	timeout        time.Duration
+
+	pool *pool
+}
+
+var _ auth.AccessController = &accessController{}
+
+// groupRule grants actions on the resources matching a name pattern to the
+// members of a group.
+type groupRule struct {
+	group   string
+	typ     string
+	name    *regexp.Regexp
+	actions map[string]struct{}
+}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	ac := &accessController{
+		userFilter:     defaultUserFilter,
+		groupAttribute: defaultGroupAttribute,
+	}
+
+	var rawURL string
+	required := []struct {
+		key  string
+		dest *string
+	}{{"realm", &ac.realm}, {"url", &rawURL}, {"basedn", &ac.baseDN}}
+	optional := map[string]*string{
+		"binddn":         &ac.bindDN,
+		"bindpassword":   &ac.bindPassword,
+		"userfilter":     &ac.userFilter,
+		"groupattribute": &ac.groupAttribute,
+	}
+	for _, opt := range required {
+		val, ok := options[opt.key].(string)
+		if !ok || val == "" {
+			return nil, fmt.Errorf("%q must be set for ldap access controller", opt.key)
+		}
+		*opt.dest = val
+	}
+	for key, dest := range optional {
+		if val, present := options[key]; present {
+			s, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("ldap auth requires a valid option string: %q", key)
+			}
+			*dest = s
+		}
+	}
+
+	if !strings.Contains(ac.userFilter, "%s") {
+		return nil, fmt.Errorf("ldap userfilter %q must contain %%s", ac.userFilter)
+	}
+	if _, err := goldap.CompileFilter(strings.ReplaceAll(ac.userFilter, "%s", "user")); err != nil {
+		return nil, fmt.Errorf("invalid ldap userfilter %q: %v", ac.userFilter, err)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ldap url: %v", err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("ldap url must use the ldap or ldaps scheme: %q", u)
+	}
+
+	startTLS, err := boolOption(options, "starttls")
+	if err != nil {
+		return nil, err
+	}
+	skipVerify, err := boolOption(options, "skipverify")
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: skipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if bundle, present := options["rootcertbundle"]; present {
+		bundlePath, ok := bundle.(string)
+		if !ok {
+			return nil, fmt.Errorf("ldap auth requires a valid option string: %q", "rootcertbundle")
+		}
+		pem, err := os.ReadFile(bundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ldap rootcertbundle: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ldap rootcertbundle %s", bundlePath)
+		}
+	}
+
+	poolSize := defaultPoolSize
+	if size, present := options["poolsize"]; present {
+		poolSize, _ = size.(int)
+		if poolSize <= 0 {
+			return nil, fmt.Errorf("ldap poolsize must be a positive integer: %#v", size)
+		}
+	}
+
+	ac.timeout = defaultTimeout
+	if t, present := options["timeout"]; present {
+		s, ok := t.(string)
+		if !ok {
+			return nil, fmt.Errorf("ldap auth requires a valid option string: %q", "timeout")
+		}
+		if ac.timeout, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("unable to parse ldap timeout: %v", err)
+		}
+	}
+
+	if groups, present := options["groups"]; present {
+		groupList, ok := groups.([]interface{})
+		if !ok {
+			return nil, errors.New("ldap groups must be a list of group rules")
+		}
+		for i, g := range groupList {
+			rule, err := parseGroupRule(g)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ldap group rule %d: %v", i, err)
+			}
+			ac.groups = append(ac.groups, rule)
+		}
+	}
+
+	ac.pool = newPool(poolSize, func() (*goldap.Conn, error) {
+		return dial(u, tlsConfig, startTLS, ac.timeout)
+	})
+
+	return ac, nil
+}
+
+func boolOption(options map[string]interface{}, key string) (bool, error) {
+	val, present := options[key]
+	if !present {
+		return false, nil
+	}
+	b, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("ldap auth requires a valid option bool: %q", key)
+	}
+	return b, nil
+}
+
+func parseGroupRule(v interface{}) (groupRule, error) {
+	options := make(map[string]interface{})
+	switch m := v.(type) {
+	case map[string]interface{}:
+		options = m
+	case map[interface{}]interface{}:
+		for k, val := range m {
+			if key, ok := k.(string); ok {
+				options[key] = val
+			}
+		}
+	default:
+		return groupRule{}, errors.New("group rule must be a map")
+	}
+
+	rule := groupRule{typ: "repository", actions: make(map[string]struct{})}
+	group, ok := options["group"].(string)
+	if !ok || group == "" {
+		return groupRule{}, errors.New(`"group" must be set to a group DN`)
+	}
+	rule.group = group
+	if typ, present := options["type"]; present {
+		if rule.typ, ok = typ.(string); !ok {
+			return groupRule{}, errors.New(`"type" must be a string`)
+		}
+	}
+
+	name, ok := options["name"].(string)
+	if !ok || name == "" {
+		return groupRule{}, errors.New(`"name" must be set to a resource name pattern`)
+	}
+	rule.name = auth.CompilePattern(name)
+
+	actions, ok := options["actions"].([]interface{})
+	if !ok || len(actions) == 0 {
+		return groupRule{}, errors.New(`"actions" must be a list of actions`)
+	}
+	for _, action := range actions {
+		a, ok := action.(string)
+		if !ok {
+			return groupRule{}, fmt.Errorf("invalid action %#v", action)
+		}
+		rule.actions[a] = struct{}{}
+	}
+
+	return rule, nil
+}
+
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrInvalidCredential,
+		}
+	}
+
+	// NOTE: a simple bind with a DN and an empty password is an
+	// unauthenticated bind, which most servers accept: it must never be
+	// taken as a proof of identity.
+	if username == "" || password == "" {
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+
+	groups, err := ac.authenticate(username, password)
+	if err != nil {
+		if err != errAuthenticationFailed {
+			return nil, err
+		}
+		dcontext.GetLogger(req.Context()).Errorf("error authenticating user %q: %v", username, err)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+
+	if !ac.authorized(groups, accessRecords) {
+		dcontext.GetLogger(req.Context()).Infof("ldap groups of user %q do not grant access to %v", username, accessRecords)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   ErrInsufficientScope,
+		}
+	}
+
+	resources := make([]auth.Resource, 0, len(accessRecords))
+	seen := make(map[auth.Resource]struct{})
+	for _, access := range accessRecords {
+		if _, ok := seen[access.Resource]; !ok {
+			seen[access.Resource] = struct{}{}
+			resources = append(resources, access.Resource)
+		}
+	}
+
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: username},
+		Resources: resources,
+	}, nil
+}
+
+// authenticate verifies the credentials of a user and returns the groups
+// the user is a member of. Pooled connections which turn out to have been
+// closed by the server are retried once with a new connection.
+func (ac *accessController) authenticate(username, password string) ([]string, error) {
+	groups, err := ac.tryAuthenticate(username, password)
+	if goldap.IsErrorWithCode(err, goldap.ErrorNetwork) {
+		groups, err = ac.tryAuthenticate(username, password)
+	}
+	return groups, err
+}
+
+func (ac *accessController) tryAuthenticate(username, password string) ([]string, error) {
+	c, err := ac.pool.get()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to ldap server: %w", err)
+	}
+	defer ac.pool.put(c)
+
+	// The service account is bound again on every use, since connections
+	// are left bound as the last authenticated user.
+	if ac.bindPassword == "" {
+		err = c.UnauthenticatedBind(ac.bindDN)
+	} else {
+		err = c.Bind(ac.bindDN, ac.bindPassword)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap service account bind failed: %w", err)
+	}
+
+	result, err := c.Search(goldap.NewSearchRequest(
+		ac.baseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		searchSizeLimit, int(ac.timeout/time.Second), false,
+		strings.ReplaceAll(ac.userFilter, "%s", goldap.EscapeFilter(username)),
+		[]string{ac.groupAttribute}, nil,
+	))
+	if err != nil && !goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		// unknown and ambiguous users alike
+		return nil, errAuthenticationFailed
+	}
+
+	if err := c.Bind(result.Entries[0].DN, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return nil, errAuthenticationFailed
+		}
+		return nil, err
+	}
+
+	return result.Entries[0].GetEqualFoldAttributeValues(ac.groupAttribute), nil
+}
+
+// authorized returns whether the groups grant all the requested access.
+// Without group rules, any authenticated user is granted all access.
+func (ac *accessController) authorized(groups []string, accessRecords []auth.Access) bool {
+	if len(ac.groups) == 0 {
+		return true
+	}
+
+	for _, access := range accessRecords {
+		granted := false
+		for _, rule := range ac.groups {
+			if rule.matches(groups, access) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return false
+		}
+	}
+	return true
+}
+
+func (r groupRule) matches(groups []string, access auth.Access) bool {
+	if r.typ != access.Type || !r.name.MatchString(access.Name) {
+		return false
+	}
+	if _, ok := r.actions[access.Action]; !ok {
+		if _, ok := r.actions["*"]; !ok {
+			return false
+		}
+	}
+	for _, group := range groups {
+		// DNs are compared case insensitively, as most directory
+		// attributes are.
+		if strings.EqualFold(group, r.group) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
@@ -0,0 +1,214 @@
+package ldap
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testServiceDN       = "cn=registry,dc=example,dc=com"
+	testServicePassword = "service-secret"
+	testGroupDN         = "cn=Developers,ou=groups,dc=example,dc=com"
+)
+
+type testUser struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+// testServer is a minimal LDAP server supporting simple binds and equality
+// searches on the uid attribute.
+type testServer struct {
+	listener    net.Listener
+	users       map[string]testUser
+	connections atomic.Int32
+}
+
+func newTestServer(t *testing.T, users map[string]testUser) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: l, users: users}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.connections.Add(1)
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testServer) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		msg, err := ber.ReadPacket(c)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id := msg.Children[0].Value
+		reply := func(op *ber.Packet) {
+			resp := ber.NewSequence("")
+			resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			resp.AppendChild(op)
+			_, _ = c.Write(resp.Bytes())
+		}
+
+		op := msg.Children[1]
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := goldap.LDAPResultInvalidCredentials
+			if dn == testServiceDN && password == testServicePassword {
+				code = goldap.LDAPResultSuccess
+			}
+			for _, user := range s.users {
+				if dn == user.dn && password == user.password {
+					code = goldap.LDAPResultSuccess
+				}
+			}
+			reply(ldapResult(goldap.ApplicationBindResponse, code))
+		case goldap.ApplicationSearchRequest:
+			filter := op.Children[6]
+			if filter.Tag == goldap.FilterEqualityMatch && filter.Children[0].Data.String() == "uid" {
+				if user, ok := s.users[filter.Children[1].Data.String()]; ok {
+					groups := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, group := range user.groups {
+						groups.AppendChild(octetString(group))
+					}
+					attr := ber.NewSequence("")
+					attr.AppendChild(octetString("memberOf"))
+					attr.AppendChild(groups)
+					attrs := ber.NewSequence("")
+					attrs.AppendChild(attr)
+					entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "")
+					entry.AppendChild(octetString(user.dn))
+					entry.AppendChild(attrs)
+					reply(entry)
+				}
+			}
+			reply(ldapResult(goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+func octetString(s string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	p.AppendChild(octetString(""))
+	p.AppendChild(octetString(""))
+	return p
+}
+
+func TestLDAPAccessController(t *testing.T) {
+	server := newTestServer(t, map[string]testUser{
+		"alice": {dn: "uid=alice,ou=people,dc=example,dc=com", password: "alice-secret", groups: []string{strings.ToLower(testGroupDN)}},
+		"bob":   {dn: "uid=bob,ou=people,dc=example,dc=com", password: "bob-secret"},
+	})
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":        "ldap-realm",
+		"url":          server.url(),
+		"basedn":       "dc=example,dc=com",
+		"binddn":       testServiceDN,
+		"bindpassword": testServicePassword,
+		"poolsize":     2,
+		"groups": []interface{}{
+			map[interface{}]interface{}{
+				"group":   testGroupDN,
+				"name":    "dev/**",
+				"actions": []interface{}{"pull", "push"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushDev := []auth.Access{
+		{Resource: auth.Resource{Type: "repository", Name: "dev/app"}, Action: "pull"},
+		{Resource: auth.Resource{Type: "repository", Name: "dev/app"}, Action: "push"},
+	}
+	authorize := func(username, password string) (*auth.Grant, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/dev/app/manifests/latest", nil)
+		req.SetBasicAuth(username, password)
+		return ac.Authorized(req, pushDev...)
+	}
+	expectChallenge := func(err, expected error) {
+		t.Helper()
+		var ch *challenge
+		if !errors.As(err, &ch) || ch.err != expected {
+			t.Fatalf("expected challenge with %v, got %v", expected, err)
+		}
+	}
+
+	grant, err := authorize("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("unexpected error authorizing group member: %v", err)
+	}
+	if grant.User.Name != "alice" || len(grant.Resources) != 1 || grant.Resources[0].Name != "dev/app" {
+		t.Fatalf("unexpected grant %+v", grant)
+	}
+
+	_, err = authorize("bob", "bob-secret")
+	expectChallenge(err, ErrInsufficientScope)
+
+	_, err = authorize("alice", "wrong")
+	expectChallenge(err, auth.ErrAuthenticationFailure)
+
+	_, err = authorize("alice", "")
+	expectChallenge(err, auth.ErrAuthenticationFailure)
+
+	_, err = authorize("carol", "carol-secret")
+	expectChallenge(err, auth.ErrAuthenticationFailure)
+
+	_, err = authorize("*", "alice-secret")
+	expectChallenge(err, auth.ErrAuthenticationFailure)
+
+	_, err = ac.Authorized(httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	expectChallenge(err, auth.ErrInvalidCredential)
+
+	if n := server.connections.Load(); n != 1 {
+		t.Fatalf("expected connections to be reused, got %d connections", n)
+	}
+}
+
+func TestAccessControllerOptions(t *testing.T) {
+	for _, userFilter := range []string{"uid=%s", "(uid=%s", "(uid=%s)(cn=%s)", "(cn=admin)"} {
+		_, err := newAccessController(map[string]interface{}{
+			"realm":      "ldap-realm",
+			"url":        "ldap://ldap.example.com",
+			"basedn":     "dc=example,dc=com",
+			"userfilter": userFilter,
+		})
+		if err == nil {
+			t.Errorf("expected error with userfilter %q", userFilter)
+		}
+	}
+}
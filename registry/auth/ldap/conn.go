@@ -0,0 +1,72 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// searchSizeLimit is enough entries to tell a unique match from an ambiguous
+// one.
+const searchSizeLimit = 2
+
+// dial connects to the server at the given ldap:// or ldaps:// URL,
+// upgrading plain connections with StartTLS if requested.
+func dial(u *url.URL, tlsConfig *tls.Config, startTLS bool, timeout time.Duration) (*goldap.Conn, error) {
+	c, err := goldap.DialURL(u.String(),
+		goldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		goldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(timeout)
+
+	if startTLS && u.Scheme == "ldap" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// pool keeps idle connections to the directory server for reuse.
+type pool struct {
+	idle chan *goldap.Conn
+	dial func() (*goldap.Conn, error)
+}
+
+func newPool(size int, dial func() (*goldap.Conn, error)) *pool {
+	return &pool{
+		idle: make(chan *goldap.Conn, size),
+		dial: dial,
+	}
+}
+
+// get returns an idle connection, or a new one if none is available.
+func (p *pool) get() (*goldap.Conn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+		return p.dial()
+	}
+}
+
+// put returns a connection to the pool. Closed connections, and those in
+// excess of the pool size, are dropped.
+func (p *pool) put(c *goldap.Conn) {
+	if c.IsClosing() {
+		c.Close()
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
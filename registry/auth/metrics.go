@@ -0,0 +1,23 @@
+package auth
+
+import (
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/docker/go-metrics"
+)
+
+// Metrics shared by the access controllers and the registry. They are
+// created here so that they are all known when the namespace is registered.
+var (
+	// FailedAttempts is the number of failed authentication attempts
+	FailedAttempts = prometheus.AuthNamespace.NewLabeledCounter("failed_attempts", "The number of failed authentication attempts", "controller")
+	// Lockouts is the number of temporary lockouts of a client IP or username
+	Lockouts = prometheus.AuthNamespace.NewLabeledCounter("lockouts", "The number of temporary lockouts", "controller", "scope")
+	// LockedAttempts is the number of authentication attempts rejected during a lockout
+	LockedAttempts = prometheus.AuthNamespace.NewLabeledCounter("locked_attempts", "The number of authentication attempts rejected during a lockout", "controller")
+	// Denials is the number of requests denied by the access controller or the policy
+	Denials = prometheus.AuthNamespace.NewLabeledCounter("denials", "The number of denied requests", "source")
+)
+
+func init() {
+	metrics.Register(prometheus.AuthNamespace)
+}
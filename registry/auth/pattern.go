@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CompilePattern compiles a resource name pattern, where "*" matches any
+// sequence of characters other than "/" and "**" matches any sequence of
+// characters, into an anchored regular expression.
+func CompilePattern(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, part := range strings.Split(pattern, "**") {
+		if i > 0 {
+			expr.WriteString(".*")
+		}
+		expr.WriteString(strings.ReplaceAll(regexp.QuoteMeta(part), `\*`, "[^/]*"))
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
@@ -0,0 +1,22 @@
+package auth
+
+import "testing"
+
+func TestCompilePattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"prod/*", "prod/app", true},
+		{"prod/*", "prod/app/api", false},
+		{"prod/**", "prod/app/api", true},
+		{"**", "anything/at/all", true},
+		{"foo.bar/*", "fooXbar/app", false},
+		{"library/ubuntu", "library/ubuntu", true},
+	} {
+		if CompilePattern(tc.pattern).MatchString(tc.name) != tc.match {
+			t.Errorf("pattern %q matching %q: expected %t", tc.pattern, tc.name, tc.match)
+		}
+	}
+}
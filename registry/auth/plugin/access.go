@@ -0,0 +1,369 @@
+// Package plugin provides an access controller delegating authentication and
+// authorization to an external command or gRPC server, so that custom logic
+// can be deployed without recompiling the registry.
+//
+// For each request, the command is executed with a JSON description of the
+// request on its standard input:
+//
+//	{
+//		"method": "GET",
+//		"path": "/v2/library/app/manifests/latest",
+//		"remoteaddr": "10.0.0.1",
+//		"headers": {"Authorization": ["Basic Ym9iOmJvYg=="]},
+//		"access": [{"type": "repository", "name": "library/app", "action": "pull"}]
+//	}
+//
+// and must write a JSON decision to its standard output:
+//
+//	{"allowed": true, "user": "bob"}
+//	{"allowed": false, "reason": "...", "challenge": "Basic realm=\"registry\""}
+//
+// A command exiting with a non-zero status, or writing an invalid decision,
+// fails the request.
+//
+// A gRPC server instead receives the request, and returns the decision, as
+// google.protobuf.Struct messages of the same form, through AuthorizeMethod.
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/requestutil"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// ErrDenied is returned when the plugin denies the request.
+var ErrDenied = errors.New("access denied by plugin")
+
+// forwardedHeaders are the request headers passed to the plugin.
+var forwardedHeaders = []string{"Authorization", "User-Agent", "X-Forwarded-For", "X-Real-Ip"}
+
+func init() {
+	if err := auth.Register("plugin", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register plugin auth: %v", err)
+	}
+}
+
+// Request is the description of a request passed to the plugin.
+type Request struct {
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	RemoteAddr string              `json:"remoteaddr"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Access     []Access            `json:"access"`
+}
+
+// Access is a requested or granted access to a resource.
+type Access struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+// Decision is the decision returned by the plugin.
+type Decision struct {
+	// Allowed grants the requested access.
+	Allowed bool `json:"allowed"`
+
+	// User is the name of the authenticated user, if any.
+	User string `json:"user,omitempty"`
+
+	// Reason explains a denial. It is logged, not returned to the client.
+	Reason string `json:"reason,omitempty"`
+
+	// Challenge is the WWW-Authenticate header returned to the client on
+	// denial. It defaults to a basic challenge for the configured realm.
+	Challenge string `json:"challenge,omitempty"`
+}
+
+type accessController struct {
+	realm   string
+	command string
+	args    []string
+	address string
+	conn    *grpc.ClientConn
+	timeout time.Duration
+
+	// trustedProxies are the proxies whose forwarding headers carry the
+	// remote address of the clients.
+	trustedProxies []*net.IPNet
+
+	// run passes the given input to the plugin and returns its output.
+	run func(ctx context.Context, input []byte) ([]byte, error)
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	realm, present := options["realm"]
+	if _, ok := realm.(string); !present || !ok {
+		return nil, fmt.Errorf(`"realm" must be set for plugin access controller`)
+	}
+
+	var command, address string
+	if c, present := options["command"]; present {
+		s, ok := c.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("plugin auth requires a valid option string: %q", "command")
+		}
+		command = s
+	}
+	if a, present := options["address"]; present {
+		s, ok := a.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("plugin auth requires a valid option string: %q", "address")
+		}
+		address = s
+	}
+	if (command == "") == (address == "") {
+		return nil, fmt.Errorf(`exactly one of "command" and "address" must be set for plugin access controller`)
+	}
+
+	var args []string
+	if a, present := options["args"]; present {
+		if command == "" {
+			return nil, fmt.Errorf(`plugin args require "command" to be set`)
+		}
+		list, ok := a.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("plugin args must be a list of strings: %#v", a)
+		}
+		for _, arg := range list {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid plugin argument: %#v", arg)
+			}
+			args = append(args, s)
+		}
+	}
+
+	timeout := defaultTimeout
+	if t, present := options["timeout"]; present {
+		s, ok := t.(string)
+		if !ok {
+			return nil, fmt.Errorf("plugin auth requires a valid option string: %q", "timeout")
+		}
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("unable to parse plugin timeout: %q", s)
+		}
+	}
+
+	var trustedProxies []*net.IPNet
+	if tp, present := options["trustedproxies"]; present {
+		list, ok := tp.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("plugin trustedproxies must be a list of IP addresses or CIDR ranges: %#v", tp)
+		}
+		proxies := make([]string, 0, len(list))
+		for _, proxy := range list {
+			s, ok := proxy.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid plugin trusted proxy: %#v", proxy)
+			}
+			proxies = append(proxies, s)
+		}
+		var err error
+		if trustedProxies, err = requestutil.ParseTrustedProxies(proxies); err != nil {
+			return nil, fmt.Errorf("plugin: %w", err)
+		}
+	}
+
+	tlsConfig, err := parseTLSOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if address == "" && tlsConfig != nil {
+		return nil, fmt.Errorf(`plugin TLS options require "address" to be set`)
+	}
+	// the Authorization header of clients is forwarded to the plugin: it
+	// must not be sent in clear over the network
+	if address != "" && tlsConfig == nil && !strings.HasPrefix(address, "unix:") {
+		return nil, fmt.Errorf("plugin address %q must be a unix socket unless TLS is configured", address)
+	}
+
+	ac := &accessController{
+		realm:          realm.(string),
+		command:        command,
+		args:           args,
+		address:        address,
+		timeout:        timeout,
+		trustedProxies: trustedProxies,
+	}
+	if address != "" {
+		conn, err := dial(address, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		ac.conn = conn
+		ac.run = ac.invoke
+	} else {
+		ac.run = ac.exec
+	}
+	return ac, nil
+}
+
+// parseTLSOptions returns the TLS configuration of the connection to the
+// plugin server, or nil if no TLS option is set.
+func parseTLSOptions(options map[string]interface{}) (*tls.Config, error) {
+	paths := make(map[string]string)
+	for _, key := range []string{"rootcertbundle", "certificate", "key"} {
+		if v, present := options[key]; present {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("plugin auth requires a valid option string: %q", key)
+			}
+			paths[key] = s
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if bundlePath, ok := paths["rootcertbundle"]; ok {
+		pem, err := os.ReadFile(bundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read plugin rootcertbundle: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in plugin rootcertbundle %s", bundlePath)
+		}
+	}
+
+	certPath, hasCert := paths["certificate"]
+	keyPath, hasKey := paths["key"]
+	if hasCert != hasKey {
+		return nil, fmt.Errorf(`plugin "certificate" and "key" must be set together`)
+	}
+	if hasCert {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load plugin client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// exec runs the command, writing input to its standard input.
+func (ac *accessController) exec(ctx context.Context, input []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ac.command, ac.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// name describes the plugin in errors.
+func (ac *accessController) name() string {
+	if ac.address != "" {
+		return "server " + ac.address
+	}
+	return "command " + ac.command
+}
+
+// Authorized calls the plugin and applies its decision.
+func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Access) (*auth.Grant, error) {
+	input := Request{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		RemoteAddr: requestutil.TrustedRemoteIP(req, ac.trustedProxies),
+		Headers:    make(map[string][]string),
+		Access:     make([]Access, 0, len(accessItems)),
+	}
+	for _, name := range forwardedHeaders {
+		if values := req.Header.Values(name); len(values) > 0 {
+			input.Headers[name] = values
+		}
+	}
+	for _, access := range accessItems {
+		input.Access = append(input.Access, Access{Type: access.Type, Name: access.Name, Action: access.Action})
+	}
+
+	p, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), ac.timeout)
+	defer cancel()
+	output, err := ac.run(ctx, p)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s failed: %v", ac.name(), err)
+	}
+
+	var decision Decision
+	if err := json.Unmarshal(output, &decision); err != nil {
+		return nil, fmt.Errorf("plugin %s returned an invalid decision: %v", ac.name(), err)
+	}
+
+	if !decision.Allowed {
+		return nil, &challenge{
+			realm:  ac.realm,
+			header: decision.Challenge,
+			reason: decision.Reason,
+		}
+	}
+
+	resources := make([]auth.Resource, 0, len(accessItems))
+	for _, access := range accessItems {
+		resources = append(resources, access.Resource)
+	}
+	return &auth.Grant{User: auth.UserInfo{Name: decision.User}, Resources: resources}, nil
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm  string
+	header string
+	reason string
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the challenge header returned by the plugin, or a basic
+// challenge for the realm.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	if ch.header != "" {
+		w.Header().Set("WWW-Authenticate", ch.header)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	if ch.reason != "" {
+		return fmt.Sprintf("%s: %s", ErrDenied, ch.reason)
+	}
+	return ErrDenied.Error()
+}
+
+// Unwrap returns ErrDenied.
+func (ch challenge) Unwrap() error {
+	return ErrDenied
+}
@@ -0,0 +1,203 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+func newTestAccessController(t *testing.T, run func(ctx context.Context, input []byte) ([]byte, error)) *accessController {
+	t.Helper()
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":   "test-realm",
+		"command": "/usr/local/bin/registry-auth",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.(*accessController).run = run
+	return ac.(*accessController)
+}
+
+func TestAccessController(t *testing.T) {
+	// the test plugin allows bob to pull, and denies everything else
+	ac := newTestAccessController(t, func(ctx context.Context, input []byte) ([]byte, error) {
+		var req Request
+		if err := json.Unmarshal(input, &req); err != nil {
+			return nil, err
+		}
+		if req.Method != http.MethodGet || req.Path != "/v2/bob/app/manifests/latest" || req.RemoteAddr != "10.0.0.1" {
+			return nil, errors.New("unexpected request")
+		}
+		if len(req.Headers["Authorization"]) == 0 {
+			return []byte(`{"allowed":false,"challenge":"Bearer realm=\"https://auth.example.com\""}`), nil
+		}
+		if req.Headers["Authorization"][0] != "Basic Ym9iOmJvYg==" || req.Access[0].Action != "pull" {
+			return []byte(`{"allowed":false,"reason":"not bob"}`), nil
+		}
+		return []byte(`{"allowed":true,"user":"bob"}`), nil
+	})
+
+	authorize := func(authorization, action string) (*auth.Grant, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/bob/app/manifests/latest", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return ac.Authorized(req, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: "bob/app"},
+			Action:   action,
+		})
+	}
+
+	grant, err := authorize("Basic Ym9iOmJvYg==", "pull")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.User.Name != "bob" || len(grant.Resources) != 1 || grant.Resources[0].Name != "bob/app" {
+		t.Fatalf("unexpected grant: %#v", grant)
+	}
+
+	_, err = authorize("", "pull")
+	var ch *challenge
+	if !errors.As(err, &ch) {
+		t.Fatalf("expected a challenge, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	ch.SetHeaders(nil, w)
+	if header := w.Header().Get("WWW-Authenticate"); header != `Bearer realm="https://auth.example.com"` {
+		t.Fatalf("unexpected challenge header: %q", header)
+	}
+
+	_, err = authorize("Basic Ym9iOmJvYg==", "push")
+	if !errors.Is(err, ErrDenied) || !errors.As(err, &ch) {
+		t.Fatalf("expected a denial, got %v", err)
+	}
+	w = httptest.NewRecorder()
+	ch.SetHeaders(nil, w)
+	if header := w.Header().Get("WWW-Authenticate"); header != `Basic realm="test-realm"` {
+		t.Fatalf("unexpected challenge header: %q", header)
+	}
+}
+
+func TestAccessControllerTrustedProxies(t *testing.T) {
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":          "test-realm",
+		"command":        "/usr/local/bin/registry-auth",
+		"trustedproxies": []interface{}{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remoteAddr string
+	ac.(*accessController).run = func(ctx context.Context, input []byte) ([]byte, error) {
+		var req Request
+		if err := json.Unmarshal(input, &req); err != nil {
+			return nil, err
+		}
+		remoteAddr = req.RemoteAddr
+		return []byte(`{"allowed":true}`), nil
+	}
+
+	for _, tc := range []struct {
+		peer     string
+		expected string
+	}{
+		// clients may not forge their address
+		{peer: "192.168.0.1:1234", expected: "192.168.0.1"},
+		// trusted proxies forward it
+		{peer: "10.0.0.1:1234", expected: "172.16.0.1"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.RemoteAddr = tc.peer
+		req.Header.Set("X-Forwarded-For", "172.16.0.1")
+		if _, err := ac.Authorized(req); err != nil {
+			t.Fatal(err)
+		}
+		if remoteAddr != tc.expected {
+			t.Errorf("%s: unexpected remote address %q, expected %q", tc.peer, remoteAddr, tc.expected)
+		}
+	}
+}
+
+func TestAccessControllerFailure(t *testing.T) {
+	for name, run := range map[string]func(ctx context.Context, input []byte) ([]byte, error){
+		"command error":    func(ctx context.Context, input []byte) ([]byte, error) { return nil, errors.New("exit status 1") },
+		"invalid decision": func(ctx context.Context, input []byte) ([]byte, error) { return []byte("yes"), nil },
+	} {
+		t.Run(name, func(t *testing.T) {
+			ac := newTestAccessController(t, run)
+			_, err := ac.Authorized(httptest.NewRequest(http.MethodGet, "/v2/", nil))
+			var ch auth.Challenge
+			if err == nil || errors.As(err, &ch) {
+				t.Fatalf("expected a non-challenge error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAccessControllerExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test plugin is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "plugin.sh")
+	script := "#!/bin/sh\ngrep -q '\"action\":\"pull\"' && echo '{\"allowed\":true,\"user\":\"'$1'\"}' || echo '{\"allowed\":false}'\n"
+	if err := os.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":   "test-realm",
+		"command": path,
+		"args":    []interface{}{"anonymous"},
+		"timeout": "10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	grant, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "app"}, Action: "pull"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.User.Name != "anonymous" {
+		t.Fatalf("unexpected user %q", grant.User.Name)
+	}
+	if _, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "app"}, Action: "push"}); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expected a denial, got %v", err)
+	}
+}
+
+func TestAccessControllerOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"command": "/bin/true"},
+		{"realm": "test-realm"},
+		{"realm": "test-realm", "command": ""},
+		{"realm": "test-realm", "command": "/bin/true", "args": "--verbose"},
+		{"realm": "test-realm", "command": "/bin/true", "args": []interface{}{1}},
+		{"realm": "test-realm", "command": "/bin/true", "timeout": "soon"},
+		{"realm": "test-realm", "command": "/bin/true", "timeout": "0s"},
+		{"realm": "test-realm", "address": ""},
+		{"realm": "test-realm", "address": "localhost:5001", "command": "/bin/true"},
+		{"realm": "test-realm", "address": "localhost:5001", "args": []interface{}{"--verbose"}},
+		{"realm": "test-realm", "address": "localhost:5001"},
+		{"realm": "test-realm", "address": "localhost:5001", "certificate": "/etc/registry/plugin.crt"},
+		{"realm": "test-realm", "address": "localhost:5001", "rootcertbundle": "/nonexistent/ca.pem"},
+		{"realm": "test-realm", "command": "/bin/true", "rootcertbundle": "/etc/ssl/certs/ca-certificates.crt"},
+		{"realm": "test-realm", "command": "/bin/true", "trustedproxies": "10.0.0.1"},
+		{"realm": "test-realm", "command": "/bin/true", "trustedproxies": []interface{}{"10.0.0.1/33"}},
+	} {
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected error with options %v", options)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// AuthorizeMethod is the gRPC method called on plugin servers. Its request
+// and response are google.protobuf.Struct messages holding the JSON request
+// and decision exchanged with plugin commands.
+const AuthorizeMethod = "/distribution.auth.plugin.v1.Plugin/Authorize"
+
+// dial connects to the plugin server at address, with TLS unless tlsConfig
+// is nil. Connections without TLS are only made to unix sockets.
+func dial(address string, tlsConfig *tls.Config) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to plugin server %s: %v", address, err)
+	}
+	return conn, nil
+}
+
+// invoke calls the Authorize method of the plugin server with input.
+func (ac *accessController) invoke(ctx context.Context, input []byte) ([]byte, error) {
+	var req structpb.Struct
+	if err := protojson.Unmarshal(input, &req); err != nil {
+		return nil, err
+	}
+	var resp structpb.Struct
+	if err := ac.conn.Invoke(ctx, AuthorizeMethod, &req, &resp); err != nil {
+		return nil, err
+	}
+	return protojson.Marshal(&resp)
+}
@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// authorizeFunc decides on a request received by the test plugin server.
+type authorizeFunc func(req *structpb.Struct) (*structpb.Struct, error)
+
+// newTestServer serves authorize on l, with TLS if creds is not nil.
+func newTestServer(t *testing.T, l net.Listener, creds credentials.TransportCredentials, authorize authorizeFunc) {
+	t.Helper()
+	var opts []grpc.ServerOption
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "distribution.auth.plugin.v1.Plugin",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Authorize",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req structpb.Struct
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return authorize(&req)
+			},
+		}},
+	}, struct{}{})
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+}
+
+// allowPulls allows pulls, and denies everything else.
+func allowPulls(req *structpb.Struct) (*structpb.Struct, error) {
+	access := req.Fields["access"].GetListValue().GetValues()
+	if req.Fields["method"].GetStringValue() != http.MethodGet || len(access) != 1 {
+		return nil, errors.New("unexpected request")
+	}
+	if access[0].GetStructValue().Fields["action"].GetStringValue() != "pull" {
+		return structpb.NewStruct(map[string]interface{}{"allowed": false, "reason": "read-only"})
+	}
+	return structpb.NewStruct(map[string]interface{}{"allowed": true, "user": "anonymous"})
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key to dir, and returns their paths.
+func writeTestCertificate(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"plugin_test"}},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestAccessControllerGRPC(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "plugin.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestServer(t, l, nil, allowPulls)
+	address := "unix://" + socket
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":   "test-realm",
+		"address": address,
+		"timeout": "10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	grant, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "app"}, Action: "pull"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.User.Name != "anonymous" {
+		t.Fatalf("unexpected user %q", grant.User.Name)
+	}
+	if _, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "app"}, Action: "push"}); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expected a denial, got %v", err)
+	}
+
+	// server errors fail the request
+	_, err = ac.Authorized(req)
+	var ch auth.Challenge
+	if err == nil || errors.As(err, &ch) {
+		t.Fatalf("expected a non-challenge error, got %v", err)
+	}
+}
+
+func TestAccessControllerGRPCTLS(t *testing.T) {
+	certPath, keyPath := writeTestCertificate(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestServer(t, l, credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}), allowPulls)
+
+	// connections over the network require TLS
+	if _, err := newAccessController(map[string]interface{}{
+		"realm":   "test-realm",
+		"address": l.Addr().String(),
+	}); err == nil {
+		t.Fatal("expected an error with a network address without TLS")
+	}
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":          "test-realm",
+		"address":        l.Addr().String(),
+		"rootcertbundle": certPath,
+		"certificate":    certPath,
+		"key":            keyPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	if _, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "app"}, Action: "pull"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package token
 
 import (
+	"context"
 	"crypto"
 	"crypto/x509"
 	"encoding/json"
@@ -12,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth"
 	"github.com/go-jose/go-jose/v4"
@@ -154,11 +156,27 @@ type accessController struct {
 	realm             string
 	autoRedirect      bool
 	autoRedirectPath  string
-	issuer            string
 	service           string
-	rootCerts         *x509.CertPool
-	trustedKeys       map[string]crypto.PublicKey
+	issuers           []*tokenIssuer
 	signingAlgorithms []jose.SignatureAlgorithm
+	oidc              *oidcProvider
+	server            *tokenServer
+}
+
+var _ auth.HandlerProvider = &accessController{}
+
+// tokenIssuer holds the keys trusted to sign the tokens of an issuer, and
+// the audiences those tokens may be intended for.
+type tokenIssuer struct {
+	issuer    string
+	audiences []string
+
+	// keyFiles are the root certificate bundle and JWKS files the static
+	// keys are loaded from, reloaded when they change.
+	keyFiles *keyFiles
+
+	// remoteKeys is set when signing keys are fetched from a remote JWKS.
+	remoteKeys *remoteKeySet
 }
 
 const (
@@ -171,11 +189,26 @@ type tokenAccessOptions struct {
 	realm             string
 	autoRedirect      bool
 	autoRedirectPath  string
-	issuer            string
 	service           string
-	rootCertBundle    string
-	jwks              string
 	signingAlgorithms []string
+	oidc              map[string]interface{}
+	server            map[string]interface{}
+	reloadInterval    time.Duration
+
+	// issuerOptions are the options of the issuer configured at the top
+	// level, if any, and issuers those of the additional issuers.
+	issuerOptions
+	issuers []issuerOptions
+}
+
+// issuerOptions are the options of a trusted token issuer.
+type issuerOptions struct {
+	issuer         string
+	audiences      []string
+	rootCertBundle string
+	jwks           string
+	jwksURL        string
+	jwksRefresh    time.Duration
 }
 
 // checkOptions gathers the necessary options
@@ -183,6 +216,8 @@ type tokenAccessOptions struct {
 func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 	var opts tokenAccessOptions
 
+	_, multipleIssuers := options["issuers"]
+
 	keys := []string{"realm", "issuer", "service", "rootcertbundle", "jwks"}
 	vals := make([]string, 0, len(keys))
 	for _, key := range keys {
@@ -193,7 +228,7 @@ func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 			// Either of these config options may be missing, but
 			// at least one must be present: we handle those cases
 			// in newAccessController func which consumes this one.
-			if key == "rootcertbundle" || key == "jwks" {
+			if key == "rootcertbundle" || key == "jwks" || (key == "issuer" && multipleIssuers) {
 				vals = append(vals, "")
 				continue
 			}
@@ -203,6 +238,7 @@ func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 	}
 
 	opts.realm, opts.issuer, opts.service, opts.rootCertBundle, opts.jwks = vals[0], vals[1], vals[2], vals[3], vals[4]
+	opts.audiences = []string{opts.service}
 
 	autoRedirectVal, ok := options["autoredirect"]
 	if ok {
@@ -235,12 +271,128 @@ func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 		opts.signingAlgorithms = signingAlgorithmsVals
 	}
 
+	if err := checkRemoteKeyOptions(options, &opts.issuerOptions); err != nil {
+		return opts, err
+	}
+
+	if intervalVal, ok := options["reloadinterval"]; ok {
+		intervalStr, ok := intervalVal.(string)
+		if !ok {
+			return opts, errors.New("token auth requires a valid option string: reloadinterval")
+		}
+		var err error
+		if opts.reloadInterval, err = time.ParseDuration(intervalStr); err != nil || opts.reloadInterval < 0 {
+			return opts, fmt.Errorf("unable to parse token auth reloadinterval: %q", intervalStr)
+		}
+	}
+
+	if oidcVal, ok := options["oidc"]; ok {
+		opts.oidc, ok = stringMap(oidcVal)
+		if !ok {
+			return opts, errors.New("token auth requires a valid option map: oidc")
+		}
+	}
+
+	if serverVal, ok := options["server"]; ok {
+		opts.server, ok = stringMap(serverVal)
+		if !ok {
+			return opts, errors.New("token auth requires a valid option map: server")
+		}
+	}
+
+	if multipleIssuers {
+		issuers, ok := options["issuers"].([]interface{})
+		if !ok {
+			return opts, errors.New("token auth issuers must be a list of issuers")
+		}
+		for i, issuerVal := range issuers {
+			issuerOpts, err := checkIssuerOptions(issuerVal, opts.service)
+			if err != nil {
+				return opts, fmt.Errorf("token auth issuers[%d]: %v", i, err)
+			}
+			opts.issuers = append(opts.issuers, issuerOpts)
+		}
+	}
+
 	return opts, nil
 }
 
+// checkIssuerOptions gathers the options of an additional issuer, whose
+// tokens are intended for service unless other audiences are set.
+func checkIssuerOptions(v interface{}, service string) (issuerOptions, error) {
+	opts := issuerOptions{audiences: []string{service}}
+
+	options, ok := stringMap(v)
+	if !ok {
+		return opts, errors.New("issuer must be a map")
+	}
+	for key, val := range map[string]*string{
+		"issuer":         &opts.issuer,
+		"rootcertbundle": &opts.rootCertBundle,
+		"jwks":           &opts.jwks,
+	} {
+		if v, present := options[key]; present {
+			if *val, ok = v.(string); !ok {
+				return opts, fmt.Errorf("requires a valid option string: %q", key)
+			}
+		}
+	}
+	if opts.issuer == "" {
+		return opts, errors.New(`"issuer" must be set`)
+	}
+
+	switch audience := options["audience"].(type) {
+	case nil:
+	case string:
+		opts.audiences = []string{audience}
+	case []interface{}:
+		opts.audiences = opts.audiences[:0]
+		for _, a := range audience {
+			s, ok := a.(string)
+			if !ok {
+				return opts, fmt.Errorf("audience must be a string or a list of strings: %#v", audience)
+			}
+			opts.audiences = append(opts.audiences, s)
+		}
+	default:
+		return opts, fmt.Errorf("audience must be a string or a list of strings: %#v", audience)
+	}
+
+	return opts, checkRemoteKeyOptions(options, &opts)
+}
+
+// checkRemoteKeyOptions gathers the options of the remote JWKS of an issuer.
+func checkRemoteKeyOptions(options map[string]interface{}, opts *issuerOptions) error {
+	if jwksURLVal, ok := options["jwksurl"]; ok {
+		opts.jwksURL, ok = jwksURLVal.(string)
+		if !ok {
+			return errors.New("token auth requires a valid option string: jwksurl")
+		}
+		if u, err := url.Parse(opts.jwksURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Errorf("token auth jwksurl must be an http or https URL: %q", opts.jwksURL)
+		}
+	}
+
+	if intervalVal, ok := options["jwksrefreshinterval"]; ok {
+		intervalStr, ok := intervalVal.(string)
+		if !ok {
+			return errors.New("token auth requires a valid option string: jwksrefreshinterval")
+		}
+		var err error
+		if opts.jwksRefresh, err = time.ParseDuration(intervalStr); err != nil {
+			return fmt.Errorf("unable to parse token auth jwksrefreshinterval: %v", err)
+		}
+	}
+
+	return nil
+}
+
 var (
 	rootCertFetcher func(string) ([]*x509.Certificate, error) = getRootCerts
 	jwkFetcher      func(string) (*jose.JSONWebKeySet, error) = getJwks
+
+	// jwksClient fetches remote key sets.
+	jwksClient = &http.Client{Timeout: 30 * time.Second}
 )
 
 func getRootCerts(path string) ([]*x509.Certificate, error) {
@@ -314,47 +466,55 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		return nil, err
 	}
 
-	var (
-		rootCerts []*x509.Certificate
-		jwks      *jose.JSONWebKeySet
-		signAlgos []jose.SignatureAlgorithm
-	)
-
-	if config.rootCertBundle != "" {
-		rootCerts, err = rootCertFetcher(config.rootCertBundle)
+	var oidc *oidcProvider
+	if config.oidc != nil {
+		oidc, err = newOIDCProvider(config.oidc, config.service)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if config.jwks != "" {
-		jwks, err = jwkFetcher(config.jwks)
+	var server *tokenServer
+	if config.server != nil {
+		server, err = newTokenServer(config.server, config.issuer, config.service)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if (len(rootCerts) == 0 && jwks == nil) || // no certs bundle and no jwks
-		(len(rootCerts) == 0 && jwks != nil && len(jwks.Keys) == 0) { // no certs bundle and empty jwks
-		return nil, errors.New("token auth requires at least one token signing key")
-	}
-
-	trustedKeys := make(map[string]crypto.PublicKey)
-	rootPool := x509.NewCertPool()
-	for _, rootCert := range rootCerts {
-		rootPool.AddCert(rootCert)
-		if key := GetRFC7638Thumbprint(rootCert.PublicKey); key != "" {
-			trustedKeys[key] = rootCert.PublicKey
+	var issuers []*tokenIssuer
+	if config.issuer != "" {
+		issuer, hasKeys, err := newTokenIssuer(config.issuerOptions, config.reloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		if server != nil {
+			// the tokens issued by the built-in server are trusted
+			issuer.keyFiles.trust(server.keyID, server.key.Public())
+			hasKeys = true
 		}
+		if !hasKeys && oidc == nil && len(config.issuers) == 0 {
+			return nil, errors.New("token auth requires at least one token signing key")
+		}
+		issuers = append(issuers, issuer)
 	}
-
-	if jwks != nil {
-		for _, key := range jwks.Keys {
-			trustedKeys[key.KeyID] = key.Public()
+	for _, issuerOpts := range config.issuers {
+		issuer, hasKeys, err := newTokenIssuer(issuerOpts, config.reloadInterval)
+		if err != nil {
+			return nil, err
 		}
+		if !hasKeys {
+			return nil, fmt.Errorf("token auth requires at least one token signing key for issuer %q", issuerOpts.issuer)
+		}
+		for _, other := range issuers {
+			if other.issuer == issuer.issuer {
+				return nil, fmt.Errorf("token auth issuer %q is configured more than once", issuer.issuer)
+			}
+		}
+		issuers = append(issuers, issuer)
 	}
 
-	signAlgos, err = getSigningAlgorithms(config.signingAlgorithms)
+	signAlgos, err := getSigningAlgorithms(config.signingAlgorithms)
 	if err != nil {
 		return nil, err
 	}
@@ -368,14 +528,58 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		realm:             config.realm,
 		autoRedirect:      config.autoRedirect,
 		autoRedirectPath:  config.autoRedirectPath,
-		issuer:            config.issuer,
 		service:           config.service,
-		rootCerts:         rootPool,
-		trustedKeys:       trustedKeys,
+		issuers:           issuers,
 		signingAlgorithms: signAlgos,
+		oidc:              oidc,
+		server:            server,
 	}, nil
 }
 
+// Handlers returns the handler of the built-in token server, if enabled.
+func (ac *accessController) Handlers() map[string]http.Handler {
+	if ac.server == nil {
+		return nil
+	}
+	return map[string]http.Handler{ac.server.path: ac.server}
+}
+
+// newTokenIssuer loads the keys trusted to sign the tokens of an issuer,
+// and returns whether any signing key is configured. The key files are
+// checked for changes at most every reloadInterval.
+func newTokenIssuer(config issuerOptions, reloadInterval time.Duration) (*tokenIssuer, bool, error) {
+	files := &keyFiles{
+		rootCertBundle: config.rootCertBundle,
+		jwks:           config.jwks,
+		reloadInterval: reloadInterval,
+		builtinKeys:    make(map[string]crypto.PublicKey),
+	}
+	// the modification times are read first, so that files modified while
+	// they are loaded are loaded again
+	files.modtimes, _ = files.stat()
+	hasKeys, err := files.load()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var remoteKeys *remoteKeySet
+	if config.jwksURL != "" {
+		remoteKeys = newRemoteKeySet(config.jwksURL, jwksClient, config.jwksRefresh)
+		// NOTE: the key server may not be up yet, keys are fetched again
+		// when the first token is presented.
+		if _, err := remoteKeys.trustedKeys(context.Background(), ""); err != nil {
+			logrus.Warnf("token auth: %v", err)
+		}
+	}
+
+	return &tokenIssuer{
+		issuer:     config.issuer,
+		audiences:  config.audiences,
+		keyFiles:   files,
+		remoteKeys: remoteKeys,
+	}, hasKeys || remoteKeys != nil, nil
+}
+
 // Authorized handles checking whether the given request is authorized
 // for actions on resources described by the given access items.
 func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Access) (*auth.Grant, error) {
@@ -399,11 +603,28 @@ func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Ac
 		return nil, challenge
 	}
 
+	if ac.oidc != nil && ac.oidc.issued(token) {
+		return ac.authorizedOIDC(req, token, accessItems, challenge)
+	}
+
+	issuer := ac.tokenIssuer(token)
+	if issuer == nil {
+		challenge.err = ErrInvalidToken
+		return nil, challenge
+	}
+
+	static := issuer.keyFiles.current()
+	trustedKeys, err := issuer.currentKeys(req.Context(), static.trustedKeys, token)
+	if err != nil {
+		challenge.err = err
+		return nil, challenge
+	}
+
 	verifyOpts := VerifyOptions{
-		TrustedIssuers:    []string{ac.issuer},
-		AcceptedAudiences: []string{ac.service},
-		Roots:             ac.rootCerts,
-		TrustedKeys:       ac.trustedKeys,
+		TrustedIssuers:    []string{issuer.issuer},
+		AcceptedAudiences: issuer.audiences,
+		Roots:             static.rootCerts,
+		TrustedKeys:       trustedKeys,
 	}
 
 	claims, err := token.Verify(verifyOpts)
@@ -421,7 +642,84 @@ func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Ac
 	}
 
 	return &auth.Grant{
-		User:      auth.UserInfo{Name: claims.Subject},
-		Resources: claims.resources(),
+		User:           auth.UserInfo{Name: claims.Subject},
+		Resources:      claims.resources(),
+		TagConstraints: claims.tagConstraints(accessItems),
+	}, nil
+}
+
+// tokenIssuer returns the issuer the token claims to be issued by, if it is
+// trusted. The claim is only used to select the keys the token is verified
+// with: keys trusted for an issuer never verify the tokens of another.
+func (ac *accessController) tokenIssuer(token *Token) *tokenIssuer {
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := token.JWT.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		logrus.Infof("failed to read token issuer: %v", err)
+		return nil
+	}
+	for _, issuer := range ac.issuers {
+		if issuer.issuer == claims.Issuer {
+			return issuer
+		}
+	}
+	logrus.Infof("token from untrusted issuer: %q", claims.Issuer)
+	return nil
+}
+
+// currentKeys returns the keys trusted to sign the token: the static keys
+// merged with those of the remote JWKS, if any.
+func (ti *tokenIssuer) currentKeys(ctx context.Context, static map[string]crypto.PublicKey, token *Token) (map[string]crypto.PublicKey, error) {
+	if ti.remoteKeys == nil {
+		return static, nil
+	}
+
+	var keyID string
+	if len(token.JWT.Headers) > 0 {
+		keyID = token.JWT.Headers[0].KeyID
+	}
+	remote, err := ti.remoteKeys.trustedKeys(ctx, keyID)
+	if err != nil {
+		if len(static) == 0 {
+			return nil, err
+		}
+		// tokens signed by static keys can still be verified
+		logrus.Warnf("token auth: %v", err)
+		return static, nil
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(static)+len(remote))
+	for kid, key := range remote {
+		keys[kid] = key
+	}
+	for kid, key := range static {
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// authorizedOIDC handles checking whether the given request bearing an
+// OpenID Connect ID token is authorized for the given access items.
+func (ac *accessController) authorizedOIDC(req *http.Request, token *Token, accessItems []auth.Access, challenge *authChallenge) (*auth.Grant, error) {
+	username, claims, err := ac.oidc.verify(req.Context(), token)
+	if err != nil {
+		challenge.err = err
+		return nil, challenge
+	}
+
+	if !ac.oidc.authorized(claims, accessItems) {
+		challenge.err = ErrInsufficientScope
+		return nil, challenge
+	}
+
+	resources := make([]auth.Resource, 0, len(accessItems))
+	for resource := range newAccessSet(accessItems...) {
+		resources = append(resources, resource)
+	}
+
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: username},
+		Resources: resources,
 	}, nil
 }
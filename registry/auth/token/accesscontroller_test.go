@@ -1,16 +1,22 @@
 package token
 
 import (
+	"os"
 	"testing"
+	"time"
 
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/pem"
 
 	"net/http"
 	"net/http/httptest"
 
+	"github.com/distribution/distribution/v3/registry/auth"
 	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
 )
 
 func TestBuildAutoRedirectURL(t *testing.T) {
@@ -143,7 +149,7 @@ func TestRootCertIncludedInTrustedKeys(t *testing.T) {
 	// newAccessController return type is an interface built from
 	// accessController struct. The type check can be safely ignored.
 	ac2, _ := ac.(*accessController)
-	if got := len(ac2.trustedKeys); got != 1 {
+	if got := len(ac2.issuers[0].keyFiles.current().trustedKeys); got != 1 {
 		t.Fatalf("Unexpected number of trusted keys, expected 1 got: %d", got)
 	}
 }
@@ -173,7 +179,235 @@ func TestJWKSIncludedInTrustedKeys(t *testing.T) {
 	// newAccessController return type is an interface built from
 	// accessController struct. The type check can be safely ignored.
 	ac2, _ := ac.(*accessController)
-	if got := len(ac2.trustedKeys); got != 1 {
+	if got := len(ac2.issuers[0].keyFiles.current().trustedKeys); got != 1 {
 		t.Fatalf("Unexpected number of trusted keys, expected 1 got: %d", got)
 	}
 }
+
+func TestMultipleIssuers(t *testing.T) {
+	legacy := newTestIdP(t)
+	legacyKey := legacy.rotate(t, "legacy")
+	federated := newTestIdP(t)
+	federatedKey := federated.rotate(t, "federated")
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":   "https://auth.example.com/token/",
+		"issuer":  "legacy-issuer",
+		"service": "test-service",
+		"jwksurl": legacy.URL + "/keys",
+		"issuers": []interface{}{
+			map[interface{}]interface{}{
+				"issuer":   "federated-issuer",
+				"audience": []interface{}{"federated-audience", "other-audience"},
+				"jwksurl":  federated.URL + "/keys",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access := auth.Access{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"}
+	authorize := func(key jose.JSONWebKey, issuer, audience string) error {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		raw, err := jwt.Signed(signer).Claims(&ClaimSet{
+			Issuer:     issuer,
+			Subject:    "foo",
+			Audience:   []string{audience},
+			Expiration: now.Add(time.Hour).Unix(),
+			NotBefore:  now.Unix(),
+			IssuedAt:   now.Unix(),
+			Access:     []*ResourceActions{{Type: "repository", Name: "foo/bar", Actions: []string{"pull"}}},
+		}).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/v2/foo/bar/manifests/latest", nil)
+		req.Header.Set("Authorization", "Bearer "+raw)
+		_, err = ac.Authorized(req, access)
+		return err
+	}
+
+	for _, tc := range []struct {
+		name       string
+		key        jose.JSONWebKey
+		issuer     string
+		audience   string
+		authorized bool
+	}{
+		{name: "legacy", key: legacyKey, issuer: "legacy-issuer", audience: "test-service", authorized: true},
+		{name: "federated", key: federatedKey, issuer: "federated-issuer", audience: "federated-audience", authorized: true},
+		{name: "audience of another issuer", key: federatedKey, issuer: "federated-issuer", audience: "test-service"},
+		{name: "key of another issuer", key: legacyKey, issuer: "federated-issuer", audience: "federated-audience"},
+		{name: "untrusted issuer", key: legacyKey, issuer: "other-issuer", audience: "test-service"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := authorize(tc.key, tc.issuer, tc.audience)
+			if tc.authorized && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.authorized && err == nil {
+				t.Fatal("expected token to be rejected")
+			}
+		})
+	}
+}
+
+func TestMultipleIssuersOptions(t *testing.T) {
+	old := jwkFetcher
+	jwkFetcher = mockGetJwks
+	defer func() { jwkFetcher = old }()
+
+	options := func(issuers ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"realm":   "https://auth.example.com/token/",
+			"service": "test-service",
+			"issuers": issuers,
+		}
+	}
+	issuer := func(name string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"issuer": name, "jwks": "something-to-trigger-our-mock"}
+	}
+
+	// the top level issuer is optional when issuers are listed
+	if _, err := newAccessController(options(issuer("first"), issuer("second"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		options map[string]interface{}
+	}{
+		{name: "duplicate issuer", options: options(issuer("first"), issuer("first"))},
+		{name: "missing issuer", options: options(map[interface{}]interface{}{"jwks": "something-to-trigger-our-mock"})},
+		{name: "missing keys", options: options(map[interface{}]interface{}{"issuer": "first"})},
+		{name: "invalid issuer", options: options("first")},
+		{name: "invalid jwksurl", options: options(map[interface{}]interface{}{"issuer": "first", "jwksurl": "/keys"})},
+	} {
+		if _, err := newAccessController(tc.options); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestRootCertBundleReload(t *testing.T) {
+	rootKeys, err := makeRootKeys(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := writeTempRootCerts(rootKeys[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle)
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":          "https://auth.example.com/token/",
+		"issuer":         "test-issuer",
+		"service":        "test-service",
+		"rootcertbundle": bundle,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access := auth.Access{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"}
+	authorize := func(rootKey *ecdsa.PrivateKey) error {
+		jwk, err := makeSigningKeyWithChain(rootKey, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := makeTestToken(jwk, "test-issuer", "test-service",
+			[]*ResourceActions{{Type: "repository", Name: "foo/bar", Actions: []string{"pull"}}},
+			time.Now(), time.Now().Add(5*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/v2/foo/bar/manifests/latest", nil)
+		req.Header.Set("Authorization", "Bearer "+token.Raw)
+		_, err = ac.Authorized(req, access)
+		return err
+	}
+	modtime := time.Now()
+	rewrite := func(content []byte) {
+		if err := os.WriteFile(bundle, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		modtime = modtime.Add(time.Second)
+		if err := os.Chtimes(bundle, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := authorize(rootKeys[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := authorize(rootKeys[1]); err == nil {
+		t.Fatal("expected a token signed by an untrusted certificate to be rejected")
+	}
+
+	// the signing certificate is rotated
+	certs, err := makeRootCerts(rootKeys[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[0].Raw}))
+	if err := authorize(rootKeys[1]); err != nil {
+		t.Fatalf("unexpected error after rotation: %v", err)
+	}
+	if err := authorize(rootKeys[0]); err == nil {
+		t.Fatal("expected a token signed by the rotated certificate to be rejected")
+	}
+
+	// bundles failing to load leave the previous keys trusted
+	for _, content := range []string{"", "-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----\n"} {
+		rewrite([]byte(content))
+		if err := authorize(rootKeys[1]); err != nil {
+			t.Fatalf("unexpected error with an invalid bundle: %v", err)
+		}
+	}
+}
+
+func TestTagConstraints(t *testing.T) {
+	claims := ClaimSet{Access: []*ResourceActions{
+		{Type: "repository", Name: "foo/bar", Actions: []string{"pull"}},
+		{Type: "repository", Name: "foo/bar", Actions: []string{"push"}, Tags: []string{"release-*"}},
+		{Type: "repository", Name: "foo/bar", Actions: []string{"push", "delete"}, Tags: []string{"v*"}},
+		{Type: "repository", Name: "foo/baz", Actions: []string{"*"}, Tags: []string{"v*"}},
+		{Type: "repository", Name: "foo/baz", Actions: []string{"push"}},
+	}}
+	access := func(name, action string) auth.Access {
+		return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+	}
+	constraints := claims.tagConstraints([]auth.Access{
+		access("foo/bar", "pull"),
+		access("foo/bar", "push"),
+		access("foo/bar", "delete"),
+		access("foo/baz", "pull"),
+		access("foo/baz", "push"),
+	})
+
+	for _, tc := range []struct {
+		name, action, tag string
+		allowed           bool
+	}{
+		{"foo/bar", "pull", "dev", true},
+		{"foo/bar", "push", "release-1", true},
+		{"foo/bar", "push", "v1.0", true},
+		{"foo/bar", "push", "dev", false},
+		{"foo/bar", "delete", "v1.0", true},
+		{"foo/bar", "delete", "release-1", false},
+		{"foo/baz", "pull", "v1.0", true},
+		{"foo/baz", "pull", "dev", false},
+		{"foo/baz", "push", "dev", true},
+	} {
+		if allowed := auth.TagAllowed(constraints, tc.name, tc.action, tc.tag); allowed != tc.allowed {
+			t.Errorf("unexpected %s of %s:%s allowed: %t", tc.action, tc.name, tc.tag, allowed)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultJWKSRefreshInterval is how long fetched signing keys are
+	// trusted before the key set is fetched again.
+	defaultJWKSRefreshInterval = time.Hour
+
+	// minJWKSRefreshInterval rate limits the refreshes triggered by tokens
+	// signed with an unknown key, so that forged key IDs cannot be used to
+	// hammer the key server.
+	minJWKSRefreshInterval = 30 * time.Second
+
+	// maxJWKSSize bounds the size of a fetched key set.
+	maxJWKSSize = 1 << 20
+)
+
+// remoteKeySet caches the signing keys published as a JSON Web Key Set at
+// a URL. Keys are refreshed periodically, and on demand when a token signed
+// by an unknown key is presented, which lets the key server roll keys over
+// without the registry being restarted.
+type remoteKeySet struct {
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+
+	refreshes singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newRemoteKeySet(url string, client *http.Client, refreshInterval time.Duration) *remoteKeySet {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if refreshInterval <= 0 {
+		refreshInterval = defaultJWKSRefreshInterval
+	}
+	return &remoteKeySet{
+		url:             url,
+		client:          client,
+		refreshInterval: refreshInterval,
+	}
+}
+
+// trustedKeys returns the currently trusted keys mapped by key ID. If
+// keyID is not empty and unknown, the key set is refreshed before
+// returning, subject to rate limiting. Previously fetched keys keep being
+// served when a refresh fails.
+func (s *remoteKeySet) trustedKeys(ctx context.Context, keyID string) (map[string]crypto.PublicKey, error) {
+	s.mu.Lock()
+	keys, fetchedAt := s.keys, s.fetchedAt
+	s.mu.Unlock()
+
+	if keys == nil || s.needsRefresh(keys, fetchedAt, keyID) {
+		// NOTE: the key set is fetched without holding the lock, so that
+		// a slow key server does not block the callers that do not need
+		// a refresh, and concurrent refreshes share a single fetch.
+		// That fetch is not canceled along with the request that
+		// started it. Without keys, callers join any pending fetch.
+		v, err, _ := s.refreshes.Do("", func() (interface{}, error) {
+			return s.refresh(context.WithoutCancel(ctx), keyID)
+		})
+		if err != nil {
+			return nil, err
+		}
+		keys = v.(map[string]crypto.PublicKey)
+	}
+
+	if keys == nil {
+		return nil, fmt.Errorf("no signing keys available from %s", s.url)
+	}
+	return keys, nil
+}
+
+// needsRefresh returns whether keys, fetched at fetchedAt, must be
+// refreshed to look up keyID.
+func (s *remoteKeySet) needsRefresh(keys map[string]crypto.PublicKey, fetchedAt time.Time, keyID string) bool {
+	age := time.Since(fetchedAt)
+	_, known := keys[keyID]
+	stale := age >= s.refreshInterval
+	missing := (keys == nil || keyID != "" && !known) && age >= minJWKSRefreshInterval
+	return stale || missing
+}
+
+// refresh fetches the key set unless it was refreshed since the caller
+// last looked at it, and returns the keys to trust.
+func (s *remoteKeySet) refresh(ctx context.Context, keyID string) (map[string]crypto.PublicKey, error) {
+	s.mu.Lock()
+	if !s.needsRefresh(s.keys, s.fetchedAt, keyID) {
+		keys := s.keys
+		s.mu.Unlock()
+		return keys, nil
+	}
+	// NOTE: failed attempts count as a fetch too, so that an
+	// unreachable key server is not queried on every request.
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+
+	keys, err := s.fetch(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if s.keys == nil {
+			return nil, err
+		}
+		log.Warnf("failed to refresh JWKS from %s, using cached keys: %v", s.url, err)
+	} else {
+		s.keys = keys
+	}
+	return s.keys, nil
+}
+
+func (s *remoteKeySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var jwks jose.JSONWebKeySet
+	if err := fetchJSON(ctx, s.client, s.url, &jwks); err != nil {
+		return nil, fmt.Errorf("unable to fetch jwks: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		keys[key.KeyID] = key.Public().Key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys found in jwks served at %s", s.url)
+	}
+
+	return keys, nil
+}
+
+// fetchJSON decodes the JSON document served at url into v.
+func fetchJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,180 @@
+package token
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestRemoteJWKSAccessController(t *testing.T) {
+	keyServer := newTestIdP(t)
+	first := keyServer.rotate(t, "first")
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":   "https://auth.example.com/token/",
+		"issuer":  "test-issuer",
+		"service": "test-service",
+		"jwksurl": keyServer.URL + "/keys",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access := auth.Access{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"}
+	authorize := func(key jose.JSONWebKey) error {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		raw, err := jwt.Signed(signer).Claims(&ClaimSet{
+			Issuer:     "test-issuer",
+			Subject:    "foo",
+			Audience:   []string{"test-service"},
+			Expiration: now.Add(time.Hour).Unix(),
+			NotBefore:  now.Unix(),
+			IssuedAt:   now.Unix(),
+			Access:     []*ResourceActions{{Type: "repository", Name: "foo/bar", Actions: []string{"pull"}}},
+		}).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/v2/foo/bar/manifests/latest", nil)
+		req.Header.Set("Authorization", "Bearer "+raw)
+		_, err = ac.Authorized(req, access)
+		return err
+	}
+
+	if err := authorize(first); err != nil {
+		t.Fatalf("unexpected error authorizing token signed by a published key: %v", err)
+	}
+
+	// a key published after the last fetch is picked up once the refresh
+	// rate limit has passed
+	second := keyServer.rotate(t, "second")
+	if err := authorize(second); err == nil {
+		t.Fatal("expected the key set not to be refreshed within the rate limit")
+	}
+	keys := ac.(*accessController).issuers[0].remoteKeys
+	keys.mu.Lock()
+	keys.fetchedAt = time.Now().Add(-minJWKSRefreshInterval)
+	keys.mu.Unlock()
+	if err := authorize(second); err != nil {
+		t.Fatalf("unexpected error authorizing token signed by a rolled over key: %v", err)
+	}
+
+	// keys are kept when the key server becomes unreachable
+	keyServer.Close()
+	keys.mu.Lock()
+	keys.fetchedAt = time.Time{}
+	keys.mu.Unlock()
+	if err := authorize(first); err != nil {
+		t.Fatalf("unexpected error authorizing with cached keys: %v", err)
+	}
+}
+
+func TestRemoteJWKSOptions(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	options := func(jwksURL string) map[string]interface{} {
+		return map[string]interface{}{
+			"realm":   "https://auth.example.com/token/",
+			"issuer":  "test-issuer",
+			"service": "test-service",
+			"jwksurl": jwksURL,
+		}
+	}
+
+	// the key server may be unavailable at startup
+	ac, err := newAccessController(options(server.URL + "/keys"))
+	if err != nil {
+		t.Fatalf("unexpected error with an unreachable key server: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set("Authorization", "Bearer a.b.c")
+	var challenge *authChallenge
+	if _, err := ac.Authorized(req); !errors.As(err, &challenge) {
+		t.Fatalf("expected challenge, got %v", err)
+	}
+
+	for _, u := range []string{"/keys", "ftp://example.com/keys", "://"} {
+		if _, err := newAccessController(options(u)); err == nil {
+			t.Errorf("expected error with jwksurl %q", u)
+		}
+	}
+}
+
+func TestRemoteKeySetSlowRefresh(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "known", Use: "sig"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	keys := newRemoteKeySet(server.URL, server.Client(), 0)
+	if _, err := keys.trustedKeys(context.Background(), "known"); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent refreshes for an unknown key share a single fetch
+	keys.mu.Lock()
+	keys.fetchedAt = time.Now().Add(-minJWKSRefreshInterval)
+	keys.mu.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys.trustedKeys(context.Background(), "unknown")
+		}()
+	}
+
+	// known keys are served while the key server is slow
+	done := make(chan error)
+	go func() {
+		_, err := keys.trustedKeys(context.Background(), "known")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error looking up a known key: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("known key lookup blocked by a pending refresh")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("expected 2 fetches of the key set, got %d", n)
+	}
+}
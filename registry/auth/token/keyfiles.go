@@ -0,0 +1,173 @@
+package token
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"maps"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// staticKeys are the keys loaded from the key files of an issuer.
+type staticKeys struct {
+	rootCerts   *x509.CertPool
+	trustedKeys map[string]crypto.PublicKey
+}
+
+// keyFiles loads the static keys of an issuer from its root certificate
+// bundle and JWKS files, and reloads them when the files change, so that
+// signing certificates can be rotated without restarting the registry.
+type keyFiles struct {
+	rootCertBundle string
+	jwks           string
+	reloadInterval time.Duration
+
+	// builtinKeys are trusted in addition to the keys of the files, such
+	// as the key of the built-in token server.
+	builtinKeys map[string]crypto.PublicKey
+
+	mu       sync.Mutex
+	checked  time.Time
+	modtimes [2]time.Time
+
+	// keys are swapped as a whole, requests being verified with either the
+	// previous or the reloaded keys.
+	keys atomic.Pointer[staticKeys]
+}
+
+// current returns the static keys, reloading the files if they changed and
+// were not checked within the reload interval. If the files fail to load,
+// the previous keys remain trusted.
+func (kf *keyFiles) current() *staticKeys {
+	if kf.rootCertBundle == "" && kf.jwks == "" {
+		return kf.keys.Load()
+	}
+
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+	if now := time.Now(); now.Sub(kf.checked) >= kf.reloadInterval {
+		kf.checked = now
+		if err := kf.reload(); err != nil {
+			logrus.Errorf("token auth: failed to reload signing keys, keeping the previous keys: %v", err)
+		}
+	}
+	return kf.keys.Load()
+}
+
+// reload loads the files if they were modified since they were last read.
+// It must be called with kf.mu held.
+func (kf *keyFiles) reload() error {
+	modtimes, err := kf.stat()
+	if err != nil {
+		return err
+	}
+	if modtimes == kf.modtimes {
+		return nil
+	}
+	// files failing to load are only reported once per modification
+	kf.modtimes = modtimes
+
+	hasKeys, err := kf.load()
+	if err != nil {
+		return err
+	}
+	if !hasKeys {
+		// most likely a file being written
+		return errors.New("no signing key found")
+	}
+	logrus.Infof("token auth: reloaded signing keys from %s", kf.String())
+	return nil
+}
+
+// stat returns the modification times of the files.
+func (kf *keyFiles) stat() ([2]time.Time, error) {
+	var modtimes [2]time.Time
+	for i, path := range []string{kf.rootCertBundle, kf.jwks} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return modtimes, err
+		}
+		modtimes[i] = fi.ModTime()
+	}
+	return modtimes, nil
+}
+
+// load reads the files and swaps the keys if they load successfully, and
+// returns whether the files hold any key.
+func (kf *keyFiles) load() (bool, error) {
+	var (
+		rootCerts []*x509.Certificate
+		jwks      *jose.JSONWebKeySet
+		err       error
+	)
+
+	if kf.rootCertBundle != "" {
+		rootCerts, err = rootCertFetcher(kf.rootCertBundle)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if kf.jwks != "" {
+		jwks, err = jwkFetcher(kf.jwks)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	hasKeys := len(rootCerts) > 0 || (jwks != nil && len(jwks.Keys) > 0)
+	if !hasKeys && kf.keys.Load() != nil {
+		return false, nil
+	}
+
+	trustedKeys := maps.Clone(kf.builtinKeys)
+	rootPool := x509.NewCertPool()
+	for _, rootCert := range rootCerts {
+		rootPool.AddCert(rootCert)
+		if key := GetRFC7638Thumbprint(rootCert.PublicKey); key != "" {
+			trustedKeys[key] = rootCert.PublicKey
+		}
+	}
+
+	if jwks != nil {
+		for _, key := range jwks.Keys {
+			trustedKeys[key.KeyID] = key.Public()
+		}
+	}
+
+	kf.keys.Store(&staticKeys{rootCerts: rootPool, trustedKeys: trustedKeys})
+	return hasKeys, nil
+}
+
+// trust adds a key trusted in addition to the keys of the files.
+func (kf *keyFiles) trust(keyID string, key crypto.PublicKey) {
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+
+	kf.builtinKeys[keyID] = key
+	keys := *kf.keys.Load()
+	keys.trustedKeys = maps.Clone(keys.trustedKeys)
+	keys.trustedKeys[keyID] = key
+	kf.keys.Store(&keys)
+}
+
+// String returns the paths of the files.
+func (kf *keyFiles) String() string {
+	switch {
+	case kf.rootCertBundle == "":
+		return kf.jwks
+	case kf.jwks == "":
+		return kf.rootCertBundle
+	default:
+		return kf.rootCertBundle + " and " + kf.jwks
+	}
+}
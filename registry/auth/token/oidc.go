@@ -0,0 +1,340 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// oidcDiscoveryPath is the path of the OpenID Provider configuration
+	// document, relative to the issuer URL.
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+	defaultOIDCUsernameClaim = "sub"
+)
+
+// oidcProvider validates OpenID Connect ID tokens issued by a trusted
+// identity provider and maps their claims to registry scopes, so that the
+// registry can trust an existing IdP without a bespoke token service.
+type oidcProvider struct {
+	issuer          string
+	audiences       []string
+	usernameClaim   string
+	rules           []scopeRule
+	refreshInterval time.Duration
+	client          *http.Client
+
+	discoveries singleflight.Group
+
+	mu            sync.Mutex
+	keySet        *remoteKeySet
+	lastDiscovery time.Time
+}
+
+// oidcDiscoveryDocument holds the fields of the OpenID Provider
+// configuration document used by the registry.
+type oidcDiscoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// scopeRule grants actions on the resources matching a pattern to the
+// tokens carrying a given claim value.
+type scopeRule struct {
+	// claim and value select the tokens the rule applies to. Claims
+	// holding a list match if any of their elements equals value. A rule
+	// without claim applies to all valid tokens.
+	claim string
+	value string
+
+	typ     string
+	name    *regexp.Regexp
+	actions actionSet
+}
+
+// matches returns whether the rule grants access to a token with the given
+// claims.
+func (r scopeRule) matches(claims map[string]interface{}, access auth.Access) bool {
+	if r.claim != "" && !claimContains(claims[r.claim], r.value) {
+		return false
+	}
+	return r.typ == access.Type && r.name.MatchString(access.Name) && r.actions.contains(access.Action)
+}
+
+func claimContains(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newOIDCProvider creates an oidcProvider from the "oidc" option of the
+// token access controller. The audience defaults to the registry service.
+func newOIDCProvider(options map[string]interface{}, service string) (*oidcProvider, error) {
+	issuer, ok := options["issuer"].(string)
+	if !ok || issuer == "" {
+		return nil, errors.New(`token auth requires a valid oidc option string: "issuer"`)
+	}
+
+	provider := &oidcProvider{
+		issuer:        strings.TrimSuffix(issuer, "/"),
+		audiences:     []string{service},
+		usernameClaim: defaultOIDCUsernameClaim,
+		client:        http.DefaultClient,
+	}
+
+	switch audience := options["audience"].(type) {
+	case nil:
+	case string:
+		provider.audiences = []string{audience}
+	case []interface{}:
+		provider.audiences = provider.audiences[:0]
+		for _, a := range audience {
+			s, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("oidc audience must be a string or a list of strings: %#v", audience)
+			}
+			provider.audiences = append(provider.audiences, s)
+		}
+	default:
+		return nil, fmt.Errorf("oidc audience must be a string or a list of strings: %#v", audience)
+	}
+
+	if claim, ok := options["usernameclaim"]; ok {
+		provider.usernameClaim, ok = claim.(string)
+		if !ok || provider.usernameClaim == "" {
+			return nil, errors.New(`token auth requires a valid oidc option string: "usernameclaim"`)
+		}
+	}
+
+	if interval, ok := options["jwksrefreshinterval"]; ok {
+		intervalStr, ok := interval.(string)
+		if !ok {
+			return nil, errors.New(`token auth requires a valid oidc option string: "jwksrefreshinterval"`)
+		}
+		var err error
+		if provider.refreshInterval, err = time.ParseDuration(intervalStr); err != nil {
+			return nil, fmt.Errorf("unable to parse oidc jwksrefreshinterval: %v", err)
+		}
+	}
+
+	scopes, ok := options["scopes"]
+	if ok {
+		scopeList, ok := scopes.([]interface{})
+		if !ok {
+			return nil, errors.New("oidc scopes must be a list of scope rules")
+		}
+		for i, s := range scopeList {
+			rule, err := parseScopeRule(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid oidc scope rule %d: %v", i, err)
+			}
+			provider.rules = append(provider.rules, rule)
+		}
+	}
+
+	return provider, nil
+}
+
+func parseScopeRule(v interface{}) (scopeRule, error) {
+	options, ok := stringMap(v)
+	if !ok {
+		return scopeRule{}, errors.New("scope rule must be a map")
+	}
+
+	rule := scopeRule{typ: "repository"}
+	for key, dest := range map[string]*string{"claim": &rule.claim, "value": &rule.value, "type": &rule.typ} {
+		if val, ok := options[key]; ok {
+			if *dest, ok = val.(string); !ok {
+				return scopeRule{}, fmt.Errorf("%q must be a string", key)
+			}
+		}
+	}
+
+	name, ok := options["name"].(string)
+	if !ok || name == "" {
+		return scopeRule{}, errors.New(`"name" must be set to a resource name pattern`)
+	}
+	rule.name = auth.CompilePattern(name)
+
+	actions, ok := options["actions"].([]interface{})
+	if !ok || len(actions) == 0 {
+		return scopeRule{}, errors.New(`"actions" must be a list of actions`)
+	}
+	rule.actions = newActionSet()
+	for _, action := range actions {
+		a, ok := action.(string)
+		if !ok {
+			return scopeRule{}, fmt.Errorf("invalid action %#v", action)
+		}
+		rule.actions.add(a)
+	}
+
+	return rule, nil
+}
+
+// stringMap converts the maps produced by the configuration parser, which
+// may be keyed by interface{} values, to a map keyed by strings.
+func stringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(m))
+		for k, val := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, false
+			}
+			out[key] = val
+		}
+		return out, true
+	default:
+		return nil, false
+	}
+}
+
+// issued returns whether the token claims to be issued by the provider.
+// The claim is not verified.
+func (p *oidcProvider) issued(token *Token) bool {
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := token.JWT.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return false
+	}
+	return strings.TrimSuffix(claims.Issuer, "/") == p.issuer
+}
+
+// trustedKeys returns the provider signing keys, discovering the key set
+// location on first use.
+func (p *oidcProvider) trustedKeys(ctx context.Context, keyID string) (map[string]crypto.PublicKey, error) {
+	p.mu.Lock()
+	keySet := p.keySet
+	p.mu.Unlock()
+
+	if keySet == nil {
+		// NOTE: like key set refreshes, discovery happens without
+		// holding the lock and concurrent attempts share a single one.
+		v, err, _ := p.discoveries.Do("", func() (interface{}, error) {
+			return p.discover(context.WithoutCancel(ctx))
+		})
+		if err != nil {
+			return nil, err
+		}
+		keySet = v.(*remoteKeySet)
+	}
+
+	return keySet.trustedKeys(ctx, keyID)
+}
+
+// discover fetches the provider configuration document to locate its key
+// set, unless that was done since the caller last looked.
+func (p *oidcProvider) discover(ctx context.Context) (*remoteKeySet, error) {
+	p.mu.Lock()
+	if p.keySet != nil {
+		keySet := p.keySet
+		p.mu.Unlock()
+		return keySet, nil
+	}
+	if time.Since(p.lastDiscovery) < minJWKSRefreshInterval {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("oidc provider %s discovery pending", p.issuer)
+	}
+	p.lastDiscovery = time.Now()
+	p.mu.Unlock()
+
+	var doc oidcDiscoveryDocument
+	if err := fetchJSON(ctx, p.client, p.issuer+oidcDiscoveryPath, &doc); err != nil {
+		return nil, fmt.Errorf("unable to discover oidc provider %s: %v", p.issuer, err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc discovery document issuer %q does not match %q", doc.Issuer, p.issuer)
+	}
+	if doc.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc provider %s does not publish a jwks_uri", p.issuer)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keySet = newRemoteKeySet(doc.JWKSURI, p.client, p.refreshInterval)
+	return p.keySet, nil
+}
+
+// verify verifies an ID token issued by the provider and returns the name
+// of the authenticated user along with its claims.
+func (p *oidcProvider) verify(ctx context.Context, token *Token) (string, map[string]interface{}, error) {
+	if len(token.JWT.Headers) == 0 {
+		return "", nil, ErrInvalidToken
+	}
+
+	keys, err := p.trustedKeys(ctx, token.JWT.Headers[0].KeyID)
+	if err != nil {
+		log.Errorf("failed to retrieve oidc signing keys: %v", err)
+		return "", nil, ErrInvalidToken
+	}
+
+	_, err = token.Verify(VerifyOptions{
+		TrustedIssuers:    []string{p.issuer, p.issuer + "/"},
+		AcceptedAudiences: p.audiences,
+		// NOTE: an empty pool, rather than nil, keeps certificate
+		// chains embedded in ID tokens from being verified against
+		// the system roots: only the provider keys are trusted.
+		Roots:       x509.NewCertPool(),
+		TrustedKeys: keys,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the signature has been verified above
+	var claims map[string]interface{}
+	if err := token.JWT.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", nil, ErrMalformedToken
+	}
+
+	username, ok := claims[p.usernameClaim].(string)
+	if !ok || username == "" {
+		log.Infof("oidc token is missing the %q claim", p.usernameClaim)
+		return "", nil, ErrInvalidToken
+	}
+
+	return username, claims, nil
+}
+
+// authorized returns whether the scope rules grant the token all the
+// requested access.
+func (p *oidcProvider) authorized(claims map[string]interface{}, accessItems []auth.Access) bool {
+	for _, access := range accessItems {
+		granted := false
+		for _, rule := range p.rules {
+			if rule.matches(claims, access) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return false
+		}
+	}
+	return true
+}
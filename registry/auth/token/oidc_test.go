@@ -0,0 +1,202 @@
+package token
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// testIdP is a minimal OpenID provider serving a discovery document and a
+// rotatable key set.
+type testIdP struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	keys []jose.JSONWebKey
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscoveryDocument{Issuer: idp.URL, JWKSURI: idp.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		jwks := jose.JSONWebKeySet{}
+		for _, key := range idp.keys {
+			jwks.Keys = append(jwks.Keys, key.Public())
+		}
+		_ = json.NewEncoder(w).Encode(jwks)
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// rotate adds a new signing key to the published key set and returns it.
+func (idp *testIdP) rotate(t *testing.T, keyID string) jose.JSONWebKey {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := jose.JSONWebKey{Key: pk, KeyID: keyID, Algorithm: string(jose.ES256), Use: "sig"}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys = append(idp.keys, key)
+	return key
+}
+
+func (idp *testIdP) idToken(t *testing.T, key jose.JSONWebKey, audience string, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	raw, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   idp.URL,
+		Subject:  "1234",
+		Audience: jwt.Audience{audience},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(now),
+	}).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestOIDCAccessController(t *testing.T) {
+	idp := newTestIdP(t)
+	key := idp.rotate(t, "key-1")
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":   "https://auth.example.com/token/",
+		"issuer":  "test-issuer.example.com",
+		"service": "registry.example.com",
+		"oidc": map[interface{}]interface{}{
+			"issuer":        idp.URL,
+			"usernameclaim": "email",
+			"scopes": []interface{}{
+				map[interface{}]interface{}{
+					"claim":   "groups",
+					"value":   "team-x",
+					"name":    "prod/**",
+					"actions": []interface{}{"pull", "push"},
+				},
+				map[interface{}]interface{}{
+					"name":    "public/*",
+					"actions": []interface{}{"pull"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(rawToken string, access ...auth.Access) (*auth.Grant, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.Header.Set("Authorization", "Bearer "+rawToken)
+		return ac.Authorized(req, access...)
+	}
+	pushProd := []auth.Access{
+		{Resource: auth.Resource{Type: "repository", Name: "prod/app/api"}, Action: "pull"},
+		{Resource: auth.Resource{Type: "repository", Name: "prod/app/api"}, Action: "push"},
+	}
+	pullPublic := auth.Access{Resource: auth.Resource{Type: "repository", Name: "public/base"}, Action: "pull"}
+
+	member := idp.idToken(t, key, "registry.example.com", map[string]interface{}{
+		"email":  "member@example.com",
+		"groups": []string{"team-x"},
+	})
+	grant, err := authorize(member, pushProd...)
+	if err != nil {
+		t.Fatalf("unexpected error authorizing team member: %v", err)
+	}
+	if grant.User.Name != "member@example.com" {
+		t.Fatalf("unexpected user name %q", grant.User.Name)
+	}
+	if len(grant.Resources) != 1 || grant.Resources[0].Name != "prod/app/api" {
+		t.Fatalf("unexpected granted resources %v", grant.Resources)
+	}
+
+	outsider := idp.idToken(t, key, "registry.example.com", map[string]interface{}{
+		"email":  "outsider@example.com",
+		"groups": []string{"team-y"},
+	})
+	if _, err := authorize(outsider, pushProd...); err == nil || err.Error() != ErrInsufficientScope.Error() {
+		t.Fatalf("expected insufficient scope for outsider, got %v", err)
+	}
+	if _, err := authorize(outsider, pullPublic); err != nil {
+		t.Fatalf("unexpected error pulling public repository: %v", err)
+	}
+
+	wrongAudience := idp.idToken(t, key, "another-service", map[string]interface{}{"email": "member@example.com"})
+	if _, err := authorize(wrongAudience, pullPublic); err == nil {
+		t.Fatal("expected token for another audience to be rejected")
+	}
+
+	// tokens signed by a key published after the key set was cached are
+	// accepted once the rate limit allows a refresh
+	rotated := idp.rotate(t, "key-2")
+	ac.(*accessController).oidc.keySet.fetchedAt = time.Now().Add(-minJWKSRefreshInterval)
+	if _, err := authorize(idp.idToken(t, rotated, "registry.example.com", map[string]interface{}{"email": "member@example.com"}), pullPublic); err != nil {
+		t.Fatalf("unexpected error authorizing token signed by rotated key: %v", err)
+	}
+}
+
+func TestOIDCConcurrentDiscovery(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.rotate(t, "key")
+
+	var discoveries atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		discoveries.Add(1)
+		<-release
+		_ = json.NewEncoder(w).Encode(oidcDiscoveryDocument{Issuer: "http://" + r.Host, JWKSURI: idp.URL + "/keys"})
+	}))
+	defer server.Close()
+
+	provider := &oidcProvider{issuer: server.URL, client: server.Client()}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := provider.trustedKeys(context.Background(), "key")
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error retrieving provider keys: %v", err)
+		}
+	}
+	if n := discoveries.Load(); n != 1 {
+		t.Fatalf("expected a single discovery, got %d", n)
+	}
+}
@@ -0,0 +1,315 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+const (
+	defaultServerPath       = "/auth/token"
+	defaultServerExpiration = 5 * time.Minute
+)
+
+// tokenServer is a built-in token server, issuing the tokens trusted by the
+// access controller. Clients are authenticated, and the requested access
+// authorized, by a backend access controller such as htpasswd or ldap.
+type tokenServer struct {
+	path       string
+	issuer     string
+	service    string
+	expiration time.Duration
+	backend    auth.AccessController
+
+	key       crypto.Signer
+	keyID     string
+	algorithm jose.SignatureAlgorithm
+}
+
+// newTokenServer configures a token server from the server option map.
+func newTokenServer(options map[string]interface{}, issuer, service string) (*tokenServer, error) {
+	ts := &tokenServer{
+		path:       defaultServerPath,
+		issuer:     issuer,
+		service:    service,
+		expiration: defaultServerExpiration,
+	}
+	if issuer == "" {
+		return nil, errors.New(`token auth server requires "issuer" to be set`)
+	}
+
+	var keyPath string
+	for key, val := range map[string]*string{"path": &ts.path, "signingkey": &keyPath} {
+		if v, present := options[key]; present {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("token auth server requires a valid option string: %q", key)
+			}
+			*val = s
+		}
+	}
+
+	if v, present := options["expiration"]; present {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("token auth server requires a valid option string: %q", "expiration")
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("unable to parse token auth server expiration: %q", s)
+		}
+		ts.expiration = d
+	}
+
+	backendOptions, ok := stringMap(options["backend"])
+	if !ok || len(backendOptions) != 1 {
+		return nil, errors.New("token auth server requires a backend access controller")
+	}
+	for name, v := range backendOptions {
+		params, ok := stringMap(v)
+		if !ok && v != nil {
+			return nil, fmt.Errorf("token auth server backend %s options must be a map", name)
+		}
+		backend, err := auth.GetAccessController(name, params)
+		if err != nil {
+			return nil, fmt.Errorf("token auth server backend: %v", err)
+		}
+		ts.backend = backend
+	}
+
+	var err error
+	if keyPath != "" {
+		ts.key, err = loadSigningKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// tokens signed by a generated key are invalidated by a restart,
+		// and are not trusted by other registry instances
+		logrus.Warn("token auth server: no signing key configured, generating one")
+		ts.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ts.keyID = GetRFC7638Thumbprint(ts.key.Public())
+	switch key := ts.key.(type) {
+	case *rsa.PrivateKey:
+		ts.algorithm = jose.RS256
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			ts.algorithm = jose.ES256
+		case elliptic.P384():
+			ts.algorithm = jose.ES384
+		case elliptic.P521():
+			ts.algorithm = jose.ES512
+		}
+	}
+	if ts.keyID == "" || ts.algorithm == "" {
+		return nil, errors.New("token auth server signing key must be an RSA or ECDSA P-256, P-384 or P-521 key")
+	}
+
+	return ts, nil
+}
+
+// loadSigningKey reads a PEM encoded private key.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token auth server signing key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("token auth server signing key %s is not PEM encoded", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse token auth server signing key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported token auth server signing key type %T", key)
+	}
+	return signer, nil
+}
+
+// tokenResponse is the response of the token server.
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// ServeHTTP issues a token granting the requested scopes allowed by the
+// backend. Clients presenting no credentials are given a token for the
+// access the backend allows anonymously, if any.
+func (ts *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if service := r.URL.Query().Get("service"); service != "" && service != ts.service {
+		ts.serveError(w, errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf("unknown service %q", service)))
+		return
+	}
+
+	var subject string
+	if r.Header.Get("Authorization") != "" {
+		grant, err := ts.backend.Authorized(r)
+		if err != nil {
+			var challenge auth.Challenge
+			if errors.As(err, &challenge) {
+				challenge.SetHeaders(r, w)
+			}
+			logrus.Infof("token auth server: authentication failed: %v", err)
+			ts.serveError(w, errcode.ErrorCodeUnauthorized)
+			return
+		}
+		subject = grant.User.Name
+	}
+
+	var access []*ResourceActions
+	for _, scope := range r.URL.Query()["scope"] {
+		for _, s := range strings.Fields(scope) {
+			resource, ok := parseScope(s)
+			if !ok {
+				logrus.Infof("token auth server: ignoring invalid scope %q", s)
+				continue
+			}
+			if granted := ts.grantedActions(r, resource); len(granted.Actions) > 0 {
+				access = append(access, granted)
+			}
+		}
+	}
+
+	now := time.Now()
+	claims := ClaimSet{
+		Issuer:     ts.issuer,
+		Subject:    subject,
+		Audience:   AudienceList{ts.service},
+		Expiration: now.Add(ts.expiration).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		JWTID:      uuid.NewString(),
+		Access:     access,
+	}
+	if claims.Access == nil {
+		claims.Access = []*ResourceActions{}
+	}
+
+	token, err := ts.sign(claims)
+	if err != nil {
+		logrus.Errorf("token auth server: unable to sign token: %v", err)
+		ts.serveError(w, errcode.ErrorCodeUnknown)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(ts.expiration.Seconds()),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	}); err != nil {
+		logrus.Errorf("token auth server: unable to write response: %v", err)
+	}
+}
+
+// grantedActions returns the requested actions on the resource allowed by
+// the backend.
+func (ts *tokenServer) grantedActions(r *http.Request, requested *ResourceActions) *ResourceActions {
+	granted := &ResourceActions{Type: requested.Type, Class: requested.Class, Name: requested.Name, Tags: requested.Tags}
+	for _, action := range requested.Actions {
+		_, err := ts.backend.Authorized(r, auth.Access{
+			Resource: auth.Resource{Type: requested.Type, Class: requested.Class, Name: requested.Name},
+			Action:   action,
+		})
+		if err == nil {
+			granted.Actions = append(granted.Actions, action)
+		}
+	}
+	return granted
+}
+
+// sign signs the claims with the server key.
+func (ts *tokenServer) sign(claims ClaimSet) (string, error) {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: ts.algorithm, Key: ts.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader(jose.HeaderKey("kid"), ts.keyID),
+	)
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
+
+func (ts *tokenServer) serveError(w http.ResponseWriter, err error) {
+	if err := errcode.ServeJSON(w, err); err != nil {
+		logrus.Errorf("token auth server: error serving error json: %v", err)
+	}
+}
+
+// parseScope parses a "type[(class)]:name[@tags]:actions" scope, where tags
+// is a comma separated list of tag patterns the actions are restricted to.
+// Names may contain colons, such as a registry host with a port.
+func parseScope(scope string) (*ResourceActions, bool) {
+	typ, rest, ok := strings.Cut(scope, ":")
+	i := strings.LastIndex(rest, ":")
+	if !ok || i <= 0 || typ == "" {
+		return nil, false
+	}
+	resource := &ResourceActions{Type: typ, Name: rest[:i]}
+	if name, tags, ok := strings.Cut(resource.Name, "@"); ok {
+		resource.Name = name
+		for _, pattern := range strings.Split(tags, ",") {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return nil, false
+			}
+			resource.Tags = append(resource.Tags, pattern)
+		}
+	}
+	if open := strings.IndexByte(typ, '('); open > 0 && strings.HasSuffix(typ, ")") {
+		resource.Type, resource.Class = typ[:open], typ[open+1:len(typ)-1]
+	}
+	for _, action := range strings.Split(rest[i+1:], ",") {
+		if action != "" {
+			resource.Actions = append(resource.Actions, action)
+		}
+	}
+	return resource, len(resource.Actions) > 0
+}
@@ -0,0 +1,249 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+var errTestDenied = errors.New("denied")
+
+// testBackend authenticates bob, who may pull and push to bob/*, and lets
+// anyone pull from public/*.
+type testBackend struct{}
+
+func (testBackend) Authorized(req *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	username, password, ok := req.BasicAuth()
+	if ok && (username != "bob" || password != "secret") {
+		return nil, auth.ErrAuthenticationFailure
+	}
+	for _, a := range access {
+		switch {
+		case strings.HasPrefix(a.Name, "public/") && a.Action == "pull":
+		case ok && strings.HasPrefix(a.Name, "bob/"):
+		default:
+			return nil, errTestDenied
+		}
+	}
+	return &auth.Grant{User: auth.UserInfo{Name: username}}, nil
+}
+
+func init() {
+	if err := auth.Register("tokenserver-test", func(options map[string]interface{}) (auth.AccessController, error) {
+		return testBackend{}, nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func newTestServerController(t *testing.T, server map[interface{}]interface{}) *accessController {
+	t.Helper()
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":   "https://registry.example.com/auth/token",
+		"issuer":  "registry.example.com",
+		"service": "registry.example.com",
+		"server":  server,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac.(*accessController)
+}
+
+func TestTokenServer(t *testing.T) {
+	ac := newTestServerController(t, map[interface{}]interface{}{
+		"backend": map[interface{}]interface{}{"tokenserver-test": nil},
+	})
+	handler := ac.Handlers()[defaultServerPath]
+	if handler == nil {
+		t.Fatalf("expected a handler at %s, got %v", defaultServerPath, ac.Handlers())
+	}
+
+	requestToken := func(username, password string, scopes ...string) (*httptest.ResponseRecorder, *ClaimSet) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, defaultServerPath+"?service=registry.example.com", nil)
+		q := req.URL.Query()
+		for _, scope := range scopes {
+			q.Add("scope", scope)
+		}
+		req.URL.RawQuery = q.Encode()
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return w, nil
+		}
+
+		var resp tokenResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Token == "" || resp.AccessToken != resp.Token || resp.ExpiresIn != 300 {
+			t.Fatalf("unexpected token response: %#v", resp)
+		}
+
+		// the issued token is trusted by the access controller
+		token, err := NewToken(resp.Token, ac.signingAlgorithms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issuer := ac.tokenIssuer(token)
+		if issuer == nil {
+			t.Fatal("token issued by an untrusted issuer")
+		}
+		keys := issuer.keyFiles.current()
+		claims, err := token.Verify(VerifyOptions{
+			TrustedIssuers:    []string{issuer.issuer},
+			AcceptedAudiences: issuer.audiences,
+			Roots:             keys.rootCerts,
+			TrustedKeys:       keys.trustedKeys,
+		})
+		if err != nil {
+			t.Fatalf("unable to verify issued token: %v", err)
+		}
+		return w, claims
+	}
+
+	_, claims := requestToken("bob", "secret", "repository:bob/app:pull,push repository:alice/app:pull", "repository:public/app:pull,push")
+	expected := []*ResourceActions{
+		{Type: "repository", Name: "bob/app", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "public/app", Actions: []string{"pull"}},
+	}
+	if claims.Subject != "bob" || !reflect.DeepEqual(claims.Access, expected) {
+		t.Fatalf("unexpected claims: %s %v", claims.Subject, claims.Access)
+	}
+
+	// the token grants access through the access controller
+	_, claims = requestToken("bob", "secret", "repository:bob/app:push")
+	if claims == nil {
+		t.Fatal("expected a token")
+	}
+
+	_, claims = requestToken("", "", "repository:public/app:pull", "repository:bob/app:pull")
+	expected = []*ResourceActions{{Type: "repository", Name: "public/app", Actions: []string{"pull"}}}
+	if claims.Subject != "" || !reflect.DeepEqual(claims.Access, expected) {
+		t.Fatalf("unexpected anonymous claims: %s %v", claims.Subject, claims.Access)
+	}
+
+	if w, _ := requestToken("bob", "wrong", "repository:bob/app:pull"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected invalid credentials to be rejected, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, defaultServerPath+"?service=other.example.com", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected a token request for another service to be denied, got %d", w.Code)
+	}
+}
+
+func TestTokenServerAuthorized(t *testing.T) {
+	ac := newTestServerController(t, map[interface{}]interface{}{
+		"path":    "/token",
+		"backend": map[interface{}]interface{}{"tokenserver-test": nil},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/token?scope=repository:bob/app:pull", nil)
+	req.SetBasicAuth("bob", "secret")
+	w := httptest.NewRecorder()
+	ac.Handlers()["/token"].ServeHTTP(w, req)
+	var resp tokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/bob/app/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token)
+	grant, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "bob/app"}, Action: "pull"})
+	if err != nil {
+		t.Fatalf("unexpected error authorizing with an issued token: %v", err)
+	}
+	if grant.User.Name != "bob" {
+		t.Fatalf("unexpected user %q", grant.User.Name)
+	}
+	if _, err := ac.Authorized(req, auth.Access{Resource: auth.Resource{Type: "repository", Name: "bob/app"}, Action: "push"}); err == nil {
+		t.Fatal("expected the token not to grant push access")
+	}
+}
+
+func TestTokenServerSigningKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ac := newTestServerController(t, map[interface{}]interface{}{
+		"signingkey": path,
+		"backend":    map[interface{}]interface{}{"tokenserver-test": nil},
+	})
+	if ac.server.keyID != GetRFC7638Thumbprint(key.Public()) || ac.server.algorithm != "ES384" {
+		t.Fatalf("unexpected signing key %s (%s)", ac.server.keyID, ac.server.algorithm)
+	}
+}
+
+func TestTokenServerOptions(t *testing.T) {
+	backend := map[interface{}]interface{}{"tokenserver-test": nil}
+	for _, server := range []map[interface{}]interface{}{
+		{},
+		{"backend": map[interface{}]interface{}{"unknown": nil}},
+		{"backend": backend, "expiration": "soon"},
+		{"backend": backend, "path": ""},
+		{"backend": backend, "signingkey": filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := newAccessController(map[string]interface{}{
+			"realm":   "https://registry.example.com/auth/token",
+			"issuer":  "registry.example.com",
+			"service": "registry.example.com",
+			"server":  server,
+		}); err == nil {
+			t.Errorf("expected error with server options %v", server)
+		}
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	for scope, expected := range map[string]*ResourceActions{
+		"repository:foo/bar:pull,push":       {Type: "repository", Name: "foo/bar", Actions: []string{"pull", "push"}},
+		"repository(plugin):foo:pull":        {Type: "repository", Class: "plugin", Name: "foo", Actions: []string{"pull"}},
+		"repository:localhost:5000/foo:pull": {Type: "repository", Name: "localhost:5000/foo", Actions: []string{"pull"}},
+		"registry:catalog:*":                 {Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		"repository:foo/bar@release-*:push":  {Type: "repository", Name: "foo/bar", Actions: []string{"push"}, Tags: []string{"release-*"}},
+		"repository:localhost:5000/foo@v*,latest:pull,push": {
+			Type: "repository", Name: "localhost:5000/foo", Actions: []string{"pull", "push"}, Tags: []string{"v*", "latest"},
+		},
+		"repository:foo@:push":    nil,
+		"repository:foo@[:push":   nil,
+		"repository:foo@v*,:push": nil,
+		"repository:foo":          nil,
+		"repository:foo:":         nil,
+		":foo:pull":               nil,
+	} {
+		resource, ok := parseScope(scope)
+		if ok != (expected != nil) || (ok && !reflect.DeepEqual(resource, expected)) {
+			t.Errorf("unexpected parse of %q: %#v %t", scope, resource, ok)
+		}
+	}
+}
@@ -67,6 +67,11 @@ type ResourceActions struct {
 	Class   string   `json:"class,omitempty"`
 	Name    string   `json:"name"`
 	Actions []string `json:"actions"`
+
+	// Tags restricts the actions on a repository to the tags matching one
+	// of the patterns, such as "release-*". The actions are allowed on all
+	// tags if it is empty.
+	Tags []string `json:"tags,omitempty"`
 }
 
 // ClaimSet describes the main section of a JSON Web Token.
@@ -295,6 +300,35 @@ func (c *ClaimSet) accessSet() accessSet {
 	return accessSet
 }
 
+// tagConstraints returns the tag constraints of the access items. An action
+// allowed on all tags by any entry of the `access` section is unconstrained.
+func (c *ClaimSet) tagConstraints(accessItems []auth.Access) []auth.TagConstraint {
+	var constraints []auth.TagConstraint
+	for _, access := range accessItems {
+		var patterns []string
+		constrained := false
+		for _, resourceActions := range c.Access {
+			if resourceActions.Type != access.Type || resourceActions.Name != access.Name ||
+				!newActionSet(resourceActions.Actions...).contains(access.Action) {
+				continue
+			}
+			if len(resourceActions.Tags) == 0 {
+				constrained = false
+				break
+			}
+			constrained = true
+			patterns = append(patterns, resourceActions.Tags...)
+		}
+		if constrained {
+			constraints = append(constraints, auth.TagConstraint{
+				Access:   auth.Access{Resource: auth.Resource{Type: access.Type, Name: access.Name}, Action: access.Action},
+				Patterns: patterns,
+			})
+		}
+	}
+	return constraints
+}
+
 func (c *ClaimSet) resources() []auth.Resource {
 	resourceSet := map[auth.Resource]struct{}{}
 
@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+// clientCAsReloadInterval is how often the modification times of the client
+// CA files are checked.
+const clientCAsReloadInterval = 10 * time.Second
+
+// clientCAs holds the TLS configuration verifying client certificates with
+// the CAs of http.tls.clientcas, and reloads the CA files when they change,
+// so that client CAs can be rotated without restarting the registry.
+type clientCAs struct {
+	files  []string
+	base   *tls.Config
+	logger dcontext.Logger
+
+	mu       sync.Mutex
+	checked  time.Time
+	modtimes []time.Time
+
+	// config is swapped as a whole, handshakes using either the previous
+	// or the reloaded CAs.
+	config atomic.Pointer[tls.Config]
+}
+
+// newClientCAs loads the client CA files, the TLS configuration of
+// handshakes being base with the loaded CAs.
+func newClientCAs(files []string, base *tls.Config, logger dcontext.Logger) (*clientCAs, error) {
+	c := &clientCAs{files: files, base: base, logger: logger, checked: time.Now()}
+	// the modification times are read first, so that files modified while
+	// they are loaded are loaded again
+	c.modtimes, _ = c.stat()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// pool returns the current client CAs.
+func (c *clientCAs) pool() *x509.CertPool {
+	return c.config.Load().ClientCAs
+}
+
+// getConfigForClient returns the TLS configuration of a handshake, reloading
+// the CA files if they changed and were not checked within the reload
+// interval. If the files fail to load, the previous CAs remain trusted.
+func (c *clientCAs) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); now.Sub(c.checked) >= clientCAsReloadInterval {
+		c.checked = now
+		if err := c.reload(); err != nil {
+			c.logger.Errorf("failed to reload http.tls.clientcas, keeping the previous CAs: %v", err)
+		}
+	}
+	return c.config.Load(), nil
+}
+
+// reload loads the files if they were modified since they were last read.
+// It must be called with c.mu held.
+func (c *clientCAs) reload() error {
+	modtimes, err := c.stat()
+	if err != nil {
+		return err
+	}
+	if slices.Equal(modtimes, c.modtimes) {
+		return nil
+	}
+	// files failing to load are only reported once per modification
+	c.modtimes = modtimes
+
+	if err := c.load(); err != nil {
+		return err
+	}
+	c.logger.Infof("reloaded http.tls.clientcas")
+	return nil
+}
+
+// stat returns the modification times of the files.
+func (c *clientCAs) stat() ([]time.Time, error) {
+	modtimes := make([]time.Time, len(c.files))
+	for i, file := range c.files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modtimes[i] = fi.ModTime()
+	}
+	return modtimes, nil
+}
+
+// load reads the files, and swaps the TLS configuration if they load
+// successfully.
+func (c *clientCAs) load() error {
+	pool := x509.NewCertPool()
+	for _, ca := range c.files {
+		caPem, err := os.ReadFile(ca)
+		if err != nil {
+			return err
+		}
+
+		if ok := pool.AppendCertsFromPEM(caPem); !ok {
+			return fmt.Errorf("could not add CA to pool: %s", ca)
+		}
+	}
+
+	config := c.base.Clone()
+	config.ClientCAs = pool
+	config.GetConfigForClient = nil
+	c.config.Store(config)
+	return nil
+}
@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+func TestClientCAsReload(t *testing.T) {
+	var pems [][]byte
+	var pools []*x509.CertPool
+	for _, name := range []string{"registry_test_client_ca_1", "registry_test_client_ca_2"} {
+		ca, err := buildRegistryTLSConfig(name, "ecdsa", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(ca.certificatePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(b)
+		pems = append(pems, b)
+		pools = append(pools, pool)
+	}
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	modtime := time.Now()
+	rewrite := func(content []byte) {
+		if err := os.WriteFile(file, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		modtime = modtime.Add(time.Second)
+		if err := os.Chtimes(file, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rewrite(pems[0])
+
+	base := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12}
+	cas, err := newClientCAs([]string{file}, base, dcontext.GetLogger(dcontext.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func() *tls.Config {
+		// the reload interval elapsed
+		cas.checked = time.Time{}
+		config, err := cas.getConfigForClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ClientAuth != tls.RequireAndVerifyClientCert || config.MinVersion != tls.VersionTLS12 {
+			t.Fatalf("unexpected TLS configuration: %#v", config)
+		}
+		return config
+	}
+
+	if !handshake().ClientCAs.Equal(pools[0]) {
+		t.Fatal("unexpected client CAs")
+	}
+
+	rewrite(pems[1])
+	if !handshake().ClientCAs.Equal(pools[1]) {
+		t.Fatal("expected the client CAs to be reloaded")
+	}
+
+	// files failing to load leave the previous CAs trusted
+	rewrite([]byte("not a certificate"))
+	if !handshake().ClientCAs.Equal(pools[1]) {
+		t.Fatal("expected the previous client CAs to remain trusted")
+	}
+
+	if _, err := newClientCAs([]string{file}, base, dcontext.GetLogger(dcontext.Background())); err == nil {
+		t.Fatal("expected an error loading an invalid CA file")
+	}
+}
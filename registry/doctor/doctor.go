@@ -0,0 +1,762 @@
+// Package doctor runs an end-to-end diagnosis of a live registry instance.
+// It pushes and pulls a small canary image, exercising the code paths behind
+// the most common deployment issues: authentication, clock skew with the
+// token service, chunked uploads resumed across requests and blob redirects
+// to the storage backend.
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/client/auth/challenge"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// DefaultRepository is the repository the canary image is pushed to.
+	DefaultRepository = "doctor/canary"
+
+	// DefaultMaxClockSkew is the clock skew above which a warning is
+	// reported.
+	DefaultMaxClockSkew = 10 * time.Second
+
+	canaryTag = "doctor"
+
+	// chunkSize is the size of each of the two chunks of the canary layer.
+	chunkSize = 64 << 10
+
+	// maxResponseSize bounds the size of the responses read, other than
+	// blobs.
+	maxResponseSize = 1 << 20
+)
+
+// Options configures a diagnosis.
+type Options struct {
+	// URL is the base URL of the registry, such as https://registry.example.com.
+	URL string
+
+	// Repository is the repository the canary image is pushed to. It
+	// defaults to DefaultRepository.
+	Repository string
+
+	// Username and Password are the credentials used to authenticate with
+	// the registry or its token service.
+	Username string
+	Password string
+
+	// Insecure disables the verification of TLS certificates.
+	Insecure bool
+
+	// MaxClockSkew is the clock skew above which a warning is reported. It
+	// defaults to DefaultMaxClockSkew.
+	MaxClockSkew time.Duration
+
+	// Transport is the transport used to reach the registry, the token
+	// service and the storage backend. It defaults to a clone of
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+// Status is the outcome of a check.
+type Status int
+
+const (
+	// StatusOK reports a successful check.
+	StatusOK Status = iota
+	// StatusWarning reports a check which succeeded, with a caveat.
+	StatusWarning
+	// StatusFailed reports a failed check.
+	StatusFailed
+	// StatusSkipped reports a check which did not apply, or could not run
+	// because an earlier check failed.
+	StatusSkipped
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "OK"
+	case StatusWarning:
+		return "WARN"
+	case StatusFailed:
+		return "FAIL"
+	case StatusSkipped:
+		return "SKIP"
+	default:
+		return "Status(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// Result is the result of a check.
+type Result struct {
+	Check    string
+	Status   Status
+	Message  string
+	Duration time.Duration
+}
+
+// Report is the result of a diagnosis.
+type Report struct {
+	URL     string
+	Results []Result
+}
+
+// Failed returns whether any check failed.
+func (r *Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteTo writes a human readable report to w.
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "registry doctor report for %s\n\n", r.URL)
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	failed, warned := 0, 0
+	for _, result := range r.Results {
+		fmt.Fprintf(tw, "[%s]\t%s\t%s\t%s\n", result.Status, result.Check, result.Duration.Round(time.Millisecond), result.Message)
+		switch result.Status {
+		case StatusFailed:
+			failed++
+		case StatusWarning:
+			warned++
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(&buf, "\n%d checks, %d failed, %d warnings\n", len(r.Results), failed, warned)
+	return buf.WriteTo(w)
+}
+
+// Run diagnoses the registry at opts.URL. Failures are recorded in the
+// report; an error is only returned if the options are invalid.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	base, err := url.Parse(strings.TrimSuffix(opts.URL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry URL %q: %v", opts.URL, err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid registry URL %q: the scheme must be http or https", opts.URL)
+	}
+	if opts.Repository == "" {
+		opts.Repository = DefaultRepository
+	}
+	if opts.MaxClockSkew <= 0 {
+		opts.MaxClockSkew = DefaultMaxClockSkew
+	}
+	if opts.Transport == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.Insecure {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // nolint:gosec // explicitly requested
+		}
+		opts.Transport = transport
+	}
+
+	d := &doctor{
+		ctx:    ctx,
+		opts:   opts,
+		base:   base,
+		report: &Report{URL: base.String()},
+		client: &http.Client{
+			Transport: opts.Transport,
+			// redirects are checked explicitly
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	d.run()
+	return d.report, nil
+}
+
+// doctor holds the state shared by the checks of a diagnosis.
+type doctor struct {
+	ctx    context.Context
+	opts   Options
+	base   *url.URL
+	client *http.Client
+	report *Report
+
+	// authorization is the value of the Authorization header sent to the
+	// registry.
+	authorization string
+	// challenge is the bearer challenge of the registry, if any.
+	challenge *challenge.Challenge
+	// clocks are the offsets of the remote clocks observed by the checks.
+	clocks []clockSample
+
+	layer, config []byte
+	manifest      []byte
+	manifestDgst  digest.Digest
+	redirects     map[digest.Digest]string
+}
+
+// clockSample is the offset of a remote clock from the local clock.
+type clockSample struct {
+	source string
+	offset time.Duration
+}
+
+func (d *doctor) run() {
+	if !d.check("api", d.checkAPI) {
+		d.skip("token", "clock", "upload", "push", "pull", "redirect", "cleanup")
+		return
+	}
+	tokenOK := true
+	if d.challenge != nil {
+		tokenOK = d.check("token", d.checkToken)
+	}
+	d.check("clock", d.checkClock)
+	if !tokenOK {
+		d.skip("upload", "push", "pull", "redirect", "cleanup")
+		return
+	}
+	if !d.check("upload", d.checkUpload) {
+		d.skip("push", "pull", "redirect", "cleanup")
+		return
+	}
+	if !d.check("push", d.checkPush) {
+		d.skip("pull", "redirect", "cleanup")
+		return
+	}
+	if d.check("pull", d.checkPull) {
+		d.check("redirect", d.checkRedirect)
+	} else {
+		d.skip("redirect")
+	}
+	d.check("cleanup", d.checkCleanup)
+}
+
+// check runs a check and records its result, returning whether it did not
+// fail.
+func (d *doctor) check(name string, f func() (Status, string, error)) bool {
+	start := time.Now()
+	status, message, err := f()
+	if err != nil {
+		status, message = StatusFailed, err.Error()
+	}
+	d.report.Results = append(d.report.Results, Result{
+		Check:    name,
+		Status:   status,
+		Message:  message,
+		Duration: time.Since(start),
+	})
+	return status != StatusFailed
+}
+
+func (d *doctor) skip(names ...string) {
+	for _, name := range names {
+		d.report.Results = append(d.report.Results, Result{
+			Check:   name,
+			Status:  StatusSkipped,
+			Message: "skipped after an earlier failure",
+		})
+	}
+}
+
+// checkAPI checks that the registry API is reachable, and authenticates
+// with basic authentication if the registry requires it.
+func (d *doctor) checkAPI() (Status, string, error) {
+	resp, _, err := d.do(http.MethodGet, "/v2/", nil, nil)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	d.observeClock("registry", resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return StatusOK, "registry API reachable without authentication", nil
+	case http.StatusUnauthorized:
+	default:
+		return StatusFailed, "", unexpectedStatus(resp, nil)
+	}
+
+	for _, c := range challenge.ResponseChallenges(resp) {
+		switch strings.ToLower(c.Scheme) {
+		case "bearer":
+			d.challenge = &c
+			return StatusOK, fmt.Sprintf("registry API reachable, token authentication with realm %s", c.Parameters["realm"]), nil
+		case "basic":
+			if d.opts.Username == "" {
+				return StatusFailed, "", errors.New("the registry requires basic authentication, but no credentials were given")
+			}
+			d.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(d.opts.Username+":"+d.opts.Password))
+
+			resp, _, err := d.do(http.MethodGet, "/v2/", nil, nil)
+			if err != nil {
+				return StatusFailed, "", err
+			}
+			if resp.StatusCode != http.StatusOK {
+				return StatusFailed, "", fmt.Errorf("basic authentication as %q failed: %s", d.opts.Username, resp.Status)
+			}
+			return StatusOK, fmt.Sprintf("registry API reachable, authenticated as %q", d.opts.Username), nil
+		}
+	}
+	return StatusFailed, "", fmt.Errorf("unsupported authentication challenge %q", resp.Header.Get("WWW-Authenticate"))
+}
+
+// checkToken fetches a token granting access to the canary repository.
+func (d *doctor) checkToken() (Status, string, error) {
+	realm, err := url.Parse(d.challenge.Parameters["realm"])
+	if err != nil || (realm.Scheme != "http" && realm.Scheme != "https") {
+		return StatusFailed, "", fmt.Errorf("invalid token realm %q", d.challenge.Parameters["realm"])
+	}
+	query := realm.Query()
+	if service := d.challenge.Parameters["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+d.opts.Repository+":pull,push,delete")
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if d.opts.Username != "" {
+		req.SetBasicAuth(d.opts.Username, d.opts.Password)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return StatusFailed, "", fmt.Errorf("token service unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	d.observeClock("token service", resp)
+	if resp.StatusCode != http.StatusOK {
+		return StatusFailed, "", unexpectedStatus(resp, body)
+	}
+
+	var tr struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return StatusFailed, "", fmt.Errorf("invalid token response: %v", err)
+	}
+	if tr.Token == "" {
+		tr.Token = tr.AccessToken
+	}
+	if tr.Token == "" {
+		return StatusFailed, "", errors.New("the token service response holds no token")
+	}
+	if !tr.IssuedAt.IsZero() {
+		d.clocks = append(d.clocks, clockSample{source: "token issued_at", offset: time.Until(tr.IssuedAt)})
+	}
+	if iat, ok := tokenIssuedAt(tr.Token); ok {
+		d.clocks = append(d.clocks, clockSample{source: "token iat claim", offset: time.Until(iat)})
+	}
+	d.authorization = "Bearer " + tr.Token
+
+	resp, _, err = d.do(http.MethodGet, "/v2/", nil, nil)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return StatusFailed, "", fmt.Errorf("the registry rejected the token issued by %s: %s", realm.Host, resp.Status)
+	}
+	return StatusOK, fmt.Sprintf("token issued by %s accepted by the registry", realm.Host), nil
+}
+
+// tokenIssuedAt returns the unverified iat claim of a JWT.
+func tokenIssuedAt(raw string) (time.Time, bool) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		IssuedAt int64 `json:"iat"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.IssuedAt == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.IssuedAt, 0), true
+}
+
+// checkClock compares the clocks of the registry and token service with the
+// local clock. Tokens are rejected when the token service and the registry
+// disagree on the time by more than the token leeway.
+func (d *doctor) checkClock() (Status, string, error) {
+	if len(d.clocks) == 0 {
+		return StatusSkipped, "no remote clock observed", nil
+	}
+
+	var worst clockSample
+	samples := make([]string, 0, len(d.clocks))
+	for _, sample := range d.clocks {
+		samples = append(samples, fmt.Sprintf("%s %+.1fs", sample.source, sample.offset.Seconds()))
+		if abs(sample.offset) > abs(worst.offset) {
+			worst = sample
+		}
+	}
+	message := "offsets from the local clock: " + strings.Join(samples, ", ")
+
+	switch skew := abs(worst.offset); {
+	case d.challenge != nil && skew > token.Leeway:
+		return StatusFailed, fmt.Sprintf("%s clock is off by %s, beyond the %s token leeway: %s", worst.source, skew.Round(time.Second), token.Leeway, message), nil
+	case skew > d.opts.MaxClockSkew:
+		return StatusWarning, fmt.Sprintf("%s clock is off by %s: %s", worst.source, skew.Round(time.Second), message), nil
+	default:
+		return StatusOK, message, nil
+	}
+}
+
+// checkUpload uploads the canary layer in two chunks, checking the upload
+// status in between as a client resuming an interrupted upload would.
+func (d *doctor) checkUpload() (Status, string, error) {
+	d.layer = make([]byte, 2*chunkSize)
+	if _, err := rand.Read(d.layer); err != nil {
+		return StatusFailed, "", err
+	}
+	dgst := digest.FromBytes(d.layer)
+
+	resp, body, err := d.do(http.MethodPost, d.repoPath("blobs/uploads/"), nil, nil)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return StatusFailed, "", fmt.Errorf("starting the upload: %v", unexpectedStatus(resp, body))
+	}
+	location := resp.Header.Get("Location")
+
+	header := http.Header{
+		"Content-Type":  []string{"application/octet-stream"},
+		"Content-Range": []string{fmt.Sprintf("0-%d", chunkSize-1)},
+	}
+	resp, body, err = d.do(http.MethodPatch, location, header, d.layer[:chunkSize])
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return StatusFailed, "", fmt.Errorf("uploading the first chunk: %v", unexpectedStatus(resp, body))
+	}
+	location = resp.Header.Get("Location")
+
+	// resume the upload from the offset reported by the registry
+	resp, body, err = d.do(http.MethodGet, location, nil, nil)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return StatusFailed, "", fmt.Errorf("getting the upload status: %v", unexpectedStatus(resp, body))
+	}
+	if r := resp.Header.Get("Range"); r != fmt.Sprintf("0-%d", chunkSize-1) {
+		return StatusFailed, "", fmt.Errorf("the upload status reports the range %q after a %d bytes chunk, uploads cannot be resumed", r, chunkSize)
+	}
+	if l := resp.Header.Get("Location"); l != "" {
+		location = l
+	}
+
+	header.Set("Content-Range", fmt.Sprintf("%d-%d", chunkSize, len(d.layer)-1))
+	resp, body, err = d.do(http.MethodPatch, location, header, d.layer[chunkSize:])
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return StatusFailed, "", fmt.Errorf("uploading the resumed chunk: %v", unexpectedStatus(resp, body))
+	}
+
+	if err := d.commitUpload(resp.Header.Get("Location"), dgst, nil); err != nil {
+		return StatusFailed, "", err
+	}
+	return StatusOK, fmt.Sprintf("uploaded %s in two chunks, resuming from the upload status", dgst), nil
+}
+
+// commitUpload completes an upload with the remaining content, if any.
+func (d *doctor) commitUpload(location string, dgst digest.Digest, content []byte) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid upload location %q: %v", location, err)
+	}
+	query := u.Query()
+	query.Set("digest", dgst.String())
+	u.RawQuery = query.Encode()
+
+	header := http.Header{"Content-Type": []string{"application/octet-stream"}}
+	resp, body, err := d.do(http.MethodPut, u.String(), header, content)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("completing the upload of %s: %v", dgst, unexpectedStatus(resp, body))
+	}
+	if got := resp.Header.Get("Docker-Content-Digest"); got != "" && got != dgst.String() {
+		return fmt.Errorf("the registry stored %s as %s", dgst, got)
+	}
+	return nil
+}
+
+// checkPush uploads the canary image configuration and pushes its manifest.
+func (d *doctor) checkPush() (Status, string, error) {
+	config, err := json.Marshal(v1.Image{
+		Created:  nowPtr(),
+		Platform: v1.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(d.layer)}},
+	})
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	d.config = config
+
+	resp, body, err := d.do(http.MethodPost, d.repoPath("blobs/uploads/"), nil, nil)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return StatusFailed, "", fmt.Errorf("starting the upload: %v", unexpectedStatus(resp, body))
+	}
+	if err := d.commitUpload(resp.Header.Get("Location"), digest.FromBytes(config), config); err != nil {
+		return StatusFailed, "", err
+	}
+
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: v1.MediaTypeImageLayer,
+			Digest:    digest.FromBytes(d.layer),
+			Size:      int64(len(d.layer)),
+		}},
+	})
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	_, d.manifest, err = m.Payload()
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	d.manifestDgst = digest.FromBytes(d.manifest)
+
+	header := http.Header{"Content-Type": []string{v1.MediaTypeImageManifest}}
+	resp, body, err = d.do(http.MethodPut, d.repoPath("manifests/"+canaryTag), header, d.manifest)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return StatusFailed, "", fmt.Errorf("pushing the manifest: %v", unexpectedStatus(resp, body))
+	}
+	return StatusOK, fmt.Sprintf("pushed %s:%s@%s", d.opts.Repository, canaryTag, d.manifestDgst), nil
+}
+
+// checkPull pulls the canary image back, recording the blobs served through
+// a redirect.
+func (d *doctor) checkPull() (Status, string, error) {
+	header := http.Header{"Accept": []string{v1.MediaTypeImageManifest}}
+	resp, body, err := d.do(http.MethodGet, d.repoPath("manifests/"+canaryTag), header, nil)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return StatusFailed, "", fmt.Errorf("pulling the manifest: %v", unexpectedStatus(resp, body))
+	}
+	if !bytes.Equal(body, d.manifest) {
+		return StatusFailed, "", fmt.Errorf("the pulled manifest differs from the pushed manifest %s", d.manifestDgst)
+	}
+
+	d.redirects = make(map[digest.Digest]string)
+	for _, content := range [][]byte{d.config, d.layer} {
+		dgst := digest.FromBytes(content)
+		resp, err := d.request(http.MethodGet, d.repoPath("blobs/"+dgst.String()), nil, nil)
+		if err != nil {
+			return StatusFailed, "", err
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			err = verifyContent(resp.Body, dgst)
+			resp.Body.Close()
+			if err != nil {
+				return StatusFailed, "", err
+			}
+		case resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get("Location") != "":
+			resp.Body.Close()
+			d.redirects[dgst] = resp.Header.Get("Location")
+		default:
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+			resp.Body.Close()
+			return StatusFailed, "", fmt.Errorf("pulling blob %s: %v", dgst, unexpectedStatus(resp, body))
+		}
+	}
+
+	if len(d.redirects) > 0 {
+		return StatusOK, fmt.Sprintf("pulled the manifest, %d of 2 blobs are redirected to the storage backend", len(d.redirects)), nil
+	}
+	return StatusOK, "pulled the manifest and blobs", nil
+}
+
+// checkRedirect follows the blob redirects as a client would, without the
+// registry credentials.
+func (d *doctor) checkRedirect() (Status, string, error) {
+	if len(d.redirects) == 0 {
+		return StatusSkipped, "blobs are served by the registry", nil
+	}
+
+	client := &http.Client{Transport: d.opts.Transport}
+	hosts := make(map[string]struct{})
+	for dgst, location := range d.redirects {
+		u, err := d.base.Parse(location)
+		if err != nil {
+			return StatusFailed, "", fmt.Errorf("invalid redirect URL for blob %s: %v", dgst, err)
+		}
+		hosts[u.Host] = struct{}{}
+
+		req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return StatusFailed, "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return StatusFailed, "", fmt.Errorf("the redirect URL of blob %s does not resolve: %v", dgst, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+			resp.Body.Close()
+			return StatusFailed, "", fmt.Errorf("the redirect URL of blob %s on %s: %v", dgst, u.Host, unexpectedStatus(resp, body))
+		}
+		err = verifyContent(resp.Body, dgst)
+		resp.Body.Close()
+		if err != nil {
+			return StatusFailed, "", fmt.Errorf("the redirect URL of blob %s on %s: %v", dgst, u.Host, err)
+		}
+	}
+
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	return StatusOK, "redirect URLs resolve to " + strings.Join(names, ", "), nil
+}
+
+// checkCleanup deletes the canary manifest. Its blobs are left to the
+// garbage collector.
+func (d *doctor) checkCleanup() (Status, string, error) {
+	resp, body, err := d.do(http.MethodDelete, d.repoPath("manifests/"+d.manifestDgst.String()), nil, nil)
+	if err != nil {
+		return StatusFailed, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return StatusOK, fmt.Sprintf("deleted %s@%s", d.opts.Repository, d.manifestDgst), nil
+	case http.StatusMethodNotAllowed:
+		return StatusWarning, fmt.Sprintf("deletes are disabled, %s:%s was left in place", d.opts.Repository, canaryTag), nil
+	default:
+		return StatusFailed, "", fmt.Errorf("deleting the canary manifest: %v", unexpectedStatus(resp, body))
+	}
+}
+
+func (d *doctor) repoPath(suffix string) string {
+	return "/v2/" + d.opts.Repository + "/" + suffix
+}
+
+// request sends a request to the registry. target is resolved against the
+// registry URL.
+func (d *doctor) request(method, target string, header http.Header, body []byte) (*http.Response, error) {
+	u, err := d.base.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %v", target, err)
+	}
+	if strings.HasPrefix(target, "/") {
+		u.Path = strings.TrimSuffix(d.base.Path, "/") + target
+	}
+	req, err := http.NewRequestWithContext(d.ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if d.authorization != "" && u.Host == d.base.Host {
+		req.Header.Set("Authorization", d.authorization)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", method, u.Path, err)
+	}
+	return resp, nil
+}
+
+// do sends a request to the registry and reads the response.
+func (d *doctor) do(method, target string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	resp, err := d.request(method, target, header, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	p, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s %s: %v", method, resp.Request.URL.Path, err)
+	}
+	return resp, p, nil
+}
+
+func (d *doctor) observeClock(source string, resp *http.Response) {
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		d.clocks = append(d.clocks, clockSample{source: source, offset: time.Until(date)})
+	}
+}
+
+func verifyContent(r io.Reader, dgst digest.Digest) error {
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, r); err != nil {
+		return fmt.Errorf("reading blob %s: %v", dgst, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("the content of blob %s does not match its digest", dgst)
+	}
+	return nil
+}
+
+func unexpectedStatus(resp *http.Response, body []byte) error {
+	message := strings.TrimSpace(string(body))
+	if len(message) > 200 {
+		message = message[:200] + "..."
+	}
+	if message == "" {
+		return fmt.Errorf("%s %s: unexpected status %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	}
+	return fmt.Errorf("%s %s: unexpected status %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, message)
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func nowPtr() *time.Time {
+	now := time.Now().UTC()
+	return &now
+}
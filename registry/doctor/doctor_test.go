@@ -0,0 +1,187 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/embed"
+)
+
+type basicChallenge struct{}
+
+func (basicChallenge) Error() string { return "authentication required" }
+
+func (basicChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="doctor"`)
+}
+
+type basicAccessController struct {
+	username, password string
+}
+
+func (ac basicAccessController) Authorized(r *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	if username, password, ok := r.BasicAuth(); !ok || username != ac.username || password != ac.password {
+		return nil, basicChallenge{}
+	}
+	return &auth.Grant{User: auth.UserInfo{Name: ac.username}}, nil
+}
+
+func newTestServer(t *testing.T, config *configuration.Configuration, options ...embed.Option) *httptest.Server {
+	t.Helper()
+	if config == nil {
+		config = embed.DefaultConfiguration()
+	}
+	reg, err := embed.New(context.Background(), config, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(reg.Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// redirectBlobs redirects blob downloads to target, which is given the path
+// of the request.
+func redirectBlobs(target func(r *http.Request) string) embed.Option {
+	return embed.WithHandler(func(config *configuration.Configuration, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/sha256:") && r.URL.Query().Get("redirected") == "" {
+				http.Redirect(w, r, target(r), http.StatusTemporaryRedirect)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+func statuses(report *Report) map[string]Status {
+	m := make(map[string]Status)
+	for _, result := range report.Results {
+		m[result.Check] = result.Status
+	}
+	return m
+}
+
+func TestRun(t *testing.T) {
+	deleteDisabled := embed.DefaultConfiguration()
+	deleteDisabled.Storage["delete"] = configuration.Parameters{"enabled": false}
+
+	skewedClock := embed.WithHandler(func(config *configuration.Configuration, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "access denied", http.StatusForbidden)
+	}))
+	defer storage.Close()
+
+	for _, tc := range []struct {
+		name     string
+		config   *configuration.Configuration
+		options  []embed.Option
+		opts     Options
+		failed   bool
+		expected map[string]Status
+	}{
+		{
+			name: "healthy",
+			expected: map[string]Status{
+				"api": StatusOK, "clock": StatusOK, "upload": StatusOK, "push": StatusOK,
+				"pull": StatusOK, "redirect": StatusSkipped, "cleanup": StatusOK,
+			},
+		},
+		{
+			name:     "deletes disabled",
+			config:   deleteDisabled,
+			expected: map[string]Status{"push": StatusOK, "cleanup": StatusWarning},
+		},
+		{
+			name:     "clock skew",
+			options:  []embed.Option{skewedClock},
+			expected: map[string]Status{"clock": StatusWarning, "push": StatusOK},
+		},
+		{
+			name:     "basic authentication",
+			options:  []embed.Option{embed.WithAccessController(basicAccessController{"doctor", "secret"})},
+			opts:     Options{Username: "doctor", Password: "secret"},
+			expected: map[string]Status{"api": StatusOK, "push": StatusOK, "cleanup": StatusOK},
+		},
+		{
+			name:     "missing credentials",
+			options:  []embed.Option{embed.WithAccessController(basicAccessController{"doctor", "secret"})},
+			failed:   true,
+			expected: map[string]Status{"api": StatusFailed, "push": StatusSkipped},
+		},
+		{
+			name: "redirects",
+			options: []embed.Option{redirectBlobs(func(r *http.Request) string {
+				return r.URL.Path + "?redirected=true"
+			})},
+			expected: map[string]Status{"pull": StatusOK, "redirect": StatusOK},
+		},
+		{
+			name: "broken redirects",
+			options: []embed.Option{redirectBlobs(func(r *http.Request) string {
+				return storage.URL + r.URL.Path
+			})},
+			failed:   true,
+			expected: map[string]Status{"pull": StatusOK, "redirect": StatusFailed, "cleanup": StatusOK},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newTestServer(t, tc.config, tc.options...)
+			opts := tc.opts
+			opts.URL = server.URL
+
+			report, err := Run(context.Background(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if _, err := report.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if report.Failed() != tc.failed {
+				t.Fatalf("expected failed=%t:\n%s", tc.failed, buf.String())
+			}
+			got := statuses(report)
+			for check, status := range tc.expected {
+				if got[check] != status {
+					t.Errorf("expected %s check status %s, got %s:\n%s", check, status, got[check], buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRunInvalidURL(t *testing.T) {
+	for _, u := range []string{"registry.example.com", "ftp://registry.example.com", "://"} {
+		if _, err := Run(context.Background(), Options{URL: u}); err == nil {
+			t.Errorf("expected error with URL %q", u)
+		}
+	}
+}
+
+func TestTokenIssuedAt(t *testing.T) {
+	issuedAt := time.Unix(1700000000, 0)
+	payload := fmt.Sprintf(`{"iss":"issuer","iat":%d}`, issuedAt.Unix())
+	raw := "eyJhbGciOiJFUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+	if got, ok := tokenIssuedAt(raw); !ok || !got.Equal(issuedAt) {
+		t.Fatalf("expected %s, got %s (%t)", issuedAt, got, ok)
+	}
+	if _, ok := tokenIssuedAt("opaque-token"); ok {
+		t.Fatal("expected no issue time for an opaque token")
+	}
+}
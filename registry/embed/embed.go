@@ -0,0 +1,240 @@
+// Package embed runs a registry from within a Go program, for test harnesses
+// and products embedding a registry.
+//
+// A Registry is built from an in-code configuration, with options supplying
+// storage drivers, middlewares and access controllers as Go values rather
+// than through the global registration performed by the registry command.
+// Nothing is registered globally, so registries may be created and dropped
+// without bound:
+//
+//	reg, err := embed.New(ctx, nil,
+//		embed.WithAccessController(myAccessController),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	defer reg.Shutdown(ctx)
+//	server := httptest.NewServer(reg.Handler())
+//
+// Unlike registry.NewRegistry, New does not configure logging, tracing or
+// health checks, all of which are process wide, so several registries may be
+// embedded in the same process.
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	registrymiddleware "github.com/distribution/distribution/v3/registry/middleware/registry"
+	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+)
+
+// An Option customizes the registry built by New.
+type Option func(*settings) error
+
+type settings struct {
+	config     *configuration.Configuration
+	appOptions []handlers.AppOption
+	handlers   []HandlerFunc
+}
+
+// HandlerFunc wraps the registry handler with an http middleware.
+type HandlerFunc func(config *configuration.Configuration, handler http.Handler) http.Handler
+
+// WithStorageDriver makes the registry store its content in driver, in place
+// of the driver in the configuration.
+func WithStorageDriver(driver storagedriver.StorageDriver) Option {
+	return func(s *settings) error {
+		if driver == nil {
+			return errors.New("embed: nil storage driver")
+		}
+
+		// the configuration names the driver, which is not created from it
+		storage := configuration.Storage{}
+		for k, v := range s.config.Storage {
+			switch k {
+			case "maintenance", "cache", "delete", "redirect", "tag":
+				storage[k] = v
+			}
+		}
+		storage[driver.Name()] = configuration.Parameters{}
+		s.config.Storage = storage
+		s.appOptions = append(s.appOptions, handlers.WithStorageDriver(driver))
+		return nil
+	}
+}
+
+// WithAccessController makes the registry authorize requests with ac, in
+// place of the access controller in the configuration.
+func WithAccessController(ac auth.AccessController) Option {
+	return func(s *settings) error {
+		if ac == nil {
+			return errors.New("embed: nil access controller")
+		}
+		s.config.Auth = nil
+		s.appOptions = append(s.appOptions, handlers.WithAccessController(ac))
+		return nil
+	}
+}
+
+// WithRegistryMiddleware appends a registry middleware, initialized with
+// options.
+func WithRegistryMiddleware(initFunc registrymiddleware.InitFunc, options map[string]interface{}) Option {
+	return func(s *settings) error {
+		s.appOptions = append(s.appOptions, handlers.WithRegistryMiddleware(initFunc, options))
+		return nil
+	}
+}
+
+// WithRepositoryMiddleware appends a repository middleware, initialized
+// with options.
+func WithRepositoryMiddleware(initFunc repositorymiddleware.InitFunc, options map[string]interface{}) Option {
+	return func(s *settings) error {
+		s.appOptions = append(s.appOptions, handlers.WithRepositoryMiddleware(initFunc, options))
+		return nil
+	}
+}
+
+// WithStorageMiddleware appends a storage driver middleware, initialized
+// with options.
+func WithStorageMiddleware(initFunc storagemiddleware.InitFunc, options map[string]interface{}) Option {
+	return func(s *settings) error {
+		s.appOptions = append(s.appOptions, handlers.WithStorageMiddleware(initFunc, options))
+		return nil
+	}
+}
+
+// WithHandler wraps the registry handler with an http middleware, such as
+// those registered with registry.RegisterHandler. Handlers are applied in
+// order, the last one being the outermost.
+func WithHandler(handlerFunc HandlerFunc) Option {
+	return func(s *settings) error {
+		s.handlers = append(s.handlers, handlerFunc)
+		return nil
+	}
+}
+
+// DefaultConfiguration returns the configuration used by New when none is
+// given: content is stored in memory, deletes are enabled and requests are
+// not authenticated.
+func DefaultConfiguration() *configuration.Configuration {
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[interface{}]interface{}{"enabled": false},
+			},
+		},
+	}
+	config.Log.AccessLog.Disabled = true
+	return config
+}
+
+// A Registry is a registry embedded in a Go program.
+type Registry struct {
+	app     *handlers.App
+	handler http.Handler
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+// New builds a registry from config, which New leaves unmodified, and
+// options. A nil config selects DefaultConfiguration. Configuration errors,
+// which make the registry command exit, are returned as errors.
+func New(ctx context.Context, config *configuration.Configuration, options ...Option) (reg *Registry, err error) {
+	if config == nil {
+		config = DefaultConfiguration()
+	}
+	c := *config
+	c.Storage = make(configuration.Storage, len(config.Storage))
+	for k, v := range config.Storage {
+		params := make(configuration.Parameters, len(v))
+		for pk, pv := range v {
+			params[pk] = pv
+		}
+		c.Storage[k] = params
+	}
+
+	s := settings{config: &c}
+	for _, option := range options {
+		if err := option(&s); err != nil {
+			return nil, err
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			reg = nil
+			if rerr, ok := r.(error); ok {
+				err = fmt.Errorf("embed: invalid configuration: %w", rerr)
+			} else {
+				err = fmt.Errorf("embed: invalid configuration: %v", r)
+			}
+		}
+	}()
+	app := handlers.NewApp(ctx, &c, s.appOptions...)
+
+	var handler http.Handler = app
+	for _, handlerFunc := range s.handlers {
+		handler = handlerFunc(&c, handler)
+	}
+
+	return &Registry{
+		app:     app,
+		handler: handler,
+	}, nil
+}
+
+// Handler returns the http.Handler serving the registry API.
+func (reg *Registry) Handler() http.Handler {
+	return reg.handler
+}
+
+// Serve serves the registry API on the listener until Shutdown is called.
+// Like http.Server.Serve, it always returns a non-nil error, which is
+// http.ErrServerClosed after Shutdown.
+func (reg *Registry) Serve(l net.Listener) error {
+	reg.mu.Lock()
+	if reg.server == nil {
+		reg.server = &http.Server{Handler: reg.handler}
+	}
+	server := reg.server
+	reg.mu.Unlock()
+	return server.Serve(l)
+}
+
+// ListenAndServe listens on the TCP address addr and serves the registry
+// API, as Serve does.
+func (reg *Registry) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return reg.Serve(l)
+}
+
+// Shutdown gracefully stops the server started by Serve, if any, then
+// releases the resources held by the registry.
+func (reg *Registry) Shutdown(ctx context.Context) error {
+	reg.mu.Lock()
+	server := reg.server
+	reg.mu.Unlock()
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return reg.app.Shutdown()
+}
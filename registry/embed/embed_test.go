@@ -0,0 +1,162 @@
+package embed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+type challenge struct{}
+
+func (challenge) Error() string { return "authentication required" }
+
+func (challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="embed"`)
+}
+
+type accessController struct {
+	user string
+}
+
+func (ac accessController) Authorized(r *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	if r.Header.Get("X-User") != ac.user {
+		return nil, challenge{}
+	}
+	return &auth.Grant{User: auth.UserInfo{Name: ac.user}}, nil
+}
+
+func newTestServer(t *testing.T, config *configuration.Configuration, options ...Option) *httptest.Server {
+	t.Helper()
+	reg, err := New(context.Background(), config, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(reg.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		if err := reg.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return server
+}
+
+func get(t *testing.T, url, user string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User", user)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestNew(t *testing.T) {
+	server := newTestServer(t, nil)
+	if resp := get(t, server.URL+"/v2/", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+}
+
+func TestWithAccessController(t *testing.T) {
+	config := DefaultConfiguration()
+	server := newTestServer(t, config, WithAccessController(accessController{user: "alice"}))
+
+	resp := get(t, server.URL+"/v2/", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	if resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatal("expected challenge")
+	}
+	if resp := get(t, server.URL+"/v2/", "alice"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+
+	if len(config.Auth) != 0 {
+		t.Fatalf("configuration was modified: %v", config.Auth)
+	}
+}
+
+func TestWithStorageDriver(t *testing.T) {
+	driver := inmemory.New()
+	var wrapped bool
+	server := newTestServer(t, nil,
+		WithStorageDriver(driver),
+		WithHandler(func(config *configuration.Configuration, handler http.Handler) http.Handler {
+			wrapped = true
+			return handler
+		}),
+	)
+	if !wrapped {
+		t.Fatal("handler middleware was not applied")
+	}
+
+	resp, err := http.Post(server.URL+"/v2/foo/bar/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+
+	uploads, err := driver.List(context.Background(), "/docker/registry/v2/repositories/foo/bar/_uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 {
+		t.Fatalf("expected upload in the storage driver, got %v", uploads)
+	}
+}
+
+func TestNewInvalidConfiguration(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Storage = configuration.Storage{"nosuchdriver": configuration.Parameters{}}
+
+	_, err := New(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "nosuchdriver") {
+		t.Fatalf("expected configuration error, got %v", err)
+	}
+
+	if _, err := New(context.Background(), nil, WithAccessController(nil)); err == nil {
+		t.Fatal("expected error with a nil access controller")
+	}
+}
+
+func TestWithMiddleware(t *testing.T) {
+	var storageWrapped, repositoryWrapped bool
+	server := newTestServer(t, nil,
+		WithStorageMiddleware(func(ctx context.Context, driver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+			storageWrapped = options["enabled"] == true
+			return driver, nil
+		}, map[string]interface{}{"enabled": true}),
+		WithRepositoryMiddleware(func(ctx context.Context, repository distribution.Repository, options map[string]interface{}) (distribution.Repository, error) {
+			repositoryWrapped = true
+			return repository, nil
+		}, nil),
+	)
+	if !storageWrapped {
+		t.Fatal("storage middleware was not applied")
+	}
+
+	if resp := get(t, server.URL+"/v2/foo/bar/tags/list", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	if !repositoryWrapped {
+		t.Fatal("repository middleware was not applied")
+	}
+}
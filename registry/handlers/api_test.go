@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -17,19 +19,27 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/delta"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/distribution/reference"
+	events "github.com/docker/go-events"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
@@ -995,15 +1005,20 @@ func testBlobAPI(t *testing.T, env *testEnv, args blobArgs) *testEnv {
 		t.Fatalf("unexpected error seeking layer: %v", err)
 	}
 	uploadURLBase, _ = startPushLayer(t, env, imageName)
-	outOfOrder := chunkOptions{
-		contentRange: "3-22",
+	uploadURLBase, _ = pushChunk(t, env.builder, imageName, uploadURLBase, layerFile, layerLength)
+
+	if _, err := layerFile.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("unexpected error seeking layer: %v", err)
+	}
+	overlapping := chunkOptions{
+		contentRange: fmt.Sprintf("3-%d", layerLength+2),
 	}
-	resp, err = doPushChunk(t, uploadURLBase, layerFile, outOfOrder)
+	resp, err = doPushChunk(t, uploadURLBase, layerFile, overlapping)
 	if err != nil {
 		t.Fatalf("unexpected error doing push layer request: %v", err)
 	}
 	defer resp.Body.Close()
-	checkResponse(t, "putting range out of order chunk", resp, http.StatusRequestedRangeNotSatisfiable)
+	checkResponse(t, "putting range overlapping chunk", resp, http.StatusRequestedRangeNotSatisfiable)
 
 	// ------------------------
 	// Use a head request to see if the layer exists.
@@ -1491,6 +1506,53 @@ func TestManifestDelete(t *testing.T) {
 	testManifestDelete(t, env, schema2Args)
 }
 
+func TestManifestDeleteTagConstraints(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: tagConstrainedAuth(t),
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/app")
+	deleteByDigest := func(dgst digest.Digest) *http.Response {
+		ref, _ := reference.WithDigest(imageName, dgst)
+		manifestURL, err := env.builder.BuildManifestURL(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := httpDelete(manifestURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// the release tag may not be deleted, nor the manifest it references
+	released := createRepository(env, t, imageName.Name(), "release-1.0")
+	checkResponse(t, "deleting a released manifest", deleteByDigest(released), http.StatusForbidden)
+	tagged, _ := reference.WithTag(imageName, "release-1.0")
+	tagURL, _ := env.builder.BuildManifestURL(tagged)
+	resp, err := http.Get(tagURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	checkResponse(t, "getting the released manifest", resp, http.StatusOK)
+
+	// pull request tags may be deleted with their manifests
+	proposed := createRepository(env, t, imageName.Name(), "pr-1")
+	checkResponse(t, "deleting a proposed manifest", deleteByDigest(proposed), http.StatusAccepted)
+}
+
 func TestManifestDeleteDisabled(t *testing.T) {
 	schema2Repo, _ := reference.WithName("foo/schema2")
 	deleteEnabled := false
@@ -2213,6 +2275,588 @@ type testEnv struct {
 	builder *v2.URLBuilder
 }
 
+// TestUploadAcrossRegistries checks that an upload started on a registry can
+// be continued on another registry sharing its storage backend, with no
+// configured secret but storesecret set, as behind a load balancer without
+// sticky sessions.
+func TestUploadAcrossRegistries(t *testing.T) {
+	root := t.TempDir()
+	newEnv := func() *testEnv {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"filesystem": configuration.Parameters{"rootdirectory": root},
+				"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				}},
+			},
+		}
+		config.HTTP.Headers = headerConfig
+		config.HTTP.StoreSecret = true
+		return newTestEnvWithConfig(t, &config)
+	}
+	env1 := newEnv()
+	defer env1.Shutdown()
+	env2 := newEnv()
+	defer env2.Shutdown()
+
+	if env1.app.httpSecret() == "" || env1.app.httpSecret() != env2.app.httpSecret() {
+		t.Fatal("expected the registries to share their secret")
+	}
+	// the second registry loaded the secret before the first one stored
+	// another concurrently
+	env2.app.Config.HTTP.Secret = "stale secret"
+
+	// moveTo rewrites the upload URL u for the server of env
+	moveTo := func(u string, env *testEnv) string {
+		uploadURL, err := url.Parse(u)
+		if err != nil {
+			t.Fatalf("error parsing upload URL: %v", err)
+		}
+		server, err := url.Parse(env.server.URL)
+		if err != nil {
+			t.Fatalf("error parsing server URL: %v", err)
+		}
+		uploadURL.Scheme, uploadURL.Host = server.Scheme, server.Host
+		return uploadURL.String()
+	}
+
+	imageName, _ := reference.WithName("foo/bar")
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+	layerLength, _ := layerFile.Seek(0, io.SeekEnd)
+	layerFile.Seek(0, io.SeekStart)
+
+	uploadURLBase, _ := startPushLayer(t, env1, imageName)
+	uploadURLBase, dgst := pushChunk(t, env2.builder, imageName, moveTo(uploadURLBase, env2), layerFile, layerLength)
+	if dgst != layerDigest {
+		t.Fatalf("unexpected digest %s, expected %s", dgst, layerDigest)
+	}
+	finishUpload(t, env1.builder, imageName, moveTo(uploadURLBase, env1), dgst)
+}
+
+// TestParallelChunkUpload checks that the chunks of a layer can be uploaded
+// out of order and in parallel, all resuming the upload where it started.
+func TestParallelChunkUpload(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+	layer, err := io.ReadAll(layerFile)
+	if err != nil {
+		t.Fatalf("error reading layer file: %v", err)
+	}
+
+	const chunks = 4
+	chunkSize := len(layer)/chunks + 1
+	pushChunks := func(uploadURLBase string, skip int) []*http.Response {
+		var wg sync.WaitGroup
+		responses := make([]*http.Response, chunks)
+		errs := make([]error, chunks)
+		for i := range chunks {
+			if i == skip {
+				continue
+			}
+			start := i * chunkSize
+			end := min(start+chunkSize, len(layer))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				responses[i], errs[i] = doPushChunk(t, uploadURLBase, bytes.NewReader(layer[start:end]), chunkOptions{
+					contentRange: fmt.Sprintf("%d-%d", start, end-1),
+				})
+			}()
+		}
+		wg.Wait()
+
+		for i, resp := range responses {
+			if i == skip {
+				continue
+			}
+			if errs[i] != nil {
+				t.Fatalf("unexpected error pushing chunk %d: %v", i, errs[i])
+			}
+			defer resp.Body.Close()
+			checkResponse(t, fmt.Sprintf("putting chunk %d", i), resp, http.StatusAccepted)
+		}
+		return responses
+	}
+
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	responses := pushChunks(uploadURLBase, -1)
+	finishUpload(t, env.builder, imageName, responses[chunks-1].Header.Get("Location"), layerDigest)
+
+	// an upload missing a chunk cannot be completed
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	responses = pushChunks(uploadURLBase, 1)
+	resp, err := doPushLayer(t, env.builder, imageName, layerDigest, responses[chunks-1].Header.Get("Location"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error doing push layer request: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "completing upload missing a chunk", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "completing upload missing a chunk", resp, errcode.ErrorCodeBlobUploadInvalid)
+}
+
+// TestUploadIdleTimeout checks that an upload request is aborted once the
+// client stalls for the upload idle timeout.
+func TestUploadIdleTimeout(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.HTTP.UploadIdleTimeout = 100 * time.Millisecond
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+
+	body, stall := io.Pipe()
+	defer stall.Close()
+	go func() {
+		// the client sends a few bytes, then stalls
+		stall.Write([]byte("partial layer"))
+	}()
+
+	start := time.Now()
+	resp, err := doPushChunk(t, uploadURLBase, body, chunkOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error doing push chunk request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("unexpected status pushing stalled chunk: %d != %d", resp.StatusCode, http.StatusRequestTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("stalled chunk aborted after %s", elapsed)
+	}
+}
+
+// TestMonolithicUploadDigestMismatch checks that a monolithic upload whose
+// content does not match its digest fails, and is canceled.
+func TestMonolithicUploadDigestMismatch(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+
+	resp, err := doPushLayer(t, env.builder, imageName, digest.FromString("other content"), uploadURLBase, strings.NewReader("layer content"))
+	if err != nil {
+		t.Fatalf("unexpected error doing push layer request: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "putting mismatched monolithic layer", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "putting mismatched monolithic layer", resp, errcode.ErrorCodeDigestInvalid)
+
+	resp, err = http.Get(uploadURLBase)
+	if err != nil {
+		t.Fatalf("unexpected error getting upload status: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "getting status of canceled upload", resp, http.StatusNotFound)
+}
+
+func TestBlobDeltas(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delta":    configuration.Parameters{"materialize": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	base := "the base layer content"
+	target := "the base layer content, rebuilt"
+	baseDigest, targetDigest := digest.FromString(base), digest.FromString(target)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, baseDigest, uploadURLBase, strings.NewReader(base))
+
+	var buf bytes.Buffer
+	dw := delta.NewWriter(&buf)
+	if err := dw.Copy(0, int64(len(base))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Insert([]byte(", rebuilt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	deltaContent := buf.Bytes()
+	deltaDigest := digest.FromBytes(deltaContent)
+
+	pushDelta := func(base, target digest.Digest) *http.Response {
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		u, err := url.Parse(uploadURLBase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.RawQuery = url.Values{
+			"_state":       u.Query()["_state"],
+			"digest":       []string{deltaDigest.String()},
+			"delta-base":   []string{base.String()},
+			"delta-target": []string{target.String()},
+		}.Encode()
+		req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(deltaContent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error pushing delta: %v", err)
+		}
+		return resp
+	}
+
+	resp := pushDelta(digest.FromString("unknown"), targetDigest)
+	defer resp.Body.Close()
+	checkResponse(t, "pushing delta of unknown base", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "pushing delta of unknown base", resp, errcode.ErrorCodeBlobUnknown)
+
+	resp = pushDelta(baseDigest, targetDigest)
+	defer resp.Body.Close()
+	checkResponse(t, "pushing delta", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{deltaDigest.String()},
+		"Docker-Delta-Target":   []string{targetDigest.String()},
+	})
+
+	// the target was materialized
+	ref, _ := reference.WithDigest(imageName, targetDigest)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(blobURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching target: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching materialized target", resp, http.StatusOK)
+	if p, _ := io.ReadAll(resp.Body); string(p) != target {
+		t.Fatalf("unexpected materialized target: %q", p)
+	}
+
+	deltasURL, err := env.builder.BuildBlobDeltasURL(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(deltasURL)
+	if err != nil {
+		t.Fatalf("unexpected error listing deltas: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "listing deltas", resp, http.StatusOK)
+	var deltas deltasAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&deltas); err != nil {
+		t.Fatalf("unexpected error decoding deltas: %v", err)
+	}
+	expected := deltasAPIResponse{
+		Name:   imageName.Name(),
+		Target: targetDigest,
+		Deltas: []deltaAPIResponse{{Base: baseDigest, Digest: deltaDigest, Size: int64(len(deltaContent)), MediaType: delta.MediaType}},
+	}
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("unexpected deltas: %+v", deltas)
+	}
+}
+
+func TestRepositoryGarbage(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				},
+				"gc": map[interface{}]interface{}{
+					"schedule":    "@yearly",
+					"graceperiod": "0s",
+				},
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	createRepository(env, t, imageName.Name(), "latest")
+
+	// a layer no manifest references
+	rs, dangling, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, dangling, uploadURLBase, rs)
+
+	unknownName, _ := reference.WithName("foo/unknown")
+	garbageURL, err := env.builder.BuildGarbageURL(unknownName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(garbageURL)
+	if err != nil {
+		t.Fatalf("unexpected error reporting garbage: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "reporting garbage of unknown repository", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "reporting garbage of unknown repository", resp, errcode.ErrorCodeNameUnknown)
+
+	garbageURL, err = env.builder.BuildGarbageURL(imageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		req, err := http.NewRequest(method, garbageURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error collecting garbage: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, method+" garbage", resp, http.StatusOK)
+		var report storage.GCReport
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatalf("unexpected error decoding report: %v", err)
+		}
+		if report.Blobs != 1 || len(report.Repositories) != 1 || report.Repositories[0].Layers != 1 {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+	}
+
+	ref, _ := reference.WithDigest(imageName, dangling)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Head(blobURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking layer: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "checking collected layer", resp, http.StatusNotFound)
+}
+
+// TestRepositoryGarbageDisabled checks that the writes are not recorded for
+// online garbage collections, which are unsupported, when gc is not
+// configured.
+func TestRepositoryGarbageDisabled(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	if env.app.gcBarrier != nil {
+		t.Fatal("expected no garbage collection barrier without gc configured")
+	}
+	imageName, _ := reference.WithName("foo/bar")
+	garbageURL, err := env.builder.BuildGarbageURL(imageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(garbageURL)
+	if err != nil {
+		t.Fatalf("unexpected error reporting garbage: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "reporting garbage without gc", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "reporting garbage without gc", resp, errcode.ErrorCodeUnsupported)
+}
+
+func TestLayerConversion(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory":   configuration.Parameters{},
+			"conversion": configuration.Parameters{"repositories": []interface{}{"foo/*"}},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	content := []byte("converted file")
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0o644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var layer bytes.Buffer
+	zw := gzip.NewWriter(&layer)
+	if _, err := zw.Write(archive.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	imageConfig, err := json.Marshal(v1.Image{
+		Platform: v1.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(archive.Bytes())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushImage := func(imageName reference.Named) digest.Digest {
+		layerDigest, configDigest := digest.FromBytes(layer.Bytes()), digest.FromBytes(imageConfig)
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, bytes.NewReader(layer.Bytes()))
+		uploadURLBase, _ = startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(imageConfig))
+
+		manifest := &ocischema.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageManifest,
+			Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: configDigest, Size: int64(len(imageConfig))},
+			Layers:    []v1.Descriptor{{MediaType: v1.MediaTypeImageLayerGzip, Digest: layerDigest, Size: int64(layer.Len())}},
+		}
+		ref, _ := reference.WithTag(imageName, "latest")
+		manifestURL, err := env.builder.BuildManifestURL(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := putManifest(t, "putting manifest", manifestURL, v1.MediaTypeImageManifest, manifest)
+		defer resp.Body.Close()
+		checkResponse(t, "putting manifest", resp, http.StatusCreated)
+		dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dgst
+	}
+	referrers := func(imageName reference.Named, dgst digest.Digest) (distribution.Descriptor, error) {
+		repository, err := env.app.registry.Repository(env.ctx, imageName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repository.Tags(env.ctx).Get(env.ctx, "sha256-"+dgst.Encoded())
+	}
+
+	// the images of the matching repositories are converted in the
+	// background, and listed by their referrers tag
+	imageName, _ := reference.WithName("foo/bar")
+	dgst := pushImage(imageName)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := referrers(imageName, dgst)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the image to be converted: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	other, _ := reference.WithName("other/bar")
+	dgst = pushImage(other)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := referrers(other, dgst); !errors.As(err, &distribution.ErrTagUnknown{}) {
+		t.Fatalf("expected the image of another repository not to be converted, got %v", err)
+	}
+}
+
+func TestBlobUploadMountHints(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache":    configuration.Parameters{"blobdescriptor": "inmemory", "mounthints": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	content := "hinted layer"
+	dgst := digest.FromString(content)
+	pushed, _ := reference.WithName("foo/bar")
+	uploadURLBase, _ := startPushLayer(t, env, pushed)
+	pushLayer(t, env.builder, pushed, dgst, uploadURLBase, strings.NewReader(content))
+
+	startUpload := func(name string, values url.Values) *http.Response {
+		named, _ := reference.WithName(name)
+		uploadURL, err := env.builder.BuildBlobUploadURL(named, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(uploadURL, "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error starting upload: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, "starting upload", resp, http.StatusAccepted)
+		return resp
+	}
+
+	// the repositories of the namespace holding the blob are hinted
+	resp := startUpload("foo/baz", url.Values{"mount": []string{dgst.String()}})
+	if hint := resp.Header.Get("Docker-Mount-Candidates"); hint != "foo/bar" {
+		t.Fatalf("unexpected mount hint: %q", hint)
+	}
+	resp = startUpload("foo/qux", url.Values{"digest": []string{dgst.String()}})
+	if hint := resp.Header.Get("Docker-Mount-Candidates"); hint != "foo/bar" {
+		t.Fatalf("unexpected mount hint: %q", hint)
+	}
+
+	// but not those of other namespaces, nor to clients mounting from a
+	// repository
+	resp = startUpload("other/baz", url.Values{"mount": []string{dgst.String()}})
+	if hint := resp.Header.Get("Docker-Mount-Candidates"); hint != "" {
+		t.Fatalf("unexpected mount hint for another namespace: %q", hint)
+	}
+	resp = startUpload("foo/baz", url.Values{"mount": []string{digest.FromString("unknown").String()}, "from": []string{"foo/bar"}})
+	if hint := resp.Header.Get("Docker-Mount-Candidates"); hint != "" {
+		t.Fatalf("unexpected mount hint for a mount: %q", hint)
+	}
+}
+
+// TestSecretNotStoredByDefault checks that a registry with no configured
+// secret does not store the one it generates.
+func TestSecretNotStoredByDefault(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	if env.app.httpSecret() == "" {
+		t.Fatal("expected a generated secret")
+	}
+	_, err := env.app.driver.GetContent(env.ctx, "/docker/registry/v2/_secret")
+	if !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Fatalf("expected the secret not to be stored, got %v", err)
+	}
+}
+
 func newTestEnvMirror(t *testing.T, deleteEnabled bool) *testEnv {
 	upstreamEnv := newTestEnv(t, deleteEnabled)
 	config := configuration.Configuration{
@@ -2714,6 +3358,89 @@ func createRepository(env *testEnv, t *testing.T, imageName string, tag string)
 	return dgst
 }
 
+func TestManifestLint(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Validation.Manifests.Lint = configuration.ValidationLint{
+		RequiredAnnotations:    []string{"org.opencontainers.image.source"},
+		ReproducibleTimestamps: true,
+		CompressedLayers:       true,
+		MaxLayers:              1,
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/lint")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	imageConfig := []byte(`{"architecture":"amd64","os":"linux","created":"2024-05-01T10:00:00Z","rootfs":{"type":"layers"}}`)
+	configDigest := digest.FromBytes(imageConfig)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(imageConfig))
+
+	manifest := &ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(imageConfig)),
+		},
+	}
+	for i := 0; i < 2; i++ {
+		rs, dgst, err := testutil.CreateRandomTarFile()
+		checkErr(t, err, "creating random layer")
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
+		manifest.Layers = append(manifest.Layers, v1.Descriptor{MediaType: v1.MediaTypeImageLayer, Digest: dgst, Size: 1})
+	}
+
+	sink := events.NewChannel(2)
+	env.app.events.sink = events.NewFilter(sink, events.MatcherFunc(func(event events.Event) bool {
+		return event.(notifications.Event).Action == notifications.EventActionLint
+	}))
+	checkLintEvent := func(rejected bool) {
+		select {
+		case e := <-sink.C:
+			event := e.(notifications.Event)
+			if event.Action != notifications.EventActionLint || event.Target.Repository != "foo/lint" || event.Target.Tag != "latest" {
+				t.Fatalf("unexpected lint event: %+v", event)
+			}
+			if len(event.Lint.Problems) != 5 || event.Lint.Rejected != rejected {
+				t.Fatalf("unexpected lint record: %+v", event.Lint)
+			}
+		default:
+			t.Fatal("expected a lint event")
+		}
+	}
+
+	resp := putManifest(t, "putting linted manifest", manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting linted manifest", resp, http.StatusCreated)
+	// one missing annotation, two uncompressed layers, the layer count and
+	// the build timestamp
+	if warnings := resp.Header.Values("Warning"); len(warnings) != 5 {
+		t.Fatalf("expected 5 lint warnings, got %q", warnings)
+	}
+	checkLintEvent(false)
+
+	env.app.Config.Validation.Manifests.Lint.Policy = "reject"
+	resp = putManifest(t, "putting rejected manifest", manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting rejected manifest", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "putting rejected manifest", resp, errcode.ErrorCodeManifestInvalid)
+	checkLintEvent(true)
+}
+
 // Test mutation operations on a registry configured as a cache.  Ensure that they return
 // appropriate errors.
 func TestRegistryAsCacheMutationAPIs(t *testing.T) {
@@ -2789,6 +3516,66 @@ func TestRegistryAsCacheMutationAPIs(t *testing.T) {
 	checkResponse(t, "deleting blob from cache", resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
 }
 
+func TestProxyPushThrough(t *testing.T) {
+	for _, cache := range []bool{true, false} {
+		t.Run(fmt.Sprintf("cache=%t", cache), func(t *testing.T) {
+			truthConfig := configuration.Configuration{
+				Storage: configuration.Storage{
+					"inmemory": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					}},
+				},
+			}
+			truthConfig.HTTP.Headers = headerConfig
+			truthEnv := newTestEnvWithConfig(t, &truthConfig)
+			defer truthEnv.Shutdown()
+
+			proxyConfig := configuration.Configuration{
+				Storage: configuration.Storage{
+					"inmemory": configuration.Parameters{},
+					"delete":   configuration.Parameters{"enabled": true},
+				},
+				Proxy: configuration.Proxy{
+					RemoteURL:   truthEnv.server.URL,
+					PushThrough: configuration.ProxyPushThrough{Enabled: true, Cache: cache},
+				},
+			}
+			proxyConfig.HTTP.Headers = headerConfig
+			proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
+			defer proxyEnv.Shutdown()
+
+			imageName, _ := reference.WithName("foo/bar")
+			dgst := createRepository(proxyEnv, t, imageName.Name(), "latest")
+
+			// the manifest and its tag were forwarded to the remote registry
+			tagRef, _ := reference.WithTag(imageName, "latest")
+			manifestTagURL, err := truthEnv.builder.BuildManifestURL(tagRef)
+			checkErr(t, err, "building manifest url")
+			resp, err := http.Get(manifestTagURL)
+			checkErr(t, err, "fetching manifest from the remote registry")
+			defer resp.Body.Close()
+			checkResponse(t, "fetching manifest from the remote registry", resp, http.StatusOK)
+			checkHeaders(t, resp, http.Header{
+				"Docker-Content-Digest": []string{dgst.String()},
+			})
+
+			// the manifest is only served by the cache without the remote
+			// registry if it was cached
+			truthEnv.Shutdown()
+			digestRef, _ := reference.WithDigest(imageName, dgst)
+			manifestDigestURL, err := proxyEnv.builder.BuildManifestURL(digestRef)
+			checkErr(t, err, "building manifest url")
+			resp, err = http.Get(manifestDigestURL)
+			checkErr(t, err, "fetching manifest from the cache")
+			defer resp.Body.Close()
+			if cached := resp.StatusCode == http.StatusOK; cached != cache {
+				t.Fatalf("unexpected status fetching the manifest pushed through from the cache: %s", resp.Status)
+			}
+		})
+	}
+}
+
 func TestProxyManifestGetByTag(t *testing.T) {
 	truthConfig := configuration.Configuration{
 		Storage: configuration.Storage{
@@ -2856,3 +3643,226 @@ func TestProxyManifestGetByTag(t *testing.T) {
 		"Docker-Content-Digest": []string{newDigest.String()},
 	})
 }
+
+func TestProxyPinned(t *testing.T) {
+	truthConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	truthConfig.HTTP.Headers = headerConfig
+	truthEnv := newTestEnvWithConfig(t, &truthConfig)
+	defer truthEnv.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	dgst := createRepository(truthEnv, t, imageName.Name(), "latest")
+	createRepository(truthEnv, t, "foo/baz", "latest")
+
+	proxyConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: truthEnv.server.URL,
+			Pinned: configuration.ProxyPinned{
+				References: []string{"foo/bar:latest"},
+			},
+		},
+	}
+	proxyConfig.HTTP.Headers = headerConfig
+	proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
+	defer proxyEnv.Shutdown()
+
+	type pinnedStatus struct {
+		Reference  string        `json:"reference"`
+		Configured bool          `json:"configured"`
+		Digest     digest.Digest `json:"digest"`
+		Prefetched time.Time     `json:"prefetched"`
+		Error      string        `json:"error"`
+	}
+	handler := proxyEnv.app.ProxyPinnedHandler()
+	serve := func(method, ref string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/debug/proxy/pinned?reference="+url.QueryEscape(ref), nil))
+		return w
+	}
+	// waitPrefetched waits for the pinned images to be prefetched
+	waitPrefetched := func(count int) []pinnedStatus {
+		t.Helper()
+		deadline := time.Now().Add(time.Minute)
+		for {
+			var statuses []pinnedStatus
+			if err := json.NewDecoder(serve(http.MethodGet, "").Body).Decode(&statuses); err != nil {
+				t.Fatal(err)
+			}
+			prefetched := 0
+			for _, status := range statuses {
+				if !status.Prefetched.IsZero() {
+					prefetched++
+				}
+			}
+			if len(statuses) == count && prefetched == count {
+				return statuses
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the pinned images to be prefetched: %+v", statuses)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	statuses := waitPrefetched(1)
+	if statuses[0].Reference != "foo/bar:latest" || !statuses[0].Configured || statuses[0].Digest != dgst {
+		t.Fatalf("unexpected status of the configured pinned image: %+v", statuses[0])
+	}
+
+	if w := serve(http.MethodPost, "foo/baz"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status pinning a reference without tag: %d", w.Code)
+	}
+	if w := serve(http.MethodPost, "foo/baz:latest"); w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status pinning an image: %d", w.Code)
+	}
+	waitPrefetched(2)
+	if w := serve(http.MethodDelete, "foo/bar:latest"); w.Code != http.StatusConflict {
+		t.Fatalf("unexpected status unpinning a configured image: %d", w.Code)
+	}
+	if w := serve(http.MethodDelete, "foo/baz:latest"); w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status unpinning an image: %d", w.Code)
+	}
+	if w := serve(http.MethodDelete, "foo/baz:latest"); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status unpinning an image not pinned: %d", w.Code)
+	}
+
+	// the pinned image was prefetched before its first pull
+	truthEnv.Shutdown()
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, err := proxyEnv.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	resp, err := http.Get(manifestDigestURL)
+	checkErr(t, err, "fetching manifest from the cache")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching pinned manifest from the cache", resp, http.StatusOK)
+}
+
+func TestProxyReferrers(t *testing.T) {
+	truthConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	truthConfig.HTTP.Headers = headerConfig
+	truthEnv := newTestEnvWithConfig(t, &truthConfig)
+	defer truthEnv.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	dgst := createRepository(truthEnv, t, imageName.Name(), "latest")
+
+	// push a signature referring to the image, listed under the referrers
+	// tag schema as the registry has no referrers API
+	uploadURLBase, _ := startPushLayer(t, truthEnv, imageName)
+	pushLayer(t, truthEnv.builder, imageName, v1.DescriptorEmptyJSON.Digest, uploadURLBase, bytes.NewReader(v1.DescriptorEmptyJSON.Data))
+	signature := &ocischema.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+		Config:       v1.DescriptorEmptyJSON,
+		Layers:       []v1.Descriptor{v1.DescriptorEmptyJSON},
+		Subject: &v1.Descriptor{
+			MediaType: schema2.MediaTypeManifest,
+			Digest:    dgst,
+		},
+	}
+	signatureRef, _ := reference.WithTag(imageName, "signature")
+	signatureURL, err := truthEnv.builder.BuildManifestURL(signatureRef)
+	checkErr(t, err, "building manifest url")
+	resp := putManifest(t, "putting signature", signatureURL, v1.MediaTypeImageManifest, signature)
+	defer resp.Body.Close()
+	checkResponse(t, "putting signature", resp, http.StatusCreated)
+	signatureDigest := digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+
+	index, err := ocischema.FromDescriptors([]v1.Descriptor{{
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: signature.ArtifactType,
+		Digest:       signatureDigest,
+		Size:         resp.Request.ContentLength,
+	}}, nil)
+	checkErr(t, err, "creating referrers index")
+	indexRef, _ := reference.WithTag(imageName, storage.ReferrersTag(dgst))
+	indexURL, err := truthEnv.builder.BuildManifestURL(indexRef)
+	checkErr(t, err, "building manifest url")
+	resp = putManifest(t, "putting referrers index", indexURL, v1.MediaTypeImageIndex, index)
+	defer resp.Body.Close()
+	checkResponse(t, "putting referrers index", resp, http.StatusCreated)
+
+	// registries other than pull through caches have no referrers API
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	referrersURL, err := truthEnv.builder.BuildReferrersURL(digestRef)
+	checkErr(t, err, "building referrers url")
+	resp, err = http.Get(referrersURL)
+	checkErr(t, err, "listing referrers")
+	defer resp.Body.Close()
+	checkResponse(t, "listing referrers", resp, http.StatusNotFound)
+
+	proxyConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: truthEnv.server.URL,
+		},
+	}
+	proxyConfig.HTTP.Headers = headerConfig
+	proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
+	defer proxyEnv.Shutdown()
+
+	getReferrers := func(msg string, values url.Values) (v1.Index, http.Header) {
+		t.Helper()
+		referrersURL, err := proxyEnv.builder.BuildReferrersURL(digestRef, values)
+		checkErr(t, err, "building referrers url")
+		resp, err := http.Get(referrersURL)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{"Content-Type": []string{v1.MediaTypeImageIndex}})
+
+		var index v1.Index
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			t.Fatalf("error decoding referrers: %v", err)
+		}
+		return index, resp.Header
+	}
+
+	referrers, _ := getReferrers("listing referrers", nil)
+	if len(referrers.Manifests) != 1 || referrers.Manifests[0].Digest != signatureDigest {
+		t.Fatalf("unexpected referrers: %+v", referrers.Manifests)
+	}
+	referrers, header := getReferrers("listing filtered referrers", url.Values{"artifactType": []string{"application/spdx+json"}})
+	if len(referrers.Manifests) != 0 || header.Get("OCI-Filters-Applied") != "artifactType" {
+		t.Fatalf("unexpected filtered referrers: %+v, %v", referrers.Manifests, header)
+	}
+
+	// the signature is pulled through the cache
+	signatureDigestRef, _ := reference.WithDigest(imageName, signatureDigest)
+	signatureURL, err = proxyEnv.builder.BuildManifestURL(signatureDigestRef)
+	checkErr(t, err, "building manifest url")
+	req, err := http.NewRequest(http.MethodGet, signatureURL, nil)
+	checkErr(t, err, "creating request")
+	req.Header.Set("Accept", v1.MediaTypeImageManifest)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching signature")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching signature", resp, http.StatusOK)
+
+	// the referrers are cached while the remote registry is unavailable
+	truthEnv.Shutdown()
+	referrers, _ = getReferrers("listing cached referrers", nil)
+	if len(referrers.Manifests) != 1 || referrers.Manifests[0].Digest != signatureDigest {
+		t.Fatalf("unexpected cached referrers: %+v", referrers.Manifests)
+	}
+}
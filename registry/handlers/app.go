@@ -5,10 +5,9 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"expvar"
 	"fmt"
-	"math"
-	"math/big"
 	"net"
 	"net/http"
 	"net/url"
@@ -17,6 +16,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/distribution/distribution/v3"
@@ -24,6 +24,7 @@ import (
 	"github.com/distribution/distribution/v3/health"
 	"github.com/distribution/distribution/v3/health/checks"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/internal/requestutil"
 	prometheus "github.com/distribution/distribution/v3/metrics"
 	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
@@ -31,11 +32,14 @@ import (
 	"github.com/distribution/distribution/v3/registry/auth"
 	registrymiddleware "github.com/distribution/distribution/v3/registry/middleware/registry"
 	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
+	"github.com/distribution/distribution/v3/registry/policy"
 	"github.com/distribution/distribution/v3/registry/proxy"
 	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
 	memorycache "github.com/distribution/distribution/v3/registry/storage/cache/memory"
 	rediscache "github.com/distribution/distribution/v3/registry/storage/cache/redis"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
 	"github.com/distribution/distribution/v3/version"
@@ -43,6 +47,7 @@ import (
 	events "github.com/docker/go-events"
 	"github.com/docker/go-metrics"
 	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
 	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
@@ -55,6 +60,29 @@ const randomSecretSize = 32
 // defaultCheckInterval is the default time in between health checks
 const defaultCheckInterval = 10 * time.Second
 
+// defaultCircuitBreakerThreshold is the default number of consecutive
+// failures of the storage backend opening the circuit breaker
+const defaultCircuitBreakerThreshold = 5
+
+// defaultCircuitBreakerCooldown is the default time the circuit breaker stays
+// open before the storage backend is probed again
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// defaultPullStatsFlushInterval is the default time in between writes of
+// the pull statistics to the storage backend
+const defaultPullStatsFlushInterval = time.Minute
+
+// defaultUploadPurgeSafetyWindow is the default time within which uploads
+// written to are not purged, whatever their age
+const defaultUploadPurgeSafetyWindow = time.Hour
+
+// defaultStorageProbeTimeout is the default time the storage probe run at
+// startup may take
+const defaultStorageProbeTimeout = time.Minute
+
+// defaultScrubInterval is the default time in between scrubs of the blobs
+const defaultScrubInterval = 7 * 24 * time.Hour
+
 // App is a global registry application object. Shared resources can be placed
 // on this object that will be accessible from all requests. Any writable
 // fields should be protected.
@@ -65,9 +93,12 @@ type App struct {
 
 	router           *mux.Router                    // main application router, configured with dispatchers
 	driver           storagedriver.StorageDriver    // driver maintains the app global storage driver instance.
+	breaker          *base.CircuitBreaker           // breaker fails the calls to the driver fast while its backend is down, if enabled.
 	registry         distribution.Namespace         // registry is the primary registry backend for the app instance.
 	repoRemover      distribution.RepositoryRemover // repoRemover provides ability to delete repos
 	accessController auth.AccessController          // main access controller for application
+	policy           policy.Authorizer              // authorizes requests once authenticated
+	policyProxies    []*net.IPNet                   // proxies trusted to forward the client IP given to the policy
 
 	// httpHost is a parsed representation of the http.host parameter from
 	// the configuration. Only the Scheme and Host fields are used.
@@ -86,17 +117,63 @@ type App struct {
 
 	// readOnly is true if the registry is in a read-only maintenance mode
 	readOnly bool
+
+	// pullStats records pulls of manifests, if enabled
+	pullStats *storage.PullStats
+
+	// refCounter maintains the reference counts of the blobs, if enabled
+	refCounter *storage.RefCounter
+
+	// uploadBandwidth and downloadBandwidth limit the bandwidth of blob
+	// transfers, if configured
+	uploadBandwidth   *bandwidthLimiter
+	downloadBandwidth *bandwidthLimiter
+
+	// deltas links the deltas of blobs into repositories, if enabled
+	deltas            *storage.DeltaService
+	materializeDeltas bool
+
+	// converter converts the layers of the pushed images, if enabled
+	converter *converter
+
+	// mountHints lists the repositories blobs can be mounted from, if
+	// enabled
+	mountHints cache.BlobRepositoryLister
+
+	// gc collects the garbage on schedule, if enabled
+	gc *gcScheduler
+
+	// gcBarrier lets the garbage collections run by the registry run while
+	// it serves writes, and gcRegistry is the registry they run against.
+	gcBarrier  *storage.GCBarrier
+	gcRegistry distribution.Namespace
+
+	// deleteEnabled is true if the deletion of content is enabled
+	deleteEnabled bool
+
+	// secretMu protects Config.HTTP.Secret, which is reloaded from the
+	// storage backend when sharedSecret is set.
+	secretMu     sync.RWMutex
+	sharedSecret bool
+
+	// options holds the values passed to NewApp in place of the
+	// configuration
+	options appOptions
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
 // requests. The app only implements ServeHTTP and can be wrapped in other
-// handlers accordingly.
-func NewApp(ctx context.Context, config *configuration.Configuration) *App {
+// handlers accordingly. Options supply Go values in place of those named by
+// the configuration.
+func NewApp(ctx context.Context, config *configuration.Configuration, opts ...AppOption) *App {
 	app := &App{
 		Config:  config,
 		Context: ctx,
 		router:  v2.RouterWithPrefix(config.HTTP.Prefix),
-		isCache: config.Proxy.RemoteURL != "",
+		isCache: config.Proxy.Enabled(),
+	}
+	for _, opt := range opts {
+		opt(&app.options)
 	}
 
 	// Register the handler dispatchers.
@@ -107,8 +184,15 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	app.register(v2.RouteNameCatalog, catalogDispatcher)
 	app.register(v2.RouteNameTags, tagsDispatcher)
 	app.register(v2.RouteNameBlob, blobDispatcher)
+	app.register(v2.RouteNameBlobDeltas, deltasDispatcher)
 	app.register(v2.RouteNameBlobUpload, blobUploadDispatcher)
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
+	app.register(v2.RouteNameGarbage, garbageDispatcher)
+	// registries without the referrers API respond with a 404, on which
+	// clients fall back to the referrers tag schema
+	if app.isCache {
+		app.register(v2.RouteNameReferrers, referrersDispatcher)
+	}
 
 	// override the storage driver's UA string for registry outbound HTTP requests
 	storageParams := config.Storage.Parameters()
@@ -120,15 +204,20 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	var err error
-	app.driver, err = factory.Create(app, config.Storage.Type(), storageParams)
-	if err != nil {
-		// TODO(stevvooe): Move the creation of a service into a protected
-		// method, where this is created lazily. Its status can be queried via
-		// a health check.
-		panic(err)
+	if app.options.driver != nil {
+		app.driver = app.options.driver
+	} else {
+		app.driver, err = factory.Create(app, config.Storage.Type(), storageParams)
+		if err != nil {
+			// TODO(stevvooe): Move the creation of a service into a protected
+			// method, where this is created lazily. Its status can be queried via
+			// a health check.
+			panic(err)
+		}
 	}
 
 	purgeConfig := uploadPurgeDefaultConfig()
+	var probeConfig, scrubConfig, gcConfig, refCountConfig map[interface{}]interface{}
 	if mc, ok := config.Storage["maintenance"]; ok {
 		if v, ok := mc["uploadpurging"]; ok {
 			purgeConfig, ok = v.(map[interface{}]interface{})
@@ -136,6 +225,37 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				panic("uploadpurging config key must contain additional keys")
 			}
 		}
+		if v, ok := mc["pullstats"]; ok {
+			pullStatsConfig, ok := v.(map[interface{}]interface{})
+			if !ok {
+				panic("pullstats config key must contain additional keys")
+			}
+			app.configurePullStats(pullStatsConfig)
+		}
+		if v, ok := mc["probe"]; ok {
+			probeConfig, ok = v.(map[interface{}]interface{})
+			if !ok {
+				panic("probe config key must contain additional keys")
+			}
+		}
+		if v, ok := mc["scrub"]; ok {
+			scrubConfig, ok = v.(map[interface{}]interface{})
+			if !ok {
+				panic("scrub config key must contain additional keys")
+			}
+		}
+		if v, ok := mc["refcount"]; ok {
+			refCountConfig, ok = v.(map[interface{}]interface{})
+			if !ok {
+				panic("refcount config key must contain additional keys")
+			}
+		}
+		if v, ok := mc["gc"]; ok {
+			gcConfig, ok = v.(map[interface{}]interface{})
+			if !ok {
+				panic("gc config key must contain additional keys")
+			}
+		}
 		if v, ok := mc["readonly"]; ok {
 			readOnly, ok := v.(map[interface{}]interface{})
 			if !ok {
@@ -151,23 +271,59 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+	scrubDriver := app.driver
 
 	app.driver, err = applyStorageMiddleware(app, app.driver, config.Middleware["storage"])
 	if err != nil {
 		panic(err)
 	}
+	for _, mw := range app.options.storageMiddleware {
+		if app.driver, err = mw(app, app.driver); err != nil {
+			panic(fmt.Sprintf("unable to configure storage middleware: %v", err))
+		}
+	}
+
+	if breaker := config.Health.StorageDriver.CircuitBreaker; breaker.Enabled {
+		threshold := breaker.Threshold
+		if threshold <= 0 {
+			threshold = defaultCircuitBreakerThreshold
+		}
+		cooldown := breaker.Cooldown
+		if cooldown <= 0 {
+			cooldown = defaultCircuitBreakerCooldown
+		}
+		app.breaker = base.NewCircuitBreaker(app.driver, threshold, cooldown)
+		app.driver = app.breaker
+	}
 
 	// Do not configure HTTP secret for a proxy registry as HTTP secret
-	// is only used for blob uploads and a proxy registry does not support blob uploads.
-	if !app.isCache {
+	// is only used for blob uploads and a proxy registry does not support
+	// blob uploads, unless pushed through.
+	if !app.isCache || config.Proxy.PushThrough.Enabled {
 		app.configureSecret(config)
 	}
 	app.configureEvents(config)
+	if scrubConfig != nil {
+		app.startScrubber(scrubDriver, scrubConfig)
+	}
 	app.configureRedis(config)
 	app.configureLogHook(config)
+	app.configureBandwidth(config)
 
 	options := registrymiddleware.GetRegistryOptions()
 
+	if gcConfig != nil {
+		app.configureGC(gcConfig)
+	}
+	if app.gcBarrier != nil {
+		options = append(options, storage.OnlineGC(app.gcBarrier))
+	}
+	if !app.isCache && !app.readOnly {
+		if refCountConfig != nil && app.configureRefCounts(refCountConfig) {
+			options = append(options, storage.ReferenceCounting(app.refCounter))
+		}
+	}
+
 	if config.HTTP.Host != "" {
 		u, err := url.Parse(config.HTTP.Host)
 		if err != nil {
@@ -186,6 +342,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		if ok {
 			if deleteEnabled, ok := e.(bool); ok && deleteEnabled {
 				options = append(options, storage.EnableDelete)
+				app.deleteEnabled = true
 			}
 		}
 	}
@@ -205,16 +362,33 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	// configure inline storage of small blobs
+	if inline, ok := config.Storage["inline"]; ok {
+		if v, ok := inline["threshold"]; ok {
+			threshold, ok := v.(int)
+			if !ok {
+				panic("inline threshold config key must have an integer value")
+			}
+			options = append(options, storage.InlineBlobThreshold(int64(threshold)))
+		}
+	}
+
+	// configure deltas of blobs
+	if deltaConfig, ok := config.Storage["delta"]; ok {
+		app.configureDeltas(deltaConfig)
+	}
+
+	// configure the conversion of the layers of pushed images
+	if conversionConfig, ok := config.Storage["conversion"]; ok {
+		app.configureConversion(conversionConfig)
+	}
+
 	// configure redirects
 	var redirectDisabled bool
 	if redirectConfig, ok := config.Storage["redirect"]; ok {
-		v := redirectConfig["disable"]
-		switch v := v.(type) {
-		case bool:
-			redirectDisabled = v
-		default:
-			panic(fmt.Sprintf("invalid type for redirect config: %#v", redirectConfig))
-		}
+		var redirectOptions []storage.RegistryOption
+		redirectDisabled, redirectOptions = parseRedirectConfig(redirectConfig)
+		options = append(options, redirectOptions...)
 	}
 	if redirectDisabled {
 		dcontext.GetLogger(app).Infof("backend redirection disabled")
@@ -222,6 +396,10 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		options = append(options, storage.EnableRedirect)
 	}
 
+	if probeConfig != nil {
+		app.probeStorage(probeConfig, !redirectDisabled)
+	}
+
 	if !config.Validation.Enabled {
 		config.Validation.Enabled = !config.Validation.Disabled
 	}
@@ -291,6 +469,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				dcontext.GetLogger(app).Warnf("blobdescriptorsize parameter is not supported with redis cache")
 			}
 			cacheProvider := rediscache.NewRedisBlobDescriptorCacheProvider(app.redis)
+			app.configureMountHints(cc, cacheProvider)
 			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
 			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
 			if err != nil {
@@ -309,6 +488,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 			}
 
 			cacheProvider := memorycache.NewInMemoryBlobDescriptorCacheProvider(blobDescriptorSize)
+			app.configureMountHints(cc, cacheProvider)
 			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
 			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
 			if err != nil {
@@ -334,27 +514,60 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	if err != nil {
 		panic(err)
 	}
+	for _, mw := range app.options.registryMiddleware {
+		if app.registry, err = mw(app, app.registry, app.driver); err != nil {
+			panic(fmt.Sprintf("unable to configure registry middleware: %v", err))
+		}
+	}
 
 	authType := config.Auth.Type()
+	if app.options.accessController != nil {
+		authType = fmt.Sprintf("%T", app.options.accessController)
+	}
 
 	if authType != "" && !strings.EqualFold(authType, "none") {
-		accessController, err := auth.GetAccessController(config.Auth.Type(), config.Auth.Parameters())
-		if err != nil {
-			panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
+		accessController := app.options.accessController
+		if accessController == nil {
+			accessController, err = auth.GetAccessController(config.Auth.Type(), config.Auth.Parameters())
+			if err != nil {
+				panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
+			}
 		}
 		app.accessController = accessController
+		if hp, ok := accessController.(auth.HandlerProvider); ok {
+			for path, handler := range hp.Handlers() {
+				app.router.Handle(path, handler)
+				dcontext.GetLogger(app).Debugf("serving %s for the %q access controller", path, authType)
+			}
+		}
 		dcontext.GetLogger(app).Debugf("configured %q access controller", authType)
 	}
 
+	if config.Policy.OPA.URL != "" {
+		app.policy = policy.NewOPA(config.Policy.OPA.URL, config.Policy.OPA.Timeout)
+		app.policyProxies, err = requestutil.ParseTrustedProxies(config.Policy.OPA.TrustedProxies)
+		if err != nil {
+			panic(fmt.Sprintf("invalid opa trusted proxies: %v", err))
+		}
+		dcontext.GetLogger(app).Debugf("configured opa policy at %s", config.Policy.OPA.URL)
+	}
+
 	// configure as a pull through cache
-	if config.Proxy.RemoteURL != "" {
+	if config.Proxy.Enabled() {
 		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy)
 		if err != nil {
 			panic(err.Error())
 		}
 		app.isCache = true
-		dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		if config.Proxy.RemoteURL != "" {
+			dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		}
+		for _, remote := range config.Proxy.Remotes {
+			dcontext.GetLogger(app).Infof("Registry configured as a proxy cache of %s to %s", remote.Prefix, remote.RemoteURL)
+		}
 	}
+	app.startConverter()
+	app.startGC()
 	var ok bool
 	app.repoRemover, ok = app.registry.(distribution.RepositoryRemover)
 	if !ok {
@@ -386,7 +599,15 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 			interval = defaultCheckInterval
 		}
 
+		timeout := app.Config.Health.StorageDriver.Timeout
+		if timeout == 0 {
+			timeout = interval
+		}
+
 		storageDriverCheck := health.CheckFunc(func(ctx context.Context) error {
+			// a backend which hangs fails the check rather than blocking it
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
 			_, err := app.driver.Stat(ctx, "/") // "/" should always exist
 			if _, ok := err.(storagedriver.PathNotFoundError); ok {
 				err = nil // pass this through, backend is responding, but this path doesn't exist.
@@ -402,6 +623,10 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 		go health.Poll(app, updater, storageDriverCheck, interval)
 	}
 
+	if app.breaker != nil {
+		healthRegistry.Register("storagedriver_"+app.Config.Storage.Type()+"_circuitbreaker", app.breaker)
+	}
+
 	for _, fileChecker := range app.Config.Health.FileCheckers {
 		interval := fileChecker.Interval
 		if interval == 0 {
@@ -449,12 +674,24 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 
 // Shutdown close the underlying registry
 func (app *App) Shutdown() error {
+	if app.pullStats != nil {
+		if err := app.pullStats.Flush(app); err != nil {
+			dcontext.GetLogger(app).Errorf("failed to flush pull statistics: %v", err)
+		}
+	}
 	if r, ok := app.registry.(proxy.Closer); ok {
 		return r.Close()
 	}
 	return nil
 }
 
+// ProxyPinnedHandler returns the handler listing, pinning and unpinning the
+// images pinned in the pull through cache, or nil if the registry is not a
+// pull through cache.
+func (app *App) ProxyPinnedHandler() http.Handler {
+	return proxy.PinnedHandler(app.registry)
+}
+
 // register a handler with the application, by route name. The handler will be
 // passed through the application filters and context will be constructed at
 // request time.
@@ -480,7 +717,33 @@ func (app *App) register(routeName string, dispatch dispatchFunc) {
 
 // configureEvents prepares the event sink for action.
 func (app *App) configureEvents(configuration *configuration.Configuration) {
-	// Configure all of the endpoint sinks.
+	// NOTE(stevvooe): Moving to a new queuing implementation is as easy as
+	// replacing broadcaster with a rabbitmq implementation. It's recommended
+	// that the registry instances also act as the workers to keep deployment
+	// simple.
+	app.events.sink = NewEventSink(app, configuration)
+
+	// Populate registry event source
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = configuration.HTTP.Addr
+	} else {
+		// try to pick the port off the config
+		_, port, err := net.SplitHostPort(configuration.HTTP.Addr)
+		if err == nil {
+			hostname = net.JoinHostPort(hostname, port)
+		}
+	}
+
+	app.events.source = notifications.SourceRecord{
+		Addr:       hostname,
+		InstanceID: dcontext.GetStringValue(app, "instance.id"),
+	}
+}
+
+// NewEventSink returns the sink broadcasting events to the notification
+// endpoints of the configuration.
+func NewEventSink(ctx context.Context, configuration *configuration.Configuration) events.Sink {
 	// NOTE(milosgajdos): we are disabling the linter here as
 	// if an endpoint is disabled we continue with the evaluation
 	// of the next one so we do not know the exact size the slice
@@ -489,11 +752,15 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 	var sinks []events.Sink
 	for _, endpoint := range configuration.Notifications.Endpoints {
 		if endpoint.Disabled {
-			dcontext.GetLogger(app).Infof("endpoint %s disabled, skipping", endpoint.Name)
+			dcontext.GetLogger(ctx).Infof("endpoint %s disabled, skipping", endpoint.Name)
 			continue
 		}
 
-		dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
+		if endpoint.Overflow == notifications.OverflowSpill && endpoint.SpillDirectory == "" {
+			panic(fmt.Sprintf("endpoint %s: spilldirectory is required with the spill overflow policy", endpoint.Name))
+		}
+
+		dcontext.GetLogger(ctx).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
 		endpoint := notifications.NewEndpoint(endpoint.Name, endpoint.URL, notifications.EndpointConfig{
 			Timeout:           endpoint.Timeout,
 			Threshold:         endpoint.Threshold,
@@ -501,33 +768,16 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 			Headers:           endpoint.Headers,
 			IgnoredMediaTypes: endpoint.IgnoredMediaTypes,
 			Ignore:            endpoint.Ignore,
+			Concurrency:       endpoint.Concurrency,
+			QueueSize:         endpoint.QueueSize,
+			Overflow:          string(endpoint.Overflow),
+			SpillDirectory:    endpoint.SpillDirectory,
 		})
 
 		sinks = append(sinks, endpoint)
 	}
 
-	// NOTE(stevvooe): Moving to a new queuing implementation is as easy as
-	// replacing broadcaster with a rabbitmq implementation. It's recommended
-	// that the registry instances also act as the workers to keep deployment
-	// simple.
-	app.events.sink = events.NewBroadcaster(sinks...)
-
-	// Populate registry event source
-	hostname, err := os.Hostname()
-	if err != nil {
-		hostname = configuration.HTTP.Addr
-	} else {
-		// try to pick the port off the config
-		_, port, err := net.SplitHostPort(configuration.HTTP.Addr)
-		if err == nil {
-			hostname = net.JoinHostPort(hostname, port)
-		}
-	}
-
-	app.events.source = notifications.SourceRecord{
-		Addr:       hostname,
-		InstanceID: dcontext.GetStringValue(app, "instance.id"),
-	}
+	return events.NewBroadcaster(sinks...)
 }
 
 func (app *App) configureRedis(cfg *configuration.Configuration) {
@@ -626,10 +876,220 @@ func (app *App) configureLogHook(configuration *configuration.Configuration) {
 	}
 }
 
+// probeStorage checks that the storage driver behaves as the registry
+// expects, and panics if it does not, unless the probe only warns.
+func (app *App) probeStorage(config map[interface{}]interface{}, redirect bool) {
+	if enabled, ok := config["enabled"]; ok {
+		enabled, ok := enabled.(bool)
+		if !ok {
+			panic("probe's enabled config key must have a boolean value")
+		}
+		if !enabled {
+			return
+		}
+	}
+
+	warnOnly := false
+	if v, ok := config["warnonly"]; ok {
+		warnOnly, ok = v.(bool)
+		if !ok {
+			panic("probe's warnonly config key must have a boolean value")
+		}
+	}
+
+	timeout := defaultStorageProbeTimeout
+	if v, ok := config["timeout"]; ok {
+		timeoutStr, ok := v.(string)
+		if !ok {
+			panic("probe's timeout config key must be a string")
+		}
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse probe timeout: %v", err))
+		}
+		if timeout <= 0 {
+			panic("probe's timeout must be positive")
+		}
+	}
+
+	if app.readOnly {
+		dcontext.GetLogger(app).Infof("skipping the storage probe in read-only mode")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(app, timeout)
+	defer cancel()
+	if err := storage.ProbeDriver(ctx, app.driver, redirect); err != nil {
+		if !warnOnly {
+			panic(err)
+		}
+		dcontext.GetLogger(app).Errorf("the storage driver does not behave as the registry expects, pushes may be corrupted: %v", err)
+		return
+	}
+	dcontext.GetLogger(app).Infof("storage probe succeeded")
+}
+
+// configureRefCounts enables the maintenance of the reference counts of the
+// blobs as manifests are pushed and deleted, reporting whether it is enabled.
+func (app *App) configureRefCounts(config map[interface{}]interface{}) bool {
+	if enabled, ok := config["enabled"]; ok {
+		enabled, ok := enabled.(bool)
+		if !ok {
+			panic("refcount's enabled config key must have a boolean value")
+		}
+		if !enabled {
+			return false
+		}
+	}
+
+	app.refCounter = storage.NewRefCounter(app.driver)
+	dcontext.GetLogger(app).Infof("maintaining the reference counts of the blobs")
+	return true
+}
+
+// configurePullStats enables the recording of manifest pulls and schedules
+// their periodic flush to the storage backend.
+func (app *App) configurePullStats(config map[interface{}]interface{}) {
+	if enabled, ok := config["enabled"]; ok {
+		enabled, ok := enabled.(bool)
+		if !ok {
+			panic("pullstats's enabled config key must have a boolean value")
+		}
+		if !enabled {
+			return
+		}
+	}
+
+	flushInterval := defaultPullStatsFlushInterval
+	if v, ok := config["flushinterval"]; ok {
+		intervalStr, ok := v.(string)
+		if !ok {
+			panic("pullstats's flushinterval config key must be a string")
+		}
+		var err error
+		flushInterval, err = time.ParseDuration(intervalStr)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse pullstats flushinterval: %v", err))
+		}
+		if flushInterval <= 0 {
+			panic("pullstats's flushinterval must be positive")
+		}
+	}
+
+	// NOTE: the statistics are written through the bare driver: they are
+	// registry metadata and must not go through storage middleware.
+	app.pullStats = storage.NewPullStats(app.driver)
+	dcontext.GetLogger(app).Infof("recording pull statistics, flushing every %s", flushInterval)
+
+	go func() {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.Done():
+				return
+			case <-ticker.C:
+				// errors are logged by Flush and retried on the next tick
+				_ = app.pullStats.Flush(app)
+			}
+		}
+	}()
+}
+
+// startScrubber schedules the periodic verification of the content of the
+// blobs, reporting the corrupt ones through notifications.
+func (app *App) startScrubber(driver storagedriver.StorageDriver, config map[interface{}]interface{}) {
+	if enabled, ok := config["enabled"]; ok {
+		enabled, ok := enabled.(bool)
+		if !ok {
+			panic("scrub's enabled config key must have a boolean value")
+		}
+		if !enabled {
+			return
+		}
+	}
+
+	interval := defaultScrubInterval
+	if v, ok := config["interval"]; ok {
+		intervalStr, ok := v.(string)
+		if !ok {
+			panic("scrub's interval config key must be a string")
+		}
+		var err error
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse scrub interval: %v", err))
+		}
+		if interval <= 0 {
+			panic("scrub's interval must be positive")
+		}
+	}
+
+	var scrubConfig storage.ScrubConfig
+	if v, ok := config["quarantine"]; ok {
+		scrubConfig.Quarantine, ok = v.(bool)
+		if !ok {
+			panic("scrub's quarantine config key must have a boolean value")
+		}
+	}
+	if v, ok := config["ratelimit"]; ok {
+		rateLimit, ok := v.(int)
+		if !ok {
+			panic("scrub's ratelimit config key must have an integer value")
+		}
+		scrubConfig.RateLimit = int64(rateLimit)
+	}
+	if scrubConfig.Quarantine && app.readOnly {
+		dcontext.GetLogger(app).Warnf("not quarantining corrupt blobs in read-only mode")
+		scrubConfig.Quarantine = false
+	}
+
+	scrubConfig.OnCorrupt = func(ctx context.Context, blob storage.CorruptBlob) {
+		if app.events.sink == nil {
+			return
+		}
+		event := notifications.NewCorruptEvent(
+			app.events.source,
+			distribution.Descriptor{MediaType: "application/octet-stream", Digest: blob.Digest, Size: blob.Size},
+			notifications.CorruptionRecord{Computed: blob.Computed, Quarantined: blob.Quarantined},
+		)
+		if err := app.events.sink.Write(*event); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error writing corrupt event: %v", err)
+		}
+	}
+
+	scrubber, err := storage.NewScrubber(driver, scrubConfig)
+	if err != nil {
+		panic(err)
+	}
+	dcontext.GetLogger(app).Infof("scrubbing blobs every %s", interval)
+	go scrubber.Run(app, interval)
+}
+
+// recordPull records a pull of dgst from the named repository, if pull
+// statistics are enabled.
+func (app *App) recordPull(name string, dgst digest.Digest) {
+	if app.pullStats != nil {
+		app.pullStats.RecordPull(name, dgst)
+	}
+}
+
 // configureSecret creates a random secret if a secret wasn't included in the
 // configuration.
 func (app *App) configureSecret(configuration *configuration.Configuration) {
 	if configuration.HTTP.Secret == "" {
+		if configuration.HTTP.StoreSecret {
+			secret, err := storage.SharedSecret(app, app.driver)
+			if err == nil {
+				dcontext.GetLogger(app).Info("No HTTP secret provided - using the secret shared through the storage backend.")
+				configuration.HTTP.Secret = secret
+				app.sharedSecret = true
+				return
+			}
+			dcontext.GetLogger(app).Warnf("failed to share an HTTP secret through the storage backend: %v", err)
+		}
+
 		var secretBytes [randomSecretSize]byte
 		if _, err := rand.Read(secretBytes[:]); err != nil {
 			panic(fmt.Sprintf("could not generate random bytes for HTTP secret: %v", err))
@@ -639,6 +1099,35 @@ func (app *App) configureSecret(configuration *configuration.Configuration) {
 	}
 }
 
+// httpSecret returns the secret signing the state of blob uploads.
+func (app *App) httpSecret() string {
+	app.secretMu.RLock()
+	defer app.secretMu.RUnlock()
+	return app.Config.HTTP.Secret
+}
+
+// reloadSharedSecret reloads the secret shared through the storage backend,
+// in case another registry stored it concurrently, returning whether it
+// changed.
+func (app *App) reloadSharedSecret(ctx context.Context) bool {
+	if !app.sharedSecret {
+		return false
+	}
+	secret, err := storage.SharedSecret(ctx, app.driver)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to reload the shared HTTP secret: %v", err)
+		return false
+	}
+
+	app.secretMu.Lock()
+	defer app.secretMu.Unlock()
+	if secret == app.Config.HTTP.Secret {
+		return false
+	}
+	app.Config.HTTP.Secret = secret
+	return true
+}
+
 func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Prepare the context with our own little decorations.
 	ctx := r.Context()
@@ -678,6 +1167,7 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 			// own errors if they need different behavior (such as range errors
 			// for layer upload).
 			if context.Errors.Len() > 0 {
+				storageUnavailable(w, context.Errors)
 				_ = errcode.ServeJSON(w, context.Errors)
 				app.logError(context, context.Errors)
 			} else if status, ok := context.Value("http.response.status").(int); ok && status >= 200 && status <= 399 {
@@ -735,6 +1225,12 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 				app.eventBridge(context, r))
 
 			context.Repository, err = applyRepoMiddleware(app, context.Repository, app.Config.Middleware["repository"])
+			for _, mw := range app.options.repositoryMiddleware {
+				if err != nil {
+					break
+				}
+				context.Repository, err = mw(app, context.Repository)
+			}
 			if err != nil {
 				dcontext.GetLogger(context).Errorf("error initializing repository middleware: %v", err)
 				context.Errors = append(context.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
@@ -823,14 +1319,20 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	dcontext.GetLogger(context).Debug("authorizing request")
 	repo := getName(context)
 
-	if app.accessController == nil {
-		return nil // access controller is not enabled.
+	if app.accessController == nil && app.policy == nil {
+		return nil // neither access controller nor policy is enabled.
 	}
 
 	var accessRecords []auth.Access
 
 	if repo != "" {
-		accessRecords = appendAccessRecords(accessRecords, r.Method, repo)
+		method := r.Method
+		if mux.CurrentRoute(r).GetName() == v2.RouteNameGarbage {
+			// even reporting the garbage runs a collection of the
+			// repository, holding off the scheduled ones
+			method = http.MethodDelete
+		}
+		accessRecords = appendAccessRecords(accessRecords, method, repo)
 		if fromRepo := r.FormValue("from"); fromRepo != "" {
 			// mounting a blob from one repository to another requires pull (GET)
 			// access to the source repository.
@@ -853,10 +1355,20 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 		accessRecords = appendCatalogAccessRecord(accessRecords, r)
 	}
 
+	if app.accessController == nil {
+		return app.applyPolicy(w, r, context, "", repo, accessRecords)
+	}
+
 	grant, err := app.accessController.Authorized(r.WithContext(context.Context), accessRecords...)
 	if err != nil {
 		switch err := err.(type) {
 		case auth.Challenge:
+			// A challenge without credentials is the usual authentication
+			// handshake, only rejected credentials are denials.
+			if r.Header.Get("Authorization") != "" {
+				app.denied(context, r, getUserName(context, r), repo, accessRecords, notifications.DenialSourceAccessController, err.Error())
+			}
+
 			// Add the appropriate WWW-Auth header
 			err.SetHeaders(r, w)
 
@@ -878,8 +1390,13 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 		return fmt.Errorf("access controller returned neither an access grant nor an error")
 	}
 
+	if err := app.applyPolicy(w, r, context, grant.User.Name, repo, accessRecords); err != nil {
+		return err
+	}
+
 	ctx := withUser(context.Context, grant.User)
 	ctx = withResources(ctx, grant.Resources)
+	ctx = withTagConstraints(ctx, grant.TagConstraints)
 
 	dcontext.GetLogger(ctx, userNameKey).Info("authorized request")
 	// TODO(stevvooe): This pattern needs to be cleaned up a bit. One context
@@ -889,6 +1406,66 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	return nil
 }
 
+// applyPolicy checks the request against the configured policy, if any,
+// once the user has been authenticated.
+func (app *App) applyPolicy(w http.ResponseWriter, r *http.Request, context *Context, user, repo string, accessRecords []auth.Access) error {
+	if app.policy == nil {
+		return nil
+	}
+
+	decision, err := app.policy.Authorize(context, policy.NewInput(r, app.policyProxies, user, repo, accessRecords))
+	if err != nil {
+		if app.Config.Policy.OPA.FailOpen {
+			dcontext.GetLogger(context).Warnf("error evaluating policy, allowing request: %v", err)
+			return nil
+		}
+		dcontext.GetLogger(context).Errorf("error evaluating policy: %v", err)
+		if err := errcode.ServeJSON(w, errcode.ErrorCodeUnavailable); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return err
+	}
+
+	if !decision.Allow {
+		app.denied(context, r, user, repo, accessRecords, notifications.DenialSourcePolicy, decision.Reason)
+		denied := errcode.ErrorCodeDenied.WithDetail(accessRecords)
+		if decision.Reason != "" {
+			denied = errcode.ErrorCodeDenied.WithMessage(decision.Reason).WithDetail(accessRecords)
+		}
+		if err := errcode.ServeJSON(w, denied); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return fmt.Errorf("denied by policy: %s", decision.Reason)
+	}
+
+	return nil
+}
+
+// denied records the denial of a request in the metrics and, if enabled, in
+// the notification events.
+func (app *App) denied(context *Context, r *http.Request, user, repo string, accessRecords []auth.Access, source, reason string) {
+	auth.Denials.WithValues(source).Inc(1)
+
+	if !app.Config.Notifications.EventConfig.IncludeDenials || app.events.sink == nil {
+		return
+	}
+
+	scopes := make([]string, 0, len(accessRecords))
+	for _, access := range accessRecords {
+		scopes = append(scopes, fmt.Sprintf("%s:%s:%s", access.Type, access.Name, access.Action))
+	}
+	event := notifications.NewDeniedEvent(
+		app.events.source,
+		notifications.ActorRecord{Name: user},
+		notifications.NewRequestRecord(dcontext.GetRequestID(context), r),
+		repo,
+		notifications.DenialRecord{Source: source, Scopes: scopes, Reason: reason},
+	)
+	if err := app.events.sink.Write(*event); err != nil {
+		dcontext.GetLogger(context).Errorf("error writing denied event: %v", err)
+	}
+}
+
 // eventBridge returns a bridge for the current request, configured with the
 // correct actor and source.
 func (app *App) eventBridge(ctx *Context, r *http.Request) notifications.Listener {
@@ -999,6 +1576,26 @@ func applyRepoMiddleware(ctx context.Context, repository distribution.Repository
 	return repository, nil
 }
 
+// storageUnavailable replaces the errors of a storage backend deemed
+// unavailable, which handlers report as unknown errors, with
+// ErrorCodeUnavailable, so that clients get a 503 response telling them when
+// to retry rather than a 500.
+func storageUnavailable(w http.ResponseWriter, errs errcode.Errors) {
+	for i, err := range errs {
+		if e, ok := err.(errcode.Error); ok {
+			if detail, ok := e.Detail.(error); ok {
+				err = detail
+			}
+		}
+		var unavailable storagedriver.UnavailableError
+		if !errors.As(err, &unavailable) {
+			continue
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(unavailable.RetryAfter.Round(time.Second).Seconds())))
+		errs[i] = errcode.ErrorCodeUnavailable.WithDetail(unavailable.Error())
+	}
+}
+
 // applyStorageMiddleware wraps a storage driver with the configured middlewares
 func applyStorageMiddleware(ctx context.Context, driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, error) {
 	for _, mw := range middlewares {
@@ -1023,6 +1620,78 @@ func uploadPurgeDefaultConfig() map[interface{}]interface{} {
 	return config
 }
 
+func badRedirectConfig(reason string) {
+	panic(fmt.Sprintf("Unable to parse redirect configuration: %s", reason))
+}
+
+// parseRedirectConfig parses the storage redirect configuration, returning
+// whether redirects are disabled by default and the options for the expiry
+// of the redirect URLs and the rules of the repositories.
+func parseRedirectConfig(parameters configuration.Parameters) (bool, []storage.RegistryOption) {
+	config := make(map[interface{}]interface{}, len(parameters))
+	for k, v := range parameters {
+		config[k] = v
+	}
+
+	parseDisable := func(config map[interface{}]interface{}) bool {
+		v, ok := config["disable"]
+		if !ok {
+			return false
+		}
+		disable, ok := v.(bool)
+		if !ok {
+			badRedirectConfig(fmt.Sprintf("disable is not a boolean: %#v", v))
+		}
+		return disable
+	}
+	parseExpiry := func(config map[interface{}]interface{}) time.Duration {
+		v, ok := config["expiry"]
+		if !ok {
+			return 0
+		}
+		str, ok := v.(string)
+		if !ok {
+			badRedirectConfig("expiry is not a string")
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			badRedirectConfig(fmt.Sprintf("Cannot parse expiry: %s", err.Error()))
+		}
+		return d
+	}
+
+	disabled := parseDisable(config)
+	var options []storage.RegistryOption
+	if expiry := parseExpiry(config); expiry != 0 {
+		options = append(options, storage.RedirectExpiry(expiry))
+	}
+
+	if v, ok := config["repositories"]; ok {
+		repositories, ok := v.([]interface{})
+		if !ok {
+			badRedirectConfig("repositories is not a list")
+		}
+		var rules []storage.RedirectRule
+		for _, r := range repositories {
+			repository, ok := r.(map[interface{}]interface{})
+			if !ok {
+				badRedirectConfig("repositories entries must contain additional keys")
+			}
+			pattern, ok := repository["pattern"].(string)
+			if !ok || pattern == "" {
+				badRedirectConfig("repositories entries must have a pattern string")
+			}
+			rules = append(rules, storage.RedirectRule{
+				Pattern: pattern,
+				Disable: parseDisable(repository),
+				Expiry:  parseExpiry(repository),
+			})
+		}
+		options = append(options, storage.RedirectRules(rules...))
+	}
+	return disabled, options
+}
+
 func badPurgeUploadConfig(reason string) {
 	panic(fmt.Sprintf("Unable to parse upload purge configuration: %s", reason))
 }
@@ -1034,42 +1703,34 @@ func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageD
 		return
 	}
 
-	var purgeAgeDuration time.Duration
-	var err error
-	purgeAge, ok := config["age"]
-	if ok {
-		ageStr, ok := purgeAge.(string)
+	parseDuration := func(key string) time.Duration {
+		v, ok := config[key]
 		if !ok {
-			badPurgeUploadConfig("age is not a string")
+			badPurgeUploadConfig(key + " missing")
 		}
-		purgeAgeDuration, err = time.ParseDuration(ageStr)
-		if err != nil {
-			badPurgeUploadConfig(fmt.Sprintf("Cannot parse duration: %s", err.Error()))
-		}
-	} else {
-		badPurgeUploadConfig("age missing")
-	}
-
-	var intervalDuration time.Duration
-	interval, ok := config["interval"]
-	if ok {
-		intervalStr, ok := interval.(string)
+		str, ok := v.(string)
 		if !ok {
-			badPurgeUploadConfig("interval is not a string")
+			badPurgeUploadConfig(key + " is not a string")
 		}
-
-		intervalDuration, err = time.ParseDuration(intervalStr)
+		d, err := time.ParseDuration(str)
 		if err != nil {
-			badPurgeUploadConfig(fmt.Sprintf("Cannot parse interval: %s", err.Error()))
+			badPurgeUploadConfig(fmt.Sprintf("Cannot parse %s: %s", key, err.Error()))
 		}
-	} else {
-		badPurgeUploadConfig("interval missing")
+		return d
+	}
+
+	purgeConfig := storage.UploadPurgeConfig{
+		Age:          parseDuration("age"),
+		SafetyWindow: defaultUploadPurgeSafetyWindow,
+	}
+	intervalDuration := parseDuration("interval")
+	if _, ok := config["safetywindow"]; ok {
+		purgeConfig.SafetyWindow = parseDuration("safetywindow")
 	}
 
-	var dryRunBool bool
 	dryRun, ok := config["dryrun"]
 	if ok {
-		dryRunBool, ok = dryRun.(bool)
+		purgeConfig.DryRun, ok = dryRun.(bool)
 		if !ok {
 			badPurgeUploadConfig("cannot parse dryrun")
 		}
@@ -1077,21 +1738,39 @@ func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageD
 		badPurgeUploadConfig("dryrun missing")
 	}
 
-	go func() {
-		randInt, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
-		if err != nil {
-			log.Infof("Failed to generate random jitter: %v", err)
-			// sleep 30min for failure case
-			randInt = big.NewInt(30)
+	if v, ok := config["repositories"]; ok {
+		repositories, ok := v.([]interface{})
+		if !ok {
+			badPurgeUploadConfig("repositories is not a list")
 		}
-		jitter := time.Duration(randInt.Int64()%60) * time.Minute
-		log.Infof("Starting upload purge in %s", jitter)
-		time.Sleep(jitter)
-
-		for {
-			storage.PurgeUploads(ctx, storageDriver, time.Now().Add(-purgeAgeDuration), !dryRunBool)
-			log.Infof("Starting upload purge in %s", intervalDuration)
-			time.Sleep(intervalDuration)
+		for _, r := range repositories {
+			repository, ok := r.(map[interface{}]interface{})
+			if !ok {
+				badPurgeUploadConfig("repositories entries must contain additional keys")
+			}
+			pattern, ok := repository["pattern"].(string)
+			if !ok || pattern == "" {
+				badPurgeUploadConfig("repositories entries must have a pattern string")
+			}
+			ageStr, ok := repository["age"].(string)
+			if !ok {
+				badPurgeUploadConfig(fmt.Sprintf("repositories entry %q must have an age string", pattern))
+			}
+			age, err := time.ParseDuration(ageStr)
+			if err != nil {
+				badPurgeUploadConfig(fmt.Sprintf("Cannot parse age of repositories entry %q: %s", pattern, err.Error()))
+			}
+			purgeConfig.RepositoryAges = append(purgeConfig.RepositoryAges, storage.RepositoryUploadAge{
+				Pattern: pattern,
+				Age:     age,
+			})
 		}
-	}()
+	}
+
+	purger, err := storage.NewUploadPurger(storageDriver, purgeConfig)
+	if err != nil {
+		badPurgeUploadConfig(err.Error())
+	}
+	log.Infof("purging uploads older than %s every %s", purgeConfig.Age, intervalDuration)
+	go purger.Run(ctx, intervalDuration)
 }
@@ -1,22 +1,30 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	"github.com/distribution/distribution/v3/registry/auth"
 	_ "github.com/distribution/distribution/v3/registry/auth/silly"
+	"github.com/distribution/distribution/v3/registry/policy"
 	"github.com/distribution/distribution/v3/registry/storage"
 	memorycache "github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
 )
 
 // TestAppDispatcher builds an application with a test dispatcher and ensures
@@ -136,6 +144,127 @@ func TestAppDispatcher(t *testing.T) {
 	}
 }
 
+// TestNewAppStorageProbe covers the storage probe run by NewApp.
+func TestNewAppStorageProbe(t *testing.T) {
+	ctx := dcontext.Background()
+	newConfig := func(probe map[interface{}]interface{}) *configuration.Configuration {
+		return &configuration.Configuration{
+			Storage: configuration.Storage{
+				"inmemory": nil,
+				"maintenance": configuration.Parameters{
+					"uploadpurging": map[interface{}]interface{}{"enabled": false},
+					"probe":         probe,
+				},
+			},
+		}
+	}
+
+	// the in-memory driver behaves as the registry expects
+	NewApp(ctx, newConfig(map[interface{}]interface{}{"enabled": true, "timeout": "10s"}))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected an invalid probe timeout to panic")
+		}
+	}()
+	NewApp(ctx, newConfig(map[interface{}]interface{}{"timeout": "soon"}))
+}
+
+// TestNewAppScrub covers the configuration of the blob scrubber by NewApp.
+func TestNewAppScrub(t *testing.T) {
+	ctx, cancel := context.WithCancel(dcontext.Background())
+	defer cancel()
+	newConfig := func(scrub map[interface{}]interface{}) *configuration.Configuration {
+		return &configuration.Configuration{
+			Storage: configuration.Storage{
+				"inmemory": nil,
+				"maintenance": configuration.Parameters{
+					"uploadpurging": map[interface{}]interface{}{"enabled": false},
+					"scrub":         scrub,
+				},
+			},
+		}
+	}
+
+	NewApp(ctx, newConfig(map[interface{}]interface{}{"interval": "24h", "quarantine": true, "ratelimit": 1 << 20}))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a negative scrub rate limit to panic")
+		}
+	}()
+	NewApp(ctx, newConfig(map[interface{}]interface{}{"ratelimit": -1}))
+}
+
+// TestNewAppGC covers the garbage collection scheduled by NewApp.
+func TestNewAppGC(t *testing.T) {
+	ctx, cancel := context.WithCancel(dcontext.Background())
+	defer cancel()
+	newConfig := func(gc map[interface{}]interface{}) *configuration.Configuration {
+		return &configuration.Configuration{
+			Storage: configuration.Storage{
+				"inmemory": nil,
+				"maintenance": configuration.Parameters{
+					"uploadpurging": map[interface{}]interface{}{"enabled": false},
+					"gc":            gc,
+				},
+			},
+		}
+	}
+
+	app := NewApp(ctx, newConfig(map[interface{}]interface{}{"schedule": "@daily", "graceperiod": "0s"}))
+	if app.gc == nil {
+		t.Fatal("garbage collection is not scheduled")
+	}
+
+	named, err := reference.WithName("gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository, err := app.registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := repository.Blobs(ctx).Put(ctx, "application/octet-stream", []byte("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.gc.collect(ctx)
+	if _, err := app.registry.BlobStatter().Stat(ctx, desc.Digest); err == nil {
+		t.Error("orphan blob was not collected")
+	}
+
+	serveStatus := func() (int, gcStatusResponse) {
+		w := httptest.NewRecorder()
+		app.GCStatusHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/gc", nil))
+		var status gcStatusResponse
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, status
+	}
+	code, status := serveStatus()
+	if code != http.StatusOK || status.LastSuccess.IsZero() || status.Sweep.Deleted != 1 || status.Sweep.Bytes != desc.Size {
+		t.Errorf("unexpected garbage collection status: %d %+v", code, status)
+	}
+	app.gc.staleAfter = time.Nanosecond
+	if code, status := serveStatus(); code != http.StatusServiceUnavailable || status.Unhealthy == "" {
+		t.Errorf("stale garbage collection status is healthy: %d %+v", code, status)
+	}
+
+	if app := NewApp(ctx, newConfig(map[interface{}]interface{}{"enabled": false, "schedule": "@daily"})); app.gc != nil {
+		t.Error("disabled garbage collection is scheduled")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected an invalid gc schedule to panic")
+		}
+	}()
+	NewApp(ctx, newConfig(map[interface{}]interface{}{"schedule": "every day"}))
+}
+
 // TestNewApp covers the creation of an application via NewApp with a
 // configuration.
 func TestNewApp(t *testing.T) {
@@ -211,6 +340,135 @@ func TestNewApp(t *testing.T) {
 	}
 }
 
+// TestGarbageAccess checks that collecting the garbage of a repository
+// requires delete access, even to report it.
+func TestGarbageAccess(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+
+	app := NewApp(dcontext.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		req, err := http.NewRequest(method, server.URL+"/v2/foo/bar/_garbage", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("unexpected status code for %s: %d", method, resp.StatusCode)
+		}
+		if challenge := resp.Header.Get("WWW-Authenticate"); !strings.Contains(challenge, `scope="repository:foo/bar:delete"`) {
+			t.Errorf("unexpected challenge for %s: %s", method, challenge)
+		}
+	}
+}
+
+// TestAppPolicy checks that requests are allowed or denied by the OPA
+// policy server, and refused while it is unreachable.
+func TestAppPolicy(t *testing.T) {
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input policy.Input `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("unexpected error decoding policy input: %v", err)
+		}
+		if body.Input.User != "silly" {
+			t.Errorf("unexpected user in policy input: %q", body.Input.User)
+		}
+		if strings.HasPrefix(body.Input.Repository, "public/") {
+			w.Write([]byte(`{"result": {"allow": true}}`))
+			return
+		}
+		w.Write([]byte(`{"result": {"allow": false, "reason": "only public repositories may be accessed"}}`))
+	}))
+	defer opa.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.Policy.OPA.URL = opa.URL
+
+	app := NewApp(dcontext.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("/v2/public/app/tags/list"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status for allowed request: %d", resp.StatusCode)
+	}
+	if resp := get("/v2/private/app/tags/list"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status for denied request: %d", resp.StatusCode)
+	}
+
+	opa.Close()
+	if resp := get("/v2/public/app/tags/list"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status with unreachable policy: %d", resp.StatusCode)
+	}
+}
+
+func TestAppPolicyInvalidTrustedProxies(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected invalid trusted proxies to panic")
+		}
+	}()
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Policy.OPA.URL = "http://localhost:8181/v1/data/registry/authz"
+	config.Policy.OPA.TrustedProxies = []string{"proxy"}
+	NewApp(dcontext.Background(), &config)
+}
+
 // Test the access record accumulator
 func TestAppendAccessRecords(t *testing.T) {
 	repo := "testRepo"
@@ -275,3 +533,216 @@ func TestAppendAccessRecords(t *testing.T) {
 		t.Fatal("Actual access record differs from expected")
 	}
 }
+
+func TestAppDeniedEvents(t *testing.T) {
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result": {"allow": false, "reason": "read only"}}`))
+	}))
+	defer opa.Close()
+
+	received := make(chan notifications.Event, 10)
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var envelope struct {
+			Events []notifications.Event `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			t.Errorf("unexpected error decoding events: %v", err)
+		}
+		for _, event := range envelope.Events {
+			received <- event
+		}
+	}))
+	defer listener.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.Policy.OPA.URL = opa.URL
+	config.Notifications.EventConfig.IncludeDenials = true
+	config.Notifications.Endpoints = []configuration.Endpoint{{
+		Name:      "test",
+		URL:       listener.URL,
+		Timeout:   time.Second,
+		Threshold: 1,
+		Backoff:   time.Second,
+	}}
+
+	app := NewApp(dcontext.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	get := func(authorization string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/v2/private/app/tags/list", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// the authentication handshake is not a denial
+	get("")
+	get("Bearer sillytoken")
+
+	select {
+	case event := <-received:
+		if event.Action != notifications.EventActionDenied || event.Target.Repository != "private/app" || event.Actor.Name != "silly" {
+			t.Fatalf("unexpected event: %#v", event)
+		}
+		expected := notifications.DenialRecord{
+			Source: notifications.DenialSourcePolicy,
+			Scopes: []string{"repository:private/app:pull"},
+			Reason: "read only",
+		}
+		if event.Denial == nil || !reflect.DeepEqual(*event.Denial, expected) {
+			t.Fatalf("unexpected denial: %#v", event.Denial)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the denied event")
+	}
+
+	select {
+	case event := <-received:
+		t.Fatalf("unexpected event: %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// tagConstrainedAccessController grants all access, only allowing pushes of
+// release and pull request tags, and deletes of pull request tags.
+type tagConstrainedAccessController struct{}
+
+func (tagConstrainedAccessController) Authorized(r *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	grant := &auth.Grant{User: auth.UserInfo{Name: "ci"}}
+	for _, a := range access {
+		switch a.Action {
+		case "push":
+			grant.TagConstraints = append(grant.TagConstraints, auth.TagConstraint{Access: a, Patterns: []string{"release-*", "v[0-9]*", "pr-*"}})
+		case "delete":
+			grant.TagConstraints = append(grant.TagConstraints, auth.TagConstraint{Access: a, Patterns: []string{"pr-*"}})
+		}
+	}
+	return grant, nil
+}
+
+var registerTagConstrained sync.Once
+
+// tagConstrainedAuth returns the auth configuration of the
+// tagConstrainedAccessController, registering it once.
+func tagConstrainedAuth(t *testing.T) configuration.Auth {
+	registerTagConstrained.Do(func() {
+		if err := auth.Register("tagconstrained", func(map[string]interface{}) (auth.AccessController, error) {
+			return tagConstrainedAccessController{}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return configuration.Auth{"tagconstrained": {}}
+}
+
+func TestAppTagConstraints(t *testing.T) {
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: tagConstrainedAuth(t),
+	}
+	app := NewApp(dcontext.Background(), &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	do := func(method, reference string) int {
+		req, err := http.NewRequest(method, server.URL+"/v2/foo/app/manifests/"+reference, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, reference := range []string{"dev", "latest", "release"} {
+		if status := do(http.MethodPut, reference); status != http.StatusForbidden {
+			t.Errorf("unexpected status pushing tag %s: %d", reference, status)
+		}
+	}
+	// the manifests are invalid, but the tags are allowed
+	for _, reference := range []string{"release-1.0", "v2", "sha256:" + strings.Repeat("a", 64)} {
+		if status := do(http.MethodPut, reference); status == http.StatusForbidden {
+			t.Errorf("unexpected status pushing %s: %d", reference, status)
+		}
+	}
+	// pulls are not constrained
+	if status := do(http.MethodGet, "dev"); status != http.StatusNotFound {
+		t.Errorf("unexpected status pulling tag dev: %d", status)
+	}
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	errs := errcode.Errors{
+		errcode.ErrorCodeUnknown.WithDetail(storagedriver.UnavailableError{DriverName: "s3aws", RetryAfter: 30 * time.Second}),
+		errcode.ErrorCodeBlobUnknown,
+	}
+	w := httptest.NewRecorder()
+	storageUnavailable(w, errs)
+	if err := errcode.ServeJSON(w, errs); err != nil {
+		t.Fatalf("unexpected error serving errors: %v", err)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d, expected 503", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("unexpected Retry-After %q", retryAfter)
+	}
+	if errs[1] != errcode.ErrorCodeBlobUnknown {
+		t.Errorf("unexpected error %v replaced", errs[1])
+	}
+}
+
+func TestParseRedirectConfig(t *testing.T) {
+	disabled, options := parseRedirectConfig(configuration.Parameters{
+		"expiry": "1h",
+		"repositories": []interface{}{
+			map[interface{}]interface{}{"pattern": "private/*", "disable": true},
+		},
+	})
+	if disabled || len(options) != 2 {
+		t.Fatalf("unexpected redirect config: disabled %t, %d options", disabled, len(options))
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a repository without a pattern to panic")
+		}
+	}()
+	parseRedirectConfig(configuration.Parameters{
+		"repositories": []interface{}{
+			map[interface{}]interface{}{"disable": true},
+		},
+	})
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/internal/requestutil"
+	"golang.org/x/time/rate"
+)
+
+// maxBandwidthBurst caps the bytes transferred at once by a client whose
+// bandwidth is limited.
+const maxBandwidthBurst = 64 << 10
+
+// clientLimiterIdleTime is the time after which the limiter of a client
+// starting no transfer is dropped, once its transfers are over.
+const clientLimiterIdleTime = time.Minute
+
+// bandwidthLimiter limits the bandwidth of blob transfers in one direction,
+// globally and per client.
+type bandwidthLimiter struct {
+	global    *rate.Limiter
+	perClient int64
+	client    func(ctx context.Context, r *http.Request) string
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+type clientLimiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+// newBandwidthLimiter returns a limiter enforcing limit, or nil if limit is
+// unlimited.
+func newBandwidthLimiter(limit configuration.BandwidthLimit, client func(ctx context.Context, r *http.Request) string) (*bandwidthLimiter, error) {
+	if limit.Global < 0 || limit.PerClient < 0 {
+		return nil, fmt.Errorf("invalid bandwidth limit: global %d, per client %d", limit.Global, limit.PerClient)
+	}
+	if limit.Global == 0 && limit.PerClient == 0 {
+		return nil, nil
+	}
+
+	bl := &bandwidthLimiter{
+		perClient: limit.PerClient,
+		client:    client,
+		clients:   make(map[string]*clientLimiter),
+	}
+	if limit.Global > 0 {
+		bl.global = newBandwidthRateLimiter(limit.Global)
+	}
+	return bl, nil
+}
+
+func newBandwidthRateLimiter(limit int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(limit), int(min(limit, maxBandwidthBurst)))
+}
+
+// limiters returns the limiters applying to the request.
+func (bl *bandwidthLimiter) limiters(ctx context.Context, r *http.Request) []*rate.Limiter {
+	var limiters []*rate.Limiter
+	if bl.global != nil {
+		limiters = append(limiters, bl.global)
+	}
+	if bl.perClient > 0 {
+		limiters = append(limiters, bl.clientLimiter(bl.client(ctx, r)))
+	}
+	return limiters
+}
+
+// clientLimiter returns the limiter of the client, dropping the limiters of
+// the clients which went idle.
+func (bl *bandwidthLimiter) clientLimiter(client string) *rate.Limiter {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(bl.lastSweep) > clientLimiterIdleTime {
+		for c, l := range bl.clients {
+			// a full bucket tells that no transfer of the client is running
+			if now.Sub(l.lastUsed) > clientLimiterIdleTime && l.TokensAt(now) >= float64(l.Burst()) {
+				delete(bl.clients, c)
+			}
+		}
+		bl.lastSweep = now
+	}
+
+	l, ok := bl.clients[client]
+	if !ok {
+		l = &clientLimiter{Limiter: newBandwidthRateLimiter(bl.perClient)}
+		bl.clients[client] = l
+	}
+	l.lastUsed = now
+	return l.Limiter
+}
+
+// reader returns body limited to the bandwidth of the request.
+func (bl *bandwidthLimiter) reader(ctx context.Context, r *http.Request, body io.ReadCloser) io.ReadCloser {
+	if bl == nil {
+		return body
+	}
+	return &throttledReader{ReadCloser: body, throttle: newThrottle(ctx, bl.limiters(ctx, r))}
+}
+
+// writer returns w limited to the bandwidth of the request.
+func (bl *bandwidthLimiter) writer(ctx context.Context, r *http.Request, w http.ResponseWriter) http.ResponseWriter {
+	if bl == nil {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, throttle: newThrottle(ctx, bl.limiters(ctx, r))}
+}
+
+// throttle waits for the bandwidth of transfers on all its limiters.
+type throttle struct {
+	ctx      context.Context
+	limiters []*rate.Limiter
+	burst    int
+}
+
+func newThrottle(ctx context.Context, limiters []*rate.Limiter) throttle {
+	burst := maxBandwidthBurst
+	for _, l := range limiters {
+		burst = min(burst, l.Burst())
+	}
+	return throttle{ctx: ctx, limiters: limiters, burst: burst}
+}
+
+func (t throttle) wait(n int) error {
+	for _, l := range t.limiters {
+		if err := l.WaitN(t.ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttledReader limits the bandwidth of the reads of a request body.
+type throttledReader struct {
+	io.ReadCloser
+	throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > tr.burst {
+		p = p[:tr.burst]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		if err := tr.wait(n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// throttledWriter limits the bandwidth of the writes of a response body.
+type throttledWriter struct {
+	http.ResponseWriter
+	throttle
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), tw.burst)]
+		if err := tw.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// configureBandwidth sets up the bandwidth limits of blob transfers.
+func (app *App) configureBandwidth(config *configuration.Configuration) {
+	bandwidth := config.HTTP.Bandwidth
+	trusted, err := requestutil.ParseTrustedProxies(bandwidth.TrustedProxies)
+	if err != nil {
+		panic(fmt.Sprintf("invalid bandwidth trusted proxies: %v", err))
+	}
+
+	var client func(ctx context.Context, r *http.Request) string
+	switch bandwidth.Client {
+	case "", "ip":
+		client = func(ctx context.Context, r *http.Request) string {
+			return requestutil.TrustedRemoteIP(r, trusted)
+		}
+	case "user":
+		client = func(ctx context.Context, r *http.Request) string {
+			// only authenticated names are trusted
+			if name := dcontext.GetStringValue(ctx, userNameKey); name != "" {
+				return "user:" + name
+			}
+			return requestutil.TrustedRemoteIP(r, trusted)
+		}
+	default:
+		panic(fmt.Sprintf("invalid bandwidth client %q, must be ip or user", bandwidth.Client))
+	}
+
+	app.uploadBandwidth, err = newBandwidthLimiter(bandwidth.Upload, client)
+	if err != nil {
+		panic(fmt.Sprintf("invalid upload bandwidth: %v", err))
+	}
+	app.downloadBandwidth, err = newBandwidthLimiter(bandwidth.Download, client)
+	if err != nil {
+		panic(fmt.Sprintf("invalid download bandwidth: %v", err))
+	}
+}
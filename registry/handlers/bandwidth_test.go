@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	ctx := context.Background()
+	client := func(ctx context.Context, r *http.Request) string {
+		return r.Header.Get("Client")
+	}
+	request := func(c string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Client", c)
+		return r
+	}
+
+	if bl, err := newBandwidthLimiter(configuration.BandwidthLimit{}, client); bl != nil || err != nil {
+		t.Fatalf("expected no limiter without limits, got %v, %v", bl, err)
+	}
+	if _, err := newBandwidthLimiter(configuration.BandwidthLimit{PerClient: -1}, client); err == nil {
+		t.Fatal("expected an error for a negative limit")
+	}
+
+	bl, err := newBandwidthLimiter(configuration.BandwidthLimit{PerClient: 1000}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first second of bandwidth is available at once, the rest is
+	// throttled
+	start := time.Now()
+	content := bytes.Repeat([]byte("a"), 1300)
+	p, err := io.ReadAll(bl.reader(ctx, request("a"), io.NopCloser(bytes.NewReader(content))))
+	if err != nil || !bytes.Equal(p, content) {
+		t.Fatalf("unexpected read: %d bytes, %v", len(p), err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("expected the read to be throttled, took %s", elapsed)
+	}
+
+	// other clients have their own bandwidth
+	start = time.Now()
+	w := httptest.NewRecorder()
+	if _, err := bl.writer(ctx, request("b"), w).Write(content[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond || w.Body.Len() != 1000 {
+		t.Fatalf("expected another client not to be throttled, took %s to write %d bytes", elapsed, w.Body.Len())
+	}
+
+	// transfers stop once the request is done
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := bl.writer(canceled, request("b"), httptest.NewRecorder()).Write(content); err == nil {
+		t.Fatal("expected a canceled transfer to fail")
+	}
+}
+
+func TestConfigureBandwidthInvalidClient(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected an invalid bandwidth client to panic")
+		}
+	}()
+	config := &configuration.Configuration{}
+	config.HTTP.Bandwidth.Client = "token"
+	(&App{}).configureBandwidth(config)
+}
+
+func TestConfigureBandwidthTrustedProxies(t *testing.T) {
+	config := &configuration.Configuration{}
+	config.HTTP.Bandwidth.TrustedProxies = []string{"10.0.0.0/8"}
+	config.HTTP.Bandwidth.Upload.PerClient = 1000
+	app := &App{}
+	app.configureBandwidth(config)
+
+	for _, tc := range []struct {
+		remoteAddr string
+		expected   string
+	}{
+		// forged by an untrusted client
+		{remoteAddr: "192.0.2.1:5000", expected: "192.0.2.1"},
+		// forwarded by a trusted proxy
+		{remoteAddr: "10.0.0.1:5000", expected: "198.51.100.1"},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		if client := app.uploadBandwidth.client(context.Background(), r); client != tc.expected {
+			t.Errorf("expected client %s from %s, got %s", tc.expected, tc.remoteAddr, client)
+		}
+	}
+}
+
+func TestConfigureBandwidthInvalidTrustedProxies(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected invalid trusted proxies to panic")
+		}
+	}()
+	config := &configuration.Configuration{}
+	config.HTTP.Bandwidth.TrustedProxies = []string{"proxy"}
+	(&App{}).configureBandwidth(config)
+}
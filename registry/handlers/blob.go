@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
 )
@@ -65,7 +68,16 @@ func (bh *blobHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := blobs.ServeBlob(bh, w, r, desc.Digest); err != nil {
+	if err := blobs.ServeBlob(bh, bh.App.downloadBandwidth.writer(bh, r, w), r, desc.Digest); err != nil {
+		var archived storagedriver.ArchivedContentError
+		if errors.As(err, &archived) {
+			// the blob can be pulled again once restored
+			if archived.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(archived.RetryAfter.Seconds())))
+			}
+			bh.Errors = append(bh.Errors, errcode.ErrorCodeUnavailable.WithDetail(archived.Error()))
+			return
+		}
 		dcontext.GetLogger(bh).Debugf("unexpected error getting blob HTTP handler: %v", err)
 		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
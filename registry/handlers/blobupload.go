@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -10,6 +12,7 @@ import (
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
@@ -99,6 +102,18 @@ func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// hint the repositories the blob can be mounted from, to the clients
+	// which do not know one
+	if buh.App.mountHints != nil && fromRepo == "" {
+		hinted := mountDigest
+		if hinted == "" {
+			hinted = r.FormValue("digest")
+		}
+		if dgst, err := digest.Parse(hinted); err == nil {
+			buh.writeMountHints(w, dgst)
+		}
+	}
+
 	w.Header().Set("Docker-Upload-UUID", buh.Upload.ID())
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -142,6 +157,10 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	var (
+		dest  io.Writer = buh.Upload
+		chunk io.WriteCloser
+	)
 	cr := r.Header.Get("Content-Range")
 	cl := r.Header.Get("Content-Length")
 	if cr != "" && cl != "" {
@@ -150,7 +169,7 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 			return
 		}
-		if start > end || start != buh.Upload.Size() {
+		if start > end || start < buh.Upload.Size() {
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeRangeInvalid)
 			return
 		}
@@ -164,13 +183,41 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid)
 			return
 		}
+
+		if start > buh.Upload.Size() {
+			// The chunk was uploaded out of order, or in parallel with the
+			// preceding ones: it is stored aside until the upload completes.
+			chunk, err = buh.chunkWriter(start, clInt)
+			if err != nil {
+				buh.Errors = append(buh.Errors, err)
+				return
+			}
+			dest = chunk
+		}
 	}
 
-	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PATCH"); err != nil {
-		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+	defer buh.watchIdleUpload(r)()
+	buh.throttleUpload(r)
+	if err := copyFullPayload(buh, w, r, dest, r.ContentLength, "blob PATCH"); err != nil {
+		if chunk != nil {
+			// discards the partial chunk
+			chunk.Close()
+		}
+		buh.Errors = append(buh.Errors, payloadError(err))
 		return
 	}
 
+	if chunk != nil {
+		if err := chunk.Close(); err != nil {
+			if err == distribution.ErrBlobInvalidLength {
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid.WithDetail(err))
+			} else {
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			}
+			return
+		}
+	}
+
 	if err := buh.blobUploadResponse(w, r); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
@@ -179,6 +226,41 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// chunkWriter returns a writer for the chunk of size bytes at offset, or the
+// error to serve if the upload does not accept chunks out of order.
+func (buh *blobUploadHandler) chunkWriter(offset, size int64) (io.WriteCloser, error) {
+	cw, ok := buh.Upload.(distribution.BlobChunkWriter)
+	if !ok {
+		return nil, errcode.ErrorCodeRangeInvalid
+	}
+	chunk, err := cw.ChunkWriter(buh, offset, size)
+	if err == distribution.ErrUnsupported {
+		return nil, errcode.ErrorCodeRangeInvalid
+	} else if err != nil {
+		return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	return chunk, nil
+}
+
+// watchIdleUpload makes the reads of the body of r fail once the client sent
+// no data for the upload idle timeout, if configured. The returned function
+// must be called once the body was read.
+func (buh *blobUploadHandler) watchIdleUpload(r *http.Request) func() {
+	timeout := buh.Config.HTTP.UploadIdleTimeout
+	if timeout <= 0 {
+		return func() {}
+	}
+	body := newIdleTimeoutReader(r.Body, timeout)
+	r.Body = body
+	return func() { body.Close() }
+}
+
+// throttleUpload limits the bandwidth of the reads of the body of r, if
+// configured.
+func (buh *blobUploadHandler) throttleUpload(r *http.Request) {
+	r.Body = buh.App.uploadBandwidth.reader(buh, r, r.Body)
+}
+
 // PutBlobUploadComplete takes the final request of a blob upload. The
 // request may include all the blob data or no blob data. Any data
 // provided is received and verified. If successful, the blob is linked
@@ -206,8 +288,39 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		return
 	}
 
-	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PUT"); err != nil {
-		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+	uploadedDelta, err := buh.uploadedDelta(r)
+	if err != nil {
+		buh.Errors = append(buh.Errors, err)
+		return
+	}
+
+	// The digest of a monolithic upload, sent in this request only, is
+	// verified as it streams in, so that a mismatch fails the upload before
+	// it is committed to the storage.
+	var (
+		dest     io.Writer = buh.Upload
+		verifier digest.Verifier
+	)
+	if buh.Upload.Size() == 0 {
+		verifier = dgst.Verifier()
+		dest = io.MultiWriter(buh.Upload, verifier)
+	}
+
+	defer buh.watchIdleUpload(r)()
+	buh.throttleUpload(r)
+	if err := copyFullPayload(buh, w, r, dest, r.ContentLength, "blob PUT"); err != nil {
+		buh.Errors = append(buh.Errors, payloadError(err))
+		return
+	}
+
+	if verifier != nil && !verifier.Verified() {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeDigestInvalid.WithDetail(distribution.ErrBlobInvalidDigest{
+			Digest: dgst,
+			Reason: errors.New("content does not match digest"),
+		}))
+		if err := buh.Upload.Cancel(buh); err != nil {
+			dcontext.GetLogger(buh).Errorf("error canceling upload after error: %v", err)
+		}
 		return
 	}
 
@@ -224,6 +337,9 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeDigestInvalid.WithDetail(err))
 		case errcode.Error:
 			buh.Errors = append(buh.Errors, err)
+		case errcode.Errors:
+			// the errors of the remote registry of a push through cache
+			buh.Errors = append(buh.Errors, err...)
 		default:
 			switch err {
 			case distribution.ErrAccessDenied:
@@ -247,6 +363,13 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 
 		return
 	}
+	if uploadedDelta != nil {
+		uploadedDelta.Digest = desc.Digest
+		if err := buh.linkDelta(w, *uploadedDelta); err != nil {
+			buh.Errors = append(buh.Errors, err)
+			return
+		}
+	}
 	if err := buh.writeBlobCreatedHeaders(w, desc); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
@@ -271,7 +394,12 @@ func (buh *blobUploadHandler) CancelBlobUpload(w http.ResponseWriter, r *http.Re
 }
 
 func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) http.Handler {
-	state, err := hmacKey(ctx.Config.HTTP.Secret).unpackUploadState(r.FormValue("_state"))
+	state, err := hmacKey(ctx.App.httpSecret()).unpackUploadState(r.FormValue("_state"))
+	if err == errInvalidSecret && ctx.App.reloadSharedSecret(ctx) {
+		// the state was signed by a registry which stored the shared secret
+		// after this one loaded it
+		state, err = hmacKey(ctx.App.httpSecret()).unpackUploadState(r.FormValue("_state"))
+	}
 	if err != nil {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			dcontext.GetLogger(ctx).Infof("error resolving upload: %v", err)
@@ -310,7 +438,13 @@ func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) ht
 	}
 	buh.Upload = upload
 
-	if size := upload.Size(); size != buh.State.Offset {
+	// The chunks uploaded in parallel all resume the upload with the state
+	// returned when it was started: the offset of a chunk declaring its range
+	// is checked against that range instead, and the upload can be completed
+	// with the state returned for any of its chunks.
+	size := upload.Size()
+	rangeChecked := r.Method == http.MethodPatch && r.Header.Get("Content-Range") != ""
+	if size != buh.State.Offset && !rangeChecked && (r.Method != http.MethodPut || size < buh.State.Offset) {
 		dcontext.GetLogger(ctx).Errorf("upload resumed at wrong offset: %d != %d", size, buh.State.Offset)
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeRangeInvalid.WithDetail(err))
@@ -330,7 +464,7 @@ func (buh *blobUploadHandler) blobUploadResponse(w http.ResponseWriter, r *http.
 	buh.State.Offset = buh.Upload.Size()
 	buh.State.StartedAt = buh.Upload.StartedAt()
 
-	token, err := hmacKey(buh.Config.HTTP.Secret).packUploadState(buh.State)
+	token, err := hmacKey(buh.App.httpSecret()).packUploadState(buh.State)
 	if err != nil {
 		dcontext.GetLogger(buh).Infof("error building upload state token: %s", err)
 		return err
@@ -401,3 +535,18 @@ func (buh *blobUploadHandler) writeBlobCreatedHeaders(w http.ResponseWriter, des
 	w.WriteHeader(http.StatusCreated)
 	return nil
 }
+
+// payloadError returns the error of a failure to write the payload of an
+// upload, which is a digest error when the storage rejected corrupted content,
+// or a size error when the payload exceeded its declared length.
+func payloadError(err error) errcode.Error {
+	var checksumErr storagedriver.ChecksumMismatchError
+	if errors.As(err, &checksumErr) {
+		return errcode.ErrorCodeDigestInvalid.WithDetail(err.Error())
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errcode.ErrorCodeSizeInvalid.WithDetail(err.Error())
+	}
+	return errcode.ErrorCodeUnknown.WithDetail(err.Error())
+}
@@ -151,6 +151,21 @@ func (rc resourceContext) Value(key interface{}) interface{} {
 	return rc.Context.Value(key)
 }
 
+// withTagConstraints returns a context with the tag constraints of the
+// granted access.
+func withTagConstraints(ctx context.Context, constraints []auth.TagConstraint) context.Context {
+	return context.WithValue(ctx, tagConstraintsKey{}, constraints)
+}
+
+type tagConstraintsKey struct{}
+
+// tagAllowed reports whether the action on the tag of the named repository
+// is granted for this request.
+func tagAllowed(ctx context.Context, name, action, tag string) bool {
+	constraints, _ := ctx.Value(tagConstraintsKey{}).([]auth.TagConstraint)
+	return auth.TagAllowed(constraints, name, action, tag)
+}
+
 // authorizedResources returns the list of resources which have
 // been authorized for this request.
 func authorizedResources(ctx context.Context) []auth.Resource {
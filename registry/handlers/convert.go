@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/internal/estargz"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// defaultConversionWorkers is the default number of images converted
+	// concurrently.
+	defaultConversionWorkers = 1
+
+	// defaultConversionQueueSize is the default number of images waiting to
+	// be converted, beyond which pushed images are not converted.
+	defaultConversionQueueSize = 100
+)
+
+// conversionsCount counts the images handled by the converter, by result.
+var conversionsCount = prometheus.StorageNamespace.NewLabeledCounter("conversions", "The number of pushed images handled by the layer converter", "format", "result")
+
+// conversion is an image waiting to be converted.
+type conversion struct {
+	name   string
+	digest digest.Digest
+}
+
+// converter converts the layers of the images pushed to the matching
+// repositories in the background, publishing the converted images as
+// referrers of the pushed ones.
+type converter struct {
+	registry     distribution.Namespace
+	repositories []string
+	format       string
+	chunkSize    int64
+	workers      int
+
+	queue chan conversion
+
+	mu      sync.Mutex
+	pending map[conversion]struct{}
+}
+
+// configureConversion enables the conversion of the layers of the pushed
+// images, if configured. The converter is started by startConverter once the
+// registry is created.
+func (app *App) configureConversion(config configuration.Parameters) {
+	if enabled, ok := config["enabled"]; ok {
+		enabled, ok := enabled.(bool)
+		if !ok {
+			panic(fmt.Sprintf("invalid type for conversion enabled config: %#v", config["enabled"]))
+		}
+		if !enabled {
+			return
+		}
+	}
+
+	c := &converter{
+		format:    storage.ConversionFormatEStargz,
+		chunkSize: estargz.DefaultChunkSize,
+		workers:   defaultConversionWorkers,
+		pending:   make(map[conversion]struct{}),
+	}
+	if v, ok := config["format"]; ok {
+		switch v {
+		case storage.ConversionFormatEStargz, storage.ConversionFormatZstdChunked:
+			c.format = v.(string)
+		default:
+			panic(fmt.Sprintf("unsupported conversion format: %#v", v))
+		}
+	}
+	if v, ok := config["repositories"]; ok {
+		repositories, ok := v.([]interface{})
+		if !ok {
+			panic(fmt.Sprintf("conversion repositories config key must be a list of patterns: %#v", v))
+		}
+		for _, pattern := range repositories {
+			pattern, ok := pattern.(string)
+			if !ok {
+				panic(fmt.Sprintf("invalid conversion repository pattern: %#v", pattern))
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				panic(fmt.Sprintf("invalid conversion repository pattern %q: %v", pattern, err))
+			}
+			c.repositories = append(c.repositories, pattern)
+		}
+	}
+	if v, ok := config["chunksize"]; ok {
+		chunkSize, ok := v.(int)
+		if !ok || chunkSize <= 0 {
+			panic(fmt.Sprintf("conversion chunksize config key must have a positive integer value: %#v", v))
+		}
+		c.chunkSize = int64(chunkSize)
+	}
+	if v, ok := config["workers"]; ok {
+		c.workers, ok = v.(int)
+		if !ok || c.workers <= 0 {
+			panic(fmt.Sprintf("conversion workers config key must have a positive integer value: %#v", v))
+		}
+	}
+	queueSize := defaultConversionQueueSize
+	if v, ok := config["queuesize"]; ok {
+		queueSize, ok = v.(int)
+		if !ok || queueSize < 0 {
+			panic(fmt.Sprintf("conversion queuesize config key must have a non-negative integer value: %#v", v))
+		}
+	}
+	c.queue = make(chan conversion, queueSize)
+
+	app.converter = c
+}
+
+// startConverter starts the workers of the converter, if enabled. Images
+// are neither converted by pull through caches nor in read-only mode.
+func (app *App) startConverter() {
+	if app.converter == nil {
+		return
+	}
+	if app.isCache || app.readOnly {
+		dcontext.GetLogger(app).Warnf("not converting layers of pushed images in proxy or read-only mode")
+		app.converter = nil
+		return
+	}
+
+	app.converter.registry = app.registry
+	for range app.converter.workers {
+		go app.converter.run(app)
+	}
+	dcontext.GetLogger(app).Infof("converting layers of pushed images to %s with %d workers", app.converter.format, app.converter.workers)
+}
+
+// enqueue queues the conversion of the image manifest dgst pushed to the
+// named repository, if the repository matches. Images are dropped when the
+// queue is full, so that pushes are never slowed down by conversions.
+func (c *converter) enqueue(ctx context.Context, name string, dgst digest.Digest) {
+	if !c.matches(name) {
+		return
+	}
+	conv := conversion{name: name, digest: dgst}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pending[conv]; ok {
+		return
+	}
+	select {
+	case c.queue <- conv:
+		c.pending[conv] = struct{}{}
+	default:
+		dcontext.GetLogger(ctx).Warnf("conversion queue full, not converting %s@%s", name, dgst)
+		conversionsCount.WithValues(c.format, "dropped").Inc(1)
+	}
+}
+
+// matches reports whether the images of the named repository are converted.
+func (c *converter) matches(name string) bool {
+	if len(c.repositories) == 0 {
+		return true
+	}
+	for _, pattern := range c.repositories {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run converts the queued images until the context is done.
+func (c *converter) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case conv := <-c.queue:
+			c.convert(ctx, conv)
+			c.mu.Lock()
+			delete(c.pending, conv)
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *converter) convert(ctx context.Context, conv conversion) {
+	logger := dcontext.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+		"vars.name":   conv.name,
+		"vars.digest": conv.digest,
+	})
+
+	named, err := reference.WithName(conv.name)
+	if err != nil {
+		logger.Errorf("error converting image: %v", err)
+		conversionsCount.WithValues(c.format, "failed").Inc(1)
+		return
+	}
+	repository, err := c.registry.Repository(ctx, named)
+	if err == nil {
+		var desc distribution.Descriptor
+		desc, err = storage.ConvertImage(ctx, repository, conv.digest, c.format, c.chunkSize)
+		if err == nil {
+			logger.Infof("converted image to %s as %s", c.format, desc.Digest)
+			conversionsCount.WithValues(c.format, "converted").Inc(1)
+			return
+		}
+	}
+	if errors.Is(err, storage.ErrNothingToConvert) {
+		conversionsCount.WithValues(c.format, "skipped").Inc(1)
+		return
+	}
+	logger.Errorf("error converting image: %v", err)
+	conversionsCount.WithValues(c.format, "failed").Inc(1)
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+func TestConfigureConversionFormat(t *testing.T) {
+	app := &App{}
+	app.configureConversion(configuration.Parameters{})
+	if app.converter.format != storage.ConversionFormatEStargz {
+		t.Errorf("expected images to be converted to eStargz by default, got %s", app.converter.format)
+	}
+
+	app = &App{}
+	app.configureConversion(configuration.Parameters{"format": "zstd:chunked"})
+	if app.converter.format != storage.ConversionFormatZstdChunked {
+		t.Errorf("expected images to be converted to zstd:chunked, got %s", app.converter.format)
+	}
+}
+
+func TestConfigureConversionInvalidFormat(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected an unsupported conversion format to panic")
+		}
+	}()
+	(&App{}).configureConversion(configuration.Parameters{"format": "zstd"})
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/internal/delta"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultMaxDeltaTargetSize bounds the size of the blobs materialized from
+// deltas by default.
+const defaultMaxDeltaTargetSize = 10 << 30
+
+// configureDeltas enables the deltas of blobs, if configured.
+func (app *App) configureDeltas(config configuration.Parameters) {
+	if enabled, ok := config["enabled"]; ok {
+		enabled, ok := enabled.(bool)
+		if !ok {
+			panic(fmt.Sprintf("invalid type for delta enabled config: %#v", config["enabled"]))
+		}
+		if !enabled {
+			return
+		}
+	}
+
+	materialize, ok := config["materialize"]
+	if ok {
+		app.materializeDeltas, ok = materialize.(bool)
+		if !ok {
+			panic(fmt.Sprintf("invalid type for delta materialize config: %#v", materialize))
+		}
+	}
+
+	maxSize := int64(defaultMaxDeltaTargetSize)
+	if v, ok := config["maxsize"]; ok {
+		size, ok := v.(int)
+		if !ok || size <= 0 {
+			panic(fmt.Sprintf("delta maxsize config key must have a positive integer value: %#v", v))
+		}
+		maxSize = int64(size)
+	}
+
+	app.deltas = storage.NewDeltaService(app.driver, maxSize)
+	dcontext.GetLogger(app).Infof("deltas of blobs enabled, materialized: %t", app.materializeDeltas)
+}
+
+// deltasDispatcher constructs the handler listing the deltas of a blob.
+func deltasDispatcher(ctx *Context, r *http.Request) http.Handler {
+	dgst, err := getDigest(ctx)
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeDigestInvalid.WithDetail(err))
+		})
+	}
+
+	deltasHandler := &deltasHandler{
+		Context: ctx,
+		Digest:  dgst,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(deltasHandler.GetDeltas),
+	}
+}
+
+// deltasHandler lists the deltas of a blob.
+type deltasHandler struct {
+	*Context
+
+	Digest digest.Digest
+}
+
+type deltaAPIResponse struct {
+	Base      digest.Digest `json:"base"`
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+	MediaType string        `json:"mediaType"`
+}
+
+type deltasAPIResponse struct {
+	Name   string             `json:"name"`
+	Target digest.Digest      `json:"target"`
+	Deltas []deltaAPIResponse `json:"deltas"`
+}
+
+// GetDeltas returns a json list of the deltas of the blob.
+func (dh *deltasHandler) GetDeltas(w http.ResponseWriter, r *http.Request) {
+	if dh.App.deltas == nil {
+		dh.Errors = append(dh.Errors, errcode.ErrorCodeUnsupported.WithDetail("deltas are not enabled"))
+		return
+	}
+
+	deltas, err := dh.App.deltas.Deltas(dh, dh.Repository, dh.Digest)
+	if err != nil {
+		dh.Errors = append(dh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	response := deltasAPIResponse{
+		Name:   dh.Repository.Named().Name(),
+		Target: dh.Digest,
+		Deltas: make([]deltaAPIResponse, 0, len(deltas)),
+	}
+	for _, d := range deltas {
+		response.Deltas = append(response.Deltas, deltaAPIResponse{
+			Base:      d.Base,
+			Digest:    d.Digest,
+			Size:      d.Size,
+			MediaType: delta.MediaType,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		dh.Errors = append(dh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// uploadedDelta returns the delta the completed upload is declared to be by
+// the delta-base and delta-target parameters, or nil if it is a plain blob.
+func (buh *blobUploadHandler) uploadedDelta(r *http.Request) (*storage.Delta, error) {
+	baseStr, targetStr := r.FormValue("delta-base"), r.FormValue("delta-target")
+	if baseStr == "" && targetStr == "" {
+		return nil, nil
+	}
+	if buh.App.deltas == nil {
+		return nil, errcode.ErrorCodeUnsupported.WithDetail("deltas are not enabled")
+	}
+
+	base, err := digest.Parse(baseStr)
+	if err != nil {
+		return nil, errcode.ErrorCodeDigestInvalid.WithDetail("delta-base parsing failed")
+	}
+	target, err := digest.Parse(targetStr)
+	if err != nil {
+		return nil, errcode.ErrorCodeDigestInvalid.WithDetail("delta-target parsing failed")
+	}
+	if base == target {
+		return nil, errcode.ErrorCodeDigestInvalid.WithDetail("delta-base and delta-target are the same")
+	}
+	return &storage.Delta{Base: base, Target: target}, nil
+}
+
+// linkDelta links the uploaded delta into the repository, materializing its
+// target if configured.
+func (buh *blobUploadHandler) linkDelta(w http.ResponseWriter, d storage.Delta) error {
+	err := buh.App.deltas.Link(buh, buh.Repository, d)
+	if err == nil && buh.App.materializeDeltas {
+		var desc distribution.Descriptor
+		desc, err = buh.App.deltas.Materialize(buh, buh.Repository, d)
+		if err == nil {
+			w.Header().Set("Docker-Delta-Target", desc.Digest.String())
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case errors.Is(err, distribution.ErrBlobUnknown):
+		return errcode.ErrorCodeBlobUnknown.WithDetail(d.Base)
+	case errors.As(err, &distribution.ErrBlobInvalidDigest{}):
+		return errcode.ErrorCodeDigestInvalid.WithDetail(err)
+	case errors.Is(err, delta.ErrInvalid), errors.Is(err, storage.ErrDeltaTooLarge):
+		return errcode.ErrorCodeBlobUploadInvalid.WithDetail(err.Error())
+	default:
+		dcontext.GetLogger(buh).Errorf("unknown error linking delta: %v", err)
+		return errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+}
@@ -0,0 +1,441 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/cron"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/uuid"
+	"github.com/gorilla/handlers"
+)
+
+const (
+	// defaultGCGracePeriod is the default time the content written before a
+	// scheduled garbage collection is kept.
+	defaultGCGracePeriod = 24 * time.Hour
+
+	// gcLockTTL is the time the registry collecting the garbage holds the
+	// lock electing it without renewing it.
+	gcLockTTL = 10 * time.Minute
+
+	// gcProgressInterval is the interval at which the progress of a scheduled
+	// garbage collection is logged.
+	gcProgressInterval = time.Minute
+)
+
+// gcScheduler collects the garbage on schedule while the registry serves
+// requests.
+type gcScheduler struct {
+	schedule *cron.Schedule
+	opts     storage.GCOpts
+
+	// staleAfter is the period after which the status of the collections
+	// is reported unhealthy if none succeeded, disabled if zero.
+	staleAfter time.Duration
+	// incremental is true if the collections delete the blobs whose
+	// reference count dropped to zero instead of marking the registry.
+	incremental bool
+	started     time.Time
+	holder      string
+
+	driver   storagedriver.StorageDriver
+	registry distribution.Namespace
+	lock     *storage.GCLock
+}
+
+// configureGC schedules the garbage collection, if configured, and enables
+// the online garbage collection, recording the writes made during the
+// collections. The collection is scheduled by startGC once the registry is
+// created.
+func (app *App) configureGC(config map[interface{}]interface{}) {
+	if enabled, ok := config["enabled"]; ok {
+		enabled, ok := enabled.(bool)
+		if !ok {
+			panic("gc's enabled config key must have a boolean value")
+		}
+		if !enabled {
+			return
+		}
+	}
+	if app.isCache || app.readOnly {
+		dcontext.GetLogger(app).Warnf("not collecting garbage in proxy or read-only mode")
+		return
+	}
+
+	expr, ok := config["schedule"].(string)
+	if !ok {
+		panic("gc's schedule config key must be a cron expression")
+	}
+	schedule, err := cron.Parse(expr)
+	if err != nil {
+		panic(fmt.Sprintf("unable to parse gc schedule: %v", err))
+	}
+
+	app.gcBarrier = storage.NewGCBarrier()
+	s := &gcScheduler{
+		schedule: schedule,
+		opts: storage.GCOpts{
+			GracePeriod: defaultGCGracePeriod,
+			Barrier:     app.gcBarrier,
+		},
+	}
+	if v, ok := config["graceperiod"]; ok {
+		gracePeriod, ok := v.(string)
+		if !ok {
+			panic("gc's graceperiod config key must be a string")
+		}
+		s.opts.GracePeriod, err = time.ParseDuration(gracePeriod)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse gc graceperiod: %v", err))
+		}
+		if s.opts.GracePeriod < 0 {
+			panic("gc's graceperiod must not be negative")
+		}
+	}
+	if v, ok := config["dryrun"]; ok {
+		if s.opts.DryRun, ok = v.(bool); !ok {
+			panic("gc's dryrun config key must have a boolean value")
+		}
+	}
+	if v, ok := config["deleteuntagged"]; ok {
+		if s.opts.RemoveUntagged, ok = v.(bool); !ok {
+			panic("gc's deleteuntagged config key must have a boolean value")
+		}
+	}
+	if v, ok := config["deleteuntaggedolderthan"]; ok {
+		olderThan, ok := v.(string)
+		if !ok {
+			panic("gc's deleteuntaggedolderthan config key must be a string")
+		}
+		s.opts.RemoveUntaggedOlderThan, err = time.ParseDuration(olderThan)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse gc deleteuntaggedolderthan: %v", err))
+		}
+		s.opts.RemoveUntagged = true
+	}
+	if v, ok := config["staleafter"]; ok {
+		staleAfter, ok := v.(string)
+		if !ok {
+			panic("gc's staleafter config key must be a string")
+		}
+		s.staleAfter, err = time.ParseDuration(staleAfter)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse gc staleafter: %v", err))
+		}
+	}
+	if v, ok := config["incremental"]; ok {
+		if s.incremental, ok = v.(bool); !ok {
+			panic("gc's incremental config key must have a boolean value")
+		}
+		if s.incremental && s.opts.RemoveUntagged {
+			panic("gc's incremental config key is incompatible with deleteuntagged")
+		}
+	}
+	if v, ok := config["concurrency"]; ok {
+		concurrency, ok := v.(int)
+		if !ok || concurrency <= 0 {
+			panic("gc's concurrency config key must have a positive integer value")
+		}
+		s.opts.Concurrency = concurrency
+	}
+
+	app.gc = s
+}
+
+// startGC creates the registry the garbage collections run against and
+// schedules the garbage collection, if configured.
+func (app *App) startGC() {
+	if app.gcBarrier == nil {
+		return
+	}
+	options := []storage.RegistryOption{storage.EnableDelete, storage.OnlineGC(app.gcBarrier)}
+	if app.refCounter != nil {
+		options = append(options, storage.ReferenceCounting(app.refCounter))
+	}
+	registry, err := storage.NewRegistry(app, app.driver, options...)
+	if err != nil {
+		panic("could not create registry: " + err.Error())
+	}
+	app.gcRegistry = registry
+	if app.gc == nil {
+		return
+	}
+
+	app.gc.driver = app.driver
+	app.gc.registry = registry
+	app.gc.opts.PullStats = app.pullStats
+	if app.gc.incremental {
+		if app.refCounter == nil {
+			panic("gc's incremental config key requires refcount to be enabled")
+		}
+		app.gc.opts.RefCounter = app.refCounter
+	}
+	app.gc.started = time.Now()
+	app.gc.holder = app.events.source.Addr + "/" + uuid.NewString()
+	app.gc.lock = storage.NewGCLock(app.driver, app.gc.holder, gcLockTTL)
+
+	dcontext.GetLogger(app).Infof("collecting garbage on schedule, keeping the content written within %s", app.gc.opts.GracePeriod)
+	go app.gc.run(app)
+}
+
+// run collects the garbage on schedule until the context is done.
+func (s *gcScheduler) run(ctx context.Context) {
+	for {
+		next := s.schedule.Next(time.Now())
+		if next.IsZero() {
+			dcontext.GetLogger(ctx).Errorf("gc schedule never matches, not collecting garbage")
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.collect(ctx)
+	}
+}
+
+// collect collects the garbage, unless another registry sharing the storage
+// backend does.
+func (s *gcScheduler) collect(ctx context.Context) {
+	logger := dcontext.GetLogger(ctx)
+
+	elected, err := s.lock.Acquire(ctx)
+	if err != nil {
+		logger.Errorf("error electing the registry collecting garbage: %v", err)
+		return
+	}
+	if !elected {
+		logger.Infof("garbage collected by another registry")
+		return
+	}
+	defer func() {
+		if err := s.lock.Release(context.WithoutCancel(ctx)); err != nil {
+			logger.Errorf("error releasing the garbage collection lock: %v", err)
+		}
+	}()
+
+	// the collection is aborted if the lock is lost
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(gcLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				elected, err := s.lock.Acquire(ctx)
+				if err == nil && !elected {
+					err = errors.New("held by another registry")
+				}
+				if err != nil {
+					logger.Errorf("lost the garbage collection lock, aborting: %v", err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	logger.Infof("collecting garbage")
+	status := storage.GCStatus{Holder: s.holder, Started: time.Now(), DryRun: s.opts.DryRun}
+	opts := s.opts
+	opts.BeforeSweep = func(ctx context.Context) error {
+		held, err := s.lock.Held(ctx)
+		if err == nil && !held {
+			err = errors.New("garbage collection lock held by another registry")
+		}
+		return err
+	}
+	var phase string
+	var last time.Time
+	opts.Progress = func(p storage.GCProgress) {
+		if p.Phase == "sweep" {
+			status.Sweep = p
+		} else {
+			status.Mark = p
+		}
+		if p.Phase == phase && time.Since(last) < gcProgressInterval {
+			return
+		}
+		phase, last = p.Phase, time.Now()
+		logger.Infof("garbage collection progress: %s", p)
+	}
+	err = storage.MarkAndSweep(ctx, s.driver, s.registry, opts)
+	status.Finished = time.Now()
+	if err != nil {
+		logger.Errorf("error collecting garbage: %v", err)
+		status.Error = err.Error()
+	} else {
+		logger.Infof("collected garbage in %s", status.Finished.Sub(status.Started))
+		status.LastSuccess = status.Finished
+	}
+	s.writeStatus(context.WithoutCancel(ctx), status)
+}
+
+// writeStatus stores the status of a collection, keeping the time of the last
+// successful one if it failed.
+func (s *gcScheduler) writeStatus(ctx context.Context, status storage.GCStatus) {
+	logger := dcontext.GetLogger(ctx)
+	if status.LastSuccess.IsZero() {
+		previous, err := storage.ReadGCStatus(ctx, s.driver)
+		if err != nil {
+			logger.Errorf("error reading the garbage collection status: %v", err)
+		}
+		status.LastSuccess = previous.LastSuccess
+	}
+	if err := storage.WriteGCStatus(ctx, s.driver, status); err != nil {
+		logger.Errorf("error writing the garbage collection status: %v", err)
+	}
+}
+
+// gcStatusResponse is the status of the scheduled garbage collection served
+// by the debug server.
+type gcStatusResponse struct {
+	storage.GCStatus
+	// Next is the time the next collection is scheduled at.
+	Next time.Time `json:"next"`
+	// Unhealthy is the reason the status is unhealthy, if it is.
+	Unhealthy string `json:"unhealthy,omitempty"`
+}
+
+// GCStatusHandler returns the handler serving the status of the last
+// scheduled garbage collection, which may have run on another registry
+// sharing the storage backend, or nil if the garbage is not collected on
+// schedule. The handler responds with 503 Service Unavailable if the last
+// collection failed, or if none succeeded within the staleafter period of
+// the configuration, for monitoring to alert on it.
+func (app *App) GCStatusHandler() http.Handler {
+	if app.gc == nil {
+		return nil
+	}
+	return http.HandlerFunc(app.gc.serveStatus)
+}
+
+func (s *gcScheduler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := storage.ReadGCStatus(r.Context(), s.driver)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := gcStatusResponse{
+		GCStatus:  status,
+		Next:      s.schedule.Next(time.Now()),
+		Unhealthy: s.unhealthy(status, time.Now()),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if response.Unhealthy != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		dcontext.GetLogger(r.Context()).Errorf("error serving the garbage collection status: %v", err)
+	}
+}
+
+// unhealthy returns the reason the status is unhealthy at now, empty if it is
+// healthy.
+func (s *gcScheduler) unhealthy(status storage.GCStatus, now time.Time) string {
+	if status.Error != "" {
+		return "last garbage collection failed"
+	}
+	if s.staleAfter <= 0 {
+		return ""
+	}
+	since := status.LastSuccess
+	if since.IsZero() {
+		since = s.started
+	}
+	if now.Sub(since) > s.staleAfter {
+		return fmt.Sprintf("no garbage collection succeeded within %s", s.staleAfter)
+	}
+	return ""
+}
+
+// garbageDispatcher constructs the handler collecting the garbage of a
+// repository.
+func garbageDispatcher(ctx *Context, r *http.Request) http.Handler {
+	garbageHandler := &garbageHandler{
+		Context: ctx,
+	}
+
+	mhandler := handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(garbageHandler.GetGarbage),
+	}
+	if !ctx.readOnly {
+		mhandler[http.MethodDelete] = http.HandlerFunc(garbageHandler.DeleteGarbage)
+	}
+	return mhandler
+}
+
+// garbageHandler collects the garbage of a repository.
+type garbageHandler struct {
+	*Context
+}
+
+// GetGarbage reports the content of the repository eligible for deletion.
+func (gh *garbageHandler) GetGarbage(w http.ResponseWriter, r *http.Request) {
+	gh.collect(w, r, true)
+}
+
+// DeleteGarbage deletes the content of the repository eligible for deletion
+// and reports it.
+func (gh *garbageHandler) DeleteGarbage(w http.ResponseWriter, r *http.Request) {
+	if !gh.App.deleteEnabled {
+		gh.Errors = append(gh.Errors, errcode.ErrorCodeUnsupported.WithDetail("deletes are not enabled"))
+		return
+	}
+	gh.collect(w, r, false)
+}
+
+func (gh *garbageHandler) collect(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	if gh.App.gcRegistry == nil {
+		gh.Errors = append(gh.Errors, errcode.ErrorCodeUnsupported.WithDetail("garbage collection is not enabled"))
+		return
+	}
+
+	opts := storage.GCOpts{
+		DryRun:         dryRun,
+		RemoveUntagged: r.FormValue("untagged") == "true",
+		Repository:     getName(gh),
+		GracePeriod:    defaultGCGracePeriod,
+		Barrier:        gh.App.gcBarrier,
+		PullStats:      gh.App.pullStats,
+		Report:         &storage.GCReport{},
+	}
+	if gh.App.gc != nil {
+		opts.GracePeriod = gh.App.gc.opts.GracePeriod
+		opts.Concurrency = gh.App.gc.opts.Concurrency
+	}
+
+	if err := storage.MarkAndSweep(gh, gh.App.driver, gh.App.gcRegistry, opts); err != nil {
+		switch {
+		case errors.As(err, &distribution.ErrRepositoryUnknown{}):
+			gh.Errors = append(gh.Errors, errcode.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": opts.Repository}))
+		case errors.Is(err, storage.ErrGCRunning):
+			gh.Errors = append(gh.Errors, errcode.ErrorCodeUnavailable.WithDetail(err))
+		default:
+			gh.Errors = append(gh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := opts.Report.WriteJSON(w); err != nil {
+		gh.Errors = append(gh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
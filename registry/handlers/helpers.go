@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/distribution/distribution/v3/internal/dcontext"
 )
@@ -60,6 +61,18 @@ func copyFullPayload(ctx context.Context, responseWriter http.ResponseWriter, r
 		}
 	}
 
+	if errors.Is(err, errPayloadIdle) {
+		// The client stalled: the request is aborted rather than left
+		// holding the upload until the connection times out. The
+		// connection is not reused, and its pending read is interrupted
+		// where the response writer allows it.
+		responseWriter.Header().Set("Connection", "close")
+		_ = http.NewResponseController(responseWriter).SetReadDeadline(time.Now())
+		responseWriter.WriteHeader(http.StatusRequestTimeout)
+		dcontext.GetLoggerWithField(ctx, "copied", copied).Error("client stalled during " + action)
+		return err
+	}
+
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("unknown error reading request payload: %v", err)
 		return err
@@ -68,6 +81,95 @@ func copyFullPayload(ctx context.Context, responseWriter http.ResponseWriter, r
 	return nil
 }
 
+// errPayloadIdle is returned by an idleTimeoutReader when no data was read
+// within its timeout.
+var errPayloadIdle = errors.New("no data received within the upload idle timeout")
+
+// idleTimeoutReader reads a request body in a goroutine, failing with
+// errPayloadIdle when a read does not complete within the timeout, which the
+// deadlines of the connection cannot enforce through wrapped response
+// writers.
+type idleTimeoutReader struct {
+	timeout time.Duration
+	next    chan struct{}
+	results chan idleTimeoutResult
+	done    chan struct{}
+
+	pending bool
+	buf     []byte
+	err     error
+}
+
+type idleTimeoutResult struct {
+	buf []byte
+	err error
+}
+
+// newIdleTimeoutReader returns an idleTimeoutReader of r, which must be
+// closed to stop its goroutine.
+func newIdleTimeoutReader(r io.Reader, timeout time.Duration) *idleTimeoutReader {
+	ir := &idleTimeoutReader{
+		timeout: timeout,
+		next:    make(chan struct{}),
+		results: make(chan idleTimeoutResult),
+		done:    make(chan struct{}),
+	}
+	go ir.readLoop(r, make([]byte, 32*1024))
+	return ir
+}
+
+// readLoop reads into buf when requested, until r fails or the reader is
+// closed. buf is not read into before its content was consumed.
+func (ir *idleTimeoutReader) readLoop(r io.Reader, buf []byte) {
+	for {
+		select {
+		case <-ir.next:
+		case <-ir.done:
+			return
+		}
+		n, err := r.Read(buf)
+		select {
+		case ir.results <- idleTimeoutResult{buf: buf[:n], err: err}:
+		case <-ir.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	if len(ir.buf) == 0 && ir.err == nil {
+		if !ir.pending {
+			ir.next <- struct{}{}
+			ir.pending = true
+		}
+		timer := time.NewTimer(ir.timeout)
+		select {
+		case res := <-ir.results:
+			ir.pending = false
+			ir.buf, ir.err = res.buf, res.err
+		case <-timer.C:
+			ir.err = errPayloadIdle
+		}
+		timer.Stop()
+	}
+	if len(ir.buf) > 0 {
+		n := copy(p, ir.buf)
+		ir.buf = ir.buf[n:]
+		return n, nil
+	}
+	return 0, ir.err
+}
+
+// Close stops the goroutine of the reader, once its pending read completes.
+// It does not close the body, which would wait for the pending read.
+func (ir *idleTimeoutReader) Close() error {
+	close(ir.done)
+	return nil
+}
+
 func parseContentRange(cr string) (start int64, end int64, err error) {
 	rStart, rEnd, ok := strings.Cut(cr, "-")
 	if !ok {
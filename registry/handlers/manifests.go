@@ -2,17 +2,20 @@ package handlers
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"mime"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
 	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
@@ -28,8 +31,17 @@ const (
 	defaultOS           = "linux"
 	maxManifestBodySize = 4 * 1024 * 1024
 	imageClass          = "image"
+
+	// maxImageConfigSize bounds the size of image configurations read to
+	// lint manifests.
+	maxImageConfigSize = 4 * 1024 * 1024
 )
 
+// maxReproducibleTimestamp is the latest image creation time considered
+// reproducible. Reproducible build tools pin timestamps to the Unix epoch,
+// or to 1980-01-01 for those constrained by the zip format.
+var maxReproducibleTimestamp = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
 type storageType int
 
 const (
@@ -80,6 +92,9 @@ type manifestHandler struct {
 // GetManifest fetches the image manifest from the storage backend, if it exists.
 func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("GetImageManifest")
+	if !imh.tagAuthorized("pull", imh.Tag) {
+		return
+	}
 	manifests, err := imh.Repository.Manifests(imh)
 	if err != nil {
 		imh.Errors = append(imh.Errors, err)
@@ -220,6 +235,8 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	imh.App.recordPull(imh.Repository.Named().Name(), imh.Digest)
+
 	if _, err := w.Write(p); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -237,6 +254,9 @@ func etagMatch(r *http.Request, etag string) bool {
 // PutManifest validates and stores a manifest in the registry.
 func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("PutImageManifest")
+	if !imh.tagAuthorized("push", imh.Tag) {
+		return
+	}
 	manifests, err := imh.Repository.Manifests(imh)
 	if err != nil {
 		imh.Errors = append(imh.Errors, err)
@@ -288,6 +308,17 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	lintProblems := imh.lintManifest(manifest)
+	if len(lintProblems) > 0 {
+		rejected := imh.App.Config.Validation.Manifests.Lint.Policy == "reject"
+		imh.linted(r, desc, lintProblems, rejected)
+		if rejected {
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(lintProblems))
+			return
+		}
+		dcontext.GetLogger(imh).Warnf("manifest %s failed lint checks: %s", desc.Digest, strings.Join(lintProblems, "; "))
+	}
+
 	_, err = manifests.Put(imh, manifest, options...)
 	if err != nil {
 		// TODO(stevvooe): These error handling switches really need to be
@@ -320,6 +351,9 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 			}
 		case errcode.Error:
 			imh.Errors = append(imh.Errors, err)
+		case errcode.Errors:
+			// the errors of the remote registry of a push through cache
+			imh.Errors = append(imh.Errors, err...)
 		default:
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		}
@@ -337,6 +371,13 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 
 	}
 
+	if imh.App.converter != nil {
+		switch manifest.(type) {
+		case *ocischema.DeserializedManifest, *schema2.DeserializedManifest:
+			imh.App.converter.enqueue(imh, imh.Repository.Named().Name(), imh.Digest)
+		}
+	}
+
 	// Construct a canonical url for the uploaded manifest.
 	ref, err := reference.WithDigest(imh.Repository.Named(), imh.Digest)
 	if err != nil {
@@ -354,11 +395,27 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 
 	w.Header().Set("Location", location)
 	w.Header().Set("Docker-Content-Digest", imh.Digest.String())
+	for _, problem := range lintProblems {
+		// warnings as specified by the OCI distribution specification
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", problem))
+	}
 	w.WriteHeader(http.StatusCreated)
 
 	dcontext.GetLogger(imh).Debug("Succeeded in putting manifest!")
 }
 
+// tagAuthorized checks that the granted access allows the action on the tag,
+// if any. Tokens may restrict actions to some tags: a token only allowed to
+// push release tags may still push manifests by digest, such as the
+// manifests of an index.
+func (imh *manifestHandler) tagAuthorized(action, tag string) bool {
+	if tag == "" || tagAllowed(imh, imh.Repository.Named().Name(), action, tag) {
+		return true
+	}
+	imh.Errors = append(imh.Errors, errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf("%s of tag %q not authorized", action, tag)))
+	return false
+}
+
 // applyResourcePolicy checks whether the resource class matches what has
 // been authorized and allowed by the policy configuration.
 func (imh *manifestHandler) applyResourcePolicy(manifest distribution.Manifest) error {
@@ -427,9 +484,117 @@ func (imh *manifestHandler) applyResourcePolicy(manifest distribution.Manifest)
 	return nil
 }
 
+// lintManifest checks the manifest against the lint rules configured under
+// validation.manifests.lint and returns the problems found.
+func (imh *manifestHandler) lintManifest(manifest distribution.Manifest) []string {
+	if !imh.App.Config.Validation.Enabled {
+		return nil
+	}
+	config := imh.App.Config.Validation.Manifests.Lint
+
+	var (
+		annotations map[string]string
+		imageConfig *v1.Descriptor
+		layers      []v1.Descriptor
+	)
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		annotations, imageConfig, layers = m.Annotations, &m.Config, m.Layers
+	case *schema2.DeserializedManifest:
+		imageConfig, layers = &m.Config, m.Layers
+	case *ocischema.DeserializedImageIndex:
+		annotations = m.Annotations
+	}
+
+	var problems []string
+	for _, annotation := range config.RequiredAnnotations {
+		if annotations[annotation] == "" {
+			problems = append(problems, fmt.Sprintf("missing required annotation %s", annotation))
+		}
+	}
+
+	if config.MaxLayers > 0 && len(layers) > config.MaxLayers {
+		problems = append(problems, fmt.Sprintf("image has %d layers, more than the maximum of %d", len(layers), config.MaxLayers))
+	}
+
+	if config.CompressedLayers {
+		for _, layer := range layers {
+			switch layer.MediaType {
+			case v1.MediaTypeImageLayer, schema2.MediaTypeUncompressedLayer:
+				problems = append(problems, fmt.Sprintf("layer %s is not compressed", layer.Digest))
+			}
+		}
+	}
+
+	if config.ReproducibleTimestamps && imageConfig != nil &&
+		(imageConfig.MediaType == v1.MediaTypeImageConfig || imageConfig.MediaType == schema2.MediaTypeImageConfig) {
+		if created, err := imh.imageCreated(*imageConfig); err != nil {
+			// missing configurations are reported by the manifest
+			// verification
+			dcontext.GetLogger(imh).Debugf("unable to read image configuration %s: %v", imageConfig.Digest, err)
+		} else if created.After(maxReproducibleTimestamp) {
+			problems = append(problems, fmt.Sprintf("image creation time %s is not reproducible", created.Format(time.RFC3339)))
+		}
+	}
+
+	return problems
+}
+
+// linted records the lint problems of the manifest described by desc in
+// the notification events.
+func (imh *manifestHandler) linted(r *http.Request, desc v1.Descriptor, problems []string, rejected bool) {
+	if imh.App.events.sink == nil {
+		return
+	}
+
+	event := notifications.NewLintEvent(
+		imh.App.events.source,
+		notifications.ActorRecord{Name: getUserName(imh, r)},
+		notifications.NewRequestRecord(dcontext.GetRequestID(imh), r),
+		imh.Repository.Named().Name(),
+		imh.Tag,
+		desc,
+		notifications.LintRecord{Problems: problems, Rejected: rejected},
+	)
+	if err := imh.App.events.sink.Write(*event); err != nil {
+		dcontext.GetLogger(imh).Errorf("error writing lint event: %v", err)
+	}
+}
+
+// imageCreated returns the latest creation time recorded in an image
+// configuration or its history.
+func (imh *manifestHandler) imageCreated(desc v1.Descriptor) (time.Time, error) {
+	if desc.Size > maxImageConfigSize {
+		return time.Time{}, fmt.Errorf("image configuration of %d bytes is too large", desc.Size)
+	}
+	content, err := imh.Repository.Blobs(imh).Get(imh, desc.Digest)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var image v1.Image
+	if err := json.Unmarshal(content, &image); err != nil {
+		return time.Time{}, err
+	}
+
+	var created time.Time
+	if image.Created != nil {
+		created = *image.Created
+	}
+	for _, h := range image.History {
+		if h.Created != nil && h.Created.After(created) {
+			created = *h.Created
+		}
+	}
+	return created, nil
+}
+
 // DeleteManifest removes the manifest with the given digest or the tag with the given name from the registry.
 func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("DeleteImageManifest")
+	if !imh.tagAuthorized("delete", imh.Tag) {
+		return
+	}
 
 	if imh.App.isCache {
 		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnsupported)
@@ -452,6 +617,20 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// deleting a manifest untags it, which the granted access must allow
+	// for each of its tags
+	tagService := imh.Repository.Tags(imh)
+	referencedTags, err := tagService.Lookup(imh, v1.Descriptor{Digest: imh.Digest})
+	if err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+	for _, tag := range referencedTags {
+		if !imh.tagAuthorized("delete", tag) {
+			return
+		}
+	}
+
 	manifests, err := imh.Repository.Manifests(imh)
 	if err != nil {
 		imh.Errors = append(imh.Errors, err)
@@ -477,13 +656,6 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	tagService := imh.Repository.Tags(imh)
-	referencedTags, err := tagService.Lookup(imh, v1.Descriptor{Digest: imh.Digest})
-	if err != nil {
-		imh.Errors = append(imh.Errors, err)
-		return
-	}
-
 	var (
 		errs []error
 		mu   sync.Mutex
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// mountHintsLimit bounds the number of repositories hinted.
+	mountHintsLimit = 10
+
+	// mountHintsLookupLimit bounds the number of repositories looked up in
+	// the cache, before keeping those of the namespace of the upload.
+	mountHintsLookupLimit = 100
+)
+
+// configureMountHints enables the hints of the repositories blobs can be
+// mounted from, if configured and supported by the descriptor cache.
+func (app *App) configureMountHints(config configuration.Parameters, provider cache.BlobDescriptorCacheProvider) {
+	v, ok := config["mounthints"]
+	if !ok {
+		return
+	}
+	enabled, ok := v.(bool)
+	if !ok {
+		panic(fmt.Sprintf("invalid type for cache mounthints config: %#v", v))
+	}
+	if !enabled {
+		return
+	}
+	lister, ok := provider.(cache.BlobRepositoryLister)
+	if !ok {
+		dcontext.GetLogger(app).Warnf("the blob descriptor cache does not support mount hints")
+		return
+	}
+	app.mountHints = lister
+}
+
+// namespace returns the first component of a repository name.
+func namespace(name string) string {
+	ns, _, _ := strings.Cut(name, "/")
+	return ns
+}
+
+// writeMountHints sets the Docker-Mount-Candidates header of the response to
+// the upload of the blob dgst to the repositories of the same namespace the
+// blob is cached for, so that clients can mount it from one of them instead
+// of uploading it. The blob is looked up in the descriptor cache only, which
+// may be out of date: clients must still handle mounts which fail.
+func (buh *blobUploadHandler) writeMountHints(w http.ResponseWriter, dgst digest.Digest) {
+	name := buh.Repository.Named().Name()
+	repositories, err := buh.App.mountHints.Repositories(buh, dgst, mountHintsLookupLimit)
+	if err != nil {
+		dcontext.GetLogger(buh).Warnf("error looking up the repositories of %s: %v", dgst, err)
+		return
+	}
+
+	var candidates []string
+	for _, repository := range repositories {
+		if repository != name && namespace(repository) == namespace(name) {
+			candidates = append(candidates, repository)
+		}
+		if len(candidates) == mountHintsLimit {
+			break
+		}
+	}
+	if len(candidates) > 0 {
+		w.Header().Set("Docker-Mount-Candidates", strings.Join(candidates, ", "))
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/auth"
+	registrymiddleware "github.com/distribution/distribution/v3/registry/middleware/registry"
+	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+)
+
+// An AppOption customizes the app built by NewApp with Go values, in place
+// of the storage drivers, access controllers and middlewares registered
+// globally and named by the configuration.
+type AppOption func(*appOptions)
+
+type appOptions struct {
+	driver               storagedriver.StorageDriver
+	accessController     auth.AccessController
+	registryMiddleware   []func(context.Context, distribution.Namespace, storagedriver.StorageDriver) (distribution.Namespace, error)
+	repositoryMiddleware []func(context.Context, distribution.Repository) (distribution.Repository, error)
+	storageMiddleware    []func(context.Context, storagedriver.StorageDriver) (storagedriver.StorageDriver, error)
+}
+
+// WithStorageDriver makes the app store its content in driver, in place of
+// the storage driver of the configuration, whose parameters are ignored.
+func WithStorageDriver(driver storagedriver.StorageDriver) AppOption {
+	return func(o *appOptions) {
+		o.driver = driver
+	}
+}
+
+// WithAccessController makes the app authorize requests with ac, in place
+// of the access controller of the configuration.
+func WithAccessController(ac auth.AccessController) AppOption {
+	return func(o *appOptions) {
+		o.accessController = ac
+	}
+}
+
+// WithRegistryMiddleware applies a registry middleware, initialized with
+// options, after those of the configuration.
+func WithRegistryMiddleware(initFunc registrymiddleware.InitFunc, options map[string]interface{}) AppOption {
+	return func(o *appOptions) {
+		o.registryMiddleware = append(o.registryMiddleware, func(ctx context.Context, registry distribution.Namespace, driver storagedriver.StorageDriver) (distribution.Namespace, error) {
+			return initFunc(ctx, registry, driver, options)
+		})
+	}
+}
+
+// WithRepositoryMiddleware applies a repository middleware, initialized
+// with options, after those of the configuration.
+func WithRepositoryMiddleware(initFunc repositorymiddleware.InitFunc, options map[string]interface{}) AppOption {
+	return func(o *appOptions) {
+		o.repositoryMiddleware = append(o.repositoryMiddleware, func(ctx context.Context, repository distribution.Repository) (distribution.Repository, error) {
+			return initFunc(ctx, repository, options)
+		})
+	}
+}
+
+// WithStorageMiddleware applies a storage driver middleware, initialized
+// with options, after those of the configuration.
+func WithStorageMiddleware(initFunc storagemiddleware.InitFunc, options map[string]interface{}) AppOption {
+	return func(o *appOptions) {
+		o.storageMiddleware = append(o.storageMiddleware, func(ctx context.Context, driver storagedriver.StorageDriver) (storagedriver.StorageDriver, error) {
+			return initFunc(ctx, driver, options)
+		})
+	}
+}
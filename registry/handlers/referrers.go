@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/proxy"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// referrersDispatcher constructs the handler listing the referrers of a
+// manifest, registered for pull through caches only.
+func referrersDispatcher(ctx *Context, r *http.Request) http.Handler {
+	dgst, err := getDigest(ctx)
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeDigestInvalid.WithDetail(err))
+		})
+	}
+
+	referrersHandler := &referrersHandler{
+		Context: ctx,
+		Digest:  dgst,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(referrersHandler.GetReferrers),
+	}
+}
+
+// referrersHandler lists the referrers of a manifest.
+type referrersHandler struct {
+	*Context
+
+	Digest digest.Digest
+}
+
+// GetReferrers returns an image index listing the referrers of the manifest,
+// filtered by the artifactType parameter, if any.
+func (rh *referrersHandler) GetReferrers(w http.ResponseWriter, r *http.Request) {
+	lister, ok := rh.App.registry.(proxy.ReferrersLister)
+	if !ok {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported.WithDetail("referrers are listed by pull through caches only"))
+		return
+	}
+
+	referrers, err := lister.Referrers(rh, rh.Repository.Named(), rh.Digest)
+	if err != nil {
+		switch err := err.(type) {
+		case distribution.ErrRepositoryUnknown:
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": rh.Repository.Named().Name()}))
+		case errcode.Error:
+			rh.Errors = append(rh.Errors, err)
+		case errcode.Errors:
+			rh.Errors = append(rh.Errors, err...)
+		default:
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: make([]v1.Descriptor, 0, len(referrers)),
+	}
+	artifactType := r.URL.Query().Get("artifactType")
+	for _, referrer := range referrers {
+		if artifactType == "" || referrer.ArtifactType == artifactType {
+			index.Manifests = append(index.Manifests, referrer)
+		}
+	}
+
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	if err := json.NewEncoder(w).Encode(index); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
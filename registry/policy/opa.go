@@ -0,0 +1,99 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultOPATimeout = 5 * time.Second
+
+	// maxOPAResponseSize bounds the size of a decision read from OPA.
+	maxOPAResponseSize = 1 << 20
+)
+
+// OPA evaluates a Rego policy hosted by an Open Policy Agent server, through
+// its data API. Rego policies are not evaluated in process: the registry does
+// not embed a Rego interpreter.
+//
+// The policy decision at URL must either be a boolean, or an object with a
+// boolean "allow" field and an optional "reason" string. An undefined
+// decision denies the request.
+type OPA struct {
+	url    string
+	client *http.Client
+}
+
+var _ Authorizer = &OPA{}
+
+// NewOPA returns an Authorizer querying the OPA data API at url, for
+// instance http://localhost:8181/v1/data/registry/authz. A zero timeout
+// selects the default.
+func NewOPA(url string, timeout time.Duration) *OPA {
+	if timeout <= 0 {
+		timeout = defaultOPATimeout
+	}
+	return &OPA{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Authorize implements Authorizer.
+func (o *OPA) Authorize(ctx context.Context, input Input) (Decision, error) {
+	body, err := json.Marshal(struct {
+		Input Input `json:"input"`
+	}{input})
+	if err != nil {
+		return Decision{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("opa: unexpected status %s", resp.Status)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxOPAResponseSize))
+	if err != nil {
+		return Decision{}, err
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(content, &result); err != nil {
+		return Decision{}, fmt.Errorf("opa: invalid response: %v", err)
+	}
+	if len(result.Result) == 0 {
+		return Decision{Reason: "policy decision is undefined"}, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(result.Result, &allow); err == nil {
+		return Decision{Allow: allow}, nil
+	}
+	var decision struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(result.Result, &decision); err != nil {
+		return Decision{}, fmt.Errorf("opa: policy decision must be a boolean or an object: %s", result.Result)
+	}
+	return Decision{Allow: decision.Allow, Reason: decision.Reason}, nil
+}
@@ -0,0 +1,60 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOPA(t *testing.T) {
+	var response string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input Input `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("unexpected error decoding input: %v", err)
+		}
+		if body.Input.Repository != "prod/app" || len(body.Input.Access) != 1 || body.Input.Access[0].Action != "push" {
+			t.Errorf("unexpected input: %+v", body.Input)
+		}
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	opa := NewOPA(server.URL+"/v1/data/registry/authz", 0)
+	input := Input{
+		User:       "alice",
+		Repository: "prod/app",
+		Access:     []Access{{Type: "repository", Name: "prod/app", Action: "push"}},
+	}
+
+	for _, tc := range []struct {
+		response string
+		expected Decision
+		err      bool
+	}{
+		{response: `{"result": true}`, expected: Decision{Allow: true}},
+		{response: `{"result": false}`, expected: Decision{}},
+		{response: `{"result": {"allow": false, "reason": "team-x only"}}`, expected: Decision{Reason: "team-x only"}},
+		{response: `{}`, expected: Decision{Reason: "policy decision is undefined"}},
+		{response: `{"result": "yes"}`, err: true},
+	} {
+		response = tc.response
+		decision, err := opa.Authorize(context.Background(), input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected error for response %s", tc.response)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for response %s: %v", tc.response, err)
+		}
+		if decision != tc.expected {
+			t.Errorf("unexpected decision for response %s: %+v", tc.response, decision)
+		}
+	}
+}
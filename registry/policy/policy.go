@@ -0,0 +1,80 @@
+// Package policy provides authorization hooks which evaluate operator defined
+// policies against registry requests, after the access controller has
+// authenticated them.
+package policy
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/distribution/distribution/v3/internal/requestutil"
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+// Input describes a request submitted to a policy.
+type Input struct {
+	// User is the name of the authenticated user, empty for anonymous
+	// requests.
+	User string `json:"user"`
+
+	// Method and Path are those of the HTTP request.
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	// RemoteAddr is the IP address of the client, as forwarded by the
+	// trusted proxies.
+	RemoteAddr string `json:"remoteaddr"`
+
+	// MediaType is the media type of the request body, such as the type of
+	// a pushed manifest.
+	MediaType string `json:"mediatype,omitempty"`
+
+	// Repository is the name of the repository the request targets, if any.
+	Repository string `json:"repository,omitempty"`
+
+	// Access lists the access requested.
+	Access []Access `json:"access"`
+}
+
+// Access is a requested action on a resource.
+type Access struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+// NewInput builds the policy input describing a request. The client IP is
+// only read from the X-Forwarded-For and X-Real-IP headers of the trusted
+// proxies.
+func NewInput(r *http.Request, trustedProxies []*net.IPNet, user, repository string, access []auth.Access) Input {
+	input := Input{
+		User:       user,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: requestutil.TrustedRemoteIP(r, trustedProxies),
+		MediaType:  r.Header.Get("Content-Type"),
+		Repository: repository,
+		Access:     make([]Access, 0, len(access)),
+	}
+	for _, a := range access {
+		input.Access = append(input.Access, Access{Type: a.Type, Name: a.Name, Action: a.Action})
+	}
+	return input
+}
+
+// Decision is the outcome of a policy evaluation.
+type Decision struct {
+	// Allow is whether the request may proceed.
+	Allow bool
+
+	// Reason optionally explains the decision.
+	Reason string
+}
+
+// Authorizer evaluates a policy against requests.
+type Authorizer interface {
+	// Authorize evaluates the policy against the input. An error is
+	// returned if the policy could not be evaluated.
+	Authorize(ctx context.Context, input Input) (Decision, error)
+}
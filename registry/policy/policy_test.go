@@ -0,0 +1,36 @@
+package policy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+func TestNewInput(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	access := []auth.Access{{Resource: auth.Resource{Type: "repository", Name: "prod/app"}, Action: "push"}}
+
+	for _, tc := range []struct {
+		peer     string
+		expected string
+	}{
+		// clients may not forge their address
+		{peer: "192.168.0.1:1234", expected: "192.168.0.1"},
+		// trusted proxies forward it
+		{peer: "10.0.0.1:1234", expected: "172.16.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/v2/prod/app/manifests/latest", nil)
+		r.RemoteAddr = tc.peer
+		r.Header.Set("X-Forwarded-For", "172.16.0.1")
+		input := NewInput(r, []*net.IPNet{trusted}, "alice", "prod/app", access)
+		if input.RemoteAddr != tc.expected {
+			t.Errorf("%s: unexpected remote address %q, expected %q", tc.peer, input.RemoteAddr, tc.expected)
+		}
+		if input.User != "alice" || input.Method != http.MethodPut || len(input.Access) != 1 || input.Access[0].Action != "push" {
+			t.Errorf("unexpected input: %+v", input)
+		}
+	}
+}
@@ -43,6 +43,21 @@ func (c credentials) RefreshToken(u *url.URL, service string) string {
 func (c credentials) SetRefreshToken(u *url.URL, service, token string) {
 }
 
+// forwardedAuthorization forwards the Authorization header of a client to
+// the remote registry. It is not sent to other hosts, such as the storage
+// backends blob downloads are redirected to.
+type forwardedAuthorization struct {
+	host          string
+	authorization string
+}
+
+func (f forwardedAuthorization) ModifyRequest(req *http.Request) error {
+	if req.URL.Host == f.host {
+		req.Header.Set("Authorization", f.authorization)
+	}
+	return nil
+}
+
 // configureAuth stores credentials for challenge responses
 func configureAuth(username, password, remoteURL string) (auth.CredentialStore, auth.CredentialStore, error) {
 	creds := map[string]userpass{}
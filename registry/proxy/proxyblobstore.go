@@ -22,8 +22,14 @@ type proxyBlobStore struct {
 	remoteStore    distribution.BlobService
 	scheduler      *scheduler.TTLExpirationScheduler
 	ttl            *time.Duration
+	evictor        *scheduler.LRUEvictor
 	repositoryName reference.Named
 	authChallenger authChallenger
+	// remote labels the metrics of the remote registry
+	remote string
+
+	// pushThrough accepts pushes, if enabled
+	pushThrough *pushThrough
 }
 
 var _ distribution.BlobStore = &proxyBlobStore{}
@@ -61,8 +67,8 @@ func (pbs *proxyBlobStore) copyContent(ctx context.Context, dgst digest.Digest,
 		return v1.Descriptor{}, err
 	}
 
-	proxyMetrics.BlobPull(uint64(desc.Size))
-	proxyMetrics.BlobPush(uint64(desc.Size), false)
+	proxyMetrics.BlobPull(pbs.remote, uint64(desc.Size))
+	proxyMetrics.BlobPush(pbs.remote, uint64(desc.Size), false)
 
 	return desc, nil
 }
@@ -75,7 +81,19 @@ func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter
 		return false, nil
 	}
 
-	proxyMetrics.BlobPush(uint64(localDesc.Size), true)
+	stale, err := pbs.revalidate(ctx, localDesc)
+	if err != nil {
+		return false, err
+	}
+	if stale {
+		w.Header().Set("Warning", staleWarning)
+		proxyMetrics.BlobStale(pbs.remote)
+	}
+
+	proxyMetrics.BlobPush(pbs.remote, uint64(localDesc.Size), true)
+	if pbs.evictor != nil {
+		pbs.evictor.Touch(dgst)
+	}
 	return true, pbs.localStore.ServeBlob(ctx, w, r, dgst)
 }
 
@@ -137,12 +155,23 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 		return err
 	}
 
+	return pbs.schedule(ctx, blobRef, desc.Size)
+}
+
+// schedule schedules the expiry and eviction of a blob cached.
+func (pbs *proxyBlobStore) schedule(ctx context.Context, blobRef reference.Canonical, size int64) error {
 	if pbs.scheduler != nil && pbs.ttl != nil {
 		if err := pbs.scheduler.AddBlob(blobRef, *pbs.ttl); err != nil {
 			dcontext.GetLogger(ctx).Errorf("Error adding blob: %s", err)
 			return err
 		}
 	}
+	if pbs.evictor != nil {
+		if err := pbs.evictor.AddBlob(blobRef, size); err != nil {
+			dcontext.GetLogger(ctx).Errorf("Error adding blob: %s", err)
+			return err
+		}
+	}
 
 	return nil
 }
@@ -186,19 +215,44 @@ func (pbs *proxyBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte,
 	return blob, nil
 }
 
-// Unsupported functions
+// Put, Create and Resume write to the cache the blobs pushed through, which
+// are forwarded to the remote registry once committed
 func (pbs *proxyBlobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.Descriptor, error) {
-	return v1.Descriptor{}, distribution.ErrUnsupported
+	if pbs.pushThrough == nil {
+		return v1.Descriptor{}, distribution.ErrUnsupported
+	}
+	desc, err := pbs.localStore.Put(ctx, mediaType, p)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return desc, pbs.forward(ctx, desc)
 }
 
+// Create ignores the requests to mount a blob from another repository,
+// which the remote registry may not hold, so that clients upload it.
 func (pbs *proxyBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
-	return nil, distribution.ErrUnsupported
+	if pbs.pushThrough == nil {
+		return nil, distribution.ErrUnsupported
+	}
+	bw, err := pbs.localStore.Create(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pushThroughBlobWriter{BlobWriter: bw, pbs: pbs}, nil
 }
 
 func (pbs *proxyBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
-	return nil, distribution.ErrUnsupported
+	if pbs.pushThrough == nil {
+		return nil, distribution.ErrUnsupported
+	}
+	bw, err := pbs.localStore.Resume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &pushThroughBlobWriter{BlobWriter: bw, pbs: pbs}, nil
 }
 
+// Unsupported functions
 func (pbs *proxyBlobStore) Mount(ctx context.Context, sourceRepo reference.Named, dgst digest.Digest) (v1.Descriptor, error) {
 	return v1.Descriptor{}, distribution.ErrUnsupported
 }
@@ -2,10 +2,12 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"sync"
 	"testing"
 	"time"
@@ -267,6 +269,34 @@ func TestProxyStoreGetWithoutScheduler(t *testing.T) {
 	}
 }
 
+func TestProxyStoreServeEvictor(t *testing.T) {
+	te := makeTestEnv(t, "foo/bar")
+	evictor := scheduler.NewLRU(te.ctx, inmemory.New(), "/lru-state.json", 1<<20)
+	if err := evictor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer evictor.Stop()
+	te.store.evictor = evictor
+
+	populate(t, te, 2, 10, 2)
+	for i := 0; i < 2; i++ {
+		for _, desc := range te.inRemote {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest(http.MethodGet, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := te.store.ServeBlob(te.ctx, w, r, desc.Digest); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if size := evictor.Size(); size != 20 {
+		t.Errorf("expected the blobs pulled through to be tracked once, got %d bytes", size)
+	}
+}
+
 func TestProxyStoreStat(t *testing.T) {
 	te := makeTestEnv(t, "foo/bar")
 
@@ -532,3 +562,80 @@ func testProxyStoreServe(t *testing.T, te *testEnv, numClients int) {
 		t.Fatalf("unexpected remote stats: %#v", remoteStats)
 	}
 }
+
+// unreachableBlobStore fails to reach the remote registry.
+type unreachableBlobStore struct {
+	distribution.BlobService
+}
+
+func (ubs unreachableBlobStore) Stat(ctx context.Context, dgst digest.Digest) (v1.Descriptor, error) {
+	return v1.Descriptor{}, &url.Error{Op: http.MethodHead, URL: "https://registry.invalid", Err: errors.New("connection refused")}
+}
+
+func TestProxyStoreServeStale(t *testing.T) {
+	proxyMetrics = &proxyMetricsCollector{}
+	te := makeTestEnv(t, "foo/bar")
+	s := te.store.scheduler
+	s.ServeStale(0)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	ttl := time.Millisecond
+	te.store.ttl = &ttl
+
+	populate(t, te, 1, 10, 1)
+	dgst := te.inRemote[0].Digest
+	blobRef, err := reference.WithDigest(te.store.repositoryName, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func() *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodGet, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := te.store.ServeBlob(te.ctx, w, r, dgst); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	serve()
+	for i := 0; !s.Stale(blobRef); i++ {
+		if i == 100 {
+			t.Fatal("timed out waiting for the blob to be stale")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the remote registry is unreachable, the blob is served stale
+	remoteStore := te.store.remoteStore
+	te.store.remoteStore = unreachableBlobStore{remoteStore}
+	w := serve()
+	if warning := w.Header().Get("Warning"); warning != staleWarning {
+		t.Errorf("unexpected Warning header %q", warning)
+	}
+	if !s.Stale(blobRef) {
+		t.Error("expected the blob to stay stale")
+	}
+	if proxyMetrics.blobMetrics.Stale != 1 {
+		t.Errorf("Expected blobMetrics.Stale %d but got %d", 1, proxyMetrics.blobMetrics.Stale)
+	}
+
+	// the remote registry is reachable again, the blob is revalidated
+	te.store.remoteStore = remoteStore
+	te.store.ttl = &repositoryTTL
+	w = serve()
+	if warning := w.Header().Get("Warning"); warning != "" {
+		t.Errorf("unexpected Warning header %q", warning)
+	}
+	if s.Stale(blobRef) {
+		t.Error("expected the revalidated blob not to be stale")
+	}
+	if (*te.RemoteStats())["open"] != 1 {
+		t.Error("expected the revalidated blob to be served from the cache")
+	}
+}
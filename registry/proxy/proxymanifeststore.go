@@ -19,7 +19,18 @@ type proxyManifestStore struct {
 	repositoryName  reference.Named
 	scheduler       *scheduler.TTLExpirationScheduler
 	ttl             *time.Duration
+	evictor         *scheduler.LRUEvictor
 	authChallenger  authChallenger
+	// remote labels the metrics of the remote registry
+	remote string
+
+	// pushThrough accepts pushes, if enabled
+	pushThrough *pushThrough
+
+	// authorizeRemote checks that the client may pull the manifests served
+	// from the cache from the remote registry, the credentials of the
+	// client being forwarded to it.
+	authorizeRemote bool
 }
 
 var _ distribution.ManifestService = &proxyManifestStore{}
@@ -29,7 +40,7 @@ func (pms proxyManifestStore) Exists(ctx context.Context, dgst digest.Digest) (b
 	if err != nil {
 		return false, err
 	}
-	if exists {
+	if exists && !pms.authorizeRemote {
 		return true, nil
 	}
 	if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
@@ -60,27 +71,38 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 		return nil, err
 	}
 
-	proxyMetrics.ManifestPush(uint64(len(payload)), !fromRemote)
-	if fromRemote {
-		proxyMetrics.ManifestPull(uint64(len(payload)))
-
-		_, err = pms.localManifests.Put(ctx, manifest)
+	if !fromRemote && pms.authorizeRemote {
+		if err := pms.authorize(ctx, dgst); err != nil {
+			return nil, err
+		}
+	}
+	if !fromRemote {
+		stale, err := pms.revalidate(ctx, dgst, int64(len(payload)))
 		if err != nil {
 			return nil, err
 		}
+		if stale {
+			if w, err := dcontext.GetResponseWriter(ctx); err == nil {
+				w.Header().Set("Warning", staleWarning)
+			}
+			proxyMetrics.ManifestStale(pms.remote)
+		}
+	}
 
-		// Schedule the manifest blob for removal
-		repoBlob, err := reference.WithDigest(pms.repositoryName, dgst)
+	proxyMetrics.ManifestPush(pms.remote, uint64(len(payload)), !fromRemote)
+	if !fromRemote && pms.evictor != nil {
+		pms.evictor.Touch(dgst)
+	}
+	if fromRemote {
+		proxyMetrics.ManifestPull(pms.remote, uint64(len(payload)))
+
+		_, err = pms.localManifests.Put(ctx, manifest)
 		if err != nil {
-			dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
 			return nil, err
 		}
 
-		if pms.scheduler != nil && pms.ttl != nil {
-			if err := pms.scheduler.AddManifest(repoBlob, *pms.ttl); err != nil {
-				dcontext.GetLogger(ctx).Errorf("Error adding manifest: %s", err)
-				return nil, err
-			}
+		if err := pms.schedule(ctx, dgst, int64(len(payload))); err != nil {
+			return nil, err
 		}
 
 		// Ensure the manifest blob is cleaned up
@@ -91,9 +113,78 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 	return manifest, err
 }
 
+// authorize checks that the remote registry has the manifest served from the
+// cache for the client, whose credentials are forwarded to it, so that the
+// content cached for a user is not served to users the remote registry does
+// not authorize to pull it.
+func (pms proxyManifestStore) authorize(ctx context.Context, dgst digest.Digest) error {
+	if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return err
+	}
+	exists, err := pms.remoteManifests.Exists(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return distribution.ErrManifestUnknownRevision{Name: pms.repositoryName.Name(), Revision: dgst}
+	}
+	return nil
+}
+
+// schedule schedules the expiry and eviction of a manifest cached.
+func (pms proxyManifestStore) schedule(ctx context.Context, dgst digest.Digest, size int64) error {
+	repoBlob, err := reference.WithDigest(pms.repositoryName, dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+		return err
+	}
+
+	if pms.scheduler != nil && pms.ttl != nil {
+		if err := pms.scheduler.AddManifest(repoBlob, *pms.ttl); err != nil {
+			dcontext.GetLogger(ctx).Errorf("Error adding manifest: %s", err)
+			return err
+		}
+	}
+	if pms.evictor != nil {
+		if err := pms.evictor.AddManifest(repoBlob, size); err != nil {
+			dcontext.GetLogger(ctx).Errorf("Error adding manifest: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Put forwards a manifest pushed through to the remote registry, then caches
+// it if configured.
 func (pms proxyManifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
-	var d digest.Digest
-	return d, distribution.ErrUnsupported
+	if pms.pushThrough == nil {
+		var d digest.Digest
+		return d, distribution.ErrUnsupported
+	}
+	if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return "", err
+	}
+	dgst, err := pms.remoteManifests.Put(ctx, manifest, options...)
+	if err != nil {
+		return "", err
+	}
+	if !pms.pushThrough.cache {
+		return dgst, nil
+	}
+
+	// the manifest was forwarded, failing to cache it is not an error
+	if _, err := pms.localManifests.Put(ctx, manifest, options...); err != nil {
+		dcontext.GetLogger(ctx).Warnf("error caching the manifest %s pushed through: %v", dgst, err)
+		return dgst, nil
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return "", err
+	}
+	if err := pms.schedule(ctx, dgst, int64(len(payload))); err != nil {
+		return "", err
+	}
+	return dgst, nil
 }
 
 func (pms proxyManifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
@@ -3,13 +3,20 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/internal/client/auth"
 	"github.com/distribution/distribution/v3/internal/client/auth/challenge"
+	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
@@ -341,3 +348,114 @@ func TestProxyManifestsMetrics(t *testing.T) {
 		t.Errorf("Expected manifestMetrics.BytesPushed %d but got %d", env.manifestSize*2, proxyMetrics.manifestMetrics.BytesPushed)
 	}
 }
+
+// unreachableManifests fails to reach the remote registry.
+type unreachableManifests struct {
+	distribution.ManifestService
+}
+
+func (um unreachableManifests) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	return false, &url.Error{Op: http.MethodHead, URL: "https://registry.invalid", Err: errors.New("connection refused")}
+}
+
+func TestProxyManifestsServeStale(t *testing.T) {
+	proxyMetrics = &proxyMetricsCollector{}
+	env := newManifestStoreTestEnv(t, "foo/bar", "latest")
+	s := env.manifests.scheduler
+	s.ServeStale(0)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	ttl := time.Millisecond
+	env.manifests.ttl = &ttl
+
+	manifestRef, err := reference.WithDigest(env.manifests.repositoryName, env.manifestDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ctx, _ := dcontext.WithResponseWriter(context.Background(), w)
+		if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	get()
+	for i := 0; !s.Stale(manifestRef); i++ {
+		if i == 100 {
+			t.Fatal("timed out waiting for the manifest to be stale")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the remote registry is unreachable, the manifest is served stale
+	remoteManifests := env.manifests.remoteManifests
+	env.manifests.remoteManifests = unreachableManifests{remoteManifests}
+	w := get()
+	if warning := w.Header().Get("Warning"); warning != staleWarning {
+		t.Errorf("unexpected Warning header %q", warning)
+	}
+	if proxyMetrics.manifestMetrics.Stale != 1 {
+		t.Errorf("Expected manifestMetrics.Stale %d but got %d", 1, proxyMetrics.manifestMetrics.Stale)
+	}
+
+	// the remote registry is reachable again, the manifest is revalidated
+	env.manifests.remoteManifests = remoteManifests
+	env.manifests.ttl = &repositoryTTL
+	w = get()
+	if warning := w.Header().Get("Warning"); warning != "" {
+		t.Errorf("unexpected Warning header %q", warning)
+	}
+	if s.Stale(manifestRef) {
+		t.Error("expected the revalidated manifest not to be stale")
+	}
+	if (*env.RemoteStats())["get"] != 1 {
+		t.Error("expected the revalidated manifest to be served from the cache")
+	}
+}
+
+// deniedManifests is the remote registry of a client it does not authorize
+// to pull the manifests.
+type deniedManifests struct {
+	distribution.ManifestService
+}
+
+func (dm deniedManifests) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	return false, errcode.ErrorCodeDenied
+}
+
+func TestProxyManifestsAuthorizeRemote(t *testing.T) {
+	env := newManifestStoreTestEnv(t, "foo/bar", "latest")
+	env.manifests.authorizeRemote = true
+
+	ctx := context.Background()
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if (*env.RemoteStats())["get"] != 1 || (*env.RemoteStats())["exists"] != 1 {
+		t.Errorf("expected the cached manifest to be checked with the remote registry: %v", *env.RemoteStats())
+	}
+
+	// the manifest cached for a client is not served to another
+	remoteManifests := env.manifests.remoteManifests
+	env.manifests.remoteManifests = deniedManifests{remoteManifests}
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); !errors.Is(err, errcode.ErrorCodeDenied) {
+		t.Errorf("unexpected error %v, expected the manifest to be denied", err)
+	}
+	if _, err := env.manifests.Exists(ctx, env.manifestDigest); !errors.Is(err, errcode.ErrorCodeDenied) {
+		t.Errorf("unexpected error %v, expected the manifest to be denied", err)
+	}
+
+	// without forwarded credentials, the cache serves it as is
+	env.manifests.authorizeRemote = false
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,23 +2,30 @@ package proxy
 
 import (
 	"expvar"
+	"net/http"
+	"strconv"
 	"sync/atomic"
+	"time"
 
 	prometheus "github.com/distribution/distribution/v3/metrics"
 	"github.com/docker/go-metrics"
 )
 
 var (
-	// requests is the number of total incoming proxy request received for blob/manifest
-	requests = prometheus.ProxyNamespace.NewLabeledCounter("requests", "The number of total incoming proxy request received", "type")
-	// hits is the number of total proxy request hits for blob/manifest
-	hits = prometheus.ProxyNamespace.NewLabeledCounter("hits", "The number of total proxy request hits", "type")
-	// hits is the number of total proxy request misses for blob/manifest
-	misses = prometheus.ProxyNamespace.NewLabeledCounter("misses", "The number of total proxy request misses", "type")
-	// pulledBytes is the size of total bytes pulled from the upstream for blob/manifest
-	pulledBytes = prometheus.ProxyNamespace.NewLabeledCounter("pulled_bytes", "The size of total bytes pulled from the upstream", "type")
-	// pushedBytes is the size of total bytes pushed to the client for blob/manifest
-	pushedBytes = prometheus.ProxyNamespace.NewLabeledCounter("pushed_bytes", "The size of total bytes pushed to the client", "type")
+	// requests is the number of total incoming proxy request received for blob/manifest by remote
+	requests = prometheus.ProxyNamespace.NewLabeledCounter("requests", "The number of total incoming proxy request received", "type", "remote")
+	// hits is the number of total proxy request hits for blob/manifest by remote
+	hits = prometheus.ProxyNamespace.NewLabeledCounter("hits", "The number of total proxy request hits", "type", "remote")
+	// hits is the number of total proxy request misses for blob/manifest by remote
+	misses = prometheus.ProxyNamespace.NewLabeledCounter("misses", "The number of total proxy request misses", "type", "remote")
+	// stale is the number of total proxy requests served stale for blob/manifest by remote
+	stale = prometheus.ProxyNamespace.NewLabeledCounter("stale", "The number of total proxy requests served stale", "type", "remote")
+	// pulledBytes is the size of total bytes pulled from the upstream for blob/manifest by remote
+	pulledBytes = prometheus.ProxyNamespace.NewLabeledCounter("pulled_bytes", "The size of total bytes pulled from the upstream", "type", "remote")
+	// pushedBytes is the size of total bytes pushed to the client for blob/manifest by remote
+	pushedBytes = prometheus.ProxyNamespace.NewLabeledCounter("pushed_bytes", "The size of total bytes pushed to the client", "type", "remote")
+	// upstreamRequests is the duration of the requests to the upstream by status code
+	upstreamRequests = prometheus.ProxyNamespace.NewLabeledTimer("upstream_requests", "The duration of the requests to the upstream", "remote", "code")
 )
 
 // Metrics is used to hold metric counters
@@ -27,6 +34,7 @@ type Metrics struct {
 	Requests    uint64
 	Hits        uint64
 	Misses      uint64
+	Stale       uint64
 	BytesPulled uint64
 	BytesPushed uint64
 }
@@ -62,62 +70,103 @@ func init() {
 	}))
 
 	metrics.Register(prometheus.ProxyNamespace)
-	initPrometheusMetrics("blob")
-	initPrometheusMetrics("manifest")
 }
 
-func initPrometheusMetrics(value string) {
-	requests.WithValues(value).Inc(0)
-	hits.WithValues(value).Inc(0)
-	misses.WithValues(value).Inc(0)
-	pulledBytes.WithValues(value).Inc(0)
-	pushedBytes.WithValues(value).Inc(0)
+// initPrometheusMetrics initializes the counters of a remote registry, so
+// that they are exported before its first pull.
+func initPrometheusMetrics(remote string) {
+	for _, value := range []string{"blob", "manifest"} {
+		requests.WithValues(value, remote).Inc(0)
+		hits.WithValues(value, remote).Inc(0)
+		misses.WithValues(value, remote).Inc(0)
+		stale.WithValues(value, remote).Inc(0)
+		pulledBytes.WithValues(value, remote).Inc(0)
+		pushedBytes.WithValues(value, remote).Inc(0)
+	}
 }
 
 // BlobPull tracks metrics about blobs pulled into the cache
-func (pmc *proxyMetricsCollector) BlobPull(bytesPulled uint64) {
+func (pmc *proxyMetricsCollector) BlobPull(remote string, bytesPulled uint64) {
 	atomic.AddUint64(&pmc.blobMetrics.Misses, 1)
 	atomic.AddUint64(&pmc.blobMetrics.BytesPulled, bytesPulled)
 
-	misses.WithValues("blob").Inc(1)
-	pulledBytes.WithValues("blob").Inc(float64(bytesPulled))
+	misses.WithValues("blob", remote).Inc(1)
+	pulledBytes.WithValues("blob", remote).Inc(float64(bytesPulled))
 }
 
 // BlobPush tracks metrics about blobs pushed to clients
-func (pmc *proxyMetricsCollector) BlobPush(bytesPushed uint64, isHit bool) {
+func (pmc *proxyMetricsCollector) BlobPush(remote string, bytesPushed uint64, isHit bool) {
 	atomic.AddUint64(&pmc.blobMetrics.Requests, 1)
 	atomic.AddUint64(&pmc.blobMetrics.BytesPushed, bytesPushed)
 
-	requests.WithValues("blob").Inc(1)
-	pushedBytes.WithValues("blob").Inc(float64(bytesPushed))
+	requests.WithValues("blob", remote).Inc(1)
+	pushedBytes.WithValues("blob", remote).Inc(float64(bytesPushed))
 
 	if isHit {
 		atomic.AddUint64(&pmc.blobMetrics.Hits, 1)
 
-		hits.WithValues("blob").Inc(1)
+		hits.WithValues("blob", remote).Inc(1)
 	}
 }
 
+// BlobStale tracks the blobs served stale while the upstream is unreachable
+func (pmc *proxyMetricsCollector) BlobStale(remote string) {
+	atomic.AddUint64(&pmc.blobMetrics.Stale, 1)
+
+	stale.WithValues("blob", remote).Inc(1)
+}
+
 // ManifestPull tracks metrics related to Manifests pulled into the cache
-func (pmc *proxyMetricsCollector) ManifestPull(bytesPulled uint64) {
+func (pmc *proxyMetricsCollector) ManifestPull(remote string, bytesPulled uint64) {
 	atomic.AddUint64(&pmc.manifestMetrics.Misses, 1)
 	atomic.AddUint64(&pmc.manifestMetrics.BytesPulled, bytesPulled)
 
-	misses.WithValues("manifest").Inc(1)
-	pulledBytes.WithValues("manifest").Inc(float64(bytesPulled))
+	misses.WithValues("manifest", remote).Inc(1)
+	pulledBytes.WithValues("manifest", remote).Inc(float64(bytesPulled))
 }
 
 // ManifestPush tracks metrics about manifests pushed to clients
-func (pmc *proxyMetricsCollector) ManifestPush(bytesPushed uint64, isHit bool) {
+func (pmc *proxyMetricsCollector) ManifestPush(remote string, bytesPushed uint64, isHit bool) {
 	atomic.AddUint64(&pmc.manifestMetrics.Requests, 1)
 	atomic.AddUint64(&pmc.manifestMetrics.BytesPushed, bytesPushed)
 
-	requests.WithValues("manifest").Inc(1)
-	pushedBytes.WithValues("manifest").Inc(float64(bytesPushed))
+	requests.WithValues("manifest", remote).Inc(1)
+	pushedBytes.WithValues("manifest", remote).Inc(float64(bytesPushed))
 
 	if isHit {
 		atomic.AddUint64(&pmc.manifestMetrics.Hits, 1)
 
-		hits.WithValues("manifest").Inc(1)
+		hits.WithValues("manifest", remote).Inc(1)
+	}
+}
+
+// ManifestStale tracks the manifests served stale while the upstream is
+// unreachable
+func (pmc *proxyMetricsCollector) ManifestStale(remote string) {
+	atomic.AddUint64(&pmc.manifestMetrics.Stale, 1)
+
+	stale.WithValues("manifest", remote).Inc(1)
+}
+
+// UpstreamRequest tracks the duration of a request to a remote registry,
+// responding with code
+func (pmc *proxyMetricsCollector) UpstreamRequest(remote, code string, start time.Time) {
+	upstreamRequests.WithValues(remote, code).UpdateSince(start)
+}
+
+// metricsTransport tracks the requests to a remote registry.
+type metricsTransport struct {
+	remote string
+	base   http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
 	}
+	proxyMetrics.UpstreamRequest(t.remote, code, start)
+	return resp, err
 }
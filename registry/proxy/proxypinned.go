@@ -0,0 +1,479 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/cron"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// pinnedStatePath is the path of the references pinned through the
+	// debug server in the storage backend.
+	pinnedStatePath = "/pinned-state.json"
+
+	// defaultPinnedSchedule is the schedule of the prefetching of the
+	// pinned images, if not configured.
+	defaultPinnedSchedule = "@hourly"
+)
+
+// pinnedStatus is the status of a pinned image served by the debug server.
+type pinnedStatus struct {
+	Reference string `json:"reference"`
+	// Configured is true if the image is pinned by the configuration,
+	// rather than through the debug server.
+	Configured bool          `json:"configured"`
+	Digest     digest.Digest `json:"digest,omitempty"`
+	// Prefetched is the time the image was last prefetched.
+	Prefetched time.Time `json:"prefetched,omitempty"`
+	// Error is the error of the last prefetching, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// pinnedImage is an image pinned in the cache.
+type pinnedImage struct {
+	status pinnedStatus
+	// digests are the digests of the manifests and blobs of the image, as
+	// of its last successful prefetching.
+	digests map[digest.Digest]struct{}
+}
+
+// pinned prefetches the pinned images into the cache on schedule, and keeps
+// their content from expiring or being evicted.
+type pinned struct {
+	sync.Mutex
+
+	// images are the pinned images by reference.
+	images map[string]*pinnedImage
+	// digests are the digests of the content of all the pinned images.
+	digests map[digest.Digest]struct{}
+
+	schedule *cron.Schedule
+	registry *proxyingRegistry
+	driver   driver.StorageDriver
+
+	ctx          context.Context
+	cancel       context.CancelFunc
+	prefetchChan chan struct{}
+	doneChan     chan struct{}
+}
+
+// newPinned returns the images pinned in the pull through cache, by the
+// configuration and through the debug server.
+func newPinned(ctx context.Context, registry *proxyingRegistry, driver driver.StorageDriver, config configuration.ProxyPinned) (*pinned, error) {
+	expr := config.Schedule
+	if expr == "" {
+		expr = defaultPinnedSchedule
+	}
+	schedule, err := cron.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pinned schedule: %w", err)
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("pinned schedule %q never matches", expr)
+	}
+
+	p := &pinned{
+		images:       make(map[string]*pinnedImage),
+		digests:      make(map[digest.Digest]struct{}),
+		schedule:     schedule,
+		registry:     registry,
+		driver:       driver,
+		prefetchChan: make(chan struct{}, 1),
+		doneChan:     make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+
+	for _, ref := range config.References {
+		if _, err := p.parse(ref); err != nil {
+			return nil, err
+		}
+		p.images[ref] = &pinnedImage{status: pinnedStatus{Reference: ref, Configured: true}}
+	}
+	added, err := p.readState()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range added {
+		if _, ok := p.images[ref]; !ok {
+			p.images[ref] = &pinnedImage{status: pinnedStatus{Reference: ref}}
+		}
+	}
+	return p, nil
+}
+
+// parse parses the reference of a pinned image, which must have a tag or a
+// digest, and be pulled through from a remote registry.
+func (p *pinned) parse(ref string) (reference.Named, error) {
+	r, err := reference.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pinned reference %q: %w", ref, err)
+	}
+	named, ok := r.(reference.Named)
+	if !ok {
+		return nil, fmt.Errorf("invalid pinned reference %q: no repository name", ref)
+	}
+	_, tagged := named.(reference.Tagged)
+	_, canonical := named.(reference.Canonical)
+	if !tagged && !canonical {
+		return nil, fmt.Errorf("invalid pinned reference %q: no tag or digest", ref)
+	}
+	if _, _, err := p.registry.remote(named); err != nil {
+		return nil, fmt.Errorf("invalid pinned reference %q: %w", ref, err)
+	}
+	return named, nil
+}
+
+// isPinned reports whether the content dgst belongs to a pinned image.
+func (p *pinned) isPinned(dgst digest.Digest) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	_, ok := p.digests[dgst]
+	return ok
+}
+
+// updateDigests updates the digests of the content of the pinned images. It
+// must be called with the lock held.
+func (p *pinned) updateDigests() {
+	p.digests = make(map[digest.Digest]struct{})
+	for _, image := range p.images {
+		for dgst := range image.digests {
+			p.digests[dgst] = struct{}{}
+		}
+	}
+}
+
+// start prefetches the pinned images, then on schedule.
+func (p *pinned) start() {
+	go func() {
+		defer close(p.doneChan)
+		for {
+			p.prefetch()
+			timer := time.NewTimer(time.Until(p.schedule.Next(time.Now())))
+			select {
+			case <-p.ctx.Done():
+				timer.Stop()
+				return
+			case <-p.prefetchChan:
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// stop stops the prefetching of the pinned images.
+func (p *pinned) stop() {
+	p.cancel()
+	<-p.doneChan
+}
+
+// prefetch prefetches the pinned images, keeping the content of the images
+// failing to be prefetched pinned.
+func (p *pinned) prefetch() {
+	p.Lock()
+	refs := make([]string, 0, len(p.images))
+	for ref := range p.images {
+		refs = append(refs, ref)
+	}
+	p.Unlock()
+	sort.Strings(refs)
+
+	for _, ref := range refs {
+		if p.ctx.Err() != nil {
+			return
+		}
+		dgst, digests, err := p.prefetchImage(p.ctx, ref)
+		if err != nil {
+			dcontext.GetLogger(p.ctx).Errorf("error prefetching pinned image %s: %v", ref, err)
+		}
+
+		p.Lock()
+		// the image may have been unpinned meanwhile
+		if image, ok := p.images[ref]; ok {
+			if err != nil {
+				image.status.Error = err.Error()
+			} else {
+				image.status.Digest = dgst
+				image.status.Prefetched = time.Now()
+				image.status.Error = ""
+				image.digests = digests
+			}
+			p.updateDigests()
+		}
+		p.Unlock()
+	}
+}
+
+// prefetchImage caches the manifests and blobs of a pinned image, returning
+// the digest of its manifest and of its content.
+func (p *pinned) prefetchImage(ctx context.Context, ref string) (digest.Digest, map[digest.Digest]struct{}, error) {
+	named, err := p.parse(ref)
+	if err != nil {
+		return "", nil, err
+	}
+	repo, err := p.registry.Repository(ctx, reference.TrimNamed(named))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var dgst digest.Digest
+	if canonical, ok := named.(reference.Canonical); ok {
+		dgst = canonical.Digest()
+	} else {
+		desc, err := repo.Tags(ctx).Get(ctx, named.(reference.Tagged).Tag())
+		if err != nil {
+			return "", nil, err
+		}
+		dgst = desc.Digest
+	}
+
+	proxied := repo.(*proxiedRepository)
+	pms := proxied.manifests.(*proxyManifestStore)
+	pbs := proxied.blobStore.(*proxyBlobStore)
+	digests := make(map[digest.Digest]struct{})
+	if err := prefetchManifest(ctx, pms, pbs, dgst, digests); err != nil {
+		return "", nil, err
+	}
+	return dgst, digests, nil
+}
+
+// prefetchManifest caches a manifest and its content, the manifests of every
+// platform of an index, recording their digests.
+func prefetchManifest(ctx context.Context, pms *proxyManifestStore, pbs *proxyBlobStore, dgst digest.Digest, digests map[digest.Digest]struct{}) error {
+	if _, ok := digests[dgst]; ok {
+		return nil
+	}
+	manifest, err := pms.prefetch(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	digests[dgst] = struct{}{}
+
+	switch manifest.(type) {
+	case *manifestlist.DeserializedManifestList, *ocischema.DeserializedImageIndex:
+		for _, desc := range manifest.References() {
+			if err := prefetchManifest(ctx, pms, pbs, desc.Digest, digests); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, desc := range manifest.References() {
+			// foreign layers are not served by registries
+			if _, ok := digests[desc.Digest]; ok || len(desc.URLs) > 0 {
+				continue
+			}
+			if err := pbs.prefetch(ctx, desc.Digest); err != nil {
+				return err
+			}
+			digests[desc.Digest] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// PinnedHandler returns the handler of the debug server listing, pinning and
+// unpinning the images pinned in a pull through cache, or nil if registry is
+// not a pull through cache.
+func PinnedHandler(registry distribution.Namespace) http.Handler {
+	pr, ok := registry.(*proxyingRegistry)
+	if !ok || pr.pinned == nil {
+		return nil
+	}
+	return http.HandlerFunc(pr.pinned.serveHTTP)
+}
+
+// serveHTTP lists the pinned images on GET, pins the image of the reference
+// query parameter on POST, and unpins it on DELETE. The images pinned by the
+// configuration cannot be unpinned.
+func (p *pinned) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("reference")
+	switch r.Method {
+	case http.MethodGet:
+		p.Lock()
+		statuses := make([]pinnedStatus, 0, len(p.images))
+		for _, image := range p.images {
+			statuses = append(statuses, image.status)
+		}
+		p.Unlock()
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Reference < statuses[j].Reference
+		})
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			dcontext.GetLogger(r.Context()).Errorf("error serving the pinned images: %v", err)
+		}
+
+	case http.MethodPost:
+		if _, err := p.parse(ref); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.Lock()
+		if _, ok := p.images[ref]; ok {
+			p.Unlock()
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		p.images[ref] = &pinnedImage{status: pinnedStatus{Reference: ref}}
+		if err := p.writeState(); err != nil {
+			delete(p.images, ref)
+			p.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.Unlock()
+		dcontext.GetLogger(r.Context()).Infof("pinned image %s", ref)
+
+		select {
+		case p.prefetchChan <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodDelete:
+		p.Lock()
+		defer p.Unlock()
+		image, ok := p.images[ref]
+		switch {
+		case !ok:
+			http.Error(w, fmt.Sprintf("image %q is not pinned", ref), http.StatusNotFound)
+			return
+		case image.status.Configured:
+			http.Error(w, fmt.Sprintf("image %q is pinned by the configuration", ref), http.StatusConflict)
+			return
+		}
+		delete(p.images, ref)
+		if err := p.writeState(); err != nil {
+			p.images[ref] = image
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.updateDigests()
+		dcontext.GetLogger(r.Context()).Infof("unpinned image %s", ref)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// writeState saves the references pinned through the debug server. It must
+// be called with the lock held.
+func (p *pinned) writeState() error {
+	refs := []string{}
+	for ref, image := range p.images {
+		if !image.status.Configured {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	jsonBytes, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	return p.driver.PutContent(p.ctx, pinnedStatePath, jsonBytes)
+}
+
+func (p *pinned) readState() ([]string, error) {
+	bytes, err := p.driver.GetContent(p.ctx, pinnedStatePath)
+	if err != nil {
+		switch err := err.(type) {
+		case driver.PathNotFoundError:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	var refs []string
+	if err := json.Unmarshal(bytes, &refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// prefetch caches a manifest, refreshing its TTL if already cached.
+func (pms proxyManifestStore) prefetch(ctx context.Context, dgst digest.Digest) (distribution.Manifest, error) {
+	var fromRemote bool
+	manifest, err := pms.localManifests.Get(ctx, dgst)
+	if err != nil {
+		if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
+			return nil, err
+		}
+		manifest, err = pms.remoteManifests.Get(ctx, dgst)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pms.localManifests.Put(ctx, manifest); err != nil {
+			return nil, err
+		}
+		fromRemote = true
+	}
+
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, err
+	}
+	if fromRemote {
+		proxyMetrics.ManifestPull(pms.remote, uint64(len(payload)))
+	}
+	return manifest, pms.schedule(ctx, dgst, int64(len(payload)))
+}
+
+// prefetch caches a blob, refreshing its TTL if already cached.
+func (pbs *proxyBlobStore) prefetch(ctx context.Context, dgst digest.Digest) error {
+	blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
+	if err != nil {
+		return err
+	}
+	if desc, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+		return pbs.schedule(ctx, blobRef, desc.Size)
+	}
+
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return err
+	}
+	desc, err := pbs.remoteStore.Stat(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	remoteReader, err := pbs.remoteStore.Open(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	defer remoteReader.Close()
+
+	bw, err := pbs.localStore.Create(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(bw, remoteReader, desc.Size); err != nil {
+		if err := bw.Cancel(ctx); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error canceling prefetching of blob %s: %v", dgst, err)
+		}
+		return err
+	}
+	if _, err := bw.Commit(ctx, desc); err != nil {
+		return err
+	}
+	proxyMetrics.BlobPull(pbs.remote, uint64(desc.Size))
+
+	return pbs.schedule(ctx, blobRef, desc.Size)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pushThrough forwards the content pushed to the pull through cache to the
+// remote registry. The blobs are uploaded to the cache first, then forwarded
+// once committed, so that uploads span several requests.
+type pushThrough struct {
+	// cache keeps the pushed content in the cache, which is removed once
+	// forwarded otherwise.
+	cache bool
+	// remove removes the data of a blob staged in the cache.
+	remove func(digest.Digest) error
+}
+
+// pushThroughBlobWriter forwards a blob to the remote registry once
+// committed to the cache.
+type pushThroughBlobWriter struct {
+	distribution.BlobWriter
+	pbs *proxyBlobStore
+}
+
+func (bw *pushThroughBlobWriter) Commit(ctx context.Context, provisional v1.Descriptor) (v1.Descriptor, error) {
+	desc, err := bw.BlobWriter.Commit(ctx, provisional)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := bw.pbs.forward(ctx, desc); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// forward uploads a blob committed to the cache to the remote registry,
+// unless it already has it, then caches or removes it.
+func (pbs *proxyBlobStore) forward(ctx context.Context, desc v1.Descriptor) error {
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return err
+	}
+
+	_, err := pbs.remoteStore.Stat(ctx, desc.Digest)
+	switch {
+	case err == nil:
+		dcontext.GetLogger(ctx).Debugf("blob %s already in the remote registry", desc.Digest)
+	case errors.Is(err, distribution.ErrBlobUnknown):
+		if err := pbs.upload(ctx, desc); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	if pbs.pushThrough.cache {
+		blobRef, err := reference.WithDigest(pbs.repositoryName, desc.Digest)
+		if err != nil {
+			return err
+		}
+		return pbs.schedule(ctx, blobRef, desc.Size)
+	}
+
+	// the blob was forwarded, failing to remove it from the cache only
+	// wastes space
+	if err := pbs.localStore.Delete(ctx, desc.Digest); err != nil {
+		dcontext.GetLogger(ctx).Warnf("error removing the blob %s pushed through: %v", desc.Digest, err)
+	} else if err := pbs.pushThrough.remove(desc.Digest); err != nil {
+		dcontext.GetLogger(ctx).Warnf("error removing the blob %s pushed through: %v", desc.Digest, err)
+	}
+	return nil
+}
+
+// upload copies a blob of the cache to the remote registry.
+func (pbs *proxyBlobStore) upload(ctx context.Context, desc v1.Descriptor) error {
+	blob, err := pbs.localStore.Open(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	bw, err := pbs.remoteStore.Create(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(bw, blob); err != nil {
+		if err := bw.Cancel(ctx); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error canceling upload to the remote registry: %v", err)
+		}
+		return err
+	}
+	_, err = bw.Commit(ctx, desc)
+	return err
+}
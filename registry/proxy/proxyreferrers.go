@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/client"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxReferrersSize bounds the size of a page of referrers read from the
+// remote registry.
+const maxReferrersSize = 4 << 20
+
+// ReferrersLister lists the referrers of the manifests of the remote
+// registries, implemented by pull through caches.
+type ReferrersLister interface {
+	// Referrers returns the descriptors of the manifests of the repository
+	// referring to the manifest dgst through their subject.
+	Referrers(ctx context.Context, name reference.Named, dgst digest.Digest) ([]v1.Descriptor, error)
+}
+
+var _ ReferrersLister = &proxyingRegistry{}
+
+// Referrers lists the referrers of a manifest of the remote registry, which
+// are cached so that they are listed while the remote registry is
+// unavailable.
+func (pr *proxyingRegistry) Referrers(ctx context.Context, name reference.Named, dgst digest.Digest) ([]v1.Descriptor, error) {
+	repository, err := pr.Repository(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return repository.(*proxiedRepository).referrers.list(ctx, dgst)
+}
+
+// proxyReferrers lists the referrers of manifests with the referrers API of
+// the remote registry, or its referrers tag schema if it has no referrers
+// API. They are cached in an image index tagged under the referrers tag
+// schema, expiring like manifests.
+type proxyReferrers struct {
+	remoteName     reference.Named
+	remoteURL      url.URL
+	client         *http.Client
+	authChallenger authChallenger
+
+	manifests  *proxyManifestStore
+	localTags  distribution.TagService
+	remoteTags distribution.TagService
+}
+
+func (prs *proxyReferrers) list(ctx context.Context, dgst digest.Digest) ([]v1.Descriptor, error) {
+	referrers, err := prs.remote(ctx, dgst)
+	if err == nil {
+		// the referrers are listed, failing to cache them only fails
+		// listing them while the remote registry is unavailable
+		if err := prs.cache(ctx, dgst, referrers); err != nil {
+			dcontext.GetLogger(ctx).Warnf("error caching the referrers of %s: %v", dgst, err)
+		}
+		return referrers, nil
+	}
+
+	referrers, ok, cacheErr := prs.cached(ctx, dgst)
+	if cacheErr != nil || !ok {
+		if cacheErr != nil {
+			dcontext.GetLogger(ctx).Errorf("error reading the cached referrers of %s: %v", dgst, cacheErr)
+		}
+		return nil, err
+	}
+	dcontext.GetLogger(ctx).Warnf("error listing the referrers of %s with the remote registry, serving the cached ones: %v", dgst, err)
+	return referrers, nil
+}
+
+// remote lists the referrers of a manifest with the remote registry,
+// following the pages of the referrers API.
+func (prs *proxyReferrers) remote(ctx context.Context, dgst digest.Digest) ([]v1.Descriptor, error) {
+	if err := prs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+
+	ub, err := v2.NewURLBuilderFromString(prs.remoteURL.String(), false)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := reference.WithDigest(prs.remoteName, dgst)
+	if err != nil {
+		return nil, err
+	}
+	u, err := ub.BuildReferrersURL(ref)
+	if err != nil {
+		return nil, err
+	}
+	listURL, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+
+	referrers := []v1.Descriptor{}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", v1.MediaTypeImageIndex)
+		resp, err := prs.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound && len(referrers) == 0 {
+			// the remote registry has no referrers API
+			resp.Body.Close()
+			return prs.remoteTagged(ctx, dgst)
+		}
+		if err := client.HandleHTTPResponseError(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var index v1.Index
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxReferrersSize)).Decode(&index)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding the referrers of %s: %w", dgst, err)
+		}
+		referrers = append(referrers, index.Manifests...)
+
+		link := resp.Header.Get("Link")
+		if link == "" {
+			return referrers, nil
+		}
+		firstLink, _, _ := strings.Cut(link, ";")
+		linkURL, err := url.Parse(strings.Trim(firstLink, "<>"))
+		if err != nil {
+			return nil, err
+		}
+		listURL = listURL.ResolveReference(linkURL)
+	}
+}
+
+// remoteTagged lists the referrers of a manifest under the referrers tag
+// schema of the remote registry.
+func (prs *proxyReferrers) remoteTagged(ctx context.Context, dgst digest.Digest) ([]v1.Descriptor, error) {
+	desc, err := prs.remoteTags.Get(ctx, storage.ReferrersTag(dgst))
+	if err != nil {
+		if errors.As(err, &distribution.ErrTagUnknown{}) {
+			return []v1.Descriptor{}, nil
+		}
+		return nil, err
+	}
+	manifest, err := prs.manifests.remoteManifests.Get(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	index, ok := manifest.(*ocischema.DeserializedImageIndex)
+	if !ok {
+		return nil, fmt.Errorf("referrers of %s tagged with a %T", dgst, manifest)
+	}
+	return index.Manifests, nil
+}
+
+// cache caches the referrers of a manifest, untagging them if there are
+// none.
+func (prs *proxyReferrers) cache(ctx context.Context, dgst digest.Digest, referrers []v1.Descriptor) error {
+	tag := storage.ReferrersTag(dgst)
+	if len(referrers) == 0 {
+		if err := prs.localTags.Untag(ctx, tag); err != nil && !errors.As(err, &distribution.ErrTagUnknown{}) {
+			return err
+		}
+		return nil
+	}
+
+	index, err := ocischema.FromDescriptors(referrers, nil)
+	if err != nil {
+		return err
+	}
+	mediaType, payload, err := index.Payload()
+	if err != nil {
+		return err
+	}
+	indexDigest, err := prs.manifests.localManifests.Put(ctx, index)
+	if err != nil {
+		return err
+	}
+	if err := prs.manifests.schedule(ctx, indexDigest, int64(len(payload))); err != nil {
+		return err
+	}
+	return prs.localTags.Tag(ctx, tag, v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    indexDigest,
+		Size:      int64(len(payload)),
+	})
+}
+
+// cached returns the cached referrers of a manifest, if any.
+func (prs *proxyReferrers) cached(ctx context.Context, dgst digest.Digest) ([]v1.Descriptor, bool, error) {
+	desc, err := prs.localTags.Get(ctx, storage.ReferrersTag(dgst))
+	if err != nil {
+		if errors.As(err, &distribution.ErrTagUnknown{}) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	manifest, err := prs.manifests.localManifests.Get(ctx, desc.Digest)
+	if err != nil {
+		if errors.As(err, &distribution.ErrManifestUnknownRevision{}) {
+			// expired
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	index, ok := manifest.(*ocischema.DeserializedImageIndex)
+	if !ok {
+		return nil, false, fmt.Errorf("referrers of %s cached in a %T", dgst, manifest)
+	}
+	return index.Manifests, true, nil
+}
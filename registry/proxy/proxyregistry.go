@@ -2,13 +2,18 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
@@ -24,38 +29,190 @@ import (
 
 var repositoryTTL = 24 * 7 * time.Hour
 
-// proxyingRegistry fetches content from a remote registry and caches it locally
+// proxyingRegistry fetches content from remote registries and caches it locally
 type proxyingRegistry struct {
-	embedded       distribution.Namespace // provides local registry functionality
-	scheduler      *scheduler.TTLExpirationScheduler
-	ttl            *time.Duration
+	embedded  distribution.Namespace // provides local registry functionality
+	scheduler *scheduler.TTLExpirationScheduler
+	ttls      *ttlPolicy
+	evictor   *scheduler.LRUEvictor
+
+	// pushThrough accepts pushes, if enabled
+	pushThrough *pushThrough
+	pinned      *pinned
+
+	// remotes are the remote registries, sorted by decreasing length of
+	// their prefix.
+	remotes []*remote
+}
+
+// remote is a remote registry the repositories under a prefix are pulled
+// through from.
+type remote struct {
+	// prefix is stripped from the names of the repositories to get their
+	// name in the remote registry, empty for the remote of all the
+	// repositories.
+	prefix         string
 	remoteURL      url.URL
 	authChallenger authChallenger
 	basicAuth      auth.CredentialStore
+
+	// name labels the metrics of the remote registry, whose requests go
+	// through transport.
+	name      string
+	transport http.RoundTripper
+
+	// forwardCredentials forwards the credentials of the client to the
+	// remote registry when it provides some.
+	forwardCredentials bool
+}
+
+// newRemote configures the remote registry of the repositories under prefix.
+func newRemote(prefix string, config configuration.ProxyRemote) (*remote, error) {
+	remoteURL, err := url.Parse(config.RemoteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cs, b, err := func() (auth.CredentialStore, auth.CredentialStore, error) {
+		switch {
+		case config.Exec != nil:
+			cs, err := configureExecAuth(*config.Exec)
+			return cs, cs, err
+		default:
+			return configureAuth(config.Username, config.Password, config.RemoteURL)
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	initPrometheusMetrics(remoteURL.Host)
+	return &remote{
+		prefix:    prefix,
+		remoteURL: *remoteURL,
+		name:      remoteURL.Host,
+		transport: metricsTransport{remote: remoteURL.Host, base: http.DefaultTransport},
+		authChallenger: &remoteAuthChallenger{
+			remoteURL: *remoteURL,
+			cm:        challenge.NewSimpleManager(),
+			cs:        cs,
+		},
+		basicAuth:          b,
+		forwardCredentials: config.ForwardCredentials,
+	}, nil
+}
+
+// newRemotes configures the remote registries of the pull through cache.
+func newRemotes(config configuration.Proxy) ([]*remote, error) {
+	var remotes []*remote
+	prefixes := make(map[string]struct{})
+	for _, rc := range config.Remotes {
+		if _, err := reference.WithName(rc.Prefix); err != nil {
+			return nil, fmt.Errorf("invalid prefix of remote %s: %v", rc.RemoteURL, err)
+		}
+		if _, ok := prefixes[rc.Prefix]; ok {
+			return nil, fmt.Errorf("duplicate remote prefix %s", rc.Prefix)
+		}
+		prefixes[rc.Prefix] = struct{}{}
+		if rc.RemoteURL == "" {
+			return nil, fmt.Errorf("no remoteurl for the remote prefix %s", rc.Prefix)
+		}
+		r, err := newRemote(rc.Prefix, rc)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, r)
+	}
+	if config.RemoteURL != "" {
+		r, err := newRemote("", configuration.ProxyRemote{
+			RemoteURL:          config.RemoteURL,
+			Username:           config.Username,
+			Password:           config.Password,
+			Exec:               config.Exec,
+			ForwardCredentials: config.ForwardCredentials,
+		})
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, r)
+	}
+	sort.SliceStable(remotes, func(i, j int) bool {
+		return len(remotes[i].prefix) > len(remotes[j].prefix)
+	})
+	return remotes, nil
 }
 
 // NewRegistryPullThroughCache creates a registry acting as a pull through cache
 func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy) (distribution.Namespace, error) {
-	remoteURL, err := url.Parse(config.RemoteURL)
+	remotes, err := newRemotes(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &proxyingRegistry{
+		embedded: registry,
+		remotes:  remotes,
+	}
+	// the pinned images are pulled through the registry once it is created
+	pins, err := newPinned(ctx, pr, driver, config.Pinned)
 	if err != nil {
 		return nil, err
 	}
 
 	v := storage.NewVacuum(ctx, driver)
 
-	var s *scheduler.TTLExpirationScheduler
-	var ttl *time.Duration
-	if config.TTL == nil {
-		// Default TTL is 7 days
-		ttl = &repositoryTTL
-	} else if *config.TTL > 0 {
-		ttl = config.TTL
-	} else {
-		// TTL is disabled, never expire
-		ttl = nil
+	var evictor *scheduler.LRUEvictor
+	if config.MaxSize > 0 {
+		evictor = scheduler.NewLRU(ctx, driver, "/lru-state.json", config.MaxSize)
+		evictor.SkipPinned(pins.isPinned)
+		evictor.OnBlobEvict(func(ref reference.Reference) error {
+			r, ok := ref.(reference.Canonical)
+			if !ok {
+				return fmt.Errorf("unexpected reference type : %T", ref)
+			}
+
+			repo, err := registry.Repository(ctx, r)
+			if err != nil {
+				return err
+			}
+			err = repo.Blobs(ctx).Delete(ctx, r.Digest())
+			if err != nil && !errors.Is(err, distribution.ErrBlobUnknown) {
+				return err
+			}
+			return removeBlob(v, r.Digest())
+		})
+		evictor.OnManifestEvict(func(ref reference.Reference) error {
+			r, ok := ref.(reference.Canonical)
+			if !ok {
+				return fmt.Errorf("unexpected reference type : %T", ref)
+			}
+
+			repo, err := registry.Repository(ctx, r)
+			if err != nil {
+				return err
+			}
+			manifests, err := repo.Manifests(ctx)
+			if err != nil {
+				return err
+			}
+			err = manifests.Delete(ctx, r.Digest())
+			if err != nil && !errors.Is(err, distribution.ErrBlobUnknown) {
+				return err
+			}
+			return removeBlob(v, r.Digest())
+		})
+		if err := evictor.Start(); err != nil {
+			return nil, err
+		}
 	}
 
-	if ttl != nil {
+	ttls, err := newTTLPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var s *scheduler.TTLExpirationScheduler
+	if ttls.expires() {
 		s = scheduler.New(ctx, driver, "/scheduler-state.json")
 		s.OnBlobExpire(func(ref reference.Reference) error {
 			var r reference.Canonical
@@ -63,6 +220,9 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 			if r, ok = ref.(reference.Canonical); !ok {
 				return fmt.Errorf("unexpected reference type : %T", ref)
 			}
+			if pins.isPinned(r.Digest()) {
+				return nil
+			}
 
 			repo, err := registry.Repository(ctx, r)
 			if err != nil {
@@ -82,6 +242,9 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 				return err
 			}
 
+			if evictor != nil {
+				evictor.Remove(r.Digest())
+			}
 			return nil
 		})
 
@@ -91,6 +254,9 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 			if r, ok = ref.(reference.Canonical); !ok {
 				return fmt.Errorf("unexpected reference type : %T", ref)
 			}
+			if pins.isPinned(r.Digest()) {
+				return nil
+			}
 
 			repo, err := registry.Repository(ctx, r)
 			if err != nil {
@@ -105,40 +271,109 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 			if err != nil {
 				return err
 			}
+			if evictor != nil {
+				evictor.Remove(r.Digest())
+			}
 			return nil
 		})
 
+		if config.ServeStale.Enabled {
+			s.ServeStale(config.ServeStale.MaxStale)
+		}
+
 		err = s.Start()
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	cs, b, err := func() (auth.CredentialStore, auth.CredentialStore, error) {
-		switch {
-		case config.Exec != nil:
-			cs, err := configureExecAuth(*config.Exec)
-			return cs, cs, err
-		default:
-			return configureAuth(config.Username, config.Password, config.RemoteURL)
+	var pt *pushThrough
+	if config.PushThrough.Enabled {
+		pt = &pushThrough{
+			cache: config.PushThrough.Cache,
+			remove: func(dgst digest.Digest) error {
+				return removeBlob(v, dgst)
+			},
 		}
-	}()
-	if err != nil {
-		return nil, err
 	}
 
-	return &proxyingRegistry{
-		embedded:  registry,
-		scheduler: s,
-		ttl:       ttl,
-		remoteURL: *remoteURL,
-		authChallenger: &remoteAuthChallenger{
-			remoteURL: *remoteURL,
-			cm:        challenge.NewSimpleManager(),
-			cs:        cs,
-		},
-		basicAuth: b,
-	}, nil
+	pr.scheduler = s
+	pr.ttls = ttls
+	pr.evictor = evictor
+	pr.pushThrough = pt
+	pr.pinned = pins
+	pins.start()
+	return pr, nil
+}
+
+// ttlPolicy is the TTL of the content of the repositories.
+type ttlPolicy struct {
+	ttl          *time.Duration
+	repositories []configuration.ProxyRepositoryTTL
+}
+
+// newTTLPolicy returns the TTL policy of the proxy configuration, the TTL
+// defaulting to 7 days.
+func newTTLPolicy(config configuration.Proxy) (*ttlPolicy, error) {
+	p := &ttlPolicy{ttl: config.TTL, repositories: config.Repositories}
+	if p.ttl == nil {
+		p.ttl = &repositoryTTL
+	}
+	for _, rt := range p.repositories {
+		if _, err := path.Match(rt.Pattern, ""); err != nil || rt.Pattern == "" {
+			return nil, fmt.Errorf("invalid repository pattern %q: %v", rt.Pattern, err)
+		}
+	}
+	return p, nil
+}
+
+// expires reports whether the content of any repository expires.
+func (p *ttlPolicy) expires() bool {
+	if expiring(p.ttl) != nil {
+		return true
+	}
+	for _, rt := range p.repositories {
+		if expiring(rt.ManifestTTL) != nil || expiring(rt.BlobTTL) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// manifests returns the TTL of the manifests of the named repository, nil if
+// they never expire.
+func (p *ttlPolicy) manifests(name string) *time.Duration {
+	if rt, ok := p.repository(name); ok && rt.ManifestTTL != nil {
+		return expiring(rt.ManifestTTL)
+	}
+	return expiring(p.ttl)
+}
+
+// blobs returns the TTL of the blobs of the named repository, nil if they
+// never expire.
+func (p *ttlPolicy) blobs(name string) *time.Duration {
+	if rt, ok := p.repository(name); ok && rt.BlobTTL != nil {
+		return expiring(rt.BlobTTL)
+	}
+	return expiring(p.ttl)
+}
+
+// repository returns the first override matching the named repository.
+func (p *ttlPolicy) repository(name string) (configuration.ProxyRepositoryTTL, bool) {
+	for _, rt := range p.repositories {
+		if matched, _ := path.Match(rt.Pattern, name); matched {
+			return rt, true
+		}
+	}
+	return configuration.ProxyRepositoryTTL{}, false
+}
+
+// expiring returns ttl if positive, nil if the content never expires.
+func expiring(ttl *time.Duration) *time.Duration {
+	if ttl == nil || *ttl <= 0 {
+		return nil
+	}
+	return ttl
 }
 
 func (pr *proxyingRegistry) Scope() distribution.Scope {
@@ -149,25 +384,72 @@ func (pr *proxyingRegistry) Repositories(ctx context.Context, repos []string, la
 	return pr.embedded.Repositories(ctx, repos, last)
 }
 
+// remote returns the remote registry the named repository is pulled through
+// from, and the name of the repository in the remote registry.
+func (pr *proxyingRegistry) remote(name reference.Named) (*remote, reference.Named, error) {
+	for _, r := range pr.remotes {
+		if r.prefix == "" {
+			return r, name, nil
+		}
+		remoteName, ok := strings.CutPrefix(name.Name(), r.prefix+"/")
+		if !ok {
+			continue
+		}
+		named, err := reference.WithName(remoteName)
+		if err != nil {
+			return nil, nil, distribution.ErrRepositoryNameInvalid{Name: name.Name(), Reason: err}
+		}
+		return r, named, nil
+	}
+	return nil, nil, distribution.ErrRepositoryUnknown{Name: name.Name()}
+}
+
 func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
-	c := pr.authChallenger
-
-	tkopts := auth.TokenHandlerOptions{
-		Transport:   http.DefaultTransport,
-		Credentials: c.credentialStore(),
-		Scopes: []auth.Scope{
-			auth.RepositoryScope{
-				Repository: name.Name(),
-				Actions:    []string{"pull"},
-			},
-		},
-		Logger: dcontext.GetLogger(ctx),
+	r, remoteName, err := pr.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	c := r.authChallenger
+	credentials, basicAuth := c.credentialStore(), r.basicAuth
+	actions := []string{"pull"}
+	if pr.pushThrough != nil {
+		actions = append(actions, "push")
+	}
+
+	var forwarded transport.RequestModifier
+	if r.forwardCredentials {
+		if req, err := dcontext.GetRequest(ctx); err == nil {
+			if username, password, ok := req.BasicAuth(); ok {
+				// authenticate with the remote registry as the client
+				credentials = userpass{username: username, password: password}
+				basicAuth = credentials
+			} else if authorization := req.Header.Get("Authorization"); authorization != "" {
+				// the client holds a token of the remote registry
+				forwarded = forwardedAuthorization{host: r.remoteURL.Host, authorization: authorization}
+			}
+		}
 	}
 
-	tr := transport.NewTransport(http.DefaultTransport,
-		auth.NewAuthorizer(c.challengeManager(),
-			auth.NewTokenHandlerWithOptions(tkopts),
-			auth.NewBasicHandler(pr.basicAuth)))
+	var tr http.RoundTripper
+	if forwarded != nil {
+		tr = transport.NewTransport(r.transport, forwarded)
+	} else {
+		tkopts := auth.TokenHandlerOptions{
+			Transport:   r.transport,
+			Credentials: credentials,
+			Scopes: []auth.Scope{
+				auth.RepositoryScope{
+					Repository: remoteName.Name(),
+					Actions:    actions,
+				},
+			},
+			Logger: dcontext.GetLogger(ctx),
+		}
+		tr = transport.NewTransport(r.transport,
+			auth.NewAuthorizer(c.challengeManager(),
+				auth.NewTokenHandlerWithOptions(tkopts),
+				auth.NewBasicHandler(basicAuth)))
+	}
 
 	localRepo, err := pr.embedded.Repository(ctx, name)
 	if err != nil {
@@ -178,7 +460,7 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		return nil, err
 	}
 
-	remoteRepo, err := client.NewRepository(name, pr.remoteURL.String(), tr)
+	remoteRepo, err := client.NewRepository(remoteName, r.remoteURL.String(), tr)
 	if err != nil {
 		return nil, err
 	}
@@ -188,29 +470,48 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		return nil, err
 	}
 
+	manifests := &proxyManifestStore{
+		repositoryName:  name,
+		localManifests:  localManifests, // Options?
+		remoteManifests: remoteManifests,
+		ctx:             ctx,
+		scheduler:       pr.scheduler,
+		ttl:             pr.ttls.manifests(name.Name()),
+		evictor:         pr.evictor,
+		authChallenger:  c,
+		remote:          r.name,
+		pushThrough:     pr.pushThrough,
+		authorizeRemote: r.forwardCredentials,
+	}
+
 	return &proxiedRepository{
 		blobStore: &proxyBlobStore{
 			localStore:     localRepo.Blobs(ctx),
 			remoteStore:    remoteRepo.Blobs(ctx),
 			scheduler:      pr.scheduler,
-			ttl:            pr.ttl,
+			ttl:            pr.ttls.blobs(name.Name()),
+			evictor:        pr.evictor,
 			repositoryName: name,
-			authChallenger: pr.authChallenger,
+			authChallenger: c,
+			remote:         r.name,
+			pushThrough:    pr.pushThrough,
 		},
-		manifests: &proxyManifestStore{
-			repositoryName:  name,
-			localManifests:  localManifests, // Options?
-			remoteManifests: remoteManifests,
-			ctx:             ctx,
-			scheduler:       pr.scheduler,
-			ttl:             pr.ttl,
-			authChallenger:  pr.authChallenger,
-		},
-		name: name,
+		manifests: manifests,
+		name:      name,
 		tags: &proxyTagService{
 			localTags:      localRepo.Tags(ctx),
 			remoteTags:     remoteRepo.Tags(ctx),
-			authChallenger: pr.authChallenger,
+			authChallenger: c,
+			pushThrough:    pr.pushThrough,
+		},
+		referrers: &proxyReferrers{
+			remoteName:     remoteName,
+			remoteURL:      r.remoteURL,
+			client:         &http.Client{Transport: tr},
+			authChallenger: c,
+			manifests:      manifests,
+			localTags:      localRepo.Tags(ctx),
+			remoteTags:     remoteRepo.Tags(ctx),
 		},
 	}, nil
 }
@@ -229,7 +530,27 @@ type Closer interface {
 }
 
 func (pr *proxyingRegistry) Close() error {
-	return pr.scheduler.Stop()
+	if pr.pinned != nil {
+		pr.pinned.stop()
+	}
+	var errs []error
+	if pr.scheduler != nil {
+		errs = append(errs, pr.scheduler.Stop())
+	}
+	if pr.evictor != nil {
+		errs = append(errs, pr.evictor.Stop())
+	}
+	return errors.Join(errs...)
+}
+
+// removeBlob removes the data of an evicted blob, which may already be gone
+// when the blob was cached in several repositories.
+func removeBlob(v storage.Vacuum, dgst digest.Digest) error {
+	err := v.RemoveBlob(dgst.String())
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return err
+	}
+	return nil
 }
 
 // authChallenger encapsulates a request to the upstream to establish credential challenges
@@ -287,6 +608,7 @@ type proxiedRepository struct {
 	manifests distribution.ManifestService
 	name      reference.Named
 	tags      distribution.TagService
+	referrers *proxyReferrers
 }
 
 func (pr *proxiedRepository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
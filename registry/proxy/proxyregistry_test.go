@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestForwardCredentials(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		authorization string
+	)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="remote"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		authorization = r.Header.Get("Authorization")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"library/app","tags":["latest"]}`))
+	}))
+	defer remote.Close()
+
+	name, err := reference.WithName("library/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name               string
+		forwardCredentials bool
+		authorization      string
+		expected           string
+	}{
+		{
+			name:     "configured credentials",
+			expected: "Basic cmVnaXN0cnk6c2VjcmV0",
+		},
+		{
+			name:          "forwarding disabled",
+			authorization: "Basic Ym9iOmJvYg==",
+			expected:      "Basic cmVnaXN0cnk6c2VjcmV0",
+		},
+		{
+			name:               "forwarded basic credentials",
+			forwardCredentials: true,
+			authorization:      "Basic Ym9iOmJvYg==",
+			expected:           "Basic Ym9iOmJvYg==",
+		},
+		{
+			name:               "forwarded token",
+			forwardCredentials: true,
+			authorization:      "Bearer remote-token",
+			expected:           "Bearer remote-token",
+		},
+		{
+			name:               "anonymous client",
+			forwardCredentials: true,
+			expected:           "Basic cmVnaXN0cnk6c2VjcmV0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			local, err := storage.NewRegistry(ctx, inmemory.New())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ttl time.Duration
+			pr, err := NewRegistryPullThroughCache(ctx, local, inmemory.New(), configuration.Proxy{
+				RemoteURL:          remote.URL,
+				Username:           "registry",
+				Password:           "secret",
+				TTL:                &ttl,
+				ForwardCredentials: tc.forwardCredentials,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/library/app/tags/list", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			ctx = dcontext.WithRequest(ctx, req)
+			repo, err := pr.Repository(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := repo.Tags(ctx).All(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if authorization != tc.expected {
+				t.Fatalf("expected the remote registry to receive %q, got %q", tc.expected, authorization)
+			}
+		})
+	}
+}
+
+func TestForwardedAuthorization(t *testing.T) {
+	f := forwardedAuthorization{host: "registry.example.com", authorization: "Bearer token"}
+
+	req := httptest.NewRequest(http.MethodGet, "https://registry.example.com/v2/", nil)
+	if err := f.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Authorization") != "Bearer token" {
+		t.Fatalf("expected the authorization to be forwarded to the remote registry")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "https://storage.example.com/blob", nil)
+	if err := f.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Fatalf("unexpected authorization forwarded to another host")
+	}
+}
+
+func TestRemotes(t *testing.T) {
+	// newRemote returns a remote registry and a function returning the path
+	// of the last request it received
+	newRemote := func(name string) (*httptest.Server, func() string) {
+		var (
+			mu   sync.Mutex
+			last string
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			last = r.URL.Path
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"name":"` + name + `","tags":["latest"]}`))
+		}))
+		return server, func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return last
+		}
+	}
+	hub, hubPath := newRemote("hub")
+	defer hub.Close()
+	quay, quayPath := newRemote("quay")
+	defer quay.Close()
+	fallback, fallbackPath := newRemote("fallback")
+	defer fallback.Close()
+
+	ctx := context.Background()
+	local, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ttl time.Duration
+	config := configuration.Proxy{
+		TTL: &ttl,
+		Remotes: []configuration.ProxyRemote{
+			{Prefix: "docker.io", RemoteURL: hub.URL},
+			{Prefix: "quay.io/team", RemoteURL: quay.URL},
+		},
+	}
+	pr, err := NewRegistryPullThroughCache(ctx, local, inmemory.New(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RemoteURL = fallback.URL
+	prWithDefault, err := NewRegistryPullThroughCache(ctx, local, inmemory.New(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		registry distribution.Namespace
+		name     string
+		lastPath func() string
+		expected string
+	}{
+		{pr, "docker.io/library/ubuntu", hubPath, "/v2/library/ubuntu/tags/list"},
+		{pr, "quay.io/team/app", quayPath, "/v2/app/tags/list"},
+		{prWithDefault, "quay.io/other/app", fallbackPath, "/v2/quay.io/other/app/tags/list"},
+		{prWithDefault, "docker.io/library/alpine", hubPath, "/v2/library/alpine/tags/list"},
+	} {
+		name, err := reference.WithName(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := tc.registry.Repository(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.Tags(ctx).All(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if path := tc.lastPath(); path != tc.expected {
+			t.Errorf("expected %s to be pulled from %s, got %s", tc.name, tc.expected, path)
+		}
+	}
+
+	name, err := reference.WithName("quay.io/other/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Repository(ctx, name); !errors.As(err, &distribution.ErrRepositoryUnknown{}) {
+		t.Errorf("expected a repository matching no remote to be unknown, got %v", err)
+	}
+
+	config.Remotes = append(config.Remotes, configuration.ProxyRemote{Prefix: "docker.io", RemoteURL: quay.URL})
+	if _, err := NewRegistryPullThroughCache(ctx, local, inmemory.New(), config); err == nil {
+		t.Error("expected an error configuring duplicate remote prefixes")
+	}
+}
+
+func TestRemoteMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"foo/bar","tags":["latest"]}`))
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	local, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ttl time.Duration
+	pr, err := NewRegistryPullThroughCache(ctx, local, inmemory.New(), configuration.Proxy{RemoteURL: server.URL, TTL: &ttl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := reference.WithName("foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := pr.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Tags(ctx).All(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// samples returns the labels of the samples of a metric of the remote
+	samples := func(metric string) []map[string]string {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var labels []map[string]string
+		for _, family := range families {
+			if family.GetName() != metric {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				l := make(map[string]string)
+				for _, pair := range m.GetLabel() {
+					l[pair.GetName()] = pair.GetValue()
+				}
+				if l["remote"] == serverURL.Host {
+					labels = append(labels, l)
+				}
+			}
+		}
+		return labels
+	}
+	if hits := samples("registry_proxy_hits_total"); len(hits) != 2 {
+		t.Errorf("expected the hits of blobs and manifests of the remote, got %v", hits)
+	}
+	if requests := samples("registry_proxy_upstream_requests_seconds"); len(requests) != 1 || requests[0]["code"] != "200" {
+		t.Errorf("expected the requests to the remote, got %v", requests)
+	}
+}
+
+func TestTTLPolicy(t *testing.T) {
+	hour, week, zero := time.Hour, 7*24*time.Hour, time.Duration(0)
+	p, err := newTTLPolicy(configuration.Proxy{
+		Repositories: []configuration.ProxyRepositoryTTL{
+			{Pattern: "internal/*", ManifestTTL: &hour, BlobTTL: &hour},
+			{Pattern: "library/*", ManifestTTL: &hour},
+			{Pattern: "pinned/*", ManifestTTL: &zero, BlobTTL: &zero},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.expires() {
+		t.Error("expected the content to expire")
+	}
+
+	for _, tc := range []struct {
+		name      string
+		manifests *time.Duration
+		blobs     *time.Duration
+	}{
+		{"internal/app", &hour, &hour},
+		{"library/ubuntu", &hour, &week},
+		{"pinned/app", nil, nil},
+		{"other/app", &week, &week},
+	} {
+		if ttl := p.manifests(tc.name); !equalTTL(ttl, tc.manifests) {
+			t.Errorf("unexpected TTL of the manifests of %s: %v", tc.name, ttl)
+		}
+		if ttl := p.blobs(tc.name); !equalTTL(ttl, tc.blobs) {
+			t.Errorf("unexpected TTL of the blobs of %s: %v", tc.name, ttl)
+		}
+	}
+
+	// the content of a repository expires even though the TTL is disabled
+	p, err = newTTLPolicy(configuration.Proxy{
+		TTL:          &zero,
+		Repositories: []configuration.ProxyRepositoryTTL{{Pattern: "mirror/*", BlobTTL: &hour}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.expires() || p.manifests("mirror/app") != nil || !equalTTL(p.blobs("mirror/app"), &hour) {
+		t.Error("expected only the blobs of mirror/* to expire")
+	}
+
+	if _, err := newTTLPolicy(configuration.Proxy{
+		Repositories: []configuration.ProxyRepositoryTTL{{Pattern: "[", BlobTTL: &hour}},
+	}); err == nil {
+		t.Error("expected an error for an invalid repository pattern")
+	}
+}
+
+func equalTTL(a, b *time.Duration) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
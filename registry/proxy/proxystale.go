@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/client"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// staleWarning is the Warning header of the content served past its TTL, see
+// RFC 7234, section 5.5.1.
+const staleWarning = `110 - "Response is Stale"`
+
+// unreachable reports whether err is a failure to reach the remote registry,
+// rather than an error it returned.
+func unreachable(err error) bool {
+	var netErr net.Error
+	var statusErr *client.UnexpectedHTTPStatusError
+	return errors.As(err, &netErr) || errors.As(err, &statusErr)
+}
+
+// revalidate revalidates a cached blob past its TTL with the remote
+// registry, refreshing its TTL if the remote registry still has it. It
+// reports whether the blob is served stale, the remote registry being
+// unreachable.
+func (pbs *proxyBlobStore) revalidate(ctx context.Context, desc v1.Descriptor) (bool, error) {
+	blobRef, err := reference.WithDigest(pbs.repositoryName, desc.Digest)
+	if err != nil {
+		return false, err
+	}
+	if pbs.scheduler == nil || !pbs.scheduler.Stale(blobRef) {
+		return false, nil
+	}
+
+	err = pbs.authChallenger.tryEstablishChallenges(ctx)
+	if err == nil {
+		_, err = pbs.remoteStore.Stat(ctx, desc.Digest)
+	}
+	switch {
+	case err == nil:
+		return false, pbs.schedule(ctx, blobRef, desc.Size)
+	case unreachable(err):
+		dcontext.GetLogger(ctx).Warnf("serving stale blob %s, the remote registry is unreachable: %v", desc.Digest, err)
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+// revalidate revalidates a cached manifest past its TTL with the remote
+// registry, refreshing its TTL if the remote registry still has it. It
+// reports whether the manifest is served stale, the remote registry being
+// unreachable.
+func (pms proxyManifestStore) revalidate(ctx context.Context, dgst digest.Digest, size int64) (bool, error) {
+	manifestRef, err := reference.WithDigest(pms.repositoryName, dgst)
+	if err != nil {
+		return false, err
+	}
+	if pms.scheduler == nil || !pms.scheduler.Stale(manifestRef) {
+		return false, nil
+	}
+
+	var exists bool
+	err = pms.authChallenger.tryEstablishChallenges(ctx)
+	if err == nil {
+		exists, err = pms.remoteManifests.Exists(ctx, dgst)
+	}
+	switch {
+	case err == nil && exists:
+		return false, pms.schedule(ctx, dgst, size)
+	case err == nil:
+		return false, distribution.ErrManifestUnknownRevision{Name: pms.repositoryName.Name(), Revision: dgst}
+	case unreachable(err):
+		dcontext.GetLogger(ctx).Warnf("serving stale manifest %s, the remote registry is unreachable: %v", dgst, err)
+		return true, nil
+	default:
+		return false, err
+	}
+}
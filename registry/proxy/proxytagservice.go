@@ -12,6 +12,9 @@ type proxyTagService struct {
 	localTags      distribution.TagService
 	remoteTags     distribution.TagService
 	authChallenger authChallenger
+
+	// pushThrough accepts pushes, if enabled
+	pushThrough *pushThrough
 }
 
 var _ distribution.TagService = proxyTagService{}
@@ -39,8 +42,16 @@ func (pt proxyTagService) Get(ctx context.Context, tag string) (v1.Descriptor, e
 	return desc, nil
 }
 
+// Tag tags a manifest pushed through, which the remote registry tagged when
+// it was put by tag.
 func (pt proxyTagService) Tag(ctx context.Context, tag string, desc v1.Descriptor) error {
-	return distribution.ErrUnsupported
+	if pt.pushThrough == nil {
+		return distribution.ErrUnsupported
+	}
+	if !pt.pushThrough.cache {
+		return nil
+	}
+	return pt.localTags.Tag(ctx, tag, desc)
 }
 
 func (pt proxyTagService) Untag(ctx context.Context, tag string) error {
@@ -0,0 +1,348 @@
+package scheduler
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// lowWatermark is the fraction of the maximum size the cache is evicted down
+// to once it exceeds it, so that eviction does not run on every pull.
+const lowWatermark = 0.9
+
+// lruEntry is a blob or manifest tracked by the LRUEvictor, cached in one or
+// more repositories. Fields are exported for serialization.
+type lruEntry struct {
+	Digest       digest.Digest `json:"digest"`
+	Size         int64         `json:"size"`
+	EntryType    int           `json:"entryType"`
+	Repositories []string      `json:"repositories"`
+	LastAccess   time.Time     `json:"lastAccess"`
+}
+
+// NewLRU returns a new LRUEvictor keeping the size of the cached content under
+// maxSize bytes.
+func NewLRU(ctx context.Context, driver driver.StorageDriver, path string, maxSize int64) *LRUEvictor {
+	return &LRUEvictor{
+		entries:         make(map[digest.Digest]*list.Element),
+		recency:         list.New(),
+		maxSize:         maxSize,
+		driver:          driver,
+		pathToStateFile: path,
+		ctx:             ctx,
+		stopped:         true,
+		evictChan:       make(chan struct{}, 1),
+		doneChan:        make(chan struct{}),
+		saveTimer:       time.NewTicker(indexSaveFrequency),
+	}
+}
+
+// LRUEvictor evicts the least recently pulled blobs and manifests of a pull
+// through cache once their total size exceeds a maximum. Content is tracked
+// by digest: evicting it removes it from every repository it was cached in.
+// Content cached while no LRUEvictor ran is not tracked, nor evicted.
+type LRUEvictor struct {
+	sync.Mutex
+
+	// entries indexes the elements of recency, which holds *lruEntry from
+	// the most to the least recently accessed.
+	entries map[digest.Digest]*list.Element
+	recency *list.List
+	size    int64
+	maxSize int64
+
+	driver          driver.StorageDriver
+	ctx             context.Context
+	pathToStateFile string
+
+	stopped bool
+
+	onBlobEvict     expiryFunc
+	onManifestEvict expiryFunc
+	pinned          func(digest.Digest) bool
+
+	indexDirty bool
+	saveTimer  *time.Ticker
+	evictChan  chan struct{}
+	doneChan   chan struct{}
+}
+
+// OnBlobEvict is called for every repository an evicted blob was cached in
+func (lru *LRUEvictor) OnBlobEvict(f expiryFunc) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	lru.onBlobEvict = f
+}
+
+// OnManifestEvict is called for every repository an evicted manifest was
+// cached in
+func (lru *LRUEvictor) OnManifestEvict(f expiryFunc) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	lru.onManifestEvict = f
+}
+
+// SkipPinned skips the eviction of the content f reports pinned, which is
+// still accounted for in the size of the cache
+func (lru *LRUEvictor) SkipPinned(f func(digest.Digest) bool) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	lru.pinned = f
+}
+
+// AddBlob records a blob of the given size cached in a repository
+func (lru *LRUEvictor) AddBlob(blobRef reference.Canonical, size int64) error {
+	return lru.add(blobRef, size, entryTypeBlob)
+}
+
+// AddManifest records a manifest of the given size cached in a repository
+func (lru *LRUEvictor) AddManifest(manifestRef reference.Canonical, size int64) error {
+	return lru.add(manifestRef, size, entryTypeManifest)
+}
+
+func (lru *LRUEvictor) add(ref reference.Canonical, size int64, eType int) error {
+	lru.Lock()
+	defer lru.Unlock()
+
+	if lru.stopped {
+		return fmt.Errorf("evictor not started")
+	}
+
+	if element, ok := lru.entries[ref.Digest()]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.addRepository(ref.Name())
+		entry.LastAccess = time.Now()
+		lru.recency.MoveToFront(element)
+	} else {
+		entry := &lruEntry{
+			Digest:       ref.Digest(),
+			Size:         size,
+			EntryType:    eType,
+			Repositories: []string{ref.Name()},
+			LastAccess:   time.Now(),
+		}
+		lru.entries[entry.Digest] = lru.recency.PushFront(entry)
+		lru.size += size
+	}
+	lru.indexDirty = true
+
+	if lru.size > lru.maxSize {
+		select {
+		case lru.evictChan <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (entry *lruEntry) addRepository(name string) {
+	for _, repository := range entry.Repositories {
+		if repository == name {
+			return
+		}
+	}
+	entry.Repositories = append(entry.Repositories, name)
+}
+
+// Touch records an access to cached content, if tracked
+func (lru *LRUEvictor) Touch(dgst digest.Digest) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	if element, ok := lru.entries[dgst]; ok {
+		element.Value.(*lruEntry).LastAccess = time.Now()
+		lru.recency.MoveToFront(element)
+		lru.indexDirty = true
+	}
+}
+
+// Remove stops tracking content removed from the cache by other means, such
+// as the expiry of its TTL
+func (lru *LRUEvictor) Remove(dgst digest.Digest) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	if element, ok := lru.entries[dgst]; ok {
+		lru.remove(element)
+		lru.indexDirty = true
+	}
+}
+
+func (lru *LRUEvictor) remove(element *list.Element) {
+	entry := lru.recency.Remove(element).(*lruEntry)
+	delete(lru.entries, entry.Digest)
+	lru.size -= entry.Size
+}
+
+// Size returns the total size of the tracked content
+func (lru *LRUEvictor) Size() int64 {
+	lru.Lock()
+	defer lru.Unlock()
+
+	return lru.size
+}
+
+// Start starts the evictor
+func (lru *LRUEvictor) Start() error {
+	lru.Lock()
+	defer lru.Unlock()
+
+	err := lru.readState()
+	if err != nil {
+		return err
+	}
+
+	if !lru.stopped {
+		return fmt.Errorf("evictor already started")
+	}
+
+	dcontext.GetLogger(lru.ctx).Infof("Starting cached object LRU evictor, %d of %d bytes used...", lru.size, lru.maxSize)
+	lru.stopped = false
+	if lru.size > lru.maxSize {
+		lru.evictChan <- struct{}{}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-lru.evictChan:
+				lru.evict()
+
+			case <-lru.saveTimer.C:
+				lru.Lock()
+				if !lru.indexDirty {
+					lru.Unlock()
+					continue
+				}
+
+				err := lru.writeState()
+				if err != nil {
+					dcontext.GetLogger(lru.ctx).Errorf("Error writing evictor state: %s", err)
+				} else {
+					lru.indexDirty = false
+				}
+				lru.Unlock()
+
+			case <-lru.doneChan:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// evict removes the least recently accessed content, unless pinned, until
+// the cache is under its low watermark. The callbacks run without holding the lock, so
+// that pulls are not blocked by the deletions.
+func (lru *LRUEvictor) evict() {
+	lru.Lock()
+	target := int64(float64(lru.maxSize) * lowWatermark)
+	var evicted []*lruEntry
+	for element := lru.recency.Back(); element != nil && lru.size > target; {
+		prev := element.Prev()
+		entry := element.Value.(*lruEntry)
+		if lru.pinned == nil || !lru.pinned(entry.Digest) {
+			evicted = append(evicted, entry)
+			lru.remove(element)
+		}
+		element = prev
+	}
+	if len(evicted) > 0 {
+		lru.indexDirty = true
+	}
+	onBlobEvict, onManifestEvict := lru.onBlobEvict, lru.onManifestEvict
+	lru.Unlock()
+
+	for _, entry := range evicted {
+		f := onBlobEvict
+		if entry.EntryType == entryTypeManifest {
+			f = onManifestEvict
+		}
+		if f == nil {
+			continue
+		}
+		dcontext.GetLogger(lru.ctx).Infof("Evicting %s (%d bytes) accessed at %s", entry.Digest, entry.Size, entry.LastAccess)
+		for _, repository := range entry.Repositories {
+			named, err := reference.WithName(repository)
+			if err != nil {
+				dcontext.GetLogger(lru.ctx).Errorf("Error unpacking reference: %s", err)
+				continue
+			}
+			ref, err := reference.WithDigest(named, entry.Digest)
+			if err != nil {
+				dcontext.GetLogger(lru.ctx).Errorf("Error unpacking reference: %s", err)
+				continue
+			}
+			if err := f(ref); err != nil {
+				dcontext.GetLogger(lru.ctx).Errorf("Evictor error returned from OnEvict(%s): %s", ref, err)
+			}
+		}
+	}
+}
+
+// Stop stops the evictor.
+func (lru *LRUEvictor) Stop() error {
+	lru.Lock()
+	defer lru.Unlock()
+
+	err := lru.writeState()
+	if err != nil {
+		err = fmt.Errorf("error writing evictor state: %w", err)
+	}
+
+	close(lru.doneChan)
+	lru.saveTimer.Stop()
+	lru.stopped = true
+	return err
+}
+
+// writeState saves the entries from the least to the most recently accessed.
+func (lru *LRUEvictor) writeState() error {
+	entries := make([]*lruEntry, 0, lru.recency.Len())
+	for element := lru.recency.Back(); element != nil; element = element.Prev() {
+		entries = append(entries, element.Value.(*lruEntry))
+	}
+	jsonBytes, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	return lru.driver.PutContent(lru.ctx, lru.pathToStateFile, jsonBytes)
+}
+
+func (lru *LRUEvictor) readState() error {
+	bytes, err := lru.driver.GetContent(lru.ctx, lru.pathToStateFile)
+	if err != nil {
+		switch err := err.(type) {
+		case driver.PathNotFoundError:
+			return nil
+		default:
+			return err
+		}
+	}
+
+	var entries []*lruEntry
+	if err := json.Unmarshal(bytes, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := lru.entries[entry.Digest]; ok {
+			continue
+		}
+		lru.entries[entry.Digest] = lru.recency.PushFront(entry)
+		lru.size += entry.Size
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+func canonicalRefs(t *testing.T) (reference.Canonical, reference.Canonical, reference.Canonical) {
+	ref1, ref2, ref3 := testRefs(t)
+	return ref1.(reference.Canonical), ref2.(reference.Canonical), ref3.(reference.Canonical)
+}
+
+func TestLRUEviction(t *testing.T) {
+	ref1, ref2, ref3 := canonicalRefs(t)
+
+	var mu sync.Mutex
+	evicted := make(map[string]bool)
+	evictedChan := make(chan struct{}, 3)
+	onEvict := func(ref reference.Reference) error {
+		mu.Lock()
+		evicted[ref.String()] = true
+		mu.Unlock()
+		evictedChan <- struct{}{}
+		return nil
+	}
+
+	lru := NewLRU(dcontext.Background(), inmemory.New(), "/lru", 100)
+	lru.OnBlobEvict(onEvict)
+	lru.OnManifestEvict(onEvict)
+	if err := lru.Start(); err != nil {
+		t.Fatalf("Error starting LRUEvictor: %s", err)
+	}
+	defer lru.Stop()
+
+	if err := lru.AddBlob(ref1, 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := lru.AddManifest(ref2, 40); err != nil {
+		t.Fatal(err)
+	}
+	// the first blob is now more recently accessed than the manifest
+	lru.Touch(ref1.Digest())
+	if err := lru.AddBlob(ref3, 40); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-evictedChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the eviction")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !evicted[ref2.String()] || len(evicted) != 1 {
+		t.Fatalf("expected the least recently accessed manifest to be evicted, got %v", evicted)
+	}
+	if size := lru.Size(); size != 80 {
+		t.Fatalf("unexpected size after eviction: %d", size)
+	}
+}
+
+func TestLRURestoreState(t *testing.T) {
+	ref1, ref2, ref3 := canonicalRefs(t)
+	driver := inmemory.New()
+
+	lru := NewLRU(dcontext.Background(), driver, "/lru", 100)
+	if err := lru.Start(); err != nil {
+		t.Fatalf("Error starting LRUEvictor: %s", err)
+	}
+	for _, ref := range []reference.Canonical{ref1, ref2, ref3} {
+		if err := lru.AddBlob(ref, 30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lru.Touch(ref1.Digest())
+	lru.Remove(ref3.Digest())
+	if err := lru.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restored with a lower maximum size, the least recently accessed blob
+	// is evicted on start
+	evictedChan := make(chan string, 2)
+	lru = NewLRU(dcontext.Background(), driver, "/lru", 50)
+	lru.OnBlobEvict(func(ref reference.Reference) error {
+		evictedChan <- ref.String()
+		return nil
+	})
+	if err := lru.Start(); err != nil {
+		t.Fatalf("Error starting LRUEvictor: %s", err)
+	}
+	defer lru.Stop()
+
+	select {
+	case ref := <-evictedChan:
+		if ref != ref2.String() {
+			t.Fatalf("expected %s to be evicted, got %s", ref2, ref)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the eviction")
+	}
+	if size := lru.Size(); size != 30 {
+		t.Fatalf("unexpected size after eviction: %d", size)
+	}
+}
+
+func TestLRUSkipPinned(t *testing.T) {
+	ref1, ref2, ref3 := canonicalRefs(t)
+
+	evictedChan := make(chan string, 3)
+	lru := NewLRU(dcontext.Background(), inmemory.New(), "/lru", 100)
+	lru.OnBlobEvict(func(ref reference.Reference) error {
+		evictedChan <- ref.String()
+		return nil
+	})
+	lru.SkipPinned(func(dgst digest.Digest) bool {
+		return dgst == ref1.Digest()
+	})
+	if err := lru.Start(); err != nil {
+		t.Fatalf("Error starting LRUEvictor: %s", err)
+	}
+	defer lru.Stop()
+
+	// the pinned blob is the least recently accessed
+	for _, ref := range []reference.Canonical{ref1, ref2, ref3} {
+		if err := lru.AddBlob(ref, 40); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case ref := <-evictedChan:
+		if ref != ref2.String() {
+			t.Fatalf("expected %s to be evicted, got %s", ref2, ref)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the eviction")
+	}
+	if size := lru.Size(); size != 80 {
+		t.Fatalf("unexpected size after eviction: %d", size)
+	}
+}
@@ -27,6 +27,9 @@ type schedulerEntry struct {
 	Key       string    `json:"Key"`
 	Expiry    time.Time `json:"ExpiryData"`
 	EntryType int       `json:"EntryType"`
+	// Stale is set once the TTL expired, while the entry is kept to be
+	// served stale.
+	Stale bool `json:"Stale,omitempty"`
 
 	timer *time.Timer
 }
@@ -60,6 +63,9 @@ type TTLExpirationScheduler struct {
 	onBlobExpire     expiryFunc
 	onManifestExpire expiryFunc
 
+	serveStale bool
+	maxStale   time.Duration
+
 	indexDirty bool
 	saveTimer  *time.Ticker
 	doneChan   chan struct{}
@@ -81,6 +87,27 @@ func (ttles *TTLExpirationScheduler) OnManifestExpire(f expiryFunc) {
 	ttles.onManifestExpire = f
 }
 
+// ServeStale keeps the entries whose TTL expires, marked stale, for maxStale
+// before calling the expiry functions, or until they are added again if
+// maxStale is zero. It must be called before the scheduler is started.
+func (ttles *TTLExpirationScheduler) ServeStale(maxStale time.Duration) {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	ttles.serveStale = true
+	ttles.maxStale = maxStale
+}
+
+// Stale reports whether the TTL of a scheduled reference expired, the entry
+// being kept to be served stale
+func (ttles *TTLExpirationScheduler) Stale(ref reference.Canonical) bool {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	entry, ok := ttles.entries[ref.String()]
+	return ok && entry.Stale
+}
+
 // AddBlob schedules a blob cleanup after ttl expires
 func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl time.Duration) error {
 	ttles.Lock()
@@ -126,6 +153,9 @@ func (ttles *TTLExpirationScheduler) Start() error {
 
 	// Start timer for each deserialized entry
 	for _, entry := range ttles.entries {
+		if entry.Stale && ttles.serveStale && ttles.maxStale == 0 {
+			continue
+		}
 		entry.timer = ttles.startTimer(entry, time.Until(entry.Expiry))
 	}
 
@@ -178,6 +208,18 @@ func (ttles *TTLExpirationScheduler) startTimer(entry *schedulerEntry, ttl time.
 		ttles.Lock()
 		defer ttles.Unlock()
 
+		if ttles.serveStale && !entry.Stale {
+			dcontext.GetLogger(ttles.ctx).Infof("Keeping stale scheduler entry for %s", entry.Key)
+			entry.Stale = true
+			entry.timer = nil
+			if ttles.maxStale > 0 {
+				entry.Expiry = time.Now().Add(ttles.maxStale)
+				entry.timer = ttles.startTimer(entry, ttles.maxStale)
+			}
+			ttles.indexDirty = true
+			return
+		}
+
 		var f expiryFunc
 
 		switch entry.EntryType {
@@ -216,7 +258,9 @@ func (ttles *TTLExpirationScheduler) Stop() error {
 	}
 
 	for _, entry := range ttles.entries {
-		entry.timer.Stop()
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
 	}
 
 	close(ttles.doneChan)
@@ -215,3 +215,50 @@ func TestDoubleStart(t *testing.T) {
 		t.Fatal("Scheduler started twice without error")
 	}
 }
+
+func TestServeStale(t *testing.T) {
+	ref1, ref2, _ := canonicalRefs(t)
+
+	expired := make(chan string, 2)
+	s := New(dcontext.Background(), inmemory.New(), "/ttl")
+	s.OnBlobExpire(func(ref reference.Reference) error {
+		expired <- ref.String()
+		return nil
+	})
+	s.ServeStale(50 * time.Millisecond)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	if err := s.AddBlob(ref1, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(ref2, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !s.Stale(ref1) || !s.Stale(ref2) {
+		t.Fatal("expected the expired entries to be kept stale")
+	}
+
+	// adding the entry again refreshes it
+	if err := s.AddBlob(ref2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if s.Stale(ref2) {
+		t.Fatal("expected the entry added again not to be stale")
+	}
+
+	select {
+	case ref := <-expired:
+		if ref != ref1.String() {
+			t.Fatalf("unexpected expiry of %s", ref)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stale entry to expire")
+	}
+	if s.Stale(ref1) {
+		t.Fatal("expected the stale entry to be removed")
+	}
+}
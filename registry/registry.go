@@ -3,7 +3,6 @@ package registry
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/http"
@@ -121,7 +120,7 @@ var ServeCmd = &cobra.Command{
 			logrus.Fatalln(err)
 		}
 
-		configureDebugServer(config)
+		configureDebugServer(config, registry.app)
 
 		if err = registry.ListenAndServe(); err != nil {
 			logrus.Fatalln(err)
@@ -147,6 +146,8 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 		return nil, fmt.Errorf("error configuring logger: %v", err)
 	}
 
+	go config.RenewSecrets(ctx)
+
 	app := handlers.NewApp(ctx, config)
 	// TODO(aaronl): The global scope of the health checks means NewRegistry
 	// can only be called once per process.
@@ -289,23 +290,6 @@ func (registry *Registry) ListenAndServe() error {
 		}
 
 		if len(config.HTTP.TLS.ClientCAs) != 0 {
-			pool := x509.NewCertPool()
-
-			for _, ca := range config.HTTP.TLS.ClientCAs {
-				caPem, err := os.ReadFile(ca)
-				if err != nil {
-					return err
-				}
-
-				if ok := pool.AppendCertsFromPEM(caPem); !ok {
-					return fmt.Errorf("could not add CA to pool")
-				}
-			}
-
-			for _, subj := range pool.Subjects() { //nolint:staticcheck // FIXME(thaJeztah): ignore SA1019: ac.(*accessController).rootCerts.Subjects has been deprecated since Go 1.18: if s was returned by SystemCertPool, Subjects will not include the system roots. (staticcheck)
-				dcontext.GetLogger(registry.app).Debugf("CA Subject: %s", string(subj))
-			}
-
 			if config.HTTP.TLS.ClientAuth != "" {
 				tlsClientAuthMod, ok := tlsClientAuth[string(config.HTTP.TLS.ClientAuth)]
 
@@ -318,7 +302,18 @@ func (registry *Registry) ListenAndServe() error {
 				tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
 			}
 
-			tlsConf.ClientCAs = pool
+			// the client CAs are reloaded when the files change
+			cas, err := newClientCAs(config.HTTP.TLS.ClientCAs, tlsConf, dcontext.GetLogger(registry.app))
+			if err != nil {
+				return err
+			}
+
+			for _, subj := range cas.pool().Subjects() { //nolint:staticcheck // FIXME(thaJeztah): ignore SA1019: ac.(*accessController).rootCerts.Subjects has been deprecated since Go 1.18: if s was returned by SystemCertPool, Subjects will not include the system roots. (staticcheck)
+				dcontext.GetLogger(registry.app).Debugf("CA Subject: %s", string(subj))
+			}
+
+			tlsConf.ClientCAs = cas.pool()
+			tlsConf.GetConfigForClient = cas.getConfigForClient
 		}
 
 		ln = tls.NewListener(ln, tlsConf)
@@ -358,11 +353,20 @@ func (registry *Registry) Shutdown(ctx context.Context) error {
 	if appErr := registry.app.Shutdown(); appErr != nil {
 		err = errors.Join(err, appErr)
 	}
+	if secretsErr := registry.config.RemoveSecrets(); secretsErr != nil {
+		err = errors.Join(err, secretsErr)
+	}
 	return err
 }
 
-func configureDebugServer(config *configuration.Configuration) {
+func configureDebugServer(config *configuration.Configuration, app *handlers.App) {
 	if config.HTTP.Debug.Addr != "" {
+		if h := app.GCStatusHandler(); h != nil {
+			http.Handle("/debug/gc", h)
+		}
+		if h := app.ProxyPinnedHandler(); h != nil {
+			http.Handle("/debug/proxy/pinned", h)
+		}
 		go func(addr string) {
 			logrus.Infof("debug server listening %v", addr)
 			if err := http.ListenAndServe(addr, nil); err != nil {
@@ -1,13 +1,24 @@
 package registry
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/car"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/registry/doctor"
+	"github.com/distribution/distribution/v3/registry/handlers"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	"github.com/distribution/distribution/v3/version"
+	"github.com/distribution/reference"
 	"github.com/spf13/cobra"
 )
 
@@ -18,6 +29,40 @@ func init() {
 	RootCmd.AddCommand(GCCmd)
 	GCCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "do everything except remove the blobs")
 	GCCmd.Flags().BoolVarP(&removeUntagged, "delete-untagged", "m", false, "delete manifests that are not currently referenced via tag")
+	GCCmd.Flags().DurationVar(&removeUntaggedOlderThan, "delete-untagged-older-than", 0, "delete manifests that are not currently referenced via tag and were pushed longer than the given duration ago, implies --delete-untagged")
+	GCCmd.Flags().DurationVar(&removeTagsNotPulledFor, "delete-tags-not-pulled-for", 0, "delete tags whose manifest has not been pulled or pushed within the given duration, based on the recorded pull statistics")
+	GCCmd.Flags().DurationVar(&gracePeriod, "grace-period", 0, "keep the content written within the given duration, so that garbage collection can run while the registry serves writes")
+	GCCmd.Flags().StringVar(&reportPath, "report", "", "write a report of the manifests, layers and blobs eligible for deletion to the given file")
+	GCCmd.Flags().StringVar(&reportFormat, "report-format", "json", "format of the report, json or csv")
+	GCCmd.Flags().IntVar(&gcConcurrency, "concurrency", 1, "number of repositories marked, and of batches of blobs deleted, at once")
+	GCCmd.Flags().DurationVar(&progressInterval, "progress", 0, "print the progress of the mark and sweep phases to stderr at the given interval")
+	GCCmd.Flags().BoolVar(&incremental, "incremental", false, "delete the blobs whose reference count dropped to zero longer than the grace period ago instead of walking the registry, requires the reference counts built by rebuild-refcounts")
+	RootCmd.AddCommand(RebuildRefCountsCmd)
+	RootCmd.AddCommand(PruneCmd)
+	PruneCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "list the tags eligible for deletion without deleting them")
+	RootCmd.AddCommand(FsckCmd)
+	FsckCmd.Flags().StringVar(&fsckFormat, "format", "text", "format of the report, text or json")
+	RootCmd.AddCommand(RepairCmd)
+	RepairCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "print the repairs without applying them")
+	RootCmd.AddCommand(MigrateCmd)
+	MigrateCmd.Flags().StringVar(&migrateFrom, "from", "", "configuration of the storage migrated from")
+	MigrateCmd.Flags().StringVar(&migrateTo, "to", "", "configuration of the storage migrated to")
+	MigrateCmd.Flags().IntVar(&migrateOpts.Concurrency, "concurrency", 8, "number of files copied at once")
+	MigrateCmd.Flags().BoolVar(&migrateOpts.Verify, "verify", true, "verify the blobs and the consistency of the destination once copied")
+	MigrateCmd.Flags().DurationVar(&progressInterval, "progress", 0, "print the progress of the migration to stderr at the given interval")
+	RootCmd.AddCommand(DuCmd)
+	DuCmd.Flags().StringVar(&duFormat, "format", "text", "format of the report, text or json")
+	DuCmd.Flags().IntVar(&duOpts.Depth, "depth", 1, "number of path components of the repository names making their namespace")
+	RootCmd.AddCommand(ExportCmd)
+	ExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "write an OCI image layout to the given directory, or tar archive if it ends in .tar, instead of a CAR file")
+	RootCmd.AddCommand(ImportCmd)
+	RootCmd.AddCommand(DoctorCmd)
+	DoctorCmd.Flags().StringVar(&doctorOptions.Repository, "repository", doctor.DefaultRepository, "repository the canary image is pushed to")
+	DoctorCmd.Flags().StringVarP(&doctorOptions.Username, "username", "u", "", "username to authenticate with")
+	DoctorCmd.Flags().StringVarP(&doctorOptions.Password, "password", "p", "", "password to authenticate with, defaults to the REGISTRY_DOCTOR_PASSWORD environment variable")
+	DoctorCmd.Flags().BoolVar(&doctorOptions.Insecure, "insecure", false, "skip the verification of TLS certificates")
+	DoctorCmd.Flags().DurationVar(&doctorOptions.MaxClockSkew, "max-clock-skew", doctor.DefaultMaxClockSkew, "clock skew above which a warning is reported")
+	DoctorCmd.Flags().DurationVar(&doctorTimeout, "timeout", 2*time.Minute, "time allowed for the whole diagnosis")
 	RootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show the version and exit")
 }
 
@@ -37,15 +82,23 @@ var RootCmd = &cobra.Command{
 }
 
 var (
-	dryRun         bool
-	removeUntagged bool
+	dryRun                  bool
+	removeUntagged          bool
+	removeUntaggedOlderThan time.Duration
+	removeTagsNotPulledFor  time.Duration
+	gracePeriod             time.Duration
+	reportPath              string
+	reportFormat            string
+	gcConcurrency           int
+	progressInterval        time.Duration
+	incremental             bool
 )
 
 // GCCmd is the cobra command that corresponds to the garbage-collect subcommand
 var GCCmd = &cobra.Command{
-	Use:   "garbage-collect <config>",
+	Use:   "garbage-collect <config> [repository]",
 	Short: "`garbage-collect` deletes layers not referenced by any manifests",
-	Long:  "`garbage-collect` deletes layers not referenced by any manifests",
+	Long:  "`garbage-collect` deletes layers not referenced by any manifests. Given a repository, it only collects the garbage of that repository.",
 	Run: func(cmd *cobra.Command, args []string) {
 		config, err := resolveConfiguration(args)
 		if err != nil {
@@ -55,6 +108,25 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		var repository string
+		if len(args) > 1 {
+			named, err := reference.WithName(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid repository name %s: %v\n", args[1], err)
+				os.Exit(1)
+			}
+			repository = named.Name()
+		}
+
+		var report *storage.GCReport
+		if reportPath != "" {
+			if reportFormat != "json" && reportFormat != "csv" {
+				fmt.Fprintf(os.Stderr, "unsupported report format: %s\n", reportFormat)
+				os.Exit(1)
+			}
+			report = &storage.GCReport{}
+		}
+
 		ctx := dcontext.Background()
 		ctx, err = configureLogging(ctx, config)
 		if err != nil {
@@ -74,13 +146,694 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		var pullStats *storage.PullStats
+		if pullStatsEnabled(config) {
+			pullStats = storage.NewPullStats(driver)
+		} else if removeTagsNotPulledFor > 0 {
+			fmt.Fprintln(os.Stderr, "--delete-tags-not-pulled-for requires pull statistics, enable maintenance.pullstats in the configuration")
+			os.Exit(1)
+		}
+
+		var refCounter *storage.RefCounter
+		if incremental {
+			refCounter = storage.NewRefCounter(driver)
+		}
+
 		err = storage.MarkAndSweep(ctx, driver, registry, storage.GCOpts{
-			DryRun:         dryRun,
-			RemoveUntagged: removeUntagged,
+			DryRun:                  dryRun,
+			RemoveUntagged:          removeUntagged || removeUntaggedOlderThan > 0,
+			RemoveUntaggedOlderThan: removeUntaggedOlderThan,
+			PullStats:               pullStats,
+			RemoveTagsNotPulledFor:  removeTagsNotPulledFor,
+			GracePeriod:             gracePeriod,
+			Report:                  report,
+			Repository:              repository,
+			Concurrency:             gcConcurrency,
+			Progress:                printGCProgress(progressInterval),
+			RefCounter:              refCounter,
 		})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to garbage collect: %v", err)
 			os.Exit(1)
 		}
+
+		if report != nil {
+			if err := writeGCReport(report, reportPath, reportFormat); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+// pullStatsEnabled reports whether the registry records pull statistics
+// according to the pullstats maintenance section of config.
+func pullStatsEnabled(config *configuration.Configuration) bool {
+	v, ok := config.Storage["maintenance"]["pullstats"]
+	if !ok {
+		return false
+	}
+	pullStatsConfig, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return false
+	}
+	enabled, ok := pullStatsConfig["enabled"].(bool)
+	return !ok || enabled
+}
+
+// printGCProgress returns the GCOpts.Progress function printing the progress
+// of the collection to stderr at interval, or nil if interval is zero.
+func printGCProgress(interval time.Duration) func(storage.GCProgress) {
+	if interval <= 0 {
+		return nil
+	}
+	var phase string
+	var last time.Time
+	return func(p storage.GCProgress) {
+		if p.Phase == phase && time.Since(last) < interval {
+			return
+		}
+		phase, last = p.Phase, time.Now()
+		fmt.Fprintln(os.Stderr, p)
+	}
+}
+
+// writeGCReport writes the garbage collection report to the file at path, in
+// the given format.
+func writeGCReport(report *storage.GCReport, path, format string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if format == "csv" {
+		err = report.WriteCSV(f)
+	} else {
+		err = report.WriteJSON(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// PruneCmd is the cobra command that corresponds to the prune subcommand
+var PruneCmd = &cobra.Command{
+	Use:   "prune <config> <policies>",
+	Short: "`prune` deletes the tags selected by prune policies",
+	Long:  "`prune` deletes the tags selected by the policies of a YAML file, keeping the newest tags, the recent tags and the tags listed, and notifies the configured endpoints of the deleted tags. `garbage-collect` then reclaims their content.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		f, err := os.Open(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", args[1], err)
+			os.Exit(1)
+		}
+		policies, err := storage.ParsePrunePolicies(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse %s: %v\n", args[1], err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s\n", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v\n", err)
+			os.Exit(1)
+		}
+
+		// the events are flushed to the endpoints before exiting
+		sink := handlers.NewEventSink(ctx, config)
+		hostname, _ := os.Hostname()
+		listener := notifications.NewBridge(nil, notifications.SourceRecord{Addr: hostname}, notifications.ActorRecord{Name: "registry prune"}, notifications.RequestRecord{}, sink, false)
+
+		_, err = storage.Prune(ctx, driver, registry, storage.PruneOpts{
+			Policies: policies,
+			DryRun:   dryRun,
+			OnDelete: func(ctx context.Context, tag storage.PrunedTag) {
+				named, err := reference.WithName(tag.Repository)
+				if err == nil {
+					err = listener.TagDeleted(named, tag.Tag)
+				}
+				if err != nil {
+					dcontext.GetLogger(ctx).Errorf("error writing tag delete event: %v", err)
+				}
+			},
+		})
+		if closeErr := sink.Close(); closeErr != nil {
+			dcontext.GetLogger(ctx).Errorf("error flushing events: %v", closeErr)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to prune: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var fsckFormat string
+
+// FsckCmd is the cobra command that corresponds to the fsck subcommand
+var FsckCmd = &cobra.Command{
+	Use:   "fsck <config> [repository]",
+	Short: "`fsck` checks the consistency of the storage of the registry",
+	Long: "`fsck` checks that the layer, manifest and tag links resolve to blobs, that the manifests parse, " +
+		"that the content they reference is linked into their repository and that the tags point to manifest revisions, " +
+		"and prints a report of the inconsistencies by category. Given a repository, it only checks that repository. " +
+		"It exits with status 1 if inconsistencies are found.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if fsckFormat != "text" && fsckFormat != "json" {
+			fmt.Fprintf(os.Stderr, "unsupported report format: %s\n", fsckFormat)
+			os.Exit(1)
+		}
+
+		var repository string
+		if len(args) > 1 {
+			named, err := reference.WithName(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid repository name %s: %v\n", args[1], err)
+				os.Exit(1)
+			}
+			repository = named.Name()
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s\n", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v\n", err)
+			os.Exit(1)
+		}
+
+		report, err := storage.Fsck(ctx, driver, registry, storage.FsckOpts{Repository: repository})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to check the storage: %v\n", err)
+			os.Exit(1)
+		}
+		if fsckFormat == "json" {
+			err = report.WriteJSON(os.Stdout)
+		} else {
+			err = report.WriteText(os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+			os.Exit(1)
+		}
+		if len(report.Issues) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// RepairCmd is the cobra command that corresponds to the repair subcommand
+var RepairCmd = &cobra.Command{
+	Use:   "repair <config> [repository]",
+	Short: "`repair` repairs the inconsistencies of the storage found by `fsck`",
+	Long: "`repair` removes the invalid and dangling links and tags, re-creates the missing tag index entries " +
+		"and quarantines the unparseable manifests found by `fsck`, and prints the repairs and the inconsistencies left. " +
+		"Given a repository, it only repairs that repository. The registry must not serve writes while repairing its storage.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		var repository string
+		if len(args) > 1 {
+			named, err := reference.WithName(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid repository name %s: %v\n", args[1], err)
+				os.Exit(1)
+			}
+			repository = named.Name()
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s\n", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v\n", err)
+			os.Exit(1)
+		}
+
+		actions, left, err := storage.Repair(ctx, driver, registry, storage.RepairOpts{Repository: repository, DryRun: dryRun})
+		for _, action := range actions {
+			fmt.Printf("%s %s: %s\n", action.Action, action.Path, action.Issue.Message)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to repair the storage: %v\n", err)
+			os.Exit(1)
+		}
+		for _, issue := range left {
+			fmt.Printf("left %s: %s: %s\n", issue.Category, issue.Path, issue.Message)
+		}
+		repaired := "repaired"
+		if dryRun {
+			repaired = "to repair"
+		}
+		fmt.Printf("%d issues %s, %d left\n", len(actions), repaired, len(left))
+		if len(left) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var (
+	migrateFrom string
+	migrateTo   string
+	migrateOpts storage.MigrateOpts
+)
+
+// MigrateCmd is the cobra command that corresponds to the migrate subcommand
+var MigrateCmd = &cobra.Command{
+	Use:   "migrate --from <config> --to <config>",
+	Short: "`migrate` copies the storage of the registry to another storage driver",
+	Long: "`migrate` copies the blobs, repositories and tags of the storage configured by --from to the storage configured by --to, " +
+		"such as from the filesystem to S3, then verifies the destination. An interrupted migration is resumed by running it again, " +
+		"skipping the files already copied. The registry must not serve writes while its storage is migrated.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if migrateFrom == "" || migrateTo == "" || len(args) != 0 {
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		fromConfig, err := resolveConfiguration([]string{migrateFrom})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			os.Exit(1)
+		}
+		toConfig, err := resolveConfiguration([]string{migrateTo})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, fromConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s\n", err)
+			os.Exit(1)
+		}
+
+		from, err := factory.Create(ctx, fromConfig.Storage.Type(), fromConfig.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", fromConfig.Storage.Type(), err)
+			os.Exit(1)
+		}
+		to, err := factory.Create(ctx, toConfig.Storage.Type(), toConfig.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", toConfig.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		opts := migrateOpts
+		opts.Progress = printMigrateProgress(progressInterval)
+		report, err := storage.Migrate(ctx, from, to, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to migrate: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d files copied, %d bytes, %d files skipped\n", report.Files, report.Bytes, report.Skipped)
+		if !opts.Verify {
+			return
+		}
+		for _, blob := range report.Corrupt {
+			fmt.Printf("corrupt blob %s: content has digest %s\n", blob.Digest, blob.Computed)
+		}
+		for _, issue := range report.Issues {
+			fmt.Printf("%s: %s: %s\n", issue.Category, issue.Path, issue.Message)
+		}
+		if len(report.Corrupt) > 0 || len(report.Issues) > 0 {
+			fmt.Fprintf(os.Stderr, "verification failed: %d corrupt blobs, %d inconsistencies\n", len(report.Corrupt), len(report.Issues))
+			os.Exit(1)
+		}
+		fmt.Println("verified the destination")
+	},
+}
+
+// printMigrateProgress returns the MigrateOpts.Progress function printing the
+// progress of the migration to stderr at interval, or nil if interval is
+// zero.
+func printMigrateProgress(interval time.Duration) func(storage.MigrateProgress) {
+	if interval <= 0 {
+		return nil
+	}
+	var phase string
+	var last time.Time
+	return func(p storage.MigrateProgress) {
+		if p.Phase == phase && time.Since(last) < interval {
+			return
+		}
+		phase, last = p.Phase, time.Now()
+		fmt.Fprintln(os.Stderr, p)
+	}
+}
+
+var (
+	duFormat string
+	duOpts   storage.DiskUsageOpts
+)
+
+// DuCmd is the cobra command that corresponds to the du subcommand
+var DuCmd = &cobra.Command{
+	Use:   "du <config>",
+	Short: "`du` reports the storage used by every repository and namespace",
+	Long: "`du` reports the number and size of the blobs linked into every repository and namespace, " +
+		"telling apart the unique blobs, which deleting them would reclaim, from the blobs shared with others, " +
+		"along with the size of the blob store and of the blobs linked into no repository.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if duFormat != "text" && duFormat != "json" {
+			fmt.Fprintf(os.Stderr, "unsupported report format: %s\n", duFormat)
+			os.Exit(1)
+		}
+		if duOpts.Depth < 1 {
+			fmt.Fprintf(os.Stderr, "invalid namespace depth: %d\n", duOpts.Depth)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s\n", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v\n", err)
+			os.Exit(1)
+		}
+
+		report, err := storage.DiskUsage(ctx, driver, registry, duOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to measure the storage: %v\n", err)
+			os.Exit(1)
+		}
+		if duFormat == "json" {
+			err = report.WriteJSON(os.Stdout)
+		} else {
+			err = report.WriteText(os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// RebuildRefCountsCmd is the cobra command that corresponds to the rebuild-refcounts subcommand
+var RebuildRefCountsCmd = &cobra.Command{
+	Use:   "rebuild-refcounts <config>",
+	Short: "`rebuild-refcounts` recomputes the reference counts of the blobs",
+	Long: "`rebuild-refcounts` walks the registry to recompute the number of manifests referencing every blob, " +
+		"which the registry then maintains on every manifest put and delete when reference counting is enabled, " +
+		"and which garbage-collect --incremental requires. The registry must not serve writes while the counts are rebuilt.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s\n", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := storage.RebuildRefCounts(ctx, storage.NewRefCounter(driver), registry); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rebuild the reference counts: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var exportOutput string
+
+// ExportCmd is the cobra command that corresponds to the export subcommand
+var ExportCmd = &cobra.Command{
+	Use:   "export <config> <repository> [file]",
+	Short: "`export` writes the manifests, tags and blobs of a repository to a CAR file or an OCI image layout",
+	Long:  "`export` writes the manifests, tags and blobs of a repository to an indexed CARv2 file or, with --output, to an OCI image layout in a directory or, if the output ends in .tar, in a tar archive, which can be imported into another registry",
+	Run: func(cmd *cobra.Command, args []string) {
+		if (exportOutput == "" && len(args) != 3) || (exportOutput != "" && len(args) != 2) {
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		ctx, repository := openRepository(cmd, args)
+
+		if exportOutput != "" && !strings.HasSuffix(exportOutput, ".tar") {
+			if err := storage.ExportRepositoryLayout(ctx, repository, exportOutput); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to export %s: %v\n", args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		output := exportOutput
+		if output == "" {
+			output = args[2]
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create %s: %v\n", output, err)
+			os.Exit(1)
+		}
+		if exportOutput != "" {
+			err = storage.ExportRepositoryLayoutArchive(ctx, repository, f)
+		} else {
+			err = storage.ExportRepository(ctx, repository, f)
+		}
+		if err != nil {
+			_ = f.Close()
+			fmt.Fprintf(os.Stderr, "failed to export %s: %v\n", args[1], err)
+			os.Exit(1)
+		}
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write %s: %v\n", output, err)
+			os.Exit(1)
+		}
+	},
+}
+
+// ImportCmd is the cobra command that corresponds to the import subcommand
+var ImportCmd = &cobra.Command{
+	Use:   "import <config> <repository> <file-or-directory>",
+	Short: "`import` imports the manifests, tags and blobs of a CAR file or an OCI image layout into a repository",
+	Long:  "`import` imports the manifests, tags and blobs of a CARv2 file written by `export`, or of an OCI image layout in a directory or a tar archive, into a repository",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 3 {
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		ctx, repository := openRepository(cmd, args)
+
+		fi, err := os.Stat(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", args[2], err)
+			os.Exit(1)
+		}
+		if fi.IsDir() {
+			if err := storage.ImportRepositoryLayout(ctx, repository, args[2]); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to import %s: %v\n", args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		f, err := os.Open(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", args[2], err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		if isTar(f) {
+			err = storage.ImportRepositoryLayoutArchive(ctx, repository, f, fi.Size())
+		} else {
+			var r *car.Reader
+			r, err = car.NewReader(f)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", args[2], err)
+				os.Exit(1)
+			}
+			err = storage.ImportRepository(ctx, repository, r)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to import %s: %v\n", args[1], err)
+			os.Exit(1)
+		}
+	},
+}
+
+// isTar reports whether r holds a tar archive, by the magic of the header of
+// its first file.
+func isTar(r io.ReaderAt) bool {
+	magic := make([]byte, 5)
+	if _, err := r.ReadAt(magic, 257); err != nil {
+		return false
+	}
+	return string(magic) == "ustar"
+}
+
+// openRepository opens the repository named by args[1] in the storage of
+// the configuration at args[0], exiting on errors.
+func openRepository(cmd *cobra.Command, args []string) (context.Context, distribution.Repository) {
+	config, err := resolveConfiguration(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+		// nolint:errcheck
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	ctx := dcontext.Background()
+	ctx, err = configureLogging(ctx, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s\n", err)
+		os.Exit(1)
+	}
+
+	named, err := reference.WithName(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid repository name %s: %v\n", args[1], err)
+		os.Exit(1)
+	}
+
+	driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", config.Storage.Type(), err)
+		os.Exit(1)
+	}
+
+	registry, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to construct registry: %v\n", err)
+		os.Exit(1)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to construct repository: %v\n", err)
+		os.Exit(1)
+	}
+	return ctx, repository
+}
+
+var (
+	doctorOptions doctor.Options
+	doctorTimeout time.Duration
+)
+
+// DoctorCmd is the cobra command that corresponds to the doctor subcommand
+var DoctorCmd = &cobra.Command{
+	Use:   "doctor <url>",
+	Short: "`doctor` runs an end-to-end diagnosis of a live registry",
+	Long: "`doctor` runs an end-to-end diagnosis of a live registry: it pushes and pulls a canary image, " +
+		"resumes a chunked upload, follows blob redirects to the storage backend, checks the clock skew " +
+		"with the token service and prints a report",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "the URL of the registry is required")
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		opts := doctorOptions
+		opts.URL = args[0]
+		if opts.Password == "" {
+			opts.Password = os.Getenv("REGISTRY_DOCTOR_PASSWORD")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		defer cancel()
+		report, err := doctor.Run(ctx, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "doctor: %v\n", err)
+			os.Exit(1)
+		}
+		// nolint:errcheck
+		report.WriteTo(os.Stdout)
+		if report.Failed() {
+			os.Exit(1)
+		}
 	},
 }
@@ -0,0 +1,284 @@
+// Package vault provides a secrets provider reading the secrets referenced
+// in the configuration from HashiCorp Vault.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+const defaultTimeout = 10 * time.Second
+
+func init() {
+	configuration.RegisterSecretsProvider("vault", newProvider)
+}
+
+// provider fetches secrets from HashiCorp Vault, through its HTTP API.
+// It authenticates with a token, or logs in with AppRole credentials, and
+// renews its token before it expires.
+type provider struct {
+	address   *url.URL
+	namespace string
+	client    *http.Client
+	refresh   time.Duration
+
+	roleID   string
+	secretID string
+	mount    string
+
+	mu    sync.Mutex
+	token string
+}
+
+func newProvider(parameters configuration.Parameters) (configuration.SecretsProvider, error) {
+	v := &provider{mount: "approle"}
+
+	address, ok := parameters["address"].(string)
+	if !ok || address == "" {
+		return nil, errors.New(`"address" must be set`)
+	}
+	var err error
+	if v.address, err = url.Parse(address); err != nil || (v.address.Scheme != "https" && v.address.Scheme != "http") {
+		return nil, fmt.Errorf("invalid vault address %q", address)
+	}
+
+	for key, dest := range map[string]*string{"token": &v.token, "namespace": &v.namespace} {
+		if val, present := parameters[key]; present {
+			s, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("%q must be a string", key)
+			}
+			*dest = s
+		}
+	}
+
+	if approle, present := parameters["approle"]; present {
+		options := make(map[string]interface{})
+		switch m := approle.(type) {
+		case map[string]interface{}:
+			options = m
+		case map[interface{}]interface{}:
+			for k, val := range m {
+				if key, ok := k.(string); ok {
+					options[key] = val
+				}
+			}
+		default:
+			return nil, errors.New(`"approle" must be a map`)
+		}
+		for key, dest := range map[string]*string{"roleid": &v.roleID, "secretid": &v.secretID, "mount": &v.mount} {
+			if val, present := options[key]; present {
+				s, ok := val.(string)
+				if !ok || s == "" {
+					return nil, fmt.Errorf("approle %q must be a string", key)
+				}
+				*dest = s
+			}
+		}
+		if v.roleID == "" {
+			return nil, errors.New(`approle "roleid" must be set`)
+		}
+	}
+	if (v.token == "") == (v.roleID == "") {
+		return nil, errors.New(`exactly one of "token" or "approle" must be set`)
+	}
+
+	timeout := defaultTimeout
+	for key, dest := range map[string]*time.Duration{"timeout": &timeout, "refreshinterval": &v.refresh} {
+		if val, present := parameters[key]; present {
+			s, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("%q must be a string", key)
+			}
+			if *dest, err = time.ParseDuration(s); err != nil || *dest <= 0 {
+				return nil, fmt.Errorf("unable to parse %s: %q", key, s)
+			}
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if bundle, present := parameters["rootcertbundle"]; present {
+		path, ok := bundle.(string)
+		if !ok {
+			return nil, fmt.Errorf("%q must be a string", "rootcertbundle")
+		}
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read vault rootcertbundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in vault rootcertbundle %s", path)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	v.client = &http.Client{Transport: transport, Timeout: timeout}
+
+	return v, nil
+}
+
+// response is the body of the Vault API responses.
+type response struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// Secret reads a secret. Secrets of the KV version 2 secrets engine, read
+// from their data path, are unwrapped. Leased secrets, such as dynamic
+// database credentials, are fetched again when two thirds of their lease
+// have elapsed, and other secrets every refresh interval, if set.
+func (v *provider) Secret(ctx context.Context, path, field string) (string, time.Duration, error) {
+	var resp response
+	if err := v.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return "", 0, err
+	}
+
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", 0, fmt.Errorf("vault secret %s has no field %q", path, field)
+	}
+	s, ok := value.(string)
+	if !ok {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return "", 0, err
+		}
+		s = string(b)
+	}
+
+	ttl := v.refresh
+	if resp.LeaseDuration > 0 {
+		ttl = time.Duration(resp.LeaseDuration) * time.Second * 2 / 3
+	}
+	return s, ttl, nil
+}
+
+// Renew logs in with AppRole credentials if no token was obtained yet, or
+// renews the token when it has a limited lifetime. Tokens which cannot be
+// renewed anymore are replaced by logging in again, when possible.
+func (v *provider) Renew(ctx context.Context) (time.Duration, error) {
+	if v.roleID != "" && v.currentToken() == "" {
+		return v.login(ctx)
+	}
+
+	var lookup response
+	err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &lookup)
+	if err == nil {
+		ttl, _ := lookup.Data["ttl"].(float64)
+		renewable, _ := lookup.Data["renewable"].(bool)
+		if ttl == 0 {
+			// the token does not expire
+			return 0, nil
+		}
+		if renewable {
+			var renewal response
+			if err = v.do(ctx, http.MethodPost, "auth/token/renew-self", struct{}{}, &renewal); err == nil && renewal.Auth != nil {
+				return time.Duration(renewal.Auth.LeaseDuration) * time.Second * 2 / 3, nil
+			}
+		} else {
+			err = fmt.Errorf("vault token is not renewable and expires in %s", time.Duration(ttl)*time.Second)
+		}
+	}
+
+	if v.roleID != "" {
+		return v.login(ctx)
+	}
+	return 0, err
+}
+
+func (v *provider) login(ctx context.Context) (time.Duration, error) {
+	body := map[string]string{"role_id": v.roleID}
+	if v.secretID != "" {
+		body["secret_id"] = v.secretID
+	}
+
+	v.mu.Lock()
+	v.token = ""
+	v.mu.Unlock()
+
+	var resp response
+	if err := v.do(ctx, http.MethodPost, "auth/"+v.mount+"/login", body, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return 0, errors.New("vault approle login returned no token")
+	}
+
+	v.mu.Lock()
+	v.token = resp.Auth.ClientToken
+	v.mu.Unlock()
+	return time.Duration(resp.Auth.LeaseDuration) * time.Second * 2 / 3, nil
+}
+
+func (v *provider) currentToken() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.token
+}
+
+// do sends a request to the Vault API, and decodes the response into out.
+func (v *provider) do(ctx context.Context, method, path string, in interface{}, out *response) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	u := v.address.JoinPath("v1", strings.TrimPrefix(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if token := v.currentToken(); token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out); err != nil && err != io.EOF {
+		return fmt.Errorf("vault %s %s: invalid response: %v", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("vault %s %s: %s: %s", method, path, resp.Status, strings.Join(out.Errors, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// testVault is a fake Vault server holding a KV version 2 secret and a
+// dynamic secret changing on every read.
+type testVault struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	renewals    int
+	generations int
+}
+
+func newTestVault(t *testing.T) *testVault {
+	v := &testVault{}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		reply := func(body string) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, body)
+		}
+		if r.URL.Path == "/v1/auth/approle/login" {
+			var login map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login["role_id"] != "registry" || login["secret_id"] != "approle-secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				reply(`{"errors":["invalid role or secret ID"]}`)
+				return
+			}
+			reply(`{"auth":{"client_token":"approle-token","lease_duration":3600,"renewable":true}}`)
+			return
+		}
+
+		token := r.Header.Get("X-Vault-Token")
+		if (token != "test-token" && token != "approle-token") || r.Header.Get("X-Vault-Namespace") != "ns1" {
+			w.WriteHeader(http.StatusForbidden)
+			reply(`{"errors":["permission denied"]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			reply(`{"data":{"ttl":3600,"renewable":true}}`)
+		case "/v1/auth/token/renew-self":
+			v.renewals++
+			reply(`{"auth":{"client_token":"test-token","lease_duration":3600,"renewable":true}}`)
+		case "/v1/secret/data/registry":
+			reply(`{"lease_duration":0,"data":{"data":{"redis":"redis-password","htpasswd":"bob:$2y$05$hash","port":6379},"metadata":{"version":1}}}`)
+		case "/v1/database/creds/registry":
+			v.generations++
+			reply(fmt.Sprintf(`{"lease_duration":60,"data":{"password":"generation-%d"}}`, v.generations))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			reply(`{"errors":[]}`)
+		}
+	}))
+	t.Cleanup(v.Close)
+	return v
+}
+
+func TestVaultSecrets(t *testing.T) {
+	v := newTestVault(t)
+	t.Setenv("VAULT_TOKEN", "test-token")
+
+	config, err := configuration.Parse(strings.NewReader(fmt.Sprintf(`
+version: 0.1
+expandvariables: true
+storage:
+  inmemory:
+    password: ${secret:secret/data/registry#port}
+auth:
+  htpasswd:
+    realm: basic-realm
+    path: ${secretfile:secret/data/registry#htpasswd}
+redis:
+  addrs: [localhost:6379]
+  password: ${secret:secret/data/registry#redis}
+proxy:
+  password: ${secretfile:database/creds/registry#password}
+secrets:
+  vault:
+    address: %s
+    token: ${VAULT_TOKEN}
+    namespace: ns1
+`, v.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Redis.Options.Password != "redis-password" {
+		t.Errorf("unexpected redis password %q", config.Redis.Options.Password)
+	}
+	if password := config.Storage.Parameters()["password"]; password != "6379" {
+		t.Errorf("unexpected storage password %#v", password)
+	}
+	htpasswd, err := os.ReadFile(config.Auth.Parameters()["path"].(string))
+	if err != nil || string(htpasswd) != "bob:$2y$05$hash" {
+		t.Errorf("unexpected htpasswd file %q: %v", htpasswd, err)
+	}
+	file := config.Proxy.Password
+	if b, err := os.ReadFile(file); err != nil || string(b) != "generation-1" {
+		t.Errorf("unexpected secret file %q: %v", b, err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("unexpected secret file mode: %v %v", info.Mode(), err)
+	}
+	if v.renewals != 1 {
+		t.Errorf("expected the token to be renewed once, got %d", v.renewals)
+	}
+
+	// leased secrets are fetched again before they expire
+	provider, err := newProvider(config.Secrets.Parameters())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, ttl, err := provider.Secret(context.Background(), "database/creds/registry", "password")
+	if err != nil || value != "generation-2" || ttl != 40*time.Second {
+		t.Errorf("unexpected leased secret %q (%s): %v", value, ttl, err)
+	}
+	if err := config.RemoveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultAppRole(t *testing.T) {
+	v := newTestVault(t)
+	provider, err := newProvider(configuration.Parameters{
+		"address":   v.URL,
+		"namespace": "ns1",
+		"approle":   map[interface{}]interface{}{"roleid": "registry", "secretid": "approle-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, _, err := provider.Secret(ctx, "secret/data/registry", "redis"); err == nil {
+		t.Fatal("expected an error before logging in")
+	}
+	ttl, err := provider.Renew(ctx)
+	if err != nil || ttl != 40*time.Minute {
+		t.Fatalf("unexpected login: %s %v", ttl, err)
+	}
+	value, ttl, err := provider.Secret(ctx, "secret/data/registry", "redis")
+	if err != nil || value != "redis-password" || ttl != 0 {
+		t.Fatalf("unexpected secret %q (%s): %v", value, ttl, err)
+	}
+	if _, _, err := provider.Secret(ctx, "secret/data/registry", "missing"); err == nil {
+		t.Fatal("expected an error reading a missing field")
+	}
+	if _, _, err := provider.Secret(ctx, "secret/data/missing", "redis"); err == nil {
+		t.Fatal("expected an error reading a missing secret")
+	}
+}
+
+func TestVaultProviderOptions(t *testing.T) {
+	for _, params := range []configuration.Parameters{
+		{},
+		{"address": "vault:8200", "token": "t"},
+		{"address": "https://vault:8200"},
+		{"address": "https://vault:8200", "token": "t", "approle": map[interface{}]interface{}{"roleid": "r"}},
+		{"address": "https://vault:8200", "approle": map[interface{}]interface{}{"secretid": "s"}},
+		{"address": "https://vault:8200", "approle": "registry"},
+		{"address": "https://vault:8200", "token": "t", "timeout": "soon"},
+		{"address": "https://vault:8200", "token": "t", "rootcertbundle": "/nonexistent/bundle.pem"},
+	} {
+		if _, err := newProvider(params); err == nil {
+			t.Errorf("expected error with parameters %v", params)
+		}
+	}
+}
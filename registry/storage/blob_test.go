@@ -4,14 +4,20 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/distribution/reference"
@@ -530,6 +536,179 @@ func TestLayerUploadZeroLength(t *testing.T) {
 	simpleUpload(t, bs, []byte{}, digestSha256Empty)
 }
 
+// TestBlobUploadChunks checks that the chunks written beyond the content of
+// an upload are assembled when it is committed.
+func TestBlobUploadChunks(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	driver := inmemory.New()
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	blob := []byte("0123456789abcdefghij")
+	wr, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	// the chunks are written last to first, beyond the first one
+	for _, offset := range []int64{15, 10, 5} {
+		cw, err := wr.(distribution.BlobChunkWriter).ChunkWriter(ctx, offset, 5)
+		if err != nil {
+			t.Fatalf("unexpected error writing chunk at %d: %v", offset, err)
+		}
+		if _, err := cw.Write(blob[offset : offset+5]); err != nil {
+			t.Fatalf("unexpected error writing chunk at %d: %v", offset, err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatalf("unexpected error closing chunk at %d: %v", offset, err)
+		}
+	}
+	if _, err := wr.Write(blob[:5]); err != nil {
+		t.Fatalf("unexpected error writing upload: %v", err)
+	}
+	if err := wr.Close(); err != nil {
+		t.Fatalf("unexpected error closing upload: %v", err)
+	}
+	wr, err = bs.Resume(ctx, wr.ID())
+	if err != nil {
+		t.Fatalf("unexpected error resuming upload: %v", err)
+	}
+
+	desc, err := wr.Commit(ctx, v1.Descriptor{Digest: digest.FromBytes(blob)})
+	if err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	if desc.Size != int64(len(blob)) {
+		t.Fatalf("unexpected size: %d != %d", desc.Size, len(blob))
+	}
+	content, err := bs.Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting blob: %v", err)
+	}
+	if !bytes.Equal(content, blob) {
+		t.Fatalf("unexpected content: %q != %q", content, blob)
+	}
+
+	// chunks of the wrong size are discarded
+	wr, err = bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	cw, err := wr.(distribution.BlobChunkWriter).ChunkWriter(ctx, 5, 5)
+	if err != nil {
+		t.Fatalf("unexpected error writing chunk: %v", err)
+	}
+	if _, err := cw.Write(blob[5:8]); err != nil {
+		t.Fatalf("unexpected error writing chunk: %v", err)
+	}
+	if err := cw.Close(); err != distribution.ErrBlobInvalidLength {
+		t.Fatalf("expected %v closing a short chunk, got %v", distribution.ErrBlobInvalidLength, err)
+	}
+	if _, err := wr.Write(blob[:5]); err != nil {
+		t.Fatalf("unexpected error writing upload: %v", err)
+	}
+	if _, err := wr.Commit(ctx, v1.Descriptor{Digest: digest.FromBytes(blob[:5])}); err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+}
+
+func TestInlineBlobs(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	mountName, _ := reference.WithName("foo/mount")
+	driver := inmemory.New()
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)), InlineBlobThreshold(16))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	small := []byte(`{"config":{}}`)
+	large := []byte("a blob larger than the inline threshold")
+	smallDesc, err := addBlob(ctx, bs, v1.Descriptor{Digest: digest.FromBytes(small), Size: int64(len(small))}, bytes.NewReader(small))
+	if err != nil {
+		t.Fatalf("unexpected error adding small blob: %v", err)
+	}
+	largeDesc, err := addBlob(ctx, bs, v1.Descriptor{Digest: digest.FromBytes(large), Size: int64(len(large))}, bytes.NewReader(large))
+	if err != nil {
+		t.Fatalf("unexpected error adding large blob: %v", err)
+	}
+	putDesc, err := bs.Put(ctx, "application/octet-stream", []byte("put"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	// only the large blob is in the blob store
+	for _, desc := range []v1.Descriptor{smallDesc, largeDesc, putDesc} {
+		_, err := registry.BlobStatter().Stat(ctx, desc.Digest)
+		if inline := desc.Size <= 16; inline != (err == distribution.ErrBlobUnknown) {
+			t.Fatalf("unexpected stat of %s in the blob store, inline=%t: %v", desc.Digest, inline, err)
+		}
+	}
+
+	mountRepository, err := registry.Repository(ctx, mountName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	canonicalRef, err := reference.WithDigest(imageName, smallDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mountRepository.Blobs(ctx).Create(ctx, WithMountFrom(canonicalRef)); !errors.As(err, &distribution.ErrBlobMounted{}) {
+		t.Fatalf("expected the small blob to be mounted, got %v", err)
+	}
+
+	// blobs stored inline remain readable once they are not stored inline
+	registry, err = NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	for _, name := range []reference.Named{imageName, mountName} {
+		repository, err := registry.Repository(ctx, name)
+		if err != nil {
+			t.Fatalf("unexpected error getting repo: %v", err)
+		}
+		bs := repository.Blobs(ctx)
+
+		desc, err := bs.Stat(ctx, smallDesc.Digest)
+		if err != nil || desc.Size != int64(len(small)) {
+			t.Fatalf("unexpected stat of small blob in %s: %v, %v", name, desc, err)
+		}
+		content, err := bs.Get(ctx, smallDesc.Digest)
+		if err != nil || !bytes.Equal(content, small) {
+			t.Fatalf("unexpected content of small blob in %s: %q, %v", name, content, err)
+		}
+		rsc, err := bs.Open(ctx, smallDesc.Digest)
+		if err != nil {
+			t.Fatalf("unexpected error opening small blob in %s: %v", name, err)
+		}
+		content, err = io.ReadAll(rsc)
+		rsc.Close()
+		if err != nil || !bytes.Equal(content, small) {
+			t.Fatalf("unexpected content of small blob in %s: %q, %v", name, content, err)
+		}
+
+		w := httptest.NewRecorder()
+		if err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), smallDesc.Digest); err != nil {
+			t.Fatalf("unexpected error serving small blob in %s: %v", name, err)
+		}
+		if w.Body.String() != string(small) || w.Header().Get("Docker-Content-Digest") != smallDesc.Digest.String() {
+			t.Fatalf("unexpected response serving small blob in %s: %q, %v", name, w.Body, w.Header())
+		}
+	}
+}
+
 func simpleUpload(t *testing.T, bs distribution.BlobIngester, blob []byte, expectedDigest digest.Digest) {
 	ctx := context.Background()
 	wr, err := bs.Create(ctx)
@@ -610,3 +789,63 @@ func addBlob(ctx context.Context, bs distribution.BlobIngester, desc v1.Descript
 
 	return wr.Commit(ctx, desc)
 }
+
+// expiryRedirectingDriver redirects to a fake backend URL recording the expiry
+// requested for the redirect URLs.
+type expiryRedirectingDriver struct {
+	*inmemory.Driver
+}
+
+func (d expiryRedirectingDriver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "https://backend.example.com" + path + "?expiry=" + storagedriver.RedirectExpiry(r).String(), nil
+}
+
+func TestRedirectRules(t *testing.T) {
+	ctx := context.Background()
+	driver := expiryRedirectingDriver{inmemory.New()}
+	registry, err := NewRegistry(ctx, driver, EnableRedirect, RedirectExpiry(time.Hour), RedirectRules(
+		RedirectRule{Pattern: "private/*", Disable: true},
+		RedirectRule{Pattern: "library/*", Expiry: 5 * time.Minute},
+	))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	content := []byte("redirected blob")
+	for _, tc := range []struct {
+		name   string
+		expiry string // empty when served through the registry
+	}{
+		{name: "private/app"},
+		{name: "library/base", expiry: "5m0s"},
+		{name: "other/app", expiry: "1h0m0s"},
+	} {
+		name, _ := reference.WithName(tc.name)
+		repository, err := registry.Repository(ctx, name)
+		if err != nil {
+			t.Fatalf("unexpected error getting repo: %v", err)
+		}
+		bs := repository.Blobs(ctx)
+		desc, err := addBlob(ctx, bs, v1.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))}, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("unexpected error adding blob: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		if err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), desc.Digest); err != nil {
+			t.Fatalf("unexpected error serving blob of %s: %v", tc.name, err)
+		}
+		location := w.Header().Get("Location")
+		if tc.expiry == "" {
+			if location != "" || !bytes.Equal(w.Body.Bytes(), content) {
+				t.Fatalf("expected %s to be served through the registry, redirected to %q", tc.name, location)
+			}
+		} else if w.Code != http.StatusTemporaryRedirect || !strings.HasSuffix(location, "?expiry="+tc.expiry) {
+			t.Fatalf("expected %s to be redirected with an expiry of %s, got %d %q", tc.name, tc.expiry, w.Code, location)
+		}
+	}
+
+	if _, err := NewRegistry(ctx, driver, RedirectRules(RedirectRule{Pattern: "["})); err == nil {
+		t.Fatal("expected an invalid pattern to fail")
+	}
+}
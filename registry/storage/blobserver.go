@@ -3,12 +3,14 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // TODO(stevvooe): This should configurable in the future.
@@ -21,6 +23,9 @@ type blobServer struct {
 	statter  distribution.BlobStatter
 	pathFn   func(dgst digest.Digest) (string, error)
 	redirect bool // allows disabling RedirectURL redirects
+	// redirectExpiry is the time the redirect URLs remain valid, the default
+	// of the driver if zero.
+	redirectExpiry time.Duration
 }
 
 func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
@@ -35,11 +40,21 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 	}
 
 	if bs.redirect {
+		if bs.redirectExpiry > 0 {
+			r = r.WithContext(driver.WithRedirectExpiry(r.Context(), bs.redirectExpiry))
+		}
 		redirectURL, err := bs.driver.RedirectURL(r, path)
 		if err != nil {
 			return err
 		}
 		if redirectURL != "" {
+			cookies, err := driver.RedirectCookies(r, bs.driver, path)
+			if err != nil {
+				return err
+			}
+			for _, cookie := range cookies {
+				http.SetCookie(w, cookie)
+			}
 			// Redirect to storage URL.
 			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 			return nil
@@ -53,6 +68,27 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 	}
 	defer br.Close()
 
+	// the content is opened before the response is written, so that the
+	// errors of opening it, such as of archived content, are returned
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		if _, err := br.reader(); err != nil {
+			return err
+		}
+	}
+
+	setBlobHeaders(w, desc)
+
+	var content io.ReadSeeker = br
+	if f, ok := br.file(); ok {
+		content = f
+	}
+	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, content)
+	return nil
+}
+
+// setBlobHeaders sets the headers of the response serving the blob described
+// by desc, unless the caller already set them.
+func setBlobHeaders(w http.ResponseWriter, desc v1.Descriptor) {
 	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, desc.Digest)) // If-None-Match handled by ServeContent
 	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%.f", blobCacheControlMaxAge.Seconds()))
 
@@ -69,7 +105,4 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		// Set the content length if not already set.
 		w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
 	}
-
-	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, br)
-	return nil
 }
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// readerDriver counts the readers opened on its content, failing to open
+// them with err if set.
+type readerDriver struct {
+	storagedriver.StorageDriver
+	readers int
+	err     error
+}
+
+func (d *readerDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.readers++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+type testStatter map[digest.Digest]distribution.Descriptor
+
+func (s testStatter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	desc, ok := s[dgst]
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	return desc, nil
+}
+
+func TestServeBlob(t *testing.T) {
+	ctx := dcontext.Background()
+	content := []byte("blob content")
+	dgst := digest.FromBytes(content)
+	driver := &readerDriver{StorageDriver: inmemory.New()}
+	if err := driver.PutContent(ctx, "/blob", content); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	bs := &blobServer{
+		driver:  driver,
+		statter: testStatter{dgst: {Digest: dgst, Size: int64(len(content)), MediaType: "application/octet-stream"}},
+		pathFn:  func(digest.Digest) (string, error) { return "/blob", nil },
+	}
+
+	w := httptest.NewRecorder()
+	if err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), dgst); err != nil {
+		t.Fatalf("unexpected error serving blob: %v", err)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	// the reader opened before the response is written serves it
+	if driver.readers != 1 {
+		t.Errorf("expected a single reader to be opened, %d were", driver.readers)
+	}
+
+	// the errors of opening the content are returned before the response is
+	// written
+	driver.err = storagedriver.ArchivedContentError{Path: "/blob", DriverName: "test", Restoring: true}
+	w = httptest.NewRecorder()
+	err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), dgst)
+	if !errors.As(err, &storagedriver.ArchivedContentError{}) {
+		t.Fatalf("unexpected error %v, expected the content to be archived", err)
+	}
+	if len(w.Header()) != 0 || w.Body.Len() != 0 {
+		t.Errorf("expected no response to be written, got %v %q", w.Header(), w.Body.String())
+	}
+}
+
+// readerFromRecorder records the readers responses are copied from.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	src io.Reader
+}
+
+func (w *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.src = src
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestServeBlobFile(t *testing.T) {
+	ctx := dcontext.Background()
+	content := []byte("blob content")
+	dgst := digest.FromBytes(content)
+	driver := filesystem.New(filesystem.DriverParameters{RootDirectory: t.TempDir(), MaxThreads: 100})
+	if err := driver.PutContent(ctx, "/blob", content); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	bs := &blobServer{
+		driver:  driver,
+		statter: testStatter{dgst: {Digest: dgst, Size: int64(len(content)), MediaType: "application/octet-stream"}},
+		pathFn:  func(digest.Digest) (string, error) { return "/blob", nil },
+	}
+
+	// the response is copied from the file, for it to be sent with sendfile
+	w := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	if err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), dgst); err != nil {
+		t.Fatalf("unexpected error serving blob: %v", err)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if lr, ok := w.src.(*io.LimitedReader); !ok {
+		t.Errorf("unexpected source %T of the response", w.src)
+	} else if _, ok := lr.R.(*os.File); !ok {
+		t.Errorf("unexpected source %T of the response, expected a file", lr.R)
+	}
+
+	// ranges are read through the reader
+	w = &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=5-")
+	if err := bs.ServeBlob(ctx, w, r, dgst); err != nil {
+		t.Fatalf("unexpected error serving blob: %v", err)
+	}
+	if w.Code != http.StatusPartialContent || w.Body.String() != string(content[5:]) {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+// cookieDriver redirects to its content with a cookie authorizing it.
+type cookieDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d cookieDriver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "https://cdn.example.com" + path, nil
+}
+
+func (d cookieDriver) RedirectCookies(r *http.Request, path string) ([]*http.Cookie, error) {
+	return []*http.Cookie{{Name: "authorization", Value: path, Domain: "example.com"}}, nil
+}
+
+func TestServeBlobRedirectCookies(t *testing.T) {
+	ctx := dcontext.Background()
+	dgst := digest.FromString("blob content")
+	bs := &blobServer{
+		driver:   cookieDriver{inmemory.New()},
+		statter:  testStatter{dgst: {Digest: dgst, Size: 12}},
+		pathFn:   func(digest.Digest) (string, error) { return "/blob", nil },
+		redirect: true,
+	}
+
+	w := httptest.NewRecorder()
+	if err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), dgst); err != nil {
+		t.Fatalf("unexpected error serving blob: %v", err)
+	}
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "https://cdn.example.com/blob" {
+		t.Errorf("unexpected response %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if cookie := w.Header().Get("Set-Cookie"); cookie != "authorization=/blob; Domain=example.com" {
+		t.Errorf("unexpected cookie %q", cookie)
+	}
+}
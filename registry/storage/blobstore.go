@@ -140,12 +140,7 @@ func (bs *blobStore) link(ctx context.Context, path string, dgst digest.Digest)
 
 // readlink returns the linked digest at path.
 func (bs *blobStore) readlink(ctx context.Context, path string) (digest.Digest, error) {
-	content, err := bs.driver.GetContent(ctx, path)
-	if err != nil {
-		return "", err
-	}
-
-	linked, err := digest.Parse(string(content))
+	linked, _, _, err := bs.readInlineLink(ctx, path)
 	if err != nil {
 		return "", err
 	}
@@ -58,7 +58,16 @@ func (bw *blobWriter) StartedAt() time.Time {
 func (bw *blobWriter) Commit(ctx context.Context, desc v1.Descriptor) (v1.Descriptor, error) {
 	dcontext.GetLogger(ctx).Debug("(*blobWriter).Commit")
 
+	if err := bw.assembleChunks(ctx); err != nil {
+		return v1.Descriptor{}, err
+	}
+
 	if err := bw.fileWriter.Commit(ctx); err != nil {
+		var checksumErr storagedriver.ChecksumMismatchError
+		if errors.As(err, &checksumErr) {
+			// the content was corrupted before it reached the storage
+			return v1.Descriptor{}, distribution.ErrBlobInvalidDigest{Digest: desc.Digest, Reason: err}
+		}
 		return v1.Descriptor{}, err
 	}
 
@@ -70,12 +79,18 @@ func (bw *blobWriter) Commit(ctx context.Context, desc v1.Descriptor) (v1.Descri
 		return v1.Descriptor{}, err
 	}
 
-	if err := bw.moveBlob(ctx, canonical); err != nil {
-		return v1.Descriptor{}, err
-	}
+	if bw.blobStore.inlineFirst(canonical.Size) {
+		if err := bw.linkInline(ctx, canonical, desc.Digest); err != nil {
+			return v1.Descriptor{}, err
+		}
+	} else {
+		if err := bw.moveBlob(ctx, canonical); err != nil {
+			return v1.Descriptor{}, err
+		}
 
-	if err := bw.blobStore.linkBlob(ctx, canonical, desc.Digest); err != nil {
-		return v1.Descriptor{}, err
+		if err := bw.blobStore.linkBlob(ctx, canonical, desc.Digest); err != nil {
+			return v1.Descriptor{}, err
+		}
 	}
 
 	if err := bw.removeResources(ctx); err != nil {
@@ -345,6 +360,23 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc v1.Descriptor) error {
 	return bw.blobStore.driver.Move(ctx, bw.path, blobPath)
 }
 
+// linkInline links the blob into the repository with its content read from
+// the upload, instead of moving the content into the blob store.
+func (bw *blobWriter) linkInline(ctx context.Context, desc v1.Descriptor, aliases ...digest.Digest) error {
+	content, err := bw.blobStore.driver.GetContent(ctx, bw.path)
+	if err != nil {
+		// no file is written for zero-length uploads
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok || desc.Size != 0 {
+			return err
+		}
+	}
+	if int64(len(content)) != desc.Size {
+		return distribution.ErrBlobInvalidLength
+	}
+
+	return bw.blobStore.linkInlineBlob(ctx, desc, content, aliases...)
+}
+
 // removeResources should clean up all resources associated with the upload
 // instance. An error will be returned if the clean up cannot proceed. If the
 // resources are already not present, no error will be returned.
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/distribution/distribution/v3"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+var _ distribution.BlobChunkWriter = &blobWriter{}
+
+// ChunkWriter returns a writer storing the chunk starting at offset beside
+// the data of the upload, until Commit assembles it.
+func (bw *blobWriter) ChunkWriter(ctx context.Context, offset, size int64) (io.WriteCloser, error) {
+	if offset <= bw.Size() {
+		return nil, fmt.Errorf("chunk at offset %d does not start beyond the %d bytes of upload %s", offset, bw.Size(), bw.id)
+	}
+	if size <= 0 {
+		return nil, distribution.ErrBlobInvalidLength
+	}
+
+	chunkPath, err := pathFor(uploadChunkPathSpec{
+		name:   bw.blobStore.repository.Named().Name(),
+		id:     bw.id,
+		offset: offset,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fw, err := bw.driver.Writer(ctx, chunkPath, false)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkWriter{ctx: ctx, fileWriter: fw, size: size}, nil
+}
+
+// chunkWriter writes a chunk of an upload, which is discarded if its size is
+// not the expected one.
+type chunkWriter struct {
+	ctx        context.Context
+	fileWriter storagedriver.FileWriter
+	size       int64
+	written    int64
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if cw.written+int64(len(p)) > cw.size {
+		return 0, distribution.ErrBlobInvalidLength
+	}
+	n, err := cw.fileWriter.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+func (cw *chunkWriter) Close() error {
+	if cw.written != cw.size {
+		if err := cw.fileWriter.Cancel(cw.ctx); err != nil {
+			return err
+		}
+		return distribution.ErrBlobInvalidLength
+	}
+	if err := cw.fileWriter.Commit(cw.ctx); err != nil {
+		return err
+	}
+	return cw.fileWriter.Close()
+}
+
+type chunkEntry struct {
+	offset int64
+	path   string
+}
+
+// assembleChunks appends the chunks received out of order to the data of the
+// upload, failing if they leave a gap or overlap.
+func (bw *blobWriter) assembleChunks(ctx context.Context) error {
+	chunksPath, err := pathFor(uploadChunkPathSpec{
+		name: bw.blobStore.repository.Named().Name(),
+		id:   bw.id,
+		list: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	paths, err := bw.driver.List(ctx, chunksPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	chunks := make([]chunkEntry, 0, len(paths))
+	for _, p := range paths {
+		offset, err := strconv.ParseInt(path.Base(p), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unable to parse offset from upload chunk path %q: %w", p, err)
+		}
+		chunks = append(chunks, chunkEntry{offset: offset, path: p})
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].offset < chunks[j].offset
+	})
+
+	size := bw.Size()
+	for _, chunk := range chunks {
+		if chunk.offset != size {
+			return distribution.ErrBlobInvalidLength
+		}
+		n, err := bw.appendChunk(ctx, chunk.path)
+		if err != nil {
+			return err
+		}
+		size += n
+	}
+	return nil
+}
+
+// appendChunk appends the chunk at chunkPath to the data of the upload, then
+// deletes it so that it is not appended again by a retried commit.
+func (bw *blobWriter) appendChunk(ctx context.Context, chunkPath string) (int64, error) {
+	rc, err := bw.driver.Reader(ctx, chunkPath, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := bw.ReadFrom(rc)
+	if err != nil {
+		return n, err
+	}
+	return n, bw.driver.Delete(ctx, chunkPath)
+}
@@ -3,9 +3,11 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -17,6 +19,14 @@ type BlobDescriptorCacheProvider interface {
 	RepositoryScoped(repo string) (distribution.BlobDescriptorService, error)
 }
 
+// BlobRepositoryLister is implemented by the BlobDescriptorCacheProviders
+// which can list the repositories a blob is cached for.
+type BlobRepositoryLister interface {
+	// Repositories returns up to limit repositories the descriptor of dgst
+	// is cached for, in no particular order.
+	Repositories(ctx context.Context, dgst digest.Digest, limit int) ([]string, error)
+}
+
 // ValidateDescriptor provides a helper function to ensure that caches have
 // common criteria for admitting descriptors.
 func ValidateDescriptor(desc v1.Descriptor) error {
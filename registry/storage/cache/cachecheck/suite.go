@@ -2,7 +2,9 @@ package cachecheck
 
 import (
 	"context"
+	"errors"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
@@ -20,6 +22,7 @@ func CheckBlobDescriptorCache(t *testing.T, provider cache.BlobDescriptorCachePr
 	checkBlobDescriptorCacheEmptyRepository(ctx, t, provider)
 	checkBlobDescriptorCacheSetAndRead(ctx, t, provider)
 	checkBlobDescriptorCacheClear(ctx, t, provider)
+	checkBlobDescriptorCacheRepositories(ctx, t, provider)
 }
 
 func checkBlobDescriptorCacheEmptyRepository(ctx context.Context, t *testing.T, provider cache.BlobDescriptorCacheProvider) {
@@ -186,3 +189,42 @@ func checkBlobDescriptorCacheClear(ctx context.Context, t *testing.T, provider c
 		t.Fatalf("expected error statting deleted blob: %v", err)
 	}
 }
+
+func checkBlobDescriptorCacheRepositories(ctx context.Context, t *testing.T, provider cache.BlobDescriptorCacheProvider) {
+	lister, ok := provider.(cache.BlobRepositoryLister)
+	if !ok {
+		return
+	}
+	dgst := digest.Digest("sha256:fed1111111111111111111111111111111111111111111111111111111111111")
+	desc := v1.Descriptor{
+		Digest:    dgst,
+		Size:      10,
+		MediaType: "application/octet-stream",
+	}
+
+	for _, repo := range []string{"foo/bar", "foo/baz"} {
+		cache, err := provider.RepositoryScoped(repo)
+		if err != nil {
+			t.Fatalf("unexpected error getting scoped cache: %v", err)
+		}
+		if err := cache.SetDescriptor(ctx, dgst, desc); err != nil {
+			t.Fatalf("error setting descriptor: %v", err)
+		}
+	}
+
+	repositories, err := lister.Repositories(ctx, dgst, 10)
+	if errors.Is(err, distribution.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error listing repositories: %v", err)
+	}
+	sort.Strings(repositories)
+	if !reflect.DeepEqual(repositories, []string{"foo/bar", "foo/baz"}) {
+		t.Fatalf("unexpected repositories: %v", repositories)
+	}
+
+	if repositories, err := lister.Repositories(ctx, dgst, 1); err != nil || len(repositories) != 1 {
+		t.Fatalf("expected a single repository, got %v, %v", repositories, err)
+	}
+}
@@ -114,6 +114,25 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Con
 	return err
 }
 
+// Repositories returns up to limit repositories the descriptor of dgst is
+// cached for. It scans the whole cache.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) Repositories(ctx context.Context, dgst digest.Digest, limit int) ([]string, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+
+	var repositories []string
+	for _, key := range imbdcp.lru.Keys() {
+		if len(repositories) >= limit {
+			break
+		}
+		if key.digest == dgst && key.repo != "" {
+			repositories = append(repositories, key.repo)
+		}
+	}
+	return repositories, nil
+}
+
 // repositoryScopedInMemoryBlobDescriptorCache provides the request scoped
 // repository cache. Instances are not thread-safe but the delegated
 // operations are.
@@ -39,6 +39,19 @@ func (p *prometheusCacheProvider) SetDescriptor(ctx context.Context, dgst digest
 	return e
 }
 
+// Repositories lists the repositories of the blob if the wrapped provider is
+// a cache.BlobRepositoryLister.
+func (p *prometheusCacheProvider) Repositories(ctx context.Context, dgst digest.Digest, limit int) ([]string, error) {
+	lister, ok := p.BlobDescriptorCacheProvider.(cache.BlobRepositoryLister)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+	start := time.Now()
+	repositories, e := lister.Repositories(ctx, dgst, limit)
+	p.latencyTimer.WithValues("Repositories").UpdateSince(start)
+	return repositories, e
+}
+
 type prometheusRepoCacheProvider struct {
 	distribution.BlobDescriptorService
 	latencyTimer metrics.LabeledTimer
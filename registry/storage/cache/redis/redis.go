@@ -158,6 +158,21 @@ func (rbds *redisBlobDescriptorService) setDescriptor(ctx context.Context, dgst
 	return nil
 }
 
+// Repositories returns up to limit random repositories the descriptor of dgst
+// is cached for.
+func (rbds *redisBlobDescriptorService) Repositories(ctx context.Context, dgst digest.Digest, limit int) ([]string, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	return rbds.pool.SRandMemberN(ctx, blobRepositorySetKey(dgst), int64(limit)).Result()
+}
+
+// blobRepositorySetKey returns the key of the set of the repositories the
+// descriptor of dgst is cached for.
+func blobRepositorySetKey(dgst digest.Digest) string {
+	return "blobs::" + dgst.String() + "::repositories"
+}
+
 func (rbds *redisBlobDescriptorService) blobDescriptorHashKey(dgst digest.Digest) string {
 	return "blobs::" + dgst.String()
 }
@@ -222,6 +237,9 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Clear(ctx context.Cont
 	if !member {
 		return distribution.ErrBlobUnknown
 	}
+	if err := rsrbds.upstream.pool.SRem(ctx, blobRepositorySetKey(dgst), rsrbds.repo).Err(); err != nil {
+		return err
+	}
 
 	return rsrbds.upstream.Clear(ctx, dgst)
 }
@@ -250,6 +268,10 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) setDescriptor(ctx cont
 	if err != nil {
 		return err
 	}
+	_, err = conn.SAdd(ctx, blobRepositorySetKey(dgst), rsrbds.repo).Result()
+	if err != nil {
+		return err
+	}
 
 	if err := rsrbds.upstream.setDescriptor(ctx, dgst, desc); err != nil {
 		return err
@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/car"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxIndexSize bounds the size of the image index read from the root of
+// imported archives and from imported image layouts.
+const maxIndexSize = 4 << 20
+
+// ExportRepository writes the manifests and blobs of repository to w as an
+// indexed CARv2 archive. The root of the archive is an OCI image index
+// listing the manifests of the repository, annotated with the name of their
+// tags, as in the index of OCI image layouts.
+func ExportRepository(ctx context.Context, repository distribution.Repository, w io.WriteSeeker) error {
+	export, err := newRepositoryExport(ctx, repository)
+	if err != nil {
+		return err
+	}
+	rootPayload, err := json.Marshal(export.index)
+	if err != nil {
+		return err
+	}
+	root := digest.FromBytes(rootPayload)
+
+	cw, err := car.NewWriter(w, root)
+	if err != nil {
+		return err
+	}
+	if err := export.write(ctx, cw.Put); err != nil {
+		return err
+	}
+	if err := cw.Put(root, int64(len(rootPayload)), bytes.NewReader(rootPayload)); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// repositoryExport holds the manifests of a repository being exported, and
+// the image index listing them.
+type repositoryExport struct {
+	repository      distribution.Repository
+	manifestService distribution.ManifestService
+	index           v1.Index
+	dgsts           []digest.Digest
+	manifests       []distribution.Manifest
+	payloads        [][]byte
+}
+
+// newRepositoryExport reads the manifests and tags of repository.
+func newRepositoryExport(ctx context.Context, repository distribution.Repository) (*repositoryExport, error) {
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+	manifestEnumerator, ok := manifestService.(distribution.ManifestEnumerator)
+	if !ok {
+		return nil, fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
+	}
+
+	var dgsts []digest.Digest
+	err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		dgsts = append(dgsts, dgst)
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, distribution.ErrRepositoryUnknown{Name: repository.Named().Name()}
+		}
+		return nil, fmt.Errorf("failed to enumerate manifests: %v", err)
+	}
+	sort.Slice(dgsts, func(i, j int) bool { return dgsts[i] < dgsts[j] })
+
+	tags, err := manifestTags(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &repositoryExport{
+		repository:      repository,
+		manifestService: manifestService,
+		index:           v1.Index{MediaType: v1.MediaTypeImageIndex},
+		dgsts:           dgsts,
+		manifests:       make([]distribution.Manifest, len(dgsts)),
+		payloads:        make([][]byte, len(dgsts)),
+	}
+	export.index.SchemaVersion = 2
+	for i, dgst := range dgsts {
+		manifest, err := manifestService.Get(ctx, dgst)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve manifest %s: %v", dgst, err)
+		}
+		mediaType, payload, err := manifest.Payload()
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve the payload of manifest %s: %v", dgst, err)
+		}
+		export.manifests[i], export.payloads[i] = manifest, payload
+
+		desc := v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}
+		if len(tags[dgst]) == 0 {
+			export.index.Manifests = append(export.index.Manifests, desc)
+		}
+		for _, tag := range tags[dgst] {
+			desc.Annotations = map[string]string{v1.AnnotationRefName: tag}
+			export.index.Manifests = append(export.index.Manifests, desc)
+		}
+	}
+	return export, nil
+}
+
+// write calls put with the content of the blobs and manifests of the
+// export, each manifest after the blobs it references, and each blob once.
+func (e *repositoryExport) write(ctx context.Context, put func(dgst digest.Digest, size int64, r io.Reader) error) error {
+	blobs := e.repository.Blobs(ctx)
+	written := make(map[digest.Digest]struct{})
+	for i, manifest := range e.manifests {
+		for _, ref := range manifest.References() {
+			if _, ok := written[ref.Digest]; ok {
+				continue
+			}
+			written[ref.Digest] = struct{}{}
+			// referenced manifests are exported with the others
+			if ok, _ := e.manifestService.Exists(ctx, ref.Digest); ok {
+				continue
+			}
+			if err := exportBlob(ctx, put, blobs, ref.Digest); err != nil {
+				return err
+			}
+		}
+		if err := put(e.dgsts[i], int64(len(e.payloads[i])), bytes.NewReader(e.payloads[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestTags returns the tags of repository, by manifest digest.
+func manifestTags(ctx context.Context, repository distribution.Repository) (map[digest.Digest][]string, error) {
+	tagService := repository.Tags(ctx)
+	allTags, err := tagService.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve tags: %v", err)
+	}
+	sort.Strings(allTags)
+
+	tags := make(map[digest.Digest][]string)
+	for _, tag := range allTags {
+		desc, err := tagService.Get(ctx, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve tag %s: %v", tag, err)
+		}
+		tags[desc.Digest] = append(tags[desc.Digest], tag)
+	}
+	return tags, nil
+}
+
+func exportBlob(ctx context.Context, put func(dgst digest.Digest, size int64, r io.Reader) error, blobs distribution.BlobStore, dgst digest.Digest) error {
+	desc, err := blobs.Stat(ctx, dgst)
+	if err != nil {
+		if errors.Is(err, distribution.ErrBlobUnknown) {
+			// such as foreign layers, which are not pushed to the registry
+			dcontext.GetLogger(ctx).Warnf("skipping blob %s, which is not in the repository", dgst)
+			return nil
+		}
+		return fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+	}
+	rc, err := blobs.Open(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %v", dgst, err)
+	}
+	defer rc.Close()
+	return put(dgst, desc.Size, rc)
+}
+
+// ImportRepository imports the manifests, blobs and tags of an archive
+// written by ExportRepository into repository. Blobs already in the
+// repository are not imported again, and tags are updated to point to the
+// imported manifests.
+func ImportRepository(ctx context.Context, repository distribution.Repository, r *car.Reader) error {
+	if len(r.Roots()) != 1 {
+		return fmt.Errorf("expected a single root, found %d", len(r.Roots()))
+	}
+	open := func(dgst digest.Digest) (io.ReadCloser, int64, error) {
+		content, size, err := r.Open(dgst)
+		if errors.Is(err, car.ErrBlockUnknown) {
+			return nil, 0, distribution.ErrBlobUnknown
+		}
+		return io.NopCloser(content), size, err
+	}
+	root, err := readBlock(open, r.Roots()[0], maxIndexSize)
+	if err != nil {
+		return fmt.Errorf("failed to read the root index: %v", err)
+	}
+	var index v1.Index
+	if err := json.Unmarshal(root, &index); err != nil {
+		return fmt.Errorf("failed to parse the root index: %v", err)
+	}
+	if index.MediaType != v1.MediaTypeImageIndex {
+		return fmt.Errorf("unexpected root media type %q", index.MediaType)
+	}
+	return importIndex(ctx, repository, index, open)
+}
+
+// importIndex imports the manifests listed by index, the content of which
+// open returns, along with their blobs, and tags them with the names they
+// are annotated with. open returns distribution.ErrBlobUnknown for content
+// missing from the source.
+func importIndex(ctx context.Context, repository distribution.Repository, index v1.Index, open func(digest.Digest) (io.ReadCloser, int64, error)) error {
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+	im := &repositoryImporter{
+		open:            open,
+		manifestService: manifestService,
+		blobs:           repository.Blobs(ctx),
+		manifests:       make(map[digest.Digest]v1.Descriptor),
+		imported:        make(map[digest.Digest]struct{}),
+	}
+	for _, desc := range index.Manifests {
+		im.manifests[desc.Digest] = desc
+	}
+	for _, desc := range index.Manifests {
+		if err := im.importManifest(ctx, desc); err != nil {
+			return err
+		}
+	}
+
+	tagService := repository.Tags(ctx)
+	for _, desc := range index.Manifests {
+		tag, ok := desc.Annotations[v1.AnnotationRefName]
+		if !ok {
+			continue
+		}
+		desc.Annotations = nil
+		if err := tagService.Tag(ctx, tag, desc); err != nil {
+			return fmt.Errorf("failed to tag %s: %v", tag, err)
+		}
+	}
+	return nil
+}
+
+type repositoryImporter struct {
+	open            func(digest.Digest) (io.ReadCloser, int64, error)
+	manifestService distribution.ManifestService
+	blobs           distribution.BlobStore
+	manifests       map[digest.Digest]v1.Descriptor
+	imported        map[digest.Digest]struct{}
+}
+
+// importManifest imports a manifest once its references are imported.
+func (im *repositoryImporter) importManifest(ctx context.Context, desc v1.Descriptor) error {
+	if _, ok := im.imported[desc.Digest]; ok {
+		return nil
+	}
+	im.imported[desc.Digest] = struct{}{}
+
+	payload, err := readBlock(im.open, desc.Digest, desc.Size)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest %s: %v", desc.Digest, err)
+	}
+	manifest, _, err := distribution.UnmarshalManifest(desc.MediaType, payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %v", desc.Digest, err)
+	}
+
+	for _, ref := range manifest.References() {
+		if child, ok := im.manifests[ref.Digest]; ok {
+			err = im.importManifest(ctx, child)
+		} else if isManifestMediaType(ref.MediaType) {
+			// manifests of an index not listed by the imported index
+			err = im.importManifest(ctx, ref)
+		} else {
+			err = im.importBlob(ctx, ref)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	dgst, err := im.manifestService.Put(ctx, manifest)
+	if err != nil {
+		return fmt.Errorf("failed to put manifest %s: %v", desc.Digest, err)
+	}
+	if dgst != desc.Digest {
+		return fmt.Errorf("manifest %s imported as %s", desc.Digest, dgst)
+	}
+	return nil
+}
+
+func (im *repositoryImporter) importBlob(ctx context.Context, desc v1.Descriptor) error {
+	if _, ok := im.imported[desc.Digest]; ok {
+		return nil
+	}
+	im.imported[desc.Digest] = struct{}{}
+
+	if _, err := im.blobs.Stat(ctx, desc.Digest); err == nil {
+		return nil
+	} else if !errors.Is(err, distribution.ErrBlobUnknown) {
+		return fmt.Errorf("failed to stat blob %s: %v", desc.Digest, err)
+	}
+
+	content, size, err := im.open(desc.Digest)
+	if err != nil {
+		if errors.Is(err, distribution.ErrBlobUnknown) {
+			// left to the validation of the manifest
+			return nil
+		}
+		return err
+	}
+	defer content.Close()
+	bw, err := im.blobs.Create(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create upload of blob %s: %v", desc.Digest, err)
+	}
+	if _, err := io.Copy(bw, content); err != nil {
+		_ = bw.Cancel(ctx)
+		return fmt.Errorf("failed to upload blob %s: %v", desc.Digest, err)
+	}
+	_, err = bw.Commit(ctx, v1.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: size})
+	if err != nil {
+		return fmt.Errorf("failed to commit blob %s: %v", desc.Digest, err)
+	}
+	return nil
+}
+
+// isManifestMediaType reports whether mediaType is the media type of a
+// manifest.
+func isManifestMediaType(mediaType string) bool {
+	for _, t := range distribution.ManifestMediaTypes() {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// readBlock reads a block of at most maxSize bytes, verifying its content.
+func readBlock(open func(digest.Digest) (io.ReadCloser, int64, error), dgst digest.Digest, maxSize int64) ([]byte, error) {
+	content, size, err := open(dgst)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	if size > maxSize {
+		return nil, fmt.Errorf("block %s is %d bytes, larger than %d bytes", dgst, size, maxSize)
+	}
+	p, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	if dgst.Algorithm().FromBytes(p) != dgst {
+		return nil, fmt.Errorf("content of block %s does not match its digest", dgst)
+	}
+	return p, nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/car"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestExportImportRepository(t *testing.T) {
+	ctx := dcontext.Background()
+	source := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, source, "export/source")
+
+	image1 := uploadRandomOCIImage(t, repo)
+	image2 := uploadRandomSchema2Image(t, repo)
+	untagged := uploadRandomOCIImage(t, repo)
+	manifestList, err := testutil.MakeManifestList(source.BlobStatter(), []digest.Digest{image1.manifestDigest, image2.manifestDigest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listDigest, err := makeManifestService(t, repo).Put(ctx, manifestList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]digest.Digest{
+		"image1": image1.manifestDigest,
+		"latest": image1.manifestDigest,
+		"list":   listDigest,
+	}
+	for tag, dgst := range tags {
+		if err := repo.Tags(ctx).Tag(ctx, tag, v1.Descriptor{Digest: dgst}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "export.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := ExportRepository(ctx, repo, f); err != nil {
+		t.Fatalf("unexpected error exporting: %v", err)
+	}
+
+	r, err := car.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := createRegistry(t, inmemory.New())
+	imported := makeRepository(t, dest, "import/dest")
+	if err := ImportRepository(ctx, imported, r); err != nil {
+		t.Fatalf("unexpected error importing: %v", err)
+	}
+	// importing again is a no-op
+	if err := ImportRepository(ctx, imported, r); err != nil {
+		t.Fatalf("unexpected error importing again: %v", err)
+	}
+
+	manifests := allManifests(t, makeManifestService(t, imported))
+	for _, dgst := range []digest.Digest{image1.manifestDigest, image2.manifestDigest, untagged.manifestDigest, listDigest} {
+		if _, ok := manifests[dgst]; !ok {
+			t.Errorf("manifest %s not imported", dgst)
+		}
+	}
+	if len(manifests) != 4 {
+		t.Errorf("unexpected number of manifests imported: %d", len(manifests))
+	}
+
+	allTags, err := imported.Tags(ctx).All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allTags) != len(tags) {
+		t.Errorf("unexpected tags imported: %v", allTags)
+	}
+	for tag, dgst := range tags {
+		desc, err := imported.Tags(ctx).Get(ctx, tag)
+		if err != nil {
+			t.Fatalf("unexpected error getting tag %s: %v", tag, err)
+		}
+		if desc.Digest != dgst {
+			t.Errorf("tag %s imported as %s instead of %s", tag, desc.Digest, dgst)
+		}
+	}
+
+	for _, im := range []image{image1, image2, untagged} {
+		for dgst, layer := range im.layers {
+			if _, err := layer.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			expected, err := io.ReadAll(layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := imported.Blobs(ctx).Open(ctx, dgst)
+			if err != nil {
+				t.Fatalf("unexpected error opening layer %s: %v", dgst, err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != string(expected) {
+				t.Errorf("unexpected content of layer %s", dgst)
+			}
+		}
+	}
+}
+
+func TestExportUnknownRepository(t *testing.T) {
+	ctx := dcontext.Background()
+	repo := makeRepository(t, createRegistry(t, inmemory.New()), "unknown")
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "export.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = ExportRepository(ctx, repo, f)
+	if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+		t.Fatalf("expected ErrRepositoryUnknown, got %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/estargz"
+	"github.com/distribution/distribution/v3/internal/zstdchunked"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ConversionAnnotation is the annotation of the manifests of converted
+	// images holding the format their layers were converted to.
+	ConversionAnnotation = "io.distribution.conversion.format"
+
+	// ConversionFormatEStargz is the format of the images converted to
+	// eStargz.
+	ConversionFormatEStargz = "estargz"
+
+	// ConversionFormatZstdChunked is the format of the images converted to
+	// zstd:chunked.
+	ConversionFormatZstdChunked = "zstd:chunked"
+)
+
+// ErrNothingToConvert is returned when converting an image which has no
+// layer to convert.
+var ErrNothingToConvert = errors.New("nothing to convert")
+
+// ConvertToEStargz converts the gzip layers of the image manifest dgst of the
+// repository to eStargz, as ConvertImage does.
+func ConvertToEStargz(ctx context.Context, repository distribution.Repository, dgst digest.Digest, chunkSize int64) (v1.Descriptor, error) {
+	return ConvertImage(ctx, repository, dgst, ConversionFormatEStargz, chunkSize)
+}
+
+// ConvertImage converts the gzip layers of the image manifest dgst of the
+// repository to format, eStargz or zstd:chunked, for container runtimes
+// pulling them lazily. The converted image is pushed to the repository as a
+// referrer of the original image: its manifest has the original one as
+// subject, and it is listed by the image index tagged with the referrers tag
+// of the original manifest, as defined by the OCI distribution
+// specification. Images already converted to format are not converted again.
+// It returns the descriptor of the manifest of the converted image.
+func ConvertImage(ctx context.Context, repository distribution.Repository, dgst digest.Digest, format string, chunkSize int64) (v1.Descriptor, error) {
+	var convertLayer func(context.Context, distribution.BlobStore, v1.Descriptor, int64) (v1.Descriptor, digest.Digest, error)
+	switch format {
+	case ConversionFormatEStargz:
+		convertLayer = convertLayerToEStargz
+	case ConversionFormatZstdChunked:
+		convertLayer = convertLayerToZstdChunked
+	default:
+		return v1.Descriptor{}, fmt.Errorf("unsupported conversion format %q", format)
+	}
+
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	m, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	subject := v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}
+
+	var config v1.Descriptor
+	var layers []v1.Descriptor
+	switch m := m.(type) {
+	case *ocischema.DeserializedManifest:
+		if m.Subject != nil || m.Annotations[ConversionAnnotation] != "" {
+			// artifacts, including converted images, are left alone
+			return v1.Descriptor{}, ErrNothingToConvert
+		}
+		config, layers = m.Config, m.Layers
+	case *schema2.DeserializedManifest:
+		// converted docker images are OCI images, which can only hold
+		// converted layers
+		for _, layer := range m.Layers {
+			if layer.MediaType != schema2.MediaTypeLayer {
+				return v1.Descriptor{}, ErrNothingToConvert
+			}
+		}
+		config, layers = m.Config, m.Layers
+	default:
+		return v1.Descriptor{}, ErrNothingToConvert
+	}
+
+	converted, index, err := convertedReferrer(ctx, repository, dgst, format)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if converted != nil {
+		return *converted, nil
+	}
+
+	blobs := repository.Blobs(ctx)
+	configPayload, err := blobs.Get(ctx, config.Digest)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("error reading image configuration: %w", err)
+	}
+	var imageConfig map[string]json.RawMessage
+	if err := json.Unmarshal(configPayload, &imageConfig); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("error parsing image configuration: %w", err)
+	}
+	var rootFS v1.RootFS
+	if err := json.Unmarshal(imageConfig["rootfs"], &rootFS); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("error parsing image root filesystem: %w", err)
+	}
+	if len(rootFS.DiffIDs) != len(layers) {
+		return v1.Descriptor{}, fmt.Errorf("image configuration lists %d layers, manifest %d", len(rootFS.DiffIDs), len(layers))
+	}
+
+	convertedLayers := make([]v1.Descriptor, len(layers))
+	var convertedCount int
+	for i, layer := range layers {
+		if !convertibleLayer(layer, format) {
+			convertedLayers[i] = layer
+			continue
+		}
+		desc, diffID, err := convertLayer(ctx, blobs, layer, chunkSize)
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("error converting layer %s: %w", layer.Digest, err)
+		}
+		convertedLayers[i] = desc
+		rootFS.DiffIDs[i] = diffID
+		convertedCount++
+	}
+	if convertedCount == 0 {
+		return v1.Descriptor{}, ErrNothingToConvert
+	}
+
+	imageConfig["rootfs"], err = json.Marshal(rootFS)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	configPayload, err = json.Marshal(imageConfig)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	configDesc, err := blobs.Put(ctx, v1.MediaTypeImageConfig, configPayload)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("error pushing image configuration: %w", err)
+	}
+
+	convertedManifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: configDesc.Digest, Size: configDesc.Size},
+		Layers:    convertedLayers,
+		Subject:   &subject,
+		Annotations: map[string]string{
+			ConversionAnnotation: format,
+		},
+	})
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	manifestDigest, err := manifests.Put(ctx, convertedManifest)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("error pushing converted manifest: %w", err)
+	}
+	_, convertedPayload, err := convertedManifest.Payload()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc := v1.Descriptor{
+		MediaType:    v1.MediaTypeImageManifest,
+		Digest:       manifestDigest,
+		Size:         int64(len(convertedPayload)),
+		ArtifactType: v1.MediaTypeImageConfig,
+		Annotations:  convertedManifest.Annotations,
+	}
+
+	if err := addReferrer(ctx, repository, dgst, index, desc); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// convertibleLayer reports whether the layer is a gzip layer to convert to
+// format: eStargz layers are only converted to zstd:chunked.
+func convertibleLayer(layer v1.Descriptor, format string) bool {
+	if layer.MediaType != v1.MediaTypeImageLayerGzip && layer.MediaType != schema2.MediaTypeLayer {
+		return false
+	}
+	_, converted := layer.Annotations[estargz.TOCDigestAnnotation]
+	return !converted || format != ConversionFormatEStargz
+}
+
+// convertLayerToEStargz pushes the eStargz conversion of the gzip layer,
+// returning its descriptor and the digest of its uncompressed content.
+func convertLayerToEStargz(ctx context.Context, blobs distribution.BlobStore, layer v1.Descriptor, chunkSize int64) (v1.Descriptor, digest.Digest, error) {
+	rc, err := blobs.Open(ctx, layer.Digest)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	defer zr.Close()
+
+	bw, err := blobs.Create(ctx)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	digester := digest.Canonical.Digester()
+	result, err := estargz.Convert(io.MultiWriter(bw, digester.Hash()), zr, chunkSize)
+	if err == nil {
+		layer, err = bw.Commit(ctx, v1.Descriptor{
+			MediaType: v1.MediaTypeImageLayerGzip,
+			Digest:    digester.Digest(),
+			Size:      bw.Size(),
+		})
+	}
+	if err != nil {
+		if cancelErr := bw.Cancel(ctx); cancelErr != nil {
+			return v1.Descriptor{}, "", errors.Join(err, cancelErr)
+		}
+		return v1.Descriptor{}, "", err
+	}
+
+	annotations := maps.Clone(layer.Annotations)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[estargz.TOCDigestAnnotation] = result.TOCDigest.String()
+	annotations[estargz.UncompressedSizeAnnotation] = strconv.FormatInt(result.UncompressedSize, 10)
+	return v1.Descriptor{
+		MediaType:   v1.MediaTypeImageLayerGzip,
+		Digest:      layer.Digest,
+		Size:        layer.Size,
+		Annotations: annotations,
+	}, result.DiffID, nil
+}
+
+// convertLayerToZstdChunked pushes the zstd:chunked conversion of the gzip
+// layer, returning its descriptor and the digest of its uncompressed content,
+// which is left unchanged.
+func convertLayerToZstdChunked(ctx context.Context, blobs distribution.BlobStore, layer v1.Descriptor, chunkSize int64) (v1.Descriptor, digest.Digest, error) {
+	rc, err := blobs.Open(ctx, layer.Digest)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	defer zr.Close()
+
+	bw, err := blobs.Create(ctx)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	digester := digest.Canonical.Digester()
+	result, err := zstdchunked.Convert(io.MultiWriter(bw, digester.Hash()), zr, chunkSize)
+	if err == nil {
+		layer, err = bw.Commit(ctx, v1.Descriptor{
+			MediaType: v1.MediaTypeImageLayerZstd,
+			Digest:    digester.Digest(),
+			Size:      bw.Size(),
+		})
+	}
+	if err != nil {
+		if cancelErr := bw.Cancel(ctx); cancelErr != nil {
+			return v1.Descriptor{}, "", errors.Join(err, cancelErr)
+		}
+		return v1.Descriptor{}, "", err
+	}
+
+	annotations := maps.Clone(layer.Annotations)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[zstdchunked.ManifestChecksumAnnotation] = result.ManifestChecksum.String()
+	annotations[zstdchunked.ManifestPositionAnnotation] = result.ManifestPosition
+	annotations[zstdchunked.TarSplitPositionAnnotation] = result.TarSplitPosition
+	return v1.Descriptor{
+		MediaType:   v1.MediaTypeImageLayerZstd,
+		Digest:      layer.Digest,
+		Size:        layer.Size,
+		Annotations: annotations,
+	}, result.DiffID, nil
+}
+
+// ReferrersTag returns the tag of the index listing the referrers of the
+// manifest dgst, under the referrers tag schema of the OCI distribution
+// specification, for registries without the referrers API.
+func ReferrersTag(dgst digest.Digest) string {
+	tag := dgst.Algorithm().String() + "-" + dgst.Encoded()
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+// convertedReferrer returns the conversion to format among the referrers of
+// the manifest dgst, if any, along with the index listing the referrers.
+func convertedReferrer(ctx context.Context, repository distribution.Repository, dgst digest.Digest, format string) (*v1.Descriptor, *ocischema.DeserializedImageIndex, error) {
+	desc, err := repository.Tags(ctx).Get(ctx, ReferrersTag(dgst))
+	if err != nil {
+		if errors.As(err, &distribution.ErrTagUnknown{}) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := manifests.Get(ctx, desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, ok := m.(*ocischema.DeserializedImageIndex)
+	if !ok {
+		return nil, nil, fmt.Errorf("referrers tag of %s is not an image index", dgst)
+	}
+	for _, referrer := range index.Manifests {
+		if referrer.Annotations[ConversionAnnotation] == format {
+			return &referrer, index, nil
+		}
+	}
+	return nil, index, nil
+}
+
+// addReferrer adds the referrer to the index listing the referrers of the
+// manifest dgst, tagging the updated index with the referrers tag.
+func addReferrer(ctx context.Context, repository distribution.Repository, dgst digest.Digest, index *ocischema.DeserializedImageIndex, referrer v1.Descriptor) error {
+	var referrers []v1.Descriptor
+	if index != nil {
+		referrers = append(referrers, index.Manifests...)
+	}
+	referrers = append(referrers, referrer)
+
+	updated, err := ocischema.FromDescriptors(referrers, nil)
+	if err != nil {
+		return err
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	indexDigest, err := manifests.Put(ctx, updated)
+	if err != nil {
+		return fmt.Errorf("error pushing referrers index: %w", err)
+	}
+	_, payload, err := updated.Payload()
+	if err != nil {
+		return err
+	}
+	return repository.Tags(ctx).Tag(ctx, ReferrersTag(dgst), v1.Descriptor{
+		MediaType: v1.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      int64(len(payload)),
+	})
+}
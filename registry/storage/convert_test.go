@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/estargz"
+	"github.com/distribution/distribution/v3/internal/zstdchunked"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pushTestImage pushes an image holding a gzip layer with a single file to
+// the repository, returning the digest of its manifest, the content of the
+// file and the uncompressed layer.
+func pushTestImage(t *testing.T, repository distribution.Repository) (digest.Digest, []byte, []byte) {
+	t.Helper()
+	ctx := context.Background()
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	content := bytes.Repeat([]byte("file content "), 100)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/file", Mode: 0o644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var layer bytes.Buffer
+	zw := gzip.NewWriter(&layer)
+	if _, err := zw.Write(archive.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDesc := pushTestBlob(t, repository, layer.Bytes())
+	layerDesc.MediaType = v1.MediaTypeImageLayerGzip
+
+	config, err := json.Marshal(v1.Image{
+		Platform: v1.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(archive.Bytes())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDesc := pushTestBlob(t, repository, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []v1.Descriptor{layerDesc},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dgst, content, archive.Bytes()
+}
+
+func TestConvertToEStargz(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repository := makeRepository(t, registry, "foo/bar")
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dgst, content, _ := pushTestImage(t, repository)
+
+	desc, err := ConvertToEStargz(ctx, repository, dgst, 256)
+	if err != nil {
+		t.Fatalf("unexpected error converting image: %v", err)
+	}
+
+	// the converted image refers to the original one and holds an eStargz
+	// layer with the same uncompressed content
+	converted, err := manifests.Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting converted manifest: %v", err)
+	}
+	cm := converted.(*ocischema.DeserializedManifest)
+	if cm.Subject == nil || cm.Subject.Digest != dgst {
+		t.Fatalf("unexpected subject of the converted manifest: %v", cm.Subject)
+	}
+	if cm.Annotations[ConversionAnnotation] != ConversionFormatEStargz || len(cm.Layers) != 1 {
+		t.Fatalf("unexpected converted manifest: %v", cm.Manifest)
+	}
+	convertedLayer := cm.Layers[0]
+	if convertedLayer.Annotations[estargz.TOCDigestAnnotation] == "" {
+		t.Fatalf("expected the converted layer to have a table of contents: %v", convertedLayer)
+	}
+	p, err := repository.Blobs(ctx).Get(ctx, convertedLayer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := estargz.ParseFooter(p[len(p)-estargz.FooterSize:]); err != nil {
+		t.Fatalf("unexpected error parsing footer of the converted layer: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var found bool
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name == "etc/file" {
+			got, err := io.ReadAll(tr)
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("unexpected converted file content: %v", err)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected the converted layer to hold the file")
+	}
+
+	configContent, err := repository.Blobs(ctx).Get(ctx, cm.Config.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var convertedConfig v1.Image
+	if err := json.Unmarshal(configContent, &convertedConfig); err != nil {
+		t.Fatal(err)
+	}
+	if convertedConfig.Architecture != "amd64" || len(convertedConfig.RootFS.DiffIDs) != 1 {
+		t.Fatalf("unexpected converted configuration: %s", configContent)
+	}
+
+	// the referrers tag lists the converted image
+	tagDesc, err := repository.Tags(ctx).Get(ctx, "sha256-"+dgst.Encoded())
+	if err != nil {
+		t.Fatalf("unexpected error getting referrers tag: %v", err)
+	}
+	index, err := manifests.Get(ctx, tagDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	referrers := index.(*ocischema.DeserializedImageIndex).Manifests
+	if len(referrers) != 1 || referrers[0].Digest != desc.Digest {
+		t.Fatalf("unexpected referrers: %v", referrers)
+	}
+
+	// images are converted once, converted images are not converted
+	again, err := ConvertToEStargz(ctx, repository, dgst, 256)
+	if err != nil || again.Digest != desc.Digest {
+		t.Fatalf("expected the existing conversion, got %v, %v", again, err)
+	}
+	if _, err := ConvertToEStargz(ctx, repository, desc.Digest, 256); !errors.Is(err, ErrNothingToConvert) {
+		t.Fatalf("expected converted image not to be converted, got %v", err)
+	}
+}
+
+func TestConvertToZstdChunked(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repository := makeRepository(t, registry, "foo/bar")
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dgst, _, archive := pushTestImage(t, repository)
+	estargzDesc, err := ConvertToEStargz(ctx, repository, dgst, 256)
+	if err != nil {
+		t.Fatalf("unexpected error converting image to eStargz: %v", err)
+	}
+
+	desc, err := ConvertImage(ctx, repository, dgst, ConversionFormatZstdChunked, 256)
+	if err != nil {
+		t.Fatalf("unexpected error converting image: %v", err)
+	}
+
+	// the converted image holds a zstd:chunked layer decompressing to the
+	// original uncompressed layer
+	converted, err := manifests.Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting converted manifest: %v", err)
+	}
+	cm := converted.(*ocischema.DeserializedManifest)
+	if cm.Subject == nil || cm.Subject.Digest != dgst {
+		t.Fatalf("unexpected subject of the converted manifest: %v", cm.Subject)
+	}
+	if cm.Annotations[ConversionAnnotation] != ConversionFormatZstdChunked || len(cm.Layers) != 1 {
+		t.Fatalf("unexpected converted manifest: %v", cm.Manifest)
+	}
+	convertedLayer := cm.Layers[0]
+	if convertedLayer.MediaType != v1.MediaTypeImageLayerZstd || convertedLayer.Annotations[zstdchunked.ManifestChecksumAnnotation] == "" {
+		t.Fatalf("expected the converted layer to be a zstd:chunked layer: %v", convertedLayer)
+	}
+	p, err := repository.Blobs(ctx).Get(ctx, convertedLayer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := zstdchunked.ParseFooter(p[len(p)-zstdchunked.FooterSize:]); err != nil {
+		t.Fatalf("unexpected error parsing footer of the converted layer: %v", err)
+	}
+	zr, err := zstd.NewReader(bytes.NewReader(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	uncompressed, err := io.ReadAll(zr)
+	if err != nil || !bytes.Equal(uncompressed, archive) {
+		t.Fatalf("expected the converted layer to decompress to the original layer: %v", err)
+	}
+
+	// the referrers tag lists both conversions
+	tagDesc, err := repository.Tags(ctx).Get(ctx, "sha256-"+dgst.Encoded())
+	if err != nil {
+		t.Fatalf("unexpected error getting referrers tag: %v", err)
+	}
+	index, err := manifests.Get(ctx, tagDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	referrers := index.(*ocischema.DeserializedImageIndex).Manifests
+	if len(referrers) != 2 || referrers[0].Digest != estargzDesc.Digest || referrers[1].Digest != desc.Digest {
+		t.Fatalf("unexpected referrers: %v", referrers)
+	}
+
+	again, err := ConvertImage(ctx, repository, dgst, ConversionFormatZstdChunked, 256)
+	if err != nil || again.Digest != desc.Digest {
+		t.Fatalf("expected the existing conversion, got %v, %v", again, err)
+	}
+	if _, err := ConvertImage(ctx, repository, dgst, "zstd", 256); err == nil {
+		t.Fatal("expected an error converting to an unsupported format")
+	}
+}
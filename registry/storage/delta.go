@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/delta"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Delta describes a delta linked into a repository: the blob rebuilding the
+// target blob out of the base blob.
+type Delta struct {
+	// Target is the digest of the blob the delta rebuilds.
+	Target digest.Digest
+	// Base is the digest of the blob the delta applies to.
+	Base digest.Digest
+	// Digest and Size describe the blob of the delta.
+	Digest digest.Digest
+	Size   int64
+}
+
+// ErrDeltaTooLarge is returned when materializing a delta whose target is
+// larger than allowed.
+var ErrDeltaTooLarge = errors.New("delta target too large")
+
+// DeltaService links deltas into repositories, so that clients holding the
+// base of a blob can fetch its delta instead of the whole blob, and rebuilds
+// the targets of the deltas pushed in place of their blobs.
+type DeltaService struct {
+	driver driver.StorageDriver
+
+	// maxTargetSize bounds the size of the targets materialized, which
+	// deltas can make arbitrarily large by copying the base repeatedly.
+	maxTargetSize int64
+}
+
+// NewDeltaService returns a delta service storing the links of the deltas
+// in driver, materializing targets of at most maxTargetSize bytes.
+func NewDeltaService(driver driver.StorageDriver, maxTargetSize int64) *DeltaService {
+	return &DeltaService{driver: driver, maxTargetSize: maxTargetSize}
+}
+
+// Link links the delta into the repository. The blobs of the delta and of
+// its base must be linked into the repository, the target need not be.
+func (ds *DeltaService) Link(ctx context.Context, repository distribution.Repository, d Delta) error {
+	if d.Base == d.Target {
+		return fmt.Errorf("delta of %s with itself as base", d.Target)
+	}
+	blobs := repository.Blobs(ctx)
+	for _, dgst := range []digest.Digest{d.Digest, d.Base} {
+		if _, err := blobs.Stat(ctx, dgst); err != nil {
+			return err
+		}
+	}
+
+	linkPath, err := pathFor(deltaLinkPathSpec{name: repository.Named().Name(), target: d.Target, base: d.Base})
+	if err != nil {
+		return err
+	}
+	return ds.driver.PutContent(ctx, linkPath, []byte(d.Digest))
+}
+
+// Deltas returns the deltas of target linked into the repository, ordered by
+// base. Deltas whose blob is no longer in the repository are left out.
+func (ds *DeltaService) Deltas(ctx context.Context, repository distribution.Repository, target digest.Digest) ([]Delta, error) {
+	name := repository.Named().Name()
+	root, err := pathFor(deltaLinkPathSpec{name: name, target: target, list: true})
+	if err != nil {
+		return nil, err
+	}
+
+	algorithms, err := ds.driver.List(ctx, root)
+	if err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	blobs := repository.Blobs(ctx)
+	var deltas []Delta
+	for _, algorithm := range algorithms {
+		bases, err := ds.driver.List(ctx, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		for _, base := range bases {
+			baseDigest := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(algorithm)), path.Base(base))
+			if err := baseDigest.Validate(); err != nil {
+				continue
+			}
+			content, err := ds.driver.GetContent(ctx, path.Join(base, "link"))
+			if err != nil {
+				if errors.As(err, &driver.PathNotFoundError{}) {
+					continue
+				}
+				return nil, err
+			}
+			dgst, err := digest.Parse(string(content))
+			if err != nil {
+				return nil, err
+			}
+			desc, err := blobs.Stat(ctx, dgst)
+			if err != nil {
+				if err == distribution.ErrBlobUnknown {
+					continue
+				}
+				return nil, err
+			}
+			deltas = append(deltas, Delta{Target: target, Base: baseDigest, Digest: dgst, Size: desc.Size})
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Base < deltas[j].Base })
+	return deltas, nil
+}
+
+// Materialize rebuilds the target of the delta from its base, both linked
+// into the repository, and pushes it into the repository. The target is
+// committed only if it matches its digest.
+func (ds *DeltaService) Materialize(ctx context.Context, repository distribution.Repository, d Delta) (v1.Descriptor, error) {
+	blobs := repository.Blobs(ctx)
+	if desc, err := blobs.Stat(ctx, d.Target); err == nil {
+		return desc, nil
+	} else if err != distribution.ErrBlobUnknown {
+		return v1.Descriptor{}, err
+	}
+
+	base, err := blobs.Open(ctx, d.Base)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer base.Close()
+	deltaReader, err := blobs.Open(ctx, d.Digest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer deltaReader.Close()
+
+	bw, err := blobs.Create(ctx)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc, err := ds.materialize(ctx, bw, base, deltaReader, d.Target)
+	if err != nil {
+		if cancelErr := bw.Cancel(ctx); cancelErr != nil {
+			return v1.Descriptor{}, errors.Join(err, cancelErr)
+		}
+		return v1.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (ds *DeltaService) materialize(ctx context.Context, bw distribution.BlobWriter, base io.ReadSeeker, deltaReader io.Reader, target digest.Digest) (v1.Descriptor, error) {
+	w := &limitedWriter{w: bw, remaining: ds.maxTargetSize}
+	size, err := delta.Apply(w, &seekingReaderAt{r: base}, deltaReader)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return bw.Commit(ctx, v1.Descriptor{Digest: target, Size: size})
+}
+
+// limitedWriter fails the writes beyond its remaining bytes.
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, ErrDeltaTooLarge
+	}
+	n, err := lw.w.Write(p)
+	lw.remaining -= int64(n)
+	return n, err
+}
+
+// seekingReaderAt reads at offsets of a blob by seeking it, which is cheap
+// for the sequential reads of deltas.
+type seekingReaderAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (sr *seekingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if _, err := sr.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(sr.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// markDeltas marks the blobs of the deltas linked into the repository whose
+// target and base are both marked, so that they are kept as long as they can
+// be applied.
+func markDeltas(ctx context.Context, storageDriver driver.StorageDriver, name string, marked func(digest.Digest) bool, mark func(digest.Digest)) error {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return err
+	}
+	deltasPath := path.Join(root, name, "_deltas")
+
+	var links []string
+	err = storageDriver.Walk(ctx, deltasPath, func(fileInfo driver.FileInfo) error {
+		if !fileInfo.IsDir() && path.Base(fileInfo.Path()) == "link" {
+			links = append(links, fileInfo.Path())
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return nil
+		}
+		return err
+	}
+
+	for _, link := range links {
+		// <target algorithm>/<target hex>/<base algorithm>/<base hex>/link
+		components := strings.Split(strings.TrimPrefix(path.Dir(link), deltasPath+"/"), "/")
+		if len(components) != 4 {
+			continue
+		}
+		target := digest.NewDigestFromEncoded(digest.Algorithm(components[0]), components[1])
+		base := digest.NewDigestFromEncoded(digest.Algorithm(components[2]), components[3])
+		if !marked(target) || !marked(base) {
+			continue
+		}
+
+		content, err := storageDriver.GetContent(ctx, link)
+		if err != nil {
+			return err
+		}
+		dgst, err := digest.Parse(string(content))
+		if err != nil {
+			return err
+		}
+		mark(dgst)
+	}
+	return nil
+}
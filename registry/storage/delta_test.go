@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/delta"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func pushTestBlob(t *testing.T, repository distribution.Repository, content []byte) v1.Descriptor {
+	t.Helper()
+	desc, err := addBlob(context.Background(), repository.Blobs(context.Background()), v1.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))}, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("unexpected error adding blob: %v", err)
+	}
+	return desc
+}
+
+// testDelta returns a delta rebuilding the target from the base by
+// replacing their differing suffix.
+func testDelta(t *testing.T, base, target []byte, shared int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	dw := delta.NewWriter(&buf)
+	if err := dw.Copy(0, int64(shared)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Insert(target[shared:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDeltas(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	registry := createRegistry(t, driver)
+	repository := makeRepository(t, registry, "foo/bar")
+	deltas := NewDeltaService(driver, 1024)
+
+	base := bytes.Repeat([]byte("layer content "), 16)
+	target := append(append([]byte{}, base[:200]...), "rebuilt"...)
+	baseDesc := pushTestBlob(t, repository, base)
+	deltaDesc := pushTestBlob(t, repository, testDelta(t, base, target, 200))
+	d := Delta{Target: digest.FromBytes(target), Base: baseDesc.Digest, Digest: deltaDesc.Digest}
+
+	if list, err := deltas.Deltas(ctx, repository, d.Target); err != nil || len(list) != 0 {
+		t.Fatalf("expected no delta before linking, got %v, %v", list, err)
+	}
+	if err := deltas.Link(ctx, repository, Delta{Target: d.Target, Base: digest.FromString("unknown"), Digest: d.Digest}); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected a delta of an unknown base to fail, got %v", err)
+	}
+	if err := deltas.Link(ctx, repository, d); err != nil {
+		t.Fatalf("unexpected error linking delta: %v", err)
+	}
+
+	list, err := deltas.Deltas(ctx, repository, d.Target)
+	if err != nil {
+		t.Fatalf("unexpected error listing deltas: %v", err)
+	}
+	d.Size = deltaDesc.Size
+	if len(list) != 1 || list[0] != d {
+		t.Fatalf("unexpected deltas: %v", list)
+	}
+
+	// the target is rebuilt and verified
+	if _, err := deltas.Materialize(ctx, repository, Delta{Target: digest.FromString("other"), Base: d.Base, Digest: d.Digest}); !errors.As(err, &distribution.ErrBlobInvalidDigest{}) {
+		t.Fatalf("expected a mismatching target to fail, got %v", err)
+	}
+	desc, err := deltas.Materialize(ctx, repository, d)
+	if err != nil {
+		t.Fatalf("unexpected error materializing delta: %v", err)
+	}
+	if desc.Digest != d.Target || desc.Size != int64(len(target)) {
+		t.Fatalf("unexpected materialized target: %v", desc)
+	}
+	content, err := repository.Blobs(ctx).Get(ctx, d.Target)
+	if err != nil || !bytes.Equal(content, target) {
+		t.Fatalf("unexpected content of the target: %q, %v", content, err)
+	}
+
+	// targets are bounded
+	small := NewDeltaService(driver, 100)
+	if _, err := small.Materialize(ctx, makeRepository(t, registry, "foo/bar"), Delta{Target: digest.FromString("large"), Base: d.Base, Digest: d.Digest}); !errors.Is(err, ErrDeltaTooLarge) {
+		t.Fatalf("expected a large target to fail, got %v", err)
+	}
+}
+
+func TestGCKeepsDeltas(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	registry := createRegistry(t, driver)
+	repository := makeRepository(t, registry, "foo/bar")
+	deltas := NewDeltaService(driver, 1<<20)
+
+	image := uploadRandomOCIImage(t, repository)
+	layers := getKeys(image.layers)
+	var contents [2][]byte
+	for i, dgst := range layers[:2] {
+		if _, err := image.layers[dgst].Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		p, err := io.ReadAll(image.layers[dgst])
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[i] = p
+	}
+
+	// a delta between two layers of the image is kept, a delta to a blob
+	// no manifest references is not
+	kept := pushTestBlob(t, repository, testDelta(t, contents[0], contents[1], 0))
+	if err := deltas.Link(ctx, repository, Delta{Target: layers[1], Base: layers[0], Digest: kept.Digest}); err != nil {
+		t.Fatal(err)
+	}
+	removed := pushTestBlob(t, repository, testDelta(t, contents[0], []byte("unreferenced"), 0))
+	if err := deltas.Link(ctx, repository, Delta{Target: digest.FromString("unreferenced"), Base: layers[0], Digest: removed.Digest}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MarkAndSweep(ctx, driver, registry, GCOpts{}); err != nil {
+		t.Fatalf("failed mark and sweep: %v", err)
+	}
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[kept.Digest]; !ok {
+		t.Error("expected the delta between referenced layers to be kept")
+	}
+	if _, ok := blobs[removed.Digest]; ok {
+		t.Error("expected the delta of an unreferenced target to be removed")
+	}
+	if list, err := deltas.Deltas(ctx, repository, digest.FromString("unreferenced")); err != nil || len(list) != 0 {
+		t.Errorf("expected the removed delta not to be listed, got %v, %v", list, err)
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/distribution/distribution/v3/internal/dcontext"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/base"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
@@ -26,9 +28,14 @@ import (
 const (
 	driverName   = "azure"
 	maxChunkSize = 4 * 1024 * 1024
+
+	// maxBlockFromURLSize is the maximum size of the blocks staged from
+	// URLs.
+	maxBlockFromURLSize = 4000 * 1024 * 1024
 )
 
 var _ storagedriver.StorageDriver = &driver{}
+var _ storagedriver.Appender = &driver{}
 
 type driver struct {
 	azClient               *azureClient
@@ -36,6 +43,9 @@ type driver struct {
 	rootDirectory          string
 	copyStatusPollMaxRetry int
 	copyStatusPollDelay    time.Duration
+	accessTier             blob.AccessTier
+	rehydrateArchived      bool
+	rehydratePriority      blob.RehydratePriority
 }
 
 type baseEmbed struct {
@@ -81,6 +91,9 @@ func New(ctx context.Context, params *Parameters) (*Driver, error) {
 		rootDirectory:          params.RootDirectory,
 		copyStatusPollMaxRetry: params.CopyStatusPollMaxRetry,
 		copyStatusPollDelay:    copyStatusPollDelay,
+		accessTier:             blob.AccessTier(params.AccessTier),
+		rehydrateArchived:      params.RehydrateArchived,
+		rehydratePriority:      blob.RehydratePriority(params.RehydratePriority),
 	}
 	return &Driver{
 		baseEmbed: baseEmbed{
@@ -98,11 +111,15 @@ func (d *driver) Name() string {
 // GetContent retrieves the content stored at "path" as a []byte.
 func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 	// TODO(milosgajdos): should we get a RetryReader here?
-	resp, err := d.client.NewBlobClient(d.blobName(path)).DownloadStream(ctx, nil)
+	blobRef := d.client.NewBlobClient(d.blobName(path))
+	resp, err := blobRef.DownloadStream(ctx, nil)
 	if err != nil {
 		if is404(err) {
 			return nil, storagedriver.PathNotFoundError{Path: path}
 		}
+		if bloberror.HasCode(err, bloberror.BlobArchived) {
+			return nil, d.archivedError(ctx, path, blobRef, nil)
+		}
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -142,7 +159,9 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 	}
 
 	// TODO(milosgajdos): should we set some concurrency options on UploadBuffer
-	_, err = d.client.NewBlockBlobClient(blobName).UploadBuffer(ctx, contents, nil)
+	_, err = d.client.NewBlockBlobClient(blobName).UploadBuffer(ctx, contents, &blockblob.UploadBufferOptions{
+		AccessTier: d.getAccessTier(),
+	})
 	return err
 }
 
@@ -165,6 +184,9 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 	if props.ContentLength == nil {
 		return nil, fmt.Errorf("missing ContentLength: %s", path)
 	}
+	if props.AccessTier != nil && blob.AccessTier(*props.AccessTier) == blob.AccessTierArchive {
+		return nil, d.archivedError(ctx, path, blobRef, props.ArchiveStatus)
+	}
 	size := *props.ContentLength
 	if offset >= size {
 		return io.NopCloser(bytes.NewReader(nil)), nil
@@ -220,6 +242,12 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 	return d.newWriter(ctx, blobName, size), nil
 }
 
+// Append returns a FileWriter appending blocks to the append blob at path,
+// without copying its content.
+func (d *driver) Append(ctx context.Context, path string) (storagedriver.FileWriter, error) {
+	return d.Writer(ctx, path, true)
+}
+
 // Stat retrieves the FileInfo for the given path, including the current size
 // in bytes and the creation time.
 func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
@@ -303,12 +331,33 @@ func (d *driver) List(ctx context.Context, path string) ([]string, error) {
 // Move moves an object stored at sourcePath to destPath, removing the original
 // object.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
-	sourceBlobURL, err := d.signBlobURL(ctx, sourcePath)
+	sourceBlobURL, err := d.signBlobURL(ctx, sourcePath, storagedriver.DefaultRedirectExpiry)
 	if err != nil {
 		return err
 	}
 	destBlobRef := d.client.NewBlockBlobClient(d.blobName(destPath))
-	resp, err := destBlobRef.StartCopyFromURL(ctx, sourceBlobURL, nil)
+	if d.accessTier != "" {
+		// blobs are uploaded to append blobs, which have no access tier,
+		// so their content is copied to block blobs instead
+		sourceBlobRef := d.client.NewBlobClient(d.blobName(sourcePath))
+		props, err := sourceBlobRef.GetProperties(ctx, nil)
+		if err != nil {
+			if is404(err) {
+				return storagedriver.PathNotFoundError{Path: sourcePath}
+			}
+			return err
+		}
+		if props.BlobType != nil && *props.BlobType == blob.BlobTypeAppendBlob && props.ContentLength != nil {
+			if err := d.copyToBlockBlob(ctx, sourceBlobURL, *props.ContentLength, destBlobRef); err != nil {
+				return err
+			}
+			_, err = sourceBlobRef.Delete(ctx, nil)
+			return err
+		}
+	}
+	resp, err := destBlobRef.StartCopyFromURL(ctx, sourceBlobURL, &blob.StartCopyFromURLOptions{
+		Tier: d.getAccessTier(),
+	})
 	if err != nil {
 		if is404(err) {
 			return storagedriver.PathNotFoundError{Path: sourcePath}
@@ -357,6 +406,87 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 	return err
 }
 
+// copyToBlockBlob copies the size bytes of the blob at sourceBlobURL to the
+// block blob destBlobRef, in the access tier of the driver.
+func (d *driver) copyToBlockBlob(ctx context.Context, sourceBlobURL string, size int64, destBlobRef *blockblob.Client) error {
+	var blockIDs []string
+	for offset := int64(0); offset < size; offset += maxBlockFromURLSize {
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%016x", offset)))
+		_, err := destBlobRef.StageBlockFromURL(ctx, blockID, sourceBlobURL, &blockblob.StageBlockFromURLOptions{
+			Range: blob.HTTPRange{Offset: offset, Count: min(size-offset, maxBlockFromURLSize)},
+		})
+		if err != nil && len(blockIDs) == 0 && bloberror.HasCode(err, bloberror.InvalidBlobType) {
+			// the destination is an append blob, which blocks cannot be
+			// staged to
+			if _, err := destBlobRef.Delete(ctx, nil); err != nil && !is404(err) {
+				return err
+			}
+			_, err = destBlobRef.StageBlockFromURL(ctx, blockID, sourceBlobURL, &blockblob.StageBlockFromURLOptions{
+				Range: blob.HTTPRange{Offset: offset, Count: min(size-offset, maxBlockFromURLSize)},
+			})
+		}
+		if err != nil {
+			return err
+		}
+		blockIDs = append(blockIDs, blockID)
+	}
+	_, err := destBlobRef.CommitBlockList(ctx, blockIDs, &blockblob.CommitBlockListOptions{
+		Tier: d.getAccessTier(),
+	})
+	return err
+}
+
+// archivedError returns the error of reading the archived blob at path,
+// whose archiveStatus is read from its properties if nil, after
+// requesting its rehydration if archived blobs are rehydrated.
+func (d *driver) archivedError(ctx context.Context, path string, blobRef *blob.Client, archiveStatus *string) error {
+	archived := storagedriver.ArchivedContentError{Path: path, DriverName: driverName}
+	if archiveStatus == nil {
+		if props, err := blobRef.GetProperties(ctx, nil); err == nil {
+			archiveStatus = props.ArchiveStatus
+		}
+	}
+	// Standard priority rehydrations take up to 15 hours, and high
+	// priority ones less than an hour for blobs under 10 GiB
+	retryAfter := 15 * time.Hour
+	if d.rehydratePriority == blob.RehydratePriorityHigh {
+		retryAfter = time.Hour
+	}
+
+	if archiveStatus != nil && strings.HasPrefix(*archiveStatus, "rehydrate-pending-to-") {
+		archived.Restoring = true
+		archived.RetryAfter = retryAfter
+		return archived
+	}
+	if !d.rehydrateArchived {
+		return archived
+	}
+
+	tier := blob.AccessTierHot
+	if d.accessTier != "" {
+		tier = d.accessTier
+	}
+	_, err := blobRef.SetTier(ctx, tier, &blob.SetTierOptions{RehydratePriority: &d.rehydratePriority})
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobBeingRehydrated) {
+		dcontext.GetLogger(ctx).Warnf("azure: failed to rehydrate archived blob %s: %v", path, err)
+		archived.Detail = err
+		return archived
+	}
+	if err == nil {
+		dcontext.GetLogger(ctx).Infof("azure: rehydrating archived blob %s to the %s tier", path, tier)
+	}
+	archived.Restoring = true
+	archived.RetryAfter = retryAfter
+	return archived
+}
+
+func (d *driver) getAccessTier() *blob.AccessTier {
+	if d.accessTier == "" {
+		return nil
+	}
+	return &d.accessTier
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (d *driver) Delete(ctx context.Context, path string) error {
 	blobRef := d.client.NewBlobClient(d.blobName(path))
@@ -391,11 +521,14 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 // for specified duration by making use of Azure Storage Shared Access Signatures (SAS).
 // See https://msdn.microsoft.com/en-us/library/azure/ee395415.aspx for more info.
 func (d *driver) RedirectURL(req *http.Request, path string) (string, error) {
-	return d.signBlobURL(req.Context(), path)
+	if !d.azClient.CanRedirect() {
+		return "", nil
+	}
+	return d.signBlobURL(req.Context(), path, storagedriver.RedirectExpiry(req))
 }
 
-func (d *driver) signBlobURL(ctx context.Context, path string) (string, error) {
-	expiresTime := time.Now().UTC().Add(20 * time.Minute) // default expiration
+func (d *driver) signBlobURL(ctx context.Context, path string, expiry time.Duration) (string, error) {
+	expiresTime := time.Now().UTC().Add(expiry)
 	blobName := d.blobName(path)
 	blobRef := d.client.NewBlobClient(blobName)
 	return d.azClient.SignBlobURL(ctx, blobRef.URL(), expiresTime)
@@ -2,21 +2,36 @@ package azure
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+	"github.com/distribution/distribution/v3/internal/dcontext"
 )
 
 const (
 	UDCGracePeriod = 30.0 * time.Minute
 	UDCExpiryTime  = 48.0 * time.Hour
+
+	// SASGracePeriod is the time before their expiry SAS tokens are
+	// renewed, and SASRefreshInterval the interval SAS tokens without an
+	// expiry are read again from their source.
+	SASGracePeriod     = 5 * time.Minute
+	SASRefreshInterval = time.Minute
 )
 
 // signer abstracts the specifics of a blob SAS and is specialized
@@ -37,6 +52,12 @@ type clientTokenSigner struct {
 	udcExpiry time.Time
 }
 
+// sasSigner signs blob urls with the SAS token of the driver, which cannot
+// be restricted to a blob.
+type sasSigner struct {
+	token *sasToken
+}
+
 // azureClient abstracts signing blob urls for a container since the
 // azure apis have completely different underlying authentication apis
 type azureClient struct {
@@ -46,6 +67,25 @@ type azureClient struct {
 }
 
 func newAzureClient(params *Parameters) (*azureClient, error) {
+	if params.Credentials.Type == credentialsTypeSAS {
+		token := newSASToken(params.ServiceURL, &params.Credentials)
+		client, err := azblob.NewClientWithNoCredential(params.ServiceURL, &azblob.ClientOptions{
+			ClientOptions: azcore.ClientOptions{
+				// the token is added to each attempt, so that retries use
+				// the renewed token
+				PerRetryPolicies: []policy.Policy{&sasPolicy{token: token}},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &azureClient{
+			container: params.Container,
+			client:    client,
+			signer:    &sasSigner{token: token},
+		}, nil
+	}
+
 	if params.AccountKey != "" {
 		cred, err := azblob.NewSharedKeyCredential(params.AccountName, params.AccountKey)
 		if err != nil {
@@ -65,14 +105,8 @@ func newAzureClient(params *Parameters) (*azureClient, error) {
 		}, nil
 	}
 
-	var cred azcore.TokenCredential
-	var err error
-	if params.Credentials.Type == "client_secret" {
-		creds := &params.Credentials
-		if cred, err = azidentity.NewClientSecretCredential(creds.TenantID, creds.ClientID, creds.Secret, nil); err != nil {
-			return nil, err
-		}
-	} else if cred, err = azidentity.NewDefaultAzureCredential(nil); err != nil {
+	cred, err := newTokenCredential(&params.Credentials)
+	if err != nil {
 		return nil, err
 	}
 
@@ -91,6 +125,58 @@ func newAzureClient(params *Parameters) (*azureClient, error) {
 	}, nil
 }
 
+// newTokenCredential returns the credential of creds, which acquires tokens
+// and refreshes them before they expire.
+func newTokenCredential(creds *Credentials) (azcore.TokenCredential, error) {
+	switch creds.Type {
+	case credentialsTypeClientSecret:
+		return azidentity.NewClientSecretCredential(creds.TenantID, creds.ClientID, creds.Secret, nil)
+	case credentialsTypeClientCertificate:
+		data, err := os.ReadFile(creds.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		var password []byte
+		if creds.CertificatePassword != "" {
+			password = []byte(creds.CertificatePassword)
+		}
+		certs, key, err := azidentity.ParseCertificates(data, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+		return azidentity.NewClientCertificateCredential(creds.TenantID, creds.ClientID, certs, key, nil)
+	case credentialsTypeManagedIdentity:
+		options := &azidentity.ManagedIdentityCredentialOptions{}
+		// the identity assigned to the host is used by default
+		if creds.ClientID != "" {
+			options.ID = azidentity.ClientID(creds.ClientID)
+		} else if creds.ResourceID != "" {
+			options.ID = azidentity.ResourceID(creds.ResourceID)
+		}
+		return azidentity.NewManagedIdentityCredential(options)
+	case credentialsTypeWorkloadIdentity:
+		// the parameters default to the environment variables set by the
+		// workload identity webhook
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientID:      creds.ClientID,
+			TenantID:      creds.TenantID,
+			TokenFilePath: creds.TokenFile,
+		})
+	default:
+		return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			TenantID: creds.TenantID,
+		})
+	}
+}
+
+// CanRedirect tells whether the blob urls signed by the client can be
+// handed to clients, which they cannot when signed with the SAS token of the
+// driver, as it grants access to the whole container.
+func (a *azureClient) CanRedirect() bool {
+	_, ok := a.signer.(*sasSigner)
+	return !ok
+}
+
 func (a *azureClient) ContainerClient() *container.Client {
 	return a.client.ServiceClient().NewContainerClient(a.container)
 }
@@ -150,3 +236,115 @@ func (s *clientTokenSigner) Sign(ctx context.Context, signatureValues *sas.BlobS
 	}
 	return signatureValues.SignWithUserDelegation(udc)
 }
+
+func (s *sasSigner) Sign(ctx context.Context, signatureValues *sas.BlobSignatureValues) (sas.QueryParameters, error) {
+	token, err := s.token.get(ctx)
+	if err != nil {
+		return sas.QueryParameters{}, err
+	}
+	return token.SAS, nil
+}
+
+// sasToken provides the SAS token of the driver, such as a user delegation
+// SAS, from its source, and renews it before it expires. Requests are
+// authorized one at a time, so that the requests of in-flight uploads are
+// authorized with the renewed token.
+type sasToken struct {
+	serviceURL string
+	source     func(context.Context) (string, error)
+
+	mu      sync.Mutex
+	token   *sas.URLParts
+	fetched time.Time
+}
+
+// newSASToken returns the SAS token of the credentials, which is either
+// sastoken, read from sastokenfile, or minted by sascommand.
+func newSASToken(serviceURL string, creds *Credentials) *sasToken {
+	t := &sasToken{serviceURL: serviceURL}
+	switch {
+	case creds.SASTokenFile != "":
+		t.source = func(context.Context) (string, error) {
+			data, err := os.ReadFile(creds.SASTokenFile)
+			return string(data), err
+		}
+	case creds.SASCommand != "":
+		t.source = func(ctx context.Context) (string, error) {
+			args := strings.Fields(creds.SASCommand)
+			cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+			cmd.Stderr = os.Stderr
+			out, err := cmd.Output()
+			return string(out), err
+		}
+	default:
+		t.source = func(context.Context) (string, error) {
+			return creds.SASToken, nil
+		}
+	}
+	return t
+}
+
+// get returns the token, renewing it if it expires within SASGracePeriod.
+// The token is kept until it expires when it fails to be renewed.
+func (t *sasToken) get(ctx context.Context) (*sas.URLParts, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.token != nil {
+		expiry := t.token.SAS.ExpiryTime()
+		if expiry.IsZero() && now.Sub(t.fetched) < SASRefreshInterval || !expiry.IsZero() && expiry.Sub(now) > SASGracePeriod {
+			return t.token, nil
+		}
+	}
+
+	token, err := t.fetch(ctx)
+	if err != nil {
+		if t.token != nil && (t.token.SAS.ExpiryTime().IsZero() || now.Before(t.token.SAS.ExpiryTime())) {
+			dcontext.GetLogger(ctx).Warnf("azure: failed to renew SAS token, using the current token until it expires: %v", err)
+			return t.token, nil
+		}
+		return nil, err
+	}
+	t.token = token
+	t.fetched = now
+	return t.token, nil
+}
+
+// fetch gets a token from the source of the token.
+func (t *sasToken) fetch(ctx context.Context) (*sas.URLParts, error) {
+	token, err := t.source(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SAS token: %w", err)
+	}
+	parts, err := sas.ParseURL(t.serviceURL + "?" + strings.TrimPrefix(strings.TrimSpace(token), "?"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SAS token: %w", err)
+	}
+	if parts.SAS.Signature() == "" {
+		return nil, errors.New("invalid SAS token: no signature")
+	}
+	return &parts, nil
+}
+
+// sasPolicy authorizes requests with a SAS token.
+type sasPolicy struct {
+	token *sasToken
+}
+
+func (p *sasPolicy) Do(req *policy.Request) (*http.Response, error) {
+	token, err := p.token.get(req.Raw().Context())
+	if err != nil {
+		return nil, err
+	}
+	sasQuery, err := url.ParseQuery(token.SAS.Encode())
+	if err != nil {
+		return nil, err
+	}
+	query := req.Raw().URL.Query()
+	for k, v := range sasQuery {
+		query[k] = v
+	}
+	req.Raw().URL.RawQuery = query.Encode()
+	return req.Next()
+}
@@ -2,11 +2,30 @@ package azure
 
 import (
 	"context"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
 )
@@ -154,6 +173,15 @@ func TestParamParsing(t *testing.T) {
 	expectErrors := []map[string]interface{}{
 		{},
 		{"accountname": "acc1"},
+		{"accountname": "acc1", "container": "c1", "credentials": map[string]interface{}{"type": "client_secret", "clientid": "c1", "tenantid": "t1"}},
+		{"accountname": "acc1", "container": "c1", "credentials": map[string]interface{}{"type": "client_certificate", "clientid": "c1", "tenantid": "t1"}},
+		{"accountname": "acc1", "container": "c1", "credentials": map[string]interface{}{"type": "managed_identity", "clientid": "c1", "resourceid": "r1"}},
+		{"accountname": "acc1", "container": "c1", "credentials": map[string]interface{}{"type": "password"}},
+		{"accountname": "acc1", "container": "c1", "credentials": map[string]interface{}{"type": "sas"}},
+		{"accountname": "acc1", "container": "c1", "credentials": map[string]interface{}{"type": "sas", "sastoken": "sv=2022-11-02&sig=s", "sascommand": "mint-sas"}},
+		{"accountname": "acc1", "accountkey": "k1", "container": "c1", "credentials": map[string]interface{}{"type": "sas", "sastoken": "sv=2022-11-02&sig=s"}},
+		{"accountname": "acc1", "accountkey": "k1", "container": "c1", "accesstier": "Archive"},
+		{"accountname": "acc1", "accountkey": "k1", "container": "c1", "rehydratepriority": "Low"},
 	}
 	for _, parameters := range expectErrors {
 		if _, err := NewParameters(parameters); err == nil {
@@ -164,23 +192,30 @@ func TestParamParsing(t *testing.T) {
 		{"accountname": "acc1", "accountkey": "k1", "container": "c1", "copy_status_poll_max_retry": 1, "copy_status_poll_delay": "10ms"},
 		{"accountname": "acc1", "container": "c1", "credentials": map[string]interface{}{"type": "default"}},
 		{"accountname": "acc1", "container": "c1", "credentials": map[string]interface{}{"type": "client_secret", "clientid": "c1", "tenantid": "t1", "secret": "s1"}},
+		{"accountname": "acc1", "accountkey": "k1", "container": "c1", "accesstier": "cool", "rehydratearchived": true, "rehydratepriority": "high"},
 	}
 	expecteds := []Parameters{
 		{
 			Container: "c1", AccountName: "acc1", AccountKey: "k1",
 			Realm: "core.windows.net", ServiceURL: "https://acc1.blob.core.windows.net",
-			CopyStatusPollMaxRetry: 1, CopyStatusPollDelay: "10ms",
+			CopyStatusPollMaxRetry: 1, CopyStatusPollDelay: "10ms", RehydratePriority: "Standard",
 		},
 		{
 			Container: "c1", AccountName: "acc1", Credentials: Credentials{Type: "default"},
 			Realm: "core.windows.net", ServiceURL: "https://acc1.blob.core.windows.net",
-			CopyStatusPollMaxRetry: 5, CopyStatusPollDelay: "100ms",
+			CopyStatusPollMaxRetry: 5, CopyStatusPollDelay: "100ms", RehydratePriority: "Standard",
 		},
 		{
 			Container: "c1", AccountName: "acc1",
 			Credentials: Credentials{Type: "client_secret", ClientID: "c1", TenantID: "t1", Secret: "s1"},
 			Realm:       "core.windows.net", ServiceURL: "https://acc1.blob.core.windows.net",
+			CopyStatusPollMaxRetry: 5, CopyStatusPollDelay: "100ms", RehydratePriority: "Standard",
+		},
+		{
+			Container: "c1", AccountName: "acc1", AccountKey: "k1",
+			Realm: "core.windows.net", ServiceURL: "https://acc1.blob.core.windows.net",
 			CopyStatusPollMaxRetry: 5, CopyStatusPollDelay: "100ms",
+			AccessTier: "Cool", RehydrateArchived: true, RehydratePriority: "High",
 		},
 	}
 	for i, expected := range expecteds {
@@ -193,3 +228,308 @@ func TestParamParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenCredential(t *testing.T) {
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "registry"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling key: %v", err)
+	}
+	certificate := filepath.Join(t.TempDir(), "certificate.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	if err := os.WriteFile(certificate, data, 0o600); err != nil {
+		t.Fatalf("unexpected error writing certificate: %v", err)
+	}
+
+	for _, env := range []string{"AZURE_CLIENT_ID", "AZURE_TENANT_ID", "AZURE_FEDERATED_TOKEN_FILE"} {
+		t.Setenv(env, "")
+	}
+
+	for _, tc := range []struct {
+		creds    Credentials
+		expected interface{}
+		err      bool
+	}{
+		{creds: Credentials{}, expected: &azidentity.DefaultAzureCredential{}},
+		{creds: Credentials{Type: "client_secret", TenantID: "t1", ClientID: "c1", Secret: "s1"}, expected: &azidentity.ClientSecretCredential{}},
+		{creds: Credentials{Type: "client_certificate", TenantID: "t1", ClientID: "c1", Certificate: certificate}, expected: &azidentity.ClientCertificateCredential{}},
+		{creds: Credentials{Type: "client_certificate", TenantID: "t1", ClientID: "c1", Certificate: filepath.Join(t.TempDir(), "missing.pem")}, err: true},
+		{creds: Credentials{Type: "managed_identity"}, expected: &azidentity.ManagedIdentityCredential{}},
+		{creds: Credentials{Type: "managed_identity", ClientID: "c1"}, expected: &azidentity.ManagedIdentityCredential{}},
+		{creds: Credentials{Type: "workload_identity", TenantID: "t1", ClientID: "c1", TokenFile: "/var/run/secrets/azure/tokens/azure-identity-token"}, expected: &azidentity.WorkloadIdentityCredential{}},
+		// without the parameters or the environment of the webhook
+		{creds: Credentials{Type: "workload_identity"}, err: true},
+	} {
+		cred, err := newTokenCredential(&tc.creds)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error", tc.creds)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.creds, err)
+			continue
+		}
+		if reflect.TypeOf(cred) != reflect.TypeOf(tc.expected) {
+			t.Errorf("%+v: unexpected credential %T, expected %T", tc.creds, cred, tc.expected)
+		}
+	}
+}
+
+func TestSASToken(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		requested []url.Values
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Query())
+		mu.Unlock()
+		w.Header().Set("Content-Length", "7")
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer s.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "sas")
+	writeToken := func(sig string, expiry time.Time) {
+		token := url.Values{"sv": {"2022-11-02"}, "sr": {"c"}, "sp": {"racwdl"}, "se": {expiry.UTC().Format(sas.TimeFormat)}, "sig": {sig}}
+		if err := os.WriteFile(tokenFile, []byte(token.Encode()+"\n"), 0o600); err != nil {
+			t.Fatalf("unexpected error writing token: %v", err)
+		}
+	}
+	// the first token expires within the grace period, and is renewed
+	// for each request until the token is renewed for longer
+	writeToken("first", time.Now().Add(SASGracePeriod/2))
+
+	params, err := NewParameters(map[string]interface{}{
+		"accountname": "acc1",
+		"container":   "c1",
+		"serviceurl":  s.URL,
+		"credentials": map[string]interface{}{"type": "sas", "sastokenfile": tokenFile},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error parsing parameters: %v", err)
+	}
+	d, err := New(context.Background(), params)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	ctx := context.Background()
+	if _, err := d.GetContent(ctx, "/file"); err != nil {
+		t.Fatalf("unexpected error getting content: %v", err)
+	}
+	writeToken("second", time.Now().Add(time.Hour))
+	if _, err := d.GetContent(ctx, "/file"); err != nil {
+		t.Fatalf("unexpected error getting content: %v", err)
+	}
+	// the token that is not about to expire is kept
+	writeToken("third", time.Now().Add(time.Hour))
+	if _, err := d.GetContent(ctx, "/file"); err != nil {
+		t.Fatalf("unexpected error getting content: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var signatures []string
+	for _, query := range requested {
+		signatures = append(signatures, query.Get("sig"))
+	}
+	if !reflect.DeepEqual(signatures, []string{"first", "second", "second"}) {
+		t.Errorf("unexpected signatures %v of the requests", signatures)
+	}
+
+	// the token of the driver is not handed to clients
+	if u, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, "/", nil), "/file"); err != nil || u != "" {
+		t.Errorf("expected no redirect, got %q: %v", u, err)
+	}
+}
+
+func TestSASCommand(t *testing.T) {
+	token := newSASToken("https://acc1.blob.core.windows.net", &Credentials{Type: "sas", SASCommand: "echo ?sv=2022-11-02&sr=c&sp=r&sig=minted"})
+	parts, err := token.get(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error minting token: %v", err)
+	}
+	if parts.SAS.Signature() != "minted" || !parts.SAS.ExpiryTime().IsZero() {
+		t.Errorf("unexpected token %s", parts.SAS.Encode())
+	}
+
+	token = newSASToken("https://acc1.blob.core.windows.net", &Credentials{Type: "sas", SASCommand: "echo sv=2022-11-02"})
+	if _, err := token.get(context.Background()); err == nil {
+		t.Error("expected an error for a token without a signature")
+	}
+}
+
+// testBlob is a blob of the fake blob service of TestAccessTiers.
+type testBlob struct {
+	data          []byte
+	blobType      string
+	tier          string
+	archiveStatus string
+}
+
+func TestAccessTiers(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		blobs    = map[string]*testBlob{}
+		blocks   = map[string][]byte{}
+		priority string
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		fail := func(status int, code string) {
+			w.Header().Set("x-ms-error-code", code)
+			w.WriteHeader(status)
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/c1/")
+		source := func() []byte {
+			u, _ := url.Parse(r.Header.Get("x-ms-copy-source"))
+			return blobs[strings.TrimPrefix(u.Path, "/c1/")].data
+		}
+		q := r.URL.Query()
+		b, ok := blobs[name]
+		switch {
+		case r.Method == http.MethodHead:
+			if !ok {
+				fail(http.StatusNotFound, "BlobNotFound")
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(b.data)))
+			w.Header().Set("x-ms-blob-type", b.blobType)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			if b.tier != "" {
+				w.Header().Set("x-ms-access-tier", b.tier)
+			}
+			if b.archiveStatus != "" {
+				w.Header().Set("x-ms-archive-status", b.archiveStatus)
+			}
+		case r.Method == http.MethodGet:
+			if !ok {
+				fail(http.StatusNotFound, "BlobNotFound")
+				return
+			}
+			if b.tier == "Archive" {
+				fail(http.StatusConflict, "BlobArchived")
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(b.data)))
+			_, _ = w.Write(b.data)
+		case r.Method == http.MethodPut && q.Get("comp") == "tier":
+			if b.archiveStatus != "" {
+				fail(http.StatusConflict, "BlobBeingRehydrated")
+				return
+			}
+			b.archiveStatus = "rehydrate-pending-to-" + strings.ToLower(r.Header.Get("x-ms-access-tier"))
+			priority = r.Header.Get("x-ms-rehydrate-priority")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && q.Get("comp") == "block":
+			if ok && b.blobType != "BlockBlob" {
+				fail(http.StatusConflict, "InvalidBlobType")
+				return
+			}
+			var start, end int
+			fmt.Sscanf(r.Header.Get("x-ms-source-range"), "bytes=%d-%d", &start, &end)
+			blocks[q.Get("blockid")] = source()[start : end+1]
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+			var list struct {
+				Latest []string
+			}
+			body, _ := io.ReadAll(r.Body)
+			_ = xml.Unmarshal(body, &list)
+			b := &testBlob{blobType: "BlockBlob", tier: r.Header.Get("x-ms-access-tier")}
+			for _, id := range list.Latest {
+				b.data = append(b.data, blocks[id]...)
+			}
+			blobs[name] = b
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && r.Header.Get("x-ms-copy-source") != "":
+			blobs[name] = &testBlob{data: source(), blobType: "BlockBlob", tier: r.Header.Get("x-ms-access-tier")}
+			w.Header().Set("x-ms-copy-id", "copy")
+			w.Header().Set("x-ms-copy-status", "success")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			blobs[name] = &testBlob{data: body, blobType: r.Header.Get("x-ms-blob-type"), tier: r.Header.Get("x-ms-access-tier")}
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodDelete:
+			delete(blobs, name)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			fail(http.StatusBadRequest, "UnsupportedHttpVerb")
+		}
+	}))
+	defer s.Close()
+
+	params, err := NewParameters(map[string]interface{}{
+		"accountname":       "acc1",
+		"container":         "c1",
+		"serviceurl":        s.URL,
+		"credentials":       map[string]interface{}{"type": "sas", "sastoken": "sv=2022-11-02&sr=c&sp=racwdl&sig=s"},
+		"accesstier":        "Cool",
+		"rehydratearchived": true,
+		"rehydratepriority": "High",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error parsing parameters: %v", err)
+	}
+	d, err := New(context.Background(), params)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/content", []byte("content")); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	if tier := blobs["content"].tier; tier != "Cool" {
+		t.Errorf("unexpected tier %q of the content", tier)
+	}
+
+	// uploads are moved to block blobs in the tier
+	blobs["upload"] = &testBlob{data: []byte("upload"), blobType: "AppendBlob"}
+	blobs["data"] = &testBlob{data: []byte("previous"), blobType: "AppendBlob"}
+	if err := d.Move(ctx, "/upload", "/data"); err != nil {
+		t.Fatalf("unexpected error moving upload: %v", err)
+	}
+	if b := blobs["data"]; b.blobType != "BlockBlob" || b.tier != "Cool" || string(b.data) != "upload" {
+		t.Errorf("unexpected blob %s %s %q", b.blobType, b.tier, b.data)
+	}
+	if _, ok := blobs["upload"]; ok {
+		t.Error("expected the upload to be deleted")
+	}
+
+	// archived blobs are rehydrated to the tier
+	blobs["data"].tier = "Archive"
+	for _, read := range []func() error{
+		func() error { _, err := d.Reader(ctx, "/data", 0); return err },
+		func() error { _, err := d.GetContent(ctx, "/data"); return err },
+	} {
+		var archived storagedriver.ArchivedContentError
+		if err := read(); !errors.As(err, &archived) || !archived.Restoring || archived.RetryAfter != time.Hour {
+			t.Errorf("unexpected error %#v, expected the blob to be rehydrated", err)
+		}
+	}
+	if b := blobs["data"]; b.archiveStatus != "rehydrate-pending-to-cool" || priority != "High" {
+		t.Errorf("unexpected rehydration %s with priority %s", b.archiveStatus, priority)
+	}
+}
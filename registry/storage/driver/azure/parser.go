@@ -3,6 +3,7 @@ package azure
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/mitchellh/mapstructure"
 )
@@ -11,13 +12,82 @@ const (
 	defaultRealm                  = "core.windows.net"
 	defaultCopyStatusPollMaxRetry = 5
 	defaultCopyStatusPollDelay    = "100ms"
+	defaultRehydratePriority      = "Standard"
+)
+
+// accessTiers are the online access tiers blobs can be stored in, and
+// rehydratePriorities the priorities archived blobs can be rehydrated with.
+var (
+	accessTiers         = []string{"Hot", "Cool", "Cold"}
+	rehydratePriorities = []string{"Standard", "High"}
+)
+
+// findFold returns the value of values equal to s under case folding.
+func findFold(values []string, s string) (string, bool) {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// The types of the credentials used without an account key.
+const (
+	credentialsTypeDefault           = "default"
+	credentialsTypeClientSecret      = "client_secret"
+	credentialsTypeClientCertificate = "client_certificate"
+	credentialsTypeManagedIdentity   = "managed_identity"
+	credentialsTypeWorkloadIdentity  = "workload_identity"
+	credentialsTypeSAS               = "sas"
 )
 
 type Credentials struct {
-	Type     string `mapstructure:"type"`
-	ClientID string `mapstructure:"clientid"`
-	TenantID string `mapstructure:"tenantid"`
-	Secret   string `mapstructure:"secret"`
+	Type                string `mapstructure:"type"`
+	ClientID            string `mapstructure:"clientid"`
+	TenantID            string `mapstructure:"tenantid"`
+	Secret              string `mapstructure:"secret"`
+	Certificate         string `mapstructure:"certificate"`
+	CertificatePassword string `mapstructure:"certificatepassword"`
+	ResourceID          string `mapstructure:"resourceid"`
+	TokenFile           string `mapstructure:"tokenfile"`
+	SASToken            string `mapstructure:"sastoken"`
+	SASTokenFile        string `mapstructure:"sastokenfile"`
+	SASCommand          string `mapstructure:"sascommand"`
+}
+
+// validate checks that the credentials have the parameters their type
+// requires.
+func (c *Credentials) validate() error {
+	switch c.Type {
+	case "", credentialsTypeDefault:
+	case credentialsTypeClientSecret:
+		if c.TenantID == "" || c.ClientID == "" || c.Secret == "" {
+			return errors.New("client_secret credentials require the tenantid, clientid and secret parameters")
+		}
+	case credentialsTypeClientCertificate:
+		if c.TenantID == "" || c.ClientID == "" || c.Certificate == "" {
+			return errors.New("client_certificate credentials require the tenantid, clientid and certificate parameters")
+		}
+	case credentialsTypeManagedIdentity:
+		if c.ClientID != "" && c.ResourceID != "" {
+			return errors.New("managed_identity credentials take either the clientid or the resourceid parameter")
+		}
+	case credentialsTypeWorkloadIdentity:
+	case credentialsTypeSAS:
+		sources := 0
+		for _, source := range []string{c.SASToken, c.SASTokenFile, strings.TrimSpace(c.SASCommand)} {
+			if source != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return errors.New("sas credentials require one of the sastoken, sastokenfile and sascommand parameters")
+		}
+	default:
+		return fmt.Errorf("unknown credentials type %q", c.Type)
+	}
+	return nil
 }
 
 type Parameters struct {
@@ -31,6 +101,9 @@ type Parameters struct {
 	ServiceURL             string      `mapstructure:"serviceurl"`
 	CopyStatusPollMaxRetry int         `mapstructure:"copy_status_poll_max_retry"`
 	CopyStatusPollDelay    string      `mapstructure:"copy_status_poll_delay"`
+	AccessTier             string      `mapstructure:"accesstier"`
+	RehydrateArchived      bool        `mapstructure:"rehydratearchived"`
+	RehydratePriority      string      `mapstructure:"rehydratepriority"`
 }
 
 func NewParameters(parameters map[string]interface{}) (*Parameters, error) {
@@ -46,6 +119,12 @@ func NewParameters(parameters map[string]interface{}) (*Parameters, error) {
 	if params.Container == "" {
 		return nil, errors.New("no container parameter provider")
 	}
+	if err := params.Credentials.validate(); err != nil {
+		return nil, err
+	}
+	if params.Credentials.Type == credentialsTypeSAS && params.AccountKey != "" {
+		return nil, errors.New("sas credentials cannot be used with the accountkey parameter")
+	}
 	if params.ServiceURL == "" {
 		params.ServiceURL = fmt.Sprintf("https://%s.blob.%s", params.AccountName, params.Realm)
 	}
@@ -55,5 +134,20 @@ func NewParameters(parameters map[string]interface{}) (*Parameters, error) {
 	if params.CopyStatusPollDelay == "" {
 		params.CopyStatusPollDelay = defaultCopyStatusPollDelay
 	}
+	if params.AccessTier != "" {
+		tier, ok := findFold(accessTiers, params.AccessTier)
+		if !ok {
+			return nil, fmt.Errorf("the accesstier parameter must be one of %v, %s invalid", accessTiers, params.AccessTier)
+		}
+		params.AccessTier = tier
+	}
+	if params.RehydratePriority == "" {
+		params.RehydratePriority = defaultRehydratePriority
+	}
+	priority, ok := findFold(rehydratePriorities, params.RehydratePriority)
+	if !ok {
+		return nil, fmt.Errorf("the rehydratepriority parameter must be one of %v, %s invalid", rehydratePriorities, params.RehydratePriority)
+	}
+	params.RehydratePriority = priority
 	return &params, nil
 }
@@ -0,0 +1,465 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAPIURL = "https://api.backblazeb2.com"
+	apiPath       = "/b2api/v2/"
+
+	maxTries = 5
+)
+
+// apiError is an error returned by the B2 API.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("b2: %s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+// isNotFound returns whether err reports a missing file, or a large file
+// which is not in progress anymore.
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && (apiErr.Status == http.StatusNotFound || apiErr.Code == "file_not_present")
+}
+
+// authorization is the response of b2_authorize_account. Allowed holds the
+// restrictions of the application key.
+type authorization struct {
+	AccountID               string `json:"accountId"`
+	AuthorizationToken      string `json:"authorizationToken"`
+	APIURL                  string `json:"apiUrl"`
+	DownloadURL             string `json:"downloadUrl"`
+	AbsoluteMinimumPartSize int64  `json:"absoluteMinimumPartSize"`
+	Allowed                 struct {
+		BucketID     string   `json:"bucketId"`
+		BucketName   string   `json:"bucketName"`
+		Capabilities []string `json:"capabilities"`
+		NamePrefix   string   `json:"namePrefix"`
+	} `json:"allowed"`
+}
+
+// file is a version of a file, or a folder when listing file names with a
+// delimiter.
+type file struct {
+	FileID          string            `json:"fileId"`
+	FileName        string            `json:"fileName"`
+	Action          string            `json:"action"`
+	ContentLength   int64             `json:"contentLength"`
+	ContentType     string            `json:"contentType"`
+	FileInfo        map[string]string `json:"fileInfo"`
+	UploadTimestamp int64             `json:"uploadTimestamp"`
+}
+
+type fileList struct {
+	Files        []file  `json:"files"`
+	NextFileName *string `json:"nextFileName"`
+	NextFileID   *string `json:"nextFileId"`
+}
+
+type part struct {
+	PartNumber    int    `json:"partNumber"`
+	ContentLength int64  `json:"contentLength"`
+	ContentSha1   string `json:"contentSha1"`
+}
+
+// uploadURL is an URL files or parts are uploaded to. It may only be used
+// by one upload at a time.
+type uploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// client is a client of the B2 native API. It authorizes the account again
+// when its authorization token expires.
+type client struct {
+	keyID          string
+	applicationKey string
+	apiURL         string
+	http           *http.Client
+
+	mu         sync.Mutex
+	auth       *authorization
+	uploadURLs []*uploadURL
+}
+
+// authorize authorizes the account with the application key.
+func (c *client) authorize(ctx context.Context) (*authorization, error) {
+	var auth authorization
+	err := retry(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(c.apiURL, "/")+apiPath+"b2_authorize_account", nil)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(c.keyID, c.applicationKey)
+		return c.do(req, &auth)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.auth = &auth
+	c.uploadURLs = nil
+	c.mu.Unlock()
+	return &auth, nil
+}
+
+// authorization returns the current authorization of the account, authorizing
+// it again if its token expired.
+func (c *client) authorization(ctx context.Context) (*authorization, error) {
+	c.mu.Lock()
+	auth := c.auth
+	c.mu.Unlock()
+	if auth != nil {
+		return auth, nil
+	}
+	return c.authorize(ctx)
+}
+
+// expire discards auth if its token expired, so that the account is
+// authorized again on the next request.
+func (c *client) expire(auth *authorization, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.Code != "expired_auth_token" {
+		return
+	}
+	c.mu.Lock()
+	if c.auth == auth {
+		c.auth = nil
+	}
+	c.mu.Unlock()
+}
+
+// call calls an operation of the B2 API with the JSON body in, and decodes
+// the response into out.
+func (c *client) call(ctx context.Context, operation string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return retry(func() error {
+		auth, err := c.authorization(ctx)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.APIURL+apiPath+operation, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		req.Header.Set("Content-Type", "application/json")
+		err = c.do(req, out)
+		c.expire(auth, err)
+		return err
+	})
+}
+
+// do sends a request, and decodes the JSON response into out, if not nil.
+func (c *client) do(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// responseError returns the error of an unsuccessful response.
+func responseError(resp *http.Response) error {
+	apiErr := &apiError{}
+	if resp.Request.Method == http.MethodHead || json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(apiErr) != nil || apiErr.Status == 0 {
+		apiErr = &apiError{Code: strings.ToLower(strings.ReplaceAll(http.StatusText(resp.StatusCode), " ", "_"))}
+	}
+	apiErr.Status = resp.StatusCode
+	return apiErr
+}
+
+// listBucket returns the ID of the bucket named name.
+func (c *client) listBucket(ctx context.Context, name string) (string, error) {
+	auth, err := c.authorization(ctx)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	if err := c.call(ctx, "b2_list_buckets", map[string]string{"accountId": auth.AccountID, "bucketName": name}, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Buckets) == 0 {
+		return "", fmt.Errorf("bucket %q not found", name)
+	}
+	return resp.Buckets[0].BucketID, nil
+}
+
+// uploadFile uploads a file with the given content type and file info.
+func (c *client) uploadFile(ctx context.Context, bucketID, name, contentType string, info map[string]string, data []byte) (*file, error) {
+	var f file
+	err := retry(func() error {
+		u, err := c.getUploadURL(ctx, bucketID)
+		if err != nil {
+			return err
+		}
+		req, err := newUploadRequest(ctx, u, data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Bz-File-Name", encodeName(name))
+		req.Header.Set("Content-Type", contentType)
+		for k, v := range info {
+			req.Header.Set("X-Bz-Info-"+k, url.QueryEscape(v))
+		}
+		if err := c.do(req, &f); err != nil {
+			// an URL failing an upload must not be used again
+			return err
+		}
+		c.mu.Lock()
+		c.uploadURLs = append(c.uploadURLs, u)
+		c.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// getUploadURL returns an upload URL which is not in use, getting a new one
+// if there is none.
+func (c *client) getUploadURL(ctx context.Context, bucketID string) (*uploadURL, error) {
+	c.mu.Lock()
+	if n := len(c.uploadURLs); n > 0 {
+		u := c.uploadURLs[n-1]
+		c.uploadURLs = c.uploadURLs[:n-1]
+		c.mu.Unlock()
+		return u, nil
+	}
+	c.mu.Unlock()
+
+	var u uploadURL
+	if err := c.call(ctx, "b2_get_upload_url", map[string]string{"bucketId": bucketID}, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// startLargeFile starts a large file, uploaded in parts.
+func (c *client) startLargeFile(ctx context.Context, bucketID, name, contentType string) (*file, error) {
+	var f file
+	err := c.call(ctx, "b2_start_large_file", map[string]string{
+		"bucketId":    bucketID,
+		"fileName":    name,
+		"contentType": contentType,
+	}, &f)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// uploadPart uploads a part of a large file with the upload URL *u, getting
+// a new one if it is nil or fails, and returns the SHA1 of the part.
+func (c *client) uploadPart(ctx context.Context, fileID string, u **uploadURL, partNumber int, data []byte) (string, error) {
+	var p part
+	err := retry(func() error {
+		if *u == nil {
+			var partURL uploadURL
+			if err := c.call(ctx, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, &partURL); err != nil {
+				return err
+			}
+			*u = &partURL
+		}
+		req, err := newUploadRequest(ctx, *u, data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Bz-Part-Number", strconv.Itoa(partNumber))
+		if err := c.do(req, &p); err != nil {
+			*u = nil
+			return err
+		}
+		return nil
+	})
+	return p.ContentSha1, err
+}
+
+// newUploadRequest returns a request uploading data to u.
+func newUploadRequest(ctx context.Context, u *uploadURL, data []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(data)
+	req.Header.Set("Authorization", u.AuthorizationToken)
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+	req.ContentLength = int64(len(data))
+	return req, nil
+}
+
+// listParts lists the parts of a large file in progress.
+func (c *client) listParts(ctx context.Context, fileID string) ([]part, error) {
+	var parts []part
+	start := 1
+	for {
+		var resp struct {
+			Parts          []part `json:"parts"`
+			NextPartNumber *int   `json:"nextPartNumber"`
+		}
+		err := c.call(ctx, "b2_list_parts", map[string]interface{}{
+			"fileId":          fileID,
+			"startPartNumber": start,
+			"maxPartCount":    1000,
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, resp.Parts...)
+		if resp.NextPartNumber == nil {
+			return parts, nil
+		}
+		start = *resp.NextPartNumber
+	}
+}
+
+// finishLargeFile assembles the parts of a large file.
+func (c *client) finishLargeFile(ctx context.Context, fileID string, partSha1s []string) (*file, error) {
+	var f file
+	err := c.call(ctx, "b2_finish_large_file", map[string]interface{}{
+		"fileId":        fileID,
+		"partSha1Array": partSha1s,
+	}, &f)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// cancelLargeFile cancels a large file in progress, deleting its parts.
+func (c *client) cancelLargeFile(ctx context.Context, fileID string) error {
+	return c.call(ctx, "b2_cancel_large_file", map[string]string{"fileId": fileID}, nil)
+}
+
+// deleteFileVersion deletes a version of a file.
+func (c *client) deleteFileVersion(ctx context.Context, f *file) error {
+	return c.call(ctx, "b2_delete_file_version", map[string]string{"fileName": f.FileName, "fileId": f.FileID}, nil)
+}
+
+// download downloads the latest version of a file, from offset.
+func (c *client) download(ctx context.Context, bucketName, name string, offset int64) (*http.Response, error) {
+	var resp *http.Response
+	err := retry(func() error {
+		auth, err := c.authorization(ctx)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, auth.DownloadURL+"/file/"+url.PathEscape(bucketName)+"/"+encodeName(name), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err = c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			err = responseError(resp)
+			resp.Body.Close()
+			c.expire(auth, err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// downloadURL returns an URL downloading a file without credentials during
+// the given duration.
+func (c *client) downloadURL(ctx context.Context, bucketID, bucketName, name string, valid time.Duration) (string, error) {
+	var resp struct {
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	err := c.call(ctx, "b2_get_download_authorization", map[string]interface{}{
+		"bucketId":               bucketID,
+		"fileNamePrefix":         name,
+		"validDurationInSeconds": int(valid.Seconds()),
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	auth, err := c.authorization(ctx)
+	if err != nil {
+		return "", err
+	}
+	return auth.DownloadURL + "/file/" + url.PathEscape(bucketName) + "/" + encodeName(name) + "?Authorization=" + url.QueryEscape(resp.AuthorizationToken), nil
+}
+
+// encodeName percent-encodes a file name, keeping its slashes.
+func encodeName(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(s), "+", "%2B")
+	}
+	return strings.Join(segments, "/")
+}
+
+// retry retries req when the B2 API is busy or fails, and right away when
+// the authorization token expired, so that the account is authorized again.
+func retry(req func() error) error {
+	backoff := time.Second
+	var err error
+	for i := 0; i < maxTries; i++ {
+		err = req()
+		if err == nil {
+			return nil
+		}
+
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			return err
+		}
+		switch {
+		case apiErr.Status == http.StatusUnauthorized && apiErr.Code == "expired_auth_token":
+		case apiErr.Status == http.StatusTooManyRequests || apiErr.Status >= http.StatusInternalServerError:
+			time.Sleep(backoff + time.Duration(rand.Int63n(int64(time.Second))))
+			backoff *= 2
+		default:
+			return err
+		}
+	}
+	return err
+}
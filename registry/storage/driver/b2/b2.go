@@ -0,0 +1,788 @@
+// Package b2 provides a storagedriver.StorageDriver implementation to
+// store blobs in Backblaze B2 Cloud Storage.
+//
+// This package uses the B2 native API, rather than its S3 compatible API,
+// authorizing with an application key which may be restricted to the
+// bucket and to a prefix of the file names.
+//
+// Uploads larger than a chunk are uploaded as B2 large files, which keep
+// their parts while an upload is suspended. The content of an upload not
+// uploaded as a part yet, and the ID of its large file, are stored in an
+// upload session file, at the path of the upload.
+//
+// Because B2 keeps the previous versions of files, the driver deletes the
+// versions it replaces, and all the versions of the files it deletes.
+package b2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	driverName = "b2"
+
+	minChunkSize          = 5 * 1024 * 1024
+	defaultChunkSize      = 16 * 1024 * 1024
+	defaultMaxConcurrency = 50
+	minConcurrency        = 25
+
+	uploadSessionContentType = "application/x-docker-upload-session"
+	blobContentType          = "application/octet-stream"
+
+	listMaxFileCount = 1000
+)
+
+// maxCopySize is the size of the largest file copied at once, larger files
+// being copied in parts of this size.
+var maxCopySize int64 = 5 * 1000 * 1000 * 1000
+
+// requiredCapabilities are the capabilities the application key must have.
+var requiredCapabilities = []string{"listFiles", "readFiles", "writeFiles", "deleteFiles"}
+
+var _ storagedriver.FileWriter = &writer{}
+
+// driverParameters is a struct that encapsulates all of the driver parameters after all values have been set
+type driverParameters struct {
+	keyID          string
+	applicationKey string
+	bucket         string
+	rootDirectory  string
+	chunkSize      int
+	apiURL         string
+	client         *http.Client
+
+	// maxConcurrency limits the number of concurrent driver operations
+	// to B2, which ultimately increases reliability of many simultaneous
+	// pushes by ensuring we aren't DoSing our own server with many
+	// connections.
+	maxConcurrency uint64
+}
+
+func init() {
+	factory.Register(driverName, &b2DriverFactory{})
+}
+
+// b2DriverFactory implements the factory.StorageDriverFactory interface
+type b2DriverFactory struct{}
+
+// Create StorageDriver from parameters
+func (factory *b2DriverFactory) Create(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(ctx, parameters)
+}
+
+var _ storagedriver.StorageDriver = &driver{}
+
+// driver is a storagedriver.StorageDriver implementation backed by B2.
+// Files are stored at absolute names in the provided bucket.
+type driver struct {
+	client        *client
+	bucketID      string
+	bucketName    string
+	rootDirectory string
+	chunkSize     int
+
+	// redirect is whether the application key may share files, to
+	// redirect downloads.
+	redirect bool
+}
+
+// Wrapper wraps `driver` with a throttler, ensuring that no more than N
+// B2 actions can occur concurrently. The default limit is 50.
+type Wrapper struct {
+	baseEmbed
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - keyid
+// - applicationkey
+// - bucket
+func FromParameters(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	var required [3]string
+	for i, name := range []string{"keyid", "applicationkey", "bucket"} {
+		value, ok := parameters[name]
+		if !ok || fmt.Sprint(value) == "" {
+			return nil, fmt.Errorf("no %s parameter provided", name)
+		}
+		required[i] = fmt.Sprint(value)
+	}
+
+	rootDirectory, ok := parameters["rootdirectory"]
+	if !ok {
+		rootDirectory = ""
+	}
+
+	apiURL, ok := parameters["apiurl"]
+	if !ok || fmt.Sprint(apiURL) == "" {
+		apiURL = defaultAPIURL
+	}
+
+	chunkSize := defaultChunkSize
+	chunkSizeParam, ok := parameters["chunksize"]
+	if ok {
+		switch v := chunkSizeParam.(type) {
+		case string:
+			vv, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("chunksize must be an integer, %v invalid", chunkSizeParam)
+			}
+			chunkSize = vv
+		case int, uint, int32, uint32, uint64, int64:
+			chunkSize = int(reflect.ValueOf(v).Convert(reflect.TypeOf(chunkSize)).Int())
+		default:
+			return nil, fmt.Errorf("invalid value for chunksize: %#v", chunkSizeParam)
+		}
+
+		if chunkSize < minChunkSize {
+			return nil, fmt.Errorf("chunksize %#v must be larger than or equal to %d", chunkSize, minChunkSize)
+		}
+	}
+
+	maxConcurrency, err := base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
+	}
+
+	params := driverParameters{
+		keyID:          required[0],
+		applicationKey: required[1],
+		bucket:         required[2],
+		rootDirectory:  fmt.Sprint(rootDirectory),
+		chunkSize:      chunkSize,
+		apiURL:         fmt.Sprint(apiURL),
+		client:         http.DefaultClient,
+		maxConcurrency: maxConcurrency,
+	}
+
+	return New(ctx, params)
+}
+
+// New constructs a new driver, authorizing the account and checking that
+// the application key is allowed to manage the files of the root directory
+// of the bucket.
+func New(ctx context.Context, params driverParameters) (storagedriver.StorageDriver, error) {
+	rootDirectory := strings.Trim(params.rootDirectory, "/")
+	if rootDirectory != "" {
+		rootDirectory += "/"
+	}
+	if params.chunkSize < minChunkSize {
+		return nil, fmt.Errorf("invalid chunksize: %d is smaller than %d", params.chunkSize, minChunkSize)
+	}
+
+	c := &client{
+		keyID:          params.keyID,
+		applicationKey: params.applicationKey,
+		apiURL:         params.apiURL,
+		http:           params.client,
+	}
+	auth, err := c.authorize(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to authorize b2 account: %v", err)
+	}
+
+	allowed := auth.Allowed
+	if allowed.BucketName != "" && allowed.BucketName != params.bucket {
+		return nil, fmt.Errorf("b2 application key is restricted to bucket %q", allowed.BucketName)
+	}
+	if !strings.HasPrefix(rootDirectory, allowed.NamePrefix) {
+		return nil, fmt.Errorf("b2 application key is restricted to file names starting with %q, which rootdirectory must be within", allowed.NamePrefix)
+	}
+	var missing []string
+	for _, capability := range requiredCapabilities {
+		if !slices.Contains(allowed.Capabilities, capability) {
+			missing = append(missing, capability)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("b2 application key lacks the capabilities %s", strings.Join(missing, ", "))
+	}
+	if int64(params.chunkSize) < auth.AbsoluteMinimumPartSize {
+		return nil, fmt.Errorf("invalid chunksize: %d is smaller than the minimum part size %d", params.chunkSize, auth.AbsoluteMinimumPartSize)
+	}
+
+	bucketID := allowed.BucketID
+	if bucketID == "" {
+		if bucketID, err = c.listBucket(ctx, params.bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &driver{
+		client:        c,
+		bucketID:      bucketID,
+		bucketName:    params.bucket,
+		rootDirectory: rootDirectory,
+		chunkSize:     params.chunkSize,
+		redirect:      slices.Contains(allowed.Capabilities, "shareFiles"),
+	}
+
+	return &Wrapper{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: base.NewRegulator(d, params.maxConcurrency),
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+// This should primarily be used for small objects.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	r, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// This should primarily be used for small objects.
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	_, err := d.client.uploadFile(ctx, d.bucketID, d.pathToKey(path), blobContentType, nil, contents)
+	return err
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path"
+// with a given byte offset.
+// May be used to resume reading a stream by providing a nonzero offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	key := d.pathToKey(path)
+	resp, err := d.client.download(ctx, d.bucketName, key, offset)
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			switch apiErr.Status {
+			case http.StatusNotFound:
+				return nil, storagedriver.PathNotFoundError{Path: path}
+			case http.StatusRequestedRangeNotSatisfiable:
+				f, err := d.file(ctx, key)
+				if err != nil {
+					return nil, err
+				}
+				if f == nil || f.ContentType == uploadSessionContentType {
+					return nil, storagedriver.PathNotFoundError{Path: path}
+				}
+				if offset == f.ContentLength {
+					return io.NopCloser(bytes.NewReader([]byte{})), nil
+				}
+				return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+			}
+		}
+		return nil, err
+	}
+	if resp.Header.Get("Content-Type") == uploadSessionContentType {
+		resp.Body.Close()
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return resp.Body, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
+	w := &writer{
+		ctx:    ctx,
+		driver: d,
+		path:   path,
+		key:    d.pathToKey(path),
+	}
+
+	if appendMode {
+		err := w.init(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current
+// size in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	// try to get as file
+	f, err := d.file(ctx, d.pathToKey(path))
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		if f.ContentType == uploadSessionContentType {
+			return nil, storagedriver.PathNotFoundError{Path: path}
+		}
+		return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+			Path:    path,
+			Size:    f.ContentLength,
+			ModTime: time.UnixMilli(f.UploadTimestamp),
+		}}, nil
+	}
+
+	// try to get as folder
+	files, err := d.listFileNames(ctx, d.pathToDirKey(path), "", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(files.Files) == 0 {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:  path,
+		IsDir: true,
+	}}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	prefix := d.pathToDirKey(path)
+	list := make([]string, 0, 64)
+	start := ""
+	for {
+		files, err := d.listFileNames(ctx, prefix, "/", start, listMaxFileCount)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files.Files {
+			if f.Action == "folder" || f.ContentType != uploadSessionContentType {
+				list = append(list, d.keyToPath(f.FileName))
+			}
+		}
+		if files.NextFileName == nil {
+			break
+		}
+		start = *files.NextFileName
+	}
+
+	if path != "/" && len(list) == 0 {
+		// Treat empty response as missing directory, since we don't actually
+		// have directories in B2.
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return list, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	srcKey, dstKey := d.pathToKey(sourcePath), d.pathToKey(destPath)
+	src, err := d.file(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return storagedriver.PathNotFoundError{Path: sourcePath}
+	}
+
+	if src.ContentLength <= maxCopySize {
+		err = d.client.call(ctx, "b2_copy_file", map[string]string{
+			"sourceFileId":      src.FileID,
+			"fileName":          dstKey,
+			"metadataDirective": "COPY",
+		}, nil)
+	} else {
+		err = d.copyLargeFile(ctx, src, dstKey)
+	}
+	if err != nil {
+		return fmt.Errorf("move %q to %q: %v", srcKey, dstKey, err)
+	}
+
+	// if deleting the file fails, log the error, but do not fail; the file was successfully copied,
+	// and the original should eventually be cleaned when purging the uploads folder.
+	if _, err := d.deleteVersions(ctx, srcKey, func(name string) bool { return name == srcKey }); err != nil {
+		logrus.Infof("error deleting %v: %v", sourcePath, err)
+	}
+	return nil
+}
+
+// copyLargeFile copies a file too large to be copied at once, in parts.
+func (d *driver) copyLargeFile(ctx context.Context, src *file, dstKey string) error {
+	dst, err := d.client.startLargeFile(ctx, d.bucketID, dstKey, src.ContentType)
+	if err != nil {
+		return err
+	}
+
+	var partSha1s []string
+	for offset := int64(0); offset < src.ContentLength; offset += maxCopySize {
+		var p part
+		err := d.client.call(ctx, "b2_copy_part", map[string]interface{}{
+			"sourceFileId": src.FileID,
+			"largeFileId":  dst.FileID,
+			"partNumber":   len(partSha1s) + 1,
+			"range":        fmt.Sprintf("bytes=%d-%d", offset, min(offset+maxCopySize, src.ContentLength)-1),
+		}, &p)
+		if err != nil {
+			_ = d.client.cancelLargeFile(ctx, dst.FileID)
+			return err
+		}
+		partSha1s = append(partSha1s, p.ContentSha1)
+	}
+
+	if _, err := d.client.finishLargeFile(ctx, dst.FileID, partSha1s); err != nil {
+		_ = d.client.cancelLargeFile(ctx, dst.FileID)
+		return err
+	}
+	return nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	key, dirKey := d.pathToKey(path), d.pathToDirKey(path)
+	n, err := d.deleteVersions(ctx, key, func(name string) bool {
+		return name == key || strings.HasPrefix(name, dirKey)
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	return nil
+}
+
+// deleteVersions deletes all the versions of the files starting with prefix
+// whose name matches, cancelling their large files in progress, and returns
+// the number of versions deleted.
+func (d *driver) deleteVersions(ctx context.Context, prefix string, match func(name string) bool) (int, error) {
+	var (
+		deleted         int
+		startFileName   = prefix
+		startFileID     string
+		versionsRequest = map[string]interface{}{
+			"bucketId":     d.bucketID,
+			"prefix":       prefix,
+			"maxFileCount": listMaxFileCount,
+		}
+	)
+	for {
+		versionsRequest["startFileName"] = startFileName
+		if startFileID != "" {
+			versionsRequest["startFileId"] = startFileID
+		}
+		var versions fileList
+		if err := d.client.call(ctx, "b2_list_file_versions", versionsRequest, &versions); err != nil {
+			return deleted, err
+		}
+		for i := range versions.Files {
+			f := &versions.Files[i]
+			if !match(f.FileName) {
+				continue
+			}
+			var err error
+			if f.Action == "start" {
+				err = d.client.cancelLargeFile(ctx, f.FileID)
+			} else {
+				err = d.client.deleteFileVersion(ctx, f)
+			}
+			// files deleted concurrently are ignored
+			if err != nil && !isNotFound(err) {
+				return deleted, err
+			}
+			deleted++
+		}
+		if versions.NextFileName == nil {
+			return deleted, nil
+		}
+		startFileName = *versions.NextFileName
+		if versions.NextFileID != nil {
+			startFileID = *versions.NextFileID
+		}
+	}
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored at
+// the given path, if the application key may share files.
+func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
+	if !d.redirect || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return "", nil
+	}
+	return d.client.downloadURL(r.Context(), d.bucketID, d.bucketName, d.pathToKey(path), storagedriver.RedirectExpiry(r))
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// file returns the latest version of the file named key, or nil if there is
+// none.
+func (d *driver) file(ctx context.Context, key string) (*file, error) {
+	files, err := d.listFileNames(ctx, key, "", key, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(files.Files) == 0 || files.Files[0].FileName != key || files.Files[0].Action != "upload" {
+		return nil, nil
+	}
+	return &files.Files[0], nil
+}
+
+// listFileNames lists the latest versions of the files starting with
+// prefix, from startFileName.
+func (d *driver) listFileNames(ctx context.Context, prefix, delimiter, startFileName string, maxFileCount int) (*fileList, error) {
+	req := map[string]interface{}{
+		"bucketId":     d.bucketID,
+		"prefix":       prefix,
+		"maxFileCount": maxFileCount,
+	}
+	if delimiter != "" {
+		req["delimiter"] = delimiter
+	}
+	if startFileName != "" {
+		req["startFileName"] = startFileName
+	}
+	var files fileList
+	if err := d.client.call(ctx, "b2_list_file_names", req, &files); err != nil {
+		return nil, err
+	}
+	return &files, nil
+}
+
+type writer struct {
+	ctx    context.Context
+	driver *driver
+	path   string
+	key    string
+
+	// largeFileID is the ID of the large file the content is uploaded to,
+	// once it is larger than a chunk.
+	largeFileID string
+	partSha1s   []string
+	partsSize   int64
+	partURL     *uploadURL
+
+	// buffer holds the content which is not uploaded as a part yet.
+	buffer bytes.Buffer
+
+	// session is the version of the file written last, to be replaced.
+	session *file
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+// init resumes the upload from its upload session file, or appends to a
+// committed file.
+func (w *writer) init(ctx context.Context) error {
+	f, err := w.driver.file(ctx, w.key)
+	if err != nil {
+		return err
+	}
+	if f == nil || (f.ContentType != uploadSessionContentType && f.ContentType != blobContentType) {
+		return storagedriver.PathNotFoundError{Path: w.path}
+	}
+
+	resp, err := w.driver.client.download(ctx, w.driver.bucketName, w.key, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(&w.buffer, resp.Body); err != nil {
+		return err
+	}
+	w.session = f
+
+	if f.ContentType != uploadSessionContentType || f.FileInfo["large_file_id"] == "" {
+		return nil
+	}
+	w.largeFileID = f.FileInfo["large_file_id"]
+	offset, err := strconv.ParseInt(f.FileInfo["offset"], 10, 64)
+	if err != nil {
+		return err
+	}
+	parts, err := w.driver.client.listParts(ctx, w.largeFileID)
+	if err != nil {
+		return err
+	}
+	// parts uploaded after the session file was written last are uploaded
+	// again
+	for _, p := range parts {
+		if p.PartNumber != len(w.partSha1s)+1 || w.partsSize+p.ContentLength > offset {
+			break
+		}
+		w.partSha1s = append(w.partSha1s, p.ContentSha1)
+		w.partsSize += p.ContentLength
+	}
+	if w.partsSize != offset {
+		return fmt.Errorf("b2 upload session %s is missing parts", w.path)
+	}
+	return nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	w.buffer.Write(p)
+	// the last chunk is kept in the buffer, so that a large file always
+	// has at least two parts
+	for w.buffer.Len() > w.driver.chunkSize {
+		if err := w.uploadPart(w.ctx, w.driver.chunkSize); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// uploadPart uploads the first n bytes of the buffer as the next part of
+// the large file, starting it if needed.
+func (w *writer) uploadPart(ctx context.Context, n int) error {
+	if w.largeFileID == "" {
+		f, err := w.driver.client.startLargeFile(ctx, w.driver.bucketID, w.key, blobContentType)
+		if err != nil {
+			return err
+		}
+		w.largeFileID = f.FileID
+	}
+
+	sha1, err := w.driver.client.uploadPart(ctx, w.largeFileID, &w.partURL, len(w.partSha1s)+1, w.buffer.Bytes()[:n])
+	if err != nil {
+		return err
+	}
+	w.partSha1s = append(w.partSha1s, sha1)
+	w.partsSize += int64(n)
+	w.buffer.Next(n)
+	return nil
+}
+
+// Size returns the number of bytes written to this FileWriter.
+func (w *writer) Size() int64 {
+	return w.partsSize + int64(w.buffer.Len())
+}
+
+// Close stores the content which is not uploaded as a part yet in the
+// upload session file, so that the upload can be resumed.
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	info := map[string]string{"offset": strconv.FormatInt(w.partsSize, 10)}
+	if w.largeFileID != "" {
+		info["large_file_id"] = w.largeFileID
+	}
+	f, err := w.driver.client.uploadFile(w.ctx, w.driver.bucketID, w.key, uploadSessionContentType, info, w.buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	w.replace(w.ctx, f)
+	return nil
+}
+
+// Cancel removes any written content from this FileWriter.
+func (w *writer) Cancel(ctx context.Context) error {
+	w.closed = true
+	w.cancelled = true
+
+	if w.largeFileID != "" {
+		if err := w.driver.client.cancelLargeFile(ctx, w.largeFileID); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	_, err := w.driver.deleteVersions(ctx, w.key, func(name string) bool { return name == w.key })
+	return err
+}
+
+// Commit flushes all content written to this FileWriter and makes it
+// available for future calls to StorageDriver.GetContent and
+// StorageDriver.Reader.
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	w.closed = true
+
+	var (
+		f   *file
+		err error
+	)
+	// no large file started yet just perform a simple upload
+	if w.largeFileID == "" {
+		f, err = w.driver.client.uploadFile(ctx, w.driver.bucketID, w.key, blobContentType, nil, w.buffer.Bytes())
+	} else {
+		if w.buffer.Len() > 0 {
+			if err := w.uploadPart(ctx, w.buffer.Len()); err != nil {
+				return err
+			}
+		}
+		// a large file is as recent as when it was started, so the upload
+		// session file must be deleted first for it to be the latest version
+		if w.session != nil {
+			if err := w.driver.client.deleteFileVersion(ctx, w.session); err != nil && !isNotFound(err) {
+				return err
+			}
+			w.session = nil
+		}
+		f, err = w.driver.client.finishLargeFile(ctx, w.largeFileID, w.partSha1s)
+	}
+	if err != nil {
+		return err
+	}
+	w.committed = true
+	w.replace(ctx, f)
+	return nil
+}
+
+// replace deletes the version of the file written last, replaced by f.
+func (w *writer) replace(ctx context.Context, f *file) {
+	if w.session != nil && w.session.FileID != f.FileID {
+		// a version failing to be deleted is only left over, the file
+		// being read from its latest version
+		if err := w.driver.client.deleteFileVersion(ctx, w.session); err != nil && !isNotFound(err) {
+			logrus.Infof("error deleting previous version of %v: %v", w.path, err)
+		}
+	}
+	w.session = f
+}
+
+func (d *driver) pathToKey(path string) string {
+	return strings.TrimSpace(strings.TrimRight(d.rootDirectory+strings.TrimLeft(path, "/"), "/"))
+}
+
+func (d *driver) pathToDirKey(path string) string {
+	key := d.pathToKey(path)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (d *driver) keyToPath(key string) string {
+	return "/" + strings.Trim(strings.TrimPrefix(key, d.rootDirectory), "/")
+}
@@ -0,0 +1,722 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+)
+
+var skipCheck func(tb testing.TB)
+
+func init() {
+	// Skip the B2 storage driver tests against B2 if environment variable
+	// parameters are not provided
+	skipCheck = func(tb testing.TB) {
+		tb.Helper()
+
+		if os.Getenv("REGISTRY_STORAGE_B2_BUCKET") == "" || os.Getenv("B2_APPLICATION_KEY_ID") == "" || os.Getenv("B2_APPLICATION_KEY") == "" {
+			tb.Skip("The following environment variables must be set to enable these tests: REGISTRY_STORAGE_B2_BUCKET, B2_APPLICATION_KEY_ID, B2_APPLICATION_KEY")
+		}
+	}
+}
+
+func newDriverConstructor(tb testing.TB) testsuites.DriverConstructor {
+	root := tb.TempDir()
+
+	return func() (storagedriver.StorageDriver, error) {
+		return New(context.Background(), driverParameters{
+			keyID:          os.Getenv("B2_APPLICATION_KEY_ID"),
+			applicationKey: os.Getenv("B2_APPLICATION_KEY"),
+			bucket:         os.Getenv("REGISTRY_STORAGE_B2_BUCKET"),
+			rootDirectory:  root,
+			chunkSize:      defaultChunkSize,
+			apiURL:         defaultAPIURL,
+			client:         http.DefaultClient,
+			maxConcurrency: 8,
+		})
+	}
+}
+
+func TestB2DriverSuite(t *testing.T) {
+	skipCheck(t)
+	testsuites.Driver(t, newDriverConstructor(t))
+}
+
+func BenchmarkB2DriverSuite(b *testing.B) {
+	skipCheck(b)
+	testsuites.BenchDriver(b, newDriverConstructor(b))
+}
+
+// testB2 is a fake B2 API server holding the files of a bucket in memory.
+// Like B2, it requires large files to have at least two parts, and orders
+// the versions of files by when they were uploaded, or started for large
+// files.
+type testB2 struct {
+	*httptest.Server
+
+	allowed     map[string]interface{}
+	minPartSize int64
+
+	mu       sync.Mutex
+	token    string
+	tokens   int
+	seq      int
+	versions []*testFile
+}
+
+type testFile struct {
+	file
+	seq   int
+	data  []byte
+	parts map[int][]byte
+}
+
+func newTestB2(t *testing.T) *testB2 {
+	b := &testB2{
+		allowed: map[string]interface{}{
+			"bucketId":     "bucket-id",
+			"bucketName":   "registry",
+			"namePrefix":   "registry/",
+			"capabilities": []string{"listFiles", "readFiles", "writeFiles", "deleteFiles", "shareFiles"},
+		},
+		minPartSize: minChunkSize,
+	}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *testB2) parameters(rootDirectory string) driverParameters {
+	return driverParameters{
+		keyID:          "key-id",
+		applicationKey: "application-key",
+		bucket:         "registry",
+		rootDirectory:  rootDirectory,
+		chunkSize:      minChunkSize,
+		apiURL:         b.URL,
+		client:         b.Client(),
+		maxConcurrency: 8,
+	}
+}
+
+// expire expires the current authorization token.
+func (b *testB2) expire() {
+	b.mu.Lock()
+	b.token = ""
+	b.mu.Unlock()
+}
+
+func (b *testB2) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	fail := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(apiError{Status: status, Code: code, Message: code})
+	}
+
+	if r.URL.Path == apiPath+"b2_authorize_account" {
+		if keyID, key, _ := r.BasicAuth(); keyID != "key-id" || key != "application-key" {
+			fail(http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		b.tokens++
+		b.token = fmt.Sprintf("token-%d", b.tokens)
+		reply(map[string]interface{}{
+			"accountId":               "account-id",
+			"authorizationToken":      b.token,
+			"apiUrl":                  b.URL,
+			"downloadUrl":             b.URL,
+			"absoluteMinimumPartSize": b.minPartSize,
+			"allowed":                 b.allowed,
+		})
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/file/registry/") {
+		name := strings.TrimPrefix(r.URL.Path, "/file/registry/")
+		auth := r.Header.Get("Authorization")
+		if token := r.URL.Query().Get("Authorization"); token != "" {
+			if prefix, ok := strings.CutPrefix(token, "download:"); ok && strings.HasPrefix(name, prefix) {
+				auth = b.token
+			}
+		}
+		if auth != b.token {
+			fail(http.StatusUnauthorized, "expired_auth_token")
+			return
+		}
+		b.download(w, r, name, fail)
+		return
+	}
+
+	if r.Header.Get("Authorization") != b.token {
+		fail(http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+
+	if fileID, ok := strings.CutPrefix(r.URL.Path, "/upload_part/"); ok {
+		data, _ := io.ReadAll(r.Body)
+		sum := sha1.Sum(data)
+		partNumber, err := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		f := b.find(fileID)
+		if err != nil || partNumber < 1 || hex.EncodeToString(sum[:]) != r.Header.Get("X-Bz-Content-Sha1") {
+			fail(http.StatusBadRequest, "bad_request")
+			return
+		}
+		if f == nil || f.Action != "start" {
+			fail(http.StatusBadRequest, "file_not_present")
+			return
+		}
+		f.parts[partNumber] = data
+		reply(part{PartNumber: partNumber, ContentLength: int64(len(data)), ContentSha1: hex.EncodeToString(sum[:])})
+		return
+	}
+
+	if r.URL.Path == "/upload/bucket-id" {
+		data, _ := io.ReadAll(r.Body)
+		sum := sha1.Sum(data)
+		name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+		if err != nil || hex.EncodeToString(sum[:]) != r.Header.Get("X-Bz-Content-Sha1") {
+			fail(http.StatusBadRequest, "bad_request")
+			return
+		}
+		info := make(map[string]string)
+		for k := range r.Header {
+			if key, ok := strings.CutPrefix(k, "X-Bz-Info-"); ok {
+				info[strings.ToLower(key)], _ = url.QueryUnescape(r.Header.Get(k))
+			}
+		}
+		reply(b.add(name, "upload", r.Header.Get("Content-Type"), info, data).file)
+		return
+	}
+
+	var req struct {
+		BucketID          string   `json:"bucketId"`
+		BucketName        string   `json:"bucketName"`
+		FileID            string   `json:"fileId"`
+		FileName          string   `json:"fileName"`
+		ContentType       string   `json:"contentType"`
+		Prefix            string   `json:"prefix"`
+		Delimiter         string   `json:"delimiter"`
+		StartFileName     string   `json:"startFileName"`
+		StartFileID       string   `json:"startFileId"`
+		MaxFileCount      int      `json:"maxFileCount"`
+		StartPartNumber   int      `json:"startPartNumber"`
+		PartSha1Array     []string `json:"partSha1Array"`
+		SourceFileID      string   `json:"sourceFileId"`
+		LargeFileID       string   `json:"largeFileId"`
+		PartNumber        int      `json:"partNumber"`
+		Range             string   `json:"range"`
+		FileNamePrefix    string   `json:"fileNamePrefix"`
+		MetadataDirective string   `json:"metadataDirective"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fail(http.StatusBadRequest, "bad_json")
+		return
+	}
+	if req.BucketID != "" && req.BucketID != "bucket-id" {
+		fail(http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, apiPath) {
+	case "b2_list_buckets":
+		buckets := []map[string]string{}
+		if req.BucketName == "registry" {
+			buckets = append(buckets, map[string]string{"bucketId": "bucket-id"})
+		}
+		reply(map[string]interface{}{"buckets": buckets})
+	case "b2_get_upload_url":
+		reply(uploadURL{UploadURL: b.URL + "/upload/bucket-id", AuthorizationToken: b.token})
+	case "b2_get_upload_part_url":
+		reply(uploadURL{UploadURL: b.URL + "/upload_part/" + req.FileID, AuthorizationToken: b.token})
+	case "b2_list_file_names":
+		reply(b.listFileNames(req.Prefix, req.Delimiter, req.StartFileName, req.MaxFileCount))
+	case "b2_list_file_versions":
+		reply(b.listFileVersions(req.Prefix, req.StartFileName, req.StartFileID, req.MaxFileCount))
+	case "b2_delete_file_version":
+		f := b.find(req.FileID)
+		if f == nil || f.FileName != req.FileName || f.Action == "start" {
+			fail(http.StatusBadRequest, "file_not_present")
+			return
+		}
+		b.remove(f)
+		reply(map[string]string{"fileId": f.FileID, "fileName": f.FileName})
+	case "b2_start_large_file":
+		reply(b.add(req.FileName, "start", req.ContentType, nil, nil).file)
+	case "b2_list_parts":
+		f := b.find(req.FileID)
+		if f == nil || f.Action != "start" {
+			fail(http.StatusBadRequest, "file_not_present")
+			return
+		}
+		var numbers []int
+		for n := range f.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		parts := []part{}
+		for _, n := range numbers {
+			if n >= req.StartPartNumber {
+				sum := sha1.Sum(f.parts[n])
+				parts = append(parts, part{PartNumber: n, ContentLength: int64(len(f.parts[n])), ContentSha1: hex.EncodeToString(sum[:])})
+			}
+		}
+		reply(map[string]interface{}{"parts": parts})
+	case "b2_finish_large_file":
+		f := b.find(req.FileID)
+		if f == nil || f.Action != "start" {
+			fail(http.StatusBadRequest, "file_not_present")
+			return
+		}
+		if len(req.PartSha1Array) < 2 || len(req.PartSha1Array) != len(f.parts) {
+			fail(http.StatusBadRequest, "bad_request")
+			return
+		}
+		var data []byte
+		for i, partSha1 := range req.PartSha1Array {
+			p := f.parts[i+1]
+			sum := sha1.Sum(p)
+			if hex.EncodeToString(sum[:]) != partSha1 || (i < len(req.PartSha1Array)-1 && int64(len(p)) < b.minPartSize) {
+				fail(http.StatusBadRequest, "bad_request")
+				return
+			}
+			data = append(data, p...)
+		}
+		f.Action, f.data, f.ContentLength, f.parts = "upload", data, int64(len(data)), nil
+		reply(f.file)
+	case "b2_cancel_large_file":
+		f := b.find(req.FileID)
+		if f == nil || f.Action != "start" {
+			fail(http.StatusBadRequest, "file_not_present")
+			return
+		}
+		b.remove(f)
+		reply(map[string]string{"fileId": f.FileID})
+	case "b2_copy_file":
+		src := b.find(req.SourceFileID)
+		if src == nil || src.Action != "upload" || req.MetadataDirective != "COPY" {
+			fail(http.StatusBadRequest, "file_not_present")
+			return
+		}
+		reply(b.add(req.FileName, "upload", src.ContentType, src.FileInfo, src.data).file)
+	case "b2_copy_part":
+		src, dst := b.find(req.SourceFileID), b.find(req.LargeFileID)
+		var start, end int
+		if _, err := fmt.Sscanf(req.Range, "bytes=%d-%d", &start, &end); err != nil || src == nil || dst == nil || end >= len(src.data) {
+			fail(http.StatusBadRequest, "bad_request")
+			return
+		}
+		data := src.data[start : end+1]
+		dst.parts[req.PartNumber] = data
+		sum := sha1.Sum(data)
+		reply(part{PartNumber: req.PartNumber, ContentLength: int64(len(data)), ContentSha1: hex.EncodeToString(sum[:])})
+	case "b2_get_download_authorization":
+		reply(map[string]string{"authorizationToken": "download:" + req.FileNamePrefix})
+	default:
+		fail(http.StatusNotFound, "not_found")
+	}
+}
+
+func (b *testB2) add(name, action, contentType string, info map[string]string, data []byte) *testFile {
+	b.seq++
+	f := &testFile{
+		file: file{
+			FileID:          fmt.Sprintf("file-%d", b.seq),
+			FileName:        name,
+			Action:          action,
+			ContentLength:   int64(len(data)),
+			ContentType:     contentType,
+			FileInfo:        info,
+			UploadTimestamp: int64(b.seq),
+		},
+		seq:   b.seq,
+		data:  data,
+		parts: make(map[int][]byte),
+	}
+	b.versions = append(b.versions, f)
+	// versions are ordered by name, and then from the latest
+	sort.Slice(b.versions, func(i, j int) bool {
+		if b.versions[i].FileName != b.versions[j].FileName {
+			return b.versions[i].FileName < b.versions[j].FileName
+		}
+		return b.versions[i].seq > b.versions[j].seq
+	})
+	return f
+}
+
+func (b *testB2) find(fileID string) *testFile {
+	for _, f := range b.versions {
+		if f.FileID == fileID {
+			return f
+		}
+	}
+	return nil
+}
+
+func (b *testB2) remove(f *testFile) {
+	b.versions = slices.DeleteFunc(b.versions, func(v *testFile) bool { return v == f })
+}
+
+// latest returns the latest version of the file named name.
+func (b *testB2) latest(name string) *testFile {
+	for _, f := range b.versions {
+		if f.FileName == name && f.Action == "upload" {
+			return f
+		}
+	}
+	return nil
+}
+
+func (b *testB2) listFileNames(prefix, delimiter, startFileName string, maxFileCount int) fileList {
+	list := fileList{Files: []file{}}
+	for _, f := range b.versions {
+		if f.Action != "upload" || !strings.HasPrefix(f.FileName, prefix) || b.latest(f.FileName) != f {
+			continue
+		}
+		entry := f.file
+		if delimiter != "" {
+			if i := strings.Index(f.FileName[len(prefix):], delimiter); i >= 0 {
+				entry = file{FileName: f.FileName[:len(prefix)+i+1], Action: "folder"}
+			}
+		}
+		if entry.FileName < startFileName || (len(list.Files) > 0 && list.Files[len(list.Files)-1].FileName == entry.FileName) {
+			continue
+		}
+		if len(list.Files) == maxFileCount {
+			list.NextFileName = &entry.FileName
+			break
+		}
+		list.Files = append(list.Files, entry)
+	}
+	return list
+}
+
+func (b *testB2) listFileVersions(prefix, startFileName, startFileID string, maxFileCount int) fileList {
+	list := fileList{Files: []file{}}
+	started := false
+	for _, f := range b.versions {
+		if !started {
+			if f.FileName < startFileName || (startFileID != "" && f.FileName == startFileName && f.FileID != startFileID) {
+				continue
+			}
+			started = true
+		}
+		if !strings.HasPrefix(f.FileName, prefix) {
+			continue
+		}
+		if len(list.Files) == maxFileCount {
+			list.NextFileName, list.NextFileID = &f.FileName, &f.FileID
+			break
+		}
+		list.Files = append(list.Files, f.file)
+	}
+	return list
+}
+
+func (b *testB2) download(w http.ResponseWriter, r *http.Request, name string, fail func(int, string)) {
+	f := b.latest(name)
+	if f == nil {
+		fail(http.StatusNotFound, "not_found")
+		return
+	}
+	data := f.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var offset int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &offset); err != nil || offset >= len(data) {
+			fail(http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable")
+			return
+		}
+		data, status = data[offset:], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(data)
+	}
+}
+
+func TestB2DriverSuiteWithTestServer(t *testing.T) {
+	// the test server holds files in memory, which the 5GB file of
+	// TestWriteReadLargeStreams would not fit in
+	if !testing.Short() {
+		t.Skip("Skipping test outside of short mode")
+	}
+	b := newTestB2(t)
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return New(context.Background(), b.parameters("/registry/suite"))
+	})
+}
+
+func TestApplicationKeyScoping(t *testing.T) {
+	b := newTestB2(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name          string
+		allowed       map[string]interface{}
+		rootDirectory string
+		err           string
+	}{
+		{
+			name:          "other bucket",
+			allowed:       map[string]interface{}{"bucketId": "other-id", "bucketName": "other", "capabilities": requiredCapabilities},
+			rootDirectory: "/registry",
+			err:           `restricted to bucket "other"`,
+		},
+		{
+			name:          "root directory outside of the name prefix",
+			allowed:       map[string]interface{}{"bucketId": "bucket-id", "bucketName": "registry", "namePrefix": "registry/", "capabilities": requiredCapabilities},
+			rootDirectory: "/other",
+			err:           `restricted to file names starting with "registry/"`,
+		},
+		{
+			name:          "bucket root outside of the name prefix",
+			allowed:       map[string]interface{}{"bucketId": "bucket-id", "bucketName": "registry", "namePrefix": "registry/", "capabilities": requiredCapabilities},
+			rootDirectory: "",
+			err:           `restricted to file names starting with "registry/"`,
+		},
+		{
+			name:          "missing capabilities",
+			allowed:       map[string]interface{}{"bucketId": "bucket-id", "bucketName": "registry", "capabilities": []string{"listFiles", "readFiles"}},
+			rootDirectory: "/registry",
+			err:           "lacks the capabilities writeFiles, deleteFiles",
+		},
+		{
+			name:          "unrestricted key",
+			allowed:       map[string]interface{}{"capabilities": append([]string{"listBuckets"}, requiredCapabilities...)},
+			rootDirectory: "/registry",
+		},
+		{
+			name:          "key restricted to the root directory",
+			allowed:       map[string]interface{}{"bucketId": "bucket-id", "bucketName": "registry", "namePrefix": "registry/", "capabilities": requiredCapabilities},
+			rootDirectory: "/registry/prod",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b.allowed = tc.allowed
+			d, err := New(ctx, b.parameters(tc.rootDirectory))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// without the shareFiles capability, downloads are not redirected
+			url, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, "/a", nil), "/a")
+			if url != "" || err != nil {
+				t.Fatalf("unexpected redirect URL %q: %v", url, err)
+			}
+			if err := d.Delete(ctx, "/a"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFromParameters(t *testing.T) {
+	b := newTestB2(t)
+	ctx := context.Background()
+
+	valid := map[string]interface{}{
+		"keyid":          "key-id",
+		"applicationkey": "application-key",
+		"bucket":         "registry",
+		"rootdirectory":  "/registry",
+		"apiurl":         b.URL,
+	}
+	if _, err := FromParameters(ctx, valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		override map[string]interface{}
+		err      string
+	}{
+		{map[string]interface{}{"keyid": ""}, "no keyid parameter provided"},
+		{map[string]interface{}{"applicationkey": ""}, "no applicationkey parameter provided"},
+		{map[string]interface{}{"bucket": ""}, "no bucket parameter provided"},
+		{map[string]interface{}{"applicationkey": "wrong"}, "unable to authorize b2 account"},
+		{map[string]interface{}{"chunksize": "big"}, "chunksize must be an integer"},
+		{map[string]interface{}{"chunksize": 1024}, "chunksize 1024 must be larger than or equal to"},
+		{map[string]interface{}{"maxconcurrency": "many"}, "maxconcurrency config error"},
+	} {
+		params := make(map[string]interface{})
+		for k, v := range valid {
+			params[k] = v
+		}
+		for k, v := range tc.override {
+			params[k] = v
+		}
+		if _, err := FromParameters(ctx, params); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.override, tc.err, err)
+		}
+	}
+}
+
+func TestExpiredAuthToken(t *testing.T) {
+	b := newTestB2(t)
+	ctx := context.Background()
+
+	d, err := New(ctx, b.parameters("/registry"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b.expire()
+	if content, err := d.GetContent(ctx, "/a"); err != nil || string(content) != "content" {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+	b.expire()
+	if err := d.PutContent(ctx, "/b", []byte("content")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.expire()
+	if err := d.Delete(ctx, "/a"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.tokens != 4 {
+		t.Fatalf("expected the account to be authorized 4 times, got %d", b.tokens)
+	}
+}
+
+// Test resuming an upload of a large file, and that no versions are left
+// over once it is committed
+func TestResumeLargeFile(t *testing.T) {
+	b := newTestB2(t)
+	ctx := context.Background()
+
+	d, err := New(ctx, b.parameters("/registry"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents := make([]byte, 3*minChunkSize+42)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	offset := 0
+	for _, n := range []int{minChunkSize + 1, 10, minChunkSize} {
+		w, err := d.Writer(ctx, "/upload", offset > 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if w.Size() != int64(offset) {
+			t.Fatalf("unexpected size %d, expected %d", w.Size(), offset)
+		}
+		if _, err := w.Write(contents[offset : offset+n]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		offset += n
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := d.Stat(ctx, "/upload"); err == nil {
+		t.Fatal("expected the upload session to be hidden")
+	}
+
+	w, err := d.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := w.Write(contents[offset:]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	received, err := d.GetContent(ctx, "/upload")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(received, contents) {
+		t.Fatal("unexpected content")
+	}
+	if len(b.versions) != 1 {
+		t.Fatalf("expected a single version, got %d", len(b.versions))
+	}
+
+	// moved large files are copied in parts
+	defer func(size int64) { maxCopySize = size }(maxCopySize)
+	maxCopySize = minChunkSize
+	if err := d.Move(ctx, "/upload", "/moved"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received, err := d.GetContent(ctx, "/moved"); err != nil || !bytes.Equal(received, contents) {
+		t.Fatalf("unexpected content after move: %v", err)
+	}
+	if len(b.versions) != 1 {
+		t.Fatalf("expected a single version, got %d", len(b.versions))
+	}
+}
+
+// Test that cancelling an upload deletes its large file and session file
+func TestCancelLargeFile(t *testing.T) {
+	b := newTestB2(t)
+	ctx := context.Background()
+
+	d, err := New(ctx, b.parameters("/registry"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := w.Write(make([]byte, 2*minChunkSize)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(b.versions) != 2 {
+		t.Fatalf("expected a large file and a session file, got %d versions", len(b.versions))
+	}
+
+	w, err = d.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Cancel(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(b.versions) != 0 {
+		t.Fatalf("expected no version to be left over, got %d", len(b.versions))
+	}
+}
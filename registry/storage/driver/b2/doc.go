@@ -0,0 +1,2 @@
+// Package b2 implements the Backblaze B2 Cloud Storage driver backend.
+package b2
@@ -87,6 +87,12 @@ func (base *Base) setDriverName(e error) error {
 	case storagedriver.InvalidOffsetError:
 		actual.DriverName = base.StorageDriver.Name()
 		return actual
+	case storagedriver.ChecksumMismatchError:
+		actual.DriverName = base.StorageDriver.Name()
+		return actual
+	case storagedriver.ArchivedContentError:
+		actual.DriverName = base.StorageDriver.Name()
+		return actual
 	default:
 		return storagedriver.Error{
 			DriverName: base.StorageDriver.Name(),
@@ -190,6 +196,32 @@ func (base *Base) Writer(ctx context.Context, path string, append bool) (storage
 	return writer, base.setDriverName(e)
 }
 
+// Append wraps Append of underlying storage driver, returning
+// storagedriver.ErrUnsupportedMethod if it is not a storagedriver.Appender.
+func (base *Base) Append(ctx context.Context, path string) (storagedriver.FileWriter, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String(tracing.AttributePrefix+"storage.driver.name", base.Name()),
+		attribute.String(tracing.AttributePrefix+"storage.path", path),
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"Append",
+		trace.WithAttributes(attrs...))
+
+	defer span.End()
+
+	if !storagedriver.PathRegexp.MatchString(path) {
+		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
+	}
+
+	appender, ok := base.StorageDriver.(storagedriver.Appender)
+	if !ok {
+		return nil, storagedriver.ErrUnsupportedMethod{DriverName: base.StorageDriver.Name()}
+	}
+	writer, e := appender.Append(ctx, path)
+	return writer, base.setDriverName(e)
+}
+
 // Stat wraps Stat of underlying storage driver.
 func (base *Base) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
 	attrs := []attribute.KeyValue{
@@ -265,6 +297,35 @@ func (base *Base) Move(ctx context.Context, sourcePath string, destPath string)
 	return err
 }
 
+// Transfer wraps Transfer of underlying storage driver, returning
+// storagedriver.ErrUnsupportedMethod if it is not a storagedriver.Transferer.
+func (base *Base) Transfer(ctx context.Context, source storagedriver.StorageDriver, sourcePath, destPath string) error {
+	attrs := []attribute.KeyValue{
+		attribute.String(tracing.AttributePrefix+"storage.driver.name", base.Name()),
+		attribute.String(tracing.AttributePrefix+"storage.source.driver.name", source.Name()),
+		attribute.String(tracing.AttributePrefix+"storage.source.path", sourcePath),
+		attribute.String(tracing.AttributePrefix+"storage.dest.path", destPath),
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"Transfer",
+		trace.WithAttributes(attrs...))
+
+	defer span.End()
+
+	if !storagedriver.PathRegexp.MatchString(sourcePath) {
+		return storagedriver.InvalidPathError{Path: sourcePath, DriverName: source.Name()}
+	} else if !storagedriver.PathRegexp.MatchString(destPath) {
+		return storagedriver.InvalidPathError{Path: destPath, DriverName: base.StorageDriver.Name()}
+	}
+
+	transferer, ok := base.StorageDriver.(storagedriver.Transferer)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{DriverName: base.StorageDriver.Name()}
+	}
+	return base.setDriverName(transferer.Transfer(ctx, source, sourcePath, destPath))
+}
+
 // Delete wraps Delete of underlying storage driver.
 func (base *Base) Delete(ctx context.Context, path string) error {
 	attrs := []attribute.KeyValue{
@@ -288,6 +349,33 @@ func (base *Base) Delete(ctx context.Context, path string) error {
 	return err
 }
 
+// DeleteFiles wraps DeleteFiles of underlying storage driver, returning
+// storagedriver.ErrUnsupportedMethod if it is not a storagedriver.BulkDeleter.
+func (base *Base) DeleteFiles(ctx context.Context, paths []string) error {
+	attrs := []attribute.KeyValue{
+		attribute.String(tracing.AttributePrefix+"storage.driver.name", base.Name()),
+		attribute.Int(tracing.AttributePrefix+"storage.paths", len(paths)),
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"DeleteFiles",
+		trace.WithAttributes(attrs...))
+
+	defer span.End()
+
+	for _, path := range paths {
+		if !storagedriver.PathRegexp.MatchString(path) {
+			return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
+		}
+	}
+
+	deleter, ok := base.StorageDriver.(storagedriver.BulkDeleter)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{DriverName: base.StorageDriver.Name()}
+	}
+	return base.setDriverName(deleter.DeleteFiles(ctx, paths))
+}
+
 // RedirectURL wraps RedirectURL of the underlying storage driver.
 func (base *Base) RedirectURL(r *http.Request, path string) (string, error) {
 	attrs := []attribute.KeyValue{
@@ -0,0 +1,270 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// CircuitBreaker wraps a storage driver, failing calls fast with a
+// storagedriver.UnavailableError once its backend failed threshold times in
+// a row, rather than letting them hang on a backend which is down. The
+// circuit is open for the cooldown, after which a single call is let through
+// to probe the backend: the circuit closes again if it succeeds, and opens
+// for another cooldown otherwise.
+type CircuitBreaker struct {
+	storagedriver.StorageDriver
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	// openUntil is the end of the cooldown of an open circuit.
+	openUntil time.Time
+	// probing is set while a call probes the backend of a half-open circuit.
+	probing bool
+}
+
+// NewCircuitBreaker wraps the given driver with a CircuitBreaker opening
+// after threshold consecutive failures for the cooldown.
+func NewCircuitBreaker(driver storagedriver.StorageDriver, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		StorageDriver: driver,
+		threshold:     threshold,
+		cooldown:      cooldown,
+		now:           time.Now,
+	}
+}
+
+// enter returns an UnavailableError if the circuit is open, or half-open
+// with the backend already being probed.
+func (cb *CircuitBreaker) enter() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.threshold {
+		return nil
+	}
+	if now := cb.now(); now.Before(cb.openUntil) || cb.probing {
+		return storagedriver.UnavailableError{
+			DriverName: cb.StorageDriver.Name(),
+			RetryAfter: max(cb.openUntil.Sub(now), time.Second),
+		}
+	}
+	cb.probing = true
+	return nil
+}
+
+// exit records the result of a call.
+func (cb *CircuitBreaker) exit(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	if !isBackendFailure(err) {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openUntil = cb.now().Add(cb.cooldown)
+	}
+}
+
+// isBackendFailure returns whether err is a failure of the backend, rather
+// than an error of the call itself.
+func isBackendFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.As(err, &storagedriver.PathNotFoundError{}),
+		errors.As(err, &storagedriver.InvalidPathError{}),
+		errors.As(err, &storagedriver.InvalidOffsetError{}),
+		errors.As(err, &storagedriver.ErrUnsupportedMethod{}),
+		errors.As(err, &storagedriver.ArchivedContentError{}),
+		errors.As(err, &storagedriver.ChecksumMismatchError{}),
+		errors.As(err, &storagedriver.UnavailableError{}):
+		return false
+	}
+	return true
+}
+
+// Check reports the circuit as unhealthy while it is open, so that it can be
+// registered as a health check.
+func (cb *CircuitBreaker) Check(context.Context) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures >= cb.threshold && cb.now().Before(cb.openUntil) {
+		return fmt.Errorf("circuit breaker open after %d consecutive failures of the storage backend", cb.failures)
+	}
+	return nil
+}
+
+// GetContent wraps GetContent of underlying storage driver.
+func (cb *CircuitBreaker) GetContent(ctx context.Context, path string) (content []byte, err error) {
+	if err := cb.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.GetContent(ctx, path)
+}
+
+// PutContent wraps PutContent of underlying storage driver.
+func (cb *CircuitBreaker) PutContent(ctx context.Context, path string, content []byte) (err error) {
+	if err := cb.enter(); err != nil {
+		return err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.PutContent(ctx, path, content)
+}
+
+// Reader wraps Reader of underlying storage driver.
+func (cb *CircuitBreaker) Reader(ctx context.Context, path string, offset int64) (rc io.ReadCloser, err error) {
+	if err := cb.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.Reader(ctx, path, offset)
+}
+
+// Writer wraps Writer of underlying storage driver.
+func (cb *CircuitBreaker) Writer(ctx context.Context, path string, append bool) (fw storagedriver.FileWriter, err error) {
+	if err := cb.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.Writer(ctx, path, append)
+}
+
+// Append wraps Append of underlying storage driver, if it is a
+// storagedriver.Appender.
+func (cb *CircuitBreaker) Append(ctx context.Context, path string) (fw storagedriver.FileWriter, err error) {
+	appender, ok := cb.StorageDriver.(storagedriver.Appender)
+	if !ok {
+		return nil, storagedriver.ErrUnsupportedMethod{}
+	}
+	if err := cb.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { cb.exit(err) }()
+
+	return appender.Append(ctx, path)
+}
+
+// Stat wraps Stat of underlying storage driver.
+func (cb *CircuitBreaker) Stat(ctx context.Context, path string) (fi storagedriver.FileInfo, err error) {
+	if err := cb.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.Stat(ctx, path)
+}
+
+// List wraps List of underlying storage driver.
+func (cb *CircuitBreaker) List(ctx context.Context, path string) (entries []string, err error) {
+	if err := cb.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.List(ctx, path)
+}
+
+// Move wraps Move of underlying storage driver.
+func (cb *CircuitBreaker) Move(ctx context.Context, sourcePath string, destPath string) (err error) {
+	if err := cb.enter(); err != nil {
+		return err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// Transfer wraps Transfer of underlying storage driver, if it is a
+// storagedriver.Transferer.
+func (cb *CircuitBreaker) Transfer(ctx context.Context, source storagedriver.StorageDriver, sourcePath, destPath string) (err error) {
+	transferer, ok := cb.StorageDriver.(storagedriver.Transferer)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+	if err := cb.enter(); err != nil {
+		return err
+	}
+	defer func() { cb.exit(err) }()
+
+	return transferer.Transfer(ctx, source, sourcePath, destPath)
+}
+
+// Delete wraps Delete of underlying storage driver.
+func (cb *CircuitBreaker) Delete(ctx context.Context, path string) (err error) {
+	if err := cb.enter(); err != nil {
+		return err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.Delete(ctx, path)
+}
+
+// DeleteFiles wraps DeleteFiles of underlying storage driver, if it is a
+// storagedriver.BulkDeleter.
+func (cb *CircuitBreaker) DeleteFiles(ctx context.Context, paths []string) (err error) {
+	deleter, ok := cb.StorageDriver.(storagedriver.BulkDeleter)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+	if err := cb.enter(); err != nil {
+		return err
+	}
+	defer func() { cb.exit(err) }()
+
+	return deleter.DeleteFiles(ctx, paths)
+}
+
+// RedirectURL wraps RedirectURL of underlying storage driver.
+func (cb *CircuitBreaker) RedirectURL(r *http.Request, path string) (url string, err error) {
+	if err := cb.enter(); err != nil {
+		return "", err
+	}
+	defer func() { cb.exit(err) }()
+
+	return cb.StorageDriver.RedirectURL(r, path)
+}
+
+// RedirectCookies passes RedirectCookies of underlying storage driver
+// through, since it does not call the backend.
+func (cb *CircuitBreaker) RedirectCookies(r *http.Request, path string) ([]*http.Cookie, error) {
+	return storagedriver.RedirectCookies(r, cb.StorageDriver, path)
+}
+
+// Walk wraps Walk of underlying storage driver. The errors returned by f are
+// not failures of the backend.
+func (cb *CircuitBreaker) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	if err := cb.enter(); err != nil {
+		return err
+	}
+
+	var walkErr error
+	err := cb.StorageDriver.Walk(ctx, path, func(fileInfo storagedriver.FileInfo) error {
+		walkErr = f(fileInfo)
+		return walkErr
+	}, options...)
+	if walkErr != nil && errors.Is(err, walkErr) {
+		cb.exit(nil)
+	} else {
+		cb.exit(err)
+	}
+	return err
+}
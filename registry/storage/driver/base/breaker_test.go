@@ -0,0 +1,116 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// failingDriver holds a single file, /file, failing the calls to Stat with
+// err when set.
+type failingDriver struct {
+	storagedriver.StorageDriver
+	err   error
+	calls int
+}
+
+func (d *failingDriver) Name() string {
+	return "failing"
+}
+
+func (d *failingDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	if path != "/file" {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{Path: path, Size: 7}}, nil
+}
+
+func (d *failingDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	fi, err := d.Stat(ctx, "/file")
+	if err != nil {
+		return err
+	}
+	return f(fi)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	d := &failingDriver{}
+	now := time.Unix(1700000000, 0)
+	cb := NewCircuitBreaker(d, 2, time.Minute)
+	cb.now = func() time.Time { return now }
+
+	// the errors of the calls themselves are not failures of the backend
+	for i := 0; i < 3; i++ {
+		if _, err := cb.Stat(ctx, "/missing"); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	d.err = errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		if _, err := cb.Stat(ctx, "/file"); err != d.err {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := cb.Check(ctx); err == nil {
+		t.Fatal("expected the circuit to be open")
+	}
+
+	// the backend is not called while the circuit is open
+	calls := d.calls
+	var unavailable storagedriver.UnavailableError
+	if _, err := cb.Stat(ctx, "/file"); !errors.As(err, &unavailable) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if unavailable.RetryAfter != time.Minute || d.calls != calls {
+		t.Fatalf("unexpected retry after %v and %d calls", unavailable.RetryAfter, d.calls-calls)
+	}
+
+	// once half-open, a failed probe opens the circuit again
+	now = now.Add(time.Minute)
+	if err := cb.Check(ctx); err != nil {
+		t.Fatalf("expected the circuit to be half-open: %v", err)
+	}
+	if _, err := cb.Stat(ctx, "/file"); err != d.err {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := cb.Stat(ctx, "/file"); !errors.As(err, &unavailable) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// and a successful probe closes it
+	now = now.Add(time.Minute)
+	d.err = nil
+	if _, err := cb.Stat(ctx, "/file"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := cb.Stat(ctx, "/file"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := cb.Check(ctx); err != nil {
+		t.Fatalf("expected the circuit to be closed: %v", err)
+	}
+}
+
+func TestCircuitBreakerWalk(t *testing.T) {
+	ctx := context.Background()
+	cb := NewCircuitBreaker(&failingDriver{}, 1, time.Minute)
+
+	// the errors returned by the walk function are not failures of the backend
+	walkErr := errors.New("stop")
+	err := cb.Walk(ctx, "/", func(storagedriver.FileInfo) error { return walkErr })
+	if !errors.Is(err, walkErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := cb.Check(ctx); err != nil {
+		t.Fatalf("expected the circuit to be closed: %v", err)
+	}
+}
@@ -136,6 +136,20 @@ func (r *regulator) Writer(ctx context.Context, path string, append bool) (stora
 	return r.StorageDriver.Writer(ctx, path, append)
 }
 
+// Append returns a FileWriter which appends to the uncommitted content
+// stored at "path", if the underlying driver is a storagedriver.Appender.
+func (r *regulator) Append(ctx context.Context, path string) (storagedriver.FileWriter, error) {
+	appender, ok := r.StorageDriver.(storagedriver.Appender)
+	if !ok {
+		return nil, storagedriver.ErrUnsupportedMethod{}
+	}
+
+	r.enter()
+	defer r.exit()
+
+	return appender.Append(ctx, path)
+}
+
 // Stat retrieves the FileInfo for the given path, including the current
 // size in bytes and the creation time.
 func (r *regulator) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
@@ -165,6 +179,20 @@ func (r *regulator) Move(ctx context.Context, sourcePath string, destPath string
 	return r.StorageDriver.Move(ctx, sourcePath, destPath)
 }
 
+// Transfer copies the content stored at sourcePath of the source driver to
+// destPath, if the underlying driver is a storagedriver.Transferer.
+func (r *regulator) Transfer(ctx context.Context, source storagedriver.StorageDriver, sourcePath, destPath string) error {
+	transferer, ok := r.StorageDriver.(storagedriver.Transferer)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+
+	r.enter()
+	defer r.exit()
+
+	return transferer.Transfer(ctx, source, sourcePath, destPath)
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (r *regulator) Delete(ctx context.Context, path string) error {
 	r.enter()
@@ -173,6 +201,20 @@ func (r *regulator) Delete(ctx context.Context, path string) error {
 	return r.StorageDriver.Delete(ctx, path)
 }
 
+// DeleteFiles deletes the files stored at paths, if the underlying driver is
+// a storagedriver.BulkDeleter.
+func (r *regulator) DeleteFiles(ctx context.Context, paths []string) error {
+	deleter, ok := r.StorageDriver.(storagedriver.BulkDeleter)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+
+	r.enter()
+	defer r.exit()
+
+	return deleter.DeleteFiles(ctx, paths)
+}
+
 // RedirectURL returns a URL which may be used to retrieve the content stored at
 // the given path.
 func (r *regulator) RedirectURL(req *http.Request, path string) (string, error) {
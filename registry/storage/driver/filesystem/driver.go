@@ -4,12 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -26,13 +32,58 @@ const (
 	// parameter. If the driver's parameters are less than this we set
 	// the parameters to minThreads
 	minThreads = uint64(25)
+
+	// tempFileSuffix marks the temporary files content is written to
+	// before being renamed into place, with the full fsync policy.
+	tempFileSuffix = ".tmp"
+
+	// deleteAttempts bounds the attempts to remove a directory tree on a
+	// shared filesystem, where files held open by other replicas linger
+	// as hidden files until they are closed.
+	deleteAttempts = 5
+
+	// maxShardingDepth bounds the levels of directories the directories
+	// named after digests are sharded in.
+	maxShardingDepth = 3
+
+	// shardPrefix marks the names of the directories digests are sharded
+	// in, which are not valid path components of the storage driver.
+	shardPrefix = "~"
+)
+
+// The fsync policies, which set the writes that are flushed to stable
+// storage.
+const (
+	// fsyncNone leaves flushing writes to the operating system.
+	fsyncNone = "none"
+
+	// fsyncFile flushes the content of files when they are committed or
+	// closed.
+	fsyncFile = "file"
+
+	// fsyncFull also replaces files by renaming them into place, and
+	// flushes the directories holding the files and directories written.
+	fsyncFull = "full"
 )
 
+// digestHexRegexp matches the path components named after digests, such as
+// blob and revision directories.
+var digestHexRegexp = regexp.MustCompile(`^[a-f0-9]{64,}$`)
+
 // DriverParameters represents all configuration options available for the
 // filesystem driver
 type DriverParameters struct {
-	RootDirectory string
-	MaxThreads    uint64
+	RootDirectory    string
+	MaxThreads       uint64
+	SharedFilesystem bool
+
+	// ShardingDepth is the number of levels of directories, named after
+	// the pairs of hex digits following the first two, the directories
+	// named after digests are sharded in.
+	ShardingDepth int
+
+	// FSync is the fsync policy, fsyncFile if empty.
+	FSync string
 }
 
 func init() {
@@ -48,6 +99,14 @@ func (factory *filesystemDriverFactory) Create(ctx context.Context, parameters m
 
 type driver struct {
 	rootDirectory string
+
+	// shared enables the code paths which are safe when the root
+	// directory is shared by several registry replicas, for instance
+	// over NFS or SMB.
+	shared bool
+
+	shardingDepth int
+	fsync         string
 }
 
 type baseEmbed struct {
@@ -64,6 +123,9 @@ type Driver struct {
 // Optional Parameters:
 // - rootdirectory
 // - maxthreads
+// - sharedfilesystem
+// - shardingdepth
+// - fsync
 func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 	params, err := fromParametersImpl(parameters)
 	if err != nil || params == nil {
@@ -74,9 +136,12 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 
 func fromParametersImpl(parameters map[string]interface{}) (*DriverParameters, error) {
 	var (
-		err           error
-		maxThreads    = defaultMaxThreads
-		rootDirectory = defaultRootDirectory
+		err              error
+		maxThreads       = defaultMaxThreads
+		rootDirectory    = defaultRootDirectory
+		sharedFilesystem = false
+		shardingDepth    = 0
+		fsync            = fsyncFile
 	)
 
 	if parameters != nil {
@@ -88,18 +153,72 @@ func fromParametersImpl(parameters map[string]interface{}) (*DriverParameters, e
 		if err != nil {
 			return nil, fmt.Errorf("maxthreads config error: %s", err.Error())
 		}
+
+		switch shared := parameters["sharedfilesystem"].(type) {
+		case string:
+			sharedFilesystem, err = strconv.ParseBool(shared)
+			if err != nil {
+				return nil, fmt.Errorf("the sharedfilesystem parameter should be a boolean")
+			}
+		case bool:
+			sharedFilesystem = shared
+		case nil:
+			// do nothing
+		default:
+			return nil, fmt.Errorf("the sharedfilesystem parameter should be a boolean")
+		}
+		if sharedFilesystem && !sharedFilesystemSupported {
+			return nil, fmt.Errorf("the sharedfilesystem parameter is not supported on this platform")
+		}
+
+		if depth, ok := parameters["shardingdepth"]; ok && depth != nil {
+			if _, err := fmt.Sscanf(fmt.Sprint(depth), "%d", &shardingDepth); err != nil {
+				return nil, fmt.Errorf("the shardingdepth parameter should be an integer, %v invalid", depth)
+			}
+			if shardingDepth < 0 || shardingDepth > maxShardingDepth {
+				return nil, fmt.Errorf("the shardingdepth parameter should be between 0 and %d", maxShardingDepth)
+			}
+		}
+
+		if sharedFilesystem {
+			fsync = fsyncFull
+		}
+		if policy, ok := parameters["fsync"]; ok && policy != nil {
+			fsync = strings.ToLower(fmt.Sprint(policy))
+			switch fsync {
+			case fsyncNone, fsyncFile, fsyncFull:
+			default:
+				return nil, fmt.Errorf("the fsync parameter should be one of %s, %s or %s", fsyncNone, fsyncFile, fsyncFull)
+			}
+			if sharedFilesystem && fsync != fsyncFull {
+				return nil, fmt.Errorf("the sharedfilesystem parameter requires the %s fsync policy", fsyncFull)
+			}
+		}
 	}
 
 	params := &DriverParameters{
-		RootDirectory: rootDirectory,
-		MaxThreads:    maxThreads,
+		RootDirectory:    rootDirectory,
+		MaxThreads:       maxThreads,
+		SharedFilesystem: sharedFilesystem,
+		ShardingDepth:    shardingDepth,
+		FSync:            fsync,
 	}
 	return params, nil
 }
 
 // New constructs a new Driver with a given rootDirectory
 func New(params DriverParameters) *Driver {
-	fsDriver := &driver{rootDirectory: params.RootDirectory}
+	fsDriver := &driver{
+		rootDirectory: params.RootDirectory,
+		shared:        params.SharedFilesystem,
+		shardingDepth: params.ShardingDepth,
+		fsync:         params.FSync,
+	}
+	if fsDriver.shared {
+		fsDriver.fsync = fsyncFull
+	} else if fsDriver.fsync == "" {
+		fsDriver.fsync = fsyncFile
+	}
 
 	return &Driver{
 		baseEmbed: baseEmbed{
@@ -152,7 +271,7 @@ func (d *driver) PutContent(ctx context.Context, subPath string, contents []byte
 // Reader retrieves an io.ReadCloser for the content stored at "path" with a
 // given byte offset.
 func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
-	file, err := os.OpenFile(d.fullPath(path), os.O_RDONLY, 0o644)
+	file, err := os.OpenFile(d.resolvePath(path), os.O_RDONLY, 0o644)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, storagedriver.PathNotFoundError{Path: path}
@@ -174,13 +293,42 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 }
 
 func (d *driver) Writer(ctx context.Context, subPath string, append bool) (storagedriver.FileWriter, error) {
-	fullPath := d.fullPath(subPath)
+	fullPath := d.shardedPath(subPath)
+	if append {
+		fullPath = d.resolvePath(subPath)
+	}
 	parentDir := path.Dir(fullPath)
-	if err := os.MkdirAll(parentDir, 0o777); err != nil {
+	if err := d.mkdirAll(parentDir); err != nil {
 		return nil, err
 	}
 
-	fp, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0o666)
+	if d.fsync == fsyncFull && !append {
+		// Truncating the file in place would let other replicas read
+		// partial content: the content is written to a temporary file
+		// instead, and renamed into place once written.
+		fp, err := createTempFile(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		fw := newFileWriter(fp, 0)
+		fw.sync = true
+		fw.target = fullPath
+		fw.lockTarget = d.shared
+		fw.syncDir = true
+		return fw, nil
+	}
+
+	var (
+		fp  *os.File
+		err error
+	)
+	if d.shared {
+		// Serialize appends with the writers of other replicas. The size
+		// of the file is only reliable once the lock is held.
+		fp, err = lockPath(fullPath, os.O_WRONLY|os.O_CREATE)
+	} else {
+		fp, err = os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0o666)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -202,15 +350,146 @@ func (d *driver) Writer(ctx context.Context, subPath string, append bool) (stora
 		offset = n
 	}
 
-	return newFileWriter(fp, offset), nil
+	fw := newFileWriter(fp, offset)
+	fw.sync = d.fsync != fsyncNone
+	fw.syncDir = d.fsync == fsyncFull
+	return fw, nil
+}
+
+// Append opens the file at subPath for writing at its end, which the local
+// filesystem supports natively.
+func (d *driver) Append(ctx context.Context, subPath string) (storagedriver.FileWriter, error) {
+	return d.Writer(ctx, subPath, true)
+}
+
+// createTempFile creates a uniquely named temporary file next to fullPath.
+func createTempFile(fullPath string) (*os.File, error) {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return nil, err
+	}
+	tempPath := path.Join(path.Dir(fullPath), "."+path.Base(fullPath)+"."+hex.EncodeToString(suffix[:])+tempFileSuffix)
+	return os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+}
+
+// lockPath opens the file at fullPath with flag and takes an exclusive lock
+// on it. The file may be replaced by another replica while waiting for the
+// lock: the lock is only returned once it is held on the file currently at
+// fullPath.
+func lockPath(fullPath string, flag int) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(fullPath, flag, 0o666)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := statFresh(fullPath)
+		if err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// lockExisting locks the regular files at the given paths which exist, in
+// a consistent order to keep replicas locking the same files from
+// deadlocking. The returned function releases the locks.
+func lockExisting(fullPaths ...string) (func(), error) {
+	sort.Strings(fullPaths)
+
+	var locked []*os.File
+	unlock := func() {
+		for _, f := range locked {
+			f.Close()
+		}
+	}
+	for _, fullPath := range fullPaths {
+		if fi, err := os.Stat(fullPath); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		f, err := lockPath(fullPath, os.O_WRONLY)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locked = append(locked, f)
+	}
+	return unlock, nil
+}
+
+// isTempFile returns whether the file name is that of a temporary file
+// created by createTempFile.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+// syncDir flushes the entries of a directory to stable storage.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// mkdirAll creates the directory dir along with its missing parents. With the
+// full fsync policy, the entries of the created directories are flushed to
+// stable storage too, so that the files written to them survive power loss.
+func (d *driver) mkdirAll(dir string) error {
+	if d.fsync != fsyncFull {
+		return os.MkdirAll(dir, 0o777)
+	}
+
+	var created []string
+	for p := dir; p != path.Dir(p); p = path.Dir(p) {
+		if _, err := os.Stat(p); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		created = append(created, p)
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return err
+	}
+	for _, p := range created {
+		if err := syncDir(path.Dir(p)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Stat retrieves the FileInfo for the given path, including the current size
 // in bytes and the creation time.
 func (d *driver) Stat(ctx context.Context, subPath string) (storagedriver.FileInfo, error) {
-	fullPath := d.fullPath(subPath)
+	fullPath := d.resolvePath(subPath)
 
-	fi, err := os.Stat(fullPath)
+	var (
+		fi  os.FileInfo
+		err error
+	)
+	if d.shared {
+		fi, err = statFresh(fullPath)
+	} else {
+		fi, err = os.Stat(fullPath)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, storagedriver.PathNotFoundError{Path: subPath}
@@ -225,16 +504,64 @@ func (d *driver) Stat(ctx context.Context, subPath string) (storagedriver.FileIn
 	}, nil
 }
 
+// statFresh stats the file through a new file descriptor. NFS clients cache
+// file attributes, but revalidate them when a file is opened: this keeps the
+// size of files written by other replicas from being stale.
+func statFresh(fullPath string) (os.FileInfo, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
 // List returns a list of the objects that are direct descendants of the given
 // path.
 func (d *driver) List(ctx context.Context, subPath string) ([]string, error) {
-	fullPath := d.fullPath(subPath)
+	// the content written before the directories named after digests
+	// were sharded is listed along with the sharded content
+	fullPaths := []string{d.shardedPath(subPath)}
+	if fullPath := d.fullPath(subPath); fullPath != fullPaths[0] {
+		fullPaths = append(fullPaths, fullPath)
+	}
+
+	var (
+		keys  []string
+		found bool
+		seen  = map[string]struct{}{}
+	)
+	for _, fullPath := range fullPaths {
+		fileNames, err := d.readDirNames(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+
+		for _, fileName := range fileNames {
+			if _, ok := seen[fileName]; ok {
+				continue
+			}
+			seen[fileName] = struct{}{}
+			keys = append(keys, path.Join(subPath, fileName))
+		}
+	}
+	if !found {
+		return nil, storagedriver.PathNotFoundError{Path: subPath}
+	}
+
+	return keys, nil
+}
 
+// readDirNames returns the names of the entries of the directory at
+// fullPath, with the entries of the directories digests are sharded in in
+// place of these directories.
+func (d *driver) readDirNames(fullPath string) ([]string, error) {
 	dir, err := os.Open(fullPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, storagedriver.PathNotFoundError{Path: subPath}
-		}
 		return nil, err
 	}
 
@@ -245,45 +572,96 @@ func (d *driver) List(ctx context.Context, subPath string) ([]string, error) {
 		return nil, err
 	}
 
-	keys := make([]string, 0, len(fileNames))
+	names := make([]string, 0, len(fileNames))
 	for _, fileName := range fileNames {
-		keys = append(keys, path.Join(subPath, fileName))
+		if d.fsync == fsyncFull && isTempFile(fileName) {
+			continue
+		}
+		if strings.HasPrefix(fileName, shardPrefix) {
+			shardNames, err := d.readDirNames(path.Join(fullPath, fileName))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			names = append(names, shardNames...)
+			continue
+		}
+		names = append(names, fileName)
 	}
-
-	return keys, nil
+	return names, nil
 }
 
 // Move moves an object stored at sourcePath to destPath, removing the original
 // object.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
-	source := d.fullPath(sourcePath)
-	dest := d.fullPath(destPath)
+	source := d.resolvePath(sourcePath)
+	dest := d.shardedPath(destPath)
 
 	if _, err := os.Stat(source); os.IsNotExist(err) {
 		return storagedriver.PathNotFoundError{Path: sourcePath}
 	}
 
-	if err := os.MkdirAll(path.Dir(dest), 0o777); err != nil {
+	if err := d.mkdirAll(path.Dir(dest)); err != nil {
 		return err
 	}
 
-	err := os.Rename(source, dest)
-	return err
+	if !d.shared {
+		if err := os.Rename(source, dest); err != nil {
+			return err
+		}
+		if d.fsync != fsyncFull {
+			return nil
+		}
+		if path.Dir(source) != path.Dir(dest) {
+			if err := syncDir(path.Dir(source)); err != nil {
+				return err
+			}
+		}
+		return syncDir(path.Dir(dest))
+	}
+
+	// Wait for the writers appending to the source or to the destination,
+	// whose appends would otherwise be lost.
+	unlock, err := lockExisting(source, dest)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Rename(source, dest); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(dest))
 }
 
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (d *driver) Delete(ctx context.Context, subPath string) error {
-	fullPath := d.fullPath(subPath)
+	fullPaths := []string{d.shardedPath(subPath)}
+	if fullPath := d.fullPath(subPath); fullPath != fullPaths[0] {
+		fullPaths = append(fullPaths, fullPath)
+	}
 
-	_, err := os.Stat(fullPath)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	} else if err != nil {
+	found := false
+	for _, fullPath := range fullPaths {
+		_, err := os.Stat(fullPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		} else if err != nil {
+			continue
+		}
+		found = true
+
+		err = os.RemoveAll(fullPath)
+		for attempt := 1; err != nil && d.shared && attempt < deleteAttempts; attempt++ {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			err = os.RemoveAll(fullPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !found {
 		return storagedriver.PathNotFoundError{Path: subPath}
 	}
-
-	err = os.RemoveAll(fullPath)
-	return err
+	return nil
 }
 
 // RedirectURL returns a URL which may be used to retrieve the content stored at the given path.
@@ -302,6 +680,46 @@ func (d *driver) fullPath(subPath string) string {
 	return path.Join(d.rootDirectory, subPath)
 }
 
+// shardedPath returns the absolute path of a key within the Driver's
+// storage, where the directories named after digests are in the directories
+// named after the pairs of hex digits following their first two, down to
+// the sharding depth.
+func (d *driver) shardedPath(subPath string) string {
+	if d.shardingDepth == 0 {
+		return d.fullPath(subPath)
+	}
+
+	components := strings.Split(subPath, "/")
+	sharded := make([]string, 0, len(components)+d.shardingDepth)
+	for _, component := range components {
+		if digestHexRegexp.MatchString(component) {
+			for i := 1; i <= d.shardingDepth; i++ {
+				sharded = append(sharded, shardPrefix+component[2*i:2*i+2])
+			}
+		}
+		sharded = append(sharded, component)
+	}
+	return path.Join(d.rootDirectory, path.Join(sharded...))
+}
+
+// resolvePath returns the absolute path of the content of a key, which is
+// at its unsharded path if it was written before the directories named
+// after digests were sharded.
+func (d *driver) resolvePath(subPath string) string {
+	sharded := d.shardedPath(subPath)
+	if d.shardingDepth == 0 {
+		return sharded
+	}
+	if _, err := os.Lstat(sharded); os.IsNotExist(err) {
+		if fullPath := d.fullPath(subPath); fullPath != sharded {
+			if _, err := os.Lstat(fullPath); err == nil {
+				return fullPath
+			}
+		}
+	}
+	return sharded
+}
+
 type fileInfo struct {
 	os.FileInfo
 	path string
@@ -343,6 +761,22 @@ type fileWriter struct {
 	closed    bool
 	committed bool
 	cancelled bool
+
+	// target is the path the file is renamed to once written, when the
+	// content is written to a temporary file.
+	target string
+
+	// lockTarget waits for the writers appending to the target before it
+	// is replaced, on shared filesystems.
+	lockTarget bool
+
+	// sync requests the content of the file to be flushed to stable
+	// storage when it is committed or closed.
+	sync bool
+
+	// syncDir requests the directory entry of the file to be flushed to
+	// stable storage too.
+	syncDir bool
 }
 
 func newFileWriter(file *os.File, size int64) *fileWriter {
@@ -379,14 +813,37 @@ func (fw *fileWriter) Close() error {
 		return err
 	}
 
-	if err := fw.file.Sync(); err != nil {
-		return err
+	if fw.sync {
+		if err := fw.file.Sync(); err != nil {
+			return err
+		}
 	}
 
 	if err := fw.file.Close(); err != nil {
 		return err
 	}
 	fw.closed = true
+
+	if fw.target != "" {
+		// Wait for the writers appending to the file being replaced,
+		// whose appends would otherwise be lost with it.
+		unlock := func() {}
+		if fw.lockTarget {
+			var err error
+			unlock, err = lockExisting(fw.target)
+			if err != nil {
+				return err
+			}
+		}
+		err := os.Rename(fw.file.Name(), fw.target)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if fw.syncDir {
+		return syncDir(path.Dir(fw.file.Name()))
+	}
 	return nil
 }
 
@@ -413,8 +870,10 @@ func (fw *fileWriter) Commit(ctx context.Context) error {
 		return err
 	}
 
-	if err := fw.file.Sync(); err != nil {
-		return err
+	if fw.sync {
+		if err := fw.file.Sync(); err != nil {
+			return err
+		}
 	}
 
 	fw.committed = true
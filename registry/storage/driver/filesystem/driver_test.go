@@ -1,20 +1,28 @@
 package filesystem
 
 import (
+	"context"
+	"os"
+	"path"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
 )
 
 func newDriverConstructor(tb testing.TB) testsuites.DriverConstructor {
-	root := tb.TempDir()
+	return newDriverConstructorWithParameters(tb, map[string]interface{}{})
+}
+
+func newDriverConstructorWithParameters(tb testing.TB, parameters map[string]interface{}) testsuites.DriverConstructor {
+	parameters["rootdirectory"] = tb.TempDir()
 
 	return func() (storagedriver.StorageDriver, error) {
-		return FromParameters(map[string]interface{}{
-			"rootdirectory": root,
-		})
+		return FromParameters(parameters)
 	}
 }
 
@@ -22,6 +30,204 @@ func TestFilesystemDriverSuite(t *testing.T) {
 	testsuites.Driver(t, newDriverConstructor(t))
 }
 
+func TestFilesystemDriverSuiteSharedFilesystem(t *testing.T) {
+	if !sharedFilesystemSupported {
+		t.Skip("shared filesystem mode is not supported on this platform")
+	}
+	testsuites.Driver(t, newDriverConstructorWithParameters(t, map[string]interface{}{
+		"sharedfilesystem": true,
+	}))
+}
+
+func TestFilesystemDriverSuiteShardedFullFSync(t *testing.T) {
+	testsuites.Driver(t, newDriverConstructorWithParameters(t, map[string]interface{}{
+		"shardingdepth": 2,
+		"fsync":         "full",
+	}))
+}
+
+func TestShardingDepth(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	dgst := strings.Repeat("0123456789abcdef", 4)
+
+	// the content written before sharding is read and listed along with
+	// the sharded content
+	unsharded := New(DriverParameters{RootDirectory: root, MaxThreads: defaultMaxThreads})
+	if err := unsharded.PutContent(ctx, "/blobs/sha256/01/"+dgst+"/data", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(DriverParameters{RootDirectory: root, MaxThreads: defaultMaxThreads, ShardingDepth: 2})
+	if content, err := d.GetContent(ctx, "/blobs/sha256/01/"+dgst+"/data"); err != nil || string(content) != "old" {
+		t.Fatalf("unexpected content %q of the unsharded path: %v", content, err)
+	}
+
+	other := strings.Repeat("0123456789abcdef", 3) + strings.Repeat("f", 16)
+	if err := d.PutContent(ctx, "/blobs/sha256/01/"+other+"/data", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(root, "blobs/sha256/01/~23/~45", other, "data")); err != nil {
+		t.Errorf("expected the content to be sharded: %v", err)
+	}
+	entries, err := d.List(ctx, "/blobs/sha256/01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(entries)
+	expected := []string{"/blobs/sha256/01/" + dgst, "/blobs/sha256/01/" + other}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries %v, expected %v", entries, expected)
+	}
+
+	if err := d.Move(ctx, "/blobs/sha256/01/"+dgst+"/data", "/blobs/sha256/01/"+dgst+"/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(root, "blobs/sha256/01/~23/~45", dgst, "moved")); err != nil {
+		t.Errorf("expected the moved content to be sharded: %v", err)
+	}
+	if err := d.Delete(ctx, "/blobs/sha256/01/"+dgst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, "/blobs/sha256/01/"+dgst); err == nil {
+		t.Error("expected the sharded and unsharded content to be deleted")
+	}
+}
+
+func TestSharedFilesystemWriterAtomic(t *testing.T) {
+	if !sharedFilesystemSupported {
+		t.Skip("shared filesystem mode is not supported on this platform")
+	}
+	ctx := context.Background()
+	d, err := newDriverConstructorWithParameters(t, map[string]interface{}{
+		"sharedfilesystem": true,
+	})()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const filename = "/a/file"
+	if err := d.PutContent(ctx, filename, []byte("old content")); err != nil {
+		t.Fatal(err)
+	}
+
+	fw, err := d.Writer(ctx, filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the content being written is neither visible nor listed
+	content, err := d.GetContent(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "old content" {
+		t.Fatalf("unexpected content while writing: %q", content)
+	}
+	entries, err := d.List(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, []string{filename}) {
+		t.Fatalf("unexpected entries while writing: %v", entries)
+	}
+
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content, err = d.GetContent(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "new" {
+		t.Fatalf("unexpected content after writing: %q", content)
+	}
+}
+
+func TestSharedFilesystemWaitsForAppends(t *testing.T) {
+	if !sharedFilesystemSupported {
+		t.Skip("shared filesystem mode is not supported on this platform")
+	}
+	ctx := context.Background()
+	d, err := newDriverConstructorWithParameters(t, map[string]interface{}{
+		"sharedfilesystem": true,
+	})()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		replace func(path string) error
+		target  string
+	}{
+		{
+			name: "PutContent",
+			replace: func(path string) error {
+				return d.PutContent(ctx, path, []byte("replaced"))
+			},
+		},
+		{
+			name: "Move",
+			replace: func(path string) error {
+				return d.Move(ctx, path, path+"-moved")
+			},
+			target: "-moved",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/uploads/" + tc.name
+			fw, err := d.Writer(ctx, path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- tc.replace(path)
+			}()
+
+			// the file is not replaced while the writer holds its lock
+			select {
+			case err := <-done:
+				t.Fatalf("replaced while appending: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			if _, err := fw.Write([]byte("appended")); err != nil {
+				t.Fatal(err)
+			}
+			if err := fw.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := fw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			want := "appended"
+			if tc.target == "" {
+				want = "replaced"
+			}
+			content, err := d.GetContent(ctx, path+tc.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != want {
+				t.Fatalf("unexpected content: %q != %q", content, want)
+			}
+		})
+	}
+}
+
 func BenchmarkFilesystemDriverSuite(b *testing.B) {
 	testsuites.BenchDriver(b, newDriverConstructor(b))
 }
@@ -38,9 +244,29 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{
 				RootDirectory: defaultRootDirectory,
 				MaxThreads:    defaultMaxThreads,
+				FSync:         fsyncFile,
 			},
 			pass: true,
 		},
+		{
+			params: map[string]interface{}{
+				"sharedfilesystem": "true",
+			},
+			expected: DriverParameters{
+				RootDirectory:    defaultRootDirectory,
+				MaxThreads:       defaultMaxThreads,
+				SharedFilesystem: sharedFilesystemSupported,
+				FSync:            fsyncFull,
+			},
+			pass: sharedFilesystemSupported,
+		},
+		{
+			params: map[string]interface{}{
+				"sharedfilesystem": "maybe",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
 		// Testing initiation with a string maxThreads which can't be parsed
 		{
 			params: map[string]interface{}{
@@ -56,6 +282,7 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{
 				RootDirectory: defaultRootDirectory,
 				MaxThreads:    uint64(100),
+				FSync:         fsyncFile,
 			},
 			pass: true,
 		},
@@ -66,6 +293,7 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{
 				RootDirectory: defaultRootDirectory,
 				MaxThreads:    uint64(100),
+				FSync:         fsyncFile,
 			},
 			pass: true,
 		},
@@ -77,9 +305,63 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{
 				RootDirectory: defaultRootDirectory,
 				MaxThreads:    minThreads,
+				FSync:         fsyncFile,
+			},
+			pass: true,
+		},
+		{
+			params: map[string]interface{}{
+				"shardingdepth": 2,
+				"fsync":         "Full",
+			},
+			expected: DriverParameters{
+				RootDirectory: defaultRootDirectory,
+				MaxThreads:    defaultMaxThreads,
+				ShardingDepth: 2,
+				FSync:         fsyncFull,
+			},
+			pass: true,
+		},
+		{
+			params: map[string]interface{}{
+				"fsync": "none",
+			},
+			expected: DriverParameters{
+				RootDirectory: defaultRootDirectory,
+				MaxThreads:    defaultMaxThreads,
+				FSync:         fsyncNone,
 			},
 			pass: true,
 		},
+		{
+			params: map[string]interface{}{
+				"shardingdepth": 4,
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
+		{
+			params: map[string]interface{}{
+				"shardingdepth": "deep",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
+		{
+			params: map[string]interface{}{
+				"fsync": "always",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
+		{
+			params: map[string]interface{}{
+				"sharedfilesystem": true,
+				"fsync":            "file",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
 	}
 
 	for _, item := range tests {
@@ -0,0 +1,31 @@
+package filesystem
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sharedFilesystemSupported reports whether the safe code paths for shared
+// filesystems are available on this platform.
+const sharedFilesystemSupported = true
+
+// lockFile takes an exclusive lock on the whole file, waiting for other
+// holders to release it. Open file description locks are used, rather than
+// classic POSIX locks, so that closing another descriptor of the same file
+// within the process does not release the lock. NFS clients forward them to
+// the server as byte-range locks, which makes them visible to the other
+// replicas. The lock is released when the file is closed.
+func lockFile(f *os.File) error {
+	lock := unix.Flock_t{
+		Type:   unix.F_WRLCK,
+		Whence: io.SeekStart,
+	}
+	for {
+		err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLKW, &lock)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
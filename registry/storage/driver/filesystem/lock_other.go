@@ -0,0 +1,16 @@
+//go:build !linux
+
+package filesystem
+
+import (
+	"errors"
+	"os"
+)
+
+// sharedFilesystemSupported reports whether the safe code paths for shared
+// filesystems are available on this platform.
+const sharedFilesystemSupported = false
+
+func lockFile(f *os.File) error {
+	return errors.New("file locking is not supported on this platform")
+}
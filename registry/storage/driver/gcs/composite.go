@@ -0,0 +1,146 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// maxComposeSources is the maximum number of objects a compose request
+// composes.
+const maxComposeSources = 32
+
+// partObject returns the object of part n of the composite upload, which
+// is hidden from listings as an upload session.
+func (w *writer) partObject(n int) *storage.ObjectHandle {
+	return w.driver.bucket.Object(fmt.Sprintf("%s.part%05d", w.object.ObjectName(), n))
+}
+
+// writePart uploads the full buffer as the next part of the composite
+// upload, concurrently with the parts being uploaded, up to the composite
+// concurrency. It returns the error of a part that failed to be uploaded.
+func (w *writer) writePart(ctx context.Context) error {
+	if w.partsSem == nil {
+		w.partsSem = make(chan struct{}, w.driver.compositeConcurrency)
+	}
+	w.partsSem <- struct{}{}
+
+	w.partsMu.Lock()
+	err := w.partsErr
+	w.partsMu.Unlock()
+	if err != nil {
+		<-w.partsSem
+		return err
+	}
+
+	part, content := w.partObject(w.parts), w.buffer[:w.buffSize]
+	w.parts++
+	w.offset += int64(w.buffSize)
+	w.buffer = make([]byte, w.driver.compositePartSize)
+	w.buffSize = 0
+
+	w.partsWG.Add(1)
+	go func() {
+		defer func() {
+			<-w.partsSem
+			w.partsWG.Done()
+		}()
+		err := retry(func() error {
+			return w.driver.putContent(ctx, part, content, uploadSessionContentType, nil)
+		})
+		if err != nil {
+			w.partsMu.Lock()
+			if w.partsErr == nil {
+				w.partsErr = err
+			}
+			w.partsMu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// waitParts waits for the parts being uploaded, and returns the error of a
+// part that failed to be uploaded.
+func (w *writer) waitParts() error {
+	w.partsWG.Wait()
+	return w.partsErr
+}
+
+// closeParts saves the number of parts uploaded and the buffered content
+// to the object of the composite upload, for the upload to be resumed.
+func (w *writer) closeParts() error {
+	if err := w.waitParts(); err != nil {
+		return err
+	}
+	metadata := map[string]string{
+		"Parts":  strconv.Itoa(w.parts),
+		"Offset": strconv.FormatInt(w.offset, 10),
+	}
+	return retry(func() error {
+		err := w.driver.putContent(w.ctx, w.object, w.buffer[0:w.buffSize], uploadSessionContentType, metadata)
+		if err != nil {
+			return err
+		}
+		w.size = w.offset + int64(w.buffSize)
+		return nil
+	})
+}
+
+// composeParts uploads the buffered content as the last part, composes the
+// parts into the object and deletes them. The composed object is encrypted
+// with the default key of the bucket, and with the configured key once it
+// is moved.
+func (w *writer) composeParts(ctx context.Context) error {
+	if w.buffSize > 0 {
+		part := w.partObject(w.parts)
+		err := retry(func() error {
+			return w.driver.putContent(ctx, part, w.buffer[0:w.buffSize], uploadSessionContentType, nil)
+		})
+		if err != nil {
+			return err
+		}
+		w.parts++
+		w.offset += int64(w.buffSize)
+		w.buffSize = 0
+	}
+
+	// the parts are composed in batches, each appended to the object
+	// composed of the previous batches
+	var sources []*storage.ObjectHandle
+	for n := 0; n < w.parts; {
+		sources = sources[:0]
+		if n > 0 {
+			sources = append(sources, w.object)
+		}
+		for ; n < w.parts && len(sources) < maxComposeSources; n++ {
+			sources = append(sources, w.partObject(n))
+		}
+		composer := w.object.ComposerFrom(sources...)
+		composer.ContentType = blobContentType
+		err := retry(func() error {
+			_, err := composer.Run(ctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.committed = true
+	w.size = w.offset
+
+	w.deleteParts(ctx)
+	return nil
+}
+
+// deleteParts deletes the parts of the composite upload. Parts that fail
+// to be deleted are deleted with the upload once it is purged.
+func (w *writer) deleteParts(ctx context.Context) {
+	for n := 0; n < w.parts; n++ {
+		if err := w.partObject(n).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			logrus.Infof("error deleting part %d of %v: %v", n, w.object.ObjectName(), err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// testObject is an object of the fake JSON API of newTestGCS.
+type testObject struct {
+	Name        string            `json:"name"`
+	Bucket      string            `json:"bucket"`
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Size        string            `json:"size"`
+
+	data []byte
+}
+
+// newTestGCS returns a client of a fake GCS, storing the objects of bucket
+// in objects, which supports the requests of composite uploads and copies.
+func newTestGCS(t *testing.T, bucket string, objects map[string]*testObject) *storage.Client {
+	var mu sync.Mutex
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		respond := func(o *testObject) {
+			o.Bucket = bucket
+			o.Size = strconv.Itoa(len(o.data))
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(o)
+		}
+		jsonPrefix := "/storage/v1/b/" + bucket + "/o/"
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/"+bucket+"/o":
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			var o testObject
+			for i := 0; i < 2; i++ {
+				p, err := mr.NextPart()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if i == 0 {
+					err = json.NewDecoder(p).Decode(&o)
+				} else {
+					o.data, err = io.ReadAll(p)
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			objects[o.Name] = &o
+			respond(&o)
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, jsonPrefix) && strings.HasSuffix(r.URL.Path, "/compose"):
+			var req struct {
+				SourceObjects []struct {
+					Name string `json:"name"`
+				} `json:"sourceObjects"`
+				Destination testObject `json:"destination"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			o := &req.Destination
+			o.Name = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, jsonPrefix), "/compose")
+			for _, src := range req.SourceObjects {
+				if objects[src.Name] == nil {
+					http.Error(w, "not found", http.StatusNotFound)
+					return
+				}
+				o.data = append(o.data, objects[src.Name].data...)
+			}
+			if len(req.SourceObjects) > maxComposeSources {
+				http.Error(w, "too many sources", http.StatusBadRequest)
+				return
+			}
+			objects[o.Name] = o
+			respond(o)
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, jsonPrefix) && strings.Contains(r.URL.Path, "/rewriteTo/b/"+bucket+"/o/"):
+			srcName, dstName, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, jsonPrefix), "/rewriteTo/b/"+bucket+"/o/")
+			src, ok := objects[srcName]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			o := &testObject{Name: dstName, ContentType: src.ContentType, data: src.data}
+			objects[dstName] = o
+			o.Bucket = bucket
+			o.Size = strconv.Itoa(len(o.data))
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"totalBytesRewritten": o.Size,
+				"objectSize":          o.Size,
+				"done":                true,
+				"resource":            o,
+			})
+		case strings.HasPrefix(r.URL.Path, jsonPrefix):
+			name := strings.TrimPrefix(r.URL.Path, jsonPrefix)
+			o, ok := objects[name]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodDelete {
+				delete(objects, name)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			respond(o)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/"+bucket+"/"):
+			o, ok := objects[strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", o.ContentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+			_, _ = w.Write(o.data)
+		default:
+			http.Error(w, "unsupported request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	gcs, err := storage.NewClient(context.Background(), option.WithEndpoint(s.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %v", err)
+	}
+	return gcs
+}
+
+func TestCompositeUpload(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]*testObject{}
+	d, err := New(ctx, driverParameters{
+		bucket:               "registry",
+		chunkSize:            4 * minChunkSize,
+		gcs:                  newTestGCS(t, "registry", objects),
+		maxConcurrency:       minConcurrency,
+		compositeUploads:     true,
+		compositePartSize:    minChunkSize,
+		compositeConcurrency: 2,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	contents := make([]byte, 40*minChunkSize+minChunkSize/2)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload is closed after some parts, and resumed
+	written := 2*minChunkSize + minChunkSize/2
+	w, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write(contents[:written]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+	if o := objects["upload"]; o == nil || o.Metadata["Parts"] != "2" || len(o.data) != minChunkSize/2 {
+		t.Fatalf("unexpected upload %+v", o)
+	}
+	if _, err := d.Stat(ctx, "/upload"); err == nil {
+		t.Error("expected the upload to be hidden until it is committed")
+	}
+
+	w, err = d.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatalf("unexpected error resuming writer: %v", err)
+	}
+	if w.Size() != int64(written) {
+		t.Errorf("unexpected size %d of the resumed upload, expected %d", w.Size(), written)
+	}
+	if _, err := w.Write(contents[written:]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if w.Size() != int64(len(contents)) {
+		t.Errorf("unexpected size %d, expected %d", w.Size(), len(contents))
+	}
+
+	o := objects["upload"]
+	if len(objects) != 1 || o.ContentType != blobContentType || !bytes.Equal(o.data, contents) {
+		t.Errorf("unexpected objects %d, expected the parts to be composed into the upload", len(objects))
+	}
+	if got, err := d.GetContent(ctx, "/upload"); err != nil || !bytes.Equal(got, contents) {
+		t.Errorf("unexpected content of the upload: %v", err)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -54,10 +55,17 @@ const (
 	blobContentType          = "application/octet-stream"
 
 	maxTries = 5
+
+	defaultCompositePartSize    = 32 * 1024 * 1024
+	defaultCompositeConcurrency = 4
 )
 
 var rangeHeader = regexp.MustCompile(`^bytes=([0-9])+-([0-9]+)$`)
 
+// kmsKeyNameRegexp matches the names of Cloud KMS keys, whose primary
+// version objects are encrypted with.
+var kmsKeyNameRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
 var _ storagedriver.FileWriter = &writer{}
 
 // driverParameters is a struct that encapsulates all of the driver parameters after all values have been set
@@ -70,6 +78,17 @@ type driverParameters struct {
 	chunkSize     int
 	gcs           *storage.Client
 
+	// kmsKeyName is the Cloud KMS key objects are encrypted with, instead
+	// of the default key of the bucket.
+	kmsKeyName string
+
+	// compositeUploads uploads the parts of large blobs concurrently,
+	// and composes them into the blob on commit, instead of uploading the
+	// chunks of blobs in sequence.
+	compositeUploads     bool
+	compositePartSize    int
+	compositeConcurrency int
+
 	// maxConcurrency limits the number of concurrent driver operations
 	// to GCS, which ultimately increases reliability of many simultaneous
 	// pushes by ensuring we aren't DoSing our own server with many
@@ -90,6 +109,7 @@ func (factory *gcsDriverFactory) Create(ctx context.Context, parameters map[stri
 }
 
 var _ storagedriver.StorageDriver = &driver{}
+var _ storagedriver.Transferer = &driver{}
 
 // driver is a storagedriver.StorageDriver implementation backed by GCS
 // Objects are stored at absolute keys in the provided bucket.
@@ -100,12 +120,18 @@ type driver struct {
 	privateKey    []byte
 	rootDirectory string
 	chunkSize     int
+	kmsKeyName    string
+
+	compositeUploads     bool
+	compositePartSize    int
+	compositeConcurrency int
 }
 
 // Wrapper wraps `driver` with a throttler, ensuring that no more than N
 // GCS actions can occur concurrently. The default limit is 75.
 type Wrapper struct {
 	baseEmbed
+	driver *driver
 }
 
 type baseEmbed struct {
@@ -161,11 +187,10 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (sto
 		if err != nil {
 			return nil, err
 		}
-		jwtConf, err = google.JWTConfigFromJSON(jsonKey, storage.ScopeFullControl)
+		ts, jwtConf, err = credentialsFromJSON(ctx, jsonKey)
 		if err != nil {
 			return nil, err
 		}
-		ts = jwtConf.TokenSource(ctx)
 		options = append(options, option.WithCredentialsFile(fmt.Sprint(keyfile)))
 	} else if credentials, ok := parameters["credentials"]; ok {
 		credentialMap, ok := credentials.(map[interface{}]interface{})
@@ -173,13 +198,11 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (sto
 			return nil, fmt.Errorf("The credentials were not specified in the correct format")
 		}
 
-		stringMap := map[string]interface{}{}
-		for k, v := range credentialMap {
-			key, ok := k.(string)
-			if !ok {
-				return nil, fmt.Errorf("One of the credential keys was not a string: %s", fmt.Sprint(k))
-			}
-			stringMap[key] = v
+		// the credential source of workload identity federation is a
+		// nested map
+		stringMap, err := stringKeys(credentialMap)
+		if err != nil {
+			return nil, err
 		}
 
 		data, err := json.Marshal(stringMap)
@@ -187,11 +210,10 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (sto
 			return nil, fmt.Errorf("Failed to marshal gcs credentials to json")
 		}
 
-		jwtConf, err = google.JWTConfigFromJSON(data, storage.ScopeFullControl)
+		ts, jwtConf, err = credentialsFromJSON(ctx, data)
 		if err != nil {
 			return nil, err
 		}
-		ts = jwtConf.TokenSource(ctx)
 		options = append(options, option.WithCredentialsJSON(data))
 	} else {
 		var err error
@@ -204,6 +226,29 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (sto
 		}
 	}
 
+	kmsKeyName := ""
+	if key, ok := parameters["kmskeyname"]; ok && key != nil {
+		kmsKeyName = fmt.Sprint(key)
+		if !kmsKeyNameRegexp.MatchString(kmsKeyName) {
+			return nil, fmt.Errorf("kmskeyname %q is not a Cloud KMS key name of the form projects/<project>/locations/<location>/keyRings/<keyring>/cryptoKeys/<key>", kmsKeyName)
+		}
+	}
+
+	kmsBucketDefault := false
+	switch v := parameters["kmsbucketdefault"].(type) {
+	case nil:
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("the kmsbucketdefault parameter should be a boolean")
+		}
+		kmsBucketDefault = b
+	case bool:
+		kmsBucketDefault = v
+	default:
+		return nil, fmt.Errorf("the kmsbucketdefault parameter should be a boolean")
+	}
+
 	if userAgent, ok := parameters["useragent"]; ok {
 		if ua, ok := userAgent.(string); ok && ua != "" {
 			options = append(options, option.WithUserAgent(ua))
@@ -215,11 +260,57 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (sto
 		return nil, err
 	}
 
+	compositeUploads := false
+	switch v := parameters["parallelcompositeuploads"].(type) {
+	case nil:
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("the parallelcompositeuploads parameter should be a boolean")
+		}
+		compositeUploads = b
+	case bool:
+		compositeUploads = v
+	default:
+		return nil, fmt.Errorf("the parallelcompositeuploads parameter should be a boolean")
+	}
+
+	compositePartSize := defaultCompositePartSize
+	if param := parameters["compositepartsize"]; param != nil {
+		if _, err := fmt.Sscanf(fmt.Sprint(param), "%d", &compositePartSize); err != nil {
+			return nil, fmt.Errorf("compositepartsize must be an integer, %v invalid", param)
+		}
+		if compositePartSize < minChunkSize {
+			return nil, fmt.Errorf("compositepartsize %d must be larger than or equal to %d", compositePartSize, minChunkSize)
+		}
+	}
+
+	compositeConcurrency, err := base.GetLimitFromParameter(parameters["compositeconcurrency"], 1, defaultCompositeConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("compositeconcurrency config error: %s", err)
+	}
+
 	maxConcurrency, err := base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
 	if err != nil {
 		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
 	}
 
+	if kmsBucketDefault {
+		// objects are encrypted with the default key of the bucket, which
+		// must be the configured key if any
+		attrs, err := gcs.Bucket(fmt.Sprint(bucket)).Attrs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the default encryption key of bucket %s: %v", bucket, err)
+		}
+		if attrs.Encryption == nil || attrs.Encryption.DefaultKMSKeyName == "" {
+			return nil, fmt.Errorf("bucket %s has no default encryption key", bucket)
+		}
+		if kmsKeyName != "" && attrs.Encryption.DefaultKMSKeyName != kmsKeyName {
+			return nil, fmt.Errorf("the default encryption key of bucket %s is %s, not %s", bucket, attrs.Encryption.DefaultKMSKeyName, kmsKeyName)
+		}
+		kmsKeyName = ""
+	}
+
 	params := driverParameters{
 		bucket:         fmt.Sprint(bucket),
 		rootDirectory:  fmt.Sprint(rootDirectory),
@@ -229,6 +320,11 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (sto
 		chunkSize:      chunkSize,
 		maxConcurrency: maxConcurrency,
 		gcs:            gcs,
+		kmsKeyName:     kmsKeyName,
+
+		compositeUploads:     compositeUploads,
+		compositePartSize:    compositePartSize,
+		compositeConcurrency: int(compositeConcurrency),
 	}
 
 	return New(ctx, params)
@@ -243,6 +339,12 @@ func New(ctx context.Context, params driverParameters) (storagedriver.StorageDri
 	if params.chunkSize <= 0 || params.chunkSize%minChunkSize != 0 {
 		return nil, fmt.Errorf("Invalid chunksize: %d is not a positive multiple of %d", params.chunkSize, minChunkSize)
 	}
+	if params.compositePartSize == 0 {
+		params.compositePartSize = defaultCompositePartSize
+	}
+	if params.compositeConcurrency == 0 {
+		params.compositeConcurrency = defaultCompositeConcurrency
+	}
 	d := &driver{
 		bucket:        params.gcs.Bucket(params.bucket),
 		rootDirectory: rootDirectory,
@@ -250,6 +352,11 @@ func New(ctx context.Context, params driverParameters) (storagedriver.StorageDri
 		privateKey:    params.privateKey,
 		client:        params.client,
 		chunkSize:     params.chunkSize,
+		kmsKeyName:    params.kmsKeyName,
+
+		compositeUploads:     params.compositeUploads,
+		compositePartSize:    params.compositePartSize,
+		compositeConcurrency: params.compositeConcurrency,
 	}
 
 	return &Wrapper{
@@ -258,6 +365,7 @@ func New(ctx context.Context, params driverParameters) (storagedriver.StorageDri
 				StorageDriver: base.NewRegulator(d, params.maxConcurrency),
 			},
 		},
+		driver: d,
 	}, nil
 }
 
@@ -337,10 +445,14 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 // at the location designated by "path" after the call to Commit.
 func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
 	w := &writer{
-		ctx:    ctx,
-		driver: d,
-		object: d.bucket.Object(d.pathToKey(path)),
-		buffer: make([]byte, d.chunkSize),
+		ctx:       ctx,
+		driver:    d,
+		object:    d.bucket.Object(d.pathToKey(path)),
+		buffer:    make([]byte, d.chunkSize),
+		composite: d.compositeUploads,
+	}
+	if w.composite {
+		w.buffer = make([]byte, d.compositePartSize)
 	}
 
 	if appendMode {
@@ -364,6 +476,14 @@ type writer struct {
 	sessionURI string
 	buffer     []byte
 	buffSize   int
+
+	// the parts of composite uploads
+	composite bool
+	parts     int
+	partsWG   sync.WaitGroup
+	partsSem  chan struct{}
+	partsMu   sync.Mutex
+	partsErr  error
 }
 
 // Cancel removes any written content from this FileWriter.
@@ -371,6 +491,10 @@ func (w *writer) Cancel(ctx context.Context) error {
 	w.closed = true
 	w.cancelled = true
 
+	if w.composite {
+		_ = w.waitParts()
+		w.deleteParts(ctx)
+	}
 	err := w.object.Delete(ctx)
 	if err != nil {
 		if err == storage.ErrObjectNotExist {
@@ -386,6 +510,10 @@ func (w *writer) Close() error {
 	}
 	w.closed = true
 
+	if w.composite {
+		return w.closeParts()
+	}
+
 	err := w.writeChunk(w.ctx)
 	if err != nil {
 		return err
@@ -421,6 +549,7 @@ func (d *driver) putContent(ctx context.Context, obj *storage.ObjectHandle, cont
 	wc.Metadata = metadata
 	wc.ContentType = contentType
 	wc.ChunkSize = d.chunkSize
+	wc.KMSKeyName = d.kmsKeyName
 
 	if _, err := bytes.NewReader(content).WriteTo(wc); err != nil {
 		return err
@@ -437,6 +566,15 @@ func (w *writer) Commit(ctx context.Context) error {
 	}
 	w.closed = true
 
+	if w.composite {
+		if err := w.waitParts(); err != nil {
+			return err
+		}
+		if w.parts > 0 {
+			return w.composeParts(ctx)
+		}
+	}
+
 	// no session started yet just perform a simple upload
 	if w.sessionURI == "" {
 		err := retry(func() error {
@@ -515,7 +653,11 @@ func (w *writer) Write(p []byte) (int, error) {
 		n := copy(w.buffer[w.buffSize:], p[written:])
 		w.buffSize += n
 		if w.buffSize == cap(w.buffer) {
-			err = w.writeChunk(w.ctx)
+			if w.composite {
+				err = w.writePart(w.ctx)
+			} else {
+				err = w.writeChunk(w.ctx)
+			}
 			if err != nil {
 				break
 			}
@@ -546,6 +688,21 @@ func (w *writer) init(ctx context.Context) error {
 		return storagedriver.PathNotFoundError{Path: w.object.ObjectName()}
 	}
 
+	// composite uploads are resumed as such whether or not they are
+	// enabled, and the other uploads resume their upload session
+	if parts, ok := attrs.Metadata["Parts"]; ok {
+		w.parts, err = strconv.Atoi(parts)
+		if err != nil {
+			return err
+		}
+		w.composite = true
+		// the part size may have been lowered since the upload was closed
+		w.buffer = make([]byte, max(w.driver.compositePartSize, int(attrs.Size)))
+	} else if w.composite {
+		w.composite = false
+		w.buffer = make([]byte, w.driver.chunkSize)
+	}
+
 	offset := int64(0)
 	// NOTE(milosgajdos): if a client creates an empty blob, then
 	// closes the stream and then attempts to append to it, the offset
@@ -575,7 +732,7 @@ func (w *writer) init(ctx context.Context) error {
 
 	// NOTE(milosgajdos): if a client closes an existing session and then attempts
 	// to append to an existing blob, the session will be empty; recreate it
-	if w.sessionURI = attrs.Metadata["Session-URI"]; w.sessionURI == "" {
+	if w.sessionURI = attrs.Metadata["Session-URI"]; w.sessionURI == "" && !w.composite {
 		w.sessionURI, err = w.newSession()
 		if err != nil {
 			return err
@@ -697,9 +854,36 @@ func (d *driver) List(ctx context.Context, path string) ([]string, error) {
 // Move moves an object stored at sourcePath to destPath, removing the
 // original object.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
-	srcKey, dstKey := d.pathToKey(sourcePath), d.pathToKey(destPath)
-	src := d.bucket.Object(srcKey)
-	_, err := d.bucket.Object(dstKey).CopierFrom(src).Run(ctx)
+	if err := d.copyFrom(ctx, d, sourcePath, destPath); err != nil {
+		return err
+	}
+	err := d.bucket.Object(d.pathToKey(sourcePath)).Delete(ctx)
+	// if deleting the file fails, log the error, but do not fail; the file was successfully copied,
+	// and the original should eventually be cleaned when purging the uploads folder.
+	if err != nil {
+		logrus.Infof("error deleting %v: %v", sourcePath, err)
+	}
+	return nil
+}
+
+// Transfer copies the object stored at sourcePath by the source driver to
+// destPath server-side, if the source driver is a GCS driver. The credentials
+// of the driver must allow reading the object.
+func (d *driver) Transfer(ctx context.Context, source storagedriver.StorageDriver, sourcePath, destPath string) error {
+	src, ok := source.(*Wrapper)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+	return d.copyFrom(ctx, src.driver, sourcePath, destPath)
+}
+
+// copyFrom copies the object stored at sourcePath by the src driver to
+// destPath.
+func (d *driver) copyFrom(ctx context.Context, src *driver, sourcePath, destPath string) error {
+	srcKey, dstKey := src.pathToKey(sourcePath), d.pathToKey(destPath)
+	copier := d.bucket.Object(dstKey).CopierFrom(src.bucket.Object(srcKey))
+	copier.DestinationKMSKeyName = d.kmsKeyName
+	_, err := copier.Run(ctx)
 	if err != nil {
 		var status *googleapi.Error
 		if errors.As(err, &status) {
@@ -707,13 +891,7 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 				return storagedriver.PathNotFoundError{Path: srcKey}
 			}
 		}
-		return fmt.Errorf("move %q to %q: %v", srcKey, dstKey, err)
-	}
-	err = src.Delete(ctx)
-	// if deleting the file fails, log the error, but do not fail; the file was successfully copied,
-	// and the original should eventually be cleaned when purging the uploads folder.
-	if err != nil {
-		logrus.Infof("error deleting %v: %v", sourcePath, err)
+		return fmt.Errorf("copy %q to %q: %v", srcKey, dstKey, err)
 	}
 	return nil
 }
@@ -793,7 +971,7 @@ func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
 		GoogleAccessID: d.email,
 		PrivateKey:     d.privateKey,
 		Method:         r.Method,
-		Expires:        time.Now().Add(20 * time.Minute),
+		Expires:        time.Now().Add(storagedriver.RedirectExpiry(r)),
 	}
 	return d.bucket.SignedURL(d.pathToKey(path), opts)
 }
@@ -811,6 +989,9 @@ func (w *writer) newSession() (uri string, err error) {
 		Path:     fmt.Sprintf("/upload/storage/v1/b/%v/o", w.object.BucketName()),
 		RawQuery: fmt.Sprintf("uploadType=resumable&name=%v", w.object.ObjectName()),
 	}
+	if w.driver.kmsKeyName != "" {
+		u.RawQuery += "&kmsKeyName=" + url.QueryEscape(w.driver.kmsKeyName)
+	}
 	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, u.String(), nil)
 	if err != nil {
 		return "", err
@@ -879,6 +1060,76 @@ func (w *writer) putChunk(ctx context.Context, sessionURI string, chunk []byte,
 	return bytesPut, err
 }
 
+// credentialsFromJSON returns the token source of the JSON credentials of a
+// service account, or of workload identity federation, along with the JWT
+// config that signs the redirect URLs of service account keys.
+func credentialsFromJSON(ctx context.Context, data []byte) (oauth2.TokenSource, *jwt.Config, error) {
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, nil, err
+	}
+	if f.Type == "external_account" {
+		// redirect URLs are signed with the IAM credentials API, as the
+		// federated credentials have no private key
+		creds, err := google.CredentialsFromJSON(ctx, data, storage.ScopeFullControl)
+		if err != nil {
+			return nil, nil, err
+		}
+		return creds.TokenSource, new(jwt.Config), nil
+	}
+
+	jwtConf, err := google.JWTConfigFromJSON(data, storage.ScopeFullControl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jwtConf.TokenSource(ctx), jwtConf, nil
+}
+
+// stringKeys converts the maps of v, as parsed from the configuration, to
+// maps with string keys that can be marshaled to JSON.
+func stringKeys(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, v := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("One of the credential keys was not a string: %s", fmt.Sprint(k))
+			}
+			value, err := stringKeys(v)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, v := range v {
+			value, err := stringKeys(v)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = value
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, v := range v {
+			value, err := stringKeys(v)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = value
+		}
+		return s, nil
+	default:
+		return v, nil
+	}
+}
+
 func (d *driver) pathToKey(path string) string {
 	return strings.TrimSpace(strings.TrimRight(d.rootDirectory+strings.TrimLeft(path, "/"), "/"))
 }
@@ -1,14 +1,19 @@
 package gcs
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"cloud.google.com/go/storage"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -306,3 +311,116 @@ func TestMoveDirectory(t *testing.T) {
 		t.Fatal("Moving directory /parent/dir /parent/other should have return a non-nil error")
 	}
 }
+
+func TestTransfer(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]*testObject{}
+	gcs := newTestGCS(t, "registry", objects)
+	newDriver := func(rootDirectory string) storagedriver.StorageDriver {
+		d, err := New(ctx, driverParameters{
+			bucket:         "registry",
+			rootDirectory:  rootDirectory,
+			chunkSize:      minChunkSize,
+			gcs:            gcs,
+			maxConcurrency: minConcurrency,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error creating driver: %v", err)
+		}
+		return d
+	}
+	source, dest := newDriver("source"), newDriver("dest")
+
+	contents := []byte("contents")
+	if err := source.PutContent(ctx, "/blob", contents); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	if err := storagedriver.Transfer(ctx, source, "/blob", dest, "/copy"); err != nil {
+		t.Fatalf("unexpected error transferring: %v", err)
+	}
+	if o := objects["dest/copy"]; o == nil || !bytes.Equal(o.data, contents) {
+		t.Fatalf("unexpected transferred object %+v", o)
+	}
+	if _, ok := objects["source/blob"]; !ok {
+		t.Error("expected the source of the transfer to be kept")
+	}
+
+	err := dest.(storagedriver.Transferer).Transfer(ctx, source, "/notfound", "/copy")
+	if !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Errorf("expected a path not found error, got %v", err)
+	}
+	err = dest.(storagedriver.Transferer).Transfer(ctx, inmemory.New(), "/blob", "/copy")
+	if !errors.As(err, &storagedriver.ErrUnsupportedMethod{}) {
+		t.Errorf("expected an unsupported method error transferring from another driver, got %v", err)
+	}
+}
+
+func TestWorkloadIdentityFederation(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := map[interface{}]interface{}{
+		"type":               "external_account",
+		"audience":           "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          "https://sts.googleapis.com/v1/token",
+		"credential_source": map[interface{}]interface{}{
+			"file": tokenFile,
+		},
+	}
+	_, err := FromParameters(context.Background(), map[string]interface{}{
+		"bucket":      "registry",
+		"credentials": credentials,
+		"kmskeyname":  "projects/p/locations/global/keyRings/r/cryptoKeys/k",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	stringMap, err := stringKeys(credentials)
+	if err != nil {
+		t.Fatalf("unexpected error converting credentials: %v", err)
+	}
+	data, err := json.Marshal(stringMap)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling credentials: %v", err)
+	}
+	ts, jwtConf, err := credentialsFromJSON(context.Background(), data)
+	if err != nil {
+		t.Fatalf("unexpected error parsing credentials: %v", err)
+	}
+	if ts == nil || jwtConf.Email != "" || jwtConf.PrivateKey != nil {
+		t.Errorf("unexpected credentials %v %+v", ts, jwtConf)
+	}
+}
+
+func TestKMSParameters(t *testing.T) {
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"kmskeyname": "k"}, `kmskeyname "k" is not a Cloud KMS key name of the form projects/<project>/locations/<location>/keyRings/<keyring>/cryptoKeys/<key>`},
+		{map[string]interface{}{"kmskeyname": "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"}, `kmskeyname "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1" is not a Cloud KMS key name of the form projects/<project>/locations/<location>/keyRings/<keyring>/cryptoKeys/<key>`},
+		{map[string]interface{}{"kmsbucketdefault": "maybe"}, "the kmsbucketdefault parameter should be a boolean"},
+		{map[string]interface{}{"kmsbucketdefault": 1}, "the kmsbucketdefault parameter should be a boolean"},
+	} {
+		params := map[string]interface{}{
+			"bucket": "registry",
+			"credentials": map[interface{}]interface{}{
+				"type":               "external_account",
+				"audience":           "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+				"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+				"token_url":          "https://sts.googleapis.com/v1/token",
+				"credential_source":  map[interface{}]interface{}{"file": "/dev/null"},
+			},
+		}
+		for k, v := range tc.params {
+			params[k] = v
+		}
+		if _, err := FromParameters(context.Background(), params); err == nil || err.Error() != tc.err {
+			t.Errorf("%v: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+}
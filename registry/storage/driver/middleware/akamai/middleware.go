@@ -0,0 +1,157 @@
+// Package middleware - akamai wrapper for storage libs
+//
+// The middleware redirects clients to Akamai, fronting the storage backend,
+// with URLs carrying an EdgeAuth token, version 2.0, which the property
+// validates before serving content.
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// init registers the akamai redirect backend.
+func init() {
+	if err := storagemiddleware.Register("akamai", newAkamaiStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register akamai middleware: %v", err)
+	}
+}
+
+// akamaiStorageMiddleware redirects clients to URLs of Akamai signed with an
+// EdgeAuth token, in the query parameter tokenName. The token is made of the
+// fields exp=EXPIRATION~hmac=HMAC, where HMAC is the hex encoded HMAC of
+// exp=EXPIRATION~url=PATH, keyed with the key of the property.
+type akamaiStorageMiddleware struct {
+	storagedriver.StorageDriver
+	baseURL   *url.URL
+	key       []byte
+	algorithm func() hash.Hash
+	duration  time.Duration
+	tokenName string
+	now       func() time.Time
+}
+
+var _ storagedriver.StorageDriver = &akamaiStorageMiddleware{}
+
+// newAkamaiStorageMiddleware constructs and returns a new Akamai
+// StorageDriver.
+//
+// Required options:
+//
+//   - baseurl
+//   - key: the hex encoded key of the property
+//
+// Optional options:
+//
+//   - duration: the duration tokens are valid for, 20m by default
+//   - algorithm: sha256 (the default), sha1 or md5
+//   - tokenname: the query parameter of the token, __token__ by default
+func newAkamaiStorageMiddleware(ctx context.Context, storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	m := &akamaiStorageMiddleware{
+		StorageDriver: storageDriver,
+		algorithm:     sha256.New,
+		duration:      20 * time.Minute,
+		tokenName:     "__token__",
+		now:           time.Now,
+	}
+
+	base, ok := options["baseurl"]
+	if !ok {
+		return nil, fmt.Errorf("no baseurl provided")
+	}
+	baseURL, ok := base.(string)
+	if !ok {
+		return nil, fmt.Errorf("baseurl must be a string")
+	}
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid baseurl: %v", err)
+	}
+	m.baseURL = u
+
+	k, ok := options["key"]
+	if !ok {
+		return nil, fmt.Errorf("no key provided")
+	}
+	key, ok := k.(string)
+	if !ok {
+		return nil, fmt.Errorf("key must be a string")
+	}
+	if m.key, err = hex.DecodeString(key); err != nil || len(m.key) == 0 {
+		return nil, fmt.Errorf("key must be hex encoded")
+	}
+
+	if d, ok := options["duration"]; ok {
+		switch d := d.(type) {
+		case time.Duration:
+			m.duration = d
+		case string:
+			dur, err := time.ParseDuration(d)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration: %s", err)
+			}
+			m.duration = dur
+		}
+	}
+
+	if a, ok := options["algorithm"]; ok {
+		algorithm, ok := a.(string)
+		if !ok {
+			return nil, fmt.Errorf("algorithm must be a string")
+		}
+		switch strings.ToLower(algorithm) {
+		case "sha256":
+			m.algorithm = sha256.New
+		case "sha1":
+			m.algorithm = sha1.New
+		case "md5":
+			m.algorithm = md5.New
+		default:
+			return nil, fmt.Errorf("algorithm only allows the following values: sha256|sha1|md5")
+		}
+	}
+
+	if n, ok := options["tokenname"]; ok {
+		if m.tokenName, ok = n.(string); !ok || m.tokenName == "" {
+			return nil, fmt.Errorf("tokenname must be a non empty string")
+		}
+	}
+
+	return m, nil
+}
+
+// RedirectURL returns a URL of Akamai for the path, with a token valid for
+// the duration of the middleware.
+func (lh *akamaiStorageMiddleware) RedirectURL(_ *http.Request, urlPath string) (string, error) {
+	u := *lh.baseURL
+	u.Path = path.Join("/", u.Path, urlPath)
+
+	token := "exp=" + strconv.FormatInt(lh.now().Add(lh.duration).Unix(), 10)
+	mac := hmac.New(lh.algorithm, lh.key)
+	mac.Write([]byte(token + "~url=" + u.Path))
+	token += "~hmac=" + hex.EncodeToString(mac.Sum(nil))
+
+	query := u.Query()
+	query.Set(lh.tokenName, token)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
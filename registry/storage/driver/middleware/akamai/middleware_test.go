@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirectURL(t *testing.T) {
+	m, err := newAkamaiStorageMiddleware(context.Background(), nil, map[string]interface{}{
+		"baseurl":  "registry.akamaized.net/prefix",
+		"key":      "0123456789abcdef",
+		"duration": "5m",
+	})
+	require.NoError(t, err)
+	m.(*akamaiStorageMiddleware).now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	redirectURL, err := m.RedirectURL(nil, "/docker/registry/v2/blobs/sha256/ab/abcd/data")
+	require.NoError(t, err)
+	u, err := url.Parse(redirectURL)
+	require.NoError(t, err)
+	require.Equal(t, "https", u.Scheme)
+	require.Equal(t, "registry.akamaized.net", u.Host)
+	require.Equal(t, "/prefix/docker/registry/v2/blobs/sha256/ab/abcd/data", u.Path)
+	// HMAC-SHA256 of exp=1700000300~url=/prefix/docker/registry/v2/blobs/sha256/ab/abcd/data
+	require.Equal(t, "exp=1700000300~hmac=eda0d1fc2f88481b6997659078fcd7c9fcc7fbdcc49fabfc6e2bb1da204de718", u.Query().Get("__token__"))
+}
+
+func TestTokenName(t *testing.T) {
+	m, err := newAkamaiStorageMiddleware(context.Background(), nil, map[string]interface{}{
+		"baseurl":   "https://registry.akamaized.net",
+		"key":       "0123456789abcdef",
+		"algorithm": "SHA1",
+		"tokenname": "hdnts",
+	})
+	require.NoError(t, err)
+
+	redirectURL, err := m.RedirectURL(nil, "/blob/data")
+	require.NoError(t, err)
+	u, err := url.Parse(redirectURL)
+	require.NoError(t, err)
+	require.Regexp(t, `^exp=[0-9]+~hmac=[0-9a-f]{40}$`, u.Query().Get("hdnts"))
+}
+
+func TestOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"key": "0123456789abcdef"},
+		{"baseurl": "https://registry.akamaized.net"},
+		{"baseurl": "https://registry.akamaized.net", "key": "not hex"},
+		{"baseurl": "https://registry.akamaized.net", "key": "0123456789abcdef", "duration": "soon"},
+		{"baseurl": "https://registry.akamaized.net", "key": "0123456789abcdef", "algorithm": "sha512"},
+		{"baseurl": "https://registry.akamaized.net", "key": "0123456789abcdef", "tokenname": ""},
+	} {
+		_, err := newAkamaiStorageMiddleware(context.Background(), nil, options)
+		require.Error(t, err, options)
+	}
+}
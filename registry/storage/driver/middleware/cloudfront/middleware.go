@@ -7,14 +7,17 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/internal/requestutil"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
 	"github.com/sirupsen/logrus"
@@ -36,9 +39,19 @@ type cloudFrontStorageMiddleware struct {
 	urlSigner *sign.URLSigner
 	baseURL   string
 	duration  time.Duration
+	// cookieSigner is set when signed cookies are issued instead of signed
+	// URLs.
+	cookieSigner   *sign.CookieSigner
+	policyResource string
+	policySourceIP string
+	trimKeyPrefix  string
+	keyPrefix      string
 }
 
-var _ storagedriver.StorageDriver = &cloudFrontStorageMiddleware{}
+var (
+	_ storagedriver.StorageDriver   = &cloudFrontStorageMiddleware{}
+	_ storagedriver.RedirectCookier = &cloudFrontStorageMiddleware{}
+)
 
 // newCloudFrontLayerHandler constructs and returns a new CloudFront
 // LayerHandler implementation.
@@ -57,6 +70,15 @@ var _ storagedriver.StorageDriver = &cloudFrontStorageMiddleware{}
 //     default value. "aws", only aws IP goes to S3 directly. "awsregion", only
 //     regions listed in awsregion options goes to S3 directly
 //   - awsregion: a comma separated string of AWS regions.
+//   - signedcookies: issue signed cookies instead of signed URLs
+//   - cookiedomain
+//   - cookiepath
+//   - policyresource: the resource of a custom policy, which may contain
+//     wildcards, such as "https://d111111abcdef8.cloudfront.net/blobs/*"
+//   - policysourceip: the IP range of a custom policy, in CIDR notation, or
+//     "client" for the IP address of the client
+//   - trimkeyprefix: a prefix trimmed from the S3 keys
+//   - keyprefix: a prefix prepended to the S3 keys
 func newCloudFrontStorageMiddleware(ctx context.Context, storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
 	// parse baseurl
 	base, ok := options["baseurl"]
@@ -195,13 +217,77 @@ func newCloudFrontStorageMiddleware(ctx context.Context, storageDriver storagedr
 		}
 	}
 
-	return &cloudFrontStorageMiddleware{
+	lh := &cloudFrontStorageMiddleware{
 		StorageDriver: storageDriver,
 		urlSigner:     urlSigner,
 		baseURL:       baseURL,
 		duration:      duration,
 		awsIPs:        awsIPs,
-	}, nil
+	}
+
+	// parse signedcookies, cookiedomain and cookiepath
+	var signedCookies bool
+	switch sc := options["signedcookies"].(type) {
+	case bool:
+		signedCookies = sc
+	case string:
+		if signedCookies, err = strconv.ParseBool(sc); err != nil {
+			return nil, fmt.Errorf("signedcookies must be a boolean")
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("signedcookies must be a boolean")
+	}
+	if signedCookies {
+		cookieOptions := sign.CookieOptions{
+			Path:   "/",
+			Secure: strings.HasPrefix(baseURL, "https://"),
+		}
+		if d, ok := options["cookiedomain"]; ok {
+			if cookieOptions.Domain, ok = d.(string); !ok {
+				return nil, fmt.Errorf("cookiedomain must be a string")
+			}
+		}
+		if p, ok := options["cookiepath"]; ok {
+			if cookieOptions.Path, ok = p.(string); !ok {
+				return nil, fmt.Errorf("cookiepath must be a string")
+			}
+		}
+		lh.cookieSigner = sign.NewCookieSigner(keypairID, privateKey, func(o *sign.CookieOptions) {
+			*o = cookieOptions
+		})
+	}
+
+	// parse policyresource and policysourceip
+	if r, ok := options["policyresource"]; ok {
+		if lh.policyResource, ok = r.(string); !ok {
+			return nil, fmt.Errorf("policyresource must be a string")
+		}
+	}
+	if i, ok := options["policysourceip"]; ok {
+		if lh.policySourceIP, ok = i.(string); !ok {
+			return nil, fmt.Errorf("policysourceip must be a string")
+		}
+		if lh.policySourceIP != "client" {
+			if _, _, err := net.ParseCIDR(lh.policySourceIP); err != nil {
+				return nil, fmt.Errorf("policysourceip must be an IP range in CIDR notation or client: %v", err)
+			}
+		}
+	}
+
+	// parse trimkeyprefix and keyprefix
+	if p, ok := options["trimkeyprefix"]; ok {
+		if lh.trimKeyPrefix, ok = p.(string); !ok {
+			return nil, fmt.Errorf("trimkeyprefix must be a string")
+		}
+	}
+	if p, ok := options["keyprefix"]; ok {
+		if lh.keyPrefix, ok = p.(string); !ok {
+			return nil, fmt.Errorf("keyprefix must be a string")
+		}
+	}
+
+	return lh, nil
 }
 
 // S3BucketKeyer is any type that is capable of returning the S3 bucket key
@@ -224,10 +310,76 @@ func (lh *cloudFrontStorageMiddleware) RedirectURL(r *http.Request, path string)
 		return lh.StorageDriver.RedirectURL(r, path)
 	}
 
+	cfURL := lh.resourceURL(keyer, path)
+	// the URL is authorized by the cookies of RedirectCookies.
+	if lh.cookieSigner != nil {
+		return cfURL, nil
+	}
+
 	// Get signed cloudfront url.
-	cfURL, err := lh.urlSigner.Sign(lh.baseURL+keyer.S3BucketKey(path), time.Now().Add(lh.duration))
+	policy, custom, err := lh.policy(r, cfURL)
 	if err != nil {
 		return "", err
 	}
-	return cfURL, nil
+	if custom {
+		return lh.urlSigner.SignWithPolicy(cfURL, policy)
+	}
+	return lh.urlSigner.Sign(cfURL, time.Now().Add(lh.duration))
+}
+
+// RedirectCookies returns the signed cookies authorizing the URL returned by
+// RedirectURL, when signed cookies are issued.
+func (lh *cloudFrontStorageMiddleware) RedirectCookies(r *http.Request, path string) ([]*http.Cookie, error) {
+	keyer, ok := lh.StorageDriver.(S3BucketKeyer)
+	if lh.cookieSigner == nil || !ok || eligibleForS3(r, lh.awsIPs) {
+		return nil, nil
+	}
+
+	policy, _, err := lh.policy(r, lh.resourceURL(keyer, path))
+	if err != nil {
+		return nil, err
+	}
+	return lh.cookieSigner.SignWithPolicy(policy)
+}
+
+// resourceURL returns the CloudFront URL of the file at the given path, with
+// the prefix of its S3 key rewritten.
+func (lh *cloudFrontStorageMiddleware) resourceURL(keyer S3BucketKeyer, path string) string {
+	key := strings.TrimPrefix(keyer.S3BucketKey(path), lh.trimKeyPrefix)
+	return lh.baseURL + strings.TrimPrefix(lh.keyPrefix+key, "/")
+}
+
+// policy returns the policy signing the URL, which is a custom policy if a
+// policy resource or source IP is configured, and a canned policy otherwise.
+func (lh *cloudFrontStorageMiddleware) policy(r *http.Request, cfURL string) (*sign.Policy, bool, error) {
+	expires := time.Now().Add(lh.duration)
+	if lh.policyResource == "" && lh.policySourceIP == "" {
+		return sign.NewCannedPolicy(cfURL, expires), false, nil
+	}
+
+	statement := sign.Statement{
+		Resource: cfURL,
+		Condition: sign.Condition{
+			DateLessThan: sign.NewAWSEpochTime(expires),
+		},
+	}
+	if lh.policyResource != "" {
+		statement.Resource = lh.policyResource
+	}
+	switch lh.policySourceIP {
+	case "":
+	case "client":
+		ip := net.ParseIP(requestutil.RemoteIP(r))
+		if ip == nil {
+			return nil, false, fmt.Errorf("failed to parse the IP address of the client %q", requestutil.RemoteIP(r))
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		statement.Condition.IPAddress = &sign.IPAddress{SourceIP: (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String()}
+	default:
+		statement.Condition.IPAddress = &sign.IPAddress{SourceIP: lh.policySourceIP}
+	}
+	return &sign.Policy{Statements: []sign.Statement{statement}}, true, nil
 }
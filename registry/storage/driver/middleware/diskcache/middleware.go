@@ -0,0 +1,396 @@
+// Package middleware - diskcache wrapper for storage libs
+//
+// The middleware caches the blobs read from the storage driver on a local
+// disk, up to a maximum size, evicting the blobs least recently read first.
+// Blobs are immutable, so that a cached blob never goes stale: reads of
+// cached blobs are served from the disk, and others from the storage driver,
+// filling the cache as they go.
+//
+// Registry instances can serve their cache to each other, so that the blobs
+// missing from the cache of an instance are fetched from the cache of a peer
+// before the storage driver.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/distribution/distribution/v3/registry/storage/driver/middleware/internal/blobpath"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	if err := storagemiddleware.Register("diskcache", newDiskCacheStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register diskcache storage middleware: %v", err)
+	}
+}
+
+type diskCacheStorageMiddleware struct {
+	storagedriver.StorageDriver
+	root    string
+	maxSize int64
+
+	mu   sync.Mutex
+	lru  *simplelru.LRU[digest.Digest, int64]
+	size int64
+
+	// peers are the registry instances whose caches are looked up before
+	// the storage driver
+	peers      []string
+	peerSecret string
+	peerClient *http.Client
+}
+
+var _ storagedriver.StorageDriver = &diskCacheStorageMiddleware{}
+
+func newDiskCacheStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	root, ok := options["rootdirectory"].(string)
+	if !ok || root == "" {
+		return nil, fmt.Errorf("no rootdirectory provided")
+	}
+	maxSize, err := parseSize(options["maxsize"])
+	if err != nil {
+		return nil, err
+	}
+
+	m := &diskCacheStorageMiddleware{
+		StorageDriver: sd,
+		root:          root,
+		maxSize:       maxSize,
+	}
+	// the size of the cache is bounded by maxSize, not by the number of blobs
+	if m.lru, err = simplelru.NewLRU[digest.Digest, int64](math.MaxInt, m.evicted); err != nil {
+		return nil, err
+	}
+	if err := m.load(ctx); err != nil {
+		return nil, fmt.Errorf("diskcache: loading %s: %v", root, err)
+	}
+	if err := m.configurePeers(ctx, options); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseSize(o interface{}) (int64, error) {
+	var size int64
+	switch v := o.(type) {
+	case int:
+		size = int64(v)
+	case int64:
+		size = v
+	case uint64:
+		size = int64(v)
+	case float64:
+		size = int64(v)
+	case string:
+		var err error
+		if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, fmt.Errorf("maxsize must be an integer")
+		}
+	case nil:
+		return 0, fmt.Errorf("no maxsize provided")
+	default:
+		return 0, fmt.Errorf("maxsize must be an integer")
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("maxsize must be positive, %d invalid", size)
+	}
+	return size, nil
+}
+
+// load adds the blobs cached by a previous run to the cache, the least
+// recently modified first, and removes the partial blobs it left.
+func (m *diskCacheStorageMiddleware) load(ctx context.Context) error {
+	if err := os.RemoveAll(m.tempDir()); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.tempDir(), 0o755); err != nil {
+		return err
+	}
+
+	type entry struct {
+		dgst digest.Digest
+		info fs.FileInfo
+	}
+	var entries []entry
+	blobs := filepath.Join(m.root, "blobs")
+	err := filepath.WalkDir(blobs, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(blobs, p)
+		if err != nil {
+			return err
+		}
+		dgst := digest.Digest(strings.Replace(filepath.ToSlash(rel), "/", ":", 1))
+		if dgst.Validate() != nil {
+			dcontext.GetLogger(ctx).Warnf("diskcache: ignoring %s", p)
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{dgst, info})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].info.ModTime().Before(entries[j].info.ModTime())
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		m.lru.Add(e.dgst, e.info.Size())
+		m.size += e.info.Size()
+	}
+	m.evict()
+	return nil
+}
+
+func (m *diskCacheStorageMiddleware) tempDir() string {
+	return filepath.Join(m.root, "_uploads")
+}
+
+func (m *diskCacheStorageMiddleware) blobPath(dgst digest.Digest) string {
+	return filepath.Join(m.root, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// evicted removes the file of a blob evicted from the cache. It is called
+// with mu held.
+func (m *diskCacheStorageMiddleware) evicted(dgst digest.Digest, size int64) {
+	m.size -= size
+	if err := os.Remove(m.blobPath(dgst)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logrus.Warnf("diskcache: removing %s: %v", dgst, err)
+	}
+}
+
+// evict evicts the least recently read blobs until the cache fits in
+// maxSize. It is called with mu held.
+func (m *diskCacheStorageMiddleware) evict() {
+	for m.size > m.maxSize {
+		if _, _, ok := m.lru.RemoveOldest(); !ok {
+			return
+		}
+	}
+}
+
+// open opens the cached file of the blob dgst, if any.
+func (m *diskCacheStorageMiddleware) open(dgst digest.Digest) (*os.File, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lru.Get(dgst); !ok {
+		return nil, false
+	}
+	f, err := os.Open(m.blobPath(dgst))
+	if err != nil {
+		logrus.Warnf("diskcache: opening %s: %v", dgst, err)
+		m.lru.Remove(dgst)
+		return nil, false
+	}
+	return f, true
+}
+
+// add moves the file of the blob dgst, fully read from the storage driver,
+// into the cache.
+func (m *diskCacheStorageMiddleware) add(dgst digest.Digest, tempPath string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size > m.maxSize || m.lru.Contains(dgst) {
+		return os.Remove(tempPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.blobPath(dgst)), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, m.blobPath(dgst)); err != nil {
+		return err
+	}
+	m.lru.Add(dgst, size)
+	m.size += size
+	m.evict()
+	return nil
+}
+
+// Reader serves the blobs in the cache from the disk. Other blobs read from
+// the start are added to the cache once they are read to the end, and their
+// content is checked against their digest.
+func (m *diskCacheStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	dgst, ok := blobpath.Digest(path)
+	if !ok {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	if rc, ok := m.readCached(ctx, dgst, offset); ok {
+		return rc, nil
+	}
+	if len(m.peers) > 0 && m.fetchFromPeers(ctx, dgst) {
+		if rc, ok := m.readCached(ctx, dgst, offset); ok {
+			return rc, nil
+		}
+	}
+
+	rc, err := m.StorageDriver.Reader(ctx, path, offset)
+	if err != nil || offset != 0 {
+		return rc, err
+	}
+	f, err := os.CreateTemp(m.tempDir(), "")
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: caching %s: %v", dgst, err)
+		return rc, nil
+	}
+	return &fillingReader{
+		m:        m,
+		ctx:      ctx,
+		dgst:     dgst,
+		rc:       rc,
+		f:        f,
+		verifier: dgst.Verifier(),
+	}, nil
+}
+
+// readCached opens the cached file of the blob dgst at offset, if any.
+func (m *diskCacheStorageMiddleware) readCached(ctx context.Context, dgst digest.Digest, offset int64) (io.ReadCloser, bool) {
+	f, ok := m.open(dgst)
+	if !ok {
+		return nil, false
+	}
+	fi, err := f.Stat()
+	if err == nil && offset <= fi.Size() {
+		if _, err = f.Seek(offset, io.SeekStart); err == nil {
+			return f, true
+		}
+	}
+	f.Close()
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: reading %s: %v", dgst, err)
+	}
+	return nil, false
+}
+
+// GetContent retrieves the content of blobs through Reader, so that they are
+// served from the cache.
+func (m *diskCacheStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if !blobpath.IsData(path) {
+		return m.StorageDriver.GetContent(ctx, path)
+	}
+	rc, err := m.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Delete removes the blobs deleted from the storage driver from the cache.
+func (m *diskCacheStorageMiddleware) Delete(ctx context.Context, subPath string) error {
+	err := m.StorageDriver.Delete(ctx, subPath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, dgst := range m.lru.Keys() {
+		p := blobpath.Data(dgst)
+		if p == subPath || strings.HasPrefix(p, strings.TrimSuffix(subPath, "/")+"/") {
+			m.lru.Remove(dgst)
+		}
+	}
+	return err
+}
+
+// RedirectURL does not redirect to blobs, so that they are served from the
+// cache.
+func (m *diskCacheStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	if blobpath.IsData(path) {
+		return "", nil
+	}
+	return m.StorageDriver.RedirectURL(r, path)
+}
+
+// fillingReader copies the content of a blob read from the storage driver to
+// a temporary file, added to the cache once the blob is read to the end.
+type fillingReader struct {
+	m        *diskCacheStorageMiddleware
+	ctx      context.Context
+	dgst     digest.Digest
+	rc       io.ReadCloser
+	f        *os.File
+	verifier digest.Verifier
+	size     int64
+}
+
+func (r *fillingReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if r.f == nil {
+		return n, err
+	}
+	if _, werr := r.f.Write(p[:n]); werr != nil {
+		dcontext.GetLogger(r.ctx).Warnf("diskcache: caching %s: %v", r.dgst, werr)
+		r.abort()
+		return n, err
+	}
+	r.verifier.Write(p[:n])
+	r.size += int64(n)
+	if err == io.EOF {
+		r.commit()
+	}
+	return n, err
+}
+
+// commit adds the temporary file to the cache if its content matches the
+// digest of the blob.
+func (r *fillingReader) commit() {
+	if !r.verifier.Verified() {
+		dcontext.GetLogger(r.ctx).Warnf("diskcache: the content of %s does not match its digest", r.dgst)
+		r.abort()
+		return
+	}
+	f := r.f
+	r.f = nil
+	if err := f.Close(); err != nil {
+		dcontext.GetLogger(r.ctx).Warnf("diskcache: caching %s: %v", r.dgst, err)
+		os.Remove(f.Name())
+		return
+	}
+	if err := r.m.add(r.dgst, f.Name(), r.size); err != nil {
+		dcontext.GetLogger(r.ctx).Warnf("diskcache: caching %s: %v", r.dgst, err)
+		os.Remove(f.Name())
+	}
+}
+
+// abort removes the temporary file, for blobs which are not cached.
+func (r *fillingReader) abort() {
+	r.f.Close()
+	os.Remove(r.f.Name())
+	r.f = nil
+}
+
+func (r *fillingReader) Close() error {
+	if r.f != nil {
+		r.abort()
+	}
+	return r.rc.Close()
+}
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/middleware/internal/blobpath"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskCacheDriverSuite(t *testing.T) {
+	root := t.TempDir()
+	cache := t.TempDir()
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		d, err := filesystem.FromParameters(map[string]interface{}{
+			"rootdirectory": root,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newDiskCacheStorageMiddleware(context.Background(), d, map[string]interface{}{
+			"rootdirectory": cache,
+			"maxsize":       1 << 20,
+		})
+	})
+}
+
+// putBlob stores a blob of size random bytes in d, returning its path.
+func putBlob(t *testing.T, d storagedriver.StorageDriver, size int) (string, []byte) {
+	t.Helper()
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	dgst := digest.FromBytes(content)
+	p := path.Join("/docker/registry/v2/blobs", dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded(), "data")
+	require.NoError(t, d.PutContent(context.Background(), p, content))
+	return p, content
+}
+
+func readBlob(t *testing.T, d storagedriver.StorageDriver, p string, offset int64) []byte {
+	t.Helper()
+	rc, err := d.Reader(context.Background(), p, offset)
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return content
+}
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	m, err := newDiskCacheStorageMiddleware(ctx, d, map[string]interface{}{
+		"rootdirectory": t.TempDir(),
+		"maxsize":       "1048576",
+	})
+	require.NoError(t, err)
+
+	p, content := putBlob(t, d, 1000)
+
+	// blobs read from an offset are not cached
+	require.Equal(t, content[10:], readBlob(t, m, p, 10))
+	require.Zero(t, m.(*diskCacheStorageMiddleware).size)
+
+	// neither are blobs not read to the end
+	rc, err := m.Reader(ctx, p, 0)
+	require.NoError(t, err)
+	_, err = rc.Read(make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Zero(t, m.(*diskCacheStorageMiddleware).size)
+
+	require.Equal(t, content, readBlob(t, m, p, 0))
+	require.Equal(t, int64(len(content)), m.(*diskCacheStorageMiddleware).size)
+
+	// cached blobs are served from the disk
+	require.NoError(t, d.Delete(ctx, p))
+	require.Equal(t, content, readBlob(t, m, p, 0))
+	require.Equal(t, content[999:], readBlob(t, m, p, 999))
+	p2, err := m.GetContent(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, content, p2)
+
+	redirectURL, err := m.RedirectURL(nil, p)
+	require.NoError(t, err)
+	require.Empty(t, redirectURL)
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	cache := t.TempDir()
+	m, err := newDiskCacheStorageMiddleware(ctx, d, map[string]interface{}{
+		"rootdirectory": cache,
+		"maxsize":       2500,
+	})
+	require.NoError(t, err)
+
+	p1, content1 := putBlob(t, d, 1000)
+	p2, _ := putBlob(t, d, 1000)
+	p3, _ := putBlob(t, d, 1000)
+	readBlob(t, m, p1, 0)
+	readBlob(t, m, p2, 0)
+	// p1 is read again, so that p2 is the least recently read
+	readBlob(t, m, p1, 0)
+	readBlob(t, m, p3, 0)
+
+	dm := m.(*diskCacheStorageMiddleware)
+	require.Equal(t, int64(2000), dm.size)
+	dgst1, _ := blobpath.Digest(p1)
+	dgst2, _ := blobpath.Digest(p2)
+	dgst3, _ := blobpath.Digest(p3)
+	require.ElementsMatch(t, []digest.Digest{dgst1, dgst3}, dm.lru.Keys())
+	_, err = os.Stat(dm.blobPath(dgst2))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// blobs larger than the cache are not cached
+	p4, _ := putBlob(t, d, 3000)
+	readBlob(t, m, p4, 0)
+	require.Equal(t, int64(2000), dm.size)
+
+	// the cache is loaded back, and shrunk to its new size
+	m, err = newDiskCacheStorageMiddleware(ctx, d, map[string]interface{}{
+		"rootdirectory": cache,
+		"maxsize":       1500,
+	})
+	require.NoError(t, err)
+	dm = m.(*diskCacheStorageMiddleware)
+	require.Equal(t, int64(1000), dm.size)
+	require.Equal(t, 1, dm.lru.Len())
+
+	// deleted blobs are removed from the cache
+	require.NoError(t, d.PutContent(ctx, p1, content1))
+	readBlob(t, m, p1, 0)
+	require.True(t, dm.lru.Contains(dgst1))
+	require.NoError(t, m.Delete(ctx, path.Dir(p1)))
+	require.False(t, dm.lru.Contains(dgst1))
+	_, err = os.Stat(dm.blobPath(dgst1))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCorruptBlobNotCached(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	cache := t.TempDir()
+	m, err := newDiskCacheStorageMiddleware(ctx, d, map[string]interface{}{
+		"rootdirectory": cache,
+		"maxsize":       1 << 20,
+	})
+	require.NoError(t, err)
+
+	p, _ := putBlob(t, d, 1000)
+	require.NoError(t, d.PutContent(ctx, p, []byte("corrupt")))
+	readBlob(t, m, p, 0)
+	require.Zero(t, m.(*diskCacheStorageMiddleware).lru.Len())
+	entries, err := os.ReadDir(filepath.Join(cache, "_uploads"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestPeers(t *testing.T) {
+	ctx := context.Background()
+	newMiddleware := func(d storagedriver.StorageDriver, options map[string]interface{}) *diskCacheStorageMiddleware {
+		options["rootdirectory"] = t.TempDir()
+		options["maxsize"] = 1 << 20
+		m, err := newDiskCacheStorageMiddleware(ctx, d, options)
+		require.NoError(t, err)
+		return m.(*diskCacheStorageMiddleware)
+	}
+
+	// the peer caches a blob of its storage driver
+	peerDriver := inmemory.New()
+	peer := newMiddleware(peerDriver, map[string]interface{}{"peersecret": "secret"})
+	server := httptest.NewServer(peer.peerHandler())
+	defer server.Close()
+	p, content := putBlob(t, peerDriver, 1000)
+	missing, _ := putBlob(t, peerDriver, 1000)
+	readBlob(t, peer, p, 0)
+
+	// blobs missing from the cache are fetched from the cache of the peer,
+	// and cached, before the storage driver
+	m := newMiddleware(inmemory.New(), map[string]interface{}{
+		"peers":      []interface{}{server.URL},
+		"peersecret": "secret",
+	})
+	require.Equal(t, content[10:], readBlob(t, m, p, 10))
+	dgst, _ := blobpath.Digest(p)
+	require.True(t, m.lru.Contains(dgst))
+
+	// blobs missing from the cache of the peer are read from the storage
+	// driver
+	_, err := m.Reader(ctx, missing, 0)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	// peers authenticate with the secret
+	other := newMiddleware(inmemory.New(), map[string]interface{}{
+		"peers": []interface{}{server.URL},
+	})
+	_, err = other.Reader(ctx, p, 0)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+}
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+	for _, options := range []map[string]interface{}{
+		{"maxsize": 1000},
+		{"rootdirectory": t.TempDir()},
+		{"rootdirectory": t.TempDir(), "maxsize": "big"},
+		{"rootdirectory": t.TempDir(), "maxsize": 0},
+		{"rootdirectory": t.TempDir(), "maxsize": true},
+		{"rootdirectory": t.TempDir(), "maxsize": 1000, "peers": "http://peer"},
+		{"rootdirectory": t.TempDir(), "maxsize": 1000, "peers": []interface{}{"peer:5001"}},
+		{"rootdirectory": t.TempDir(), "maxsize": 1000, "peertimeout": "soon"},
+	} {
+		_, err := newDiskCacheStorageMiddleware(ctx, inmemory.New(), options)
+		require.Error(t, err, options)
+	}
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultPeerTimeout is the default time peers have to respond, before the
+// blob is read from the storage driver instead.
+const defaultPeerTimeout = 5 * time.Second
+
+// configurePeers configures the peers the blobs missing from the cache are
+// fetched from, and serves the cache to them, if configured.
+func (m *diskCacheStorageMiddleware) configurePeers(ctx context.Context, options map[string]interface{}) error {
+	if v, ok := options["peers"]; ok {
+		peers, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("peers must be a list of URLs")
+		}
+		for _, peer := range peers {
+			peer, ok := peer.(string)
+			if !ok || !strings.HasPrefix(peer, "http://") && !strings.HasPrefix(peer, "https://") {
+				return fmt.Errorf("invalid peer URL: %v", peer)
+			}
+			m.peers = append(m.peers, strings.TrimSuffix(peer, "/"))
+		}
+	}
+	if v, ok := options["peersecret"]; ok {
+		if m.peerSecret, ok = v.(string); !ok {
+			return fmt.Errorf("peersecret must be a string")
+		}
+	}
+	timeout := defaultPeerTimeout
+	if v, ok := options["peertimeout"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("peertimeout must be a duration")
+		}
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid peertimeout: %v", s)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	m.peerClient = &http.Client{Transport: transport}
+
+	if v, ok := options["peerlisten"]; ok {
+		addr, ok := v.(string)
+		if !ok || addr == "" {
+			return fmt.Errorf("peerlisten must be an address")
+		}
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           m.peerHandler(),
+			ReadHeaderTimeout: timeout,
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				dcontext.GetLogger(ctx).Errorf("diskcache: serving peers on %s: %v", addr, err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+	}
+	return nil
+}
+
+// peerHandler serves the cached blobs to the peers at /blobs/<digest>. Peers
+// are only served the blobs in the cache, so that a blob missing from every
+// cache is never fetched from peer to peer.
+func (m *diskCacheStorageMiddleware) peerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if m.peerSecret != "" {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(m.peerSecret)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		dgst, err := digest.Parse(strings.TrimPrefix(r.URL.Path, "/blobs/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f, ok := m.open(dgst)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	})
+}
+
+// fetchFromPeers adds the blob dgst to the cache from the cache of the first
+// peer holding it, and reports whether one did.
+func (m *diskCacheStorageMiddleware) fetchFromPeers(ctx context.Context, dgst digest.Digest) bool {
+	for _, peer := range m.peers {
+		err := m.fetchFromPeer(ctx, peer, dgst)
+		if err == nil {
+			dcontext.GetLogger(ctx).Debugf("diskcache: fetched %s from %s", dgst, peer)
+			return true
+		}
+		if !errors.Is(err, errNotInPeerCache) {
+			dcontext.GetLogger(ctx).Warnf("diskcache: fetching %s from %s: %v", dgst, peer, err)
+		}
+	}
+	return false
+}
+
+var errNotInPeerCache = errors.New("not in the cache of the peer")
+
+func (m *diskCacheStorageMiddleware) fetchFromPeer(ctx context.Context, peer string, dgst digest.Digest) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/blobs/"+dgst.String(), nil)
+	if err != nil {
+		return err
+	}
+	if m.peerSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+m.peerSecret)
+	}
+	resp, err := m.peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errNotInPeerCache
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	f, err := os.CreateTemp(m.tempDir(), "")
+	if err != nil {
+		return err
+	}
+	verifier := dgst.Verifier()
+	size, err := io.Copy(io.MultiWriter(f, verifier), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !verifier.Verified() {
+		err = fmt.Errorf("the content does not match the digest")
+	}
+	if err == nil {
+		err = m.add(dgst, f.Name(), size)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/smithy-go"
+)
+
+// kmsTimeout bounds the time spent decrypting the key, so that an unreachable
+// KMS endpoint fails the startup of the registry rather than hanging it.
+var kmsTimeout = 30 * time.Second
+
+// decryptKMSKey decrypts the key encrypted by AWS KMS in the kmsciphertext
+// option, for instance a data key generated with GenerateDataKey, with the
+// credentials of the default credential chain.
+func decryptKMSKey(ctx context.Context, options map[string]interface{}) ([]byte, error) {
+	ciphertext, ok := options["kmsciphertext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("kmsciphertext must be a string")
+	}
+	blob, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("kmsciphertext must be base64 encoded")
+	}
+	region, ok := options["kmsregion"].(string)
+	if !ok || region == "" {
+		return nil, fmt.Errorf("kmsregion must be provided with kmsciphertext")
+	}
+	var endpoint string
+	if o, ok := options["kmsendpoint"]; ok {
+		if endpoint, ok = o.(string); !ok {
+			return nil, fmt.Errorf("kmsendpoint must be a string")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kmsTimeout)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("kms: failed to load the AWS configuration: %v", err)
+	}
+	client := kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+
+	out, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			return nil, fmt.Errorf("kms: failed to decrypt the key: %s %s", apiErr.ErrorCode(), apiErr.ErrorMessage())
+		}
+		return nil, fmt.Errorf("kms: %v", err)
+	}
+	if len(out.Plaintext) != 32 {
+		return nil, fmt.Errorf("kms: the decrypted key is not a key of 32 bytes")
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,726 @@
+// Package middleware - encrypt wrapper for storage libs
+//
+// The middleware encrypts the content stored by the storage driver with
+// AES-256-GCM, for backends with no encryption at rest of their own. Content
+// is encrypted in segments of a fixed size, each authenticated on its own,
+// so that it can be read from any offset without decrypting what precedes.
+// Every file is encrypted with its own key, derived from the configured key
+// with HKDF, as the AES-GCM-HKDF streaming AEAD of Tink does, so that the
+// number of files encrypted with a configured key is not bounded by the
+// collisions of random nonces.
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted files start with a header of magic, the ID of the key the file
+// is encrypted with, and the random salt its own key is derived with. The
+// segments follow, each sealed with a nonce of the index of the segment and
+// whether it is the last segment, and bound to the path of the file and the
+// index of the segment, so that segments cannot be moved within or across
+// files.
+//
+// The last segment of a committed file is always shorter than the others,
+// and is empty if the content is a multiple of segmentSize. The files made of
+// full segments only are thus uploads in progress: the content which does not
+// fill a segment yet is stored in a tail file next to them, as its own
+// encrypted file, until the upload is committed. Closed uploads always have a
+// tail, empty if the content is a multiple of segmentSize, so that committed
+// files truncated to full segments fail to read rather than read short.
+const (
+	magic      = "\x00encrypted\x00"
+	keyIDSize  = 4
+	saltSize   = 32
+	headerSize = len(magic) + keyIDSize + saltSize
+
+	segmentSize       = 64 << 10
+	tagSize           = 16
+	sealedSegmentSize = segmentSize + tagSize
+
+	tailSuffix = ".encrypted-tail"
+)
+
+func init() {
+	if err := storagemiddleware.Register("encrypt", newEncryptStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register encrypt storage middleware: %v", err)
+	}
+}
+
+type keyID [keyIDSize]byte
+
+type encryptStorageMiddleware struct {
+	storagedriver.StorageDriver
+	current keyID
+	keys    map[keyID][]byte
+}
+
+var _ storagedriver.StorageDriver = &encryptStorageMiddleware{}
+
+func newEncryptStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	m := &encryptStorageMiddleware{
+		StorageDriver: sd,
+		keys:          make(map[keyID][]byte),
+	}
+
+	var (
+		key []byte
+		err error
+	)
+	switch {
+	case options["key"] != nil && options["keyfile"] == nil && options["kmsciphertext"] == nil:
+		key, err = decodeKey("key", options["key"])
+	case options["keyfile"] != nil && options["key"] == nil && options["kmsciphertext"] == nil:
+		name, ok := options["keyfile"].(string)
+		if !ok {
+			return nil, fmt.Errorf("keyfile must be a string")
+		}
+		p, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read keyfile: %v", err)
+		}
+		key, err = decodeKey("keyfile", strings.TrimSpace(string(p)))
+		if err != nil {
+			return nil, err
+		}
+	case options["kmsciphertext"] != nil && options["key"] == nil && options["keyfile"] == nil:
+		key, err = decryptKMSKey(ctx, options)
+	default:
+		return nil, fmt.Errorf("exactly one of key, keyfile or kmsciphertext must be provided")
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.current = m.addKey(key)
+
+	if o, ok := options["previouskeys"]; ok {
+		previousKeys, ok := o.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("previouskeys must be a list of keys")
+		}
+		for _, o := range previousKeys {
+			key, err := decodeKey("previouskeys", o)
+			if err != nil {
+				return nil, err
+			}
+			m.addKey(key)
+		}
+	}
+
+	return m, nil
+}
+
+// decodeKey decodes the base64 encoded key of option name.
+func decodeKey(name string, o interface{}) ([]byte, error) {
+	s, ok := o.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string", name)
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be a base64 encoded key of 32 bytes", name)
+	}
+	return key, nil
+}
+
+// addKey adds an AES-256 key to the keys content may be encrypted with.
+func (m *encryptStorageMiddleware) addKey(key []byte) keyID {
+	var id keyID
+	sum := sha256.Sum256(key)
+	copy(id[:], sum[:])
+	m.keys[id] = key
+	return id
+}
+
+// fileKey returns the AEAD of a file, keyed with the key derived from key and
+// the salt of the file.
+func fileKey(key, salt []byte) (cipher.AEAD, error) {
+	derived := make([]byte, len(key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(magic)), derived); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader returns the header of a new file encrypted with the current key,
+// and the AEAD of the file.
+func (m *encryptStorageMiddleware) newHeader() ([]byte, cipher.AEAD, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	copy(header[len(magic):], m.current[:])
+	salt := header[len(magic)+keyIDSize:]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	aead, err := fileKey(m.keys[m.current], salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+// parseHeader returns the AEAD of the file at path.
+func (m *encryptStorageMiddleware) parseHeader(path string, header []byte) (cipher.AEAD, error) {
+	if len(header) != headerSize || !bytes.HasPrefix(header, []byte(magic)) {
+		return nil, fmt.Errorf("encrypt: %s is not encrypted", path)
+	}
+	var id keyID
+	copy(id[:], header[len(magic):])
+	key, ok := m.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encrypt: %s is encrypted with an unknown key", path)
+	}
+	return fileKey(key, header[len(magic)+keyIDSize:])
+}
+
+// nonce returns the nonce of segment i of a file. The key of every file is
+// unique, so that the nonces only need to be unique within a file.
+func nonce(i uint32, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint32(n[7:], i)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+// additionalData returns the additional data segment i of the file at path
+// is authenticated with.
+func additionalData(path string, i uint32) []byte {
+	ad := make([]byte, 0, 4+len(path))
+	ad = binary.BigEndian.AppendUint32(ad, i)
+	return append(ad, path...)
+}
+
+// seal returns content encrypted as a committed file at path.
+func (m *encryptStorageMiddleware) seal(path string, content []byte) ([]byte, error) {
+	header, aead, err := m.newHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, headerSize+len(content)+(len(content)/segmentSize+1)*tagSize)
+	sealed = append(sealed, header...)
+	var i uint32
+	for ; len(content) >= segmentSize; i++ {
+		sealed = aead.Seal(sealed, nonce(i, false), content[:segmentSize], additionalData(path, i))
+		content = content[segmentSize:]
+	}
+	return aead.Seal(sealed, nonce(i, true), content, additionalData(path, i)), nil
+}
+
+// plainSize returns the size of the content of a file of size bytes once
+// decrypted, excluding the tail of uploads in progress, and whether the file
+// is committed.
+func plainSize(size int64) (int64, bool) {
+	if size <= int64(headerSize) {
+		return 0, false
+	}
+	segments, last := (size-int64(headerSize))/sealedSegmentSize, (size-int64(headerSize))%sealedSegmentSize
+	if last == 0 {
+		return segments * segmentSize, false
+	}
+	return segments*segmentSize + max(last-tagSize, 0), true
+}
+
+func tailPath(path string) string {
+	return path + tailSuffix
+}
+
+// tail returns the content of the tail of the upload at path, which is nil
+// if the upload has no tail.
+func (m *encryptStorageMiddleware) tail(ctx context.Context, path string) ([]byte, error) {
+	content, err := m.GetContent(ctx, tailPath(path))
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil, nil
+	}
+	return content, err
+}
+
+// deleteTail deletes the tail of the upload at path, if any.
+func (m *encryptStorageMiddleware) deleteTail(ctx context.Context, path string) error {
+	err := m.StorageDriver.Delete(ctx, tailPath(path))
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil
+	}
+	return err
+}
+
+// GetContent retrieves the content stored at path, decrypting it.
+func (m *encryptStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	rc, err := m.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// PutContent stores content at path, encrypting it.
+func (m *encryptStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	sealed, err := m.seal(path, content)
+	if err != nil {
+		return err
+	}
+	return m.StorageDriver.PutContent(ctx, path, sealed)
+}
+
+// Reader retrieves an io.ReadCloser decrypting the content stored at path
+// from offset.
+func (m *encryptStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.Name()}
+	}
+
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(rc, header)
+	if n == 0 && err == io.EOF {
+		// only uploads in progress which were never closed have no header,
+		// and nothing to read, but committed files may be truncated
+		rc.Close()
+		return nil, fmt.Errorf("encrypt: %s is truncated", path)
+	}
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("encrypt: reading the header of %s: %v", path, err)
+	}
+	aead, err := m.parseHeader(path, header)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	segment := offset / segmentSize
+	if segment > 0 {
+		rc.Close()
+		rc, err = m.StorageDriver.Reader(ctx, path, int64(headerSize)+segment*sealedSegmentSize)
+		if err != nil {
+			if errors.As(err, &storagedriver.InvalidOffsetError{}) {
+				return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.Name()}
+			}
+			return nil, err
+		}
+	}
+
+	r := &reader{
+		m:       m,
+		ctx:     ctx,
+		path:    path,
+		rc:      rc,
+		br:      bufio.NewReaderSize(rc, sealedSegmentSize),
+		aead:    aead,
+		segment: uint32(segment),
+	}
+	if skip := offset % segmentSize; skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+			r.Close()
+			if err == io.EOF {
+				return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.Name()}
+			}
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Writer returns a FileWriter encrypting the content written to it.
+func (m *encryptStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if !append {
+		// the tail of a previous upload to path would be appended to
+		if err := m.deleteTail(ctx, path); err != nil {
+			return nil, err
+		}
+	}
+
+	fw, err := m.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	if size, committed := plainSize(fw.Size()); append && committed && size == 0 {
+		// committed empty content is replaced, as appending to it
+		fw.Close()
+		if fw, err = m.StorageDriver.Writer(ctx, path, false); err != nil {
+			return nil, err
+		}
+	}
+	w := &writer{
+		m:    m,
+		ctx:  ctx,
+		path: path,
+		fw:   fw,
+		buf:  make([]byte, 0, segmentSize),
+	}
+	if fw.Size() == 0 {
+		if w.header, w.aead, err = m.newHeader(); err != nil {
+			fw.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+
+	size, committed := plainSize(fw.Size())
+	if committed {
+		fw.Close()
+		return nil, fmt.Errorf("encrypt: %s is committed and cannot be appended to", path)
+	}
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(rc, header)
+	rc.Close()
+	if err != nil {
+		fw.Close()
+		return nil, fmt.Errorf("encrypt: reading the header of %s: %v", path, err)
+	}
+	if w.aead, err = m.parseHeader(path, header); err != nil {
+		fw.Close()
+		return nil, err
+	}
+
+	tail, err := m.tail(ctx, path)
+	if err == nil && len(tail) >= segmentSize {
+		err = fmt.Errorf("encrypt: the tail of %s is larger than a segment", path)
+	}
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	w.segment = uint32(size / segmentSize)
+	w.buf = w.buf[:len(tail)]
+	copy(w.buf, tail)
+	w.size = size + int64(len(tail))
+	w.tail = tail != nil
+	return w, nil
+}
+
+// Move moves the file at sourcePath to destPath. The segments of files are
+// bound to their path, so the content is encrypted again for destPath.
+func (m *encryptStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	rc, err := m.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := m.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, rc); err != nil {
+		fw.Cancel(ctx)
+		fw.Close()
+		return err
+	}
+	if err := fw.Commit(ctx); err != nil {
+		fw.Close()
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	if err := m.deleteTail(ctx, sourcePath); err != nil {
+		return err
+	}
+	return m.StorageDriver.Delete(ctx, sourcePath)
+}
+
+// Stat retrieves the FileInfo for the given path, with the size of the
+// decrypted content.
+func (m *encryptStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+	size, committed := plainSize(fi.Size())
+	if !committed {
+		tail, err := m.StorageDriver.Stat(ctx, tailPath(path))
+		if err != nil && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			return nil, err
+		} else if err == nil {
+			tailSize, _ := plainSize(tail.Size())
+			size += tailSize
+		}
+	}
+	return plainFileInfo(fi, size), nil
+}
+
+// List returns the objects that are direct descendants of path, excluding
+// the tails of uploads.
+func (m *encryptStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	entries, err := m.StorageDriver.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, tailSuffix) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered, nil
+}
+
+// Walk traverses the files stored at path, excluding the tails of uploads,
+// with the size of their decrypted content.
+func (m *encryptStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return m.StorageDriver.Walk(ctx, path, func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() {
+			return f(fi)
+		}
+		if strings.HasSuffix(fi.Path(), tailSuffix) {
+			return nil
+		}
+		size, _ := plainSize(fi.Size())
+		return f(plainFileInfo(fi, size))
+	}, options...)
+}
+
+// RedirectURL does not redirect, since the storage driver would serve the
+// encrypted content.
+func (m *encryptStorageMiddleware) RedirectURL(*http.Request, string) (string, error) {
+	return "", nil
+}
+
+func plainFileInfo(fi storagedriver.FileInfo, size int64) storagedriver.FileInfo {
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    size,
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+	}}
+}
+
+// reader decrypts the segments of a file from the segment rc is at.
+type reader struct {
+	m       *encryptStorageMiddleware
+	ctx     context.Context
+	path    string
+	rc      io.ReadCloser
+	br      *bufio.Reader
+	aead    cipher.AEAD
+	segment uint32
+
+	sealed []byte
+	buf    []byte
+	eof    bool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next segment.
+func (r *reader) next() error {
+	if r.sealed == nil {
+		r.sealed = make([]byte, sealedSegmentSize)
+	}
+	n, err := io.ReadFull(r.br, r.sealed)
+	switch err {
+	case nil:
+		// full segments are never the last segment
+		r.buf, err = r.aead.Open(r.sealed[:0], nonce(r.segment, false), r.sealed, additionalData(r.path, r.segment))
+	case io.ErrUnexpectedEOF:
+		r.eof = true
+		r.buf, err = r.aead.Open(r.sealed[:0], nonce(r.segment, true), r.sealed[:n], additionalData(r.path, r.segment))
+	case io.EOF:
+		// the file is an upload in progress, followed by its tail, unless
+		// it is a committed file truncated to full segments
+		r.eof = true
+		r.buf, err = r.m.GetContent(r.ctx, tailPath(r.path))
+		if errors.As(err, &storagedriver.PathNotFoundError{}) {
+			return fmt.Errorf("encrypt: %s is truncated", r.path)
+		}
+		return err
+	default:
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("encrypt: decrypting segment %d of %s: %v", r.segment, r.path, err)
+	}
+	r.segment++
+	return nil
+}
+
+func (r *reader) Close() error {
+	return r.rc.Close()
+}
+
+// writer encrypts the content written to it in segments, buffering the
+// content which does not fill a segment yet.
+type writer struct {
+	m    *encryptStorageMiddleware
+	ctx  context.Context
+	path string
+	fw   storagedriver.FileWriter
+
+	// header is written before the first segment of new files
+	header  []byte
+	aead    cipher.AEAD
+	segment uint32
+
+	buf  []byte
+	size int64
+	// tail is set when the upload may have a tail to delete
+	tail bool
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	var written int
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):segmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		if len(w.buf) == segmentSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		written += n
+		w.size += int64(n)
+	}
+	return written, nil
+}
+
+// flush writes the buffered content as a segment.
+func (w *writer) flush(last bool) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	sealed := w.aead.Seal(nil, nonce(w.segment, last), w.buf, additionalData(w.path, w.segment))
+	if _, err := w.fw.Write(sealed); err != nil {
+		return err
+	}
+	w.segment++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *writer) writeHeader() error {
+	if w.header == nil {
+		return nil
+	}
+	if _, err := w.fw.Write(w.header); err != nil {
+		return err
+	}
+	w.header = nil
+	return nil
+}
+
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+// Close stores the buffered content in the tail of the upload, so that the
+// writer can be resumed.
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	if !w.committed && !w.cancelled {
+		// the header holds the key and the salt of resumed writers
+		if err := w.writeHeader(); err != nil {
+			w.fw.Close()
+			return err
+		}
+		// the tail marks the upload as in progress, even when empty
+		if err := w.m.PutContent(w.ctx, tailPath(w.path), w.buf); err != nil {
+			w.fw.Close()
+			return err
+		}
+	}
+	return w.fw.Close()
+}
+
+func (w *writer) Cancel(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+
+	if w.tail {
+		if err := w.m.deleteTail(ctx, w.path); err != nil {
+			return err
+		}
+	}
+	return w.fw.Cancel(ctx)
+}
+
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+
+	if err := w.flush(true); err != nil {
+		return err
+	}
+	if err := w.fw.Commit(ctx); err != nil {
+		return err
+	}
+	w.committed = true
+
+	if w.tail {
+		return w.m.deleteTail(ctx, w.path)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+func TestEncryptDriverSuite(t *testing.T) {
+	root := t.TempDir()
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		d, err := filesystem.FromParameters(map[string]interface{}{
+			"rootdirectory": root,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newEncryptStorageMiddleware(context.Background(), d, map[string]interface{}{"key": testKey})
+	})
+}
+
+func TestResumedUpload(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	m, err := newEncryptStorageMiddleware(ctx, d, map[string]interface{}{"key": testKey})
+	require.NoError(t, err)
+
+	content := make([]byte, 2*segmentSize+100)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+
+	// the upload is closed in the middle of a segment
+	w, err := m.Writer(ctx, "/upload/data", false)
+	require.NoError(t, err)
+	_, err = w.Write(content[:segmentSize+10])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	raw, err := d.GetContent(ctx, "/upload/data")
+	require.NoError(t, err)
+	require.Len(t, raw, headerSize+sealedSegmentSize)
+	require.NotContains(t, string(raw), string(content[:64]))
+	_, err = d.Stat(ctx, "/upload/data"+tailSuffix)
+	require.NoError(t, err)
+
+	entries, err := m.List(ctx, "/upload")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/upload/data"}, entries)
+	fi, err := m.Stat(ctx, "/upload/data")
+	require.NoError(t, err)
+	require.Equal(t, int64(segmentSize+10), fi.Size())
+
+	// the tail is read after the segments of the upload
+	rc, err := m.Reader(ctx, "/upload/data", segmentSize+5)
+	require.NoError(t, err)
+	p, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	require.Equal(t, content[segmentSize+5:segmentSize+10], p)
+
+	w, err = m.Writer(ctx, "/upload/data", true)
+	require.NoError(t, err)
+	require.Equal(t, int64(segmentSize+10), w.Size())
+	_, err = w.Write(content[segmentSize+10:])
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, w.Close())
+
+	_, err = d.Stat(ctx, "/upload/data"+tailSuffix)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+	fi, err = m.Stat(ctx, "/upload/data")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fi.Size())
+	got, err := m.GetContent(ctx, "/upload/data")
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+
+	_, err = m.Writer(ctx, "/upload/data", true)
+	require.Error(t, err)
+	_, err = m.Reader(ctx, "/upload/data", int64(len(content))+1)
+	require.ErrorAs(t, err, &storagedriver.InvalidOffsetError{})
+
+	// tampered content fails to decrypt
+	raw, err = d.GetContent(ctx, "/upload/data")
+	require.NoError(t, err)
+	raw[len(raw)-1] ^= 1
+	require.NoError(t, d.PutContent(ctx, "/upload/data", raw))
+	rc, err = m.Reader(ctx, "/upload/data", 2*segmentSize)
+	if err == nil {
+		_, err = io.ReadAll(rc)
+		rc.Close()
+	}
+	require.ErrorContains(t, err, "encrypt: decrypting segment 2 of /upload/data")
+}
+
+func TestTruncatedContent(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	m, err := newEncryptStorageMiddleware(ctx, d, map[string]interface{}{"key": testKey})
+	require.NoError(t, err)
+
+	content := make([]byte, 2*segmentSize)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+	require.NoError(t, m.PutContent(ctx, "/blob", content))
+
+	// committed content truncated to full segments fails to read, rather
+	// than reading short as an upload in progress
+	raw, err := d.GetContent(ctx, "/blob")
+	require.NoError(t, err)
+	for _, size := range []int{headerSize + 2*sealedSegmentSize, headerSize + sealedSegmentSize, 0} {
+		require.NoError(t, d.PutContent(ctx, "/blob", raw[:size]))
+		_, err = m.GetContent(ctx, "/blob")
+		require.ErrorContains(t, err, "encrypt: /blob is truncated", "truncated to %d bytes", size)
+	}
+
+	// an upload of full segments reads whole, as its tail is empty
+	w, err := m.Writer(ctx, "/upload", false)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	got, err := m.GetContent(ctx, "/upload")
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+}
+
+func TestMovedContent(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	m, err := newEncryptStorageMiddleware(ctx, d, map[string]interface{}{"key": testKey})
+	require.NoError(t, err)
+
+	content := make([]byte, segmentSize+10)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+	require.NoError(t, m.PutContent(ctx, "/a", content))
+
+	// content moved by the storage driver is bound to its path
+	require.NoError(t, d.Move(ctx, "/a", "/c"))
+	_, err = m.GetContent(ctx, "/c")
+	require.ErrorContains(t, err, "encrypt: decrypting segment 0 of /c")
+
+	// content moved by the middleware is encrypted for its new path
+	require.NoError(t, m.PutContent(ctx, "/a", content))
+	require.NoError(t, m.Move(ctx, "/a", "/d"))
+	got, err := m.GetContent(ctx, "/d")
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+	_, err = d.Stat(ctx, "/a")
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	newKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	m, err := newEncryptStorageMiddleware(ctx, d, map[string]interface{}{"key": testKey})
+	require.NoError(t, err)
+	require.NoError(t, m.PutContent(ctx, "/old", []byte("old content")))
+
+	m, err = newEncryptStorageMiddleware(ctx, d, map[string]interface{}{"key": newKey})
+	require.NoError(t, err)
+	_, err = m.GetContent(ctx, "/old")
+	require.ErrorContains(t, err, "encrypt: /old is encrypted with an unknown key")
+
+	m, err = newEncryptStorageMiddleware(ctx, d, map[string]interface{}{
+		"key":          newKey,
+		"previouskeys": []interface{}{testKey},
+	})
+	require.NoError(t, err)
+	got, err := m.GetContent(ctx, "/old")
+	require.NoError(t, err)
+	require.Equal(t, []byte("old content"), got)
+}
+
+func TestFileKeys(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	m, err := newEncryptStorageMiddleware(ctx, d, map[string]interface{}{"key": testKey})
+	require.NoError(t, err)
+
+	// the same content is encrypted with a different key in every file
+	content := []byte("content")
+	require.NoError(t, m.PutContent(ctx, "/a", content))
+	require.NoError(t, m.PutContent(ctx, "/b", content))
+	a, err := d.GetContent(ctx, "/a")
+	require.NoError(t, err)
+	b, err := d.GetContent(ctx, "/b")
+	require.NoError(t, err)
+	require.NotEqual(t, a[headerSize-saltSize:headerSize], b[headerSize-saltSize:headerSize])
+	require.NotEqual(t, a[headerSize:], b[headerSize:])
+
+	// the salt authenticates the content
+	a[headerSize-1] ^= 1
+	require.NoError(t, d.PutContent(ctx, "/a", a))
+	_, err = m.GetContent(ctx, "/a")
+	require.ErrorContains(t, err, "encrypt: decrypting segment 0 of /a")
+}
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testKey+"\n"), 0o600))
+
+	for _, tc := range []struct {
+		options map[string]interface{}
+		err     string
+	}{
+		{map[string]interface{}{"keyfile": keyFile}, ""},
+		{map[string]interface{}{}, "exactly one of key, keyfile or kmsciphertext must be provided"},
+		{map[string]interface{}{"key": testKey, "keyfile": keyFile}, "exactly one of key, keyfile or kmsciphertext must be provided"},
+		{map[string]interface{}{"key": "c2hvcnQ="}, "key must be a base64 encoded key of 32 bytes"},
+		{map[string]interface{}{"key": testKey, "previouskeys": testKey}, "previouskeys must be a list of keys"},
+		{map[string]interface{}{"kmsciphertext": "Y2lwaGVydGV4dA=="}, "kmsregion must be provided with kmsciphertext"},
+	} {
+		_, err := newEncryptStorageMiddleware(ctx, inmemory.New(), tc.options)
+		if tc.err == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, tc.err)
+		}
+	}
+}
+
+func TestKMSKey(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("AWS_ACCESS_KEY_ID", "accesskey")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secretkey")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CiphertextBlob string
+		}
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" ||
+			!strings.Contains(r.Header.Get("Authorization"), "Credential=accesskey/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/us-east-1/kms/aws4_request") ||
+			json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ValidationException","message":"invalid request"}`))
+			return
+		}
+		if req.CiphertextBlob != "Y2lwaGVydGV4dA==" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidCiphertextException","message":""}`))
+			return
+		}
+		w.Write([]byte(`{"KeyId":"arn:aws:kms:us-east-1:123456789012:key/test","Plaintext":"` + testKey + `"}`))
+	}))
+	defer s.Close()
+
+	options := map[string]interface{}{
+		"kmsciphertext": "Y2lwaGVydGV4dA==",
+		"kmsregion":     "us-east-1",
+		"kmsendpoint":   s.URL,
+	}
+	m, err := newEncryptStorageMiddleware(ctx, inmemory.New(), options)
+	require.NoError(t, err)
+	_, ok := m.(*encryptStorageMiddleware).keys[m.(*encryptStorageMiddleware).current]
+	require.True(t, ok)
+
+	options["kmsciphertext"] = "b3RoZXI="
+	_, err = newEncryptStorageMiddleware(ctx, inmemory.New(), options)
+	require.EqualError(t, err, "kms: failed to decrypt the key: InvalidCiphertextException ")
+}
+
+func TestKMSKeyTimeout(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "accesskey")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secretkey")
+	defer func(timeout time.Duration) { kmsTimeout = timeout }(kmsTimeout)
+	kmsTimeout = 100 * time.Millisecond
+
+	// the endpoint never answers
+	done := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer s.Close()
+	defer close(done)
+
+	_, err := newEncryptStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{
+		"kmsciphertext": "Y2lwaGVydGV4dA==",
+		"kmsregion":     "us-east-1",
+		"kmsendpoint":   s.URL,
+	})
+	require.ErrorContains(t, err, "deadline exceeded")
+}
@@ -0,0 +1,146 @@
+// Package middleware - fastly wrapper for storage libs
+//
+// The middleware redirects clients to a Fastly service fronting the storage
+// backend, with URLs signed for the token authentication of the service.
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/requestutil"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTTL is the default time signed URLs are valid for.
+const defaultTTL = 20 * time.Minute
+
+func init() {
+	if err := storagemiddleware.Register("fastly", newFastlyStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register fastly storage middleware: %v", err)
+	}
+}
+
+// fastlyStorageMiddleware redirects clients to URLs of a Fastly service,
+// carrying a token of the form EXPIRATION_SIGNATURE in the query parameter
+// tokenparam. The signature is the hex encoded HMAC-SHA256, keyed with the
+// secret, of the path of the URL followed by the expiration, as a Unix time,
+// and by the IP address of the client when URLs are pinned to it.
+type fastlyStorageMiddleware struct {
+	storagedriver.StorageDriver
+	baseURL    *url.URL
+	secret     []byte
+	ttl        time.Duration
+	ipPinning  bool
+	tokenParam string
+	now        func() time.Time
+}
+
+var _ storagedriver.StorageDriver = &fastlyStorageMiddleware{}
+
+func newFastlyStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	m := &fastlyStorageMiddleware{
+		StorageDriver: sd,
+		ttl:           defaultTTL,
+		tokenParam:    "token",
+		now:           time.Now,
+	}
+
+	o, ok := options["baseurl"]
+	if !ok {
+		return nil, fmt.Errorf("no baseurl provided")
+	}
+	b, ok := o.(string)
+	if !ok {
+		return nil, fmt.Errorf("baseurl must be a string")
+	}
+	u, err := url.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse fastly baseurl: %s", b)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("no scheme or host specified for fastly baseurl")
+	}
+	m.baseURL = u
+
+	o, ok = options["secret"]
+	if !ok {
+		return nil, fmt.Errorf("no secret provided")
+	}
+	s, ok := o.(string)
+	if !ok {
+		return nil, fmt.Errorf("secret must be a string")
+	}
+	if m.secret, err = base64.StdEncoding.DecodeString(s); err != nil || len(m.secret) == 0 {
+		return nil, fmt.Errorf("secret must be base64 encoded")
+	}
+
+	if o, ok := options["ttl"]; ok {
+		switch ttl := o.(type) {
+		case time.Duration:
+			m.ttl = ttl
+		case string:
+			if m.ttl, err = time.ParseDuration(ttl); err != nil {
+				return nil, fmt.Errorf("invalid ttl: %s", err)
+			}
+		default:
+			return nil, fmt.Errorf("ttl must be a duration")
+		}
+		if m.ttl <= 0 {
+			return nil, fmt.Errorf("ttl must be positive")
+		}
+	}
+
+	switch ipPinning := options["ippinning"].(type) {
+	case bool:
+		m.ipPinning = ipPinning
+	case string:
+		if m.ipPinning, err = strconv.ParseBool(ipPinning); err != nil {
+			return nil, fmt.Errorf("ippinning must be a boolean")
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("ippinning must be a boolean")
+	}
+
+	if o, ok := options["tokenparam"]; ok {
+		if m.tokenParam, ok = o.(string); !ok || m.tokenParam == "" {
+			return nil, fmt.Errorf("tokenparam must be a non empty string")
+		}
+	}
+
+	return m, nil
+}
+
+// RedirectURL returns a URL of the Fastly service for the path, signed for
+// the client of the request when URLs are pinned to its IP address.
+func (m *fastlyStorageMiddleware) RedirectURL(r *http.Request, urlPath string) (string, error) {
+	u := *m.baseURL
+	u.Path = path.Join("/", u.Path, urlPath)
+
+	expiration := strconv.FormatInt(m.now().Add(m.ttl).Unix(), 10)
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(u.Path + expiration))
+	if m.ipPinning {
+		if r == nil {
+			return "", fmt.Errorf("fastly: no request to pin the URL of %s to", urlPath)
+		}
+		mac.Write([]byte(requestutil.RemoteIP(r)))
+	}
+
+	query := u.Query()
+	query.Set(m.tokenParam, expiration+"_"+hex.EncodeToString(mac.Sum(nil)))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
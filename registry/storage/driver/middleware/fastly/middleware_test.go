@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testSecret = base64.StdEncoding.EncodeToString([]byte("fastly secret"))
+
+func newTestMiddleware(t *testing.T, options map[string]interface{}) *fastlyStorageMiddleware {
+	t.Helper()
+	m, err := newFastlyStorageMiddleware(context.Background(), nil, options)
+	require.NoError(t, err)
+	fm := m.(*fastlyStorageMiddleware)
+	fm.now = func() time.Time { return time.Unix(1700000000, 0) }
+	return fm
+}
+
+// checkToken checks the token of the redirect URL u against the signed
+// message, returning the expiration of the token.
+func checkToken(t *testing.T, u *url.URL, message string) string {
+	t.Helper()
+	expiration, signature, ok := strings.Cut(u.Query().Get("token"), "_")
+	require.True(t, ok)
+	mac := hmac.New(sha256.New, []byte("fastly secret"))
+	mac.Write([]byte(u.Path + expiration + message))
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), signature)
+	return expiration
+}
+
+func TestRedirectURL(t *testing.T) {
+	m := newTestMiddleware(t, map[string]interface{}{
+		"baseurl": "https://cdn.example.com/registry",
+		"secret":  testSecret,
+		"ttl":     "5m",
+	})
+
+	redirectURL, err := m.RedirectURL(httptest.NewRequest("GET", "/", nil), "/docker/registry/v2/blobs/sha256/ab/abcd/data")
+	require.NoError(t, err)
+	u, err := url.Parse(redirectURL)
+	require.NoError(t, err)
+	require.Equal(t, "cdn.example.com", u.Host)
+	require.Equal(t, "/registry/docker/registry/v2/blobs/sha256/ab/abcd/data", u.Path)
+	require.Equal(t, "1700000300", checkToken(t, u, ""))
+}
+
+func TestIPPinning(t *testing.T) {
+	m := newTestMiddleware(t, map[string]interface{}{
+		"baseurl":    "https://cdn.example.com",
+		"secret":     testSecret,
+		"ippinning":  true,
+		"tokenparam": "auth",
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	redirectURL, err := m.RedirectURL(r, "/blob/data")
+	require.NoError(t, err)
+	u, err := url.Parse(redirectURL)
+	require.NoError(t, err)
+	u.RawQuery = url.Values{"token": {u.Query().Get("auth")}}.Encode()
+	require.Equal(t, "1700001200", checkToken(t, u, "192.0.2.1"))
+
+	_, err = m.RedirectURL(nil, "/blob/data")
+	require.Error(t, err)
+}
+
+func TestOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"secret": testSecret},
+		{"baseurl": "cdn.example.com", "secret": testSecret},
+		{"baseurl": "https://cdn.example.com"},
+		{"baseurl": "https://cdn.example.com", "secret": "not base64!"},
+		{"baseurl": "https://cdn.example.com", "secret": testSecret, "ttl": "soon"},
+		{"baseurl": "https://cdn.example.com", "secret": testSecret, "ttl": "-1m"},
+		{"baseurl": "https://cdn.example.com", "secret": testSecret, "ippinning": "maybe"},
+		{"baseurl": "https://cdn.example.com", "secret": testSecret, "tokenparam": ""},
+	} {
+		_, err := newFastlyStorageMiddleware(context.Background(), nil, options)
+		require.Error(t, err, options)
+	}
+}
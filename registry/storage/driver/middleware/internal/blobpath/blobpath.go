@@ -0,0 +1,52 @@
+// Package blobpath parses and builds the paths of blobs in the storage
+// layout of the registry, for the storage middlewares handling blobs.
+package blobpath
+
+import (
+	"path"
+	"regexp"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Root is the directory of the blobs.
+const Root = "/docker/registry/v2/blobs"
+
+// pathRegexp matches the paths of blob directories and data files, capturing
+// the algorithm and the encoded digest of the blob, and the data file name.
+var pathRegexp = regexp.MustCompile(`^/docker/registry/v2/blobs/([^/]+)/[0-9a-f]{2}/([0-9a-f]+)(/data)?$`)
+
+// Parse returns the digest of the blob of a blob directory or data file, and
+// whether p is the data file.
+func Parse(p string) (dgst digest.Digest, data bool, ok bool) {
+	match := pathRegexp.FindStringSubmatch(p)
+	if match == nil {
+		return "", false, false
+	}
+	dgst = digest.NewDigestFromEncoded(digest.Algorithm(match[1]), match[2])
+	if dgst.Validate() != nil {
+		return "", false, false
+	}
+	return dgst, match[3] != "", true
+}
+
+// Digest returns the digest of the blob whose data is stored at p.
+func Digest(p string) (digest.Digest, bool) {
+	dgst, data, ok := Parse(p)
+	if !ok || !data {
+		return "", false
+	}
+	return dgst, true
+}
+
+// IsData returns whether p is the path of a blob data file, without
+// validating the digest of the blob.
+func IsData(p string) bool {
+	match := pathRegexp.FindStringSubmatch(p)
+	return match != nil && match[3] != ""
+}
+
+// Data returns the path of the data file of a blob.
+func Data(dgst digest.Digest) string {
+	return path.Join(Root, dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded(), "data")
+}
@@ -0,0 +1,39 @@
+package blobpath
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParse(t *testing.T) {
+	dgst := digest.FromString("blob")
+	data := Data(dgst)
+	dir := data[:len(data)-len("/data")]
+
+	for _, tc := range []struct {
+		path string
+		data bool
+		ok   bool
+	}{
+		{path: data, data: true, ok: true},
+		{path: dir, ok: true},
+		{path: data + "/more"},
+		{path: "/docker/registry/v2/repositories/foo/_layers/sha256/" + dgst.Encoded() + "/link"},
+		{path: "/docker/registry/v2/blobs/sha256/ab/abcd"},
+	} {
+		parsed, isData, ok := Parse(tc.path)
+		if ok != tc.ok || isData != tc.data || (ok && parsed != dgst) {
+			t.Errorf("unexpected parse of %s: %s, %t, %t", tc.path, parsed, isData, ok)
+		}
+		if IsData(tc.path) != (tc.ok && tc.data) {
+			t.Errorf("unexpected data file match of %s", tc.path)
+		}
+	}
+
+	// the digest of a data file is validated when it is parsed only
+	p := "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+	if _, ok := Digest(p); ok || !IsData(p) {
+		t.Errorf("unexpected match of %s with an invalid digest", p)
+	}
+}
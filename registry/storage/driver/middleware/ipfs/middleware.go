@@ -0,0 +1,367 @@
+// Package middleware - ipfs wrapper for storage libs
+//
+// The middleware stores the blobs committed from uploads in IPFS, through
+// the HTTP RPC API of an IPFS node. Their data files in the storage driver
+// only hold a pointer to the CID of their content, while everything else,
+// such as manifests and tags, stays in the storage driver.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/distribution/distribution/v3/registry/storage/driver/middleware/internal/blobpath"
+	"github.com/sirupsen/logrus"
+)
+
+// pointerMagic starts the pointers stored in place of blob data. Blobs
+// stored with PutContent are manifests, which cannot start with it.
+const pointerMagic = "\x00ipfs-blob\x00"
+
+// maxPointerSize bounds the size of pointers, so that only small data
+// files are read to check whether they are pointers.
+const maxPointerSize = 1024
+
+func init() {
+	if err := storagemiddleware.Register("ipfs", newIPFSStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register ipfs storage middleware: %v", err)
+	}
+}
+
+// pointer is stored in place of the data of a blob stored in IPFS.
+type pointer struct {
+	CID  string `json:"cid"`
+	Size int64  `json:"size"`
+}
+
+type ipfsStorageMiddleware struct {
+	storagedriver.StorageDriver
+	apiURL  *url.URL
+	gateway *url.URL
+	pin     bool
+	client  *http.Client
+}
+
+var _ storagedriver.StorageDriver = &ipfsStorageMiddleware{}
+
+func newIPFSStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	m := &ipfsStorageMiddleware{
+		StorageDriver: sd,
+		pin:           true,
+		client:        http.DefaultClient,
+	}
+
+	o, ok := options["apiurl"]
+	if !ok {
+		return nil, fmt.Errorf("no apiurl provided")
+	}
+	apiURL, err := parseURL("apiurl", o)
+	if err != nil {
+		return nil, err
+	}
+	m.apiURL = apiURL
+
+	if o, ok := options["gateway"]; ok {
+		gateway, err := parseURL("gateway", o)
+		if err != nil {
+			return nil, err
+		}
+		m.gateway = gateway
+	}
+
+	switch pin := options["pin"].(type) {
+	case bool:
+		m.pin = pin
+	case string:
+		if m.pin, err = strconv.ParseBool(pin); err != nil {
+			return nil, fmt.Errorf("pin must be a boolean")
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("pin must be a boolean")
+	}
+
+	if o, ok := options["timeout"]; ok {
+		s, ok := o.(string)
+		if !ok {
+			return nil, fmt.Errorf("timeout must be a string")
+		}
+		timeout, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %v", err)
+		}
+		m.client = &http.Client{Timeout: timeout}
+	}
+
+	return m, nil
+}
+
+func parseURL(name string, o interface{}) (*url.URL, error) {
+	s, ok := o.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string", name)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", name, s)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("no scheme or host specified for %s", name)
+	}
+	return u, nil
+}
+
+// Move adds the content of blobs moved into place, once uploaded, to IPFS,
+// storing a pointer to its CID in place of the blob data.
+func (m *ipfsStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if !blobpath.IsData(destPath) {
+		return m.StorageDriver.Move(ctx, sourcePath, destPath)
+	}
+
+	fi, err := m.StorageDriver.Stat(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	rc, err := m.StorageDriver.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	cid, err := m.add(ctx, rc)
+	if err != nil {
+		return err
+	}
+	p, err := json.Marshal(pointer{CID: cid, Size: fi.Size()})
+	if err != nil {
+		return err
+	}
+	if err := m.StorageDriver.PutContent(ctx, destPath, append([]byte(pointerMagic), p...)); err != nil {
+		return err
+	}
+	return m.StorageDriver.Delete(ctx, sourcePath)
+}
+
+// Stat returns the size of the content of blobs stored in IPFS.
+func (m *ipfsStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	p, fi, err := m.pointer(ctx, path)
+	if err != nil || p == nil {
+		return fi, err
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    path,
+		Size:    p.Size,
+		ModTime: fi.ModTime(),
+	}}, nil
+}
+
+// GetContent retrieves the content of blobs stored in IPFS from IPFS.
+func (m *ipfsStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if !blobpath.IsData(path) {
+		return m.StorageDriver.GetContent(ctx, path)
+	}
+	rc, err := m.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Reader reads the content of blobs stored in IPFS from IPFS.
+func (m *ipfsStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if !blobpath.IsData(path) {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+	p, _, err := m.pointer(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+	if offset > p.Size {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.Name()}
+	}
+	if offset == p.Size {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return m.cat(ctx, p.CID, offset)
+}
+
+// RedirectURL redirects to the gateway for blobs stored in IPFS, when a
+// gateway is configured.
+func (m *ipfsStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	if m.gateway == nil || !blobpath.IsData(path) {
+		return m.StorageDriver.RedirectURL(r, path)
+	}
+
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	p, _, err := m.pointer(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if p == nil {
+		return m.StorageDriver.RedirectURL(r, path)
+	}
+	u := m.gateway.JoinPath("ipfs", p.CID)
+	return u.String(), nil
+}
+
+// Delete unpins the content of the blob deleted, if it is stored in IPFS.
+// Blobs are deleted with their directory.
+func (m *ipfsStorageMiddleware) Delete(ctx context.Context, path string) error {
+	dataPath := path
+	if !blobpath.IsData(dataPath) {
+		dataPath = strings.TrimSuffix(path, "/") + "/data"
+	}
+
+	var p *pointer
+	if m.pin && blobpath.IsData(dataPath) {
+		var err error
+		if p, _, err = m.pointer(ctx, dataPath); err != nil {
+			var pathNotFound storagedriver.PathNotFoundError
+			if !errors.As(err, &pathNotFound) {
+				return err
+			}
+		}
+	}
+
+	if err := m.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	if p != nil {
+		// the content only stays pinned if unpinning fails, to be removed
+		// with the IPFS node tools
+		if err := m.unpin(ctx, p.CID); err != nil {
+			dcontext.GetLogger(ctx).Warnf("ipfs: error unpinning %s of %s: %v", p.CID, dataPath, err)
+		}
+	}
+	return nil
+}
+
+// pointer returns the pointer stored at path, which is nil if the file at
+// path is not the data of a blob stored in IPFS, and the file info of path.
+func (m *ipfsStorageMiddleware) pointer(ctx context.Context, path string) (*pointer, storagedriver.FileInfo, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() || fi.Size() > maxPointerSize || !blobpath.IsData(path) {
+		return nil, fi, err
+	}
+	content, err := m.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(content, []byte(pointerMagic)) {
+		return nil, fi, nil
+	}
+	var p pointer
+	if err := json.Unmarshal(content[len(pointerMagic):], &p); err != nil {
+		return nil, nil, fmt.Errorf("ipfs: invalid pointer at %s: %v", path, err)
+	}
+	return &p, fi, nil
+}
+
+// add adds content to IPFS, returning its CID.
+func (m *ipfsStorageMiddleware) add(ctx context.Context, content io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", "data")
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp, err := m.call(ctx, "add", url.Values{
+		"cid-version": {"1"},
+		"raw-leaves":  {"true"},
+		"pin":         {strconv.FormatBool(m.pin)},
+		"quieter":     {"true"},
+	}, pr, mw.FormDataContentType())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var added struct {
+		Hash string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		return "", fmt.Errorf("ipfs add: %v", err)
+	}
+	if added.Hash == "" {
+		return "", fmt.Errorf("ipfs add: no CID returned")
+	}
+	return added.Hash, nil
+}
+
+// cat reads the content of cid from offset.
+func (m *ipfsStorageMiddleware) cat(ctx context.Context, cid string, offset int64) (io.ReadCloser, error) {
+	resp, err := m.call(ctx, "cat", url.Values{
+		"arg":    {cid},
+		"offset": {strconv.FormatInt(offset, 10)},
+	}, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (m *ipfsStorageMiddleware) unpin(ctx context.Context, cid string) error {
+	resp, err := m.call(ctx, "pin/rm", url.Values{"arg": {cid}}, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// call calls a command of the HTTP RPC API of the IPFS node.
+func (m *ipfsStorageMiddleware) call(ctx context.Context, command string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := m.apiURL.JoinPath("api/v0", command)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ipfs %s: %v", command, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Message == "" {
+			return nil, fmt.Errorf("ipfs %s: unexpected status %s", command, resp.Status)
+		}
+		return nil, fmt.Errorf("ipfs %s: %s", command, apiErr.Message)
+	}
+	return resp, nil
+}
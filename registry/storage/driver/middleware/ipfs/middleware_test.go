@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+// testIPFS is a fake IPFS node, serving the commands of the HTTP RPC API
+// used by the middleware.
+type testIPFS struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	content map[string][]byte
+	pinned  map[string]bool
+}
+
+func newTestIPFS(t *testing.T) *testIPFS {
+	n := &testIPFS{
+		content: make(map[string][]byte),
+		pinned:  make(map[string]bool),
+	}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serveHTTP))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *testIPFS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"Message":"` + msg + `","Code":0,"Type":"error"}`))
+	}
+	if r.Method != http.MethodPost {
+		fail(http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/api/v0/add":
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		content, err := io.ReadAll(f)
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		sum := sha256.Sum256(content)
+		cid := "bafk" + hex.EncodeToString(sum[:])
+		n.content[cid] = content
+		if q.Get("pin") == "true" {
+			n.pinned[cid] = true
+		}
+		w.Write([]byte(`{"Name":"data","Hash":"` + cid + `","Size":"` + strconv.Itoa(len(content)) + `"}`))
+	case "/api/v0/cat":
+		content, ok := n.content[q.Get("arg")]
+		if !ok {
+			fail(http.StatusInternalServerError, "block not found")
+			return
+		}
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		w.Write(content[offset:])
+	case "/api/v0/pin/rm":
+		if !n.pinned[q.Get("arg")] {
+			fail(http.StatusInternalServerError, "not pinned or pinned indirectly")
+			return
+		}
+		delete(n.pinned, q.Get("arg"))
+		w.Write([]byte(`{"Pins":["` + q.Get("arg") + `"]}`))
+	default:
+		fail(http.StatusNotFound, "unknown command")
+	}
+}
+
+func (n *testIPFS) isPinned(cid string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.pinned[cid]
+}
+
+const (
+	testUploadPath = "/docker/registry/v2/repositories/foo/_uploads/id/data"
+	testBlobDir    = "/docker/registry/v2/blobs/sha256/ab/ab01"
+	testBlobPath   = testBlobDir + "/data"
+)
+
+func TestNoConfig(t *testing.T) {
+	_, err := newIPFSStorageMiddleware(context.Background(), nil, map[string]interface{}{})
+	require.ErrorContains(t, err, "no apiurl provided")
+
+	_, err = newIPFSStorageMiddleware(context.Background(), nil, map[string]interface{}{"apiurl": "localhost:5001"})
+	require.ErrorContains(t, err, "no scheme or host specified for apiurl")
+
+	_, err = newIPFSStorageMiddleware(context.Background(), nil, map[string]interface{}{"apiurl": "http://localhost:5001", "pin": "maybe"})
+	require.ErrorContains(t, err, "pin must be a boolean")
+}
+
+func TestBlobsStoredInIPFS(t *testing.T) {
+	ctx := context.Background()
+	node := newTestIPFS(t)
+	base := inmemory.New()
+	d, err := newIPFSStorageMiddleware(ctx, base, map[string]interface{}{
+		"apiurl":  node.URL,
+		"gateway": "https://ipfs.example.com",
+	})
+	require.NoError(t, err)
+
+	content := []byte(strings.Repeat("layer content ", 200))
+	require.NoError(t, d.PutContent(ctx, testUploadPath, content))
+	require.NoError(t, d.Move(ctx, testUploadPath, testBlobPath))
+
+	// the upload is moved, and the blob data only holds a pointer
+	_, err = d.Stat(ctx, testUploadPath)
+	require.ErrorAs(t, err, new(storagedriver.PathNotFoundError))
+	stored, err := base.GetContent(ctx, testBlobPath)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(stored), pointerMagic))
+	sum := sha256.Sum256(content)
+	cid := "bafk" + hex.EncodeToString(sum[:])
+	require.True(t, node.isPinned(cid))
+
+	fi, err := d.Stat(ctx, testBlobPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fi.Size())
+
+	got, err := d.GetContent(ctx, testBlobPath)
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+
+	rc, err := d.Reader(ctx, testBlobPath, 100)
+	require.NoError(t, err)
+	got, err = io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	require.Equal(t, content[100:], got)
+
+	_, err = d.Reader(ctx, testBlobPath, int64(len(content))+1)
+	require.ErrorAs(t, err, new(storagedriver.InvalidOffsetError))
+
+	url, err := d.RedirectURL(nil, testBlobPath)
+	require.NoError(t, err)
+	require.Equal(t, "https://ipfs.example.com/ipfs/"+cid, url)
+
+	// deleting the blob unpins its content
+	require.NoError(t, d.Delete(ctx, testBlobDir))
+	require.False(t, node.isPinned(cid))
+	_, err = d.Stat(ctx, testBlobPath)
+	require.ErrorAs(t, err, new(storagedriver.PathNotFoundError))
+}
+
+func TestOtherContentStoredInDriver(t *testing.T) {
+	ctx := context.Background()
+	node := newTestIPFS(t)
+	base := inmemory.New()
+	d, err := newIPFSStorageMiddleware(ctx, base, map[string]interface{}{
+		"apiurl": node.URL,
+	})
+	require.NoError(t, err)
+
+	// blobs put in one go, such as manifests, stay in the driver
+	manifest := []byte(`{"schemaVersion":2}`)
+	require.NoError(t, d.PutContent(ctx, testBlobPath, manifest))
+	got, err := base.GetContent(ctx, testBlobPath)
+	require.NoError(t, err)
+	require.Equal(t, manifest, got)
+	fi, err := d.Stat(ctx, testBlobPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(manifest)), fi.Size())
+	got, err = d.GetContent(ctx, testBlobPath)
+	require.NoError(t, err)
+	require.Equal(t, manifest, got)
+
+	// so do files moved elsewhere
+	require.NoError(t, d.PutContent(ctx, testUploadPath, []byte("content")))
+	require.NoError(t, d.Move(ctx, testUploadPath, testUploadPath+"2"))
+	got, err = base.GetContent(ctx, testUploadPath+"2")
+	require.NoError(t, err)
+	require.Equal(t, []byte("content"), got)
+
+	require.NoError(t, d.Delete(ctx, testBlobDir))
+	require.Empty(t, node.content)
+}
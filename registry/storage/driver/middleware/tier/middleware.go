@@ -0,0 +1,542 @@
+// Package middleware - tier wrapper for storage libs
+//
+// The middleware stores the blobs in two storage drivers: the hot tier, the
+// storage driver it wraps, and the cold tier, a cheaper storage driver it
+// creates. Blobs not read within a configured duration are periodically
+// migrated to the cold tier, and are promoted back to the hot tier when they
+// are read again. Everything but the data of blobs, such as manifests, tags
+// and uploads, stays in the hot tier.
+//
+// The tier of each blob and the time it was last read are recorded in the
+// hot tier, under /docker/registry/v2/_tiering, so that the blobs missing from
+// the hot tier are looked up in the cold tier only if they were migrated.
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/distribution/distribution/v3/registry/storage/driver/middleware/internal/blobpath"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stateRoot = "/docker/registry/v2/_tiering"
+
+	tierHot  = "hot"
+	tierCold = "cold"
+
+	// defaultAfter is the default duration after which blobs not read are
+	// migrated to the cold tier.
+	defaultAfter = 30 * 24 * time.Hour
+
+	// defaultInterval is the default interval between migrations.
+	defaultInterval = 24 * time.Hour
+
+	// accessFlushInterval is the interval between the writes of the times
+	// blobs were last read, which are kept in memory in between.
+	accessFlushInterval = 5 * time.Minute
+)
+
+// tieredBlobsCount counts the blobs moved between the tiers.
+var tieredBlobsCount = prometheus.StorageNamespace.NewLabeledCounter("tiered_blobs", "The number of blobs moved between the storage tiers", "tier")
+
+func init() {
+	if err := storagemiddleware.Register("tier", newTierStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register tier storage middleware: %v", err)
+	}
+}
+
+// blobState is the tiering state of a blob, recorded in the hot tier.
+type blobState struct {
+	Tier       string    `json:"tier"`
+	LastAccess time.Time `json:"lastaccess"`
+}
+
+type tierStorageMiddleware struct {
+	storagedriver.StorageDriver
+	cold  storagedriver.StorageDriver
+	after time.Duration
+
+	mu       sync.Mutex
+	accessed map[digest.Digest]time.Time
+	// promoting holds the blobs being promoted, closed once promoted
+	promoting map[digest.Digest]chan struct{}
+}
+
+var _ storagedriver.StorageDriver = &tierStorageMiddleware{}
+
+func newTierStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	name, parameters, err := parseCold(options["cold"])
+	if err != nil {
+		return nil, err
+	}
+	cold, err := factory.Create(ctx, name, parameters)
+	if err != nil {
+		return nil, fmt.Errorf("tier: creating cold %s driver: %v", name, err)
+	}
+
+	after, err := parseDuration(options, "after", defaultAfter)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := parseDuration(options, "interval", defaultInterval)
+	if err != nil {
+		return nil, err
+	}
+	migrate := true
+	if v, ok := options["migrate"]; ok {
+		if migrate, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("migrate must be a boolean")
+		}
+	}
+
+	m := &tierStorageMiddleware{
+		StorageDriver: sd,
+		cold:          cold,
+		after:         after,
+		accessed:      make(map[digest.Digest]time.Time),
+		promoting:     make(map[digest.Digest]chan struct{}),
+	}
+	go m.run(ctx, interval, migrate)
+	return m, nil
+}
+
+// parseCold parses the configuration of the cold tier, which has the form of
+// the storage section: the name of the storage driver and its parameters.
+func parseCold(o interface{}) (string, map[string]interface{}, error) {
+	var drivers map[string]interface{}
+	switch v := o.(type) {
+	case map[string]interface{}:
+		drivers = v
+	case map[interface{}]interface{}:
+		drivers = make(map[string]interface{}, len(v))
+		for k, params := range v {
+			drivers[fmt.Sprint(k)] = params
+		}
+	case nil:
+		return "", nil, fmt.Errorf("no cold storage driver provided")
+	default:
+		return "", nil, fmt.Errorf("cold must be a storage driver configuration")
+	}
+	if len(drivers) > 1 {
+		return "", nil, fmt.Errorf("cold must configure exactly one storage driver, got %d", len(drivers))
+	}
+
+	for name, params := range drivers {
+		parameters := make(map[string]interface{})
+		switch params := params.(type) {
+		case map[string]interface{}:
+			parameters = params
+		case map[interface{}]interface{}:
+			for k, v := range params {
+				parameters[fmt.Sprint(k)] = v
+			}
+		case nil:
+		default:
+			return "", nil, fmt.Errorf("invalid parameters of the cold %s driver", name)
+		}
+		return name, parameters, nil
+	}
+	return "", nil, fmt.Errorf("no cold storage driver provided")
+}
+
+func parseDuration(options map[string]interface{}, key string, defaultValue time.Duration) (time.Duration, error) {
+	v, ok := options[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("%s must be a duration", key)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive, %s invalid", key, s)
+	}
+	return d, nil
+}
+
+func statePath(dgst digest.Digest) string {
+	return path.Join(stateRoot, dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded())
+}
+
+func isNotFound(err error) bool {
+	return errors.As(err, &storagedriver.PathNotFoundError{})
+}
+
+// state returns the tiering state of the blob, the zero state if it has none.
+func (m *tierStorageMiddleware) state(ctx context.Context, dgst digest.Digest) (blobState, error) {
+	content, err := m.StorageDriver.GetContent(ctx, statePath(dgst))
+	if err != nil {
+		if isNotFound(err) {
+			return blobState{}, nil
+		}
+		return blobState{}, err
+	}
+	var state blobState
+	if err := json.Unmarshal(content, &state); err != nil {
+		dcontext.GetLogger(ctx).Warnf("tier: discarding unreadable state of %s: %v", dgst, err)
+		return blobState{}, nil
+	}
+	return state, nil
+}
+
+func (m *tierStorageMiddleware) putState(ctx context.Context, dgst digest.Digest, state blobState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return m.StorageDriver.PutContent(ctx, statePath(dgst), content)
+}
+
+// isCold reports whether the blob missing from the hot tier was migrated to
+// the cold tier.
+func (m *tierStorageMiddleware) isCold(ctx context.Context, dgst digest.Digest) (bool, error) {
+	state, err := m.state(ctx, dgst)
+	return state.Tier == tierCold, err
+}
+
+// recordAccess records that the blob was read, until the next flush.
+func (m *tierStorageMiddleware) recordAccess(dgst digest.Digest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accessed[dgst] = time.Now().UTC()
+}
+
+// Stat reports the blobs of the cold tier as if they were in the hot tier.
+func (m *tierStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if !isNotFound(err) {
+		return fi, err
+	}
+	dgst, data, ok := blobpath.Parse(path)
+	if !ok || !data {
+		return fi, err
+	}
+	if cold, stateErr := m.isCold(ctx, dgst); stateErr != nil || !cold {
+		return fi, err
+	}
+	return m.cold.Stat(ctx, path)
+}
+
+// Reader promotes the blobs of the cold tier to the hot tier before reading
+// them.
+func (m *tierStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	dgst, data, ok := blobpath.Parse(path)
+	if !ok || !data {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+	rc, err := m.StorageDriver.Reader(ctx, path, offset)
+	if isNotFound(err) {
+		var promoted bool
+		if promoted, err = m.promote(ctx, dgst); err == nil && promoted {
+			rc, err = m.StorageDriver.Reader(ctx, path, offset)
+		} else if err == nil {
+			err = storagedriver.PathNotFoundError{Path: path}
+		}
+	}
+	if err == nil {
+		m.recordAccess(dgst)
+	}
+	return rc, err
+}
+
+// GetContent retrieves the content of blobs through Reader, so that the
+// blobs of the cold tier are promoted.
+func (m *tierStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if _, data, ok := blobpath.Parse(path); !ok || !data {
+		return m.StorageDriver.GetContent(ctx, path)
+	}
+	rc, err := m.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// RedirectURL promotes the blobs of the cold tier before redirecting to the
+// hot tier, so that clients are never redirected to the cold tier.
+func (m *tierStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	dgst, data, ok := blobpath.Parse(path)
+	if !ok || !data {
+		return m.StorageDriver.RedirectURL(r, path)
+	}
+	ctx := r.Context()
+	if _, err := m.StorageDriver.Stat(ctx, path); err != nil {
+		if !isNotFound(err) {
+			return "", err
+		}
+		if promoted, err := m.promote(ctx, dgst); err != nil || !promoted {
+			return "", err
+		}
+	}
+	m.recordAccess(dgst)
+	return m.StorageDriver.RedirectURL(r, path)
+}
+
+// Delete deletes the blobs from both tiers, along with their state.
+func (m *tierStorageMiddleware) Delete(ctx context.Context, path string) error {
+	err := m.StorageDriver.Delete(ctx, path)
+	dgst, _, ok := blobpath.Parse(path)
+	if !ok {
+		return err
+	}
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	cold, stateErr := m.isCold(ctx, dgst)
+	if stateErr != nil {
+		return stateErr
+	}
+	if cold {
+		if coldErr := m.cold.Delete(ctx, path); coldErr != nil && !isNotFound(coldErr) {
+			return coldErr
+		} else if coldErr == nil {
+			err = nil
+		}
+	}
+	if stateErr := m.StorageDriver.Delete(ctx, statePath(dgst)); stateErr != nil && !isNotFound(stateErr) {
+		return stateErr
+	}
+
+	m.mu.Lock()
+	delete(m.accessed, dgst)
+	m.mu.Unlock()
+	return err
+}
+
+// List lists the blobs of both tiers.
+func (m *tierStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	hot, err := m.StorageDriver.List(ctx, path)
+	if path != blobpath.Root && !strings.HasPrefix(path, blobpath.Root+"/") {
+		return hot, err
+	}
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	cold, coldErr := m.cold.List(ctx, path)
+	if coldErr != nil {
+		if isNotFound(coldErr) {
+			return hot, err
+		}
+		return nil, coldErr
+	}
+
+	seen := make(map[string]struct{}, len(hot))
+	for _, p := range hot {
+		seen[p] = struct{}{}
+	}
+	for _, p := range cold {
+		if _, ok := seen[p]; !ok {
+			hot = append(hot, p)
+		}
+	}
+	sort.Strings(hot)
+	return hot, nil
+}
+
+// Walk walks the blobs of both tiers.
+func (m *tierStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	if path == blobpath.Root || strings.HasPrefix(path, blobpath.Root+"/") || strings.HasPrefix(blobpath.Root, strings.TrimSuffix(path, "/")+"/") {
+		return storagedriver.WalkFallback(ctx, m, path, f, options...)
+	}
+	return m.StorageDriver.Walk(ctx, path, f, options...)
+}
+
+// promote moves the blob from the cold tier to the hot tier, if it was
+// migrated. Concurrent promotions of a blob wait for the first one.
+func (m *tierStorageMiddleware) promote(ctx context.Context, dgst digest.Digest) (bool, error) {
+	m.mu.Lock()
+	if done, ok := m.promoting[dgst]; ok {
+		m.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		_, err := m.StorageDriver.Stat(ctx, blobpath.Data(dgst))
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	done := make(chan struct{})
+	m.promoting[dgst] = done
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.promoting, dgst)
+		m.mu.Unlock()
+		close(done)
+	}()
+
+	cold, err := m.isCold(ctx, dgst)
+	if err != nil || !cold {
+		return false, err
+	}
+	if err := move(ctx, m.cold, m.StorageDriver, blobpath.Data(dgst)); err != nil {
+		return false, fmt.Errorf("tier: promoting %s: %w", dgst, err)
+	}
+	if err := m.putState(ctx, dgst, blobState{Tier: tierHot, LastAccess: time.Now().UTC()}); err != nil {
+		return false, err
+	}
+	if err := m.cold.Delete(ctx, blobpath.Data(dgst)); err != nil && !isNotFound(err) {
+		dcontext.GetLogger(ctx).Warnf("tier: deleting promoted %s from the cold tier: %v", dgst, err)
+	}
+	tieredBlobsCount.WithValues(tierHot).Inc(1)
+	dcontext.GetLogger(ctx).Infof("tier: promoted %s to the hot tier", dgst)
+	return true, nil
+}
+
+// move copies the file at path from one storage driver to another.
+func move(ctx context.Context, from, to storagedriver.StorageDriver, path string) error {
+	fi, err := from.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+	rc, err := from.Reader(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	fw, err := to.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(fw, rc)
+	if err == nil && n != fi.Size() {
+		err = fmt.Errorf("copied %d bytes out of %d", n, fi.Size())
+	}
+	if err != nil {
+		fw.Cancel(ctx)
+		return err
+	}
+	if err := fw.Commit(ctx); err != nil {
+		return err
+	}
+	return fw.Close()
+}
+
+// run flushes the times blobs were read, and migrates the blobs not read
+// recently to the cold tier every interval, until the context is done.
+func (m *tierStorageMiddleware) run(ctx context.Context, interval time.Duration, migrate bool) {
+	flushTicker := time.NewTicker(accessFlushInterval)
+	defer flushTicker.Stop()
+	var migrateTicks <-chan time.Time
+	if migrate {
+		migrateTicker := time.NewTicker(interval)
+		defer migrateTicker.Stop()
+		migrateTicks = migrateTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushTicker.C:
+			m.flush(ctx)
+		case <-migrateTicks:
+			m.flush(ctx)
+			if err := m.migrate(ctx, time.Now().Add(-m.after)); err != nil {
+				dcontext.GetLogger(ctx).Errorf("tier: migrating blobs to the cold tier: %v", err)
+			}
+		}
+	}
+}
+
+// flush records the times blobs were last read in their state.
+func (m *tierStorageMiddleware) flush(ctx context.Context) {
+	m.mu.Lock()
+	accessed := m.accessed
+	m.accessed = make(map[digest.Digest]time.Time)
+	m.mu.Unlock()
+
+	for dgst, t := range accessed {
+		err := m.putState(ctx, dgst, blobState{Tier: tierHot, LastAccess: t})
+		if err != nil {
+			dcontext.GetLogger(ctx).Warnf("tier: recording the last read of %s: %v", dgst, err)
+		}
+	}
+}
+
+// migrate moves the blobs of the hot tier neither read nor written since
+// before to the cold tier.
+func (m *tierStorageMiddleware) migrate(ctx context.Context, before time.Time) error {
+	var stale []digest.Digest
+	err := m.StorageDriver.Walk(ctx, blobpath.Root, func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() {
+			return nil
+		}
+		dgst, data, ok := blobpath.Parse(fi.Path())
+		if !ok || !data || !fi.ModTime().Before(before) {
+			return nil
+		}
+		stale = append(stale, dgst)
+		return nil
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	var migrated int
+	for _, dgst := range stale {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		state, err := m.state(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		_, accessed := m.accessed[dgst]
+		_, promoting := m.promoting[dgst]
+		m.mu.Unlock()
+		if accessed || promoting || !state.LastAccess.Before(before) {
+			continue
+		}
+
+		if err := move(ctx, m.StorageDriver, m.cold, blobpath.Data(dgst)); err != nil {
+			dcontext.GetLogger(ctx).Errorf("tier: migrating %s: %v", dgst, err)
+			continue
+		}
+		// the state is recorded first, so that the blob is found in the cold
+		// tier as soon as it leaves the hot one
+		if err := m.putState(ctx, dgst, blobState{Tier: tierCold, LastAccess: state.LastAccess}); err != nil {
+			return err
+		}
+		if err := m.StorageDriver.Delete(ctx, blobpath.Data(dgst)); err != nil && !isNotFound(err) {
+			return err
+		}
+		tieredBlobsCount.WithValues(tierCold).Inc(1)
+		migrated++
+	}
+	dcontext.GetLogger(ctx).Infof("tier: migrated %d blobs to the cold tier", migrated)
+	return nil
+}
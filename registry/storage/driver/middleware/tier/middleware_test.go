@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"path"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/middleware/internal/blobpath"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMiddleware(t *testing.T, hot storagedriver.StorageDriver) *tierStorageMiddleware {
+	t.Helper()
+	m, err := newTierStorageMiddleware(context.Background(), hot, map[string]interface{}{
+		"cold":    map[interface{}]interface{}{"inmemory": nil},
+		"migrate": false,
+	})
+	require.NoError(t, err)
+	return m.(*tierStorageMiddleware)
+}
+
+func TestTierDriverSuite(t *testing.T) {
+	// both tiers hold their content in memory
+	testsuites.DriverWithoutLargeStreams(t, func() (storagedriver.StorageDriver, error) {
+		return newTestMiddleware(t, inmemory.New()), nil
+	})
+}
+
+func TestOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"cold": "inmemory"},
+		{"cold": map[string]interface{}{"inmemory": nil, "filesystem": nil}},
+		{"cold": map[string]interface{}{"unknown": nil}},
+		{"cold": map[string]interface{}{"inmemory": nil}, "after": "-1h"},
+		{"cold": map[string]interface{}{"inmemory": nil}, "interval": 24},
+	} {
+		_, err := newTierStorageMiddleware(context.Background(), inmemory.New(), options)
+		require.Error(t, err, "options %v", options)
+	}
+}
+
+func readBlob(t *testing.T, d storagedriver.StorageDriver, p string) []byte {
+	t.Helper()
+	rc, err := d.Reader(context.Background(), p, 0)
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return content
+}
+
+func TestMigrateAndPromote(t *testing.T) {
+	ctx := context.Background()
+	hot := inmemory.New()
+	m := newTestMiddleware(t, hot)
+
+	content := make([]byte, 1000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	dgst := digest.FromBytes(content)
+	p := blobpath.Data(dgst)
+	require.NoError(t, m.PutContent(ctx, p, content))
+
+	// blobs written or read recently are not migrated
+	require.NoError(t, m.migrate(ctx, time.Now().Add(-time.Hour)))
+	_, err = hot.Stat(ctx, p)
+	require.NoError(t, err)
+
+	require.NoError(t, m.migrate(ctx, time.Now().Add(time.Hour)))
+	_, err = hot.Stat(ctx, p)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+	_, err = m.cold.Stat(ctx, p)
+	require.NoError(t, err)
+
+	// migrated blobs are still found and listed
+	fi, err := m.Stat(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fi.Size())
+	list, err := m.List(ctx, path.Dir(p))
+	require.NoError(t, err)
+	require.Equal(t, []string{p}, list)
+
+	// and promoted when read
+	require.Equal(t, content, readBlob(t, m, p))
+	_, err = hot.Stat(ctx, p)
+	require.NoError(t, err)
+	_, err = m.cold.Stat(ctx, p)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	// the last read is recorded
+	require.NoError(t, m.migrate(ctx, time.Now().Add(time.Hour)))
+	_, err = hot.Stat(ctx, p)
+	require.NoError(t, err)
+	m.flush(ctx)
+	require.NoError(t, m.migrate(ctx, time.Now().Add(-time.Hour)))
+	_, err = hot.Stat(ctx, p)
+	require.NoError(t, err)
+
+	// migrated blobs are deleted from the cold tier
+	require.NoError(t, m.migrate(ctx, time.Now().Add(time.Hour)))
+	require.NoError(t, m.Delete(ctx, path.Dir(p)))
+	_, err = m.Stat(ctx, p)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+	_, err = m.cold.Stat(ctx, p)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+	_, err = hot.Stat(ctx, statePath(dgst))
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	// blobs which were never migrated are not looked up in the cold tier
+	_, err = m.Reader(ctx, blobpath.Data(digest.FromString("unknown")), 0)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+}
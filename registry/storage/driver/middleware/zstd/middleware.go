@@ -0,0 +1,436 @@
+// Package middleware - zstd wrapper for storage libs
+//
+// The middleware compresses the blobs committed from uploads with zstd,
+// for backends charged by the byte stored. Blobs are compressed in frames of
+// a fixed size, indexed at the end of the file, so that they can be read from
+// any offset. Everything else, such as manifests, tags and uploads in
+// progress, is stored as is, as are the blobs which do not compress, such as
+// layers already compressed with gzip.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/distribution/distribution/v3/registry/storage/driver/middleware/internal/blobpath"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// Compressed blobs start with a header of magic and the size of their
+// content, followed by its zstd frames and a skippable frame indexing the
+// compressed size of the frames, which zstd decoders skip. The index ends with
+// the number of frames and indexMagic.
+const (
+	magic      = "\x00zstd-blob\x00"
+	headerSize = len(magic) + 8
+
+	frameSize = 1 << 20
+
+	skippableFrameMagic = 0x184D2A50
+	indexMagic          = "zidx"
+	indexFooterSize     = 4 + len(indexMagic)
+
+	// maxRatio is the compression ratio of the first frame of a blob above
+	// which the blob is stored as is.
+	maxRatio = 0.9
+
+	// maxCachedHeaders bounds the number of blob headers cached by Stat.
+	maxCachedHeaders = 10000
+)
+
+func init() {
+	if err := storagemiddleware.Register("zstd", newZstdStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register zstd storage middleware: %v", err)
+	}
+}
+
+type zstdStorageMiddleware struct {
+	storagedriver.StorageDriver
+	encoder *zstd.Encoder
+
+	// headers caches the headers of the blobs, so that they are not read
+	// on every Stat. Blobs are immutable once moved into place, so an entry
+	// is valid as long as the size and modification time of the file are.
+	headersMu sync.Mutex
+	headers   map[string]cachedHeader
+}
+
+// cachedHeader is the header of a blob, cached with the size and modification
+// time of the file it was read from.
+type cachedHeader struct {
+	fileSize   int64
+	modTime    time.Time
+	size       int64
+	compressed bool
+}
+
+var _ storagedriver.StorageDriver = &zstdStorageMiddleware{}
+
+func newZstdStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	level := zstd.SpeedDefault
+	if o, ok := options["level"]; ok {
+		s, ok := o.(string)
+		if !ok {
+			return nil, fmt.Errorf("level must be a string")
+		}
+		var valid bool
+		if valid, level = zstd.EncoderLevelFromString(s); !valid {
+			return nil, fmt.Errorf("level must be one of fastest, default, better or best, %s invalid", s)
+		}
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdStorageMiddleware{
+		StorageDriver: sd,
+		encoder:       encoder,
+		headers:       make(map[string]cachedHeader),
+	}, nil
+}
+
+// Move compresses the content of blobs moved into place, once uploaded,
+// unless it does not compress.
+func (m *zstdStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	dgst, ok := blobpath.Digest(destPath)
+	if !ok || !dgst.Algorithm().Available() {
+		return m.StorageDriver.Move(ctx, sourcePath, destPath)
+	}
+
+	fi, err := m.StorageDriver.Stat(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	rc, err := m.StorageDriver.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	buf := make([]byte, frameSize)
+	n, err := io.ReadFull(rc, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	frame := m.encoder.EncodeAll(buf[:n], nil)
+	if n == 0 || float64(len(frame)) > maxRatio*float64(n) {
+		rc.Close()
+		return m.StorageDriver.Move(ctx, sourcePath, destPath)
+	}
+
+	fw, err := m.StorageDriver.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	if err := m.compress(rc, fw, buf[:n], frame, fi.Size(), dgst); err != nil {
+		return errors.Join(fmt.Errorf("zstd: compressing %s: %w", sourcePath, err), fw.Cancel(ctx))
+	}
+	if err := fw.Commit(ctx); err != nil {
+		fw.Close()
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	return m.StorageDriver.Delete(ctx, sourcePath)
+}
+
+// compress writes the content of size bytes read from r, starting with
+// first, compressed into frame, to fw, checking that it matches dgst.
+func (m *zstdStorageMiddleware) compress(r io.Reader, fw io.Writer, first, frame []byte, size int64, dgst digest.Digest) error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint64(header[len(magic):], uint64(size))
+	if _, err := fw.Write(header); err != nil {
+		return err
+	}
+
+	digester := dgst.Algorithm().Digester()
+	buf := first
+	var (
+		index   []byte
+		written int64
+	)
+	for len(buf) > 0 {
+		digester.Hash().Write(buf)
+		written += int64(len(buf))
+		if _, err := fw.Write(frame); err != nil {
+			return err
+		}
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(frame)))
+
+		n, err := io.ReadFull(r, buf[:cap(buf)])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		buf = buf[:n]
+		frame = m.encoder.EncodeAll(buf, frame[:0])
+	}
+	if written != size || digester.Digest() != dgst {
+		return fmt.Errorf("the content does not match the size %d and the digest %s of the blob", size, dgst)
+	}
+
+	index = binary.LittleEndian.AppendUint32(index, uint32(len(index)/4))
+	index = append(index, indexMagic...)
+	skippable := binary.LittleEndian.AppendUint32(nil, skippableFrameMagic)
+	skippable = binary.LittleEndian.AppendUint32(skippable, uint32(len(index)))
+	_, err := fw.Write(append(skippable, index...))
+	return err
+}
+
+// header returns the size of the content of the blob at path, and whether
+// it is compressed, along with the header read.
+func (m *zstdStorageMiddleware) header(ctx context.Context, path string) (int64, bool, error) {
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rc.Close()
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(rc, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	size, compressed := parseHeader(header)
+	return size, compressed, nil
+}
+
+// cachedHeader returns the header of the blob at path, whose file info is
+// fi, reading it only if it is not cached yet.
+func (m *zstdStorageMiddleware) cachedHeader(ctx context.Context, path string, fi storagedriver.FileInfo) (int64, bool, error) {
+	m.headersMu.Lock()
+	h, ok := m.headers[path]
+	m.headersMu.Unlock()
+	if ok && h.fileSize == fi.Size() && h.modTime.Equal(fi.ModTime()) {
+		return h.size, h.compressed, nil
+	}
+
+	size, compressed, err := m.header(ctx, path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	m.headersMu.Lock()
+	defer m.headersMu.Unlock()
+	if len(m.headers) >= maxCachedHeaders {
+		clear(m.headers)
+	}
+	m.headers[path] = cachedHeader{
+		fileSize:   fi.Size(),
+		modTime:    fi.ModTime(),
+		size:       size,
+		compressed: compressed,
+	}
+	return size, compressed, nil
+}
+
+func parseHeader(header []byte) (int64, bool) {
+	if !bytes.HasPrefix(header, []byte(magic)) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(header[len(magic):])), true
+}
+
+// frameOffset returns the offset in the file of path of frame i.
+func (m *zstdStorageMiddleware) frameOffset(ctx context.Context, path string, i int64) (int64, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	footer, err := m.readAt(ctx, path, fi.Size()-int64(indexFooterSize), indexFooterSize)
+	if err != nil {
+		return 0, err
+	}
+	if string(footer[4:]) != indexMagic {
+		return 0, fmt.Errorf("zstd: invalid index of %s", path)
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer))
+	if i >= frames {
+		return 0, fmt.Errorf("zstd: invalid index of %s", path)
+	}
+	index, err := m.readAt(ctx, path, fi.Size()-int64(indexFooterSize)-4*frames, int(4*i))
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(headerSize)
+	for ; len(index) > 0; index = index[4:] {
+		offset += int64(binary.LittleEndian.Uint32(index))
+	}
+	return offset, nil
+}
+
+// readAt reads n bytes of the file at path from offset.
+func (m *zstdStorageMiddleware) readAt(ctx context.Context, path string, offset int64, n int) ([]byte, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("zstd: invalid index of %s", path)
+	}
+	rc, err := m.StorageDriver.Reader(ctx, path, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	p := make([]byte, n)
+	if _, err := io.ReadFull(rc, p); err != nil {
+		return nil, fmt.Errorf("zstd: reading the index of %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// Stat returns the size of the content of compressed blobs.
+func (m *zstdStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() || fi.Size() < int64(headerSize) || !blobpath.IsData(path) {
+		return fi, err
+	}
+	size, compressed, err := m.cachedHeader(ctx, path, fi)
+	if err != nil || !compressed {
+		return fi, err
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    path,
+		Size:    size,
+		ModTime: fi.ModTime(),
+	}}, nil
+}
+
+// GetContent retrieves the content of blobs, decompressing it.
+func (m *zstdStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if !blobpath.IsData(path) {
+		return m.StorageDriver.GetContent(ctx, path)
+	}
+	rc, err := m.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Reader reads the content of blobs, decompressing it. The content read from
+// the start is checked against the digest of the blob.
+func (m *zstdStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	dgst, ok := blobpath.Digest(path)
+	if !ok || offset < 0 {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(rc, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		rc.Close()
+		return nil, err
+	}
+	size, compressed := parseHeader(header[:n])
+	if !compressed {
+		if offset == 0 {
+			return readCloser{io.MultiReader(bytes.NewReader(header[:n]), rc), rc}, nil
+		}
+		rc.Close()
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	if offset > size {
+		rc.Close()
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.Name()}
+	}
+	r := &reader{path: path, remaining: size - offset}
+	if offset == 0 {
+		if dgst.Algorithm().Available() {
+			r.verifier = dgst.Verifier()
+		}
+	} else {
+		rc.Close()
+		if offset == size {
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		frameOffset, err := m.frameOffset(ctx, path, offset/frameSize)
+		if err != nil {
+			return nil, err
+		}
+		if rc, err = m.StorageDriver.Reader(ctx, path, frameOffset); err != nil {
+			return nil, err
+		}
+	}
+	r.rc = rc
+	if r.decoder, err = zstd.NewReader(rc, zstd.WithDecoderConcurrency(1)); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if skip := offset % frameSize; skip > 0 {
+		if _, err := io.CopyN(io.Discard, r.decoder, skip); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("zstd: decompressing %s: %v", path, err)
+		}
+	}
+	return r, nil
+}
+
+// RedirectURL does not redirect to compressed blobs, since the storage driver
+// would serve the compressed content.
+func (m *zstdStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	if !blobpath.IsData(path) {
+		return m.StorageDriver.RedirectURL(r, path)
+	}
+
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	_, compressed, err := m.header(ctx, path)
+	if err != nil || compressed {
+		return "", err
+	}
+	return m.StorageDriver.RedirectURL(r, path)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// reader decompresses the content of a blob, checking its size, and its
+// digest if verifier is set.
+type reader struct {
+	path      string
+	rc        io.ReadCloser
+	decoder   *zstd.Decoder
+	verifier  digest.Verifier
+	remaining int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.decoder.Read(p)
+	r.remaining -= int64(n)
+	if r.verifier != nil {
+		r.verifier.Write(p[:n])
+	}
+	if err == io.EOF && (r.remaining != 0 || r.verifier != nil && !r.verifier.Verified()) {
+		err = fmt.Errorf("zstd: the decompressed content of %s does not match its size and digest", r.path)
+	} else if err != nil && err != io.EOF {
+		err = fmt.Errorf("zstd: decompressing %s: %v", r.path, err)
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	r.decoder.Close()
+	return r.rc.Close()
+}
@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/middleware/internal/blobpath"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZstdDriverSuite(t *testing.T) {
+	root := t.TempDir()
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		d, err := filesystem.FromParameters(map[string]interface{}{
+			"rootdirectory": root,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newZstdStorageMiddleware(context.Background(), d, map[string]interface{}{})
+	})
+}
+
+// countingDriver counts the readers opened on the files of a driver.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	readers map[string]int
+}
+
+func (d *countingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.readers[path]++
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+// uploadBlob writes content to an upload and moves it to the data path of
+// dgst through m.
+func uploadBlob(t *testing.T, m storagedriver.StorageDriver, content []byte, dgst digest.Digest) (string, error) {
+	t.Helper()
+	ctx := context.Background()
+	upload := "/docker/registry/v2/repositories/foo/_uploads/upload/data"
+	w, err := m.Writer(ctx, upload, false)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, w.Close())
+
+	p := blobpath.Data(dgst)
+	return p, m.Move(ctx, upload, p)
+}
+
+func TestCompressedBlob(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	m, err := newZstdStorageMiddleware(ctx, d, map[string]interface{}{"level": "fastest"})
+	require.NoError(t, err)
+
+	content := bytes.Repeat([]byte("compressible content\n"), 2*frameSize/10)
+	p, err := uploadBlob(t, m, content, digest.FromBytes(content))
+	require.NoError(t, err)
+
+	raw, err := d.GetContent(ctx, p)
+	require.NoError(t, err)
+	require.Less(t, len(raw), len(content)/10)
+	_, err = d.Stat(ctx, "/docker/registry/v2/repositories/foo/_uploads/upload/data")
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	fi, err := m.Stat(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fi.Size())
+
+	p2, err := m.GetContent(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, content, p2)
+
+	for _, offset := range []int64{1, frameSize - 1, frameSize, 3*frameSize + 7, int64(len(content))} {
+		rc, err := m.Reader(ctx, p, offset)
+		require.NoError(t, err)
+		p, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		require.Equal(t, content[offset:], p, "offset %d", offset)
+	}
+	_, err = m.Reader(ctx, p, int64(len(content))+1)
+	require.ErrorAs(t, err, &storagedriver.InvalidOffsetError{})
+
+	redirectURL, err := m.RedirectURL(nil, p)
+	require.NoError(t, err)
+	require.Empty(t, redirectURL)
+}
+
+func TestStatCachesHeader(t *testing.T) {
+	ctx := context.Background()
+	d := &countingDriver{StorageDriver: inmemory.New(), readers: make(map[string]int)}
+	m, err := newZstdStorageMiddleware(ctx, d, map[string]interface{}{"level": "fastest"})
+	require.NoError(t, err)
+
+	content := bytes.Repeat([]byte("compressible content\n"), frameSize/10)
+	p, err := uploadBlob(t, m, content, digest.FromBytes(content))
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		fi, err := m.Stat(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), fi.Size())
+	}
+	require.Equal(t, 1, d.readers[p])
+
+	// other files are not read
+	other := "/docker/registry/v2/repositories/foo/_manifests/tags/latest/current/link"
+	require.NoError(t, m.PutContent(ctx, other, bytes.Repeat([]byte("a"), 100)))
+	_, err = m.Stat(ctx, other)
+	require.NoError(t, err)
+	require.Zero(t, d.readers[other])
+}
+
+func TestIncompressibleBlob(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	m, err := newZstdStorageMiddleware(ctx, d, map[string]interface{}{})
+	require.NoError(t, err)
+
+	content := make([]byte, frameSize+100)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+	p, err := uploadBlob(t, m, content, digest.FromBytes(content))
+	require.NoError(t, err)
+
+	raw, err := d.GetContent(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, content, raw)
+
+	fi, err := m.Stat(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fi.Size())
+	rc, err := m.Reader(ctx, p, 10)
+	require.NoError(t, err)
+	p2, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	require.Equal(t, content[10:], p2)
+}
+
+func TestDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	m, err := newZstdStorageMiddleware(ctx, d, map[string]interface{}{})
+	require.NoError(t, err)
+
+	content := bytes.Repeat([]byte("compressible content\n"), 1000)
+	p, err := uploadBlob(t, m, content, digest.FromString("other content"))
+	require.Error(t, err)
+	_, err = d.Stat(ctx, p)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	// content corrupted in storage is not served
+	dgst := digest.FromBytes(content)
+	p, err = uploadBlob(t, m, content, dgst)
+	require.NoError(t, err)
+	other := bytes.Repeat([]byte("compressible content!"), 1000)
+	other2, err := newZstdStorageMiddleware(ctx, inmemory.New(), map[string]interface{}{})
+	require.NoError(t, err)
+	otherPath, err := uploadBlob(t, other2, other, digest.FromBytes(other))
+	require.NoError(t, err)
+	raw, err := other2.(*zstdStorageMiddleware).StorageDriver.GetContent(ctx, otherPath)
+	require.NoError(t, err)
+	require.NoError(t, d.PutContent(ctx, p, raw))
+	_, err = m.GetContent(ctx, p)
+	require.Error(t, err)
+}
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+	for _, level := range []string{"fastest", "default", "better", "best"} {
+		_, err := newZstdStorageMiddleware(ctx, inmemory.New(), map[string]interface{}{"level": level})
+		require.NoError(t, err, level)
+	}
+	_, err := newZstdStorageMiddleware(ctx, inmemory.New(), map[string]interface{}{"level": "ultra"})
+	require.Error(t, err)
+	_, err = newZstdStorageMiddleware(ctx, inmemory.New(), map[string]interface{}{"level": 3})
+	require.Error(t, err)
+}
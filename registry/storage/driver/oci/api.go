@@ -0,0 +1,281 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+)
+
+// isNotFound returns whether err reports a missing object, bucket or
+// multipart upload.
+func isNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// hasStatus returns whether err is an error of the API with the given HTTP
+// status.
+func hasStatus(err error, status int) bool {
+	serviceErr, ok := common.IsServiceError(err)
+	return ok && serviceErr.GetHTTPStatusCode() == status
+}
+
+// object is an object, as listed or from its headers.
+type object struct {
+	Name         string
+	Size         int64
+	TimeModified time.Time
+	Metadata     map[string]string
+}
+
+type objectList struct {
+	Objects       []object
+	Prefixes      []string
+	NextStartWith string
+}
+
+// part is a part of a multipart upload.
+type part struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+// client is a client of the Object Storage API, for a bucket. Requests are
+// signed and retried by the Object Storage client of the OCI SDK.
+type client struct {
+	objectstorage.ObjectStorageClient
+	namespace string
+	bucket    string
+}
+
+// getNamespace returns the Object Storage namespace of the tenancy.
+func (c *client) getNamespace(ctx context.Context) (string, error) {
+	resp, err := c.GetNamespace(ctx, objectstorage.GetNamespaceRequest{})
+	if err != nil {
+		return "", err
+	}
+	return *resp.Value, nil
+}
+
+// headBucket checks that the bucket exists and may be accessed.
+func (c *client) headBucket(ctx context.Context) error {
+	_, err := c.HeadBucket(ctx, objectstorage.HeadBucketRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+	})
+	return err
+}
+
+// head returns the object named name.
+func (c *client) head(ctx context.Context, name string) (*object, error) {
+	resp, err := c.HeadObject(ctx, objectstorage.HeadObjectRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		ObjectName:    &name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	o := &object{
+		Name:     name,
+		Metadata: resp.OpcMeta,
+	}
+	if resp.ContentLength != nil {
+		o.Size = *resp.ContentLength
+	}
+	if resp.LastModified != nil {
+		o.TimeModified = resp.LastModified.Time
+	}
+	return o, nil
+}
+
+// list lists the objects starting with prefix, from start, grouping the
+// names with a slash after the prefix when delimited.
+func (c *client) list(ctx context.Context, prefix, start string, delimited bool, limit int) (*objectList, error) {
+	req := objectstorage.ListObjectsRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		Prefix:        &prefix,
+		Limit:         &limit,
+		Fields:        common.String("name,size,timeModified"),
+	}
+	if start != "" {
+		req.Start = &start
+	}
+	if delimited {
+		req.Delimiter = common.String("/")
+	}
+	resp, err := c.ListObjects(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &objectList{
+		Objects:  make([]object, len(resp.Objects)),
+		Prefixes: resp.Prefixes,
+	}
+	for i, summary := range resp.Objects {
+		o := object{Name: *summary.Name}
+		if summary.Size != nil {
+			o.Size = *summary.Size
+		}
+		if summary.TimeModified != nil {
+			o.TimeModified = summary.TimeModified.Time
+		}
+		list.Objects[i] = o
+	}
+	if resp.NextStartWith != nil {
+		list.NextStartWith = *resp.NextStartWith
+	}
+	return list, nil
+}
+
+// put uploads an object with the given content type and metadata.
+func (c *client) put(ctx context.Context, name, contentType string, metadata map[string]string, data []byte) error {
+	_, err := c.PutObject(ctx, objectstorage.PutObjectRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		ObjectName:    &name,
+		ContentLength: common.Int64(int64(len(data))),
+		PutObjectBody: io.NopCloser(bytes.NewReader(data)),
+		ContentType:   &contentType,
+		OpcMeta:       metadata,
+	})
+	return err
+}
+
+// get downloads an object from offset.
+func (c *client) get(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	req := objectstorage.GetObjectRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		ObjectName:    &name,
+	}
+	if offset > 0 {
+		req.Range = common.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.GetObject(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Content, nil
+}
+
+// delete deletes an object.
+func (c *client) delete(ctx context.Context, name string) error {
+	_, err := c.DeleteObject(ctx, objectstorage.DeleteObjectRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		ObjectName:    &name,
+	})
+	return err
+}
+
+// rename renames an object, replacing the object named newName if any.
+func (c *client) rename(ctx context.Context, sourceName, newName string) error {
+	_, err := c.RenameObject(ctx, objectstorage.RenameObjectRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		RenameObjectDetails: objectstorage.RenameObjectDetails{
+			SourceName: &sourceName,
+			NewName:    &newName,
+		},
+	})
+	return err
+}
+
+// createMultipartUpload starts a multipart upload, returning its ID.
+func (c *client) createMultipartUpload(ctx context.Context, name, contentType string) (string, error) {
+	resp, err := c.CreateMultipartUpload(ctx, objectstorage.CreateMultipartUploadRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		CreateMultipartUploadDetails: objectstorage.CreateMultipartUploadDetails{
+			Object:      &name,
+			ContentType: &contentType,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return *resp.UploadId, nil
+}
+
+// uploadPart uploads a part of a multipart upload, returning its ETag.
+func (c *client) uploadPart(ctx context.Context, name, uploadID string, partNumber int, data []byte) (string, error) {
+	resp, err := c.UploadPart(ctx, objectstorage.UploadPartRequest{
+		NamespaceName:  &c.namespace,
+		BucketName:     &c.bucket,
+		ObjectName:     &name,
+		UploadId:       &uploadID,
+		UploadPartNum:  &partNumber,
+		ContentLength:  common.Int64(int64(len(data))),
+		UploadPartBody: io.NopCloser(bytes.NewReader(data)),
+	})
+	if err != nil {
+		return "", err
+	}
+	return *resp.ETag, nil
+}
+
+// listParts lists the parts of a multipart upload.
+func (c *client) listParts(ctx context.Context, name, uploadID string) ([]part, error) {
+	var parts []part
+	req := objectstorage.ListMultipartUploadPartsRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		ObjectName:    &name,
+		UploadId:      &uploadID,
+		Limit:         common.Int(1000),
+	}
+	for {
+		resp, err := c.ListMultipartUploadParts(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range resp.Items {
+			parts = append(parts, part{PartNumber: *p.PartNumber, ETag: *p.Etag, Size: *p.Size})
+		}
+		if resp.OpcNextPage == nil {
+			return parts, nil
+		}
+		req.Page = resp.OpcNextPage
+	}
+}
+
+// commitMultipartUpload assembles the parts of a multipart upload.
+func (c *client) commitMultipartUpload(ctx context.Context, name, uploadID string, parts []part) error {
+	partsToCommit := make([]objectstorage.CommitMultipartUploadPartDetails, len(parts))
+	for i, p := range parts {
+		partsToCommit[i] = objectstorage.CommitMultipartUploadPartDetails{
+			PartNum: common.Int(p.PartNumber),
+			Etag:    common.String(p.ETag),
+		}
+	}
+	_, err := c.CommitMultipartUpload(ctx, objectstorage.CommitMultipartUploadRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		ObjectName:    &name,
+		UploadId:      &uploadID,
+		CommitMultipartUploadDetails: objectstorage.CommitMultipartUploadDetails{
+			PartsToCommit: partsToCommit,
+		},
+	})
+	return err
+}
+
+// abortMultipartUpload aborts a multipart upload, deleting its parts.
+func (c *client) abortMultipartUpload(ctx context.Context, name, uploadID string) error {
+	_, err := c.AbortMultipartUpload(ctx, objectstorage.AbortMultipartUploadRequest{
+		NamespaceName: &c.namespace,
+		BucketName:    &c.bucket,
+		ObjectName:    &name,
+		UploadId:      &uploadID,
+	})
+	return err
+}
@@ -0,0 +1,3 @@
+// Package oci implements the Oracle Cloud Infrastructure Object Storage driver
+// backend.
+package oci
@@ -0,0 +1,691 @@
+// Package oci provides a storagedriver.StorageDriver implementation to
+// store blobs in Oracle Cloud Infrastructure Object Storage.
+//
+// This package uses the native Object Storage API, rather than its Amazon
+// S3 compatibility API, through the OCI SDK. It authenticates either with
+// the API signing key of a user or as the compute instance the registry runs
+// on (instance principal).
+//
+// Uploads larger than a chunk are uploaded as multipart uploads, which keep
+// their parts while an upload is suspended. The content of an upload not
+// uploaded as a part yet, and the ID of its multipart upload, are stored in
+// an upload session object, next to the object of the upload. Its name ends
+// with a suffix which registry paths cannot contain, so that it is hidden
+// from the registry.
+//
+// Objects are moved with the rename operation of Object Storage, which
+// replaces the destination atomically.
+package oci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/common/auth"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	driverName = "oci"
+
+	minChunkSize          = 10 * 1024 * 1024
+	defaultChunkSize      = 32 * 1024 * 1024
+	defaultMaxConcurrency = 50
+	minConcurrency        = 25
+
+	authAPIKey            = "apikey"
+	authInstancePrincipal = "instanceprincipal"
+
+	// sessionSuffix ends the names of upload session objects.
+	sessionSuffix            = "~upload-session"
+	uploadSessionContentType = "application/x-docker-upload-session"
+	blobContentType          = "application/octet-stream"
+
+	listLimit = 1000
+)
+
+var _ storagedriver.FileWriter = &writer{}
+
+// driverParameters is a struct that encapsulates all of the driver parameters after all values have been set
+type driverParameters struct {
+	auth string
+
+	// the API signing key of a user, for the apikey authentication
+	tenancy     string
+	user        string
+	fingerprint string
+	privateKey  []byte
+
+	region        string
+	endpoint      string
+	namespace     string
+	bucket        string
+	rootDirectory string
+	chunkSize     int
+	client        *http.Client
+
+	// maxConcurrency limits the number of concurrent driver operations
+	// to Object Storage, which ultimately increases reliability of many
+	// simultaneous pushes by ensuring we aren't DoSing our own server with
+	// many connections.
+	maxConcurrency uint64
+}
+
+func init() {
+	factory.Register(driverName, &ociDriverFactory{})
+}
+
+// ociDriverFactory implements the factory.StorageDriverFactory interface
+type ociDriverFactory struct{}
+
+// Create StorageDriver from parameters
+func (factory *ociDriverFactory) Create(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(ctx, parameters)
+}
+
+var _ storagedriver.StorageDriver = &driver{}
+
+// driver is a storagedriver.StorageDriver implementation backed by Oracle
+// Cloud Infrastructure Object Storage. Objects are stored at absolute names
+// in the provided bucket.
+type driver struct {
+	client        *client
+	rootDirectory string
+	chunkSize     int
+}
+
+// Wrapper wraps `driver` with a throttler, ensuring that no more than N
+// Object Storage actions can occur concurrently. The default limit is 50.
+type Wrapper struct {
+	baseEmbed
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - bucket
+// - tenancy, user, fingerprint, privatekey and region, with the apikey
+// authentication
+func FromParameters(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	param := func(name string) string {
+		value, ok := parameters[name]
+		if !ok || value == nil {
+			return ""
+		}
+		return fmt.Sprint(value)
+	}
+
+	params := driverParameters{
+		auth:          param("auth"),
+		tenancy:       param("tenancy"),
+		user:          param("user"),
+		fingerprint:   param("fingerprint"),
+		region:        param("region"),
+		endpoint:      param("endpoint"),
+		namespace:     param("namespace"),
+		bucket:        param("bucket"),
+		rootDirectory: param("rootdirectory"),
+		chunkSize:     defaultChunkSize,
+		client:        http.DefaultClient,
+	}
+	if params.bucket == "" {
+		return nil, fmt.Errorf("no bucket parameter provided")
+	}
+
+	switch params.auth {
+	case "", authAPIKey:
+		params.auth = authAPIKey
+		for _, name := range []string{"tenancy", "user", "fingerprint", "privatekey", "region"} {
+			if param(name) == "" {
+				return nil, fmt.Errorf("no %s parameter provided, which the %s authentication requires", name, authAPIKey)
+			}
+		}
+		privateKey, err := os.ReadFile(param("privatekey"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read privatekey: %v", err)
+		}
+		params.privateKey = privateKey
+	case authInstancePrincipal:
+	default:
+		return nil, fmt.Errorf("invalid auth %q, must be %s or %s", params.auth, authAPIKey, authInstancePrincipal)
+	}
+
+	chunkSizeParam, ok := parameters["chunksize"]
+	if ok {
+		switch v := chunkSizeParam.(type) {
+		case string:
+			vv, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("chunksize must be an integer, %v invalid", chunkSizeParam)
+			}
+			params.chunkSize = vv
+		case int, uint, int32, uint32, uint64, int64:
+			params.chunkSize = int(reflect.ValueOf(v).Convert(reflect.TypeOf(params.chunkSize)).Int())
+		default:
+			return nil, fmt.Errorf("invalid value for chunksize: %#v", chunkSizeParam)
+		}
+
+		if params.chunkSize < minChunkSize {
+			return nil, fmt.Errorf("chunksize %#v must be larger than or equal to %d", params.chunkSize, minChunkSize)
+		}
+	}
+
+	maxConcurrency, err := base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
+	}
+	params.maxConcurrency = maxConcurrency
+
+	return New(ctx, params)
+}
+
+// New constructs a new driver, authenticating and checking that the bucket
+// may be accessed.
+func New(ctx context.Context, params driverParameters) (storagedriver.StorageDriver, error) {
+	rootDirectory := strings.Trim(params.rootDirectory, "/")
+	if rootDirectory != "" {
+		rootDirectory += "/"
+	}
+	if params.chunkSize < minChunkSize {
+		return nil, fmt.Errorf("invalid chunksize: %d is smaller than %d", params.chunkSize, minChunkSize)
+	}
+
+	var provider common.ConfigurationProvider
+	switch params.auth {
+	case authAPIKey:
+		if _, err := common.PrivateKeyFromBytes(params.privateKey, nil); err != nil {
+			return nil, fmt.Errorf("invalid privatekey: %v", err)
+		}
+		provider = common.NewRawConfigurationProvider(params.tenancy, params.user, params.region, params.fingerprint, string(params.privateKey), nil)
+	case authInstancePrincipal:
+		var err error
+		if provider, err = auth.InstancePrincipalConfigurationProvider(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid auth %q", params.auth)
+	}
+
+	osClient, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	osClient.HTTPClient = params.client
+	if params.endpoint != "" {
+		osClient.Host = strings.TrimRight(params.endpoint, "/")
+	} else if params.region != "" {
+		osClient.SetRegion(params.region)
+	}
+
+	c := &client{
+		ObjectStorageClient: osClient,
+		namespace:           params.namespace,
+		bucket:              params.bucket,
+	}
+	if c.namespace == "" {
+		namespace, err := c.getNamespace(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the object storage namespace: %v", err)
+		}
+		c.namespace = namespace
+	}
+	if err := c.headBucket(ctx); err != nil {
+		return nil, fmt.Errorf("unable to access bucket %q: %v", params.bucket, err)
+	}
+
+	d := &driver{
+		client:        c,
+		rootDirectory: rootDirectory,
+		chunkSize:     params.chunkSize,
+	}
+
+	return &Wrapper{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: base.NewRegulator(d, params.maxConcurrency),
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+// This should primarily be used for small objects.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	r, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// This should primarily be used for small objects.
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	return d.client.put(ctx, d.pathToKey(path), blobContentType, nil, contents)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path"
+// with a given byte offset.
+// May be used to resume reading a stream by providing a nonzero offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	key := d.pathToKey(path)
+	rc, err := d.client.get(ctx, key, offset)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, storagedriver.PathNotFoundError{Path: path}
+		}
+		if hasStatus(err, http.StatusRequestedRangeNotSatisfiable) {
+			o, err := d.client.head(ctx, key)
+			if err != nil {
+				if isNotFound(err) {
+					return nil, storagedriver.PathNotFoundError{Path: path}
+				}
+				return nil, err
+			}
+			if offset == o.Size {
+				return io.NopCloser(bytes.NewReader([]byte{})), nil
+			}
+			return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+		}
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
+	w := &writer{
+		ctx:    ctx,
+		driver: d,
+		path:   path,
+		key:    d.pathToKey(path),
+	}
+
+	if appendMode {
+		err := w.init(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current
+// size in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	// try to get as object
+	o, err := d.client.head(ctx, d.pathToKey(path))
+	if err == nil {
+		return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+			Path:    path,
+			Size:    o.Size,
+			ModTime: o.TimeModified,
+		}}, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	// try to get as folder
+	list, err := d.client.list(ctx, d.pathToDirKey(path), "", false, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Objects) == 0 {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:  path,
+		IsDir: true,
+	}}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	prefix := d.pathToDirKey(path)
+	list := make([]string, 0, 64)
+	start := ""
+	for {
+		objects, err := d.client.list(ctx, prefix, start, true, listLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects.Objects {
+			if !strings.HasSuffix(o.Name, sessionSuffix) {
+				list = append(list, d.keyToPath(o.Name))
+			}
+		}
+		for _, p := range objects.Prefixes {
+			list = append(list, d.keyToPath(p))
+		}
+		if objects.NextStartWith == "" {
+			break
+		}
+		start = objects.NextStartWith
+	}
+
+	if path != "/" && len(list) == 0 {
+		// Treat empty response as missing directory, since we don't actually
+		// have directories in Object Storage.
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return list, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := d.client.rename(ctx, d.pathToKey(sourcePath), d.pathToKey(destPath)); err != nil {
+		if isNotFound(err) {
+			return storagedriver.PathNotFoundError{Path: sourcePath}
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths,
+// aborting the multipart uploads of the upload session objects deleted.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	key, dirKey := d.pathToKey(path), d.pathToDirKey(path)
+	deleted := 0
+	start := ""
+	for {
+		objects, err := d.client.list(ctx, key, start, false, listLimit)
+		if err != nil {
+			return err
+		}
+		for _, o := range objects.Objects {
+			if o.Name != key && o.Name != key+sessionSuffix && !strings.HasPrefix(o.Name, dirKey) {
+				continue
+			}
+			if strings.HasSuffix(o.Name, sessionSuffix) {
+				err = d.deleteSession(ctx, o.Name)
+			} else {
+				err = d.client.delete(ctx, o.Name)
+			}
+			// objects deleted concurrently are ignored
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+			deleted++
+		}
+		if objects.NextStartWith == "" {
+			break
+		}
+		start = objects.NextStartWith
+	}
+	if deleted == 0 {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	return nil
+}
+
+// deleteSession deletes an upload session object, and aborts its multipart
+// upload.
+func (d *driver) deleteSession(ctx context.Context, name string) error {
+	o, err := d.client.head(ctx, name)
+	if err != nil {
+		return err
+	}
+	if uploadID := o.Metadata["upload-id"]; uploadID != "" {
+		err := d.client.abortMultipartUpload(ctx, strings.TrimSuffix(name, sessionSuffix), uploadID)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return d.client.delete(ctx, name)
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored at
+// the given path. Downloads are not redirected, since Object Storage only
+// shares objects with pre-authenticated requests, which are stored by the
+// bucket.
+func (d *driver) RedirectURL(*http.Request, string) (string, error) {
+	return "", nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+type writer struct {
+	ctx    context.Context
+	driver *driver
+	path   string
+	key    string
+
+	// uploadID is the ID of the multipart upload the content is uploaded
+	// to, once it is larger than a chunk.
+	uploadID  string
+	parts     []part
+	partsSize int64
+
+	// buffer holds the content which is not uploaded as a part yet.
+	buffer bytes.Buffer
+
+	// session is whether an upload session object was stored.
+	session bool
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+// init resumes the upload from its upload session object, or appends to a
+// committed object.
+func (w *writer) init(ctx context.Context) error {
+	session, err := w.driver.client.head(ctx, w.key+sessionSuffix)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	name := w.key + sessionSuffix
+	if session == nil {
+		name = w.key
+	}
+
+	rc, err := w.driver.client.get(ctx, name, 0)
+	if err != nil {
+		if isNotFound(err) {
+			return storagedriver.PathNotFoundError{Path: w.path}
+		}
+		return err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(&w.buffer, rc); err != nil {
+		return err
+	}
+
+	if session == nil {
+		return nil
+	}
+	w.session = true
+	if session.Metadata["upload-id"] == "" {
+		return nil
+	}
+	w.uploadID = session.Metadata["upload-id"]
+	offset, err := strconv.ParseInt(session.Metadata["offset"], 10, 64)
+	if err != nil {
+		return err
+	}
+	parts, err := w.driver.client.listParts(ctx, w.key, w.uploadID)
+	if err != nil {
+		return err
+	}
+	// parts uploaded after the session object was written last are
+	// uploaded again
+	for _, p := range parts {
+		if p.PartNumber != len(w.parts)+1 || w.partsSize+p.Size > offset {
+			break
+		}
+		w.parts = append(w.parts, p)
+		w.partsSize += p.Size
+	}
+	if w.partsSize != offset {
+		return fmt.Errorf("oci upload session %s is missing parts", w.path)
+	}
+	return nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	w.buffer.Write(p)
+	for w.buffer.Len() >= w.driver.chunkSize {
+		if err := w.uploadPart(w.ctx, w.driver.chunkSize); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// uploadPart uploads the first n bytes of the buffer as the next part of
+// the multipart upload, starting it if needed.
+func (w *writer) uploadPart(ctx context.Context, n int) error {
+	if w.uploadID == "" {
+		uploadID, err := w.driver.client.createMultipartUpload(ctx, w.key, blobContentType)
+		if err != nil {
+			return err
+		}
+		w.uploadID = uploadID
+	}
+
+	partNumber := len(w.parts) + 1
+	etag, err := w.driver.client.uploadPart(ctx, w.key, w.uploadID, partNumber, w.buffer.Bytes()[:n])
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, part{PartNumber: partNumber, ETag: etag, Size: int64(n)})
+	w.partsSize += int64(n)
+	w.buffer.Next(n)
+	return nil
+}
+
+// Size returns the number of bytes written to this FileWriter.
+func (w *writer) Size() int64 {
+	return w.partsSize + int64(w.buffer.Len())
+}
+
+// Close stores the content which is not uploaded as a part yet in the
+// upload session object, so that the upload can be resumed.
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	metadata := map[string]string{"offset": strconv.FormatInt(w.partsSize, 10)}
+	if w.uploadID != "" {
+		metadata["upload-id"] = w.uploadID
+	}
+	if err := w.driver.client.put(w.ctx, w.key+sessionSuffix, uploadSessionContentType, metadata, w.buffer.Bytes()); err != nil {
+		return err
+	}
+	w.session = true
+	return nil
+}
+
+// Cancel removes any written content from this FileWriter.
+func (w *writer) Cancel(ctx context.Context) error {
+	w.closed = true
+	w.cancelled = true
+
+	if w.uploadID != "" {
+		if err := w.driver.client.abortMultipartUpload(ctx, w.key, w.uploadID); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	if err := w.driver.client.delete(ctx, w.key+sessionSuffix); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Commit flushes all content written to this FileWriter and makes it
+// available for future calls to StorageDriver.GetContent and
+// StorageDriver.Reader.
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	w.closed = true
+
+	var err error
+	// no multipart upload started yet just perform a simple upload
+	if w.uploadID == "" {
+		err = w.driver.client.put(ctx, w.key, blobContentType, nil, w.buffer.Bytes())
+	} else {
+		if w.buffer.Len() > 0 {
+			if err := w.uploadPart(ctx, w.buffer.Len()); err != nil {
+				return err
+			}
+		}
+		err = w.driver.client.commitMultipartUpload(ctx, w.key, w.uploadID, w.parts)
+	}
+	if err != nil {
+		return err
+	}
+	w.committed = true
+
+	if w.session {
+		// a session object failing to be deleted is only left over, as
+		// it is hidden from the registry
+		if err := w.driver.client.delete(ctx, w.key+sessionSuffix); err != nil && !isNotFound(err) {
+			logrus.Infof("error deleting upload session of %v: %v", w.path, err)
+		}
+	}
+	return nil
+}
+
+func (d *driver) pathToKey(path string) string {
+	return strings.TrimSpace(strings.TrimRight(d.rootDirectory+strings.TrimLeft(path, "/"), "/"))
+}
+
+func (d *driver) pathToDirKey(path string) string {
+	key := d.pathToKey(path)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (d *driver) keyToPath(key string) string {
+	return "/" + strings.Trim(strings.TrimPrefix(key, d.rootDirectory), "/")
+}
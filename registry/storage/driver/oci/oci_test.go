@@ -0,0 +1,776 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+)
+
+var skipCheck func(tb testing.TB)
+
+func init() {
+	// Skip the OCI storage driver tests against Object Storage if
+	// environment variable parameters are not provided
+	skipCheck = func(tb testing.TB) {
+		tb.Helper()
+
+		for _, name := range []string{"REGISTRY_STORAGE_OCI_BUCKET", "OCI_TENANCY", "OCI_USER", "OCI_FINGERPRINT", "OCI_PRIVATE_KEY", "OCI_REGION"} {
+			if os.Getenv(name) == "" {
+				tb.Skip("The following environment variables must be set to enable these tests: REGISTRY_STORAGE_OCI_BUCKET, OCI_TENANCY, OCI_USER, OCI_FINGERPRINT, OCI_PRIVATE_KEY, OCI_REGION")
+			}
+		}
+	}
+}
+
+func newDriverConstructor(tb testing.TB) testsuites.DriverConstructor {
+	root := tb.TempDir()
+
+	return func() (storagedriver.StorageDriver, error) {
+		privateKey, err := os.ReadFile(os.Getenv("OCI_PRIVATE_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		return New(context.Background(), driverParameters{
+			auth:           authAPIKey,
+			tenancy:        os.Getenv("OCI_TENANCY"),
+			user:           os.Getenv("OCI_USER"),
+			fingerprint:    os.Getenv("OCI_FINGERPRINT"),
+			privateKey:     privateKey,
+			region:         os.Getenv("OCI_REGION"),
+			bucket:         os.Getenv("REGISTRY_STORAGE_OCI_BUCKET"),
+			rootDirectory:  root,
+			chunkSize:      defaultChunkSize,
+			client:         http.DefaultClient,
+			maxConcurrency: 8,
+		})
+	}
+}
+
+func TestOCIDriverSuite(t *testing.T) {
+	skipCheck(t)
+	testsuites.Driver(t, newDriverConstructor(t))
+}
+
+func BenchmarkOCIDriverSuite(b *testing.B) {
+	skipCheck(b)
+	testsuites.BenchDriver(b, newDriverConstructor(b))
+}
+
+const (
+	testNamespace = "test-namespace"
+	testBucket    = "registry"
+	testTenancy   = "ocid1.tenancy.oc1..test"
+	testKeyID     = testTenancy + "/ocid1.user.oc1..test/00:11:22"
+)
+
+// testOCI is a fake Object Storage API server holding the objects of a
+// bucket in memory, which verifies the signatures of requests. It also
+// serves the instance metadata and authentication services of instance
+// principals.
+type testOCI struct {
+	*httptest.Server
+
+	userKey        *rsa.PrivateKey
+	instanceKey    *rsa.PrivateKey
+	instanceCert   []byte
+	instanceKeyID  string
+	intermediateCA []byte
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	tokens  int
+	seq     int
+	objects map[string]*testObject
+	uploads map[string]*testUpload
+}
+
+type testObject struct {
+	data        []byte
+	contentType string
+	metadata    map[string]string
+	modified    time.Time
+}
+
+type testUpload struct {
+	name        string
+	contentType string
+	parts       map[int][]byte
+	etags       map[int]string
+}
+
+func newTestOCI(t *testing.T) *testOCI {
+	o := &testOCI{
+		keys:    make(map[string]*rsa.PublicKey),
+		objects: make(map[string]*testObject),
+		uploads: make(map[string]*testUpload),
+	}
+	var err error
+	if o.userKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	o.keys[testKeyID] = &o.userKey.PublicKey
+
+	// the instance certificate, issued by an intermediate CA, and naming the
+	// tenancy of the instance
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.instanceKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{
+			CommonName:         "ocid1.instance.oc1..test",
+			OrganizationalUnit: []string{"opc-certtype:instance", "opc-compartment:ocid1.compartment.oc1..test", "opc-tenant:" + testTenancy},
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}, caTemplate, &o.instanceKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := sha1.Sum(certDER)
+	o.instanceKeyID = testTenancy + "/fed-x509/" + strings.ReplaceAll(fmt.Sprintf("% x", fingerprint), " ", ":")
+	o.instanceCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	o.intermediateCA = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	o.Server = httptest.NewServer(http.HandlerFunc(o.serveHTTP))
+	t.Cleanup(o.Close)
+	return o
+}
+
+func (o *testOCI) parameters(rootDirectory string) driverParameters {
+	return driverParameters{
+		auth:           authAPIKey,
+		tenancy:        testTenancy,
+		user:           "ocid1.user.oc1..test",
+		fingerprint:    "00:11:22",
+		privateKey:     pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(o.userKey)}),
+		region:         "us-test-1",
+		endpoint:       o.URL,
+		bucket:         testBucket,
+		rootDirectory:  rootDirectory,
+		chunkSize:      minChunkSize,
+		client:         o.Client(),
+		maxConcurrency: 8,
+	}
+}
+
+var signatureParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// verify verifies the signature of a request.
+func (o *testOCI) verify(r *http.Request, body []byte) (string, bool) {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Signature ")
+	if !ok {
+		return "missing signature", false
+	}
+	params := make(map[string]string)
+	for _, m := range signatureParamRegexp.FindAllStringSubmatch(auth, -1) {
+		params[m[1]] = m[2]
+	}
+	key, ok := o.keys[params["keyId"]]
+	if !ok {
+		return "unknown key " + params["keyId"], false
+	}
+	if params["version"] != "1" || params["algorithm"] != "rsa-sha256" {
+		return "unsupported signature", false
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date).Abs() > 5*time.Minute {
+		return "invalid date", false
+	}
+
+	headers := strings.Split(params["headers"], " ")
+	required := []string{"date", "(request-target)", "host"}
+	if r.URL.Path == "/v1/x509" {
+		// the authentication service does not require the host to be
+		// signed
+		required = required[:2]
+	}
+	if r.Method == http.MethodPost {
+		required = append(required, "content-length", "content-type", "x-content-sha256")
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Content-Sha256") != base64.StdEncoding.EncodeToString(sum[:]) {
+			return "invalid content hash", false
+		}
+	}
+	for _, h := range required {
+		if !strings.Contains(" "+params["headers"]+" ", " "+h+" ") {
+			return "unsigned header " + h, false
+		}
+	}
+
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		var value string
+		switch h {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.RequestURI
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			value = r.Header.Get(h)
+		}
+		lines[i] = h + ": " + value
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "invalid signature", false
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) != nil {
+		return "signature mismatch", false
+	}
+	return "", true
+}
+
+func (o *testOCI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	fail := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]string{"code": code, "message": code})
+	}
+
+	if metadata, ok := strings.CutPrefix(r.URL.Path, "/opc/v2/"); ok {
+		if r.Header.Get("Authorization") != "Bearer Oracle" {
+			fail(http.StatusUnauthorized, "NotAuthenticated")
+			return
+		}
+		switch metadata {
+		case "identity/cert.pem":
+			_, _ = w.Write(o.instanceCert)
+		case "identity/intermediate.pem":
+			_, _ = w.Write(o.intermediateCA)
+		case "identity/key.pem":
+			_, _ = w.Write(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(o.instanceKey)}))
+		case "instance/region":
+			_, _ = w.Write([]byte("us-test-1"))
+		default:
+			fail(http.StatusNotFound, "NotFound")
+		}
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fail(http.StatusBadRequest, "InvalidBody")
+		return
+	}
+
+	if r.URL.Path == "/v1/x509" {
+		o.keys[o.instanceKeyID] = &o.instanceKey.PublicKey
+		msg, ok := o.verify(r, body)
+		delete(o.keys, o.instanceKeyID)
+		if !ok {
+			fail(http.StatusUnauthorized, msg)
+			return
+		}
+		var req struct {
+			Certificate string `json:"certificate"`
+			PublicKey   string `json:"publicKey"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			fail(http.StatusBadRequest, "InvalidParameter")
+			return
+		}
+		der, err := base64.StdEncoding.DecodeString(req.PublicKey)
+		if err != nil {
+			fail(http.StatusBadRequest, "InvalidParameter")
+			return
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			fail(http.StatusBadRequest, "InvalidParameter")
+			return
+		}
+		o.tokens++
+		claims, _ := json.Marshal(map[string]int64{"exp": time.Now().Add(time.Hour).Unix(), "n": int64(o.tokens)})
+		token := "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+		o.keys["ST$"+token] = publicKey.(*rsa.PublicKey)
+		reply(map[string]string{"token": token})
+		return
+	}
+
+	if msg, ok := o.verify(r, body); !ok {
+		fail(http.StatusUnauthorized, msg)
+		return
+	}
+
+	if r.URL.Path == "/n" {
+		reply(testNamespace)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.EscapedPath(), "/n/"+testNamespace+"/b/"+testBucket)
+	if !ok {
+		fail(http.StatusNotFound, "BucketNotFound")
+		return
+	}
+	q := r.URL.Query()
+
+	switch {
+	case rest == "" && r.Method == http.MethodHead:
+	case rest == "/o" && r.Method == http.MethodGet:
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		reply(o.list(q.Get("prefix"), q.Get("start"), q.Get("delimiter"), limit))
+	case strings.HasPrefix(rest, "/o/"):
+		name, err := url.PathUnescape(strings.TrimPrefix(rest, "/o/"))
+		if err != nil {
+			fail(http.StatusBadRequest, "InvalidObjectName")
+			return
+		}
+		o.serveObject(w, r, name, body, fail)
+	case rest == "/actions/renameObject" && r.Method == http.MethodPost:
+		var req struct {
+			SourceName string `json:"sourceName"`
+			NewName    string `json:"newName"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			fail(http.StatusBadRequest, "InvalidParameter")
+			return
+		}
+		obj, ok := o.objects[req.SourceName]
+		if !ok {
+			fail(http.StatusNotFound, "ObjectNotFound")
+			return
+		}
+		delete(o.objects, req.SourceName)
+		o.objects[req.NewName] = obj
+	case rest == "/u" && r.Method == http.MethodPost:
+		var req struct {
+			Object      string `json:"object"`
+			ContentType string `json:"contentType"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			fail(http.StatusBadRequest, "InvalidParameter")
+			return
+		}
+		o.seq++
+		uploadID := fmt.Sprintf("upload-%d", o.seq)
+		o.uploads[uploadID] = &testUpload{name: req.Object, contentType: req.ContentType, parts: make(map[int][]byte), etags: make(map[int]string)}
+		reply(map[string]string{"namespace": testNamespace, "bucket": testBucket, "uploadId": uploadID, "object": req.Object})
+	case strings.HasPrefix(rest, "/u/"):
+		name, err := url.PathUnescape(strings.TrimPrefix(rest, "/u/"))
+		if err != nil {
+			fail(http.StatusBadRequest, "InvalidObjectName")
+			return
+		}
+		upload, ok := o.uploads[q.Get("uploadId")]
+		if !ok || upload.name != name {
+			fail(http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		o.serveUpload(w, r, q.Get("uploadId"), upload, body, reply, fail)
+	default:
+		fail(http.StatusNotFound, "NotFound")
+	}
+}
+
+func (o *testOCI) serveObject(w http.ResponseWriter, r *http.Request, name string, body []byte, fail func(int, string)) {
+	switch r.Method {
+	case http.MethodPut:
+		obj := &testObject{data: body, contentType: r.Header.Get("Content-Type"), metadata: make(map[string]string), modified: time.Now()}
+		for k, v := range r.Header {
+			if key, ok := strings.CutPrefix(strings.ToLower(k), "opc-meta-"); ok {
+				obj.metadata[key] = v[0]
+			}
+		}
+		o.objects[name] = obj
+	case http.MethodDelete:
+		if _, ok := o.objects[name]; !ok {
+			fail(http.StatusNotFound, "ObjectNotFound")
+			return
+		}
+		delete(o.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := o.objects[name]
+		if !ok {
+			fail(http.StatusNotFound, "ObjectNotFound")
+			return
+		}
+		data := obj.data
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			var offset int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-", &offset); err != nil || offset >= len(data) {
+				fail(http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			data, status = data[offset:], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		for k, v := range obj.metadata {
+			w.Header().Set("Opc-Meta-"+k, v)
+		}
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		fail(http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (o *testOCI) serveUpload(w http.ResponseWriter, r *http.Request, uploadID string, upload *testUpload, body []byte, reply func(interface{}), fail func(int, string)) {
+	switch r.Method {
+	case http.MethodPut:
+		partNumber, err := strconv.Atoi(r.URL.Query().Get("uploadPartNum"))
+		if err != nil || partNumber < 1 || partNumber > 10000 {
+			fail(http.StatusBadRequest, "InvalidUploadPart")
+			return
+		}
+		o.seq++
+		upload.parts[partNumber] = body
+		upload.etags[partNumber] = fmt.Sprintf("etag-%d", o.seq)
+		w.Header().Set("ETag", upload.etags[partNumber])
+	case http.MethodGet:
+		numbers := make([]int, 0, len(upload.parts))
+		for n := range upload.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		// a page per part, to exercise the pagination of clients
+		start, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		parts := []objectstorage.MultipartUploadPartSummary{}
+		if start < len(numbers) {
+			n := numbers[start]
+			parts = append(parts, objectstorage.MultipartUploadPartSummary{
+				PartNumber: common.Int(n),
+				Etag:       common.String(upload.etags[n]),
+				Size:       common.Int64(int64(len(upload.parts[n]))),
+			})
+			if start+1 < len(numbers) {
+				w.Header().Set("Opc-Next-Page", strconv.Itoa(start+1))
+			}
+		}
+		reply(parts)
+	case http.MethodPost:
+		var req struct {
+			PartsToCommit []struct {
+				PartNum int    `json:"partNum"`
+				ETag    string `json:"etag"`
+			} `json:"partsToCommit"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil || len(req.PartsToCommit) == 0 {
+			fail(http.StatusBadRequest, "InvalidParameter")
+			return
+		}
+		var data []byte
+		for i, p := range req.PartsToCommit {
+			content, ok := upload.parts[p.PartNum]
+			if !ok || upload.etags[p.PartNum] != p.ETag || (i > 0 && p.PartNum <= req.PartsToCommit[i-1].PartNum) {
+				fail(http.StatusBadRequest, "InvalidUploadPart")
+				return
+			}
+			if i < len(req.PartsToCommit)-1 && len(content) < minChunkSize {
+				fail(http.StatusBadRequest, "PartTooSmall")
+				return
+			}
+			data = append(data, content...)
+		}
+		o.objects[upload.name] = &testObject{data: data, contentType: upload.contentType, metadata: map[string]string{}, modified: time.Now()}
+		delete(o.uploads, uploadID)
+	case http.MethodDelete:
+		delete(o.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fail(http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (o *testOCI) list(prefix, start, delimiter string, limit int) objectstorage.ListObjects {
+	names := make([]string, 0, len(o.objects))
+	for name := range o.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := objectstorage.ListObjects{Objects: []objectstorage.ObjectSummary{}}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || name < start {
+			continue
+		}
+		entry := ""
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				entry = name[:len(prefix)+i+1]
+				if seen[entry] {
+					continue
+				}
+			}
+		}
+		if len(list.Objects)+len(list.Prefixes) == limit {
+			list.NextStartWith = common.String(name)
+			break
+		}
+		if entry != "" {
+			seen[entry] = true
+			list.Prefixes = append(list.Prefixes, entry)
+			continue
+		}
+		obj := o.objects[name]
+		list.Objects = append(list.Objects, objectstorage.ObjectSummary{
+			Name:         common.String(name),
+			Size:         common.Int64(int64(len(obj.data))),
+			TimeModified: &common.SDKTime{Time: obj.modified},
+		})
+	}
+	return list
+}
+
+func TestOCIDriverSuiteWithTestServer(t *testing.T) {
+	// the test server holds objects in memory, which the 5GB file of
+	// TestWriteReadLargeStreams would not fit in
+	if !testing.Short() {
+		t.Skip("Skipping test outside of short mode")
+	}
+	o := newTestOCI(t)
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return New(context.Background(), o.parameters("/registry/suite"))
+	})
+}
+
+func TestFromParameters(t *testing.T) {
+	o := newTestOCI(t)
+	ctx := context.Background()
+
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyPath, o.parameters("").privateKey, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	valid := map[string]interface{}{
+		"tenancy":       testTenancy,
+		"user":          "ocid1.user.oc1..test",
+		"fingerprint":   "00:11:22",
+		"privatekey":    keyPath,
+		"region":        "us-test-1",
+		"endpoint":      o.URL,
+		"bucket":        testBucket,
+		"rootdirectory": "/registry",
+	}
+	if _, err := FromParameters(ctx, valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		override map[string]interface{}
+		err      string
+	}{
+		{map[string]interface{}{"bucket": ""}, "no bucket parameter provided"},
+		{map[string]interface{}{"tenancy": ""}, "no tenancy parameter provided"},
+		{map[string]interface{}{"privatekey": ""}, "no privatekey parameter provided"},
+		{map[string]interface{}{"privatekey": keyPath + ".missing"}, "unable to read privatekey"},
+		{map[string]interface{}{"auth": "password"}, `invalid auth "password"`},
+		{map[string]interface{}{"fingerprint": "33:44:55"}, "unable to get the object storage namespace"},
+		{map[string]interface{}{"namespace": "other"}, `unable to access bucket "registry"`},
+		{map[string]interface{}{"bucket": "other"}, `unable to access bucket "other"`},
+		{map[string]interface{}{"chunksize": "big"}, "chunksize must be an integer"},
+		{map[string]interface{}{"chunksize": 1024}, "chunksize 1024 must be larger than or equal to"},
+		{map[string]interface{}{"maxconcurrency": "many"}, "maxconcurrency config error"},
+	} {
+		params := make(map[string]interface{})
+		for k, v := range valid {
+			params[k] = v
+		}
+		for k, v := range tc.override {
+			params[k] = v
+		}
+		if _, err := FromParameters(ctx, params); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.override, tc.err, err)
+		}
+	}
+}
+
+func TestInstancePrincipal(t *testing.T) {
+	o := newTestOCI(t)
+	ctx := context.Background()
+	t.Setenv("OCI_METADATA_BASE_URL", o.URL+"/opc/v2")
+	t.Setenv("OCI_SDK_AUTH_CLIENT_REGION_URL", o.URL)
+
+	d, err := New(ctx, driverParameters{
+		auth:           authInstancePrincipal,
+		endpoint:       o.URL,
+		bucket:         testBucket,
+		rootDirectory:  "/registry",
+		chunkSize:      minChunkSize,
+		client:         o.Client(),
+		maxConcurrency: 8,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if content, err := d.GetContent(ctx, "/a"); err != nil || string(content) != "content" {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+	if o.tokens != 1 {
+		t.Fatalf("expected a single token to be issued, got %d", o.tokens)
+	}
+}
+
+// Test resuming a multipart upload, and that the upload session object is
+// hidden and deleted once the upload is committed
+func TestResumeUpload(t *testing.T) {
+	o := newTestOCI(t)
+	ctx := context.Background()
+
+	d, err := New(ctx, o.parameters("/registry"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents := make([]byte, 3*minChunkSize+42)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	offset := 0
+	for _, n := range []int{minChunkSize + 1, 10, minChunkSize} {
+		w, err := d.Writer(ctx, "/uploads/upload", offset > 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if w.Size() != int64(offset) {
+			t.Fatalf("unexpected size %d, expected %d", w.Size(), offset)
+		}
+		if _, err := w.Write(contents[offset : offset+n]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		offset += n
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := d.Stat(ctx, "/uploads/upload"); err == nil {
+		t.Fatal("expected the upload to be hidden until committed")
+	}
+	if list, err := d.List(ctx, "/uploads"); err == nil {
+		t.Fatalf("expected the upload session to be hidden, got %v", list)
+	}
+
+	w, err := d.Writer(ctx, "/uploads/upload", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := w.Write(contents[offset:]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	received, err := d.GetContent(ctx, "/uploads/upload")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(received, contents) {
+		t.Fatal("unexpected content")
+	}
+	if len(o.objects) != 1 || len(o.uploads) != 0 {
+		t.Fatalf("expected a single object, got %d objects and %d uploads", len(o.objects), len(o.uploads))
+	}
+}
+
+// Test that cancelling or deleting an upload aborts its multipart upload
+// and deletes its session object
+func TestCancelUpload(t *testing.T) {
+	o := newTestOCI(t)
+	ctx := context.Background()
+
+	d, err := New(ctx, o.parameters("/registry"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, cancel := range []func() error{
+		func() error {
+			w, err := d.Writer(ctx, "/uploads/upload", true)
+			if err != nil {
+				return err
+			}
+			return w.Cancel(ctx)
+		},
+		func() error {
+			return d.Delete(ctx, "/uploads")
+		},
+	} {
+		w, err := d.Writer(ctx, "/uploads/upload", false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := w.Write(make([]byte, 2*minChunkSize+1)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(o.objects) != 1 || len(o.uploads) != 1 {
+			t.Fatalf("expected a session object and an upload, got %d objects and %d uploads", len(o.objects), len(o.uploads))
+		}
+
+		if err := cancel(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(o.objects) != 0 || len(o.uploads) != 0 {
+			t.Fatalf("expected nothing to be left over, got %d objects and %d uploads", len(o.objects), len(o.uploads))
+		}
+	}
+}
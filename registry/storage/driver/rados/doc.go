@@ -0,0 +1,3 @@
+// Package rados implements the Ceph RADOS driver backend. It is built with
+// the include_rados build tag, and requires librados.
+package rados
@@ -0,0 +1,646 @@
+//go:build include_rados
+
+// Package rados provides a storagedriver.StorageDriver implementation to
+// store blobs in a Ceph RADOS pool, talking to the cluster with librados
+// rather than through a RADOS Gateway.
+//
+// The content of files is striped over RADOS objects of chunksize bytes,
+// named after a random ID of the file rather than its path, so that files
+// are moved without copying their content.
+//
+// Directories are RADOS objects whose omap maps the names of their children
+// to their metadata, so that directories are listed without listing the
+// objects of the pool. Like on a filesystem, directories are not deleted
+// when their last child is, and only files may be moved.
+package rados
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/google/uuid"
+)
+
+const (
+	driverName = "rados"
+
+	minChunkSize          = 64 * 1024
+	defaultChunkSize      = 4 * 1024 * 1024
+	defaultMaxConcurrency = 50
+	minConcurrency        = 25
+
+	defaultCluster  = "ceph"
+	defaultUsername = "admin"
+
+	// omapIteratorSize is the number of omap keys read at once when
+	// listing a directory.
+	omapIteratorSize = 1000
+)
+
+var _ storagedriver.FileWriter = &writer{}
+
+// driverParameters is a struct that encapsulates all of the driver parameters after all values have been set
+type driverParameters struct {
+	poolname   string
+	namespace  string
+	cluster    string
+	username   string
+	configfile string
+	keyring    string
+	monhost    string
+	chunkSize  uint64
+
+	// maxConcurrency limits the number of concurrent driver operations
+	// to RADOS.
+	maxConcurrency uint64
+}
+
+func init() {
+	factory.Register(driverName, &radosDriverFactory{})
+}
+
+// radosDriverFactory implements the factory.StorageDriverFactory interface
+type radosDriverFactory struct{}
+
+// Create StorageDriver from parameters
+func (factory *radosDriverFactory) Create(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+var _ storagedriver.StorageDriver = &driver{}
+
+// driver is a storagedriver.StorageDriver implementation backed by a RADOS
+// pool.
+type driver struct {
+	conn      *rados.Conn
+	ioctx     *rados.IOContext
+	chunkSize uint64
+}
+
+// Wrapper wraps `driver` with a throttler, ensuring that no more than N
+// RADOS operations can occur concurrently. The default limit is 50.
+type Wrapper struct {
+	baseEmbed
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// entry is the metadata of a child of a directory, stored as the value of
+// its omap key.
+type entry struct {
+	Dir     bool      `json:"dir,omitempty"`
+	ID      string    `json:"id,omitempty"`
+	Size    uint64    `json:"size,omitempty"`
+	ModTime time.Time `json:"modtime,omitempty"`
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - poolname
+func FromParameters(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	params := driverParameters{
+		cluster:   defaultCluster,
+		username:  defaultUsername,
+		chunkSize: defaultChunkSize,
+	}
+
+	poolname, ok := parameters["poolname"]
+	if !ok || fmt.Sprint(poolname) == "" {
+		return nil, fmt.Errorf("no poolname parameter provided")
+	}
+	params.poolname = fmt.Sprint(poolname)
+
+	for name, dest := range map[string]*string{
+		"namespace":  &params.namespace,
+		"cluster":    &params.cluster,
+		"username":   &params.username,
+		"configfile": &params.configfile,
+		"keyring":    &params.keyring,
+		"monhost":    &params.monhost,
+	} {
+		if value, ok := parameters[name]; ok && fmt.Sprint(value) != "" {
+			*dest = fmt.Sprint(value)
+		}
+	}
+
+	if chunkSizeParam, ok := parameters["chunksize"]; ok {
+		switch v := chunkSizeParam.(type) {
+		case string:
+			vv, err := strconv.ParseUint(v, 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("chunksize must be an integer, %v invalid", chunkSizeParam)
+			}
+			params.chunkSize = vv
+		case int, int32, int64:
+			params.chunkSize = uint64(reflect.ValueOf(v).Int())
+		case uint, uint32, uint64:
+			params.chunkSize = reflect.ValueOf(v).Uint()
+		default:
+			return nil, fmt.Errorf("invalid value for chunksize: %#v", chunkSizeParam)
+		}
+
+		if params.chunkSize < minChunkSize {
+			return nil, fmt.Errorf("chunksize %#v must be larger than or equal to %d", params.chunkSize, minChunkSize)
+		}
+	}
+
+	maxConcurrency, err := base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
+	}
+	params.maxConcurrency = maxConcurrency
+
+	return New(params)
+}
+
+// New constructs a new driver, connecting to the cluster.
+func New(params driverParameters) (storagedriver.StorageDriver, error) {
+	conn, err := rados.NewConnWithClusterAndUser(params.cluster, "client."+params.username)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create rados connection: %v", err)
+	}
+	if params.configfile != "" {
+		err = conn.ReadConfigFile(params.configfile)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ceph configuration: %v", err)
+	}
+	for option, value := range map[string]string{"keyring": params.keyring, "mon_host": params.monhost} {
+		if value == "" {
+			continue
+		}
+		if err := conn.SetConfigOption(option, value); err != nil {
+			return nil, fmt.Errorf("unable to set ceph option %s: %v", option, err)
+		}
+	}
+	if err := conn.Connect(); err != nil {
+		return nil, fmt.Errorf("unable to connect to ceph cluster %s: %v", params.cluster, err)
+	}
+
+	ioctx, err := conn.OpenIOContext(params.poolname)
+	if err != nil {
+		conn.Shutdown()
+		return nil, fmt.Errorf("unable to open rados pool %s: %v", params.poolname, err)
+	}
+	ioctx.SetNamespace(params.namespace)
+
+	d := &driver{
+		conn:      conn,
+		ioctx:     ioctx,
+		chunkSize: params.chunkSize,
+	}
+
+	return &Wrapper{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: base.NewRegulator(d, params.maxConcurrency),
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	r, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	id := uuid.NewString()
+	if err := d.write(id, contents, 0); err != nil {
+		d.removeStripes(id, uint64(len(contents)))
+		return err
+	}
+	return d.replace(path, &entry{ID: id, Size: uint64(len(contents)), ModTime: time.Now()})
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	e, err := d.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.Dir {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	if uint64(offset) > e.Size {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+	return &reader{driver: d, id: e.ID, offset: uint64(offset), size: e.Size}, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
+	w := &writer{
+		driver: d,
+		path:   path,
+		id:     uuid.NewString(),
+	}
+
+	if appendMode {
+		e, err := d.lookup(path)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || e.Dir {
+			return nil, storagedriver.PathNotFoundError{Path: path}
+		}
+		w.id, w.flushed = e.ID, e.Size
+	}
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current
+// size in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	e, err := d.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    path,
+		IsDir:   e.Dir,
+		Size:    int64(e.Size),
+		ModTime: e.ModTime,
+	}}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	e, err := d.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || !e.Dir {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+
+	children, err := d.children(path)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(children))
+	for name := range children {
+		list = append(list, strings.TrimSuffix(path, "/")+"/"+name)
+	}
+	return list, nil
+}
+
+// Move moves the file stored at sourcePath to destPath, removing the
+// original file. The content of the file is not copied.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	e, err := d.lookup(sourcePath)
+	if err != nil {
+		return err
+	}
+	if e == nil || e.Dir {
+		return storagedriver.PathNotFoundError{Path: sourcePath}
+	}
+
+	// the source is unlinked first, so that both paths never share the
+	// content, which deleting either would remove; if linking the
+	// destination fails, the content is left over
+	if err := d.unlink(sourcePath); err != nil {
+		return err
+	}
+	e.ModTime = time.Now()
+	return d.replace(destPath, e)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	e, err := d.lookup(path)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	if err := d.unlink(path); err != nil {
+		return err
+	}
+	return d.remove(path, e)
+}
+
+// RedirectURL returns an empty URL, as RADOS has no HTTP endpoint.
+func (d *driver) RedirectURL(*http.Request, string) (string, error) {
+	return "", nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// lookup returns the entry of path in its directory, or nil if there is
+// none.
+func (d *driver) lookup(p string) (*entry, error) {
+	if p == "/" {
+		return &entry{Dir: true}, nil
+	}
+	dir, name := path.Split(p)
+	// the first key starting with the name is the name itself, if present
+	values, err := d.ioctx.GetOmapValues(dirOID(dir), "", name, 1)
+	if err != nil {
+		if errors.Is(err, rados.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	value, ok := values[name]
+	if !ok {
+		return nil, nil
+	}
+	var e entry
+	if err := json.Unmarshal(value, &e); err != nil {
+		return nil, fmt.Errorf("invalid rados directory entry %s: %v", p, err)
+	}
+	return &e, nil
+}
+
+// children returns the entries of the directory at p.
+func (d *driver) children(p string) (map[string]*entry, error) {
+	values, err := d.ioctx.GetAllOmapValues(dirOID(p), "", "", omapIteratorSize)
+	if err != nil {
+		if errors.Is(err, rados.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	children := make(map[string]*entry, len(values))
+	for name, value := range values {
+		var e entry
+		if err := json.Unmarshal(value, &e); err != nil {
+			return nil, fmt.Errorf("invalid rados directory entry %s: %v", path.Join(p, name), err)
+		}
+		children[name] = &e
+	}
+	return children, nil
+}
+
+// replace links e at p, creating the parent directories of p, and removes
+// the content of the file it replaces.
+func (d *driver) replace(p string, e *entry) error {
+	previous, err := d.lookup(p)
+	if err != nil {
+		return err
+	}
+
+	dirValue, err := json.Marshal(entry{Dir: true})
+	if err != nil {
+		return err
+	}
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		parent, name := path.Split(dir)
+		if err := d.ioctx.SetOmap(dirOID(parent), map[string][]byte{name: dirValue}); err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	dir, name := path.Split(p)
+	if err := d.ioctx.SetOmap(dirOID(dir), map[string][]byte{name: value}); err != nil {
+		return err
+	}
+
+	if previous != nil && !previous.Dir && previous.ID != e.ID {
+		d.removeStripes(previous.ID, previous.Size)
+	}
+	return nil
+}
+
+// unlink removes the entry of p from its directory.
+func (d *driver) unlink(p string) error {
+	dir, name := path.Split(p)
+	return d.ioctx.RmOmapKeys(dirOID(dir), []string{name})
+}
+
+// remove removes the content of the unlinked entry e of p, and the
+// children of directories.
+func (d *driver) remove(p string, e *entry) error {
+	if !e.Dir {
+		d.removeStripes(e.ID, e.Size)
+		return nil
+	}
+	children, err := d.children(p)
+	if err != nil {
+		return err
+	}
+	for name, child := range children {
+		if err := d.remove(path.Join(p, name), child); err != nil {
+			return err
+		}
+	}
+	if err := d.ioctx.Delete(dirOID(p)); err != nil && !errors.Is(err, rados.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// write writes data at offset of the content of the file id, striped over
+// objects of the chunk size.
+func (d *driver) write(id string, data []byte, offset uint64) error {
+	for len(data) > 0 {
+		off := offset % d.chunkSize
+		n := min(uint64(len(data)), d.chunkSize-off)
+		if err := d.ioctx.Write(stripeOID(id, offset/d.chunkSize), data[:n], off); err != nil {
+			return err
+		}
+		data = data[n:]
+		offset += n
+	}
+	return nil
+}
+
+// removeStripes deletes the objects of the content of the file id. Objects
+// failing to be deleted are left over, as they are not reachable anymore.
+func (d *driver) removeStripes(id string, size uint64) {
+	for n := uint64(0); n*d.chunkSize < size; n++ {
+		_ = d.ioctx.Delete(stripeOID(id, n))
+	}
+}
+
+// dirOID returns the name of the object of the directory at p.
+func dirOID(p string) string {
+	return "dir:" + path.Clean(p)
+}
+
+// stripeOID returns the name of the nth object of the content of the file id.
+func stripeOID(id string, n uint64) string {
+	return fmt.Sprintf("blob:%s.%016x", id, n)
+}
+
+type reader struct {
+	driver *driver
+	id     string
+	offset uint64
+	size   uint64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	chunkSize := r.driver.chunkSize
+	off := r.offset % chunkSize
+	n := min(uint64(len(p)), chunkSize-off, r.size-r.offset)
+	read, err := r.driver.ioctx.Read(stripeOID(r.id, r.offset/chunkSize), p[:n], off)
+	if err != nil {
+		return 0, err
+	}
+	if read == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.offset += uint64(read)
+	return read, nil
+}
+
+func (r *reader) Close() error {
+	return nil
+}
+
+type writer struct {
+	driver *driver
+	path   string
+	id     string
+
+	// flushed is the size of the content written to the stripes, the
+	// buffer holding the content written after.
+	flushed uint64
+	buffer  []byte
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	w.buffer = append(w.buffer, p...)
+	if uint64(len(w.buffer)) >= w.driver.chunkSize {
+		if err := w.flush(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes the buffer to the stripes.
+func (w *writer) flush() error {
+	if err := w.driver.write(w.id, w.buffer, w.flushed); err != nil {
+		return err
+	}
+	w.flushed += uint64(len(w.buffer))
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+// Size returns the number of bytes written to this FileWriter.
+func (w *writer) Size() int64 {
+	return int64(w.flushed) + int64(len(w.buffer))
+}
+
+// Close flushes the content written to this FileWriter and links it at its
+// path, so that the upload can be resumed.
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.committed {
+		return nil
+	}
+	return w.link()
+}
+
+// Cancel removes any written content from this FileWriter.
+func (w *writer) Cancel(ctx context.Context) error {
+	w.closed = true
+	w.cancelled = true
+
+	e, err := w.driver.lookup(w.path)
+	if err != nil {
+		return err
+	}
+	if e != nil && e.ID == w.id {
+		if err := w.driver.unlink(w.path); err != nil {
+			return err
+		}
+	}
+	w.driver.removeStripes(w.id, w.flushed)
+	return nil
+}
+
+// Commit flushes all content written to this FileWriter and makes it
+// available for future calls to StorageDriver.GetContent and
+// StorageDriver.Reader.
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+
+	if err := w.link(); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+// link flushes the buffer, and links the content at the path of the writer.
+func (w *writer) link() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.driver.replace(w.path, &entry{ID: w.id, Size: w.flushed, ModTime: time.Now()})
+}
@@ -0,0 +1,63 @@
+//go:build include_rados
+
+package rados
+
+import (
+	"os"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+)
+
+var (
+	radosDriverConstructor func() (storagedriver.StorageDriver, error)
+	skipCheck              func(tb testing.TB)
+)
+
+func init() {
+	poolname := os.Getenv("RADOS_POOL")
+	username := os.Getenv("RADOS_USER")
+
+	// Skip RADOS storage driver tests if environment variable parameters are not provided
+	skipCheck = func(tb testing.TB) {
+		tb.Helper()
+
+		if poolname == "" {
+			tb.Skip("The following environment variables must be set to enable these tests: RADOS_POOL")
+		}
+	}
+
+	radosDriverConstructor = func() (storagedriver.StorageDriver, error) {
+		parameters := map[string]interface{}{
+			"poolname":  poolname,
+			"username":  username,
+			"namespace": os.Getenv("RADOS_NAMESPACE"),
+		}
+		return FromParameters(parameters)
+	}
+}
+
+func TestRADOSDriverSuite(t *testing.T) {
+	skipCheck(t)
+	testsuites.Driver(t, radosDriverConstructor)
+}
+
+func BenchmarkRADOSDriverSuite(b *testing.B) {
+	skipCheck(b)
+	testsuites.BenchDriver(b, radosDriverConstructor)
+}
+
+func TestFromParametersRequiresPoolname(t *testing.T) {
+	for _, parameters := range []map[string]interface{}{
+		{},
+		{"poolname": ""},
+		{"poolname": "registry", "chunksize": "big"},
+		{"poolname": "registry", "chunksize": 1024},
+		{"poolname": "registry", "maxconcurrency": "many"},
+	} {
+		if _, err := FromParameters(parameters); err == nil {
+			t.Errorf("expected an error with parameters %v", parameters)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// checksums maps the checksum algorithms S3 verifies uploads with to their
+// hash functions.
+var checksums = map[string]func() hash.Hash{
+	string(types.ChecksumAlgorithmCrc32):  func() hash.Hash { return crc32.NewIEEE() },
+	string(types.ChecksumAlgorithmCrc32c): func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	string(types.ChecksumAlgorithmSha256): sha256.New,
+}
+
+// checksumAlgorithms returns the sorted names of the checksum algorithms.
+func checksumAlgorithms() []string {
+	names := make([]string, 0, len(checksums))
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checksumFields are the checksum algorithm of the driver and the checksum
+// of the content of an upload, of which only the one of the algorithm is set.
+type checksumFields struct {
+	Algorithm types.ChecksumAlgorithm
+	CRC32     *string
+	CRC32C    *string
+	SHA256    *string
+}
+
+// checksum returns the checksum of the content of an upload, with which S3
+// verifies the content it stores. The SDK would send the checksum in a
+// trailer, which S3 compatible services seldom support, but the content of
+// uploads is buffered, so it is computed before the request is sent, and
+// sent in a header.
+func (d *driver) checksum(data []byte) checksumFields {
+	var fields checksumFields
+	if d.ChecksumAlgorithm == "" {
+		return fields
+	}
+	h := checksums[d.ChecksumAlgorithm]()
+	h.Write(data)
+	sum := aws.String(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	fields.Algorithm = d.getChecksumAlgorithm()
+	switch fields.Algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		fields.CRC32 = sum
+	case types.ChecksumAlgorithmCrc32c:
+		fields.CRC32C = sum
+	case types.ChecksumAlgorithmSha256:
+		fields.SHA256 = sum
+	}
+	return fields
+}
+
+func (d *driver) getChecksumAlgorithm() types.ChecksumAlgorithm {
+	return types.ChecksumAlgorithm(d.ChecksumAlgorithm)
+}
+
+// completedPart returns the part to complete a multipart upload with, which
+// has the checksum of the part when the upload was created with a checksum
+// algorithm.
+func completedPart(part types.Part) types.CompletedPart {
+	return types.CompletedPart{
+		ETag:           part.ETag,
+		PartNumber:     part.PartNumber,
+		ChecksumCRC32:  part.ChecksumCRC32,
+		ChecksumCRC32C: part.ChecksumCRC32C,
+		ChecksumSHA256: part.ChecksumSHA256,
+	}
+}
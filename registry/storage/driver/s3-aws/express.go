@@ -0,0 +1,87 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// directoryBucketSuffix ends the names of the directory buckets of S3 Express
+// One Zone, which are named <base name>--<zone id>--x-s3.
+const directoryBucketSuffix = "--x-s3"
+
+// isDirectoryBucket tells whether bucket is a directory bucket. The SDK
+// authenticates the requests to directory buckets with the sessions it
+// creates with the credentials of the driver.
+func isDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, directoryBucketSuffix)
+}
+
+// zonalEndpoint returns the endpoint of the zone of the directory bucket.
+func zonalEndpoint(bucket, region string) (string, error) {
+	name := strings.TrimSuffix(bucket, directoryBucketSuffix)
+	i := strings.LastIndex(name, "--")
+	if i <= 0 || i+2 == len(name) {
+		return "", fmt.Errorf("invalid directory bucket name %q, expected <name>--<zone id>%s", bucket, directoryBucketSuffix)
+	}
+	return fmt.Sprintf("https://s3express-%s.%s.amazonaws.com", name[i+2:], region), nil
+}
+
+// validateDirectoryBucket checks that the parameters only use the features
+// directory buckets support.
+func validateDirectoryBucket(params DriverParameters) error {
+	switch {
+	case params.StorageClass != string(types.StorageClassExpressOnezone) && params.StorageClass != noStorageClass:
+		return fmt.Errorf("the storageclass parameter must be one of %v for directory buckets", []string{string(types.StorageClassExpressOnezone), noStorageClass})
+	case params.ObjectACL != string(types.ObjectCannedACLPrivate):
+		return fmt.Errorf("directory buckets do not support object ACLs")
+	case params.SSECustomerKey != "":
+		return fmt.Errorf("directory buckets do not support the ssecustomerkey parameter")
+	case params.ObjectTagging:
+		return fmt.Errorf("directory buckets do not support the objecttagging parameter")
+	case params.RequesterPays:
+		return fmt.Errorf("directory buckets do not support the requesterpays parameter")
+	case len(params.FailoverEndpoints) > 0:
+		return fmt.Errorf("directory buckets do not support the failoverendpoints parameter")
+	case params.Accelerate || params.UseDualStack:
+		return fmt.Errorf("directory buckets do not support accelerate or dual-stack endpoints")
+	case !params.V4Auth:
+		return fmt.Errorf("directory buckets require v4 authentication")
+	}
+	return nil
+}
+
+// listDirectoryBucketObjectsV2 calls fn with all the objects of input, in
+// sorted order, as a single page. Directory buckets list objects in no
+// particular order, and do not support StartAfter, for which the objects
+// are filtered instead.
+func (d *driver) listDirectoryBucketObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output) bool) error {
+	startAfter := aws.ToString(input.StartAfter)
+	listInput := *input
+	listInput.StartAfter = nil
+
+	var objects []types.Object
+	paginator := s3.NewListObjectsV2Paginator(d.S3, &listInput)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			if aws.ToString(object.Key) > startAfter {
+				objects = append(objects, object)
+			}
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return aws.ToString(objects[i].Key) < aws.ToString(objects[j].Key)
+	})
+	fn(&s3.ListObjectsV2Output{Contents: objects})
+	return nil
+}
@@ -0,0 +1,180 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+func TestZonalEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		bucket   string
+		endpoint string
+		err      bool
+	}{
+		{bucket: "registry--usw2-az1--x-s3", endpoint: "https://s3express-usw2-az1.us-west-2.amazonaws.com"},
+		{bucket: "my--registry--usw2-az1--x-s3", endpoint: "https://s3express-usw2-az1.us-west-2.amazonaws.com"},
+		{bucket: "registry--x-s3", err: true},
+		{bucket: "--usw2-az1--x-s3", err: true},
+		{bucket: "registry----x-s3", err: true},
+	} {
+		endpoint, err := zonalEndpoint(tc.bucket, "us-west-2")
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got endpoint %s", tc.bucket, endpoint)
+			}
+		} else if err != nil || endpoint != tc.endpoint {
+			t.Errorf("%s: unexpected endpoint %q, expected %q: %v", tc.bucket, endpoint, tc.endpoint, err)
+		}
+	}
+}
+
+func TestDirectoryBucketParameters(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"storageclass": "STANDARD"}, "the storageclass parameter must be one of [EXPRESS_ONEZONE NONE] for directory buckets"},
+		{map[string]interface{}{"objectacl": "bucket-owner-full-control"}, "directory buckets do not support object ACLs"},
+		{map[string]interface{}{"objecttagging": true}, "directory buckets do not support the objecttagging parameter"},
+		{map[string]interface{}{"requesterpays": true}, "directory buckets do not support the requesterpays parameter"},
+		{map[string]interface{}{"accelerate": true}, "directory buckets do not support accelerate or dual-stack endpoints"},
+		{map[string]interface{}{"v4auth": false, "regionendpoint": "https://storage.example.com"}, "directory buckets require v4 authentication"},
+	} {
+		params := map[string]interface{}{
+			"region": "us-west-2",
+			"bucket": "registry--usw2-az1--x-s3",
+		}
+		for k, v := range tc.params {
+			params[k] = v
+		}
+		if _, err := FromParameters(ctx, params); err == nil || err.Error() != tc.err {
+			t.Errorf("%v: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+
+	for _, storageClass := range []string{"", "express_onezone", noStorageClass} {
+		params := map[string]interface{}{
+			"region":    "us-west-2",
+			"bucket":    "registry--usw2-az1--x-s3",
+			"accesskey": "accesskey",
+			"secretkey": "secretkey",
+		}
+		if storageClass != "" {
+			params["storageclass"] = storageClass
+		}
+		d, err := FromParameters(ctx, params)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", storageClass, err)
+		}
+		s3drv := d.baseEmbed.Base.StorageDriver.(*driver)
+		if s3drv.Endpoint != "https://s3express-usw2-az1.us-west-2.amazonaws.com" {
+			t.Errorf("unexpected endpoint %s, expected the zonal endpoint of the bucket", s3drv.Endpoint)
+		}
+		if expected := strings.ToUpper(storageClass); expected != "" && s3drv.StorageClass != expected || expected == "" && s3drv.StorageClass != "EXPRESS_ONEZONE" {
+			t.Errorf("unexpected storage class %s", s3drv.StorageClass)
+		}
+	}
+}
+
+func TestDirectoryBucket(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+	s.bucket = "registry--usw2-az1--x-s3"
+	s.directoryBucket = true
+
+	d, err := FromParameters(ctx, map[string]interface{}{
+		"region":         "us-west-2",
+		"regionendpoint": s.URL,
+		"forcepathstyle": true,
+		"skipverify":     true,
+		"bucket":         s.bucket,
+		"accesskey":      "accesskey",
+		"secretkey":      "secretkey",
+		"rootdirectory":  "/registry",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	contents := []byte("contents")
+	for _, path := range []string{"/dir/b/file2", "/dir/a/file1", "/dir/a/file3", "/dirfile"} {
+		if err := d.PutContent(ctx, path, contents); err != nil {
+			t.Fatalf("unexpected error putting %s: %v", path, err)
+		}
+	}
+	w, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if err := d.Move(ctx, "/upload", "/dir/b/file4"); err != nil {
+		t.Fatalf("unexpected error moving: %v", err)
+	}
+	if received, err := d.GetContent(ctx, "/dir/b/file4"); err != nil || !bytes.Equal(received, contents) {
+		t.Fatalf("unexpected content %q: %v", received, err)
+	}
+
+	// objects are walked in sorted order, whichever order they are listed in
+	var walked []string
+	err = d.Walk(ctx, "/dir", func(fi storagedriver.FileInfo) error {
+		walked = append(walked, fi.Path())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error walking: %v", err)
+	}
+	expected := []string{"/dir/a", "/dir/a/file1", "/dir/a/file3", "/dir/b", "/dir/b/file2", "/dir/b/file4"}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("unexpected walk %v, expected %v", walked, expected)
+	}
+
+	walked = nil
+	err = d.Walk(ctx, "/dir", func(fi storagedriver.FileInfo) error {
+		walked = append(walked, fi.Path())
+		return nil
+	}, storagedriver.WithStartAfterHint("/dir/a/file3"))
+	if err != nil {
+		t.Fatalf("unexpected error walking: %v", err)
+	}
+	expected = []string{"/dir/b", "/dir/b/file2", "/dir/b/file4"}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("unexpected walk after hint %v, expected %v", walked, expected)
+	}
+
+	// the objects sharing the prefix of the path are not taken for its
+	// children
+	if fi, err := d.Stat(ctx, "/dir"); err != nil || !fi.IsDir() {
+		t.Errorf("unexpected stat %v: %v", fi, err)
+	}
+	if _, err := d.Stat(ctx, "/dirf"); err == nil {
+		t.Error("expected an error for the stat of a prefix of a file")
+	}
+
+	if err := d.Delete(ctx, "/dir"); err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+	if len(s.objects) != 1 {
+		t.Errorf("expected the objects of /dir to be deleted, %d objects left", len(s.objects))
+	}
+
+	if url, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, "/", nil), "/dirfile"); err != nil || url != "" {
+		t.Errorf("expected no redirect, got %q: %v", url, err)
+	}
+	if s.sessions != 1 {
+		t.Errorf("expected the session to be reused until it expires, %d sessions were created", s.sessions)
+	}
+}
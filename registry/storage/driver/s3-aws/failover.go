@@ -0,0 +1,197 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+const (
+	// defaultFailoverThreshold is the default number of consecutive failed
+	// attempts after which requests fail over to the next endpoint.
+	defaultFailoverThreshold = 3
+
+	// defaultFailbackInterval is the default interval of the health checks of
+	// the endpoints requests failed over from.
+	defaultFailbackInterval = 30 * time.Second
+)
+
+// readOperations are the operations that fail over whether or not writes do.
+var readOperations = map[string]struct{}{
+	"GetObject":     {},
+	"HeadObject":    {},
+	"HeadBucket":    {},
+	"ListObjects":   {},
+	"ListObjectsV2": {},
+}
+
+// failoverEndpointKey pins the requests of health checks to an endpoint.
+type failoverEndpointKey struct{}
+
+// failover sends requests to the first healthy endpoint of a list ordered by
+// priority, for S3 compatible services replicated across sites. The
+// endpoint requests are sent to is considered unhealthy after threshold
+// consecutive failed attempts, and requests fail over to the next
+// endpoint. Once failed over, the endpoints of higher priority are checked
+// every interval, and requests fail back to the first that is healthy.
+type failover struct {
+	endpoints []*url.URL
+	writes    bool
+	threshold int
+	interval  time.Duration
+	bucket    string
+	client    *s3.Client
+
+	mu       sync.Mutex
+	active   int
+	failures int
+	checking bool
+	checked  time.Time
+}
+
+// newFailover returns the failover of the driver parameters, whose first
+// endpoint is the region endpoint.
+func newFailover(params DriverParameters) (*failover, error) {
+	f := &failover{
+		writes:    params.FailoverWrites,
+		threshold: params.FailoverThreshold,
+		interval:  params.FailbackInterval,
+		bucket:    params.Bucket,
+	}
+	for _, endpoint := range append([]string{params.RegionEndpoint}, params.FailoverEndpoints...) {
+		u, err := url.Parse(addScheme(endpoint, params.Secure))
+		if err != nil {
+			return nil, err
+		}
+		f.endpoints = append(f.endpoints, u)
+	}
+	return f, nil
+}
+
+// middleware returns the middleware routing each attempt of requests, which
+// runs before attempts are signed for their endpoint.
+func (f *failover) middleware(stack *middleware.Stack) error {
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("distribution.Failover", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		req, ok := in.Request.(*smithyhttp.Request)
+		if !ok {
+			return next.HandleFinalize(ctx, in)
+		}
+		f.route(ctx, req)
+		out, metadata, err := next.HandleFinalize(ctx, in)
+		f.update(ctx, req, err)
+		return out, metadata, err
+	}), "Signing", middleware.Before)
+}
+
+// route sends req to the active endpoint, or to the first endpoint for the
+// writes that do not fail over.
+func (f *failover) route(ctx context.Context, req *smithyhttp.Request) {
+	endpoint, pinned := ctx.Value(failoverEndpointKey{}).(int)
+	if !pinned {
+		f.mu.Lock()
+		endpoint = f.active
+		if endpoint > 0 && !f.checking && time.Since(f.checked) >= f.interval {
+			f.checking = true
+			go f.check()
+		}
+		f.mu.Unlock()
+
+		if _, read := readOperations[middleware.GetOperationName(ctx)]; !read && !f.writes {
+			endpoint = 0
+		}
+	}
+
+	// virtual hosted-style requests are sent to the bucket subdomain of
+	// the endpoint
+	u := req.URL
+	current := f.endpoints[f.endpointOf(u)]
+	u.Scheme = f.endpoints[endpoint].Scheme
+	u.Host = strings.TrimSuffix(u.Host, current.Host) + f.endpoints[endpoint].Host
+}
+
+// update counts the consecutive failed attempts of the active endpoint,
+// and fails over to the next endpoint at the threshold.
+func (f *failover) update(ctx context.Context, req *smithyhttp.Request, err error) {
+	if _, pinned := ctx.Value(failoverEndpointKey{}).(int); pinned {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.endpointOf(req.URL) != f.active {
+		return
+	}
+	// requests canceled by their callers tell nothing of the endpoint
+	var respErr *awshttp.ResponseError
+	if err == nil || ctx.Err() != nil ||
+		errors.As(err, &respErr) && respErr.HTTPStatusCode() > 0 && respErr.HTTPStatusCode() < 500 {
+		f.failures = 0
+		return
+	}
+	f.failures++
+	if f.failures < f.threshold || f.active == len(f.endpoints)-1 {
+		return
+	}
+	dcontext.GetLogger(ctx).Warnf("s3aws: %d consecutive requests to %s failed, failing over to %s: %v", f.failures, f.endpoints[f.active], f.endpoints[f.active+1], err)
+	f.active++
+	f.failures = 0
+	f.checked = time.Now()
+}
+
+// check checks the endpoints of higher priority than the active endpoint,
+// and fails back to the first that is healthy.
+func (f *failover) check() {
+	f.mu.Lock()
+	active := f.active
+	f.mu.Unlock()
+
+	healthy := active
+	for i := 0; i < active; i++ {
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), failoverEndpointKey{}, i), f.interval)
+		_, err := f.client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(f.bucket),
+		}, func(o *s3.Options) {
+			o.Retryer = aws.NopRetryer{}
+		})
+		cancel()
+		if err == nil {
+			healthy = i
+			break
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if healthy < f.active {
+		dcontext.GetLogger(context.Background()).Infof("s3aws: %s is healthy, failing back from %s", f.endpoints[healthy], f.endpoints[f.active])
+		f.active = healthy
+		f.failures = 0
+	}
+	f.checking = false
+	f.checked = time.Now()
+}
+
+// endpointOf returns the index of the endpoint of u, which is the first
+// endpoint when the host of u is not that of an endpoint.
+func (f *failover) endpointOf(u *url.URL) int {
+	for i, endpoint := range f.endpoints {
+		if u.Host == endpoint.Host || strings.HasSuffix(u.Host, "."+endpoint.Host) {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,134 @@
+package s3
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailoverParameters(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"regionendpoint": nil}, "the failoverendpoints parameter requires the regionendpoint parameter"},
+		{map[string]interface{}{"failoverendpoints": "http://site2.example.com,"}, "the failoverendpoints parameter should not contain empty endpoints"},
+		{map[string]interface{}{"failoverendpoints": 1}, "the failoverendpoints parameter should be a list of endpoints"},
+		{map[string]interface{}{"failoverwrites": "sometimes"}, "the failoverWrites parameter should be a boolean"},
+		{map[string]interface{}{"failoverthreshold": 0}, "the failoverthreshold 0 parameter should be a number between 1 and 2147483647 (inclusive)"},
+		{map[string]interface{}{"failbackinterval": "0s"}, "the failbackinterval parameter must be positive"},
+	} {
+		params := map[string]interface{}{
+			"region":            "us-east-1",
+			"regionendpoint":    "http://site1.example.com",
+			"bucket":            "registry",
+			"failoverendpoints": []interface{}{"http://site2.example.com"},
+		}
+		for k, v := range tc.params {
+			if v == nil {
+				delete(params, k)
+			} else {
+				params[k] = v
+			}
+		}
+		if _, err := FromParameters(ctx, params); err == nil || err.Error() != tc.err {
+			t.Errorf("%v: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+	primary := newTestS3(t)
+	secondary := newTestS3(t)
+
+	newDriver := func(endpoint string, params map[string]interface{}) *Driver {
+		parameters := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": endpoint,
+			"forcepathstyle": true,
+			"skipverify":     true,
+			"bucket":         "registry",
+			"accesskey":      "accesskey",
+			"secretkey":      "secretkey",
+			"maxretries":     0,
+		}
+		for k, v := range params {
+			parameters[k] = v
+		}
+		d, err := FromParameters(ctx, parameters)
+		if err != nil {
+			t.Fatalf("unexpected error creating driver: %v", err)
+		}
+		return d
+	}
+	setFailures := func(s *testS3, failures int) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.failures = failures
+	}
+
+	// the sites hold distinct contents, to tell which served the reads
+	for _, s := range []*testS3{primary, secondary} {
+		if err := newDriver(s.URL, nil).PutContent(ctx, "/file", []byte(s.URL)); err != nil {
+			t.Fatalf("unexpected error putting content: %v", err)
+		}
+	}
+
+	d := newDriver(primary.URL, map[string]interface{}{
+		"failoverendpoints": secondary.URL,
+		"failoverthreshold": 2,
+		"failbackinterval":  "50ms",
+	})
+	if contents, err := d.GetContent(ctx, "/file"); err != nil || string(contents) != primary.URL {
+		t.Fatalf("unexpected content %q, expected the content of the primary site: %v", contents, err)
+	}
+
+	setFailures(primary, 1000)
+	for i := 0; i < 2; i++ {
+		if _, err := d.GetContent(ctx, "/file"); err == nil {
+			t.Fatal("expected an error while the primary site is down")
+		}
+	}
+	if contents, err := d.GetContent(ctx, "/file"); err != nil || string(contents) != secondary.URL {
+		t.Fatalf("unexpected content %q, expected reads to fail over to the secondary site: %v", contents, err)
+	}
+	if err := d.PutContent(ctx, "/file", []byte("contents")); err == nil || !strings.Contains(err.Error(), "SlowDown") {
+		t.Errorf("unexpected error %v, expected writes to be sent to the primary site", err)
+	}
+
+	w := newDriver(primary.URL, map[string]interface{}{
+		"failoverendpoints": []interface{}{secondary.URL},
+		"failoverwrites":    "true",
+		"failoverthreshold": 1,
+	})
+	if err := w.PutContent(ctx, "/written", []byte("contents")); err == nil {
+		t.Fatal("expected an error while the primary site is down")
+	}
+	if err := w.PutContent(ctx, "/written", []byte("contents")); err != nil {
+		t.Fatalf("unexpected error %v, expected writes to fail over to the secondary site", err)
+	}
+	if _, ok := secondary.objects["written"]; !ok {
+		t.Error("expected the content to be written to the secondary site")
+	}
+
+	// the primary site is checked until it recovers
+	setFailures(primary, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		contents, err := d.GetContent(ctx, "/file")
+		if err != nil {
+			t.Fatalf("unexpected error while failing back: %v", err)
+		}
+		if string(contents) == primary.URL {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected reads to fail back to the primary site")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
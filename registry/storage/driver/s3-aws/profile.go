@@ -0,0 +1,345 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// profile describes how an S3 compatible service differs from Amazon S3, so
+// that the driver only uses the features the service supports.
+type profile struct {
+	// forcePathStyle is the default of the forcepathstyle parameter.
+	forcePathStyle bool
+
+	// storageClasses lists the storage classes of the service, the first
+	// being the default. Requests are sent without storage class to services
+	// which do not list any.
+	storageClasses []string
+
+	// objectACLs lists the canned ACLs of the service, all of them if nil.
+	objectACLs []string
+
+	// encrypt and kms tell whether the service supports server-side
+	// encryption with keys it manages, and with KMS keys.
+	encrypt bool
+	kms     bool
+
+	// awsEndpoints tells whether the service has accelerate and dual-stack
+	// endpoints.
+	awsEndpoints bool
+
+	// contentMD5 tells whether MD5 checksums of uploaded content are sent,
+	// for the service to verify.
+	contentMD5 bool
+
+	// multipartCopyMaxConcurrency is the default of the
+	// multipartcopymaxconcurrency parameter.
+	multipartCopyMaxConcurrency int64
+}
+
+const awsProfile = "aws"
+
+// profiles are the compatibility profiles of the services known to work with
+// the driver, by name.
+var profiles = map[string]profile{
+	awsProfile: {
+		storageClasses:              s3StorageClasses[1:],
+		encrypt:                     true,
+		kms:                         true,
+		awsEndpoints:                true,
+		contentMD5:                  true,
+		multipartCopyMaxConcurrency: defaultMultipartCopyMaxConcurrency,
+	},
+	"minio": {
+		forcePathStyle:              true,
+		storageClasses:              []string{string(types.StorageClassStandard), string(types.StorageClassReducedRedundancy)},
+		objectACLs:                  []string{string(types.ObjectCannedACLPrivate)},
+		encrypt:                     true,
+		kms:                         true,
+		contentMD5:                  true,
+		multipartCopyMaxConcurrency: defaultMultipartCopyMaxConcurrency,
+	},
+	"ceph": {
+		forcePathStyle:              true,
+		storageClasses:              []string{string(types.StorageClassStandard)},
+		encrypt:                     true,
+		kms:                         true,
+		contentMD5:                  true,
+		multipartCopyMaxConcurrency: 32,
+	},
+	"spaces": {
+		objectACLs:                  []string{string(types.ObjectCannedACLPrivate), string(types.ObjectCannedACLPublicRead)},
+		multipartCopyMaxConcurrency: 10,
+	},
+	"wasabi": {
+		storageClasses:              []string{string(types.StorageClassStandard)},
+		encrypt:                     true,
+		multipartCopyMaxConcurrency: 32,
+	},
+}
+
+// profileNames returns the sorted names of the profiles.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// defaultStorageClass returns the storage class used when the storageclass
+// parameter is not set.
+func (p profile) defaultStorageClass() string {
+	if len(p.storageClasses) == 0 {
+		return noStorageClass
+	}
+	return p.storageClasses[0]
+}
+
+// validate returns an error if params use features the service lacks.
+func (p profile) validate(name string, params DriverParameters) error {
+	if params.StorageClass != noStorageClass && !slices.Contains(p.storageClasses, params.StorageClass) {
+		return fmt.Errorf("the storageclass parameter must be one of %v for the %s profile, %v invalid",
+			append([]string{noStorageClass}, p.storageClasses...), name, params.StorageClass)
+	}
+	if p.objectACLs != nil && !slices.Contains(p.objectACLs, params.ObjectACL) {
+		return fmt.Errorf("the objectacl parameter must be one of %v for the %s profile, %v invalid", p.objectACLs, name, params.ObjectACL)
+	}
+	if params.Encrypt && !p.encrypt {
+		return fmt.Errorf("the %s profile does not support server-side encryption", name)
+	}
+	if params.Encrypt && params.KeyID != "" && !p.kms {
+		return fmt.Errorf("the %s profile does not support server-side encryption with KMS keys", name)
+	}
+	if (params.Accelerate || params.UseDualStack) && !p.awsEndpoints {
+		return fmt.Errorf("the %s profile does not support accelerate or dual-stack endpoints", name)
+	}
+	return nil
+}
+
+// addContentMD5 sets the Content-MD5 header of the requests uploading
+// content, for the service to verify it. The SDK sets it on DeleteObjects
+// requests, which S3 requires it for, itself.
+func addContentMD5(stack *middleware.Stack) error {
+	switch stack.ID() {
+	case "PutObject", "UploadPart":
+		return smithyhttp.AddContentChecksumMiddleware(stack)
+	}
+	return nil
+}
+
+// probe checks that the service behaves as the driver expects, running the
+// operations the driver relies on against objects it creates, and deletes,
+// under a random prefix of the root directory.
+func (d *driver) probe(ctx context.Context) (err error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	prefix := d.s3Path("/_probe/"+hex.EncodeToString(id[:])) + "/"
+	content := []byte("distribution conformance probe")
+	keys := []string{prefix + "a", prefix + "b", prefix + "copy", prefix + "multipart-copy"}
+
+	defer func() {
+		// the objects are deleted by the last step, unless a step failed
+		if err == nil {
+			return
+		}
+		objects := make([]types.ObjectIdentifier, len(keys))
+		for i := range keys {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(keys[i])}
+		}
+		_, _ = d.S3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(d.Bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+	}()
+
+	head := func(key string) error {
+		resp, err := d.S3.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(key),
+			SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+			SSECustomerKey:       d.getSSECustomerKey(),
+		})
+		if err != nil {
+			return err
+		}
+		if aws.ToInt64(resp.ContentLength) != int64(len(content)) {
+			return fmt.Errorf("object %s is %d bytes, expected %d", key, aws.ToInt64(resp.ContentLength), len(content))
+		}
+		return nil
+	}
+
+	sum := d.checksum(content)
+	for _, key := range keys[:2] {
+		_, err := d.S3.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(key),
+			ContentType:          d.getContentType(),
+			ACL:                  d.getACL(),
+			ServerSideEncryption: d.getEncryptionMode(),
+			SSEKMSKeyId:          d.getSSEKMSKeyID(),
+			StorageClass:         d.getStorageClass(),
+			SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+			SSECustomerKey:       d.getSSECustomerKey(),
+			ChecksumAlgorithm:    sum.Algorithm,
+			ChecksumCRC32:        sum.CRC32,
+			ChecksumCRC32C:       sum.CRC32C,
+			ChecksumSHA256:       sum.SHA256,
+			Body:                 bytes.NewReader(content),
+		})
+		if err != nil {
+			return fmt.Errorf("PutObject: %w", err)
+		}
+	}
+	if err := head(keys[0]); err != nil {
+		return fmt.Errorf("HeadObject: %w", err)
+	}
+
+	// list the objects a page at a time, as the driver relies on the
+	// continuation of truncated lists
+	var listed []string
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(d.Bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(1),
+	}
+	for page := 0; ; page++ {
+		if page == len(keys) {
+			return errors.New("ListObjectsV2: continuation tokens are ignored")
+		}
+		resp, err := d.S3.ListObjectsV2(ctx, input)
+		if err != nil {
+			return fmt.Errorf("ListObjectsV2: %w", err)
+		}
+		if len(resp.Contents) > 1 {
+			return fmt.Errorf("ListObjectsV2: %d objects listed, more than the maximum of 1", len(resp.Contents))
+		}
+		for _, obj := range resp.Contents {
+			listed = append(listed, aws.ToString(obj.Key))
+		}
+		if !aws.ToBool(resp.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+	if !slices.Equal(listed, keys[:2]) {
+		return fmt.Errorf("ListObjectsV2: listed %v, expected %v", listed, keys[:2])
+	}
+
+	_, err = d.S3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:               aws.String(d.Bucket),
+		Key:                  aws.String(keys[2]),
+		ContentType:          d.getContentType(),
+		ACL:                  d.getACL(),
+		ServerSideEncryption: d.getEncryptionMode(),
+		SSEKMSKeyId:          d.getSSEKMSKeyID(),
+		StorageClass:         d.getStorageClass(),
+		SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+		SSECustomerKey:       d.getSSECustomerKey(),
+		CopySource:           aws.String(d.Bucket + "/" + keys[0]),
+
+		CopySourceSSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+		CopySourceSSECustomerKey:       d.getSSECustomerKey(),
+	})
+	if err == nil {
+		err = head(keys[2])
+	}
+	if err != nil {
+		return fmt.Errorf("CopyObject: %w", err)
+	}
+
+	if err := d.probeMultipartCopy(ctx, keys[0], keys[3], int64(len(content))); err != nil {
+		return fmt.Errorf("UploadPartCopy: %w", err)
+	}
+	if err := head(keys[3]); err != nil {
+		return fmt.Errorf("UploadPartCopy: %w", err)
+	}
+
+	objects := make([]types.ObjectIdentifier, len(keys))
+	for i := range keys {
+		objects[i] = types.ObjectIdentifier{Key: aws.String(keys[i])}
+	}
+	resp, err := d.S3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(d.Bucket),
+		Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(false)},
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteObjects: %w", err)
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("DeleteObjects: %w", deleteError(resp.Errors[0]))
+	}
+	if err := head(keys[0]); err == nil {
+		return errors.New("DeleteObjects: deleted object still exists")
+	} else if statusCode(err) != 404 {
+		return fmt.Errorf("DeleteObjects: %w", err)
+	}
+	return nil
+}
+
+// probeMultipartCopy copies source to dest with a multipart copy of a single
+// part, as the driver moves large objects.
+func (d *driver) probeMultipartCopy(ctx context.Context, source, dest string, size int64) error {
+	createResp, err := d.S3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(d.Bucket),
+		Key:                  aws.String(dest),
+		ContentType:          d.getContentType(),
+		ACL:                  d.getACL(),
+		ServerSideEncryption: d.getEncryptionMode(),
+		SSEKMSKeyId:          d.getSSEKMSKeyID(),
+		StorageClass:         d.getStorageClass(),
+		SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+		SSECustomerKey:       d.getSSECustomerKey(),
+	})
+	if err != nil {
+		return err
+	}
+	uploadResp, err := d.S3.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+		Bucket:          aws.String(d.Bucket),
+		CopySource:      aws.String(d.Bucket + "/" + source),
+		Key:             aws.String(dest),
+		PartNumber:      aws.Int32(1),
+		UploadId:        createResp.UploadId,
+		CopySourceRange: aws.String(fmt.Sprintf("bytes=0-%d", size-1)),
+
+		SSECustomerAlgorithm:           d.getSSECustomerAlgorithm(),
+		SSECustomerKey:                 d.getSSECustomerKey(),
+		CopySourceSSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+		CopySourceSSECustomerKey:       d.getSSECustomerKey(),
+	})
+	if err == nil && (uploadResp.CopyPartResult == nil || uploadResp.CopyPartResult.ETag == nil) {
+		err = errors.New("no ETag in the copy result")
+	}
+	if err != nil {
+		_, _ = d.S3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(d.Bucket),
+			Key:      aws.String(dest),
+			UploadId: createResp.UploadId,
+		})
+		return err
+	}
+	_, err = d.S3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(d.Bucket),
+		Key:      aws.String(dest),
+		UploadId: createResp.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: []types.CompletedPart{{
+			ETag:       uploadResp.CopyPartResult.ETag,
+			PartNumber: aws.Int32(1),
+		}}},
+	})
+	return err
+}
@@ -0,0 +1,543 @@
+package s3
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testS3 is a fake S3 compatible service on a single bucket, serving the
+// operations of the conformance probe, and reads and writes of objects
+// encrypted with customer keys.
+type testS3 struct {
+	*httptest.Server
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]*testS3Object
+	uploads map[string]*testS3Upload
+	md5     map[string]bool
+
+	// ignoreContinuationToken breaks the pagination of lists, as some
+	// services do
+	ignoreContinuationToken bool
+
+	// requesterPays denies the requests not acknowledging that the requester
+	// pays for them
+	requesterPays bool
+
+	// directoryBucket authenticates requests with sessions, and lists
+	// objects in reverse order, as the zonal endpoints of directory buckets
+	// list them in no particular order
+	directoryBucket bool
+	sessions        int
+
+	// corrupt flips a bit of the content of uploads, as if it was corrupted
+	// in transit, and checksums counts the uploads verified with a checksum
+	corrupt   bool
+	checksums int
+
+	// deleteRequests counts the DeleteObjects requests
+	deleteRequests int
+
+	// failures is the number of requests to throttle before serving
+	// requests, which are served after delay
+	failures int
+	delay    time.Duration
+}
+
+// testChecksum returns the checksum of data with algorithm, as S3 encodes it.
+func testChecksum(algorithm string, data []byte) string {
+	h := checksums[algorithm]()
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+type testS3Object struct {
+	data []byte
+	// keyMD5 is the MD5 of the customer key the object is encrypted with
+	keyMD5  string
+	tagging string
+	// storageClass archives the object in GLACIER or DEEP_ARCHIVE, until it
+	// is restored
+	storageClass string
+	restore      string
+	restoreBody  string
+}
+
+type testS3Upload struct {
+	keyMD5            string
+	tagging           string
+	checksumAlgorithm string
+	parts             map[int][]byte
+}
+
+const (
+	sseCustomerKeyMD5Header           = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+	copySourceSSECustomerKeyMD5Header = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key-Md5"
+)
+
+func newTestS3(t *testing.T) *testS3 {
+	s := &testS3{
+		bucket:  "registry",
+		objects: make(map[string]*testS3Object),
+		uploads: make(map[string]*testS3Upload),
+		md5:     make(map[string]bool),
+	}
+	// customer keys are only sent over TLS
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(v)
+	}
+	fail := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+	type object struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	lastModified := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		fail(http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if s.failures > 0 {
+		s.failures--
+		fail(http.StatusServiceUnavailable, "SlowDown")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	q := r.URL.Query()
+	if s.corrupt && len(body) > 0 {
+		body[0] ^= 1
+	}
+	if algorithm := r.Header.Get("X-Amz-Sdk-Checksum-Algorithm"); algorithm != "" {
+		if r.Header.Get("X-Amz-Checksum-"+algorithm) != testChecksum(algorithm, body) {
+			fail(http.StatusBadRequest, "BadDigest")
+			return
+		}
+		w.Header().Set("X-Amz-Checksum-"+algorithm, testChecksum(algorithm, body))
+		s.checksums++
+	}
+	if s.requesterPays && r.Header.Get("X-Amz-Request-Payer") != "requester" && q.Get("x-amz-request-payer") != "requester" {
+		fail(http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	// copySource returns the source of a copy, if it is decrypted with the
+	// right key
+	copySource := func() (*testS3Object, bool) {
+		source, ok := s.objects[strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), s.bucket+"/")]
+		if !ok {
+			fail(http.StatusNotFound, "NoSuchKey")
+			return nil, false
+		}
+		if source.keyMD5 != r.Header.Get(copySourceSSECustomerKeyMD5Header) {
+			fail(http.StatusBadRequest, "InvalidRequest")
+			return nil, false
+		}
+		return source, true
+	}
+
+	if s.directoryBucket {
+		if r.Method == http.MethodGet && key == "" && q.Has("session") {
+			if !strings.Contains(r.Header.Get("Authorization"), "/s3express/aws4_request") {
+				fail(http.StatusForbidden, "AccessDenied")
+				return
+			}
+			s.sessions++
+			type credentials struct {
+				AccessKeyId     string
+				SecretAccessKey string
+				SessionToken    string
+				Expiration      string
+			}
+			reply(struct {
+				XMLName     xml.Name `xml:"CreateSessionResult"`
+				Credentials credentials
+			}{Credentials: credentials{
+				AccessKeyId:     "sessionaccesskey",
+				SecretAccessKey: "sessionsecretkey",
+				SessionToken:    "sessiontoken",
+				Expiration:      time.Now().Add(5 * time.Minute).UTC().Format(time.RFC3339),
+			}})
+			return
+		}
+		// the SDK authenticates copies with the credentials of the
+		// driver rather than with sessions
+		session := r.Header.Get("X-Amz-S3session-Token") == "sessiontoken" &&
+			strings.Contains(r.Header.Get("Authorization"), "Credential=sessionaccesskey/")
+		copied := r.Header.Get("X-Amz-Copy-Source") != "" &&
+			strings.Contains(r.Header.Get("Authorization"), "Credential=accesskey/")
+		if !session && !copied || r.Header.Get("X-Amz-Content-Sha256") == "" ||
+			!strings.Contains(r.Header.Get("Authorization"), "/s3express/aws4_request") {
+			fail(http.StatusForbidden, "AccessDenied")
+			return
+		}
+		if q.Has("start-after") || r.Header.Get("X-Amz-Acl") != "" {
+			fail(http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodHead && key == "":
+		// HeadBucket
+	case r.Method == http.MethodGet && key == "" && q.Get("list-type") == "2" && s.directoryBucket:
+		// the keys are listed a key at a time in reverse order, continuing
+		// from the previous key
+		var result struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			IsTruncated           bool
+			Contents              []object
+			NextContinuationToken string `xml:",omitempty"`
+		}
+		var keys []string
+		for k := range s.objects {
+			if strings.HasPrefix(k, q.Get("prefix")) && (!q.Has("continuation-token") || k < q.Get("continuation-token")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		if len(keys) > 0 {
+			result.Contents = []object{{Key: keys[0], Size: len(s.objects[keys[0]].data), LastModified: lastModified}}
+		}
+		if len(keys) > 1 {
+			result.IsTruncated = true
+			result.NextContinuationToken = keys[0]
+		}
+		reply(result)
+	case r.Method == http.MethodGet && key == "" && q.Get("list-type") == "2":
+		var keys []string
+		for k := range s.objects {
+			if strings.HasPrefix(k, q.Get("prefix")) && (s.ignoreContinuationToken || k > q.Get("continuation-token")) {
+				keys = append(keys, k)
+			}
+		}
+		// the probe lists a key at a time
+		var result struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			IsTruncated           bool
+			Contents              []object
+			NextContinuationToken string `xml:",omitempty"`
+		}
+		for _, k := range keys {
+			if len(result.Contents) == 0 || k < result.Contents[0].Key {
+				result.Contents = []object{{Key: k, Size: len(s.objects[k].data), LastModified: lastModified}}
+			}
+		}
+		if len(keys) > 1 {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[0].Key
+		}
+		reply(result)
+	case r.Method == http.MethodPost && key == "" && q.Has("delete"):
+		s.md5["DeleteObjects"] = r.Header.Get("Content-Md5") != ""
+		s.deleteRequests++
+		var req struct {
+			Object []struct{ Key string }
+		}
+		if err := xml.Unmarshal(body, &req); err != nil {
+			fail(http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var result struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+			Deleted []struct{ Key string }
+		}
+		for _, obj := range req.Object {
+			delete(s.objects, obj.Key)
+			result.Deleted = append(result.Deleted, struct{ Key string }{obj.Key})
+		}
+		reply(result)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		upload, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			fail(http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if upload.keyMD5 != r.Header.Get(sseCustomerKeyMD5Header) {
+			fail(http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		var partNumber int
+		fmt.Sscan(q.Get("partNumber"), &partNumber)
+		if r.Header.Get("X-Amz-Copy-Source") == "" {
+			upload.parts[partNumber] = body
+			w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, partNumber))
+			return
+		}
+		source, ok := copySource()
+		if !ok {
+			return
+		}
+		data := source.data
+		if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+			var first, last int
+			fmt.Sscanf(rng, "bytes=%d-%d", &first, &last)
+			data = data[first : last+1]
+		}
+		upload.parts[partNumber] = data
+		result := struct {
+			XMLName        xml.Name `xml:"CopyPartResult"`
+			ETag           string
+			LastModified   string
+			ChecksumCRC32  string `xml:",omitempty"`
+			ChecksumCRC32C string `xml:",omitempty"`
+			ChecksumSHA256 string `xml:",omitempty"`
+		}{ETag: fmt.Sprintf(`"part-%d"`, partNumber), LastModified: lastModified}
+		switch upload.checksumAlgorithm {
+		case "CRC32":
+			result.ChecksumCRC32 = testChecksum("CRC32", data)
+		case "CRC32C":
+			result.ChecksumCRC32C = testChecksum("CRC32C", data)
+		case "SHA256":
+			result.ChecksumSHA256 = testChecksum("SHA256", data)
+		}
+		reply(result)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, ok := copySource()
+		if !ok {
+			return
+		}
+		tagging := source.tagging
+		if r.Header.Get("X-Amz-Tagging-Directive") == "REPLACE" {
+			tagging = r.Header.Get("X-Amz-Tagging")
+		}
+		s.objects[key] = &testS3Object{data: source.data, keyMD5: r.Header.Get(sseCustomerKeyMD5Header), tagging: tagging}
+		reply(struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: `"copy"`, LastModified: lastModified})
+	case r.Method == http.MethodPut:
+		s.md5["PutObject"] = r.Header.Get("Content-Md5") != ""
+		s.objects[key] = &testS3Object{data: body, keyMD5: r.Header.Get(sseCustomerKeyMD5Header), tagging: r.Header.Get("X-Amz-Tagging")}
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodPost && q.Has("restore"):
+		obj, ok := s.objects[key]
+		if !ok {
+			fail(http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if obj.restore != "" {
+			fail(http.StatusConflict, "RestoreAlreadyInProgress")
+			return
+		}
+		obj.restore = `ongoing-request="true"`
+		obj.restoreBody = string(body)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodHead || (r.Method == http.MethodGet && key != ""):
+		obj, ok := s.objects[key]
+		if !ok {
+			fail(http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if obj.storageClass != "" {
+			w.Header().Set("X-Amz-Storage-Class", obj.storageClass)
+		}
+		if obj.restore != "" {
+			w.Header().Set("X-Amz-Restore", obj.restore)
+		}
+		if r.Method == http.MethodGet && obj.storageClass != "" && !strings.HasPrefix(obj.restore, `ongoing-request="false"`) {
+			fail(http.StatusForbidden, "InvalidObjectState")
+			return
+		}
+		if obj.keyMD5 != r.Header.Get(sseCustomerKeyMD5Header) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusForbidden)
+			} else {
+				fail(http.StatusBadRequest, "InvalidRequest")
+			}
+			return
+		}
+		data := obj.data
+		if rng := r.Header.Get("Range"); rng != "" {
+			var offset int
+			fmt.Sscanf(rng, "bytes=%d-", &offset)
+			if offset >= len(data) {
+				fail(http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			data = data[offset:]
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		uploadID := fmt.Sprintf("upload-%d", len(s.uploads))
+		s.uploads[uploadID] = &testS3Upload{keyMD5: r.Header.Get(sseCustomerKeyMD5Header), tagging: r.Header.Get("X-Amz-Tagging"), checksumAlgorithm: r.Header.Get("X-Amz-Checksum-Algorithm"), parts: make(map[int][]byte)}
+		reply(struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		upload, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			fail(http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var req struct {
+			Part []struct {
+				PartNumber     int
+				ChecksumCRC32  string
+				ChecksumCRC32C string
+				ChecksumSHA256 string
+			}
+		}
+		if err := xml.Unmarshal(body, &req); err != nil {
+			fail(http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		// the parts of uploads created with a checksum algorithm are
+		// completed with their checksums
+		for _, part := range req.Part {
+			checksum := map[string]string{"CRC32": part.ChecksumCRC32, "CRC32C": part.ChecksumCRC32C, "SHA256": part.ChecksumSHA256}[upload.checksumAlgorithm]
+			if upload.checksumAlgorithm != "" && checksum != testChecksum(upload.checksumAlgorithm, upload.parts[part.PartNumber]) {
+				fail(http.StatusBadRequest, "InvalidPart")
+				return
+			}
+		}
+		sort.Slice(req.Part, func(i, j int) bool { return req.Part[i].PartNumber < req.Part[j].PartNumber })
+		var data []byte
+		for _, part := range req.Part {
+			data = append(data, upload.parts[part.PartNumber]...)
+		}
+		delete(s.uploads, q.Get("uploadId"))
+		s.objects[key] = &testS3Object{data: data, keyMD5: upload.keyMD5, tagging: upload.tagging}
+		reply(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"multipart"`})
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fail(http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func TestProfileParameters(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"profile": "r2"}, "the profile parameter must be one of [aws ceph minio spaces wasabi], r2 invalid"},
+		{map[string]interface{}{"profile": "minio", "regionendpoint": ""}, "the minio profile requires the regionendpoint parameter"},
+		{map[string]interface{}{"profile": "minio", "storageclass": "GLACIER_IR"}, "the storageclass parameter must be one of [NONE STANDARD REDUCED_REDUNDANCY] for the minio profile"},
+		{map[string]interface{}{"profile": "spaces", "storageclass": "STANDARD"}, "the storageclass parameter must be one of [NONE] for the spaces profile"},
+		{map[string]interface{}{"profile": "minio", "objectacl": "public-read"}, "the objectacl parameter must be one of [private] for the minio profile"},
+		{map[string]interface{}{"profile": "spaces", "encrypt": true}, "the spaces profile does not support server-side encryption"},
+		{map[string]interface{}{"profile": "wasabi", "encrypt": true, "keyid": "key"}, "the wasabi profile does not support server-side encryption with KMS keys"},
+		{map[string]interface{}{"profile": "ceph", "accelerate": true}, "the ceph profile does not support accelerate or dual-stack endpoints"},
+		{map[string]interface{}{"profile": "ceph", "conformanceprobe": "sometimes"}, "the conformanceProbe parameter should be a boolean"},
+	} {
+		params := map[string]interface{}{
+			"bucket":           "registry",
+			"regionendpoint":   "http://storage.example.com",
+			"conformanceprobe": false,
+		}
+		for k, v := range tc.params {
+			params[k] = v
+		}
+		if _, err := FromParameters(ctx, params); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+
+	d, err := FromParameters(ctx, map[string]interface{}{
+		"profile":          "Spaces",
+		"bucket":           "registry",
+		"regionendpoint":   "https://nyc3.digitaloceanspaces.com",
+		"conformanceprobe": false,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s3drv := d.baseEmbed.Base.StorageDriver.(*driver)
+	if s3drv.StorageClass != noStorageClass || s3drv.MultipartCopyMaxConcurrency != 10 || s3drv.S3.Options().Region != "us-east-1" {
+		t.Errorf("unexpected defaults of the spaces profile: storage class %s, multipart copy concurrency %d, region %s",
+			s3drv.StorageClass, s3drv.MultipartCopyMaxConcurrency, s3drv.S3.Options().Region)
+	}
+}
+
+func TestConformanceProbe(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		profile                 string
+		ignoreContinuationToken bool
+		contentMD5              bool
+		err                     string
+	}{
+		{profile: "minio", contentMD5: true},
+		{profile: "spaces"},
+		{profile: "ceph", ignoreContinuationToken: true, contentMD5: true, err: "ListObjectsV2: continuation tokens are ignored"},
+	} {
+		t.Run(tc.profile, func(t *testing.T) {
+			s := newTestS3(t)
+			s.ignoreContinuationToken = tc.ignoreContinuationToken
+
+			_, err := FromParameters(ctx, map[string]interface{}{
+				"profile":        tc.profile,
+				"accesskey":      "accesskey",
+				"secretkey":      "secretkey",
+				"bucket":         "registry",
+				"regionendpoint": s.URL,
+				"forcepathstyle": true,
+				"skipverify":     true,
+				"rootdirectory":  "/registry",
+			})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(s.objects) != 0 || len(s.uploads) != 0 {
+				t.Errorf("expected the probe to clean up, %d objects and %d uploads left", len(s.objects), len(s.uploads))
+			}
+			if s.md5["PutObject"] != tc.contentMD5 {
+				t.Errorf("unexpected Content-MD5 of uploads, expected %v", tc.contentMD5)
+			}
+			if !s.md5["DeleteObjects"] {
+				t.Error("expected DeleteObjects requests to have a Content-MD5")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package s3
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// defaultRestoreDays is the default number of days restored objects are
+// kept for.
+const defaultRestoreDays = 1
+
+// restoreTiers are the retrieval tiers archived objects can be restored with.
+var restoreTiers = []string{string(types.TierStandard), string(types.TierBulk), string(types.TierExpedited)}
+
+// restoreTime estimates the time the restore of an object archived in
+// storageClass, or in the archive tier archiveStatus of Intelligent-Tiering,
+// takes with tier, from the upper bounds AWS documents.
+func restoreTime(storageClass types.StorageClass, archiveStatus types.ArchiveStatus, tier types.Tier) time.Duration {
+	deep := storageClass == types.StorageClassDeepArchive || archiveStatus == types.ArchiveStatusDeepArchiveAccess
+	switch {
+	case tier == types.TierExpedited:
+		return 5 * time.Minute
+	case tier == types.TierBulk && deep:
+		return 48 * time.Hour
+	case tier == types.TierBulk || deep:
+		return 12 * time.Hour
+	default:
+		return 5 * time.Hour
+	}
+}
+
+// archivedError returns the error of reading the archived object at path,
+// after requesting its restore if archived objects are restored.
+func (d *driver) archivedError(ctx context.Context, path string, err error) error {
+	archived := storagedriver.ArchivedContentError{Path: path, DriverName: driverName, Detail: err}
+
+	var head *s3.HeadObjectOutput
+	headErr := d.withSSECustomerKeys(func(key *string) (err error) {
+		head, err = d.S3.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(d.s3Path(path)),
+			SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+			SSECustomerKey:       key,
+		})
+		return err
+	})
+	if headErr != nil {
+		dcontext.GetLogger(ctx).Warnf("s3aws: failed to get the restore status of archived object %s: %v", path, headErr)
+		return archived
+	}
+
+	storageClass := head.StorageClass
+	tier := types.Tier(d.RestoreTier)
+	// Deep Archive and the archive tiers of Intelligent-Tiering have no
+	// expedited retrievals
+	if tier == types.TierExpedited && (storageClass == types.StorageClassDeepArchive || storageClass == types.StorageClassIntelligentTiering) {
+		tier = types.TierStandard
+	}
+
+	if strings.Contains(aws.ToString(head.Restore), `ongoing-request="true"`) {
+		archived.Restoring = true
+		archived.RetryAfter = restoreTime(storageClass, head.ArchiveStatus, tier)
+		return archived
+	}
+	if !d.RestoreArchived {
+		return archived
+	}
+
+	input := &s3.RestoreObjectInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(d.s3Path(path)),
+		RestoreRequest: &types.RestoreRequest{
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: tier},
+		},
+	}
+	// objects are restored out of Intelligent-Tiering archive tiers until
+	// they are archived again, instead of being copied for some days
+	if storageClass != types.StorageClassIntelligentTiering {
+		input.RestoreRequest.Days = aws.Int32(int32(d.RestoreDays))
+	}
+	if _, err := d.S3.RestoreObject(ctx, input); err != nil {
+		if errorCode(err) != "RestoreAlreadyInProgress" {
+			dcontext.GetLogger(ctx).Warnf("s3aws: failed to restore archived object %s: %v", path, err)
+			return archived
+		}
+	} else {
+		dcontext.GetLogger(ctx).Infof("s3aws: restoring archived object %s from %s with the %s tier", path, storageClass, tier)
+	}
+	archived.Restoring = true
+	archived.RetryAfter = restoreTime(storageClass, head.ArchiveStatus, tier)
+	return archived
+}
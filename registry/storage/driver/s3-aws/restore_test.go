@@ -0,0 +1,120 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+func TestRestoreTime(t *testing.T) {
+	for _, tc := range []struct {
+		storageClass  types.StorageClass
+		archiveStatus types.ArchiveStatus
+		tier          types.Tier
+		expected      time.Duration
+	}{
+		{"GLACIER", "", "Expedited", 5 * time.Minute},
+		{"GLACIER", "", "Standard", 5 * time.Hour},
+		{"GLACIER", "", "Bulk", 12 * time.Hour},
+		{"DEEP_ARCHIVE", "", "Standard", 12 * time.Hour},
+		{"DEEP_ARCHIVE", "", "Bulk", 48 * time.Hour},
+		{"INTELLIGENT_TIERING", "ARCHIVE_ACCESS", "Standard", 5 * time.Hour},
+		{"INTELLIGENT_TIERING", "DEEP_ARCHIVE_ACCESS", "Bulk", 48 * time.Hour},
+	} {
+		if d := restoreTime(tc.storageClass, tc.archiveStatus, tc.tier); d != tc.expected {
+			t.Errorf("%s %s %s: unexpected restore time %s, expected %s", tc.storageClass, tc.archiveStatus, tc.tier, d, tc.expected)
+		}
+	}
+}
+
+func TestArchivedContent(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+
+	newDriver := func(params map[string]interface{}) *Driver {
+		parameters := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": s.URL,
+			"forcepathstyle": true,
+			"skipverify":     true,
+			"bucket":         "registry",
+			"accesskey":      "accesskey",
+			"secretkey":      "secretkey",
+		}
+		for k, v := range params {
+			parameters[k] = v
+		}
+		d, err := FromParameters(ctx, parameters)
+		if err != nil {
+			t.Fatalf("unexpected error creating driver: %v", err)
+		}
+		return d
+	}
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"restorearchived": "maybe"}, "the restoreArchived parameter should be a boolean"},
+		{map[string]interface{}{"restoredays": 0}, "the restoredays 0 parameter should be a number between 1 and 2147483647 (inclusive)"},
+		{map[string]interface{}{"restoretier": "fast"}, "the restoretier parameter must be one of [Standard Bulk Expedited], fast invalid"},
+	} {
+		params := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": s.URL,
+			"bucket":         "registry",
+		}
+		for k, v := range tc.params {
+			params[k] = v
+		}
+		if _, err := FromParameters(ctx, params); err == nil || err.Error() != tc.err {
+			t.Errorf("%v: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+
+	s.objects["glacier"] = &testS3Object{data: []byte("contents"), storageClass: "GLACIER"}
+	s.objects["deep"] = &testS3Object{data: []byte("contents"), storageClass: "DEEP_ARCHIVE"}
+
+	// archived objects are not restored by default
+	_, err := newDriver(nil).GetContent(ctx, "/glacier")
+	var archived storagedriver.ArchivedContentError
+	if !errors.As(err, &archived) || archived.Restoring || archived.Path != "/glacier" {
+		t.Fatalf("unexpected error %#v, expected the content to be archived", err)
+	}
+	if s.objects["glacier"].restore != "" {
+		t.Error("expected the object not to be restored")
+	}
+
+	d := newDriver(map[string]interface{}{"restorearchived": true, "restoredays": "3", "restoretier": "expedited"})
+	_, err = d.Reader(ctx, "/glacier", 0)
+	if !errors.As(err, &archived) || !archived.Restoring || archived.RetryAfter != 5*time.Minute {
+		t.Fatalf("unexpected error %#v, expected the content to be restored", err)
+	}
+	if body := s.objects["glacier"].restoreBody; !strings.Contains(body, "<Days>3</Days>") || !strings.Contains(body, "<Tier>Expedited</Tier>") {
+		t.Errorf("unexpected restore request %s", body)
+	}
+
+	// the restore of deep archives is not expedited
+	_, err = d.Reader(ctx, "/deep", 0)
+	if !errors.As(err, &archived) || !archived.Restoring || archived.RetryAfter != 12*time.Hour {
+		t.Fatalf("unexpected error %#v, expected the content to be restored", err)
+	}
+	if body := s.objects["deep"].restoreBody; !strings.Contains(body, "<Tier>Standard</Tier>") {
+		t.Errorf("unexpected restore request %s", body)
+	}
+
+	// the content is being restored until the restore completes
+	_, err = newDriver(nil).GetContent(ctx, "/glacier")
+	if !errors.As(err, &archived) || !archived.Restoring {
+		t.Fatalf("unexpected error %#v, expected the content to be being restored", err)
+	}
+	s.objects["glacier"].restore = `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`
+	if contents, err := d.GetContent(ctx, "/glacier"); err != nil || string(contents) != "contents" {
+		t.Errorf("unexpected content %q of the restored object: %v", contents, err)
+	}
+}
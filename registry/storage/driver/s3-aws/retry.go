@@ -0,0 +1,170 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultMaxRetries is the default number of times failed requests are
+	// retried.
+	defaultMaxRetries = 3
+
+	// defaultRetryMinDelay and defaultRetryMaxDelay are the default bounds
+	// of the delays before retries.
+	defaultRetryMinDelay = 30 * time.Millisecond
+	defaultRetryMaxDelay = 300 * time.Second
+
+	// minThrottleDelay is the minimum delay before throttled requests are
+	// retried, within the bounds of the delays before retries.
+	minThrottleDelay = 500 * time.Millisecond
+)
+
+// errReadTimeout is the error of the reads of response bodies that time out.
+var errReadTimeout = errors.New("read of the response body timed out")
+
+// backoff delays retries exponentially, with jitter, from minDelay to
+// maxDelay.
+type backoff struct {
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+// BackoffDelay returns the delay before attempt is retried after err.
+func (b backoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	delay := b.minDelay
+	if isThrottle(err) {
+		delay = max(delay, minThrottleDelay)
+	}
+	for i := 1; i < attempt && delay < b.maxDelay; i++ {
+		delay *= 2
+	}
+	delay += rand.N(delay + 1)
+	return min(delay, b.maxDelay), nil
+}
+
+// isThrottle returns whether err is the error of a throttled request.
+func isThrottle(err error) bool {
+	return retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary
+}
+
+// withTimeouts returns the middleware bounding the duration of requests.
+// Object downloads are streamed to clients for as long as they read them, so
+// only the reads of their responses are bounded, by readTimeout, while other
+// operations, retries included, are bounded by operationTimeout.
+func withTimeouts(operationTimeout, readTimeout time.Duration) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		if operationTimeout > 0 {
+			err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("distribution.OperationTimeout", func(
+				ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+			) (middleware.InitializeOutput, middleware.Metadata, error) {
+				if middleware.GetOperationName(ctx) == "GetObject" {
+					return next.HandleInitialize(ctx, in)
+				}
+				ctx, cancel := context.WithTimeout(ctx, operationTimeout)
+				defer cancel()
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+			if err != nil {
+				return err
+			}
+		}
+		if readTimeout > 0 {
+			// the bodies of responses are wrapped before they are read
+			// by the deserializers
+			return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("distribution.ReadTimeout", func(
+				ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler,
+			) (middleware.DeserializeOutput, middleware.Metadata, error) {
+				out, metadata, err := next.HandleDeserialize(ctx, in)
+				if resp, ok := out.RawResponse.(*smithyhttp.Response); ok && resp.Body != nil {
+					resp.Body = &timeoutReader{ReadCloser: resp.Body, timeout: readTimeout}
+				}
+				return out, metadata, err
+			}), middleware.After)
+		}
+		return nil
+	}
+}
+
+// timeoutReader fails the reads of a response body that take longer than
+// timeout, closing the body.
+type timeoutReader struct {
+	io.ReadCloser
+	timeout time.Duration
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(r.timeout, func() { r.ReadCloser.Close() })
+	n, err := r.ReadCloser.Read(p)
+	if !timer.Stop() {
+		return n, errReadTimeout
+	}
+	return n, err
+}
+
+// rateLimiter limits the rate of the requests of the driver. When adaptive,
+// the rate is halved each time S3 throttles a request, and recovers with the
+// requests that are not throttled.
+type rateLimiter struct {
+	mu       sync.Mutex
+	limiter  *rate.Limiter
+	max      rate.Limit
+	adaptive bool
+}
+
+// newRateLimiter returns a limiter of requestsPerSecond requests per second.
+func newRateLimiter(requestsPerSecond int, adaptive bool) *rateLimiter {
+	return &rateLimiter{
+		limiter:  rate.NewLimiter(rate.Limit(requestsPerSecond), requestsPerSecond),
+		max:      rate.Limit(requestsPerSecond),
+		adaptive: adaptive,
+	}
+}
+
+// middleware returns the middleware waiting for the rate of requests to
+// allow each attempt, which runs before attempts are signed.
+func (l *rateLimiter) middleware(stack *middleware.Stack) error {
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("distribution.RateLimit", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		if err := l.limiter.Wait(ctx); err != nil {
+			return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+		}
+		out, metadata, err := next.HandleFinalize(ctx, in)
+		l.update(err)
+		return out, metadata, err
+	}), "Signing", middleware.Before)
+}
+
+// update adapts the rate of requests to the outcome of an attempt, which
+// failed with err.
+func (l *rateLimiter) update(err error) {
+	if !l.adaptive {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.limiter.Limit()
+	switch {
+	case isThrottle(err):
+		// at least a request per second is still allowed
+		limit = max(limit/2, 1)
+	case err == nil:
+		limit = min(limit+l.max/100, l.max)
+	default:
+		return
+	}
+	l.limiter.SetLimit(limit)
+}
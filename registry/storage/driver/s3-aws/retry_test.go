@@ -0,0 +1,127 @@
+package s3
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"golang.org/x/time/rate"
+)
+
+func TestRetryParameters(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"maxretries": "many"}, "maxretries parameter must be an integer, many invalid"},
+		{map[string]interface{}{"retrymindelay": "soon"}, "the retrymindelay parameter must be a duration, soon invalid"},
+		{map[string]interface{}{"retrymaxdelay": 10}, "the retrymaxdelay parameter must be a duration, 10 invalid"},
+		{map[string]interface{}{"retrymindelay": "1s", "retrymaxdelay": "100ms"}, "the retrymaxdelay parameter must not be less than the retrymindelay parameter"},
+		{map[string]interface{}{"operationtimeout": "-1s"}, "the operationtimeout parameter must not be negative, -1s invalid"},
+		{map[string]interface{}{"ratelimit": -1}, "the ratelimit -1 parameter should be a number between 0 and 2147483647 (inclusive)"},
+		{map[string]interface{}{"adaptiveratelimit": true}, "the adaptiveratelimit parameter requires the ratelimit parameter"},
+	} {
+		params := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": "http://storage.example.com",
+			"bucket":         "registry",
+		}
+		for k, v := range tc.params {
+			params[k] = v
+		}
+		if _, err := FromParameters(ctx, params); err == nil || err.Error() != tc.err {
+			t.Errorf("%v: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+
+	newDriver := func(params map[string]interface{}) *Driver {
+		parameters := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": s.URL,
+			"forcepathstyle": true,
+			"skipverify":     true,
+			"bucket":         "registry",
+			"accesskey":      "accesskey",
+			"secretkey":      "secretkey",
+			"retrymindelay":  "1ms",
+			"retrymaxdelay":  "1ms",
+		}
+		for k, v := range params {
+			parameters[k] = v
+		}
+		d, err := FromParameters(ctx, parameters)
+		if err != nil {
+			t.Fatalf("unexpected error creating driver: %v", err)
+		}
+		return d
+	}
+
+	s.failures = 2
+	if err := newDriver(map[string]interface{}{"maxretries": 1}).PutContent(ctx, "/content", []byte("contents")); err == nil || !strings.Contains(err.Error(), "SlowDown") {
+		t.Errorf("unexpected error %v, expected the requests to be throttled", err)
+	}
+	s.failures = 2
+	if err := newDriver(map[string]interface{}{"maxretries": "2"}).PutContent(ctx, "/content", []byte("contents")); err != nil {
+		t.Errorf("unexpected error %v, expected the throttled requests to be retried", err)
+	}
+
+	s.delay = 100 * time.Millisecond
+	start := time.Now()
+	err := newDriver(map[string]interface{}{"maxretries": 0, "operationtimeout": "10ms"}).PutContent(ctx, "/content", []byte("contents"))
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("unexpected error %v, expected the operation to time out", err)
+	}
+	if elapsed := time.Since(start); elapsed >= s.delay {
+		t.Errorf("expected the operation to time out before the response, it took %s", elapsed)
+	}
+}
+
+func TestAdaptiveRateLimit(t *testing.T) {
+	l := newRateLimiter(100, true)
+	throttled := &smithy.GenericAPIError{Code: "SlowDown", Message: "Please reduce your request rate."}
+	failed := &smithy.GenericAPIError{Code: "InternalError", Message: "We encountered an internal error."}
+	var succeeded error
+
+	l.update(throttled)
+	l.update(throttled)
+	if limit := l.limiter.Limit(); limit != 25 {
+		t.Errorf("unexpected limit %v after throttling, expected 25", limit)
+	}
+	l.update(failed)
+	if limit := l.limiter.Limit(); limit != 25 {
+		t.Errorf("unexpected limit %v after an error, expected 25", limit)
+	}
+	for i := 0; i < 10; i++ {
+		l.update(succeeded)
+	}
+	if limit := l.limiter.Limit(); limit != 35 {
+		t.Errorf("unexpected limit %v after successes, expected 35", limit)
+	}
+	for i := 0; i < 100; i++ {
+		l.update(succeeded)
+	}
+	if limit := l.limiter.Limit(); limit != 100 {
+		t.Errorf("unexpected limit %v, expected the limit to recover to 100", limit)
+	}
+	for i := 0; i < 10; i++ {
+		l.update(throttled)
+	}
+	if limit := l.limiter.Limit(); limit != rate.Limit(1) {
+		t.Errorf("unexpected limit %v, expected at least a request per second", limit)
+	}
+
+	fixed := newRateLimiter(100, false)
+	fixed.update(throttled)
+	if limit := fixed.limiter.Limit(); limit != 100 {
+		t.Errorf("unexpected limit %v, expected the limit not to adapt", limit)
+	}
+}
@@ -14,12 +14,15 @@ package s3
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"slices"
 	"sort"
@@ -28,13 +31,21 @@ import (
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -66,6 +77,9 @@ const (
 	defaultMultipartCopyThresholdSize = 32 * 1024 * 1024
 )
 
+// defaultRoleSessionName is the session name of the roles assumed by the driver
+const defaultRoleSessionName = "distribution-registry"
+
 // listMax is the largest amount of objects you can request from S3 in a list call
 const listMax = 1000
 
@@ -75,18 +89,15 @@ const noStorageClass = "NONE"
 // s3StorageClasses lists all compatible (instant retrieval) S3 storage classes
 var s3StorageClasses = []string{
 	noStorageClass,
-	s3.StorageClassStandard,
-	s3.StorageClassReducedRedundancy,
-	s3.StorageClassStandardIa,
-	s3.StorageClassOnezoneIa,
-	s3.StorageClassIntelligentTiering,
-	s3.StorageClassOutposts,
-	s3.StorageClassGlacierIr,
+	string(types.StorageClassStandard),
+	string(types.StorageClassReducedRedundancy),
+	string(types.StorageClassStandardIa),
+	string(types.StorageClassOnezoneIa),
+	string(types.StorageClassIntelligentTiering),
+	string(types.StorageClassOutposts),
+	string(types.StorageClassGlacierIr),
 }
 
-// validRegions maps known s3 region identifiers to region descriptors
-var validRegions = map[string]struct{}{}
-
 // validObjectACLs contains known s3 object Acls
 var validObjectACLs = map[string]struct{}{}
 
@@ -114,27 +125,47 @@ type DriverParameters struct {
 	SessionToken                string
 	UseDualStack                bool
 	Accelerate                  bool
-	LogLevel                    aws.LogLevelType
+	RequesterPays               bool
+	ObjectTagging               bool
+	ChecksumAlgorithm           string
+	MaxRetries                  int
+	RetryMinDelay               time.Duration
+	RetryMaxDelay               time.Duration
+	OperationTimeout            time.Duration
+	ReadTimeout                 time.Duration
+	RateLimit                   int
+	AdaptiveRateLimit           bool
+	FailoverEndpoints           []string
+	FailoverWrites              bool
+	FailoverThreshold           int
+	FailbackInterval            time.Duration
+	RestoreArchived             bool
+	RestoreDays                 int
+	RestoreTier                 string
+	LogLevel                    aws.ClientLogMode
+	Profile                     string
+	ConformanceProbe            bool
+	SSECustomerKey              string
+	SSECustomerPreviousKeys     []string
+	RoleARN                     string
+	RoleSessionName             string
+	ExternalID                  string
+	WebIdentityTokenFile        string
+	STSEndpoint                 string
 }
 
-func init() {
-	partitions := endpoints.DefaultPartitions()
-	for _, p := range partitions {
-		for region := range p.Regions() {
-			validRegions[region] = struct{}{}
-		}
-	}
+// validRegion reports whether region resolves to an S3 endpoint of a known
+// partition.
+func validRegion(region string) bool {
+	_, err := s3.NewDefaultEndpointResolverV2().ResolveEndpoint(context.Background(), s3.EndpointParameters{
+		Region: aws.String(region),
+	})
+	return err == nil
+}
 
-	for _, objectACL := range []string{
-		s3.ObjectCannedACLPrivate,
-		s3.ObjectCannedACLPublicRead,
-		s3.ObjectCannedACLPublicReadWrite,
-		s3.ObjectCannedACLAuthenticatedRead,
-		s3.ObjectCannedACLAwsExecRead,
-		s3.ObjectCannedACLBucketOwnerRead,
-		s3.ObjectCannedACLBucketOwnerFullControl,
-	} {
-		validObjectACLs[objectACL] = struct{}{}
+func init() {
+	for _, objectACL := range types.ObjectCannedACLPrivate.Values() {
+		validObjectACLs[string(objectACL)] = struct{}{}
 	}
 
 	// Register this as the default s3 driver in addition to s3aws
@@ -150,9 +181,12 @@ func (factory *s3DriverFactory) Create(ctx context.Context, parameters map[strin
 }
 
 var _ storagedriver.StorageDriver = &driver{}
+var _ storagedriver.BulkDeleter = &driver{}
+var _ storagedriver.Transferer = &driver{}
 
 type driver struct {
-	S3                          *s3.S3
+	S3                          *s3.Client
+	Endpoint                    string
 	Bucket                      string
 	ChunkSize                   int
 	Encrypt                     bool
@@ -163,6 +197,15 @@ type driver struct {
 	RootDirectory               string
 	StorageClass                string
 	ObjectACL                   string
+	SSECustomerKey              string
+	SSECustomerPreviousKeys     []string
+	ObjectTagging               bool
+	ChecksumAlgorithm           string
+	DirectoryBucket             bool
+	RestoreArchived             bool
+	RestoreDays                 int
+	RestoreTier                 string
+	presignClient               *s3.PresignClient
 	pool                        *sync.Pool
 }
 
@@ -201,7 +244,24 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		regionEndpoint = ""
 	}
 
-	forcePathStyleBool := false
+	// The profile adjusts the defaults of other parameters, and the
+	// features they may use, to the S3 compatible service
+	profileName := ""
+	profile := profiles[awsProfile]
+	profileParam := parameters["profile"]
+	if profileParam != nil {
+		profileName = strings.ToLower(fmt.Sprint(profileParam))
+		p, ok := profiles[profileName]
+		if !ok {
+			return nil, fmt.Errorf("the profile parameter must be one of %v, %v invalid", profileNames(), profileParam)
+		}
+		profile = p
+		if profileName != awsProfile && regionEndpoint == "" {
+			return nil, fmt.Errorf("the %s profile requires the regionendpoint parameter", profileName)
+		}
+	}
+
+	forcePathStyleBool := profile.forcePathStyle
 	forcePathStyle := parameters["forcepathstyle"]
 	switch forcePathStyle := forcePathStyle.(type) {
 	case string:
@@ -220,13 +280,18 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 
 	regionName := parameters["region"]
 	region := fmt.Sprint(regionName)
+	if regionName == nil && profileName != "" && profileName != awsProfile {
+		// services other than Amazon S3 mostly ignore the region, but
+		// requests must still be signed for one
+		region = "us-east-1"
+	}
 
 	// Don't check the region value if a custom endpoint is provided.
 	if regionEndpoint == "" {
 		if regionName == nil || region == "" {
 			return nil, fmt.Errorf("no region parameter provided")
 		}
-		if _, ok := validRegions[region]; !ok {
+		if !validRegion(region) {
 			return nil, fmt.Errorf("invalid region provided: %v", region)
 		}
 	}
@@ -309,6 +374,74 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		keyID = ""
 	}
 
+	roleARN := parameters["rolearn"]
+	if roleARN == nil {
+		roleARN = ""
+	}
+
+	roleSessionName := parameters["rolesessionname"]
+	if roleSessionName == nil {
+		roleSessionName = defaultRoleSessionName
+	}
+
+	externalID := parameters["externalid"]
+	if externalID == nil {
+		externalID = ""
+	}
+
+	webIdentityTokenFile := parameters["webidentitytokenfile"]
+	if webIdentityTokenFile == nil {
+		webIdentityTokenFile = ""
+	}
+
+	stsEndpoint := parameters["stsendpoint"]
+	if stsEndpoint == nil {
+		stsEndpoint = ""
+	}
+
+	if fmt.Sprint(roleARN) == "" {
+		for _, name := range []string{"externalid", "webidentitytokenfile", "stsendpoint"} {
+			if parameters[name] != nil {
+				return nil, fmt.Errorf("the %s parameter requires the rolearn parameter", name)
+			}
+		}
+	}
+	if fmt.Sprint(externalID) != "" && fmt.Sprint(webIdentityTokenFile) != "" {
+		return nil, fmt.Errorf("the externalid parameter cannot be used with the webidentitytokenfile parameter")
+	}
+
+	sseCustomerKey, err := parseSSECustomerKey("ssecustomerkey", parameters["ssecustomerkey"])
+	if err != nil {
+		return nil, err
+	}
+	if sseCustomerKey != "" && encryptBool {
+		return nil, fmt.Errorf("the ssecustomerkey parameter cannot be used with the encrypt parameter")
+	}
+
+	var sseCustomerPreviousKeys []string
+	switch previousKeys := parameters["ssecustomerpreviouskeys"].(type) {
+	case string:
+		for _, key := range strings.Split(previousKeys, ",") {
+			sseCustomerPreviousKeys = append(sseCustomerPreviousKeys, strings.TrimSpace(key))
+		}
+	case []interface{}:
+		for _, key := range previousKeys {
+			sseCustomerPreviousKeys = append(sseCustomerPreviousKeys, fmt.Sprint(key))
+		}
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the ssecustomerpreviouskeys parameter should be a list of keys")
+	}
+	for i, key := range sseCustomerPreviousKeys {
+		if sseCustomerPreviousKeys[i], err = parseSSECustomerKey("ssecustomerpreviouskeys", key); err != nil {
+			return nil, err
+		}
+	}
+	if len(sseCustomerPreviousKeys) > 0 && sseCustomerKey == "" {
+		return nil, fmt.Errorf("the ssecustomerpreviouskeys parameter requires the ssecustomerkey parameter")
+	}
+
 	chunkSize, err := getParameterAsInteger(parameters, "chunksize", defaultChunkSize, minChunkSize, maxChunkSize)
 	if err != nil {
 		return nil, err
@@ -319,7 +452,7 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		return nil, err
 	}
 
-	multipartCopyMaxConcurrency, err := getParameterAsInteger[int64](parameters, "multipartcopymaxconcurrency", defaultMultipartCopyMaxConcurrency, 1, math.MaxInt64)
+	multipartCopyMaxConcurrency, err := getParameterAsInteger[int64](parameters, "multipartcopymaxconcurrency", profile.multipartCopyMaxConcurrency, 1, math.MaxInt64)
 	if err != nil {
 		return nil, err
 	}
@@ -334,7 +467,11 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		rootDirectory = ""
 	}
 
-	storageClass := s3.StorageClassStandard
+	storageClass := profile.defaultStorageClass()
+	directoryBucket := isDirectoryBucket(fmt.Sprint(bucket))
+	if directoryBucket {
+		storageClass = string(types.StorageClassExpressOnezone)
+	}
 	storageClassParam := parameters["storageclass"]
 	if storageClassParam != nil {
 		storageClassString, ok := storageClassParam.(string)
@@ -347,14 +484,8 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		}
 		// All valid storage class parameters are UPPERCASE, so be a bit more flexible here
 		storageClassString = strings.ToUpper(storageClassString)
-		if storageClassString != noStorageClass &&
-			storageClassString != s3.StorageClassStandard &&
-			storageClassString != s3.StorageClassReducedRedundancy &&
-			storageClassString != s3.StorageClassStandardIa &&
-			storageClassString != s3.StorageClassOnezoneIa &&
-			storageClassString != s3.StorageClassIntelligentTiering &&
-			storageClassString != s3.StorageClassOutposts &&
-			storageClassString != s3.StorageClassGlacierIr {
+		if !slices.Contains(s3StorageClasses, storageClassString) &&
+			(!directoryBucket || storageClassString != string(types.StorageClassExpressOnezone)) {
 			return nil, fmt.Errorf(
 				"the storageclass parameter must be one of %v, %v invalid",
 				s3StorageClasses,
@@ -369,7 +500,7 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		userAgent = ""
 	}
 
-	objectACL := s3.ObjectCannedACLPrivate
+	objectACL := string(types.ObjectCannedACLPrivate)
 	objectACLParam := parameters["objectacl"]
 	if objectACLParam != nil {
 		objectACLString, ok := objectACLParam.(string)
@@ -419,6 +550,203 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		return nil, fmt.Errorf("the accelerate parameter should be a boolean")
 	}
 
+	requesterPaysBool := false
+	requesterPays := parameters["requesterpays"]
+	switch requesterPays := requesterPays.(type) {
+	case string:
+		b, err := strconv.ParseBool(requesterPays)
+		if err != nil {
+			return nil, fmt.Errorf("the requesterPays parameter should be a boolean")
+		}
+		requesterPaysBool = b
+	case bool:
+		requesterPaysBool = requesterPays
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the requesterPays parameter should be a boolean")
+	}
+
+	objectTaggingBool := false
+	objectTagging := parameters["objecttagging"]
+	switch objectTagging := objectTagging.(type) {
+	case string:
+		b, err := strconv.ParseBool(objectTagging)
+		if err != nil {
+			return nil, fmt.Errorf("the objectTagging parameter should be a boolean")
+		}
+		objectTaggingBool = b
+	case bool:
+		objectTaggingBool = objectTagging
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the objectTagging parameter should be a boolean")
+	}
+
+	checksumAlgorithm := ""
+	if checksumAlgorithmParam := parameters["checksumalgorithm"]; checksumAlgorithmParam != nil {
+		checksumAlgorithm = strings.ToUpper(fmt.Sprint(checksumAlgorithmParam))
+		if _, ok := checksums[checksumAlgorithm]; !ok {
+			return nil, fmt.Errorf("the checksumalgorithm parameter must be one of %v, %v invalid", checksumAlgorithms(), checksumAlgorithmParam)
+		}
+	}
+
+	maxRetries, err := getParameterAsInteger(parameters, "maxretries", defaultMaxRetries, 0, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	retryMinDelay, err := getParameterAsDuration(parameters, "retrymindelay", defaultRetryMinDelay)
+	if err != nil {
+		return nil, err
+	}
+	retryMaxDelay, err := getParameterAsDuration(parameters, "retrymaxdelay", defaultRetryMaxDelay)
+	if err != nil {
+		return nil, err
+	}
+	if retryMaxDelay < retryMinDelay {
+		return nil, fmt.Errorf("the retrymaxdelay parameter must not be less than the retrymindelay parameter")
+	}
+	operationTimeout, err := getParameterAsDuration(parameters, "operationtimeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	readTimeout, err := getParameterAsDuration(parameters, "readtimeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := getParameterAsInteger(parameters, "ratelimit", 0, 0, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	adaptiveRateLimitBool := false
+	adaptiveRateLimit := parameters["adaptiveratelimit"]
+	switch adaptiveRateLimit := adaptiveRateLimit.(type) {
+	case string:
+		b, err := strconv.ParseBool(adaptiveRateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("the adaptiveRateLimit parameter should be a boolean")
+		}
+		adaptiveRateLimitBool = b
+	case bool:
+		adaptiveRateLimitBool = adaptiveRateLimit
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the adaptiveRateLimit parameter should be a boolean")
+	}
+	if adaptiveRateLimitBool && rateLimit == 0 {
+		return nil, fmt.Errorf("the adaptiveratelimit parameter requires the ratelimit parameter")
+	}
+
+	var failoverEndpoints []string
+	switch endpoints := parameters["failoverendpoints"].(type) {
+	case string:
+		for _, endpoint := range strings.Split(endpoints, ",") {
+			failoverEndpoints = append(failoverEndpoints, strings.TrimSpace(endpoint))
+		}
+	case []interface{}:
+		for _, endpoint := range endpoints {
+			failoverEndpoints = append(failoverEndpoints, fmt.Sprint(endpoint))
+		}
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the failoverendpoints parameter should be a list of endpoints")
+	}
+	for _, endpoint := range failoverEndpoints {
+		if endpoint == "" {
+			return nil, fmt.Errorf("the failoverendpoints parameter should not contain empty endpoints")
+		}
+	}
+	if len(failoverEndpoints) > 0 && (regionEndpoint == nil || fmt.Sprint(regionEndpoint) == "") {
+		return nil, fmt.Errorf("the failoverendpoints parameter requires the regionendpoint parameter")
+	}
+
+	failoverWritesBool := false
+	failoverWrites := parameters["failoverwrites"]
+	switch failoverWrites := failoverWrites.(type) {
+	case string:
+		b, err := strconv.ParseBool(failoverWrites)
+		if err != nil {
+			return nil, fmt.Errorf("the failoverWrites parameter should be a boolean")
+		}
+		failoverWritesBool = b
+	case bool:
+		failoverWritesBool = failoverWrites
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the failoverWrites parameter should be a boolean")
+	}
+
+	failoverThreshold, err := getParameterAsInteger(parameters, "failoverthreshold", defaultFailoverThreshold, 1, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	failbackInterval, err := getParameterAsDuration(parameters, "failbackinterval", defaultFailbackInterval)
+	if err != nil {
+		return nil, err
+	}
+	if failbackInterval == 0 {
+		return nil, fmt.Errorf("the failbackinterval parameter must be positive")
+	}
+
+	restoreArchivedBool := false
+	restoreArchived := parameters["restorearchived"]
+	switch restoreArchived := restoreArchived.(type) {
+	case string:
+		b, err := strconv.ParseBool(restoreArchived)
+		if err != nil {
+			return nil, fmt.Errorf("the restoreArchived parameter should be a boolean")
+		}
+		restoreArchivedBool = b
+	case bool:
+		restoreArchivedBool = restoreArchived
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the restoreArchived parameter should be a boolean")
+	}
+
+	restoreDays, err := getParameterAsInteger(parameters, "restoredays", defaultRestoreDays, 1, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreTier := string(types.TierStandard)
+	if restoreTierParam := parameters["restoretier"]; restoreTierParam != nil {
+		restoreTier = ""
+		for _, tier := range restoreTiers {
+			if strings.EqualFold(tier, fmt.Sprint(restoreTierParam)) {
+				restoreTier = tier
+			}
+		}
+		if restoreTier == "" {
+			return nil, fmt.Errorf("the restoretier parameter must be one of %v, %v invalid", restoreTiers, restoreTierParam)
+		}
+	}
+
+	// the services of profiles are probed by default, checking that the
+	// driver works with them before the registry starts
+	conformanceProbeBool := profileName != ""
+	conformanceProbe := parameters["conformanceprobe"]
+	switch conformanceProbe := conformanceProbe.(type) {
+	case string:
+		b, err := strconv.ParseBool(conformanceProbe)
+		if err != nil {
+			return nil, fmt.Errorf("the conformanceProbe parameter should be a boolean")
+		}
+		conformanceProbeBool = b
+	case bool:
+		conformanceProbeBool = conformanceProbe
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the conformanceProbe parameter should be a boolean")
+	}
+
 	params := DriverParameters{
 		AccessKey:                   fmt.Sprint(accessKey),
 		SecretKey:                   fmt.Sprint(secretKey),
@@ -442,35 +770,70 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		SessionToken:                fmt.Sprint(sessionToken),
 		UseDualStack:                useDualStackBool,
 		Accelerate:                  accelerateBool,
+		RequesterPays:               requesterPaysBool,
+		ObjectTagging:               objectTaggingBool,
+		ChecksumAlgorithm:           checksumAlgorithm,
+		MaxRetries:                  maxRetries,
+		RetryMinDelay:               retryMinDelay,
+		RetryMaxDelay:               retryMaxDelay,
+		OperationTimeout:            operationTimeout,
+		ReadTimeout:                 readTimeout,
+		RateLimit:                   rateLimit,
+		AdaptiveRateLimit:           adaptiveRateLimitBool,
+		FailoverEndpoints:           failoverEndpoints,
+		FailoverWrites:              failoverWritesBool,
+		FailoverThreshold:           failoverThreshold,
+		FailbackInterval:            failbackInterval,
+		RestoreArchived:             restoreArchivedBool,
+		RestoreDays:                 restoreDays,
+		RestoreTier:                 restoreTier,
 		LogLevel:                    getS3LogLevelFromParam(parameters["loglevel"]),
+		Profile:                     profileName,
+		ConformanceProbe:            conformanceProbeBool,
+		SSECustomerKey:              sseCustomerKey,
+		SSECustomerPreviousKeys:     sseCustomerPreviousKeys,
+		RoleARN:                     fmt.Sprint(roleARN),
+		RoleSessionName:             fmt.Sprint(roleSessionName),
+		ExternalID:                  fmt.Sprint(externalID),
+		WebIdentityTokenFile:        fmt.Sprint(webIdentityTokenFile),
+		STSEndpoint:                 fmt.Sprint(stsEndpoint),
+	}
+
+	if profileName != "" {
+		if err := profile.validate(profileName, params); err != nil {
+			return nil, err
+		}
+	}
+	if directoryBucket {
+		if err := validateDirectoryBucket(params); err != nil {
+			return nil, err
+		}
 	}
 
 	return New(ctx, params)
 }
 
-func getS3LogLevelFromParam(param interface{}) aws.LogLevelType {
+func getS3LogLevelFromParam(param interface{}) aws.ClientLogMode {
 	if param == nil {
-		return aws.LogOff
+		return 0
 	}
 	logLevelParam := param.(string)
-	var logLevel aws.LogLevelType
+	var logLevel aws.ClientLogMode
 	switch strings.ToLower(logLevelParam) {
 	case "off":
-		logLevel = aws.LogOff
-	case "debug":
-		logLevel = aws.LogDebug
+		logLevel = 0
+	case "debug", "debugwithrequesterrors":
+		logLevel = aws.LogRequest | aws.LogResponse
 	case "debugwithsigning":
-		logLevel = aws.LogDebugWithSigning
+		logLevel = aws.LogRequest | aws.LogResponse | aws.LogSigning
 	case "debugwithhttpbody":
-		logLevel = aws.LogDebugWithHTTPBody
+		logLevel = aws.LogRequestWithBody | aws.LogResponseWithBody
 	case "debugwithrequestretries":
-		logLevel = aws.LogDebugWithRequestRetries
-	case "debugwithrequesterrors":
-		logLevel = aws.LogDebugWithRequestErrors
+		logLevel = aws.LogRequest | aws.LogResponse | aws.LogRetries
 	case "debugwitheventstreambody":
-		logLevel = aws.LogDebugWithEventStreamBody
+		logLevel = aws.LogRequestEventMessage | aws.LogResponseEventMessage
 	default:
-		logLevel = aws.LogOff
+		logLevel = 0
 	}
 	return logLevel
 }
@@ -485,8 +848,45 @@ type unsigned interface {
 	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
 }
 
+// parseSSECustomerKey decodes the base64 encoded SSE-C key of parameter name,
+// returning an empty key if p is nil.
+func parseSSECustomerKey(name string, p interface{}) (string, error) {
+	if p == nil || p == "" {
+		return "", nil
+	}
+	key, err := base64.StdEncoding.DecodeString(fmt.Sprint(p))
+	if err != nil || len(key) != 32 {
+		return "", fmt.Errorf("the %s parameter must be a base64 encoded 256-bit key", name)
+	}
+	return string(key), nil
+}
+
 // getParameterAsInteger converts parameters[name] to T (using defaultValue if
 // nil) and ensures it is in the range of min and max.
+// getParameterAsDuration returns the duration of the parameter name, which
+// must not be negative, or defaultValue.
+func getParameterAsDuration(parameters map[string]any, name string, defaultValue time.Duration) (time.Duration, error) {
+	v := defaultValue
+	switch p := parameters[name].(type) {
+	case nil:
+		// do nothing
+	case time.Duration:
+		v = p
+	case string:
+		d, err := time.ParseDuration(p)
+		if err != nil {
+			return 0, fmt.Errorf("the %s parameter must be a duration, %v invalid", name, p)
+		}
+		v = d
+	default:
+		return 0, fmt.Errorf("the %s parameter must be a duration, %v invalid", name, p)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("the %s parameter must not be negative, %v invalid", name, v)
+	}
+	return v, nil
+}
+
 func getParameterAsInteger[T integer](parameters map[string]any, name string, defaultValue, min, max T) (T, error) {
 	v := defaultValue
 	if p := parameters[name]; p != nil {
@@ -500,6 +900,88 @@ func getParameterAsInteger[T integer](parameters map[string]any, name string, de
 	return v, nil
 }
 
+// roleCredentials returns the credentials of the role of the parameters,
+// assumed with the credentials of cfg, or with the web identity token of the
+// parameters when set. The credentials are refreshed before they expire.
+func roleCredentials(cfg aws.Config, params DriverParameters) aws.CredentialsProvider {
+	// The regionendpoint is the endpoint of S3, not of STS
+	stsClient := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		if params.STSEndpoint != "" {
+			o.BaseEndpoint = aws.String(addScheme(params.STSEndpoint, params.Secure))
+		}
+	})
+	if params.WebIdentityTokenFile != "" {
+		return aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(stsClient, params.RoleARN, stscreds.IdentityTokenFile(params.WebIdentityTokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = params.RoleSessionName
+		}))
+	}
+	return aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsClient, params.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = params.RoleSessionName
+		if params.ExternalID != "" {
+			o.ExternalID = aws.String(params.ExternalID)
+		}
+	}))
+}
+
+// addRequestPayer acknowledges that the registry pays for the requests to a
+// requester pays bucket.
+func addRequestPayer(stack *middleware.Stack) error {
+	// the clients of presigned URLs do not send the headers these are
+	// signed with
+	_, presigned := stack.Finalize.Get("PresignHTTPRequest")
+	return stack.Build.Add(middleware.BuildMiddlewareFunc("distribution.RequestPayer", func(
+		ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler,
+	) (middleware.BuildOutput, middleware.Metadata, error) {
+		if req, ok := in.Request.(*smithyhttp.Request); ok {
+			if presigned {
+				q := req.URL.Query()
+				q.Set("x-amz-request-payer", string(types.RequestPayerRequester))
+				req.URL.RawQuery = q.Encode()
+			} else {
+				req.Header.Set("X-Amz-Request-Payer", string(types.RequestPayerRequester))
+			}
+		}
+		return next.HandleBuild(ctx, in)
+	}), middleware.After)
+}
+
+// addSSECustomerKeyMD5 encodes the customer keys of requests, which the
+// driver sets as they are, and sets their MD5 digests, with which S3 checks
+// that the keys were not corrupted.
+func addSSECustomerKeyMD5(stack *middleware.Stack) error {
+	return stack.Build.Add(middleware.BuildMiddlewareFunc("distribution.SSECustomerKeyMD5", func(
+		ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler,
+	) (middleware.BuildOutput, middleware.Metadata, error) {
+		if req, ok := in.Request.(*smithyhttp.Request); ok {
+			for _, header := range []string{
+				"X-Amz-Server-Side-Encryption-Customer-Key",
+				"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key",
+			} {
+				key := req.Header.Get(header)
+				if key == "" {
+					continue
+				}
+				sum := md5.Sum([]byte(key))
+				req.Header.Set(header, base64.StdEncoding.EncodeToString([]byte(key)))
+				req.Header.Set(header+"-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+			}
+		}
+		return next.HandleBuild(ctx, in)
+	}), middleware.After)
+}
+
+// addScheme returns endpoint with the scheme of the secure parameter, unless
+// it has a scheme.
+func addScheme(endpoint string, secure bool) string {
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	if secure {
+		return "https://" + endpoint
+	}
+	return "http://" + endpoint
+}
+
 // New constructs a new Driver with the given AWS credentials, region, encryption flag, and
 // bucketName
 func New(ctx context.Context, params DriverParameters) (*Driver, error) {
@@ -509,53 +991,146 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 		return nil, fmt.Errorf("on Amazon S3 this storage driver can only be used with v4 authentication")
 	}
 
-	awsConfig := aws.NewConfig().WithLogLevel(params.LogLevel)
-
+	profile := profiles[awsProfile]
+	if params.Profile != "" {
+		p, ok := profiles[params.Profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", params.Profile)
+		}
+		profile = p
+	}
+
+	// credentials are those of the parameters, or else those of the default
+	// chain of the SDK, such as those of the environment, of shared
+	// configuration and SSO, of web identity tokens, and of the instance
+	// metadata service
+	configOptions := []func(*config.LoadOptions) error{
+		config.WithRegion(params.Region),
+		config.WithClientLogMode(params.LogLevel),
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = params.MaxRetries + 1
+				o.Backoff = backoff{minDelay: params.RetryMinDelay, maxDelay: params.RetryMaxDelay}
+				// retries are only limited by the rate limit of the driver
+				o.RateLimiter = ratelimit.None
+			})
+		}),
+	}
 	if params.AccessKey != "" && params.SecretKey != "" {
-		creds := credentials.NewStaticCredentials(
+		configOptions = append(configOptions, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
 			params.AccessKey,
 			params.SecretKey,
 			params.SessionToken,
-		)
-		awsConfig.WithCredentials(creds)
+		)))
 	}
-
-	if params.RegionEndpoint != "" {
-		awsConfig.WithEndpoint(params.RegionEndpoint)
+	if params.SkipVerify {
+		configOptions = append(configOptions, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.InsecureSkipVerify = true
+		})))
 	}
 
-	awsConfig.WithS3ForcePathStyle(params.ForcePathStyle)
-	awsConfig.WithS3UseAccelerate(params.Accelerate)
-	awsConfig.WithRegion(params.Region)
-	awsConfig.WithDisableSSL(!params.Secure)
-	if params.UseDualStack {
-		awsConfig.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	cfg, err := config.LoadDefaultConfig(ctx, configOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config: %v", err)
 	}
 
-	if params.SkipVerify {
-		httpTransport := http.DefaultTransport.(*http.Transport).Clone()
-		httpTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		awsConfig.WithHTTPClient(&http.Client{
-			Transport: httpTransport,
+	// the endpoint requests are sent to, to which objects are transferred
+	// server-side from drivers of the same endpoint
+	var endpoint string
+	forcePathStyle := params.ForcePathStyle
+	directoryBucket := isDirectoryBucket(params.Bucket)
+	switch {
+	case params.RegionEndpoint != "":
+		endpoint = addScheme(params.RegionEndpoint, params.Secure)
+	case directoryBucket:
+		// directory buckets are only accessed through the endpoint of their
+		// zone, which the SDK resolves
+		endpoint, err = zonalEndpoint(params.Bucket, params.Region)
+		if err != nil {
+			return nil, err
+		}
+		forcePathStyle = false
+	default:
+		resolved, err := s3.NewDefaultEndpointResolverV2().ResolveEndpoint(ctx, s3.EndpointParameters{
+			Region:         aws.String(params.Region),
+			UseDualStack:   aws.Bool(params.UseDualStack),
+			UseFIPS:        aws.Bool(false),
+			ForcePathStyle: aws.Bool(true),
 		})
+		if err != nil {
+			return nil, err
+		}
+		if !params.Secure {
+			resolved.URI.Scheme = "http"
+		}
+		endpoint = resolved.URI.String()
 	}
 
-	sess, err := session.NewSession(awsConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new session with aws config: %v", err)
+	var f *failover
+	if len(params.FailoverEndpoints) > 0 {
+		f, err = newFailover(params)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if params.UserAgent != "" {
-		sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(params.UserAgent))
-	}
+	s3obj := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = forcePathStyle
+		if params.RegionEndpoint != "" {
+			// custom endpoints are used as they are
+			o.BaseEndpoint = aws.String(endpoint)
+		} else {
+			o.EndpointOptions.DisableHTTPS = !params.Secure
+			o.UseAccelerate = params.Accelerate
+			if params.UseDualStack {
+				o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+			}
+		}
 
-	s3obj := s3.New(sess)
+		if params.RoleARN != "" {
+			o.Credentials = roleCredentials(cfg, params)
+		}
 
-	// enable S3 compatible signature v2 signing instead
-	if !params.V4Auth {
-		setv2Handlers(s3obj)
+		// enable S3 compatible signature v2 signing instead
+		if !params.V4Auth {
+			o.HTTPSignerV4 = v2Signer{}
+		}
+
+		if params.UserAgent != "" {
+			o.APIOptions = append(o.APIOptions, awsmiddleware.AddUserAgentKey(params.UserAgent))
+		}
+		if params.RequesterPays {
+			o.APIOptions = append(o.APIOptions, addRequestPayer)
+		}
+		if params.SSECustomerKey != "" {
+			o.APIOptions = append(o.APIOptions, addSSECustomerKeyMD5)
+		}
+		if profile.contentMD5 {
+			o.APIOptions = append(o.APIOptions, addContentMD5)
+		}
+		if params.OperationTimeout > 0 || params.ReadTimeout > 0 {
+			o.APIOptions = append(o.APIOptions, withTimeouts(params.OperationTimeout, params.ReadTimeout))
+		}
+		if params.RateLimit > 0 {
+			o.APIOptions = append(o.APIOptions, newRateLimiter(params.RateLimit, params.AdaptiveRateLimit).middleware)
+		}
+		if f != nil {
+			o.APIOptions = append(o.APIOptions, f.middleware)
+		}
+	})
+	if f != nil {
+		f.client = s3obj
 	}
 
+	presignClient := s3.NewPresignClient(s3obj, func(o *s3.PresignOptions) {
+		if !params.V4Auth {
+			o.Presigner = v2Signer{}
+		}
+	})
+
 	// TODO Currently multipart uploads have no timestamps, so this would be unwise
 	// if you initiated a new s3driver while another one is running on the same bucket.
 	// multis, _, err := bucket.ListMulti("", "")
@@ -573,6 +1148,8 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 
 	d := &driver{
 		S3:                          s3obj,
+		Endpoint:                    endpoint,
+		presignClient:               presignClient,
 		Bucket:                      params.Bucket,
 		ChunkSize:                   params.ChunkSize,
 		Encrypt:                     params.Encrypt,
@@ -583,11 +1160,29 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 		RootDirectory:               params.RootDirectory,
 		StorageClass:                params.StorageClass,
 		ObjectACL:                   params.ObjectACL,
+		SSECustomerKey:              params.SSECustomerKey,
+		SSECustomerPreviousKeys:     params.SSECustomerPreviousKeys,
+		ObjectTagging:               params.ObjectTagging,
+		ChecksumAlgorithm:           params.ChecksumAlgorithm,
+		DirectoryBucket:             directoryBucket,
+		RestoreArchived:             params.RestoreArchived,
+		RestoreDays:                 params.RestoreDays,
+		RestoreTier:                 params.RestoreTier,
 		pool: &sync.Pool{
 			New: func() any { return &bytes.Buffer{} },
 		},
 	}
 
+	if params.ConformanceProbe {
+		name := params.Profile
+		if name == "" {
+			name = awsProfile
+		}
+		if err := d.probe(ctx); err != nil {
+			return nil, fmt.Errorf("the %s conformance probe of bucket %s failed: %v", name, params.Bucket, err)
+		}
+	}
+
 	return &Driver{
 		baseEmbed: baseEmbed{
 			Base: base.Base{
@@ -614,7 +1209,8 @@ func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 
 // PutContent stores the []byte content at a location designated by "path".
 func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
-	_, err := d.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+	sum := d.checksum(contents)
+	_, err := d.S3.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:               aws.String(d.Bucket),
 		Key:                  aws.String(d.s3Path(path)),
 		ContentType:          d.getContentType(),
@@ -622,6 +1218,13 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 		ServerSideEncryption: d.getEncryptionMode(),
 		SSEKMSKeyId:          d.getSSEKMSKeyID(),
 		StorageClass:         d.getStorageClass(),
+		SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+		SSECustomerKey:       d.getSSECustomerKey(),
+		Tagging:              d.getTagging(ctx, d.s3Path(path), ""),
+		ChecksumAlgorithm:    sum.Algorithm,
+		ChecksumCRC32:        sum.CRC32,
+		ChecksumCRC32C:       sum.CRC32C,
+		ChecksumSHA256:       sum.SHA256,
 		Body:                 bytes.NewReader(contents),
 	})
 	return parseError(path, err)
@@ -630,14 +1233,23 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 // Reader retrieves an io.ReadCloser for the content stored at "path" with a
 // given byte offset.
 func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
-	resp, err := d.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(d.Bucket),
-		Key:    aws.String(d.s3Path(path)),
-		Range:  aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-"),
+	var resp *s3.GetObjectOutput
+	err := d.withSSECustomerKeys(func(key *string) (err error) {
+		resp, err = d.S3.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(d.s3Path(path)),
+			Range:                aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-"),
+			SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+			SSECustomerKey:       key,
+		})
+		return err
 	})
 	if err != nil {
-		if s3Err, ok := err.(awserr.Error); ok && s3Err.Code() == "InvalidRange" {
+		switch errorCode(err) {
+		case "InvalidRange":
 			return io.NopCloser(bytes.NewReader(nil)), nil
+		case "InvalidObjectState":
+			return nil, d.archivedError(ctx, path, err)
 		}
 
 		return nil, parseError(path, err)
@@ -655,7 +1267,7 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 	key := d.s3Path(path)
 	if !appendMode {
 		// TODO (brianbland): cancel other uploads at this path
-		resp, err := d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		resp, err := d.S3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
 			Bucket:               aws.String(d.Bucket),
 			Key:                  aws.String(key),
 			ContentType:          d.getContentType(),
@@ -663,6 +1275,10 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 			ServerSideEncryption: d.getEncryptionMode(),
 			SSEKMSKeyId:          d.getSSEKMSKeyID(),
 			StorageClass:         d.getStorageClass(),
+			SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+			SSECustomerKey:       d.getSSECustomerKey(),
+			Tagging:              d.getTagging(ctx, key, ""),
+			ChecksumAlgorithm:    d.getChecksumAlgorithm(),
 		})
 		if err != nil {
 			return nil, err
@@ -675,7 +1291,7 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 		Prefix: aws.String(key),
 	}
 	for {
-		resp, err := d.S3.ListMultipartUploadsWithContext(ctx, listMultipartUploadsInput)
+		resp, err := d.S3.ListMultipartUploads(ctx, listMultipartUploadsInput)
 		if err != nil {
 			return nil, parseError(path, err)
 		}
@@ -690,7 +1306,7 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 			}
 
 			if fi.Size() == 0 {
-				resp, err := d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+				resp, err := d.S3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
 					Bucket:               aws.String(d.Bucket),
 					Key:                  aws.String(key),
 					ContentType:          d.getContentType(),
@@ -698,6 +1314,10 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 					ServerSideEncryption: d.getEncryptionMode(),
 					SSEKMSKeyId:          d.getSSEKMSKeyID(),
 					StorageClass:         d.getStorageClass(),
+					SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+					SSECustomerKey:       d.getSSECustomerKey(),
+					Tagging:              d.getTagging(ctx, key, ""),
+					ChecksumAlgorithm:    d.getChecksumAlgorithm(),
 				})
 				if err != nil {
 					return nil, err
@@ -710,13 +1330,13 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 			}
 		}
 
-		var allParts []*s3.Part
+		var allParts []types.Part
 		for _, multi := range resp.Uploads {
 			if key != *multi.Key {
 				continue
 			}
 
-			partsList, err := d.S3.ListPartsWithContext(ctx, &s3.ListPartsInput{
+			partsList, err := d.S3.ListParts(ctx, &s3.ListPartsInput{
 				Bucket:   aws.String(d.Bucket),
 				Key:      aws.String(key),
 				UploadId: multi.UploadId,
@@ -726,7 +1346,7 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 			}
 			allParts = append(allParts, partsList.Parts...)
 			for *partsList.IsTruncated {
-				partsList, err = d.S3.ListPartsWithContext(ctx, &s3.ListPartsInput{
+				partsList, err = d.S3.ListParts(ctx, &s3.ListPartsInput{
 					Bucket:           aws.String(d.Bucket),
 					Key:              aws.String(key),
 					UploadId:         multi.UploadId,
@@ -753,9 +1373,15 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 }
 
 func (d *driver) statHead(ctx context.Context, path string) (*storagedriver.FileInfoFields, error) {
-	resp, err := d.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(d.Bucket),
-		Key:    aws.String(d.s3Path(path)),
+	var resp *s3.HeadObjectOutput
+	err := d.withSSECustomerKeys(func(key *string) (err error) {
+		resp, err = d.S3.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(d.s3Path(path)),
+			SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+			SSECustomerKey:       key,
+		})
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -770,10 +1396,16 @@ func (d *driver) statHead(ctx context.Context, path string) (*storagedriver.File
 
 func (d *driver) statList(ctx context.Context, path string) (*storagedriver.FileInfoFields, error) {
 	s3Path := d.s3Path(path)
-	resp, err := d.S3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+	prefix := s3Path
+	if d.DirectoryBucket {
+		// directory buckets do not list the keys sharing the prefix of the
+		// path first
+		prefix += "/"
+	}
+	resp, err := d.S3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
 		Bucket:  aws.String(d.Bucket),
-		Prefix:  aws.String(s3Path),
-		MaxKeys: aws.Int64(1),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(1),
 	})
 	if err != nil {
 		return nil, err
@@ -810,8 +1442,8 @@ func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo,
 		// are slightly outdated, the HeadObject actually returns NotFound error
 		// if querying a key which doesn't exist or a key which has nested keys
 		// and Forbidden if IAM/ACL permissions do not allow Head but allow List.
-		var awsErr awserr.Error
-		if errors.As(err, &awsErr) {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
 			fi, err := d.statList(ctx, path)
 			if err != nil {
 				return nil, parseError(path, err)
@@ -839,11 +1471,11 @@ func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
 		prefix = "/"
 	}
 
-	resp, err := d.S3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+	resp, err := d.S3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
 		Bucket:    aws.String(d.Bucket),
 		Prefix:    aws.String(d.s3Path(path)),
 		Delimiter: aws.String("/"),
-		MaxKeys:   aws.Int64(listMax),
+		MaxKeys:   aws.Int32(listMax),
 	})
 	if err != nil {
 		return nil, parseError(opath, err)
@@ -866,11 +1498,11 @@ func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
 			break
 		}
 
-		resp, err = d.S3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		resp, err = d.S3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
 			Bucket:            aws.String(d.Bucket),
 			Prefix:            aws.String(d.s3Path(path)),
 			Delimiter:         aws.String("/"),
-			MaxKeys:           aws.Int64(listMax),
+			MaxKeys:           aws.Int32(listMax),
 			ContinuationToken: resp.NextContinuationToken,
 		})
 		if err != nil {
@@ -901,19 +1533,54 @@ func (d *driver) Move(ctx context.Context, sourcePath, destPath string) error {
 
 // copy copies an object stored at sourcePath to destPath.
 func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
+	return d.copyFrom(ctx, d, sourcePath, destPath)
+}
+
+// Transfer copies the object stored at sourcePath by the source driver to
+// destPath server-side, if the source driver is an S3 driver of the same
+// endpoint. The credentials of the driver must allow reading the object.
+func (d *driver) Transfer(ctx context.Context, source storagedriver.StorageDriver, sourcePath, destPath string) error {
+	sourceDriver, ok := source.(*Driver)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+	src, ok := sourceDriver.Base.StorageDriver.(*driver)
+	if !ok || src.Endpoint != d.Endpoint {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+	return d.copyFrom(ctx, src, sourcePath, destPath)
+}
+
+// copyFrom copies an object stored at sourcePath by the src driver to
+// destPath.
+func (d *driver) copyFrom(ctx context.Context, src *driver, sourcePath, destPath string) error {
 	// S3 can copy objects up to 5 GB in size with a single PUT Object - Copy
 	// operation. For larger objects, the multipart upload API must be used.
 	//
 	// Empirically, multipart copy is fastest with 32 MB parts and is faster
 	// than PUT Object - Copy for objects larger than 32 MB.
 
-	fileInfo, err := d.Stat(ctx, sourcePath)
+	fileInfo, err := src.Stat(ctx, sourcePath)
+	if err != nil {
+		return parseError(sourcePath, err)
+	}
+
+	// the copy is encrypted with the current customer key, whichever key
+	// the source is encrypted with
+	sourceKey, err := src.sourceSSECustomerKey(ctx, src.s3Path(sourcePath))
 	if err != nil {
 		return parseError(sourcePath, err)
 	}
 
+	// the tags of the source are replaced, as the copy has a digest
+	tagging := d.getTagging(ctx, d.s3Path(destPath), src.s3Path(sourcePath))
+	var taggingDirective types.TaggingDirective
+	if tagging != nil {
+		taggingDirective = types.TaggingDirectiveReplace
+	}
+
 	if fileInfo.Size() <= d.MultipartCopyThresholdSize {
-		_, err := d.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		_, err := d.S3.CopyObject(ctx, &s3.CopyObjectInput{
 			Bucket:               aws.String(d.Bucket),
 			Key:                  aws.String(d.s3Path(destPath)),
 			ContentType:          d.getContentType(),
@@ -921,7 +1588,14 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 			ServerSideEncryption: d.getEncryptionMode(),
 			SSEKMSKeyId:          d.getSSEKMSKeyID(),
 			StorageClass:         d.getStorageClass(),
-			CopySource:           aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
+			SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+			SSECustomerKey:       d.getSSECustomerKey(),
+			Tagging:              tagging,
+			TaggingDirective:     taggingDirective,
+			CopySource:           aws.String(src.Bucket + "/" + src.s3Path(sourcePath)),
+
+			CopySourceSSECustomerAlgorithm: src.getSSECustomerAlgorithm(),
+			CopySourceSSECustomerKey:       sourceKey,
 		})
 		if err != nil {
 			return parseError(sourcePath, err)
@@ -929,7 +1603,7 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 		return nil
 	}
 
-	createResp, err := d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+	createResp, err := d.S3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
 		Bucket:               aws.String(d.Bucket),
 		Key:                  aws.String(d.s3Path(destPath)),
 		ContentType:          d.getContentType(),
@@ -937,13 +1611,16 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 		SSEKMSKeyId:          d.getSSEKMSKeyID(),
 		ServerSideEncryption: d.getEncryptionMode(),
 		StorageClass:         d.getStorageClass(),
+		SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+		SSECustomerKey:       d.getSSECustomerKey(),
+		Tagging:              tagging,
 	})
 	if err != nil {
 		return err
 	}
 
 	numParts := (fileInfo.Size() + d.MultipartCopyChunkSize - 1) / d.MultipartCopyChunkSize
-	completedParts := make([]*s3.CompletedPart, numParts)
+	completedParts := make([]types.CompletedPart, numParts)
 	errChan := make(chan error, numParts)
 	limiter := make(chan struct{}, d.MultipartCopyMaxConcurrency)
 
@@ -956,18 +1633,23 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 			if lastByte >= fileInfo.Size() {
 				lastByte = fileInfo.Size() - 1
 			}
-			uploadResp, err := d.S3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			uploadResp, err := d.S3.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
 				Bucket:          aws.String(d.Bucket),
-				CopySource:      aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
+				CopySource:      aws.String(src.Bucket + "/" + src.s3Path(sourcePath)),
 				Key:             aws.String(d.s3Path(destPath)),
-				PartNumber:      aws.Int64(i + 1),
+				PartNumber:      aws.Int32(int32(i + 1)),
 				UploadId:        createResp.UploadId,
 				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", firstByte, lastByte)),
+
+				SSECustomerAlgorithm:           d.getSSECustomerAlgorithm(),
+				SSECustomerKey:                 d.getSSECustomerKey(),
+				CopySourceSSECustomerAlgorithm: src.getSSECustomerAlgorithm(),
+				CopySourceSSECustomerKey:       sourceKey,
 			})
 			if err == nil {
-				completedParts[i] = &s3.CompletedPart{
+				completedParts[i] = types.CompletedPart{
 					ETag:       uploadResp.CopyPartResult.ETag,
-					PartNumber: aws.Int64(i + 1),
+					PartNumber: aws.Int32(int32(i + 1)),
 				}
 			}
 			errChan <- err
@@ -982,11 +1664,11 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 		}
 	}
 
-	_, err = d.S3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+	_, err = d.S3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
 		Bucket:          aws.String(d.Bucket),
 		Key:             aws.String(d.s3Path(destPath)),
 		UploadId:        createResp.UploadId,
-		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
 	})
 	return err
 }
@@ -994,7 +1676,7 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 // We must be careful since S3 does not guarantee read after delete consistency
 func (d *driver) Delete(ctx context.Context, path string) error {
-	s3Objects := make([]*s3.ObjectIdentifier, 0, listMax)
+	s3Objects := make([]types.ObjectIdentifier, 0, listMax)
 	s3Path := d.s3Path(path)
 	listObjectsInput := &s3.ListObjectsV2Input{
 		Bucket: aws.String(d.Bucket),
@@ -1003,7 +1685,7 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 
 	for {
 		// list all the objects
-		resp, err := d.S3.ListObjectsV2WithContext(ctx, listObjectsInput)
+		resp, err := d.S3.ListObjectsV2(ctx, listObjectsInput)
 
 		// resp.Contents can only be empty on the first call
 		// if there were no more results to return after the first call, resp.IsTruncated would have been false
@@ -1017,7 +1699,7 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 			if len(*key.Key) > len(s3Path) && (*key.Key)[len(s3Path)] != '/' {
 				continue
 			}
-			s3Objects = append(s3Objects, &s3.ObjectIdentifier{
+			s3Objects = append(s3Objects, types.ObjectIdentifier{
 				Key: key.Key,
 			})
 		}
@@ -1028,9 +1710,9 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 			// by default the response returns up to 1,000 key names. The response _might_ contain fewer keys but it will never contain more.
 			// 10000 keys is coincidentally (?) also the max number of keys that can be deleted in a single Delete operation, so we'll just smack
 			// Delete here straight away and reset the object slice when successful.
-			resp, err := d.S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			resp, err := d.S3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
 				Bucket: aws.String(d.Bucket),
-				Delete: &s3.Delete{
+				Delete: &types.Delete{
 					Objects: s3Objects,
 					Quiet:   aws.Bool(false),
 				},
@@ -1040,11 +1722,11 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 			}
 
 			if len(resp.Errors) > 0 {
-				// NOTE: AWS SDK s3.Error does not implement error interface which
+				// NOTE: AWS SDK types.Error does not implement error interface which
 				// is pretty intensely sad, so we have to do away with this for now.
 				errs := make([]error, 0, len(resp.Errors))
 				for _, err := range resp.Errors {
-					errs = append(errs, errors.New(err.String()))
+					errs = append(errs, deleteError(err))
 				}
 				return storagedriver.Errors{
 					DriverName: driverName,
@@ -1057,7 +1739,12 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 		s3Objects = s3Objects[:0]
 
 		// resp.Contents must have at least one element or we would have returned not found
-		listObjectsInput.StartAfter = resp.Contents[len(resp.Contents)-1].Key
+		if d.DirectoryBucket {
+			// directory buckets do not support StartAfter
+			listObjectsInput.ContinuationToken = resp.NextContinuationToken
+		} else {
+			listObjectsInput.StartAfter = resp.Contents[len(resp.Contents)-1].Key
+		}
 
 		// from the s3 api docs, IsTruncated "specifies whether (true) or not (false) all of the results were returned"
 		// if everything has been returned, break
@@ -1069,28 +1756,76 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 	return nil
 }
 
+// DeleteFiles deletes the objects stored at paths with DeleteObjects, in
+// batches of listMax objects, the most a single request may delete.
+func (d *driver) DeleteFiles(ctx context.Context, paths []string) error {
+	var errs []error
+	for start := 0; start < len(paths); start += listMax {
+		batch := paths[start:min(start+listMax, len(paths))]
+		s3Objects := make([]types.ObjectIdentifier, 0, len(batch))
+		for _, path := range batch {
+			s3Objects = append(s3Objects, types.ObjectIdentifier{
+				Key: aws.String(d.s3Path(path)),
+			})
+		}
+
+		// deleting keys which are not found succeeds
+		resp, err := d.S3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(d.Bucket),
+			Delete: &types.Delete{
+				Objects: s3Objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		for _, err := range resp.Errors {
+			errs = append(errs, deleteError(err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return storagedriver.Errors{
+			DriverName: driverName,
+			Errs:       errs,
+		}
+	}
+	return nil
+}
+
 // RedirectURL returns a URL which may be used to retrieve the content stored at the given path.
 func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
-	expiresIn := 20 * time.Minute
+	// clients cannot send the customer key objects are encrypted with, nor
+	// authenticate with the sessions of directory buckets
+	if d.SSECustomerKey != "" || d.DirectoryBucket {
+		return "", nil
+	}
 
-	var req *request.Request
+	expires := s3.WithPresignExpires(storagedriver.RedirectExpiry(r))
+
+	var req *v4.PresignedHTTPRequest
+	var err error
 
 	switch r.Method {
 	case http.MethodGet:
-		req, _ = d.S3.GetObjectRequest(&s3.GetObjectInput{
+		req, err = d.presignClient.PresignGetObject(r.Context(), &s3.GetObjectInput{
 			Bucket: aws.String(d.Bucket),
 			Key:    aws.String(d.s3Path(path)),
-		})
+		}, expires)
 	case http.MethodHead:
-		req, _ = d.S3.HeadObjectRequest(&s3.HeadObjectInput{
+		req, err = d.presignClient.PresignHeadObject(r.Context(), &s3.HeadObjectInput{
 			Bucket: aws.String(d.Bucket),
 			Key:    aws.String(d.s3Path(path)),
-		})
+		}, expires)
 	default:
 		return "", nil
 	}
+	if err != nil {
+		return "", err
+	}
 
-	return req.Presign(expiresIn)
+	return req.URL, nil
 }
 
 // Walk traverses a filesystem defined within driver, starting
@@ -1132,12 +1867,12 @@ func (d *driver) doWalk(parentCtx context.Context, objectCount *int64, from, sta
 	listObjectsInput := &s3.ListObjectsV2Input{
 		Bucket:     aws.String(d.Bucket),
 		Prefix:     aws.String(d.s3Path(path)),
-		MaxKeys:    aws.Int64(listMax),
+		MaxKeys:    aws.Int32(listMax),
 		StartAfter: aws.String(d.s3Path(startAfter)),
 	}
 
 	ctx, done := dcontext.WithTrace(parentCtx)
-	defer done("s3aws.ListObjectsV2PagesWithContext(%s)", listObjectsInput)
+	defer done("s3aws.ListObjectsV2Paginator(%s)", listObjectsInput)
 
 	// When the "delimiter" argument is omitted, the S3 list API will list all objects in the bucket
 	// recursively, omitting directory paths. Objects are listed in sorted, depth-first order so we
@@ -1148,7 +1883,7 @@ func (d *driver) doWalk(parentCtx context.Context, objectCount *int64, from, sta
 	// ErrSkipDir is handled by explicitly skipping over any files under the skipped directory. This may be sub-optimal
 	// for extreme edge cases but for the general use case in a registry, this is orders of magnitude
 	// faster than a more explicit recursive implementation.
-	listObjectErr := d.S3.ListObjectsV2PagesWithContext(ctx, listObjectsInput, func(objects *s3.ListObjectsV2Output, lastPage bool) bool {
+	walkPage := func(objects *s3.ListObjectsV2Output) bool {
 		walkInfos := make([]storagedriver.FileInfoInternal, 0, len(objects.Contents))
 
 		for _, file := range objects.Contents {
@@ -1208,7 +1943,20 @@ func (d *driver) doWalk(parentCtx context.Context, objectCount *int64, from, sta
 			}
 		}
 		return true
-	})
+	}
+
+	var listObjectErr error
+	if d.DirectoryBucket {
+		listObjectErr = d.listDirectoryBucketObjectsV2(ctx, listObjectsInput, walkPage)
+	} else {
+		paginator := s3.NewListObjectsV2Paginator(d.S3, listObjectsInput)
+		for paginator.HasMorePages() {
+			var page *s3.ListObjectsV2Output
+			if page, listObjectErr = paginator.NextPage(ctx); listObjectErr != nil || !walkPage(page) {
+				break
+			}
+		}
+	}
 
 	if retError != nil {
 		return retError
@@ -1269,21 +2017,50 @@ func (d *Driver) S3BucketKey(path string) string {
 }
 
 func parseError(path string, err error) error {
-	if s3Err, ok := err.(awserr.Error); ok && s3Err.Code() == "NoSuchKey" {
+	switch errorCode(err) {
+	case "NoSuchKey":
 		return storagedriver.PathNotFoundError{Path: path}
+	case "BadDigest":
+		return storagedriver.ChecksumMismatchError{Path: path, DriverName: driverName, Detail: err}
 	}
 
 	return err
 }
 
-func (d *driver) getEncryptionMode() *string {
+// errorCode returns the code of the S3 error err is, or wraps, or the empty
+// string.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// statusCode returns the HTTP status code of the response err is the error
+// of, or zero.
+func statusCode(err error) int {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode()
+	}
+	return 0
+}
+
+// deleteError returns the error of the object a DeleteObjects request failed
+// to delete.
+func deleteError(err types.Error) error {
+	return fmt.Errorf("%s: %s: %s", aws.ToString(err.Key), aws.ToString(err.Code), aws.ToString(err.Message))
+}
+
+func (d *driver) getEncryptionMode() types.ServerSideEncryption {
 	if !d.Encrypt {
-		return nil
+		return ""
 	}
 	if d.KeyID == "" {
-		return aws.String("AES256")
+		return types.ServerSideEncryptionAes256
 	}
-	return aws.String("aws:kms")
+	return types.ServerSideEncryptionAwsKms
 }
 
 func (d *driver) getSSEKMSKeyID() *string {
@@ -1297,15 +2074,127 @@ func (d *driver) getContentType() *string {
 	return aws.String("application/octet-stream")
 }
 
-func (d *driver) getACL() *string {
-	return aws.String(d.ObjectACL)
+func (d *driver) getACL() types.ObjectCannedACL {
+	if d.DirectoryBucket {
+		return ""
+	}
+	return types.ObjectCannedACL(d.ObjectACL)
 }
 
-func (d *driver) getStorageClass() *string {
+func (d *driver) getStorageClass() types.StorageClass {
 	if d.StorageClass == noStorageClass {
+		return ""
+	}
+	return types.StorageClass(d.StorageClass)
+}
+
+func (d *driver) getSSECustomerAlgorithm() *string {
+	if d.SSECustomerKey == "" {
 		return nil
 	}
-	return aws.String(d.StorageClass)
+	return aws.String(string(types.ServerSideEncryptionAes256))
+}
+
+func (d *driver) getSSECustomerKey() *string {
+	if d.SSECustomerKey == "" {
+		return nil
+	}
+	return aws.String(d.SSECustomerKey)
+}
+
+// getTagging returns the tags of the object at key, in the query format of
+// the Tagging parameters, or nil when objects are not tagged. The repository
+// is the one of the request, or else the one of the repository paths of key
+// or sourceKey, the key the object is copied from. The digest is the one of
+// blob data paths.
+func (d *driver) getTagging(ctx context.Context, key, sourceKey string) *string {
+	if !d.ObjectTagging {
+		return nil
+	}
+
+	tags := url.Values{}
+	repository := dcontext.GetStringValue(ctx, "vars.name")
+	if repository == "" {
+		repository = repositoryFromKey(key)
+	}
+	if repository == "" {
+		repository = repositoryFromKey(sourceKey)
+	}
+	if repository != "" {
+		tags.Set("repository", truncateTagValue(repository))
+	}
+
+	// blob data is stored at blobs/<algorithm>/<first two hex bytes>/<hex digest>/data
+	if parts := strings.Split(key, "/"); len(parts) >= 5 && parts[len(parts)-1] == "data" && parts[len(parts)-5] == "blobs" {
+		tags.Set("digest", parts[len(parts)-4]+":"+parts[len(parts)-2])
+	}
+
+	contentType, _, _ := strings.Cut(dcontext.GetStringValue(ctx, "http.request.contenttype"), ";")
+	if contentType = strings.TrimSpace(contentType); contentType != "" {
+		tags.Set("contenttype", truncateTagValue(contentType))
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+	return aws.String(tags.Encode())
+}
+
+// repositoryFromKey returns the name of the repository of the key of a
+// repository path, such as an upload, or the empty string.
+func repositoryFromKey(key string) string {
+	_, name, ok := strings.Cut("/"+key, "/repositories/")
+	if !ok {
+		return ""
+	}
+	// the components of repository names do not start with underscores
+	name, _, ok = strings.Cut(name, "/_")
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+// truncateTagValue truncates value to the maximum length of S3 tag values.
+func truncateTagValue(value string) string {
+	if len(value) > 256 {
+		return value[:256]
+	}
+	return value
+}
+
+// withSSECustomerKeys calls f with the current customer key, and then with
+// the previous customer keys while S3 rejects the key, so that objects
+// encrypted before the key was rotated can still be read.
+func (d *driver) withSSECustomerKeys(f func(key *string) error) error {
+	err := f(d.getSSECustomerKey())
+	for _, key := range d.SSECustomerPreviousKeys {
+		if code := statusCode(err); code != http.StatusBadRequest && code != http.StatusForbidden {
+			break
+		}
+		err = f(aws.String(key))
+	}
+	return err
+}
+
+// sourceSSECustomerKey returns the customer key the object at key is
+// encrypted with, to copy it.
+func (d *driver) sourceSSECustomerKey(ctx context.Context, key string) (*string, error) {
+	if d.SSECustomerKey == "" {
+		return nil, nil
+	}
+	var sourceKey *string
+	err := d.withSSECustomerKeys(func(k *string) error {
+		sourceKey = k
+		_, err := d.S3.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(key),
+			SSECustomerAlgorithm: d.getSSECustomerAlgorithm(),
+			SSECustomerKey:       k,
+		})
+		return err
+	})
+	return sourceKey, err
 }
 
 // writer uploads parts to S3 in a buffered fashion where the length of each
@@ -1318,7 +2207,7 @@ type writer struct {
 	driver    *driver
 	key       string
 	uploadID  string
-	parts     []*s3.Part
+	parts     []types.Part
 	size      int64
 	buf       *bytes.Buffer
 	closed    bool
@@ -1326,7 +2215,7 @@ type writer struct {
 	cancelled bool
 }
 
-func (d *driver) newWriter(ctx context.Context, key, uploadID string, parts []*s3.Part) storagedriver.FileWriter {
+func (d *driver) newWriter(ctx context.Context, key, uploadID string, parts []types.Part) storagedriver.FileWriter {
 	var size int64
 	for _, part := range parts {
 		size += *part.Size
@@ -1342,7 +2231,7 @@ func (d *driver) newWriter(ctx context.Context, key, uploadID string, parts []*s
 	}
 }
 
-type completedParts []*s3.CompletedPart
+type completedParts []types.CompletedPart
 
 func (a completedParts) Len() int           { return len(a) }
 func (a completedParts) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -1358,24 +2247,21 @@ func (w *writer) Write(p []byte) (int, error) {
 	if len(w.parts) > 0 && int(*w.parts[len(w.parts)-1].Size) < minChunkSize {
 		completedUploadedParts := make(completedParts, len(w.parts))
 		for i, part := range w.parts {
-			completedUploadedParts[i] = &s3.CompletedPart{
-				ETag:       part.ETag,
-				PartNumber: part.PartNumber,
-			}
+			completedUploadedParts[i] = completedPart(part)
 		}
 
 		sort.Sort(completedUploadedParts)
 
-		_, err := w.driver.S3.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+		_, err := w.driver.S3.CompleteMultipartUpload(w.ctx, &s3.CompleteMultipartUploadInput{
 			Bucket:   aws.String(w.driver.Bucket),
 			Key:      aws.String(w.key),
 			UploadId: aws.String(w.uploadID),
-			MultipartUpload: &s3.CompletedMultipartUpload{
+			MultipartUpload: &types.CompletedMultipartUpload{
 				Parts: completedUploadedParts,
 			},
 		})
 		if err != nil {
-			if _, aErr := w.driver.S3.AbortMultipartUploadWithContext(w.ctx, &s3.AbortMultipartUploadInput{
+			if _, aErr := w.driver.S3.AbortMultipartUpload(w.ctx, &s3.AbortMultipartUploadInput{
 				Bucket:   aws.String(w.driver.Bucket),
 				Key:      aws.String(w.key),
 				UploadId: aws.String(w.uploadID),
@@ -1385,13 +2271,17 @@ func (w *writer) Write(p []byte) (int, error) {
 			return 0, err
 		}
 
-		resp, err := w.driver.S3.CreateMultipartUploadWithContext(w.ctx, &s3.CreateMultipartUploadInput{
+		resp, err := w.driver.S3.CreateMultipartUpload(w.ctx, &s3.CreateMultipartUploadInput{
 			Bucket:               aws.String(w.driver.Bucket),
 			Key:                  aws.String(w.key),
 			ContentType:          w.driver.getContentType(),
 			ACL:                  w.driver.getACL(),
 			ServerSideEncryption: w.driver.getEncryptionMode(),
 			StorageClass:         w.driver.getStorageClass(),
+			SSECustomerAlgorithm: w.driver.getSSECustomerAlgorithm(),
+			SSECustomerKey:       w.driver.getSSECustomerKey(),
+			Tagging:              w.driver.getTagging(w.ctx, w.key, ""),
+			ChecksumAlgorithm:    w.driver.getChecksumAlgorithm(),
 		})
 		if err != nil {
 			return 0, err
@@ -1401,9 +2291,15 @@ func (w *writer) Write(p []byte) (int, error) {
 		// If the entire written file is smaller than minChunkSize, we need to make
 		// a new part from scratch :double sad face:
 		if w.size < minChunkSize {
-			resp, err := w.driver.S3.GetObjectWithContext(w.ctx, &s3.GetObjectInput{
-				Bucket: aws.String(w.driver.Bucket),
-				Key:    aws.String(w.key),
+			var resp *s3.GetObjectOutput
+			err := w.driver.withSSECustomerKeys(func(key *string) (err error) {
+				resp, err = w.driver.S3.GetObject(w.ctx, &s3.GetObjectInput{
+					Bucket:               aws.String(w.driver.Bucket),
+					Key:                  aws.String(w.key),
+					SSECustomerAlgorithm: w.driver.getSSECustomerAlgorithm(),
+					SSECustomerKey:       key,
+				})
+				return err
 			})
 			if err != nil {
 				return 0, err
@@ -1417,20 +2313,32 @@ func (w *writer) Write(p []byte) (int, error) {
 			}
 		} else {
 			// Otherwise we can use the old file as the new first part
-			copyPartResp, err := w.driver.S3.UploadPartCopyWithContext(w.ctx, &s3.UploadPartCopyInput{
+			sourceKey, err := w.driver.sourceSSECustomerKey(w.ctx, w.key)
+			if err != nil {
+				return 0, err
+			}
+			copyPartResp, err := w.driver.S3.UploadPartCopy(w.ctx, &s3.UploadPartCopyInput{
 				Bucket:     aws.String(w.driver.Bucket),
 				CopySource: aws.String(w.driver.Bucket + "/" + w.key),
 				Key:        aws.String(w.key),
-				PartNumber: aws.Int64(1),
+				PartNumber: aws.Int32(1),
 				UploadId:   resp.UploadId,
+
+				SSECustomerAlgorithm:           w.driver.getSSECustomerAlgorithm(),
+				SSECustomerKey:                 w.driver.getSSECustomerKey(),
+				CopySourceSSECustomerAlgorithm: w.driver.getSSECustomerAlgorithm(),
+				CopySourceSSECustomerKey:       sourceKey,
 			})
 			if err != nil {
 				return 0, err
 			}
-			w.parts = []*s3.Part{{
-				ETag:       copyPartResp.CopyPartResult.ETag,
-				PartNumber: aws.Int64(1),
-				Size:       aws.Int64(w.size),
+			w.parts = []types.Part{{
+				ETag:           copyPartResp.CopyPartResult.ETag,
+				PartNumber:     aws.Int32(1),
+				Size:           aws.Int64(w.size),
+				ChecksumCRC32:  copyPartResp.CopyPartResult.ChecksumCRC32,
+				ChecksumCRC32C: copyPartResp.CopyPartResult.ChecksumCRC32C,
+				ChecksumSHA256: copyPartResp.CopyPartResult.ChecksumSHA256,
 			}}
 		}
 	}
@@ -1482,7 +2390,7 @@ func (w *writer) Cancel(ctx context.Context) error {
 	}
 
 	w.cancelled = true
-	_, err := w.driver.S3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+	_, err := w.driver.S3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
 		Bucket:   aws.String(w.driver.Bucket),
 		Key:      aws.String(w.key),
 		UploadId: aws.String(w.uploadID),
@@ -1505,10 +2413,7 @@ func (w *writer) Commit(ctx context.Context) error {
 
 	completedUploadedParts := make(completedParts, len(w.parts))
 	for i, part := range w.parts {
-		completedUploadedParts[i] = &s3.CompletedPart{
-			ETag:       part.ETag,
-			PartNumber: part.PartNumber,
-		}
+		completedUploadedParts[i] = completedPart(part)
 	}
 
 	// This is an edge case when we are trying to upload an empty file as part of
@@ -1519,34 +2424,45 @@ func (w *writer) Commit(ctx context.Context) error {
 	// Solution: we upload the empty i.e. 0 byte part as a single part and then append it
 	// to the completedUploadedParts slice used to complete the Multipart upload.
 	if len(w.parts) == 0 {
-		resp, err := w.driver.S3.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
+		sum := w.driver.checksum(nil)
+		resp, err := w.driver.S3.UploadPart(w.ctx, &s3.UploadPartInput{
 			Bucket:     aws.String(w.driver.Bucket),
 			Key:        aws.String(w.key),
-			PartNumber: aws.Int64(1),
+			PartNumber: aws.Int32(1),
 			UploadId:   aws.String(w.uploadID),
 			Body:       bytes.NewReader(nil),
+
+			SSECustomerAlgorithm: w.driver.getSSECustomerAlgorithm(),
+			SSECustomerKey:       w.driver.getSSECustomerKey(),
+			ChecksumAlgorithm:    sum.Algorithm,
+			ChecksumCRC32:        sum.CRC32,
+			ChecksumCRC32C:       sum.CRC32C,
+			ChecksumSHA256:       sum.SHA256,
 		})
 		if err != nil {
 			return err
 		}
 
-		completedUploadedParts = append(completedUploadedParts, &s3.CompletedPart{
-			ETag:       resp.ETag,
-			PartNumber: aws.Int64(1),
+		completedUploadedParts = append(completedUploadedParts, types.CompletedPart{
+			ETag:           resp.ETag,
+			PartNumber:     aws.Int32(1),
+			ChecksumCRC32:  resp.ChecksumCRC32,
+			ChecksumCRC32C: resp.ChecksumCRC32C,
+			ChecksumSHA256: resp.ChecksumSHA256,
 		})
 	}
 
 	sort.Sort(completedUploadedParts)
 
-	if _, err := w.driver.S3.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+	if _, err := w.driver.S3.CompleteMultipartUpload(w.ctx, &s3.CompleteMultipartUploadInput{
 		Bucket:   aws.String(w.driver.Bucket),
 		Key:      aws.String(w.key),
 		UploadId: aws.String(w.uploadID),
-		MultipartUpload: &s3.CompletedMultipartUpload{
+		MultipartUpload: &types.CompletedMultipartUpload{
 			Parts: completedUploadedParts,
 		},
 	}); err != nil {
-		if _, aErr := w.driver.S3.AbortMultipartUploadWithContext(w.ctx, &s3.AbortMultipartUploadInput{
+		if _, aErr := w.driver.S3.AbortMultipartUpload(w.ctx, &s3.AbortMultipartUploadInput{
 			Bucket:   aws.String(w.driver.Bucket),
 			Key:      aws.String(w.key),
 			UploadId: aws.String(w.uploadID),
@@ -1566,26 +2482,37 @@ func (w *writer) flush() error {
 		return nil
 	}
 
-	r := bytes.NewReader(w.buf.Next(w.driver.ChunkSize))
+	data := w.buf.Next(w.driver.ChunkSize)
+	sum := w.driver.checksum(data)
 
-	partSize := r.Len()
-	partNumber := aws.Int64(int64(len(w.parts)) + 1)
+	partSize := len(data)
+	partNumber := aws.Int32(int32(len(w.parts)) + 1)
 
-	resp, err := w.driver.S3.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
+	resp, err := w.driver.S3.UploadPart(w.ctx, &s3.UploadPartInput{
 		Bucket:     aws.String(w.driver.Bucket),
 		Key:        aws.String(w.key),
 		PartNumber: partNumber,
 		UploadId:   aws.String(w.uploadID),
-		Body:       r,
+		Body:       bytes.NewReader(data),
+
+		SSECustomerAlgorithm: w.driver.getSSECustomerAlgorithm(),
+		SSECustomerKey:       w.driver.getSSECustomerKey(),
+		ChecksumAlgorithm:    sum.Algorithm,
+		ChecksumCRC32:        sum.CRC32,
+		ChecksumCRC32C:       sum.CRC32C,
+		ChecksumSHA256:       sum.SHA256,
 	})
 	if err != nil {
-		return fmt.Errorf("upload part: %w", err)
+		return fmt.Errorf("upload part: %w", parseError(w.key, err))
 	}
 
-	w.parts = append(w.parts, &s3.Part{
-		ETag:       resp.ETag,
-		PartNumber: partNumber,
-		Size:       aws.Int64(int64(partSize)),
+	w.parts = append(w.parts, types.Part{
+		ETag:           resp.ETag,
+		PartNumber:     partNumber,
+		Size:           aws.Int64(int64(partSize)),
+		ChecksumCRC32:  resp.ChecksumCRC32,
+		ChecksumCRC32C: resp.ChecksumCRC32C,
+		ChecksumSHA256: resp.ChecksumSHA256,
 	})
 
 	w.size += int64(partSize)
@@ -3,20 +3,30 @@ package s3
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
@@ -102,7 +112,7 @@ func init() {
 		}
 
 		if objectACL == "" {
-			objectACL = s3.ObjectCannedACLPrivate
+			objectACL = string(types.ObjectCannedACLPrivate)
 		}
 
 		parameters := DriverParameters{
@@ -148,7 +158,7 @@ func newDriverConstructor(tb testing.TB) testsuites.DriverConstructor {
 	root := tb.TempDir()
 
 	return func() (storagedriver.StorageDriver, error) {
-		return s3DriverConstructor(root, s3.StorageClassStandard)
+		return s3DriverConstructor(root, string(types.StorageClassStandard))
 	}
 }
 
@@ -166,17 +176,17 @@ func TestEmptyRootList(t *testing.T) {
 	skipCheck(t)
 
 	validRoot := t.TempDir()
-	rootedDriver, err := s3DriverConstructor(validRoot, s3.StorageClassStandard)
+	rootedDriver, err := s3DriverConstructor(validRoot, string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating rooted driver: %v", err)
 	}
 
-	emptyRootDriver, err := s3DriverConstructor("", s3.StorageClassStandard)
+	emptyRootDriver, err := s3DriverConstructor("", string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating empty root driver: %v", err)
 	}
 
-	slashRootDriver, err := s3DriverConstructor("/", s3.StorageClassStandard)
+	slashRootDriver, err := s3DriverConstructor("/", string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating slash root driver: %v", err)
 	}
@@ -232,11 +242,12 @@ func TestClientTransport(t *testing.T) {
 			}
 
 			s3drv := drv.baseEmbed.Base.StorageDriver.(*driver)
+			client, ok := s3drv.S3.Options().HTTPClient.(*awshttp.BuildableClient)
+			if !ok {
+				t.Fatal("unexpected driver HTTP client")
+			}
+			tr := client.GetTransport()
 			if tc.skipverify {
-				tr, ok := s3drv.S3.Client.Config.HTTPClient.Transport.(*http.Transport)
-				if !ok {
-					t.Fatal("unexpected driver transport")
-				}
 				if !tr.TLSClientConfig.InsecureSkipVerify {
 					t.Errorf("unexpected TLS Config. Expected InsecureSkipVerify: %v, got %v",
 						tc.skipverify,
@@ -248,15 +259,156 @@ func TestClientTransport(t *testing.T) {
 				}
 				return
 			}
-			// if tc.skipverify is false we do not override the driver
-			// HTTP client transport and leave it to the AWS SDK.
-			if s3drv.S3.Client.Config.HTTPClient.Transport != nil {
+			// if tc.skipverify is false we do not override the TLS
+			// configuration of the transport and leave it to the AWS SDK.
+			if tr.TLSClientConfig != nil && tr.TLSClientConfig.InsecureSkipVerify {
 				t.Errorf("unexpected S3 driver client transport")
 			}
 		})
 	}
 }
 
+func TestValidRegion(t *testing.T) {
+	for region, valid := range map[string]bool{
+		"us-east-1":      true,
+		"eu-central-2":   true,
+		"cn-north-1":     true,
+		"us-gov-west-1":  true,
+		"":               false,
+		"not a region":   false,
+		"us-east-1/evil": false,
+	} {
+		if validRegion(region) != valid {
+			t.Errorf("validRegion(%q) != %v", region, valid)
+		}
+	}
+}
+
+func TestRoleCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mu      sync.Mutex
+		assumed []url.Values
+	)
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse STS request: %v", err)
+		}
+		mu.Lock()
+		assumed = append(assumed, r.PostForm)
+		n := len(assumed)
+		mu.Unlock()
+
+		action := r.PostForm.Get("Action")
+		// the credentials expire immediately, to be refreshed on each use
+		fmt.Fprintf(w, `<%[1]sResponse><%[1]sResult><Credentials>
+<AccessKeyId>roleaccesskey%[2]d</AccessKeyId>
+<SecretAccessKey>rolesecretkey</SecretAccessKey>
+<SessionToken>rolesessiontoken</SessionToken>
+<Expiration>%[3]s</Expiration>
+</Credentials></%[1]sResult></%[1]sResponse>`, action, n, time.Now().UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("webidentitytoken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params map[string]interface{}
+		expect url.Values
+	}{
+		{
+			name: "AssumeRole",
+			params: map[string]interface{}{
+				"accesskey":  "accesskey",
+				"secretkey":  "secretkey",
+				"externalid": "externalid",
+			},
+			expect: url.Values{
+				"Action":          {"AssumeRole"},
+				"RoleArn":         {"arn:aws:iam::123456789012:role/registry"},
+				"RoleSessionName": {defaultRoleSessionName},
+				"ExternalId":      {"externalid"},
+			},
+		},
+		{
+			name: "AssumeRoleWithWebIdentity",
+			params: map[string]interface{}{
+				"webidentitytokenfile": tokenFile,
+				"rolesessionname":      "registry",
+			},
+			expect: url.Values{
+				"Action":           {"AssumeRoleWithWebIdentity"},
+				"RoleArn":          {"arn:aws:iam::123456789012:role/registry"},
+				"RoleSessionName":  {"registry"},
+				"WebIdentityToken": {"webidentitytoken"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assumed = nil
+			parameters := map[string]interface{}{
+				"region":         "us-east-1",
+				"regionendpoint": "http://storage.example.com",
+				"bucket":         "registry",
+				"rolearn":        "arn:aws:iam::123456789012:role/registry",
+				"stsendpoint":    sts.URL,
+			}
+			for k, v := range tc.params {
+				parameters[k] = v
+			}
+			drv, err := FromParameters(ctx, parameters)
+			if err != nil {
+				t.Fatalf("failed to create driver: %v", err)
+			}
+			s3drv := drv.baseEmbed.Base.StorageDriver.(*driver)
+
+			for i := 1; i <= 2; i++ {
+				creds, err := s3drv.S3.Options().Credentials.Retrieve(ctx)
+				if err != nil {
+					t.Fatalf("unexpected error getting credentials: %v", err)
+				}
+				if creds.AccessKeyID != fmt.Sprintf("roleaccesskey%d", i) || creds.SessionToken != "rolesessiontoken" {
+					t.Errorf("unexpected credentials %q, expected the credentials of the role", creds.AccessKeyID)
+				}
+			}
+			if len(assumed) != 2 {
+				t.Fatalf("expected the expired credentials to be refreshed, the role was assumed %d times", len(assumed))
+			}
+			for k, v := range tc.expect {
+				if got := assumed[0][k]; !slices.Equal(got, v) {
+					t.Errorf("unexpected %s %v, expected %v", k, got, v)
+				}
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"externalid": "externalid"}, "the externalid parameter requires the rolearn parameter"},
+		{map[string]interface{}{"webidentitytokenfile": tokenFile}, "the webidentitytokenfile parameter requires the rolearn parameter"},
+		{map[string]interface{}{"rolearn": "arn:aws:iam::123456789012:role/registry", "externalid": "externalid", "webidentitytokenfile": tokenFile}, "the externalid parameter cannot be used with the webidentitytokenfile parameter"},
+	} {
+		parameters := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": "http://storage.example.com",
+			"bucket":         "registry",
+		}
+		for k, v := range tc.params {
+			parameters[k] = v
+		}
+		if _, err := FromParameters(ctx, parameters); err == nil || err.Error() != tc.err {
+			t.Errorf("%v: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+}
+
 func TestStorageClass(t *testing.T) {
 	skipCheck(t)
 
@@ -274,7 +426,7 @@ func TestStorageClass(t *testing.T) {
 		}
 
 		// Can only test outposts if using s3 outposts
-		if storageClass == s3.StorageClassOutposts {
+		if storageClass == string(types.StorageClassOutposts) {
 			continue
 		}
 
@@ -286,7 +438,7 @@ func TestStorageClass(t *testing.T) {
 		defer s3Driver.Delete(ctx, filename)
 
 		driverUnwrapped := s3Driver.Base.StorageDriver.(*driver)
-		resp, err := driverUnwrapped.S3.GetObject(&s3.GetObjectInput{
+		resp, err := driverUnwrapped.S3.GetObject(ctx, &s3.GetObjectInput{
 			Bucket: aws.String(driverUnwrapped.Bucket),
 			Key:    aws.String(driverUnwrapped.s3Path(filename)),
 		})
@@ -297,23 +449,23 @@ func TestStorageClass(t *testing.T) {
 		// Amazon only populates this header value for non-standard storage classes
 		if storageClass == noStorageClass {
 			// We haven't specified a storage class so we can't confirm what it is
-		} else if storageClass == s3.StorageClassStandard && resp.StorageClass != nil {
+		} else if storageClass == string(types.StorageClassStandard) && resp.StorageClass != "" {
 			t.Fatalf(
 				"unexpected response storage class for file with storage class %v: %v",
 				storageClass,
-				*resp.StorageClass,
+				resp.StorageClass,
 			)
-		} else if storageClass != s3.StorageClassStandard && resp.StorageClass == nil {
+		} else if storageClass != string(types.StorageClassStandard) && resp.StorageClass == "" {
 			t.Fatalf(
 				"unexpected response storage class for file with storage class %v: %v",
 				storageClass,
-				s3.StorageClassStandard,
+				types.StorageClassStandard,
 			)
-		} else if storageClass != s3.StorageClassStandard && storageClass != *resp.StorageClass {
+		} else if storageClass != string(types.StorageClassStandard) && storageClass != string(resp.StorageClass) {
 			t.Fatalf(
 				"unexpected response storage class for file with storage class %v: %v",
 				storageClass,
-				*resp.StorageClass,
+				resp.StorageClass,
 			)
 		}
 	}
@@ -324,7 +476,7 @@ func TestDelete(t *testing.T) {
 
 	rootDir := t.TempDir()
 
-	drvr, err := s3DriverConstructor(rootDir, s3.StorageClassStandard)
+	drvr, err := s3DriverConstructor(rootDir, string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating driver with standard storage: %v", err)
 	}
@@ -518,12 +670,100 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteFiles(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+	d, err := FromParameters(ctx, map[string]interface{}{
+		"region":         "us-east-1",
+		"regionendpoint": s.URL,
+		"forcepathstyle": true,
+		"skipverify":     true,
+		"bucket":         "registry",
+		"accesskey":      "accesskey",
+		"secretkey":      "secretkey",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	paths := []string{"/notfound"}
+	for i := 0; i < listMax+10; i++ {
+		key := fmt.Sprintf("blobs/%04d/data", i)
+		s.objects[key] = &testS3Object{data: []byte("contents")}
+		paths = append(paths, "/"+key)
+	}
+	s.objects["blobs/kept/data"] = &testS3Object{data: []byte("contents")}
+
+	if err := storagedriver.DeleteFiles(ctx, d, paths); err != nil {
+		t.Fatalf("unexpected error deleting files: %v", err)
+	}
+	if s.deleteRequests != 2 {
+		t.Errorf("deleted the files with %d requests, expected 2", s.deleteRequests)
+	}
+	if len(s.objects) != 1 || s.objects["blobs/kept/data"] == nil {
+		t.Errorf("unexpected objects left after deleting files: %v", s.objects)
+	}
+
+	if err := d.DeleteFiles(ctx, []string{"/invalid path"}); !errors.As(err, &storagedriver.InvalidPathError{}) {
+		t.Errorf("expected an invalid path error, got %v", err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+	newDriver := func(url, rootDirectory string) *Driver {
+		d, err := FromParameters(ctx, map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": url,
+			"forcepathstyle": true,
+			"skipverify":     true,
+			"bucket":         "registry",
+			"rootdirectory":  rootDirectory,
+			"accesskey":      "accesskey",
+			"secretkey":      "secretkey",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error creating driver: %v", err)
+		}
+		return d
+	}
+	source, dest := newDriver(s.URL, "/source"), newDriver(s.URL, "/dest")
+
+	contents := []byte("contents")
+	if err := source.PutContent(ctx, "/blob", contents); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	if err := storagedriver.Transfer(ctx, source, "/blob", dest, "/copy"); err != nil {
+		t.Fatalf("unexpected error transferring: %v", err)
+	}
+	if o := s.objects["dest/copy"]; o == nil || !bytes.Equal(o.data, contents) {
+		t.Fatalf("unexpected transferred object %+v", o)
+	}
+	if _, ok := s.objects["source/blob"]; !ok {
+		t.Error("expected the source of the transfer to be kept")
+	}
+
+	// the content is streamed between drivers which cannot copy server-side
+	other := newTestS3(t)
+	err := dest.Transfer(ctx, newDriver(other.URL, "/source"), "/blob", "/copy")
+	if !errors.As(err, &storagedriver.ErrUnsupportedMethod{}) {
+		t.Errorf("expected an unsupported method error transferring from another endpoint, got %v", err)
+	}
+	if err := storagedriver.Transfer(ctx, source, "/blob", newDriver(other.URL, "/dest"), "/copy"); err != nil {
+		t.Fatalf("unexpected error transferring to another endpoint: %v", err)
+	}
+	if o := other.objects["dest/copy"]; o == nil || !bytes.Equal(o.data, contents) {
+		t.Fatalf("unexpected object transferred to another endpoint %+v", o)
+	}
+}
+
 func TestWalkEmptyUploadsDir(t *testing.T) {
 	skipCheck(t)
 
 	ctx := dcontext.Background()
 
-	drvr, err := s3DriverConstructor("s3walktest", s3.StorageClassStandard)
+	drvr, err := s3DriverConstructor("s3walktest", string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating driver with standard storage: %v", err)
 	}
@@ -544,7 +784,7 @@ func TestWalkEmptyUploadsDir(t *testing.T) {
 	created := make([]string, 0, len(fileset))
 	d := drvr.baseEmbed.Base.StorageDriver.(*driver)
 	for _, p := range fileset {
-		_, err := d.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		_, err := d.S3.PutObject(ctx, &s3.PutObjectInput{
 			Bucket:               aws.String(d.Bucket),
 			Key:                  aws.String(d.s3Path(p)),
 			ContentType:          d.getContentType(),
@@ -564,21 +804,21 @@ func TestWalkEmptyUploadsDir(t *testing.T) {
 	// use a custom cleanup here because we create an empty dir during this test's
 	// setup, and the regular driver.Delete will error when trying to delete it.
 	defer func() {
-		s3Objects := make([]*s3.ObjectIdentifier, 0, len(fileset))
+		s3Objects := make([]types.ObjectIdentifier, 0, len(fileset))
 		for _, p := range created {
-			s3Objects = append(s3Objects, &s3.ObjectIdentifier{
+			s3Objects = append(s3Objects, types.ObjectIdentifier{
 				Key: aws.String(d.s3Path(p)),
 			})
 		}
-		resp, err := d.S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		resp, err := d.S3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
 			Bucket: aws.String(d.Bucket),
-			Delete: &s3.Delete{
+			Delete: &types.Delete{
 				Objects: s3Objects,
 				Quiet:   aws.Bool(false),
 			},
 		})
 		if err != nil {
-			t.Logf("DeleteObjectsWithContext resp: %+v", resp)
+			t.Logf("DeleteObjects resp: %+v", resp)
 			t.Fatalf("cleanup failed: %s", err)
 		}
 	}()
@@ -603,7 +843,7 @@ func TestWalk(t *testing.T) {
 
 	rootDir := t.TempDir()
 
-	drvr, err := s3DriverConstructor(rootDir, s3.StorageClassStandard)
+	drvr, err := s3DriverConstructor(rootDir, string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating driver with standard storage: %v", err)
 	}
@@ -841,7 +1081,7 @@ func TestOverThousandBlobs(t *testing.T) {
 	skipCheck(t)
 
 	rootDir := t.TempDir()
-	standardDriver, err := s3DriverConstructor(rootDir, s3.StorageClassStandard)
+	standardDriver, err := s3DriverConstructor(rootDir, string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating driver with standard storage: %v", err)
 	}
@@ -867,7 +1107,7 @@ func TestMoveWithMultipartCopy(t *testing.T) {
 	skipCheck(t)
 
 	rootDir := t.TempDir()
-	d, err := s3DriverConstructor(rootDir, s3.StorageClassStandard)
+	d, err := s3DriverConstructor(rootDir, string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating driver: %v", err)
 	}
@@ -918,7 +1158,7 @@ func TestListObjectsV2(t *testing.T) {
 	skipCheck(t)
 
 	rootDir := t.TempDir()
-	d, err := s3DriverConstructor(rootDir, s3.StorageClassStandard)
+	d, err := s3DriverConstructor(rootDir, string(types.StorageClassStandard))
 	if err != nil {
 		t.Fatalf("unexpected error creating driver: %v", err)
 	}
@@ -1002,3 +1242,382 @@ func compareWalked(t *testing.T, expected, walked []string) {
 		}
 	}
 }
+
+func TestSSECustomerKey(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+
+	keys := make([]string, 2)
+	keyMD5s := make([]string, 2)
+	for i := range keys {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = base64.StdEncoding.EncodeToString(key)
+		sum := md5.Sum(key)
+		keyMD5s[i] = base64.StdEncoding.EncodeToString(sum[:])
+	}
+	newDriver := func(params map[string]interface{}) (*Driver, error) {
+		parameters := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": s.URL,
+			"forcepathstyle": true,
+			"skipverify":     true,
+			"bucket":         "registry",
+			"accesskey":      "accesskey",
+			"secretkey":      "secretkey",
+			"rootdirectory":  "/registry",
+		}
+		for k, v := range params {
+			parameters[k] = v
+		}
+		return FromParameters(ctx, parameters)
+	}
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"ssecustomerkey": "c2hvcnQ="}, "the ssecustomerkey parameter must be a base64 encoded 256-bit key"},
+		{map[string]interface{}{"ssecustomerkey": keys[0], "encrypt": true}, "the ssecustomerkey parameter cannot be used with the encrypt parameter"},
+		{map[string]interface{}{"ssecustomerpreviouskeys": keys[0]}, "the ssecustomerpreviouskeys parameter requires the ssecustomerkey parameter"},
+		{map[string]interface{}{"ssecustomerkey": keys[1], "ssecustomerpreviouskeys": []interface{}{"invalid"}}, "the ssecustomerpreviouskeys parameter must be a base64 encoded 256-bit key"},
+	} {
+		if _, err := newDriver(tc.params); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.params, tc.err, err)
+		}
+	}
+
+	d, err := newDriver(map[string]interface{}{"ssecustomerkey": keys[0]})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	contents := []byte("contents")
+	if err := d.PutContent(ctx, "/content", contents); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	w, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	for _, key := range []string{"registry/content", "registry/upload"} {
+		if s.objects[key].keyMD5 != keyMD5s[0] {
+			t.Errorf("expected %s to be encrypted with the customer key", key)
+		}
+	}
+	if url, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, "/", nil), "/content"); err != nil || url != "" {
+		t.Errorf("expected no redirect, got %q: %v", url, err)
+	}
+
+	// after rotating the key, objects encrypted with the previous key are
+	// still readable, and moved objects are encrypted with the new key
+	rotated, err := newDriver(map[string]interface{}{"ssecustomerkey": keys[1], "ssecustomerpreviouskeys": []interface{}{keys[0]}})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	if received, err := rotated.GetContent(ctx, "/content"); err != nil || !bytes.Equal(received, contents) {
+		t.Fatalf("unexpected content %q: %v", received, err)
+	}
+	if fi, err := rotated.Stat(ctx, "/content"); err != nil || fi.Size() != int64(len(contents)) {
+		t.Fatalf("unexpected stat %v: %v", fi, err)
+	}
+	if err := rotated.Move(ctx, "/upload", "/moved"); err != nil {
+		t.Fatalf("unexpected error moving: %v", err)
+	}
+	if s.objects["registry/moved"].keyMD5 != keyMD5s[1] {
+		t.Error("expected the moved object to be encrypted with the new customer key")
+	}
+
+	withoutPrevious, err := newDriver(map[string]interface{}{"ssecustomerkey": keys[1]})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	if _, err := withoutPrevious.GetContent(ctx, "/content"); err == nil {
+		t.Fatal("expected an error reading content encrypted with another key")
+	}
+	if received, err := withoutPrevious.GetContent(ctx, "/moved"); err != nil || !bytes.Equal(received, contents) {
+		t.Fatalf("unexpected content %q: %v", received, err)
+	}
+}
+
+func TestRequesterPays(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+	s.requesterPays = true
+
+	newDriver := func(requesterPays interface{}) (*Driver, error) {
+		return FromParameters(ctx, map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": s.URL,
+			"forcepathstyle": true,
+			"skipverify":     true,
+			"bucket":         "registry",
+			"accesskey":      "accesskey",
+			"secretkey":      "secretkey",
+			"rootdirectory":  "/registry",
+			"requesterpays":  requesterPays,
+		})
+	}
+
+	if _, err := newDriver("sometimes"); err == nil || err.Error() != "the requesterPays parameter should be a boolean" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	d, err := newDriver(false)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	if err := d.PutContent(ctx, "/content", []byte("contents")); err == nil {
+		t.Fatal("expected requests without the request payer to be denied")
+	}
+
+	d, err = newDriver("true")
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	contents := []byte("contents")
+	if err := d.PutContent(ctx, "/content", contents); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	w, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if err := d.Move(ctx, "/upload", "/moved"); err != nil {
+		t.Fatalf("unexpected error moving: %v", err)
+	}
+	if received, err := d.GetContent(ctx, "/moved"); err != nil || !bytes.Equal(received, contents) {
+		t.Fatalf("unexpected content %q: %v", received, err)
+	}
+	if children, err := d.List(ctx, "/"); err != nil || len(children) != 2 {
+		t.Fatalf("unexpected children %v: %v", children, err)
+	}
+	if err := d.Delete(ctx, "/moved"); err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+
+	// presigned URLs carry the request payer in their query, as clients do
+	// not send the headers they were signed with
+	redirect, err := d.RedirectURL(httptest.NewRequest(http.MethodGet, "/", nil), "/content")
+	if err != nil {
+		t.Fatalf("unexpected error getting redirect URL: %v", err)
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatalf("unexpected error parsing redirect URL: %v", err)
+	}
+	if u.Query().Get("x-amz-request-payer") != "requester" || strings.Contains(u.Query().Get("X-Amz-SignedHeaders"), "x-amz-request-payer") {
+		t.Errorf("unexpected redirect URL %s", redirect)
+	}
+}
+
+func TestObjectTagging(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+
+	newDriver := func(params map[string]interface{}) *Driver {
+		parameters := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": s.URL,
+			"forcepathstyle": true,
+			"skipverify":     true,
+			"bucket":         "registry",
+			"accesskey":      "accesskey",
+			"secretkey":      "secretkey",
+			"rootdirectory":  "/registry",
+		}
+		for k, v := range params {
+			parameters[k] = v
+		}
+		d, err := FromParameters(ctx, parameters)
+		if err != nil {
+			t.Fatalf("unexpected error creating driver: %v", err)
+		}
+		return d
+	}
+	tags := func(key string) url.Values {
+		obj, ok := s.objects["registry"+key]
+		if !ok {
+			t.Fatalf("missing object %s", key)
+		}
+		tags, err := url.ParseQuery(obj.tagging)
+		if err != nil {
+			t.Fatalf("unexpected tagging %q of %s: %v", obj.tagging, key, err)
+		}
+		return tags
+	}
+
+	const (
+		uploadPath = "/docker/registry/v2/repositories/library/ubuntu/_uploads/a5d3f1b0/data"
+		blobHex    = "4bf6a0b1c8d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8"
+		blobPath   = "/docker/registry/v2/blobs/sha256/4b/" + blobHex + "/data"
+	)
+	contents := []byte("contents")
+
+	// uploads are tagged with the repository of their path, and the blobs
+	// they are moved to, with a multipart copy, with their digest and the
+	// repository and content type of the request
+	d := newDriver(map[string]interface{}{"objecttagging": true, "multipartcopythresholdsize": 0})
+	w, err := d.Writer(ctx, uploadPath, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if got := tags(uploadPath); !reflect.DeepEqual(got, url.Values{"repository": {"library/ubuntu"}}) {
+		t.Errorf("unexpected tags of the upload %v", got)
+	}
+
+	requestCtx := dcontext.WithValues(ctx, map[string]interface{}{
+		"vars.name":                "library/debian",
+		"http.request.contenttype": "application/octet-stream",
+	})
+	if err := d.Move(requestCtx, uploadPath, blobPath); err != nil {
+		t.Fatalf("unexpected error moving: %v", err)
+	}
+	expected := url.Values{
+		"repository":  {"library/debian"},
+		"digest":      {"sha256:" + blobHex},
+		"contenttype": {"application/octet-stream"},
+	}
+	if got := tags(blobPath); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected tags of the blob %v, expected %v", got, expected)
+	}
+
+	// content types are tagged without their parameters
+	manifestCtx := dcontext.WithValues(ctx, map[string]interface{}{
+		"vars.name":                "library/ubuntu",
+		"http.request.contenttype": "application/vnd.oci.image.manifest.v1+json; charset=utf-8",
+	})
+	if err := d.PutContent(manifestCtx, blobPath, contents); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	expected = url.Values{
+		"repository":  {"library/ubuntu"},
+		"digest":      {"sha256:" + blobHex},
+		"contenttype": {"application/vnd.oci.image.manifest.v1+json"},
+	}
+	if got := tags(blobPath); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected tags of the manifest %v, expected %v", got, expected)
+	}
+
+	// the tags of objects moved with a single copy are replaced, the
+	// repository being taken from the source path without a request
+	d = newDriver(map[string]interface{}{"objecttagging": "true"})
+	if err := d.PutContent(ctx, uploadPath, contents); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	if err := d.Move(ctx, uploadPath, blobPath); err != nil {
+		t.Fatalf("unexpected error moving: %v", err)
+	}
+	expected = url.Values{
+		"repository": {"library/ubuntu"},
+		"digest":     {"sha256:" + blobHex},
+	}
+	if got := tags(blobPath); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected tags of the blob %v, expected %v", got, expected)
+	}
+
+	d = newDriver(nil)
+	if err := d.PutContent(requestCtx, blobPath, contents); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	if tagging := s.objects["registry"+blobPath].tagging; tagging != "" {
+		t.Errorf("unexpected tags %q, expected objects not to be tagged by default", tagging)
+	}
+}
+
+func TestChecksumAlgorithm(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3(t)
+
+	newDriver := func(checksumAlgorithm interface{}) (*Driver, error) {
+		return FromParameters(ctx, map[string]interface{}{
+			"region":            "us-east-1",
+			"regionendpoint":    s.URL,
+			"forcepathstyle":    true,
+			"skipverify":        true,
+			"bucket":            "registry",
+			"accesskey":         "accesskey",
+			"secretkey":         "secretkey",
+			"rootdirectory":     "/registry",
+			"chunksize":         minChunkSize,
+			"checksumalgorithm": checksumAlgorithm,
+		})
+	}
+
+	if _, err := newDriver("MD5"); err == nil || err.Error() != "the checksumalgorithm parameter must be one of [CRC32 CRC32C SHA256], MD5 invalid" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	contents := make([]byte, minChunkSize+1024)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, algorithm := range []string{"crc32", "CRC32C", "SHA256"} {
+		t.Run(algorithm, func(t *testing.T) {
+			s.corrupt = false
+			s.checksums = 0
+
+			d, err := newDriver(algorithm)
+			if err != nil {
+				t.Fatalf("unexpected error creating driver: %v", err)
+			}
+			if err := d.PutContent(ctx, "/content", contents[:1024]); err != nil {
+				t.Fatalf("unexpected error putting content: %v", err)
+			}
+			// the upload is completed with the checksums of its parts
+			w, err := d.Writer(ctx, "/upload", false)
+			if err != nil {
+				t.Fatalf("unexpected error creating writer: %v", err)
+			}
+			if _, err := w.Write(contents); err != nil {
+				t.Fatalf("unexpected error writing: %v", err)
+			}
+			if err := w.Commit(ctx); err != nil {
+				t.Fatalf("unexpected error committing: %v", err)
+			}
+			if received, err := d.GetContent(ctx, "/upload"); err != nil || !bytes.Equal(received, contents) {
+				t.Fatalf("unexpected content: %v", err)
+			}
+			if s.checksums != 3 {
+				t.Errorf("expected all the uploads to be verified with a checksum, %d were", s.checksums)
+			}
+
+			// corrupted content is rejected as checksum mismatches
+			s.corrupt = true
+			var checksumErr storagedriver.ChecksumMismatchError
+			if err := d.PutContent(ctx, "/content", contents[:1024]); !errors.As(err, &checksumErr) {
+				t.Errorf("unexpected error putting corrupted content %v, expected a checksum mismatch", err)
+			}
+			w, err = d.Writer(ctx, "/upload", false)
+			if err != nil {
+				t.Fatalf("unexpected error creating writer: %v", err)
+			}
+			if _, err := w.Write(contents[:1024]); err != nil {
+				t.Fatalf("unexpected error writing: %v", err)
+			}
+			if err := w.Commit(ctx); !errors.As(err, &checksumErr) {
+				t.Errorf("unexpected error committing corrupted content %v, expected a checksum mismatch", err)
+			}
+		})
+	}
+}
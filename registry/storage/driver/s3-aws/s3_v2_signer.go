@@ -23,19 +23,19 @@ package s3
 // THE SOFTWARE.
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/corehandlers"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -43,7 +43,7 @@ type signer struct {
 	// Values that must be populated from the request
 	Request      *http.Request
 	Time         time.Time
-	Credentials  *credentials.Credentials
+	Credentials  aws.Credentials
 	Query        url.Values
 	stringToSign string
 	signature    string
@@ -73,50 +73,55 @@ var s3ParamsToSign = map[string]bool{
 	"delete":                       true,
 }
 
-// setv2Handlers will setup v2 signature signing on the S3 driver
-func setv2Handlers(svc *s3.S3) {
-	svc.Handlers.Build.PushBack(func(r *request.Request) {
-		parsedURL, err := url.Parse(r.HTTPRequest.URL.String())
-		if err != nil {
-			log.Fatalf("Failed to parse URL: %v", err)
-		}
-		r.HTTPRequest.URL.Opaque = parsedURL.Path
-	})
+// v2Signer signs requests with signature version 2 in place of the
+// signature version 4 signer of the S3 client.
+type v2Signer struct{}
 
-	svc.Handlers.Sign.Clear()
-	svc.Handlers.Sign.PushBack(Sign)
-	svc.Handlers.Sign.PushBackNamed(corehandlers.BuildContentLengthHandler)
+// SignHTTP signs r with signature version 2.
+func (v2Signer) SignHTTP(ctx context.Context, credentials aws.Credentials, r *http.Request, payloadHash, service, region string, signingTime time.Time, optFns ...func(*v4.SignerOptions)) error {
+	v2 := signer{
+		Request:     r,
+		Time:        signingTime,
+		Credentials: credentials,
+	}
+	return v2.Sign()
 }
 
-// Sign requests with signature version 2.
-//
-// Will sign the requests with the service config's Credentials object
-// Signing is skipped if the credentials is the credentials.AnonymousCredentials
-// object.
-func Sign(req *request.Request) {
-	// If the request does not need to be signed ignore the signing of the
-	// request if the AnonymousCredentials object is used.
-	if req.Config.Credentials == credentials.AnonymousCredentials {
-		return
+// PresignHTTP returns the URL of r presigned with signature version 2, which
+// expires when the presigned URL of signature version 4 would.
+func (v2Signer) PresignHTTP(ctx context.Context, credentials aws.Credentials, r *http.Request, payloadHash, service, region string, signingTime time.Time, optFns ...func(*v4.SignerOptions)) (string, http.Header, error) {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil {
+		return "", nil, err
+	}
+	query.Del("X-Amz-Expires")
+	query.Set("Expires", strconv.FormatInt(signingTime.Unix()+expires, 10))
+
+	// the clients of presigned URLs send none of the headers of r
+	r = r.Clone(ctx)
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			r.Header.Del(name)
+		}
 	}
 
 	v2 := signer{
-		Request:     req.HTTPRequest,
-		Time:        req.Time,
-		Credentials: req.Config.Credentials,
+		Request:     r,
+		Time:        signingTime,
+		Credentials: credentials,
+		Query:       query,
 	}
-	// TODO(milosgajdos): figure this out; if Sign returns error which we should check,
-	// we should modify the codepath related to svc.Handlers.Sign.PushBack etc.
-	// nolint:errcheck
-	v2.Sign()
+	if err := v2.Sign(); err != nil {
+		return "", nil, err
+	}
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.String(), http.Header{}, nil
 }
 
 func (v2 *signer) Sign() error {
-	credValue, err := v2.Credentials.Get()
-	if err != nil {
-		return err
-	}
-	accessKey := credValue.AccessKeyID
+	accessKey := v2.Credentials.AccessKeyID
 	var (
 		md5, ctype, date, xamz string
 		xamzDate               bool
@@ -126,16 +131,23 @@ func (v2 *signer) Sign() error {
 	)
 
 	headers := v2.Request.Header
-	params := v2.Request.URL.Query()
+	params := v2.Query
+	if params == nil {
+		params = v2.Request.URL.Query()
+	}
 	parsedURL, err := url.Parse(v2.Request.URL.String())
 	if err != nil {
 		return err
 	}
-	host, canonicalPath := parsedURL.Host, parsedURL.Path
+	host, canonicalPath := parsedURL.Host, parsedURL.EscapedPath()
 	v2.Request.Header["Host"] = []string{host}
 	v2.Request.Header["date"] = []string{v2.Time.In(time.UTC).Format(time.RFC1123)}
-	if credValue.SessionToken != "" {
-		v2.Request.Header["x-amz-security-token"] = []string{credValue.SessionToken}
+	if v2.Credentials.SessionToken != "" {
+		if v2.Query != nil {
+			params.Set("x-amz-security-token", v2.Credentials.SessionToken)
+		} else {
+			v2.Request.Header["x-amz-security-token"] = []string{v2.Credentials.SessionToken}
+		}
 	}
 
 	smap = make(map[string]string)
@@ -201,7 +213,7 @@ func (v2 *signer) Sign() error {
 		date,
 		xamz + canonicalPath,
 	}, "\n")
-	hash := hmac.New(sha1.New, []byte(credValue.SecretAccessKey))
+	hash := hmac.New(sha1.New, []byte(v2.Credentials.SecretAccessKey))
 	hash.Write([]byte(v2.stringToSign))
 	v2.signature = base64.StdEncoding.EncodeToString(hash.Sum(nil))
 
@@ -0,0 +1,768 @@
+// Package sftp provides a storagedriver.StorageDriver implementation to
+// store blobs on a remote host, over the SFTP protocol of SSH.
+//
+// The driver keeps a pool of SSH connections, each of which carries an SFTP
+// session of github.com/pkg/sftp, whose requests are pipelined. Sessions are
+// dialed on demand, and dialed again once they fail.
+//
+// Writers resume writing on another session when theirs fails, rewriting
+// the data they had not flushed yet at the same offset. Content written by
+// non appending writers is written to a temporary file, which is renamed
+// into place once the writer is closed, so that readers never see partial
+// content.
+package sftp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	gosftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	driverName = "sftp"
+
+	defaultPort           = 22
+	defaultMaxConnections = 4
+	defaultMaxConcurrency = 50
+	minConcurrency        = 25
+	dialTimeout           = 30 * time.Second
+
+	// writeBufferSize is the size of the data buffered by writers before
+	// it is written to the server.
+	writeBufferSize = 1024 * 1024
+
+	// tempFileSuffix marks the temporary files content is written to
+	// before being renamed into place.
+	tempFileSuffix = ".tmp"
+
+	posixRenameExtension = "posix-rename@openssh.com"
+	fsyncExtension       = "fsync@openssh.com"
+)
+
+var _ storagedriver.FileWriter = &writer{}
+
+// driverParameters is a struct that encapsulates all of the driver parameters after all values have been set
+type driverParameters struct {
+	addr          string
+	config        *ssh.ClientConfig
+	rootDirectory string
+
+	// maxConnections is the number of SSH connections of the pool.
+	maxConnections uint64
+
+	// maxConcurrency limits the number of concurrent driver operations
+	// to the server, which are multiplexed over the connections of the
+	// pool.
+	maxConcurrency uint64
+}
+
+func init() {
+	factory.Register(driverName, &sftpDriverFactory{})
+}
+
+// sftpDriverFactory implements the factory.StorageDriverFactory interface
+type sftpDriverFactory struct{}
+
+// Create StorageDriver from parameters
+func (factory *sftpDriverFactory) Create(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(ctx, parameters)
+}
+
+var _ storagedriver.StorageDriver = &driver{}
+
+// driver is a storagedriver.StorageDriver implementation backed by a remote
+// host reachable over SFTP. All provided paths will be subpaths of the root
+// directory on the remote host.
+type driver struct {
+	pool          *pool
+	rootDirectory string
+}
+
+// Wrapper wraps `driver` with a throttler, ensuring that no more than N
+// SFTP requests can occur concurrently. The default limit is 50.
+type Wrapper struct {
+	baseEmbed
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - host
+// - username
+// - password or privatekey
+// - knownhosts or hostkey
+// - rootdirectory
+func FromParameters(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	param := func(name string) string {
+		value, ok := parameters[name]
+		if !ok || value == nil {
+			return ""
+		}
+		return fmt.Sprint(value)
+	}
+
+	host := param("host")
+	if host == "" {
+		return nil, fmt.Errorf("no host parameter provided")
+	}
+	port := defaultPort
+	if p := param("port"); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+	}
+	username := param("username")
+	if username == "" {
+		return nil, fmt.Errorf("no username parameter provided")
+	}
+	rootDirectory := param("rootdirectory")
+	if rootDirectory == "" {
+		return nil, fmt.Errorf("no rootdirectory parameter provided")
+	}
+
+	var auth []ssh.AuthMethod
+	if keyFile := param("privatekey"); keyFile != "" {
+		signer, err := readPrivateKey(keyFile, param("passphrase"))
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password := param("password"); password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no password or privatekey parameter provided")
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch knownHosts, hostKey := param("knownhosts"), param("hostkey"); {
+	case knownHosts != "" && hostKey != "":
+		return nil, fmt.Errorf("only one of the knownhosts and hostkey parameters may be provided")
+	case knownHosts != "":
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read known hosts: %v", err)
+		}
+		hostKeyCallback = callback
+	case hostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostkey: %v", err)
+		}
+		hostKeyCallback = ssh.FixedHostKey(key)
+	default:
+		return nil, fmt.Errorf("no knownhosts or hostkey parameter provided")
+	}
+
+	maxConnections, err := base.GetLimitFromParameter(parameters["maxconnections"], 1, defaultMaxConnections)
+	if err != nil {
+		return nil, fmt.Errorf("maxconnections config error: %s", err)
+	}
+	maxConcurrency, err := base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
+	}
+
+	params := driverParameters{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         dialTimeout,
+		},
+		rootDirectory:  rootDirectory,
+		maxConnections: maxConnections,
+		maxConcurrency: maxConcurrency,
+	}
+
+	return New(ctx, params)
+}
+
+// readPrivateKey reads a private key in the PEM or OpenSSH formats,
+// decrypting it with passphrase if it is not empty.
+func readPrivateKey(keyFile, passphrase string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %v", err)
+	}
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	return signer, nil
+}
+
+// New constructs a new driver, connecting to the server to check that the
+// root directory may be created.
+func New(ctx context.Context, params driverParameters) (storagedriver.StorageDriver, error) {
+	if params.maxConnections == 0 {
+		params.maxConnections = defaultMaxConnections
+	}
+	d := &driver{
+		pool: &pool{
+			addr:   params.addr,
+			config: params.config,
+			slots:  make([]slot, params.maxConnections),
+		},
+		rootDirectory: strings.TrimSuffix(params.rootDirectory, "/"),
+	}
+	if d.rootDirectory == "" {
+		d.rootDirectory = "/"
+	}
+
+	err := d.do(func(s *session) error {
+		return s.MkdirAll(d.rootDirectory)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create root directory %s: %v", d.rootDirectory, err)
+	}
+
+	return &Wrapper{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: base.NewRegulator(d, params.maxConcurrency),
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	rc, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(contents); err != nil {
+		if cErr := w.Cancel(ctx); cErr != nil {
+			return errors.Join(err, cErr)
+		}
+		return err
+	}
+	if err := w.Commit(ctx); err != nil {
+		if cErr := w.Cancel(ctx); cErr != nil {
+			return errors.Join(err, cErr)
+		}
+		return err
+	}
+	return w.Close()
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	r := &reader{}
+	err := d.do(func(s *session) error {
+		f, err := s.Open(d.fullPath(path))
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		if offset > fi.Size() {
+			_ = f.Close()
+			return storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return err
+		}
+		r.File = f
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, subPath string, append bool) (storagedriver.FileWriter, error) {
+	fullPath := d.fullPath(subPath)
+	w := &writer{driver: d, path: fullPath}
+	if !append {
+		tempPath, err := tempPath(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		w.path, w.target = tempPath, fullPath
+	}
+
+	err := d.do(func(s *session) error {
+		if err := s.MkdirAll(path.Dir(fullPath)); err != nil {
+			return err
+		}
+		flags := os.O_WRONLY | os.O_CREATE
+		if !append {
+			flags |= os.O_TRUNC
+		}
+		f, err := s.OpenFile(w.path, flags)
+		if err != nil {
+			return err
+		}
+		if append {
+			fi, err := f.Stat()
+			if err != nil {
+				_ = f.Close()
+				return err
+			}
+			w.size = fi.Size()
+		}
+		w.session, w.file = s, f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// tempPath returns a uniquely named temporary path next to fullPath.
+func tempPath(fullPath string) (string, error) {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(fullPath), "."+path.Base(fullPath)+"."+hex.EncodeToString(suffix[:])+tempFileSuffix), nil
+}
+
+// isTempFile returns whether the file name is that of a temporary file
+// created by tempPath.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	var fsInfo fs.FileInfo
+	err := d.do(func(s *session) (err error) {
+		fsInfo, err = s.Stat(d.fullPath(path))
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fi := storagedriver.FileInfoFields{
+		Path:    path,
+		ModTime: fsInfo.ModTime(),
+		IsDir:   fsInfo.IsDir(),
+	}
+	if !fi.IsDir {
+		fi.Size = fsInfo.Size()
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the given
+// path.
+func (d *driver) List(ctx context.Context, subPath string) ([]string, error) {
+	var entries []fs.FileInfo
+	err := d.do(func(s *session) (err error) {
+		entries, err = s.ReadDir(d.fullPath(subPath))
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, storagedriver.PathNotFoundError{Path: subPath}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if isTempFile(entry.Name()) {
+			continue
+		}
+		keys = append(keys, path.Join(subPath, entry.Name()))
+	}
+	return keys, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the original
+// object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	source := d.fullPath(sourcePath)
+	dest := d.fullPath(destPath)
+
+	err := d.do(func(s *session) error {
+		if _, err := s.Stat(source); err != nil {
+			return err
+		}
+		if err := s.MkdirAll(path.Dir(dest)); err != nil {
+			return err
+		}
+		return s.rename(source, dest)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return storagedriver.PathNotFoundError{Path: sourcePath}
+	}
+	return err
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	fullPath := d.fullPath(path)
+
+	err := d.do(func(s *session) error {
+		fi, err := s.Stat(fullPath)
+		if err != nil {
+			return err
+		}
+		return s.removeAll(fullPath, fi)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	return err
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored at the given path.
+func (d *driver) RedirectURL(*http.Request, string) (string, error) {
+	return "", nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file and directory
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// fullPath returns the absolute path of a key within the Driver's storage.
+func (d *driver) fullPath(subPath string) string {
+	return path.Join(d.rootDirectory, subPath)
+}
+
+// do calls f with a session of the pool. When the session fails before f
+// completes, f is retried with the next sessions, which are dialed again if
+// they failed too.
+func (d *driver) do(f func(s *session) error) error {
+	var err error
+	for attempt := 0; attempt <= len(d.pool.slots); attempt++ {
+		var s *session
+		if s, err = d.pool.get(); err != nil {
+			return err
+		}
+		if err = f(s); !connectionLost(err) {
+			return err
+		}
+		s.fail()
+	}
+	return err
+}
+
+// connectionLost returns whether err is due to the failure of the session
+// rather than to that of the request.
+func connectionLost(err error) bool {
+	// Requests sent while the session is being torn down fail with
+	// the error of the SSH channel.
+	return errors.Is(err, gosftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF)
+}
+
+// session is an SFTP session over its own SSH connection.
+type session struct {
+	*gosftp.Client
+	conn   *ssh.Client
+	failed atomic.Bool
+}
+
+// dial opens an SFTP session to addr.
+func dial(addr string, config *ssh.ClientConfig) (*session, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gosftp.NewClient(conn, gosftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sftp subsystem unavailable: %v", err)
+	}
+
+	s := &session{Client: client, conn: conn}
+	go func() {
+		_ = client.Wait()
+		s.fail()
+	}()
+	return s, nil
+}
+
+// fail marks the session as failed and closes its connection.
+func (s *session) fail() {
+	s.failed.Store(true)
+	s.conn.Close()
+}
+
+// rename renames a file, replacing the target if it exists. Without the
+// POSIX rename extension of OpenSSH, the target is removed first.
+func (s *session) rename(oldpath, newpath string) error {
+	if _, ok := s.HasExtension(posixRenameExtension); ok {
+		return s.PosixRename(oldpath, newpath)
+	}
+	if err := s.Remove(newpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return s.Rename(oldpath, newpath)
+}
+
+// removeAll removes a file, or a directory and its content. Entries removed
+// concurrently are ignored.
+func (s *session) removeAll(p string, fi fs.FileInfo) error {
+	if !fi.IsDir() {
+		return s.Remove(p)
+	}
+	entries, err := s.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.removeAll(path.Join(p, entry.Name()), entry); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return s.RemoveDirectory(p)
+}
+
+// pool is a fixed size pool of SFTP sessions. Sessions are dialed when
+// first used, and dialed again once they fail.
+type pool struct {
+	addr   string
+	config *ssh.ClientConfig
+	next   atomic.Uint64
+	slots  []slot
+}
+
+type slot struct {
+	mu      sync.Mutex
+	session *session
+}
+
+// get returns the session of the next slot of the pool.
+func (p *pool) get() (*session, error) {
+	sl := &p.slots[(p.next.Add(1)-1)%uint64(len(p.slots))]
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.session == nil || sl.session.failed.Load() {
+		s, err := dial(p.addr, p.config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to %s: %v", p.addr, err)
+		}
+		sl.session = s
+	}
+	return sl.session, nil
+}
+
+// reader reads a file from its offset, ignoring the failure of its session
+// once closed.
+type reader struct {
+	*gosftp.File
+}
+
+func (r *reader) Close() error {
+	err := r.File.Close()
+	if connectionLost(err) {
+		return nil
+	}
+	return err
+}
+
+type writer struct {
+	driver  *driver
+	session *session
+	file    *gosftp.File
+
+	// path is the path of the file written, which is renamed to target
+	// once closed if target is set.
+	path   string
+	target string
+
+	// size is the size of the content written to the server, buf holding
+	// the content written to the writer since.
+	size int64
+	buf  []byte
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= writeBufferSize {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *writer) Size() int64 {
+	return w.size + int64(len(w.buf))
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil && !connectionLost(err) {
+		return err
+	}
+	w.closed = true
+
+	if w.target != "" {
+		return w.driver.do(func(s *session) error {
+			return s.rename(w.path, w.target)
+		})
+	}
+	return nil
+}
+
+func (w *writer) Cancel(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+
+	w.cancelled = true
+	_ = w.file.Close()
+	return w.driver.do(func(s *session) error {
+		return s.Remove(w.path)
+	})
+}
+
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+// flush writes the buffered content to the server.
+func (w *writer) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.resume(func() error {
+		_, err := w.file.WriteAt(w.buf, w.size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// sync flushes the file to stable storage, if the server supports it.
+func (w *writer) sync() error {
+	return w.resume(func() error {
+		if _, ok := w.session.HasExtension(fsyncExtension); !ok {
+			return nil
+		}
+		return w.file.Sync()
+	})
+}
+
+// resume calls f, reopening the file on another session and retrying if
+// the session of the writer fails. Nothing written beyond size is assumed
+// to have been written.
+func (w *writer) resume(f func() error) error {
+	err := f()
+	if !connectionLost(err) {
+		return err
+	}
+	w.session.fail()
+	return w.driver.do(func(s *session) error {
+		file, err := s.OpenFile(w.path, os.O_WRONLY)
+		if err != nil {
+			return err
+		}
+		w.session, w.file = s, file
+		return f()
+	})
+}
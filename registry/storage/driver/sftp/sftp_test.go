@@ -0,0 +1,377 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	gosftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var skipCheck func(tb testing.TB)
+
+func init() {
+	// Skip the SFTP storage driver tests against a real server if
+	// environment variable parameters are not provided
+	skipCheck = func(tb testing.TB) {
+		tb.Helper()
+
+		if os.Getenv("SFTP_DRIVER_HOST") == "" || os.Getenv("SFTP_DRIVER_USERNAME") == "" || os.Getenv("SFTP_DRIVER_KNOWNHOSTS") == "" || os.Getenv("SFTP_DRIVER_ROOTDIRECTORY") == "" {
+			tb.Skip("The following environment variables must be set to enable these tests: SFTP_DRIVER_HOST, SFTP_DRIVER_USERNAME, SFTP_DRIVER_KNOWNHOSTS, SFTP_DRIVER_ROOTDIRECTORY, and SFTP_DRIVER_PASSWORD or SFTP_DRIVER_PRIVATEKEY")
+		}
+	}
+}
+
+func newDriverConstructor(tb testing.TB) testsuites.DriverConstructor {
+	return func() (storagedriver.StorageDriver, error) {
+		return FromParameters(context.Background(), map[string]interface{}{
+			"host":          os.Getenv("SFTP_DRIVER_HOST"),
+			"port":          os.Getenv("SFTP_DRIVER_PORT"),
+			"username":      os.Getenv("SFTP_DRIVER_USERNAME"),
+			"password":      os.Getenv("SFTP_DRIVER_PASSWORD"),
+			"privatekey":    os.Getenv("SFTP_DRIVER_PRIVATEKEY"),
+			"knownhosts":    os.Getenv("SFTP_DRIVER_KNOWNHOSTS"),
+			"rootdirectory": os.Getenv("SFTP_DRIVER_ROOTDIRECTORY"),
+		})
+	}
+}
+
+func TestSFTPDriverSuite(t *testing.T) {
+	skipCheck(t)
+	testsuites.Driver(t, newDriverConstructor(t))
+}
+
+func BenchmarkSFTPDriverSuite(b *testing.B) {
+	skipCheck(b)
+	testsuites.BenchDriver(b, newDriverConstructor(b))
+}
+
+// testServer is an SSH server serving the local file system over SFTP, the
+// driver storing its content in a temporary directory.
+type testServer struct {
+	t        *testing.T
+	root     string
+	listener net.Listener
+	hostKey  ssh.PublicKey
+	config   *ssh.ServerConfig
+
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		t:        t,
+		root:     t.TempDir(),
+		listener: listener,
+		hostKey:  signer.PublicKey(),
+		config: &ssh.ServerConfig{
+			PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if c.User() == "registry" && string(password) == "secret" {
+					return nil, nil
+				}
+				return nil, errors.New("access denied")
+			},
+		},
+	}
+	s.config.AddHostKey(signer)
+	t.Cleanup(func() {
+		listener.Close()
+		s.drop()
+	})
+
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, nc)
+			s.dials++
+			s.mu.Unlock()
+			go s.serveConn(nc)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) parameters(rootDirectory string) map[string]interface{} {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return map[string]interface{}{
+		"host":          host,
+		"port":          port,
+		"username":      "registry",
+		"password":      "secret",
+		"hostkey":       string(ssh.MarshalAuthorizedKey(s.hostKey)),
+		"rootdirectory": filepath.ToSlash(s.local(rootDirectory)),
+	}
+}
+
+// drop closes the connections of the clients.
+func (s *testServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nc := range s.conns {
+		nc.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) serveConn(nc net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go s.serveSFTP(ch)
+				}
+			}
+		}()
+	}
+}
+
+func (s *testServer) local(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(p))
+}
+
+func (s *testServer) serveSFTP(ch ssh.Channel) {
+	defer ch.Close()
+	server, err := gosftp.NewServer(ch)
+	if err != nil {
+		return
+	}
+	_ = server.Serve()
+}
+
+func TestSFTPDriverSuiteWithTestServer(t *testing.T) {
+	// the 5GB file of TestWriteReadLargeStreams takes too long to be
+	// written to the test server
+	if !testing.Short() {
+		t.Skip("Skipping test outside of short mode")
+	}
+	s := newTestServer(t)
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return FromParameters(context.Background(), s.parameters("/registry"))
+	})
+}
+
+func TestFromParameters(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	valid := s.parameters("/registry")
+	if _, err := FromParameters(ctx, valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi, err := os.Stat(s.local("/registry")); err != nil || !fi.IsDir() {
+		t.Fatalf("root directory was not created: %v", err)
+	}
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		override map[string]interface{}
+		err      string
+	}{
+		{map[string]interface{}{"host": ""}, "no host parameter provided"},
+		{map[string]interface{}{"port": "ssh"}, "invalid port"},
+		{map[string]interface{}{"username": ""}, "no username parameter provided"},
+		{map[string]interface{}{"rootdirectory": ""}, "no rootdirectory parameter provided"},
+		{map[string]interface{}{"password": ""}, "no password or privatekey parameter provided"},
+		{map[string]interface{}{"password": "wrong"}, "unable to authenticate"},
+		{map[string]interface{}{"hostkey": ""}, "no knownhosts or hostkey parameter provided"},
+		{map[string]interface{}{"hostkey": "invalid"}, "invalid hostkey"},
+		{map[string]interface{}{"hostkey": string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey()))}, "host key mismatch"},
+		{map[string]interface{}{"knownhosts": "/known_hosts"}, "only one of the knownhosts and hostkey parameters may be provided"},
+		{map[string]interface{}{"maxconnections": "many"}, "maxconnections config error"},
+		{map[string]interface{}{"maxconcurrency": "many"}, "maxconcurrency config error"},
+	} {
+		params := make(map[string]interface{})
+		for k, v := range valid {
+			params[k] = v
+		}
+		for k, v := range tc.override {
+			params[k] = v
+		}
+		if _, err := FromParameters(ctx, params); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.override, tc.err, err)
+		}
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	params := s.parameters("/registry")
+	params["maxconnections"] = 2
+	d, err := FromParameters(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	s.mu.Lock()
+	dials := s.dials
+	s.mu.Unlock()
+	if dials != 2 {
+		t.Fatalf("expected 2 connections, got %d", dials)
+	}
+
+	// Failed connections are dialed again.
+	s.drop()
+	content, err := d.GetContent(ctx, "/file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(content) != "content" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+}
+
+func TestResumeWriter(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	d, err := FromParameters(ctx, s.parameters("/registry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*writeBufferSize)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content[:writeBufferSize+100]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The writer reopens the file on another connection once its own
+	// fails.
+	s.drop()
+	if _, err := w.Write(content[writeBufferSize+100 : 2*writeBufferSize]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The upload is resumed by an appending writer.
+	w, err = d.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != 2*writeBufferSize {
+		t.Fatalf("expected size %d, got %d", 2*writeBufferSize, w.Size())
+	}
+	if _, err := w.Write(content[2*writeBufferSize:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetContent(ctx, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("content mismatch")
+	}
+}
+
+func TestWithoutPosixRename(t *testing.T) {
+	if err := gosftp.SetSFTPExtensions(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = gosftp.SetSFTPExtensions("hardlink@openssh.com", posixRenameExtension, "statvfs@openssh.com")
+	})
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	d, err := FromParameters(ctx, s.parameters("/registry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		if err := d.PutContent(ctx, "/file", []byte(content)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got, err := d.GetContent(ctx, "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Fatalf("expected %q, got %q", content, got)
+		}
+	}
+
+	list, err := d.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != "/file" {
+		t.Fatalf("unexpected list: %v", list)
+	}
+}
@@ -3,12 +3,14 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Version is a string representing the storage driver version, of the form
@@ -131,6 +133,140 @@ type FileWriter interface {
 	Commit(context.Context) error
 }
 
+// Appender is an optional interface of a StorageDriver whose backend
+// natively appends to files, such as a local filesystem or Azure append blobs.
+// Drivers emulating appends, for instance by copying the content written so
+// far into a new multipart upload when a writer is resumed, should not
+// implement it.
+type Appender interface {
+	// Append returns a FileWriter which appends the content written to it
+	// to the uncommitted content stored at "path", like Writer does when
+	// called with append set, without copying that content.
+	Append(ctx context.Context, path string) (FileWriter, error)
+}
+
+// Append returns a FileWriter appending to the content stored at path. It
+// uses the Append method of the driver if it is an Appender supporting it,
+// and falls back to its Writer otherwise.
+func Append(ctx context.Context, driver StorageDriver, path string) (FileWriter, error) {
+	if appender, ok := driver.(Appender); ok {
+		fw, err := appender.Append(ctx, path)
+		if !errors.As(err, &ErrUnsupportedMethod{}) {
+			return fw, err
+		}
+	}
+	return driver.Writer(ctx, path, true)
+}
+
+// BulkDeleter is an optional interface of a StorageDriver whose backend
+// deletes several files in a single request, such as S3 with DeleteObjects.
+type BulkDeleter interface {
+	// DeleteFiles deletes the files stored at paths, ignoring the paths
+	// which are not found. Unlike Delete, it does not delete the subpaths of
+	// paths. Drivers of backends having directories remove those left empty.
+	DeleteFiles(ctx context.Context, paths []string) error
+}
+
+// DeleteFiles deletes the files stored at paths, ignoring the paths which
+// are not found. It uses the DeleteFiles method of the driver if it is a
+// BulkDeleter supporting it, and falls back to deleting each path otherwise.
+func DeleteFiles(ctx context.Context, driver StorageDriver, paths []string) error {
+	if deleter, ok := driver.(BulkDeleter); ok {
+		err := deleter.DeleteFiles(ctx, paths)
+		if !errors.As(err, &ErrUnsupportedMethod{}) {
+			return err
+		}
+	}
+	for _, path := range paths {
+		if err := driver.Delete(ctx, path); err != nil && !errors.As(err, &PathNotFoundError{}) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transferer is an optional interface of a StorageDriver able to copy the
+// content stored by another storage driver without streaming it through the
+// registry, such as with a server-side copy between the buckets of a service.
+type Transferer interface {
+	// Transfer copies the content stored at sourcePath of the source driver
+	// to destPath. It returns ErrUnsupportedMethod if it cannot copy from the
+	// source driver.
+	Transfer(ctx context.Context, source StorageDriver, sourcePath, destPath string) error
+}
+
+// Transfer copies the content stored at sourcePath of the source driver to
+// destPath of the dest driver. It uses the Transfer method of the dest driver
+// if it is a Transferer able to copy from the source driver, and streams the
+// content from the source driver to the dest driver otherwise.
+func Transfer(ctx context.Context, source StorageDriver, sourcePath string, dest StorageDriver, destPath string) error {
+	if transferer, ok := dest.(Transferer); ok {
+		err := transferer.Transfer(ctx, source, sourcePath, destPath)
+		if !errors.As(err, &ErrUnsupportedMethod{}) {
+			return err
+		}
+	}
+
+	rc, err := source.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := dest.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, rc); err != nil {
+		return errors.Join(err, fw.Cancel(ctx))
+	}
+	if err := fw.Commit(ctx); err != nil {
+		fw.Close()
+		return err
+	}
+	return fw.Close()
+}
+
+// RedirectCookier is an optional interface of a StorageDriver, usually a
+// middleware, whose redirect URLs are authorized by cookies set on the
+// redirect response rather than by the URLs themselves, such as the signed
+// cookies of CloudFront.
+type RedirectCookier interface {
+	// RedirectCookies returns the cookies to set on the response redirecting
+	// the request r to the redirect URL of "path".
+	RedirectCookies(r *http.Request, path string) ([]*http.Cookie, error)
+}
+
+// RedirectCookies returns the cookies to set on the response redirecting r
+// to the redirect URL of "path", if the driver is a RedirectCookier.
+func RedirectCookies(r *http.Request, driver StorageDriver, path string) ([]*http.Cookie, error) {
+	if cookier, ok := driver.(RedirectCookier); ok {
+		return cookier.RedirectCookies(r, path)
+	}
+	return nil, nil
+}
+
+// DefaultRedirectExpiry is the time the redirect URLs signed by the drivers
+// remain valid unless the request asks for another with WithRedirectExpiry.
+const DefaultRedirectExpiry = 20 * time.Minute
+
+type redirectExpiryKey struct{}
+
+// WithRedirectExpiry returns a context asking the drivers to sign the
+// redirect URLs of the requests carrying it for the given time.
+func WithRedirectExpiry(ctx context.Context, expiry time.Duration) context.Context {
+	return context.WithValue(ctx, redirectExpiryKey{}, expiry)
+}
+
+// RedirectExpiry returns the time the redirect URL returned for r should
+// remain valid.
+func RedirectExpiry(r *http.Request) time.Duration {
+	if expiry, ok := r.Context().Value(redirectExpiryKey{}).(time.Duration); ok && expiry > 0 {
+		return expiry
+	}
+	return DefaultRedirectExpiry
+}
+
 // PathRegexp is the regular expression which each file path must match. A
 // file path is absolute, beginning with a slash and containing a positive
 // number of path components separated by slashes, where each component is
@@ -179,6 +315,58 @@ func (err InvalidOffsetError) Error() string {
 	return fmt.Sprintf("%s: invalid offset: %d for path: %s", err.DriverName, err.Offset, err.Path)
 }
 
+// ChecksumMismatchError is returned when the storage backend rejects content
+// written to it because it does not match its checksum, as when it was
+// corrupted in transit.
+type ChecksumMismatchError struct {
+	Path       string
+	DriverName string
+	Detail     error
+}
+
+func (err ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s: checksum mismatch for path %s: %v", err.DriverName, err.Path, err.Detail)
+}
+
+func (err ChecksumMismatchError) Unwrap() error {
+	return err.Detail
+}
+
+// ArchivedContentError is returned when the content at Path is archived by
+// the storage backend, and cannot be read until it is restored.
+type ArchivedContentError struct {
+	Path       string
+	DriverName string
+	// Restoring is set when the content is being restored, which takes
+	// about RetryAfter, if known.
+	Restoring  bool
+	RetryAfter time.Duration
+	Detail     error
+}
+
+func (err ArchivedContentError) Error() string {
+	if err.Restoring {
+		return fmt.Sprintf("%s: content at path %s is archived and being restored", err.DriverName, err.Path)
+	}
+	return fmt.Sprintf("%s: content at path %s is archived", err.DriverName, err.Path)
+}
+
+func (err ArchivedContentError) Unwrap() error {
+	return err.Detail
+}
+
+// UnavailableError is returned without calling the storage backend when it
+// is deemed unavailable, such as by a circuit breaker after repeated
+// failures. The backend is tried again after RetryAfter.
+type UnavailableError struct {
+	DriverName string
+	RetryAfter time.Duration
+}
+
+func (err UnavailableError) Error() string {
+	return fmt.Sprintf("%s: the storage backend is unavailable", err.DriverName)
+}
+
 // Error is a catch-all error type which captures an error string and
 // the driver type on which it occurred.
 type Error struct {
@@ -0,0 +1,3 @@
+// Package storj implements the Storj DCS driver backend. It is built with
+// the include_storj build tag.
+package storj
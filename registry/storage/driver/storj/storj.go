@@ -0,0 +1,649 @@
+//go:build include_storj
+
+// Package storj provides a storagedriver.StorageDriver implementation to
+// store blobs in a Storj DCS bucket, through the uplink library, which
+// encrypts the content and the keys of objects on the client.
+//
+// Uploads larger than a chunk are uploaded as Storj multipart uploads,
+// which keep their parts while an upload is suspended. All the parts of a
+// multipart upload but the last must be at least 5MiB, so the content of an
+// upload not uploaded as a part yet, and the ID of its multipart upload,
+// are stored in an upload session object, at the key of the upload.
+// Upload session objects are hidden from the readers of the driver.
+package storj
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"storj.io/uplink"
+)
+
+const (
+	driverName = "storj"
+
+	minChunkSize          = 5 * 1024 * 1024
+	defaultChunkSize      = 64 * 1024 * 1024
+	defaultMaxConcurrency = 50
+	minConcurrency        = 25
+
+	// sessionUploadIDKey and sessionOffsetKey are the custom metadata of
+	// upload session objects: the ID of their multipart upload, and the
+	// size of its parts.
+	sessionUploadIDKey = "docker-upload-session-id"
+	sessionOffsetKey   = "docker-upload-session-offset"
+)
+
+var _ storagedriver.FileWriter = &writer{}
+
+// driverParameters is a struct that encapsulates all of the driver parameters after all values have been set
+type driverParameters struct {
+	accessGrant      string
+	satelliteAddress string
+	apiKey           string
+	passphrase       string
+	bucket           string
+	rootDirectory    string
+	chunkSize        int
+
+	// maxConcurrency limits the number of concurrent driver operations
+	// to Storj.
+	maxConcurrency uint64
+}
+
+func init() {
+	factory.Register(driverName, &storjDriverFactory{})
+}
+
+// storjDriverFactory implements the factory.StorageDriverFactory interface
+type storjDriverFactory struct{}
+
+// Create StorageDriver from parameters
+func (factory *storjDriverFactory) Create(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(ctx, parameters)
+}
+
+var _ storagedriver.StorageDriver = &driver{}
+
+// driver is a storagedriver.StorageDriver implementation backed by Storj.
+// Objects are stored at absolute keys in the provided bucket.
+type driver struct {
+	project       *uplink.Project
+	bucket        string
+	rootDirectory string
+	chunkSize     int
+}
+
+// Wrapper wraps `driver` with a throttler, ensuring that no more than N
+// Storj operations can occur concurrently. The default limit is 50.
+type Wrapper struct {
+	baseEmbed
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - bucket
+// - accessgrant, or satelliteaddress, apikey and passphrase
+func FromParameters(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	var params driverParameters
+	for name, dest := range map[string]*string{
+		"accessgrant":      &params.accessGrant,
+		"satelliteaddress": &params.satelliteAddress,
+		"apikey":           &params.apiKey,
+		"passphrase":       &params.passphrase,
+		"bucket":           &params.bucket,
+		"rootdirectory":    &params.rootDirectory,
+	} {
+		if value, ok := parameters[name]; ok && value != nil {
+			*dest = fmt.Sprint(value)
+		}
+	}
+
+	if params.bucket == "" {
+		return nil, fmt.Errorf("no bucket parameter provided")
+	}
+	if params.accessGrant == "" && (params.satelliteAddress == "" || params.apiKey == "" || params.passphrase == "") {
+		return nil, fmt.Errorf("either accessgrant, or satelliteaddress, apikey and passphrase must be provided")
+	}
+	if params.accessGrant != "" && (params.satelliteAddress != "" || params.apiKey != "" || params.passphrase != "") {
+		return nil, fmt.Errorf("accessgrant may not be provided with satelliteaddress, apikey or passphrase")
+	}
+
+	params.chunkSize = defaultChunkSize
+	chunkSizeParam, ok := parameters["chunksize"]
+	if ok {
+		switch v := chunkSizeParam.(type) {
+		case string:
+			vv, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("chunksize must be an integer, %v invalid", chunkSizeParam)
+			}
+			params.chunkSize = vv
+		case int, uint, int32, uint32, uint64, int64:
+			params.chunkSize = int(reflect.ValueOf(v).Convert(reflect.TypeOf(params.chunkSize)).Int())
+		default:
+			return nil, fmt.Errorf("invalid value for chunksize: %#v", chunkSizeParam)
+		}
+
+		if params.chunkSize < minChunkSize {
+			return nil, fmt.Errorf("chunksize %#v must be larger than or equal to %d", params.chunkSize, minChunkSize)
+		}
+	}
+
+	var err error
+	params.maxConcurrency, err = base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
+	}
+
+	return New(ctx, params)
+}
+
+// New constructs a new driver, opening the project of the access grant and
+// checking that the bucket exists.
+func New(ctx context.Context, params driverParameters) (storagedriver.StorageDriver, error) {
+	rootDirectory := strings.Trim(params.rootDirectory, "/")
+	if rootDirectory != "" {
+		rootDirectory += "/"
+	}
+	if params.chunkSize < minChunkSize {
+		return nil, fmt.Errorf("invalid chunksize: %d is smaller than %d", params.chunkSize, minChunkSize)
+	}
+
+	var (
+		access *uplink.Access
+		err    error
+	)
+	if params.accessGrant != "" {
+		access, err = uplink.ParseAccess(params.accessGrant)
+	} else {
+		access, err = uplink.RequestAccessWithPassphrase(ctx, params.satelliteAddress, params.apiKey, params.passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid storj access: %v", err)
+	}
+
+	project, err := uplink.OpenProject(ctx, access)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open storj project: %v", err)
+	}
+	if _, err := project.StatBucket(ctx, params.bucket); err != nil {
+		project.Close()
+		return nil, fmt.Errorf("unable to access storj bucket %s: %v", params.bucket, err)
+	}
+
+	d := &driver{
+		project:       project,
+		bucket:        params.bucket,
+		rootDirectory: rootDirectory,
+		chunkSize:     params.chunkSize,
+	}
+
+	return &Wrapper{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: base.NewRegulator(d, params.maxConcurrency),
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	rc, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	return d.upload(ctx, d.pathToKey(path), nil, contents)
+}
+
+// upload uploads an object in one go, replacing the object at key.
+func (d *driver) upload(ctx context.Context, key string, custom uplink.CustomMetadata, contents []byte) error {
+	upload, err := d.project.UploadObject(ctx, d.bucket, key, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := upload.Write(contents); err != nil {
+		return errors.Join(err, upload.Abort())
+	}
+	if custom != nil {
+		if err := upload.SetCustomMetadata(ctx, custom); err != nil {
+			return errors.Join(err, upload.Abort())
+		}
+	}
+	return upload.Commit()
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path"
+// with a given byte offset.
+// May be used to resume reading a stream by providing a nonzero offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	key := d.pathToKey(path)
+	object, err := d.object(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if object == nil {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	if offset > object.System.ContentLength {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+	if offset == object.System.ContentLength {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	download, err := d.project.DownloadObject(ctx, d.bucket, key, &uplink.DownloadOptions{Offset: offset, Length: -1})
+	if errors.Is(err, uplink.ErrObjectNotFound) {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return download, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
+	w := &writer{
+		ctx:    ctx,
+		driver: d,
+		path:   path,
+		key:    d.pathToKey(path),
+	}
+
+	if appendMode {
+		if err := w.init(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current
+// size in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	// try to get as object
+	key := d.pathToKey(path)
+	object, err := d.object(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if object != nil {
+		return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+			Path:    path,
+			Size:    object.System.ContentLength,
+			ModTime: object.System.Created,
+		}}, nil
+	}
+
+	// try to get as prefix
+	objects := d.project.ListObjects(ctx, d.bucket, &uplink.ListObjectsOptions{Prefix: d.pathToDirKey(path)})
+	if !objects.Next() {
+		if err := objects.Err(); err != nil {
+			return nil, err
+		}
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:  path,
+		IsDir: true,
+	}}, nil
+}
+
+// object returns the object at key, or nil if there is none or if it is an
+// upload session object.
+func (d *driver) object(ctx context.Context, key string) (*uplink.Object, error) {
+	object, err := d.project.StatObject(ctx, d.bucket, key)
+	if errors.Is(err, uplink.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isSession(object) {
+		return nil, nil
+	}
+	return object, nil
+}
+
+// isSession returns whether object is an upload session object.
+func isSession(object *uplink.Object) bool {
+	_, ok := object.Custom[sessionOffsetKey]
+	return ok
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	objects := d.project.ListObjects(ctx, d.bucket, &uplink.ListObjectsOptions{
+		Prefix: d.pathToDirKey(path),
+		Custom: true,
+	})
+	list := make([]string, 0, 64)
+	for objects.Next() {
+		object := objects.Item()
+		if object.IsPrefix || !isSession(object) {
+			list = append(list, d.keyToPath(object.Key))
+		}
+	}
+	if err := objects.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(list) == 0 && path != "/" {
+		// Treat empty response as missing directory, since we don't actually
+		// have directories in Storj.
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return list, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	source := d.pathToKey(sourcePath)
+	dest := d.pathToKey(destPath)
+
+	if _, err := d.project.StatObject(ctx, d.bucket, source); err != nil {
+		if errors.Is(err, uplink.ErrObjectNotFound) {
+			return storagedriver.PathNotFoundError{Path: sourcePath}
+		}
+		return err
+	}
+	if _, err := d.project.DeleteObject(ctx, d.bucket, dest); err != nil && !errors.Is(err, uplink.ErrObjectNotFound) {
+		return err
+	}
+	return d.project.MoveObject(ctx, d.bucket, source, d.bucket, dest, nil)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths,
+// and aborts the multipart uploads of the upload sessions among them.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	key := d.pathToKey(path)
+
+	var keys []string
+	if _, err := d.project.StatObject(ctx, d.bucket, key); err == nil {
+		keys = append(keys, key)
+	} else if !errors.Is(err, uplink.ErrObjectNotFound) {
+		return err
+	}
+	objects := d.project.ListObjects(ctx, d.bucket, &uplink.ListObjectsOptions{
+		Prefix:    d.pathToDirKey(path),
+		Recursive: true,
+	})
+	for objects.Next() {
+		keys = append(keys, objects.Item().Key)
+	}
+	if err := objects.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+
+	for _, key := range keys {
+		if err := d.deleteObject(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteObject deletes the object at key, aborting the multipart upload of
+// its upload session if it is an upload session object.
+func (d *driver) deleteObject(ctx context.Context, key string) error {
+	object, err := d.project.DeleteObject(ctx, d.bucket, key)
+	if errors.Is(err, uplink.ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if object != nil && object.Custom[sessionUploadIDKey] != "" {
+		err := d.project.AbortUpload(ctx, d.bucket, key, object.Custom[sessionUploadIDKey])
+		if err != nil && !errors.Is(err, uplink.ErrUploadIDInvalid) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored at the given path.
+func (d *driver) RedirectURL(*http.Request, string) (string, error) {
+	return "", nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file and directory
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+func (d *driver) pathToKey(path string) string {
+	return strings.TrimRight(d.rootDirectory+strings.TrimLeft(path, "/"), "/")
+}
+
+func (d *driver) pathToDirKey(path string) string {
+	key := d.pathToKey(path)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (d *driver) keyToPath(key string) string {
+	return "/" + strings.Trim(strings.TrimPrefix(key, d.rootDirectory), "/")
+}
+
+// writer writes the content of a file as a multipart upload, whose parts
+// are all chunkSize bytes but the last.
+type writer struct {
+	ctx    context.Context
+	driver *driver
+	path   string
+	key    string
+
+	// uploadID is the ID of the multipart upload the content is uploaded
+	// to, once it is larger than a chunk.
+	uploadID  string
+	parts     uint32
+	partsSize int64
+
+	// buffer holds the content which is not uploaded as a part yet.
+	buffer bytes.Buffer
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+// init resumes the upload from its upload session object, or appends to a
+// committed object.
+func (w *writer) init(ctx context.Context) error {
+	object, err := w.driver.project.StatObject(ctx, w.driver.bucket, w.key)
+	if errors.Is(err, uplink.ErrObjectNotFound) {
+		return storagedriver.PathNotFoundError{Path: w.path}
+	}
+	if err != nil {
+		return err
+	}
+
+	download, err := w.driver.project.DownloadObject(ctx, w.driver.bucket, w.key, nil)
+	if err != nil {
+		return err
+	}
+	defer download.Close()
+	if _, err := io.Copy(&w.buffer, download); err != nil {
+		return err
+	}
+
+	if object.Custom[sessionUploadIDKey] == "" {
+		return nil
+	}
+	w.uploadID = object.Custom[sessionUploadIDKey]
+	offset, err := strconv.ParseInt(object.Custom[sessionOffsetKey], 10, 64)
+	if err != nil {
+		return err
+	}
+	// parts uploaded after the session object was stored last are
+	// uploaded again, replacing them
+	parts := w.driver.project.ListUploadParts(ctx, w.driver.bucket, w.key, w.uploadID, nil)
+	for parts.Next() {
+		part := parts.Item()
+		if part.PartNumber != w.parts+1 || w.partsSize+part.Size > offset {
+			break
+		}
+		w.parts++
+		w.partsSize += part.Size
+	}
+	if err := parts.Err(); err != nil {
+		return err
+	}
+	if w.partsSize != offset {
+		return fmt.Errorf("storj upload session %s is missing parts", w.path)
+	}
+	return nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	w.buffer.Write(p)
+	for w.buffer.Len() >= w.driver.chunkSize {
+		if err := w.uploadPart(w.ctx, w.driver.chunkSize); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// uploadPart uploads the first n bytes of the buffer as the next part of
+// the multipart upload, beginning it if needed.
+func (w *writer) uploadPart(ctx context.Context, n int) error {
+	if w.uploadID == "" {
+		info, err := w.driver.project.BeginUpload(ctx, w.driver.bucket, w.key, nil)
+		if err != nil {
+			return err
+		}
+		w.uploadID = info.UploadID
+	}
+
+	part, err := w.driver.project.UploadPart(ctx, w.driver.bucket, w.key, w.uploadID, w.parts+1)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(w.buffer.Bytes()[:n]); err != nil {
+		return errors.Join(err, part.Abort())
+	}
+	if err := part.Commit(); err != nil {
+		return err
+	}
+	w.parts++
+	w.partsSize += int64(n)
+	w.buffer.Next(n)
+	return nil
+}
+
+// Size returns the number of bytes written to this FileWriter.
+func (w *writer) Size() int64 {
+	return w.partsSize + int64(w.buffer.Len())
+}
+
+// Close stores the content which is not uploaded as a part yet in the
+// upload session object, so that the upload can be resumed.
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	custom := uplink.CustomMetadata{sessionOffsetKey: strconv.FormatInt(w.partsSize, 10)}
+	if w.uploadID != "" {
+		custom[sessionUploadIDKey] = w.uploadID
+	}
+	return w.driver.upload(w.ctx, w.key, custom, w.buffer.Bytes())
+}
+
+// Cancel removes any written content from this FileWriter.
+func (w *writer) Cancel(ctx context.Context) error {
+	w.closed = true
+	w.cancelled = true
+
+	if w.uploadID != "" {
+		err := w.driver.project.AbortUpload(ctx, w.driver.bucket, w.key, w.uploadID)
+		if err != nil && !errors.Is(err, uplink.ErrUploadIDInvalid) {
+			return err
+		}
+	}
+	return w.driver.deleteObject(ctx, w.key)
+}
+
+// Commit flushes all content written to this FileWriter and makes it
+// available for future calls to StorageDriver.GetContent and
+// StorageDriver.Reader.
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	w.closed = true
+
+	// no multipart upload begun yet just perform a simple upload
+	if w.uploadID == "" {
+		if err := w.driver.upload(ctx, w.key, nil, w.buffer.Bytes()); err != nil {
+			return err
+		}
+		w.committed = true
+		return nil
+	}
+
+	if w.buffer.Len() > 0 {
+		if err := w.uploadPart(ctx, w.buffer.Len()); err != nil {
+			return err
+		}
+	}
+	// committing the multipart upload replaces the upload session object
+	if _, err := w.driver.project.CommitUpload(ctx, w.driver.bucket, w.key, w.uploadID, nil); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
@@ -0,0 +1,125 @@
+//go:build include_storj
+
+package storj
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+)
+
+var skipCheck func(tb testing.TB)
+
+func init() {
+	// Skip the Storj storage driver tests if environment variable
+	// parameters are not provided
+	skipCheck = func(tb testing.TB) {
+		tb.Helper()
+
+		if os.Getenv("STORJ_ACCESS_GRANT") == "" || os.Getenv("REGISTRY_STORAGE_STORJ_BUCKET") == "" {
+			tb.Skip("The following environment variables must be set to enable these tests: STORJ_ACCESS_GRANT, REGISTRY_STORAGE_STORJ_BUCKET")
+		}
+	}
+}
+
+func newDriverConstructor(tb testing.TB) testsuites.DriverConstructor {
+	root := tb.TempDir()
+
+	return func() (storagedriver.StorageDriver, error) {
+		return New(context.Background(), driverParameters{
+			accessGrant:    os.Getenv("STORJ_ACCESS_GRANT"),
+			bucket:         os.Getenv("REGISTRY_STORAGE_STORJ_BUCKET"),
+			rootDirectory:  root,
+			chunkSize:      minChunkSize,
+			maxConcurrency: 8,
+		})
+	}
+}
+
+func TestStorjDriverSuite(t *testing.T) {
+	skipCheck(t)
+	testsuites.Driver(t, newDriverConstructor(t))
+}
+
+func BenchmarkStorjDriverSuite(b *testing.B) {
+	skipCheck(b)
+	testsuites.BenchDriver(b, newDriverConstructor(b))
+}
+
+func TestFromParameters(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		parameters map[string]interface{}
+		err        string
+	}{
+		{map[string]interface{}{"accessgrant": "grant"}, "no bucket parameter provided"},
+		{map[string]interface{}{"bucket": "registry"}, "either accessgrant, or satelliteaddress, apikey and passphrase must be provided"},
+		{map[string]interface{}{"bucket": "registry", "apikey": "key", "passphrase": "secret"}, "either accessgrant, or satelliteaddress, apikey and passphrase must be provided"},
+		{map[string]interface{}{"bucket": "registry", "accessgrant": "grant", "passphrase": "secret"}, "accessgrant may not be provided with"},
+		{map[string]interface{}{"bucket": "registry", "accessgrant": "grant", "chunksize": "big"}, "chunksize must be an integer"},
+		{map[string]interface{}{"bucket": "registry", "accessgrant": "grant", "chunksize": 1024}, "chunksize 1024 must be larger than or equal to"},
+		{map[string]interface{}{"bucket": "registry", "accessgrant": "grant", "maxconcurrency": "many"}, "maxconcurrency config error"},
+		{map[string]interface{}{"bucket": "registry", "accessgrant": "grant"}, "invalid storj access"},
+	} {
+		if _, err := FromParameters(ctx, tc.parameters); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.parameters, tc.err, err)
+		}
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	skipCheck(t)
+	ctx := context.Background()
+
+	d, err := newDriverConstructor(t)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte(strings.Repeat("0123456789abcdef", (minChunkSize+minChunkSize/2)/16))
+	w, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content[:minChunkSize+10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload session object is hidden
+	if _, err := d.Stat(ctx, "/upload"); err == nil {
+		t.Fatal("expected the upload session to be hidden")
+	}
+
+	w, err = d.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != minChunkSize+10 {
+		t.Fatalf("unexpected size: %d", w.Size())
+	}
+	if _, err := w.Write(content[minChunkSize+10:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetContent(ctx, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Fatal("content mismatch")
+	}
+	if err := d.Delete(ctx, "/upload"); err != nil {
+		t.Fatal(err)
+	}
+}
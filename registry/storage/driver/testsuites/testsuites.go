@@ -44,6 +44,9 @@ type DriverSuite struct {
 	Teardown    DriverTeardown
 	storagedriver.StorageDriver
 	ctx context.Context
+
+	// skipLargeStreams skips the tests writing streams of gigabytes.
+	skipLargeStreams bool
 }
 
 // Driver runs [DriverSuite] for the given [DriverConstructor].
@@ -54,6 +57,18 @@ func Driver(t *testing.T, driverConstructor DriverConstructor) {
 	})
 }
 
+// DriverWithoutLargeStreams runs [DriverSuite] for the given
+// [DriverConstructor], except for the tests writing streams of gigabytes,
+// which would not fit the test timeout for drivers wrapping several
+// in-memory drivers.
+func DriverWithoutLargeStreams(t *testing.T, driverConstructor DriverConstructor) {
+	suite.Run(t, &DriverSuite{
+		Constructor:      driverConstructor,
+		ctx:              context.Background(),
+		skipLargeStreams: true,
+	})
+}
+
 // SetupSuite implements [suite.SetupAllSuite] interface.
 func (suite *DriverSuite) SetupSuite() {
 	d, err := suite.Constructor()
@@ -266,6 +281,9 @@ func (suite *DriverSuite) TestWriteReadLargeStreams() {
 	if testing.Short() {
 		suite.T().Skip("Skipping test in short mode")
 	}
+	if suite.skipLargeStreams {
+		suite.T().Skip("Skipping large streams for this driver")
+	}
 
 	filename := randomPath(32)
 	defer suite.deletePath(firstPart(filename))
@@ -445,6 +463,80 @@ func (suite *DriverSuite) testContinueStreamAppend(chunkSize int64) {
 	suite.Require().Equal(fullContents.Bytes(), received)
 }
 
+// TestWriterSize checks that the size of a FileWriter counts every byte
+// written to it, including the bytes the driver still buffers, until the
+// content is committed.
+func (suite *DriverSuite) TestWriterSize() {
+	filename := randomPath(32)
+	defer suite.deletePath(firstPart(filename))
+
+	contents := randomContents(96)
+	writer, err := suite.StorageDriver.Writer(suite.ctx, filename, false)
+	suite.Require().NoError(err)
+	suite.Require().Equal(int64(0), writer.Size())
+
+	for i := 0; i < len(contents); i += 32 {
+		nn, err := writer.Write(contents[i : i+32])
+		suite.Require().NoError(err)
+		suite.Require().Equal(32, nn)
+		suite.Require().Equal(int64(i+32), writer.Size())
+	}
+
+	err = writer.Commit(suite.ctx)
+	suite.Require().NoError(err)
+	suite.Require().Equal(int64(len(contents)), writer.Size())
+	err = writer.Close()
+	suite.Require().NoError(err)
+	suite.Require().Equal(int64(len(contents)), writer.Size())
+
+	received, err := suite.StorageDriver.GetContent(suite.ctx, filename)
+	suite.Require().NoError(err)
+	suite.Require().Equal(contents, received)
+}
+
+// TestAppend tests that content written with storagedriver.Append is appended
+// to the uncommitted content of a path, whether or not the driver natively
+// supports appends.
+func (suite *DriverSuite) TestAppend() {
+	filename := randomPath(32)
+	defer suite.deletePath(firstPart(filename))
+
+	chunkSize := int64(32)
+	var fullContents bytes.Buffer
+	contents := io.TeeReader(newRandReader(chunkSize*2), &fullContents)
+
+	writer, err := suite.StorageDriver.Writer(suite.ctx, filename, false)
+	suite.Require().NoError(err)
+	_, err = io.CopyN(writer, contents, chunkSize)
+	suite.Require().NoError(err)
+	err = writer.Close()
+	suite.Require().NoError(err)
+
+	if appender, ok := suite.StorageDriver.(storagedriver.Appender); ok {
+		writer, err = appender.Append(suite.ctx, filename)
+		if err == nil {
+			err = writer.Close()
+			suite.Require().NoError(err)
+		} else {
+			suite.Require().ErrorAs(err, &storagedriver.ErrUnsupportedMethod{})
+		}
+	}
+
+	writer, err = storagedriver.Append(suite.ctx, suite.StorageDriver, filename)
+	suite.Require().NoError(err)
+	suite.Require().Equal(chunkSize, writer.Size())
+	_, err = io.CopyN(writer, contents, chunkSize)
+	suite.Require().NoError(err)
+	err = writer.Commit(context.Background())
+	suite.Require().NoError(err)
+	err = writer.Close()
+	suite.Require().NoError(err)
+
+	received, err := suite.StorageDriver.GetContent(suite.ctx, filename)
+	suite.Require().NoError(err)
+	suite.Require().Equal(fullContents.Bytes(), received)
+}
+
 // TestReadNonexistentStream tests that reading a stream for a nonexistent path
 // fails.
 func (suite *DriverSuite) TestReadNonexistentStream() {
@@ -636,6 +728,31 @@ func (suite *DriverSuite) TestMove() {
 	suite.Require().Contains(err.Error(), suite.Name())
 }
 
+// TestTransfer tests that storagedriver.Transfer copies content to another
+// path, keeping the source, whether or not the driver copies it server-side.
+func (suite *DriverSuite) TestTransfer() {
+	contents := randomContents(32)
+	sourcePath := randomPath(32)
+	destPath := randomPath(32)
+
+	defer suite.deletePath(firstPart(sourcePath))
+	defer suite.deletePath(firstPart(destPath))
+
+	err := suite.StorageDriver.PutContent(suite.ctx, sourcePath, contents)
+	suite.Require().NoError(err)
+
+	err = storagedriver.Transfer(suite.ctx, suite.StorageDriver, sourcePath, suite.StorageDriver, destPath)
+	suite.Require().NoError(err)
+
+	received, err := suite.StorageDriver.GetContent(suite.ctx, destPath)
+	suite.Require().NoError(err)
+	suite.Require().Equal(contents, received)
+
+	received, err = suite.StorageDriver.GetContent(suite.ctx, sourcePath)
+	suite.Require().NoError(err)
+	suite.Require().Equal(contents, received)
+}
+
 // TestMoveOverwrite checks that a moved object no longer exists at the source
 // path and overwrites the contents at the destination.
 func (suite *DriverSuite) TestMoveOverwrite() {
@@ -867,6 +984,38 @@ func (suite *DriverSuite) TestDeleteOnlyDeletesSubpaths() {
 	suite.Require().NoError(err)
 }
 
+// TestDeleteFiles tests that storagedriver.DeleteFiles deletes the given
+// files, ignoring those not found, whether or not the driver deletes files in
+// bulk.
+func (suite *DriverSuite) TestDeleteFiles() {
+	dirname := randomPath(32)
+	contents := randomContents(32)
+
+	defer suite.deletePath(firstPart(dirname))
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		filename := path.Join(dirname, randomFilename(32))
+		err := suite.StorageDriver.PutContent(suite.ctx, filename, contents)
+		suite.Require().NoError(err)
+		paths = append(paths, filename)
+	}
+	kept := path.Join(dirname, randomFilename(32))
+	err := suite.StorageDriver.PutContent(suite.ctx, kept, contents)
+	suite.Require().NoError(err)
+
+	err = storagedriver.DeleteFiles(suite.ctx, suite.StorageDriver, append(paths, path.Join(dirname, randomFilename(32))))
+	suite.Require().NoError(err)
+
+	for _, filename := range paths {
+		_, err = suite.StorageDriver.Stat(suite.ctx, filename)
+		suite.Require().ErrorAs(err, &storagedriver.PathNotFoundError{})
+	}
+	received, err := suite.StorageDriver.GetContent(suite.ctx, kept)
+	suite.Require().NoError(err)
+	suite.Require().Equal(contents, received)
+}
+
 // TestStatCall runs verifies the implementation of the storagedriver's Stat call.
 func (suite *DriverSuite) TestStatCall() {
 	content := randomContents(4096)
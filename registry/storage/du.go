@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// DiskUsageOpts contains options for DiskUsage.
+type DiskUsageOpts struct {
+	// Depth is the number of path components of the name of a repository
+	// which make its namespace, 1 if zero: the namespace of team/app is
+	// team. A repository with no more components is its own namespace.
+	Depth int
+}
+
+// DiskUsageEntry is the storage used by a repository or a namespace.
+type DiskUsageEntry struct {
+	Name string `json:"name"`
+	// Blobs and Bytes are the number and size of the blobs linked into the
+	// repositories.
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	// UniqueBytes is the size of the blobs only linked into the
+	// repositories, which deleting them would reclaim, and SharedBytes the
+	// size of the blobs also linked into others.
+	UniqueBytes int64 `json:"uniqueBytes"`
+	SharedBytes int64 `json:"sharedBytes"`
+}
+
+// DiskUsageReport is the storage used by the repositories and namespaces of a
+// registry.
+type DiskUsageReport struct {
+	// Repositories and Namespaces are sorted by decreasing size.
+	Repositories []DiskUsageEntry `json:"repositories"`
+	Namespaces   []DiskUsageEntry `json:"namespaces"`
+	// Blobs and Bytes are the number and size of the blobs of the blob
+	// store.
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	// UnreferencedBlobs and UnreferencedBytes are the number and size of
+	// the blobs linked into no repository, left to the garbage collection.
+	UnreferencedBlobs int   `json:"unreferencedBlobs"`
+	UnreferencedBytes int64 `json:"unreferencedBytes"`
+}
+
+// WriteJSON writes the report as a JSON document.
+func (r *DiskUsageReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the report as tables of the repositories and namespaces,
+// followed by a summary of the blob store.
+func (r *DiskUsageReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, table := range []struct {
+		title  string
+		usages []DiskUsageEntry
+	}{
+		{"REPOSITORY", r.Repositories},
+		{"NAMESPACE", r.Namespaces},
+	} {
+		fmt.Fprintf(tw, "%s\tBLOBS\tSIZE\tUNIQUE\tSHARED\n", table.title)
+		for _, usage := range table.usages {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", usage.Name, usage.Blobs,
+				formatBytes(usage.Bytes), formatBytes(usage.UniqueBytes), formatBytes(usage.SharedBytes))
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d blobs, %s in the blob store, %d blobs, %s unreferenced\n",
+		r.Blobs, formatBytes(r.Bytes), r.UnreferencedBlobs, formatBytes(r.UnreferencedBytes))
+	return err
+}
+
+// formatBytes formats a size in bytes with binary prefixes.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// DiskUsage reports the storage used by every repository and namespace of a
+// registry, telling apart the blobs only linked into them from the blobs
+// shared with others. It only reads the storage: the blob store is walked
+// once for the size of the blobs, and the layer links and manifest revisions
+// of the repositories for the blobs they link.
+func DiskUsage(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts DiskUsageOpts) (*DiskUsageReport, error) {
+	log := dcontext.GetLogger(ctx)
+	report := &DiskUsageReport{Repositories: []DiskUsageEntry{}, Namespaces: []DiskUsageEntry{}}
+
+	blobsPath, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[digest.Digest]int64)
+	err = storageDriver.Walk(ctx, blobsPath, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "data" {
+			return nil
+		}
+		dgst, err := digestFromPath(fileInfo.Path())
+		if err != nil {
+			return err
+		}
+		sizes[dgst] = fileInfo.Size()
+		report.Blobs++
+		report.Bytes += fileInfo.Size()
+		return nil
+	})
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return nil, fmt.Errorf("failed to walk the blob store: %v", err)
+	}
+
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, errors.New("unable to convert Namespace to RepositoryEnumerator")
+	}
+	depth := max(opts.Depth, 1)
+	linked := make(map[string]map[digest.Digest]struct{})
+	namespaces := make(map[string]map[digest.Digest]struct{})
+	err = repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		log.Debugf("measuring repository %s", repoName)
+		dgsts, err := linkedBlobs(ctx, storageDriver, repoName, sizes)
+		if err != nil {
+			return err
+		}
+		linked[repoName] = dgsts
+
+		namespace := repositoryNamespace(repoName, depth)
+		if namespaces[namespace] == nil {
+			namespaces[namespace] = make(map[digest.Digest]struct{})
+		}
+		for dgst := range dgsts {
+			namespaces[namespace][dgst] = struct{}{}
+		}
+		return nil
+	})
+	// an empty registry has no repositories directory
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return nil, err
+	}
+
+	report.Repositories = diskUsages(linked, sizes)
+	report.Namespaces = diskUsages(namespaces, sizes)
+	referenced := make(map[digest.Digest]struct{})
+	for _, dgsts := range linked {
+		for dgst := range dgsts {
+			referenced[dgst] = struct{}{}
+		}
+	}
+	for dgst, size := range sizes {
+		if _, ok := referenced[dgst]; !ok {
+			report.UnreferencedBlobs++
+			report.UnreferencedBytes += size
+		}
+	}
+	log.Infof("measured %d repositories, %d namespaces, %d bytes in the blob store", len(report.Repositories), len(report.Namespaces), report.Bytes)
+	return report, nil
+}
+
+// linkedBlobs returns the blobs of the blob store linked into the named
+// repository, as layers or manifest revisions. The digests are read from the
+// paths of the links.
+func linkedBlobs(ctx context.Context, storageDriver driver.StorageDriver, repoName string, sizes map[digest.Digest]int64) (map[digest.Digest]struct{}, error) {
+	layersPath, err := pathFor(layersPathSpec{name: repoName})
+	if err != nil {
+		return nil, err
+	}
+	revisionsPath, err := pathFor(manifestRevisionsPathSpec{name: repoName})
+	if err != nil {
+		return nil, err
+	}
+
+	dgsts := make(map[digest.Digest]struct{})
+	for _, root := range []string{layersPath, revisionsPath} {
+		err := storageDriver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+			if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "link" {
+				return nil
+			}
+			dir := path.Dir(fileInfo.Path())
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(dir))), path.Base(dir))
+			// inline manifests and links to missing blobs use no blob
+			if _, ok := sizes[dgst]; ok {
+				dgsts[dgst] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+			return nil, err
+		}
+	}
+	return dgsts, nil
+}
+
+// repositoryNamespace returns the namespace of a repository, made of the
+// first depth components of its name.
+func repositoryNamespace(repoName string, depth int) string {
+	components := strings.Split(repoName, "/")
+	if len(components) <= depth {
+		return repoName
+	}
+	return strings.Join(components[:depth], "/")
+}
+
+// diskUsages returns the usage of every group of blobs, sorted by decreasing
+// size, a blob being shared if other groups hold it too.
+func diskUsages(groups map[string]map[digest.Digest]struct{}, sizes map[digest.Digest]int64) []DiskUsageEntry {
+	holders := make(map[digest.Digest]int)
+	for _, dgsts := range groups {
+		for dgst := range dgsts {
+			holders[dgst]++
+		}
+	}
+
+	usages := make([]DiskUsageEntry, 0, len(groups))
+	for name, dgsts := range groups {
+		usage := DiskUsageEntry{Name: name, Blobs: len(dgsts)}
+		for dgst := range dgsts {
+			size := sizes[dgst]
+			usage.Bytes += size
+			if holders[dgst] > 1 {
+				usage.SharedBytes += size
+			} else {
+				usage.UniqueBytes += size
+			}
+		}
+		usages = append(usages, usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Bytes != usages[j].Bytes {
+			return usages[i].Bytes > usages[j].Bytes
+		}
+		return usages[i].Name < usages[j].Name
+	})
+	return usages
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestDiskUsage(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+
+	app := uploadRandomOCIImage(t, makeRepository(t, registry, "team/app"))
+	uploadRandomOCIImage(t, makeRepository(t, registry, "team/db"))
+	uploadRandomOCIImage(t, makeRepository(t, registry, "ubuntu"))
+
+	// a layer of team/app is shared with team/db, and one with ubuntu
+	var shared []digest.Digest
+	for dgst := range app.layers {
+		shared = append(shared, dgst)
+		if len(shared) == 2 {
+			break
+		}
+	}
+	for i, repoName := range []string{"team/db", "ubuntu"} {
+		linkPath, err := pathFor(layerLinkPathSpec{name: repoName, digest: shared[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.PutContent(ctx, linkPath, []byte(shared[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a blob is linked into no repository
+	unreferenced := []byte("unreferenced")
+	dataPath, err := pathFor(blobDataPathSpec{digest: digest.FromBytes(unreferenced)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, dataPath, unreferenced); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := DiskUsage(ctx, d, registry, DiskUsageOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[digest.Digest]int64)
+	blobs := &blobStore{driver: d}
+	err = blobs.Enumerate(ctx, func(dgst digest.Digest) error {
+		size, err := blobSize(ctx, d, dgst)
+		sizes[dgst] = size
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	if report.Blobs != len(sizes) || report.Bytes != total {
+		t.Errorf("unexpected blob store usage: %d blobs, %d bytes", report.Blobs, report.Bytes)
+	}
+	if report.UnreferencedBlobs != 1 || report.UnreferencedBytes != int64(len(unreferenced)) {
+		t.Errorf("unexpected unreferenced usage: %d blobs, %d bytes", report.UnreferencedBlobs, report.UnreferencedBytes)
+	}
+
+	usages := make(map[string]DiskUsageEntry)
+	for _, usage := range report.Repositories {
+		usages["repository "+usage.Name] = usage
+	}
+	for _, usage := range report.Namespaces {
+		usages["namespace "+usage.Name] = usage
+	}
+	if len(usages) != 5 {
+		t.Fatalf("unexpected usages: %+v", report)
+	}
+	for name, expected := range map[string]int64{
+		"repository team/app": sizes[shared[0]] + sizes[shared[1]],
+		"repository team/db":  sizes[shared[0]],
+		"repository ubuntu":   sizes[shared[1]],
+		"namespace team":      sizes[shared[1]],
+		"namespace ubuntu":    sizes[shared[1]],
+	} {
+		usage := usages[name]
+		if usage.SharedBytes != expected {
+			t.Errorf("unexpected shared bytes of %s: %d != %d", name, usage.SharedBytes, expected)
+		}
+		if usage.UniqueBytes+usage.SharedBytes != usage.Bytes {
+			t.Errorf("unique and shared bytes of %s do not add up: %+v", name, usage)
+		}
+	}
+	// blobs shared within a namespace are counted once
+	if n := usages["namespace team"].Bytes; n != usages["repository team/app"].Bytes+usages["repository team/db"].Bytes-sizes[shared[0]] {
+		t.Errorf("unexpected size of namespace team: %d", n)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"REPOSITORY", "NAMESPACE", "team/app", "1 blobs, 12 B unreferenced"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("text report does not contain %q: %s", s, buf.String())
+		}
+	}
+}
+
+func TestRepositoryNamespace(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		depth     int
+		namespace string
+	}{
+		{"ubuntu", 1, "ubuntu"},
+		{"team/app", 1, "team"},
+		{"org/team/app", 1, "org"},
+		{"org/team/app", 2, "org/team"},
+		{"org/team", 2, "org/team"},
+	} {
+		if namespace := repositoryNamespace(tc.name, tc.depth); namespace != tc.namespace {
+			t.Errorf("unexpected namespace of %s at depth %d: %s != %s", tc.name, tc.depth, namespace, tc.namespace)
+		}
+	}
+}
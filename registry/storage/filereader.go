@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 )
@@ -30,10 +31,11 @@ type fileReader struct {
 	size int64 // size is the total size, must be set.
 
 	// mutable fields
-	rc     io.ReadCloser // remote read closer
-	brd    *bufio.Reader // internal buffered io
-	offset int64         // offset is the current read offset
-	err    error         // terminal error, if set, reader is closed
+	rc       io.ReadCloser // remote read closer
+	brd      *bufio.Reader // internal buffered io
+	rcOffset int64         // rcOffset is the read offset of the remote reader
+	offset   int64         // offset is the current read offset
+	err      error         // terminal error, if set, reader is closed
 }
 
 // newFileReader initializes a file reader for the remote file. The reader
@@ -61,6 +63,7 @@ func (fr *fileReader) Read(p []byte) (n int, err error) {
 
 	n, err = rd.Read(p)
 	fr.offset += int64(n)
+	fr.rcOffset += int64(n)
 
 	// Simulate io.EOR error if we reach filesize.
 	if err == nil && fr.offset >= fr.size {
@@ -90,11 +93,9 @@ func (fr *fileReader) Seek(offset int64, whence int) (int64, error) {
 	if newOffset < 0 {
 		err = fmt.Errorf("cannot seek to negative position")
 	} else {
-		if fr.offset != newOffset {
-			fr.reset()
-		}
-
-		// No problems, set the offset.
+		// No problems, set the offset. The reader is reset by the next read
+		// if it is not at the offset, so that seeking back to the offset of
+		// the reader, as http.ServeContent does, keeps it open.
 		fr.offset = newOffset
 	}
 
@@ -113,7 +114,10 @@ func (fr *fileReader) reader() (io.Reader, error) {
 	}
 
 	if fr.rc != nil {
-		return fr.brd, nil
+		if fr.rcOffset == fr.offset {
+			return fr.brd, nil
+		}
+		fr.reset()
 	}
 
 	// If we don't have a reader, open one up.
@@ -132,6 +136,7 @@ func (fr *fileReader) reader() (io.Reader, error) {
 	}
 
 	fr.rc = rc
+	fr.rcOffset = fr.offset
 
 	if fr.brd == nil {
 		fr.brd = bufio.NewReaderSize(fr.rc, fileReaderBufferSize)
@@ -142,6 +147,19 @@ func (fr *fileReader) reader() (io.Reader, error) {
 	return fr.brd, nil
 }
 
+// file returns the local file the content is read from, for drivers that
+// read it from the filesystem, when the reader is open at the start of the
+// content and none of it has been read yet. Serving the file instead of the
+// reader lets the response be sent with sendfile, bypassing the buffers of
+// the reader.
+func (fr *fileReader) file() (*os.File, bool) {
+	if fr.err != nil || fr.rc == nil || fr.rcOffset != 0 || fr.brd.Buffered() > 0 {
+		return nil, false
+	}
+	f, ok := fr.rc.(*os.File)
+	return f, ok
+}
+
 // resetReader resets the reader, forcing the read method to open up a new
 // connection and rebuild the buffered reader. This should be called when the
 // offset and the reader will become out of sync, such as during a seek
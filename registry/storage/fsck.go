@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// FsckCategory classifies the inconsistencies found by Fsck.
+type FsckCategory string
+
+// Categories of the inconsistencies found by Fsck.
+const (
+	// FsckInvalidLink is a link which does not hold a valid digest, holds
+	// the digest of another blob than the one of its path, or whose inline
+	// content does not match its digest.
+	FsckInvalidLink FsckCategory = "invalid-link"
+	// FsckMissingBlob is a link to a blob missing from the blob store.
+	FsckMissingBlob FsckCategory = "missing-blob"
+	// FsckInvalidManifest is a manifest revision which does not parse.
+	FsckInvalidManifest FsckCategory = "invalid-manifest"
+	// FsckMissingReference is a manifest referencing a manifest or blob not
+	// linked into its repository.
+	FsckMissingReference FsckCategory = "missing-reference"
+	// FsckDanglingTag is a tag which does not point to a manifest revision
+	// of its repository.
+	FsckDanglingTag FsckCategory = "dangling-tag"
+	// FsckMissingTagIndex is a tag whose current revision is missing from
+	// the index of its revisions.
+	FsckMissingTagIndex FsckCategory = "missing-tag-index"
+)
+
+// fsckCategories lists the categories in the order they are reported.
+var fsckCategories = []FsckCategory{FsckInvalidLink, FsckMissingBlob, FsckInvalidManifest, FsckMissingReference, FsckDanglingTag, FsckMissingTagIndex}
+
+// FsckIssue is an inconsistency found by Fsck.
+type FsckIssue struct {
+	Category   FsckCategory `json:"category"`
+	Repository string       `json:"repository"`
+	// Tag is the tag of the issues of tags.
+	Tag string `json:"tag,omitempty"`
+	// Path is the path of the link or manifest revision in the storage
+	// backend.
+	Path string `json:"path"`
+	// Digest is the digest of the content missing or invalid, if known.
+	Digest  digest.Digest `json:"digest,omitempty"`
+	Message string        `json:"message"`
+}
+
+// FsckReport lists the inconsistencies of the storage of a registry.
+type FsckReport struct {
+	// Repositories, Layers, Manifests and Tags are the numbers of
+	// repositories, layer links, manifest revisions and tags checked.
+	Repositories int `json:"repositories"`
+	Layers       int `json:"layers"`
+	Manifests    int `json:"manifests"`
+	Tags         int `json:"tags"`
+	// Issues lists the inconsistencies found, by repository.
+	Issues []FsckIssue `json:"issues"`
+}
+
+// Count returns the number of issues of the category.
+func (r *FsckReport) Count(category FsckCategory) int {
+	var n int
+	for _, issue := range r.Issues {
+		if issue.Category == category {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteJSON writes the report as a JSON document.
+func (r *FsckReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the issues of the report grouped by category, followed by
+// a summary.
+func (r *FsckReport) WriteText(w io.Writer) error {
+	for _, category := range fsckCategories {
+		n := r.Count(category)
+		if n == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s (%d):\n", category, n); err != nil {
+			return err
+		}
+		for _, issue := range r.Issues {
+			if issue.Category != category {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "  %s: %s: %s\n", issue.Repository, issue.Path, issue.Message); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d repositories, %d layers, %d manifests, %d tags checked, %d issues found\n",
+		r.Repositories, r.Layers, r.Manifests, r.Tags, len(r.Issues))
+	return err
+}
+
+// FsckOpts contains options for Fsck.
+type FsckOpts struct {
+	// Repository, if set, restricts the check to the named repository.
+	Repository string
+}
+
+// Fsck checks the consistency of the storage of a registry: that the layer,
+// manifest and tag links resolve to blobs of the blob store, that the
+// manifests parse, that the content they reference is linked into their
+// repository and that the tags point to indexed manifest revisions of their
+// repository. It only reads the storage, and returns the inconsistencies
+// found; the returned error is a failure to read the storage.
+func Fsck(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts FsckOpts) (*FsckReport, error) {
+	log := dcontext.GetLogger(ctx)
+	report := &FsckReport{Issues: []FsckIssue{}}
+
+	if opts.Repository != "" {
+		if err := checkRepository(ctx, storageDriver, opts.Repository); err != nil {
+			return nil, err
+		}
+		if err := fsckRepository(ctx, storageDriver, registry, opts.Repository, report); err != nil {
+			return nil, err
+		}
+		return report, nil
+	}
+
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, errors.New("unable to convert Namespace to RepositoryEnumerator")
+	}
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		log.Debugf("checking repository %s", repoName)
+		return fsckRepository(ctx, storageDriver, registry, repoName, report)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("checked %d repositories, %d issues found", report.Repositories, len(report.Issues))
+	return report, nil
+}
+
+// fsckRepository checks the named repository, adding its issues to report.
+func fsckRepository(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, repoName string, report *FsckReport) error {
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return fmt.Errorf("failed to construct repository: %v", err)
+	}
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+
+	report.Repositories++
+	var tag string
+	issue := func(category FsckCategory, p string, dgst digest.Digest, format string, a ...interface{}) {
+		report.Issues = append(report.Issues, FsckIssue{
+			Category:   category,
+			Repository: repoName,
+			Tag:        tag,
+			Path:       p,
+			Digest:     dgst,
+			Message:    fmt.Sprintf(format, a...),
+		})
+	}
+
+	// the layer links and manifest revisions resolving to a blob
+	layersPath, err := pathFor(layersPathSpec{name: repoName})
+	if err != nil {
+		return err
+	}
+	layers, err := fsckLinks(ctx, storageDriver, layersPath, issue)
+	if err != nil {
+		return err
+	}
+	report.Layers += len(layers)
+
+	revisionsPath, err := pathFor(manifestRevisionsPathSpec{name: repoName})
+	if err != nil {
+		return err
+	}
+	revisions, err := fsckLinks(ctx, storageDriver, revisionsPath, issue)
+	if err != nil {
+		return err
+	}
+	report.Manifests += len(revisions)
+
+	for _, dgst := range sortedDigests(revisions) {
+		if !revisions[dgst] {
+			continue
+		}
+		revisionPath, err := pathFor(manifestRevisionLinkPathSpec{name: repoName, revision: dgst})
+		if err != nil {
+			return err
+		}
+		manifest, err := manifestService.Get(ctx, dgst)
+		if err != nil {
+			issue(FsckInvalidManifest, revisionPath, dgst, "manifest %s does not parse: %v", dgst, err)
+			continue
+		}
+		for _, desc := range manifest.References() {
+			// foreign layers are not pushed to the registry
+			if len(desc.URLs) > 0 {
+				continue
+			}
+			if _, ok := revisions[desc.Digest]; ok {
+				continue
+			}
+			if _, ok := layers[desc.Digest]; ok {
+				continue
+			}
+			issue(FsckMissingReference, revisionPath, desc.Digest, "manifest %s references %s, which is not linked into the repository", dgst, desc.Digest)
+		}
+	}
+
+	tagsPath, err := pathFor(manifestTagsPathSpec{name: repoName})
+	if err != nil {
+		return err
+	}
+	tagPaths, err := storageDriver.List(ctx, tagsPath)
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return err
+	}
+	sort.Strings(tagPaths)
+	for _, tagPath := range tagPaths {
+		tag = path.Base(tagPath)
+		report.Tags++
+		currentPath, err := pathFor(manifestTagCurrentPathSpec{name: repoName, tag: tag})
+		if err != nil {
+			return err
+		}
+		content, err := storageDriver.GetContent(ctx, currentPath)
+		if err != nil {
+			if errors.As(err, &driver.PathNotFoundError{}) {
+				issue(FsckDanglingTag, currentPath, "", "tag %s has no current revision", tag)
+				continue
+			}
+			return err
+		}
+		dgst, _, _, err := parseLink(content)
+		if err != nil {
+			issue(FsckInvalidLink, currentPath, "", "tag %s link does not hold a digest: %v", tag, err)
+			continue
+		}
+		if _, ok := revisions[dgst]; !ok {
+			issue(FsckDanglingTag, currentPath, dgst, "tag %s points to %s, which is not a manifest revision of the repository", tag, dgst)
+			continue
+		}
+		indexPath, err := pathFor(manifestTagIndexEntryLinkPathSpec{name: repoName, tag: tag, revision: dgst})
+		if err != nil {
+			return err
+		}
+		if _, err := storageDriver.Stat(ctx, indexPath); err != nil {
+			if !errors.As(err, &driver.PathNotFoundError{}) {
+				return err
+			}
+			issue(FsckMissingTagIndex, currentPath, dgst, "current revision %s of tag %s is missing from the tag index", dgst, tag)
+		}
+	}
+	return nil
+}
+
+// fsckLinks checks the links of the directory at root, whose paths are
+// <root>/<algorithm>/<encoded digest>/link. It returns the digests of the
+// links, mapped to whether they resolve to a blob; the links which do not are
+// reported, and not reported again as missing references.
+func fsckLinks(ctx context.Context, storageDriver driver.StorageDriver, root string, issue func(FsckCategory, string, digest.Digest, string, ...interface{})) (map[digest.Digest]bool, error) {
+	links := make(map[digest.Digest]bool)
+	err := storageDriver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+		linkPath := fileInfo.Path()
+		if fileInfo.IsDir() || path.Base(linkPath) != "link" {
+			return nil
+		}
+		dir := path.Dir(linkPath)
+		expected := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(dir))), path.Base(dir))
+		if err := expected.Validate(); err != nil {
+			issue(FsckInvalidLink, linkPath, "", "link is not at the path of a digest: %v", err)
+			return nil
+		}
+
+		content, err := storageDriver.GetContent(ctx, linkPath)
+		if err != nil {
+			return err
+		}
+		dgst, inlined, inline, err := parseLink(content)
+		if err != nil {
+			issue(FsckInvalidLink, linkPath, expected, "link does not hold a digest: %v", err)
+			links[expected] = false
+			return nil
+		}
+		if dgst != expected {
+			issue(FsckInvalidLink, linkPath, dgst, "link holds %s instead of %s", dgst, expected)
+			links[expected] = false
+			return nil
+		}
+		if inline {
+			if computed := dgst.Algorithm().FromBytes(inlined); computed != dgst {
+				issue(FsckInvalidLink, linkPath, dgst, "inline content of %s has digest %s", dgst, computed)
+				links[dgst] = false
+				return nil
+			}
+			links[dgst] = true
+			return nil
+		}
+
+		blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+		if err != nil {
+			return err
+		}
+		if _, err := storageDriver.Stat(ctx, blobPath); err != nil {
+			if !errors.As(err, &driver.PathNotFoundError{}) {
+				return err
+			}
+			issue(FsckMissingBlob, linkPath, dgst, "link to %s, which is missing from the blob store", dgst)
+			links[dgst] = false
+			return nil
+		}
+		links[dgst] = true
+		return nil
+	})
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return nil, err
+	}
+	return links, nil
+}
+
+// sortedDigests returns the digests of links, sorted.
+func sortedDigests(links map[digest.Digest]bool) []digest.Digest {
+	dgsts := make([]digest.Digest, 0, len(links))
+	for dgst := range links {
+		dgsts = append(dgsts, dgst)
+	}
+	sort.Slice(dgsts, func(i, j int) bool {
+		return dgsts[i] < dgsts[j]
+	})
+	return dgsts
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFsck(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+
+	healthy := makeRepository(t, registry, "healthy")
+	tagImages(t, healthy, "latest")
+
+	broken := makeRepository(t, registry, "broken")
+	images := tagImages(t, broken, "missing-blob", "missing-reference", "invalid-link", "missing-tag-index")
+
+	report, err := Fsck(ctx, d, registry, FsckOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("unexpected issues in a consistent registry: %+v", report.Issues)
+	}
+	if report.Repositories != 2 || report.Manifests != 5 || report.Tags != 5 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	expected := corruptRepository(t, d, "broken", images)
+
+	report, err = Fsck(ctx, d, registry, FsckOpts{Repository: "broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for category, dgst := range expected {
+		if n := report.Count(category); n != 1 {
+			t.Errorf("expected 1 %s issue, found %d: %+v", category, n, report.Issues)
+			continue
+		}
+		for _, issue := range report.Issues {
+			if issue.Category == category && issue.Digest != dgst {
+				t.Errorf("unexpected digest of %s issue: %s != %s", category, issue.Digest, dgst)
+			}
+		}
+	}
+	if report.Repositories != 1 {
+		t.Errorf("unexpected number of repositories checked: %d", report.Repositories)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for category := range expected {
+		if !strings.Contains(buf.String(), string(category)+" (1):") {
+			t.Errorf("text report does not list %s: %s", category, buf.String())
+		}
+	}
+
+	if _, err := Fsck(ctx, d, registry, FsckOpts{Repository: "unknown"}); !errors.As(err, &distribution.ErrRepositoryUnknown{}) {
+		t.Errorf("expected ErrRepositoryUnknown, got %v", err)
+	}
+}
+
+// corruptRepository corrupts the storage of the named repository, whose
+// images are tagged missing-blob, missing-reference, invalid-link and
+// missing-tag-index, returning the digest of the issue of each category.
+func corruptRepository(t *testing.T, d driver.StorageDriver, name string, images map[string]image) map[FsckCategory]digest.Digest {
+	ctx := dcontext.Background()
+	layerOf := func(im image) digest.Digest {
+		return getAnyKey(im.layers)
+	}
+	mustPath := func(spec pathSpec) string {
+		p, err := pathFor(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// the blob of a layer is missing from the blob store
+	missingBlob := layerOf(images["missing-blob"])
+	if err := d.Delete(ctx, mustPath(blobPathSpec{digest: missingBlob})); err != nil {
+		t.Fatal(err)
+	}
+	// a layer is no longer linked into the repository
+	missingReference := layerOf(images["missing-reference"])
+	if err := d.Delete(ctx, mustPath(layerLinkPathSpec{name: name, digest: missingReference})); err != nil {
+		t.Fatal(err)
+	}
+	// a layer link holds garbage
+	invalidLink := layerOf(images["invalid-link"])
+	if err := d.PutContent(ctx, mustPath(layerLinkPathSpec{name: name, digest: invalidLink}), []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	// a manifest revision does not parse
+	garbage := []byte("not a manifest")
+	invalidManifest := digest.FromBytes(garbage)
+	if err := d.PutContent(ctx, mustPath(blobDataPathSpec{digest: invalidManifest}), garbage); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, mustPath(manifestRevisionLinkPathSpec{name: name, revision: invalidManifest}), []byte(invalidManifest)); err != nil {
+		t.Fatal(err)
+	}
+	// a tag points to a manifest which was never pushed
+	if err := d.PutContent(ctx, mustPath(manifestTagCurrentPathSpec{name: name, tag: "dangling"}), []byte(digest.FromString("unknown"))); err != nil {
+		t.Fatal(err)
+	}
+	// the index of a tag is missing its current revision
+	missingTagIndex := images["missing-tag-index"].manifestDigest
+	if err := d.Delete(ctx, mustPath(manifestTagIndexPathSpec{name: name, tag: "missing-tag-index"})); err != nil {
+		t.Fatal(err)
+	}
+
+	return map[FsckCategory]digest.Digest{
+		FsckMissingBlob:      missingBlob,
+		FsckInvalidLink:      invalidLink,
+		FsckInvalidManifest:  invalidManifest,
+		FsckMissingReference: missingReference,
+		FsckDanglingTag:      digest.FromString("unknown"),
+		FsckMissingTagIndex:  missingTagIndex,
+	}
+}
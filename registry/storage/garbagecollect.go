@@ -4,12 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path"
+	"sync"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	prometheus "github.com/distribution/distribution/v3/metrics"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
+	"github.com/docker/go-metrics"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
 )
 
 func emit(format string, a ...interface{}) {
@@ -20,8 +26,125 @@ func emit(format string, a ...interface{}) {
 type GCOpts struct {
 	DryRun         bool
 	RemoveUntagged bool
+
+	// PullStats provides the pull statistics used to expire tags which
+	// are no longer pulled. It may be nil, in which case usage is not
+	// taken into account.
+	PullStats *PullStats
+
+	// RemoveUntaggedOlderThan keeps the untagged manifests pushed within the
+	// given duration when RemoveUntagged is set, so that the manifests of
+	// the pushes whose tag is not pushed yet are not deleted. It is disabled
+	// when zero.
+	RemoveUntaggedOlderThan time.Duration
+
+	// RemoveTagsNotPulledFor removes tags whose manifest has neither been
+	// pulled nor pushed within the given duration. It requires PullStats
+	// and is disabled when zero.
+	RemoveTagsNotPulledFor time.Duration
+
+	// GracePeriod keeps the blobs, layer links and untagged manifests
+	// written within the period before the collection started, or during
+	// the collection, so that the content of the pushes in progress is not
+	// collected. It must exceed the time between the upload of a blob and
+	// the push of the manifest referencing it.
+	GracePeriod time.Duration
+
+	// Barrier lets the collection run while the registry serves writes,
+	// keeping the content referenced by the writes made during the
+	// collection. It must be the barrier the registry was created with, see
+	// OnlineGC. It may be nil, in which case only the grace period protects
+	// the writes.
+	Barrier *GCBarrier
+
+	// Report, if set, is filled with the content eligible for deletion.
+	Report *GCReport
+
+	// Repository, if set, limits the collection to the named repository:
+	// only its manifests, its layer links and the blobs linked into no other
+	// repository are deleted.
+	Repository string
+
+	// Concurrency is the number of repositories marked, and of batches of
+	// blobs deleted, at once. Values below 1 mark them one at a time.
+	Concurrency int
+
+	// Progress, if set, is called as the collection progresses, one call at
+	// a time. It must not block.
+	Progress func(GCProgress)
+
+	// BeforeSweep, if set, is called once the content to delete is known,
+	// before anything is deleted, unless DryRun is set. The collection is
+	// aborted if it returns an error.
+	BeforeSweep func(context.Context) error
+
+	// RefCounter, if set, collects the garbage by reference counts: only
+	// the blobs whose count dropped to zero before the grace period are
+	// deleted, along with their layer links, without marking the
+	// registry. It must be the counter the registry was created with, see
+	// ReferenceCounting. Such collections do not delete manifests, nor
+	// collect single repositories.
+	RefCounter *RefCounter
+}
+
+// GCProgress reports the progress of a garbage collection.
+type GCProgress struct {
+	// Phase is "mark" or "sweep".
+	Phase string `json:"phase"`
+	// Repositories is the number of repositories marked.
+	Repositories int `json:"repositories,omitempty"`
+	// Manifests is the number of manifests marked.
+	Manifests int `json:"manifests,omitempty"`
+	// Marked is the number of blobs marked.
+	Marked int `json:"marked,omitempty"`
+	// Eligible is the number of blobs eligible for deletion, known once the
+	// sweep phase starts.
+	Eligible int `json:"eligible,omitempty"`
+	// Deleted is the number of blobs deleted.
+	Deleted int `json:"deleted,omitempty"`
+	// Bytes is the size of the blobs deleted.
+	Bytes int64 `json:"bytes,omitempty"`
 }
 
+// String formats the progress for logs.
+func (p GCProgress) String() string {
+	if p.Phase == "mark" {
+		return fmt.Sprintf("mark: %d repositories, %d manifests and %d blobs marked", p.Repositories, p.Manifests, p.Marked)
+	}
+	return fmt.Sprintf("sweep: %d of %d blobs deleted, %d bytes", p.Deleted, p.Eligible, p.Bytes)
+}
+
+// concurrency returns the number of repositories marked at once.
+func (opts GCOpts) concurrency() int {
+	return max(opts.Concurrency, 1)
+}
+
+// online reports whether the collection runs while the registry serves
+// writes, in which case recently written content is kept.
+func (opts GCOpts) online() bool {
+	return opts.GracePeriod > 0 || opts.Barrier != nil
+}
+
+var (
+	// gcMarkedBlobsCount is the number of blobs marked by garbage collections.
+	gcMarkedBlobsCount = prometheus.StorageNamespace.NewLabeledCounter("gc_marked_blobs", "The number of blobs marked by garbage collections", "driver")
+	// gcDeletedBlobsCount is the number of blobs deleted by garbage collections.
+	gcDeletedBlobsCount = prometheus.StorageNamespace.NewLabeledCounter("gc_deleted_blobs", "The number of blobs deleted by garbage collections", "driver")
+	// gcDeletedBytesCount is the size of the blobs deleted by garbage collections.
+	gcDeletedBytesCount = prometheus.StorageNamespace.NewLabeledCounter("gc_deleted_bytes", "The number of bytes of the blobs deleted by garbage collections", "driver")
+	// gcDurationTimer is the duration of garbage collections.
+	gcDurationTimer = prometheus.StorageNamespace.NewLabeledTimer("gc_duration", "The number of seconds garbage collections take", "driver")
+	// gcErrorsCount is the number of failed garbage collections.
+	gcErrorsCount = prometheus.StorageNamespace.NewLabeledCounter("gc_errors", "The number of failed garbage collections", "driver")
+	// gcLastSuccessGauge is the time the last garbage collection of the whole
+	// registry completed.
+	gcLastSuccessGauge = prometheus.StorageNamespace.NewLabeledGauge("gc_last_success", "The Unix time the last garbage collection of the whole registry completed", metrics.Seconds, "driver")
+)
+
+// gcSweepBatchSize is the number of blobs deleted at once, while the writes
+// recording their references are held off.
+const gcSweepBatchSize = 100
+
 // ManifestDel contains manifest structure which will be deleted
 type ManifestDel struct {
 	Name   string
@@ -31,16 +154,67 @@ type ManifestDel struct {
 
 // MarkAndSweep performs a mark and sweep of registry data
 func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) error {
+	start := time.Now()
+	var err error
+	if opts.RefCounter != nil {
+		err = sweepUnreferenced(ctx, storageDriver, opts)
+	} else {
+		err = markAndSweep(ctx, storageDriver, registry, opts)
+	}
+	if errors.Is(err, ErrGCRunning) {
+		return err
+	}
+
+	driverName := storageDriver.Name()
+	gcDurationTimer.WithValues(driverName).UpdateSince(start)
+	if err != nil {
+		gcErrorsCount.WithValues(driverName).Inc()
+		return err
+	}
+	if opts.Repository == "" {
+		gcLastSuccessGauge.WithValues(driverName).Set(float64(time.Now().Unix()))
+	}
+	return nil
+}
+
+func markAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) error {
 	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
 	if !ok {
 		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
 	}
 
+	if err := opts.Barrier.start(); err != nil {
+		return err
+	}
+	defer opts.Barrier.stop()
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	untaggedCutoff := time.Now().Add(-max(opts.GracePeriod, opts.RemoveUntaggedOlderThan))
+
 	// mark
+	// markMu guards the state shared by the repositories marked at once
+	var markMu sync.Mutex
 	markSet := make(map[digest.Digest]struct{})
 	deleteLayerSet := make(map[string][]digest.Digest)
 	manifestArr := make([]ManifestDel, 0)
-	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+	progress := GCProgress{Phase: "mark"}
+	// mark marks the blob dgst, reporting whether it was already marked
+	mark := func(dgst digest.Digest) bool {
+		markMu.Lock()
+		defer markMu.Unlock()
+		_, marked := markSet[dgst]
+		if !marked {
+			markSet[dgst] = struct{}{}
+			progress.Marked++
+		}
+		return marked
+	}
+	marked := func(dgst digest.Digest) bool {
+		markMu.Lock()
+		defer markMu.Unlock()
+		_, marked := markSet[dgst]
+		return marked
+	}
+	markRepository := func(ctx context.Context, repoName string) error {
 		emit(repoName)
 
 		var err error
@@ -53,6 +227,12 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 			return fmt.Errorf("failed to construct repository: %v", err)
 		}
 
+		if opts.PullStats != nil && opts.RemoveTagsNotPulledFor > 0 {
+			if err := removeStaleTags(ctx, repository, opts); err != nil {
+				return err
+			}
+		}
+
 		manifestService, err := repository.Manifests(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to construct manifest service: %v", err)
@@ -70,7 +250,18 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 				if err != nil {
 					return fmt.Errorf("failed to retrieve tags for digest %v: %v", dgst, err)
 				}
-				if len(tags) == 0 {
+				// keep the manifests pushed recently, which may be tagged soon
+				recent := false
+				if len(tags) == 0 && (opts.online() || opts.RemoveUntaggedOlderThan > 0) {
+					recent, err = modifiedAfter(ctx, storageDriver, manifestRevisionLinkPathSpec{name: repoName, revision: dgst}, untaggedCutoff)
+					if err != nil {
+						return fmt.Errorf("failed to stat manifest %v: %v", dgst, err)
+					}
+					if recent {
+						emit("%s: keeping recent untagged manifest %s", repoName, dgst)
+					}
+				}
+				if len(tags) == 0 && !recent {
 					// fetch all tags from repository
 					// all of these tags could contain manifest in history
 					// which means that we need check (and delete) those references when deleting manifest
@@ -82,18 +273,22 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 						}
 						return fmt.Errorf("failed to retrieve tags %v", err)
 					}
+					markMu.Lock()
 					manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags})
+					markMu.Unlock()
 					return nil
 				}
 			}
 			// Mark the manifest's blob
 			emit("%s: marking manifest %s ", repoName, dgst)
-			markSet[dgst] = struct{}{}
+			mark(dgst)
+			markMu.Lock()
+			progress.Manifests++
+			markMu.Unlock()
 
 			return markManifestReferences(dgst, manifestService, ctx, func(d digest.Digest) bool {
-				_, marked := markSet[d]
+				marked := mark(d)
 				if !marked {
-					markSet[d] = struct{}{}
 					emit("%s: marking blob %s", repoName, d)
 				}
 				return marked
@@ -110,6 +305,16 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 				return err
 			}
 		}
+
+		err = markDeltas(ctx, storageDriver, repoName, marked, func(d digest.Digest) {
+			if !mark(d) {
+				emit("%s: marking delta %s", repoName, d)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to mark deltas: %v", err)
+		}
+
 		blobService := repository.Blobs(ctx)
 		layerEnumerator, ok := blobService.(distribution.ManifestEnumerator)
 		if !ok {
@@ -118,70 +323,335 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 
 		var deleteLayers []digest.Digest
 		err = layerEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
-			if _, ok := markSet[dgst]; !ok {
-				deleteLayers = append(deleteLayers, dgst)
+			if marked(dgst) {
+				return nil
 			}
+			// keep the layers linked recently, which may be referenced by
+			// a manifest soon, along with their blob
+			recent, err := opts.writtenSince(ctx, storageDriver, layerLinkPathSpec{name: repoName, digest: dgst}, cutoff)
+			if err != nil {
+				return fmt.Errorf("failed to stat layer link %v: %v", dgst, err)
+			}
+			if recent {
+				emit("%s: keeping recent layer %s", repoName, dgst)
+				mark(dgst)
+				return nil
+			}
+			deleteLayers = append(deleteLayers, dgst)
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+
+		markMu.Lock()
+		defer markMu.Unlock()
 		if len(deleteLayers) > 0 {
 			deleteLayerSet[repoName] = deleteLayers
 		}
-		return err
-	})
+		progress.Repositories++
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+		return nil
+	}
+	var err error
+	if opts.Repository != "" {
+		if err := checkRepository(ctx, storageDriver, opts.Repository); err != nil {
+			return err
+		}
+		err = markRepository(ctx, opts.Repository)
+	} else {
+		// the repositories are marked concurrently, the enumeration stopping
+		// at the first error
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(opts.concurrency())
+		err = repositoryEnumerator.Enumerate(gctx, func(repoName string) error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			g.Go(func() error {
+				return markRepository(gctx, repoName)
+			})
+			return nil
+		})
+		if werr := g.Wait(); werr != nil {
+			err = werr
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to mark: %v", err)
 	}
+	gcMarkedBlobsCount.WithValues(storageDriver.Name()).Inc(float64(len(markSet)))
 
 	manifestArr = unmarkReferencedManifest(manifestArr, markSet)
 
+	if opts.Report != nil {
+		*opts.Report = GCReport{}
+		defer opts.Report.finish()
+		for _, obj := range manifestArr {
+			if err := opts.Report.add(ctx, storageDriver, GCReportManifest, obj.Name, obj.Digest); err != nil {
+				return fmt.Errorf("failed to report manifest %s: %v", obj.Digest, err)
+			}
+		}
+	}
+
 	// sweep
+	if !opts.DryRun && opts.BeforeSweep != nil {
+		if err := opts.BeforeSweep(ctx); err != nil {
+			return fmt.Errorf("not sweeping: %v", err)
+		}
+	}
 	vacuum := NewVacuum(ctx, storageDriver)
 	if !opts.DryRun {
 		for _, obj := range manifestArr {
-			err = vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags)
+			err = opts.Barrier.sweepRepository(obj.Name, []digest.Digest{obj.Digest}, func([]digest.Digest) error {
+				return vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags)
+			})
 			if err != nil {
 				return fmt.Errorf("failed to delete manifest %s: %v", obj.Digest, err)
 			}
 		}
 	}
-	blobService := registry.Blobs()
+	enumerateBlobs := registry.Blobs().Enumerate
+	if opts.Repository != "" {
+		enumerateBlobs = func(ctx context.Context, ingester func(digest.Digest) error) error {
+			return enumerateRepositoryBlobs(ctx, storageDriver, repositoryEnumerator, opts.Repository, manifestArr, deleteLayerSet[opts.Repository], ingester)
+		}
+	}
 	deleteSet := make(map[digest.Digest]struct{})
-	err = blobService.Enumerate(ctx, func(dgst digest.Digest) error {
+	err = enumerateBlobs(ctx, func(dgst digest.Digest) error {
 		// check if digest is in markSet. If not, delete it!
-		if _, ok := markSet[dgst]; !ok {
-			deleteSet[dgst] = struct{}{}
+		if _, ok := markSet[dgst]; ok {
+			return nil
+		}
+		recent, err := opts.writtenSince(ctx, storageDriver, blobDataPathSpec{digest: dgst}, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to stat blob %v: %v", dgst, err)
 		}
+		if recent {
+			emit("keeping recent blob %s", dgst)
+			return nil
+		}
+		deleteSet[dgst] = struct{}{}
 		return nil
 	})
 	if err != nil {
 		return fmt.Errorf("error enumerating blobs: %v", err)
 	}
 	emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", len(markSet), len(deleteSet), len(manifestArr))
+	deleteBlobs := make([]digest.Digest, 0, len(deleteSet))
 	for dgst := range deleteSet {
 		emit("blob eligible for deletion: %s", dgst)
-		if opts.DryRun {
-			continue
+		deleteBlobs = append(deleteBlobs, dgst)
+		if opts.Report != nil {
+			if err := opts.Report.add(ctx, storageDriver, GCReportBlob, "", dgst); err != nil {
+				return fmt.Errorf("failed to report blob %s: %v", dgst, err)
+			}
 		}
-		err = vacuum.RemoveBlob(string(dgst))
-		if err != nil {
-			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+	}
+	if !opts.DryRun {
+		if err := sweepBlobs(ctx, storageDriver, deleteBlobs, opts); err != nil {
+			return fmt.Errorf("failed to delete blobs: %v", err)
 		}
 	}
 
 	for repo, dgsts := range deleteLayerSet {
 		for _, dgst := range dgsts {
 			emit("%s: layer link eligible for deletion: %s", repo, dgst)
-			if opts.DryRun {
-				continue
+			if opts.Report != nil {
+				if err := opts.Report.add(ctx, storageDriver, GCReportLayer, repo, dgst); err != nil {
+					return fmt.Errorf("failed to report layer %s: %v", dgst, err)
+				}
 			}
-			err = vacuum.RemoveLayer(repo, dgst)
+		}
+		if opts.DryRun {
+			continue
+		}
+		err = opts.Barrier.sweepRepository(repo, dgsts, func(dgsts []digest.Digest) error {
+			return vacuum.RemoveLayers(repo, dgsts)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete layer links of repo %s: %v", repo, err)
+		}
+	}
+
+	return err
+}
+
+// sweepBlobs deletes the blobs in batches, opts.Concurrency batches at once,
+// reporting the progress after each batch.
+func sweepBlobs(ctx context.Context, storageDriver driver.StorageDriver, dgsts []digest.Digest, opts GCOpts) error {
+	var mu sync.Mutex
+	progress := GCProgress{Phase: "sweep", Eligible: len(dgsts)}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.concurrency())
+	vacuum := NewVacuum(ctx, storageDriver)
+	driverName := storageDriver.Name()
+	for len(dgsts) > 0 && ctx.Err() == nil {
+		batch := dgsts[:min(len(dgsts), gcSweepBatchSize)]
+		dgsts = dgsts[len(batch):]
+		g.Go(func() error {
+			return opts.Barrier.sweep(batch, func(batch []digest.Digest) error {
+				var size int64
+				for _, dgst := range batch {
+					blobSize, err := blobSize(ctx, storageDriver, dgst)
+					if err != nil {
+						return err
+					}
+					size += blobSize
+				}
+				if err := vacuum.RemoveBlobs(batch); err != nil {
+					return err
+				}
+				gcDeletedBlobsCount.WithValues(driverName).Inc(float64(len(batch)))
+				gcDeletedBytesCount.WithValues(driverName).Inc(float64(size))
+
+				mu.Lock()
+				defer mu.Unlock()
+				progress.Deleted += len(batch)
+				progress.Bytes += size
+				if opts.Progress != nil {
+					opts.Progress(progress)
+				}
+				return nil
+			})
+		})
+	}
+	return g.Wait()
+}
+
+// blobSize returns the size of the data of the blob dgst, zero if it is
+// missing.
+func blobSize(ctx context.Context, storageDriver driver.StorageDriver, dgst digest.Digest) (int64, error) {
+	blobDataPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return 0, err
+	}
+	fi, err := storageDriver.Stat(ctx, blobDataPath)
+	switch err.(type) {
+	case nil:
+		return fi.Size(), nil
+	case driver.PathNotFoundError:
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+// checkRepository returns distribution.ErrRepositoryUnknown if the named
+// repository does not exist.
+func checkRepository(ctx context.Context, storageDriver driver.StorageDriver, name string) error {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return err
+	}
+	_, err = storageDriver.Stat(ctx, path.Join(root, name, "_layers"))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return distribution.ErrRepositoryUnknown{Name: name}
+	}
+	return err
+}
+
+// errAllLinked stops the enumeration of the repositories once all the blobs
+// are found linked into one.
+var errAllLinked = errors.New("all blobs are linked")
+
+// enumerateRepositoryBlobs applies ingester to the blobs of the manifests and
+// layer links of the named repository eligible for deletion which are linked
+// into no other repository, and can therefore be deleted without marking the
+// other repositories. Blobs referenced by a repository are linked into it.
+func enumerateRepositoryBlobs(ctx context.Context, storageDriver driver.StorageDriver, repositoryEnumerator distribution.RepositoryEnumerator, name string, manifestArr []ManifestDel, layers []digest.Digest, ingester func(digest.Digest) error) error {
+	pending := make(map[digest.Digest]struct{})
+	for _, obj := range manifestArr {
+		pending[obj.Digest] = struct{}{}
+	}
+	for _, dgst := range layers {
+		pending[dgst] = struct{}{}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		if repoName == name {
+			return nil
+		}
+		for dgst := range pending {
+			linked, err := blobLinked(ctx, storageDriver, repoName, dgst)
 			if err != nil {
-				return fmt.Errorf("failed to delete layer link %s of repo %s: %v", dgst, repo, err)
+				return err
+			}
+			if linked {
+				emit("%s: blob %s linked, keeping it", repoName, dgst)
+				delete(pending, dgst)
 			}
 		}
+		if len(pending) == 0 {
+			return errAllLinked
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errAllLinked) {
+		return err
+	}
+
+	for dgst := range pending {
+		if err := ingester(dgst); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return err
+// blobLinked reports whether the blob dgst is linked into the named
+// repository, as a layer or as a manifest.
+func blobLinked(ctx context.Context, storageDriver driver.StorageDriver, name string, dgst digest.Digest) (bool, error) {
+	for _, spec := range []pathSpec{
+		layerLinkPathSpec{name: name, digest: dgst},
+		manifestRevisionLinkPathSpec{name: name, revision: dgst},
+	} {
+		linkPath, err := pathFor(spec)
+		if err != nil {
+			return false, err
+		}
+		_, err = storageDriver.Stat(ctx, linkPath)
+		if err == nil {
+			return true, nil
+		}
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// writtenSince reports whether the file of the path spec was written after
+// cutoff, in which case an online collection keeps it. Missing files were
+// not.
+func (opts GCOpts) writtenSince(ctx context.Context, storageDriver driver.StorageDriver, spec pathSpec, cutoff time.Time) (bool, error) {
+	if !opts.online() {
+		return false, nil
+	}
+	return modifiedAfter(ctx, storageDriver, spec, cutoff)
+}
+
+// modifiedAfter reports whether the file of the path spec was modified after
+// cutoff. Missing files were not.
+func modifiedAfter(ctx context.Context, storageDriver driver.StorageDriver, spec pathSpec, cutoff time.Time) (bool, error) {
+	filePath, err := pathFor(spec)
+	if err != nil {
+		return false, err
+	}
+	fi, err := storageDriver.Stat(ctx, filePath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return fi.ModTime().After(cutoff), nil
 }
 
 // unmarkReferencedManifest filters out manifest present in markSet
@@ -196,6 +666,55 @@ func unmarkReferencedManifest(manifestArr []ManifestDel, markSet map[digest.Dige
 	return filtered
 }
 
+// removeStaleTags removes the tags of the repository whose manifest has not
+// been pulled or pushed within opts.RemoveTagsNotPulledFor.
+func removeStaleTags(ctx context.Context, repository distribution.Repository, opts GCOpts) error {
+	repoName := repository.Named().Name()
+	tagService := repository.Tags(ctx)
+
+	tags, err := tagService.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to retrieve tags %v", err)
+	}
+
+	cutoff := time.Now().Add(-opts.RemoveTagsNotPulledFor)
+	for _, tag := range tags {
+		desc, err := tagService.Get(ctx, tag)
+		if err != nil {
+			if _, ok := err.(distribution.ErrTagUnknown); ok {
+				continue
+			}
+			return fmt.Errorf("failed to retrieve tag %s: %v", tag, err)
+		}
+
+		linkPath, err := pathFor(manifestTagCurrentPathSpec{name: repoName, tag: tag})
+		if err != nil {
+			return err
+		}
+
+		lastActivity, err := opts.PullStats.lastActivity(ctx, repoName, desc.Digest, linkPath)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve pull statistics for %s@%s: %v", repoName, desc.Digest, err)
+		}
+		if lastActivity.After(cutoff) {
+			continue
+		}
+
+		emit("%s: tag %s not pulled since %s, eligible for deletion", repoName, tag, lastActivity.Format(time.RFC3339))
+		if opts.DryRun {
+			continue
+		}
+		if err := tagService.Untag(ctx, tag); err != nil {
+			return fmt.Errorf("failed to delete tag %s of repo %s: %v", tag, repoName, err)
+		}
+	}
+
+	return nil
+}
+
 // markManifestReferences marks the manifest references
 func markManifestReferences(dgst digest.Digest, manifestService distribution.ManifestService, ctx context.Context, ingester func(digest.Digest) bool) error {
 	manifest, err := manifestService.Get(ctx, dgst)
@@ -1,9 +1,16 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/internal/dcontext"
@@ -702,6 +709,65 @@ func TestOrphanBlobDeleted(t *testing.T) {
 	}
 }
 
+// bulkDeletingDriver deletes files in bulk, counting the calls.
+type bulkDeletingDriver struct {
+	storagedriver.StorageDriver
+	calls int
+}
+
+func (d *bulkDeletingDriver) DeleteFiles(ctx context.Context, paths []string) error {
+	d.calls++
+	for _, path := range paths {
+		if err := d.Delete(ctx, path); err != nil && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestOrphanBlobsDeletedInBulk(t *testing.T) {
+	d := &bulkDeletingDriver{StorageDriver: inmemory.New()}
+
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "bulk")
+
+	digests, err := testutil.CreateRandomLayers(3)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+
+	if err = testutil.UploadBlobs(repo, digests); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+
+	image := uploadRandomSchema2Image(t, repo)
+
+	err = MarkAndSweep(dcontext.Background(), d, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: false,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	// the orphan blobs and their layer links are deleted with a call each
+	if d.calls != 2 {
+		t.Errorf("deleted files in bulk %d times, expected 2", d.calls)
+	}
+
+	blobs := allBlobs(t, registry)
+	for dgst := range digests {
+		if _, ok := blobs[dgst]; ok {
+			t.Errorf("Orphan layer is present: %v", dgst)
+		}
+	}
+	for dgst := range image.layers {
+		if _, ok := blobs[dgst]; !ok {
+			t.Errorf("Referenced layer is missing: %v", dgst)
+		}
+	}
+}
+
 func TestTaggedManifestlistWithUntaggedManifest(t *testing.T) {
 	ctx := dcontext.Background()
 	inmemoryDriver := inmemory.New()
@@ -923,3 +989,393 @@ func TestTaggedManifestlistWithDeletedReference(t *testing.T) {
 		t.Fatalf("Garbage collection affected storage: %d != %d", len(after), 0)
 	}
 }
+
+func TestOnlineGCKeepsRecentContent(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "online")
+
+	digests, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+	if err = testutil.UploadBlobs(repo, digests); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+	image := uploadRandomSchema2Image(t, repo)
+
+	// the orphan blob and the untagged image were written within the
+	// grace period
+	err = MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		RemoveUntagged: true,
+		GracePeriod:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	blobs := allBlobs(t, registry)
+	for dgst := range digests {
+		if _, ok := blobs[dgst]; !ok {
+			t.Errorf("Recent orphan layer was deleted: %v", dgst)
+		}
+	}
+	if _, ok := allManifests(t, makeManifestService(t, repo))[image.manifestDigest]; !ok {
+		t.Errorf("Recent untagged manifest was deleted: %v", image.manifestDigest)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	err = MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		RemoveUntagged: true,
+		GracePeriod:    time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	blobs = allBlobs(t, registry)
+	for dgst := range digests {
+		if _, ok := blobs[dgst]; ok {
+			t.Errorf("Orphan layer is present: %v", dgst)
+		}
+	}
+	if _, ok := allManifests(t, makeManifestService(t, repo))[image.manifestDigest]; ok {
+		t.Errorf("Untagged manifest is present: %v", image.manifestDigest)
+	}
+}
+
+func TestDeleteUntaggedOlderThan(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "untagged")
+
+	old := uploadRandomSchema2Image(t, repo)
+	time.Sleep(time.Second)
+	recent := uploadRandomSchema2Image(t, repo)
+
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		RemoveUntagged:          true,
+		RemoveUntaggedOlderThan: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	manifests := allManifests(t, makeManifestService(t, repo))
+	if _, ok := manifests[old.manifestDigest]; ok {
+		t.Errorf("Old untagged manifest is present: %v", old.manifestDigest)
+	}
+	if _, ok := manifests[recent.manifestDigest]; !ok {
+		t.Errorf("Recent untagged manifest was deleted: %v", recent.manifestDigest)
+	}
+	blobs := allBlobs(t, registry)
+	for dgst := range old.layers {
+		if _, ok := blobs[dgst]; ok {
+			t.Errorf("Layer of old untagged manifest is present: %v", dgst)
+		}
+	}
+	for dgst := range recent.layers {
+		if _, ok := blobs[dgst]; !ok {
+			t.Errorf("Layer of recent untagged manifest was deleted: %v", dgst)
+		}
+	}
+}
+
+// statHookDriver calls hook the first time the file at path is stat'ed.
+type statHookDriver struct {
+	storagedriver.StorageDriver
+	path string
+	hook func()
+}
+
+func (d *statHookDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if path == d.path && d.hook != nil {
+		hook := d.hook
+		d.hook = nil
+		hook()
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func TestOnlineGCKeepsContentWrittenDuringCollection(t *testing.T) {
+	ctx := dcontext.Background()
+	d := &statHookDriver{StorageDriver: inmemory.New()}
+	barrier := NewGCBarrier()
+
+	registry := createRegistry(t, d, OnlineGC(barrier))
+	repo := makeRepository(t, registry, "online")
+
+	digests, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+	if err = testutil.UploadBlobs(repo, digests); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+	orphan := getAnyKey(digests)
+	uploadRandomSchema2Image(t, repo)
+
+	// an image referencing the orphan blob is pushed once the collection
+	// has found the blob unreferenced
+	d.path, err = pathFor(blobDataPathSpec{digest: orphan})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.hook = func() {
+		manifest, err := testutil.MakeSchema2Manifest(repo, []digest.Digest{orphan})
+		if err != nil {
+			t.Fatalf("Failed to make manifest: %v", err)
+		}
+		dgst, err := makeManifestService(t, repo).Put(ctx, manifest)
+		if err != nil {
+			t.Fatalf("Failed to push manifest: %v", err)
+		}
+		if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: dgst}); err != nil {
+			t.Fatalf("Failed to tag manifest: %v", err)
+		}
+	}
+
+	err = MarkAndSweep(ctx, d, registry, GCOpts{Barrier: barrier})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if d.hook != nil {
+		t.Fatal("The orphan blob was not considered for deletion")
+	}
+	if _, err := repo.Blobs(ctx).Stat(ctx, orphan); err != nil {
+		t.Errorf("Blob referenced during the collection was deleted: %v", err)
+	}
+
+	// the next collection runs after the previous one
+	err = MarkAndSweep(ctx, d, registry, GCOpts{Barrier: barrier})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if _, err := repo.Blobs(ctx).Stat(ctx, orphan); err != nil {
+		t.Errorf("Referenced blob was deleted: %v", err)
+	}
+}
+
+func TestGCReport(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "report")
+
+	digests, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+	if err = testutil.UploadBlobs(repo, digests); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+	orphan := getAnyKey(digests)
+	image := uploadRandomSchema2Image(t, repo)
+	tagged := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: tagged.manifestDigest}); err != nil {
+		t.Fatalf("Failed to tag manifest: %v", err)
+	}
+
+	var report GCReport
+	err = MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		DryRun:         true,
+		RemoveUntagged: true,
+		Report:         &report,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	kinds := make(map[string]int)
+	sizes := make(map[digest.Digest]int64)
+	for _, entry := range report.Entries {
+		kinds[entry.Kind]++
+		sizes[entry.Digest] = entry.Size
+	}
+	// the untagged manifest, its blob and the blobs and layer links of the
+	// orphan layer and of the two layers of the untagged image, whose empty
+	// configuration is shared with the tagged image
+	if kinds[GCReportManifest] != 1 || kinds[GCReportLayer] != 3 || kinds[GCReportBlob] != 4 {
+		t.Errorf("unexpected entries: %v", kinds)
+	}
+	if sizes[image.manifestDigest] <= 0 {
+		t.Errorf("untagged manifest %s is not reported with its size", image.manifestDigest)
+	}
+	if sizes[orphan] <= 0 {
+		t.Errorf("orphan layer %s is not reported with its size", orphan)
+	}
+
+	var blobBytes int64
+	for _, entry := range report.Entries {
+		if entry.Kind == GCReportBlob {
+			blobBytes += entry.Size
+		}
+	}
+	if report.Blobs != 4 || report.Bytes != blobBytes {
+		t.Errorf("unexpected blob totals: %d blobs, %d bytes", report.Blobs, report.Bytes)
+	}
+	if len(report.Repositories) != 1 {
+		t.Fatalf("unexpected repositories: %v", report.Repositories)
+	}
+	if r := report.Repositories[0]; r.Name != "report" || r.Manifests != 1 || r.Layers != 3 || r.Bytes == 0 {
+		t.Errorf("unexpected repository report: %+v", r)
+	}
+
+	var csv strings.Builder
+	if err := report.WriteCSV(&csv); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if lines[0] != "kind,repository,digest,size" || len(lines) != len(report.Entries)+1 {
+		t.Errorf("unexpected CSV report:\n%s", csv.String())
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded GCReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON report: %v", err)
+	}
+	if len(decoded.Entries) != len(report.Entries) || decoded.Bytes != report.Bytes {
+		t.Errorf("JSON report does not match: %s", buf.String())
+	}
+
+	// nothing was deleted by the dry run
+	if _, ok := allBlobs(t, registry)[orphan]; !ok {
+		t.Errorf("dry run deleted %s", orphan)
+	}
+}
+
+func TestRepositoryScopedGC(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repoA := makeRepository(t, registry, "a")
+	repoB := makeRepository(t, registry, "b")
+
+	orphansA, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+	orphansB, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+	if err = testutil.UploadBlobs(repoA, orphansA); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+	if err = testutil.UploadBlobs(repoB, orphansB); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+	orphanA, orphanB := getAnyKey(orphansA), getAnyKey(orphansB)
+	uploadRandomSchema2Image(t, repoA)
+
+	// the layers of an image of b are also linked into a, unreferenced
+	imageB := uploadRandomSchema2Image(t, repoB)
+	for dgst, rs := range imageB.layers {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.UploadBlobs(repoA, map[digest.Digest]io.ReadSeeker{dgst: rs}); err != nil {
+			t.Fatalf("Failed to upload blob: %v", err)
+		}
+	}
+
+	err = MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{Repository: "a"})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[orphanA]; ok {
+		t.Errorf("Orphan layer of a is present: %v", orphanA)
+	}
+	if _, ok := blobs[orphanB]; !ok {
+		t.Errorf("Orphan layer of b, out of scope, was deleted: %v", orphanB)
+	}
+	for dgst := range imageB.layers {
+		if _, ok := blobs[dgst]; !ok {
+			t.Errorf("Layer referenced by b was deleted: %v", dgst)
+		}
+		if _, err := repoA.Blobs(ctx).Stat(ctx, dgst); err == nil {
+			t.Errorf("Unreferenced layer link of a is present: %v", dgst)
+		}
+		if _, err := repoB.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Errorf("Layer link of b was deleted: %v", err)
+		}
+	}
+}
+
+func TestConcurrentGC(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	var images []image
+	var orphans []digest.Digest
+	for i := 0; i < 8; i++ {
+		repo := makeRepository(t, registry, fmt.Sprintf("repo%d", i))
+		images = append(images, uploadRandomSchema2Image(t, repo))
+
+		layers, err := testutil.CreateRandomLayers(1)
+		if err != nil {
+			t.Fatalf("Failed to create random digest: %v", err)
+		}
+		if err = testutil.UploadBlobs(repo, layers); err != nil {
+			t.Fatalf("Failed to upload blob: %v", err)
+		}
+		orphans = append(orphans, getAnyKey(layers))
+	}
+
+	var progress []GCProgress
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		Concurrency: 4,
+		Progress: func(p GCProgress) {
+			progress = append(progress, p)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+	for _, dgst := range orphans {
+		if _, ok := blobs[dgst]; ok {
+			t.Errorf("Orphan layer is present: %v", dgst)
+		}
+	}
+	for _, image := range images {
+		if _, ok := blobs[image.manifestDigest]; !ok {
+			t.Errorf("Manifest was deleted: %v", image.manifestDigest)
+		}
+		for dgst := range image.layers {
+			if _, ok := blobs[dgst]; !ok {
+				t.Errorf("Layer was deleted: %v", dgst)
+			}
+		}
+	}
+
+	if len(progress) == 0 {
+		t.Fatal("no progress reported")
+	}
+	var mark, sweep GCProgress
+	for _, p := range progress {
+		if p.Phase == "mark" {
+			mark = p
+		} else {
+			sweep = p
+		}
+	}
+	if mark.Repositories != len(images) || mark.Manifests != len(images) {
+		t.Errorf("unexpected mark progress: %s", mark)
+	}
+	if sweep.Eligible != len(orphans) || sweep.Deleted != len(orphans) {
+		t.Errorf("unexpected sweep progress: %s", sweep)
+	}
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// gcLockStripes is the number of locks the repositories are spread over.
+const gcLockStripes = 64
+
+// GCBarrier coordinates the garbage collection with the writes of a registry
+// serving requests, so that content is not collected while being referenced.
+// While a collection runs, the digests of the manifests, of their references
+// and of the blobs linked into repositories are recorded, and the collector
+// keeps them. Writes to a repository hold its lock in shared mode, which the
+// collector takes in exclusive mode while deleting the manifests and links of
+// the repository, so that the references a write relies on are either
+// recorded or gone before they are checked.
+//
+// The barrier only covers the registries it is passed to with OnlineGC, in
+// the process running the collection.
+type GCBarrier struct {
+	locks [gcLockStripes]sync.RWMutex
+
+	mu      sync.Mutex
+	running bool
+	written map[digest.Digest]struct{}
+}
+
+// NewGCBarrier returns a barrier for a registry and its garbage collector.
+func NewGCBarrier() *GCBarrier {
+	return &GCBarrier{}
+}
+
+// OnlineGC returns a functional option for NewRegistry. The writes of the
+// registry go through the barrier, so that the garbage collection run with
+// the barrier in GCOpts can run while the registry serves requests.
+func OnlineGC(barrier *GCBarrier) RegistryOption {
+	return func(registry *registry) error {
+		registry.gcBarrier = barrier
+		return nil
+	}
+}
+
+// ErrGCRunning is returned when starting a garbage collection while another
+// one runs with the same barrier.
+var ErrGCRunning = errors.New("garbage collection already running")
+
+// start starts recording the written digests for a collection.
+func (b *GCBarrier) start() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running {
+		return ErrGCRunning
+	}
+	b.running = true
+	b.written = make(map[digest.Digest]struct{})
+	return nil
+}
+
+// stop stops recording the written digests once the collection is done.
+func (b *GCBarrier) stop() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running = false
+	b.written = nil
+}
+
+// record records the digests referenced by a write, if a collection runs.
+// Writes record their references before checking that they exist.
+func (b *GCBarrier) record(dgsts ...digest.Digest) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.running {
+		return
+	}
+	for _, dgst := range dgsts {
+		b.written[dgst] = struct{}{}
+	}
+}
+
+// unwritten returns the digests which were not written since the collection
+// started. It must be called with b.mu held.
+func (b *GCBarrier) unwritten(dgsts []digest.Digest) []digest.Digest {
+	filtered := make([]digest.Digest, 0, len(dgsts))
+	for _, dgst := range dgsts {
+		if _, ok := b.written[dgst]; !ok {
+			filtered = append(filtered, dgst)
+		}
+	}
+	return filtered
+}
+
+// sweep calls remove with the digests which were not written since the
+// collection started, holding off the writes recording references until
+// they are removed.
+func (b *GCBarrier) sweep(dgsts []digest.Digest, remove func([]digest.Digest) error) error {
+	if b == nil {
+		return remove(dgsts)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if dgsts = b.unwritten(dgsts); len(dgsts) == 0 {
+		return nil
+	}
+	return remove(dgsts)
+}
+
+// sweepRepository is sweep, holding the lock of the named repository so that
+// no write to the repository is in progress while its content is removed.
+func (b *GCBarrier) sweepRepository(name string, dgsts []digest.Digest, remove func([]digest.Digest) error) error {
+	if b == nil {
+		return remove(dgsts)
+	}
+	lock := b.lock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	b.mu.Lock()
+	dgsts = b.unwritten(dgsts)
+	b.mu.Unlock()
+	if len(dgsts) == 0 {
+		return nil
+	}
+	return remove(dgsts)
+}
+
+type gcLockKey struct{}
+
+// lockRepository holds the lock of the named repository in shared mode for a
+// write, returning the context of the write and the function releasing the
+// lock. Writes nested in a write holding the lock do not take it again.
+func (b *GCBarrier) lockRepository(ctx context.Context, name string) (context.Context, func()) {
+	if b == nil || ctx.Value(gcLockKey{}) == name {
+		return ctx, func() {}
+	}
+	lock := b.lock(name)
+	lock.RLock()
+	return context.WithValue(ctx, gcLockKey{}, name), lock.RUnlock
+}
+
+func (b *GCBarrier) lock(name string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &b.locks[h.Sum32()%gcLockStripes]
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// gcLockPath is the path of the lock electing the registry collecting the
+// garbage among the registries sharing the storage backend.
+var gcLockPath = path.Join(storagePathRoot, storagePathVersion, "_gc", "lock")
+
+// defaultGCLockSettle is the time a registry waits after writing the lock
+// before reading it back, so that the writes of the registries electing
+// themselves at once are settled.
+const defaultGCLockSettle = 2 * time.Second
+
+// gcLockRecord is the content of the lock.
+type gcLockRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// GCLock elects the registry collecting the garbage among the registries
+// sharing a storage backend, so that the scheduled collections of replicas
+// do not run at once. The lock is a file of the storage backend holding the
+// name of its holder until it expires. Since storage drivers cannot write a
+// file only if it does not exist, a registry writes the lock and reads it
+// back after a delay: the one whose write came last holds it.
+type GCLock struct {
+	driver driver.StorageDriver
+	holder string
+	ttl    time.Duration
+	settle time.Duration
+}
+
+// NewGCLock returns the lock of the storage backend of driver, acquired by
+// holder for ttl, which must be unique among the registries sharing it.
+func NewGCLock(driver driver.StorageDriver, holder string, ttl time.Duration) *GCLock {
+	return &GCLock{driver: driver, holder: holder, ttl: ttl, settle: defaultGCLockSettle}
+}
+
+// Acquire acquires the lock, or extends it if already held, and reports
+// whether the lock is held. It is not held if another registry holds it and
+// it did not expire.
+func (l *GCLock) Acquire(ctx context.Context) (bool, error) {
+	record, err := l.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	if record.Holder != "" && record.Holder != l.holder && time.Now().Before(record.Expires) {
+		return false, nil
+	}
+	if err := l.write(ctx); err != nil {
+		return false, err
+	}
+	if record.Holder == l.holder {
+		// already elected
+		return true, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(l.settle):
+	}
+	record, err = l.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	return record.Holder == l.holder, nil
+}
+
+// Held reports whether the lock is currently held by this registry and did
+// not expire. The collector checks it again before deleting anything, since
+// two registries may both find themselves elected when the write of one of
+// them is settled after the other read the lock back.
+func (l *GCLock) Held(ctx context.Context) (bool, error) {
+	record, err := l.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	return record.Holder == l.holder && time.Now().Before(record.Expires), nil
+}
+
+// Release releases the lock, if held.
+func (l *GCLock) Release(ctx context.Context) error {
+	record, err := l.read(ctx)
+	if err != nil || record.Holder != l.holder {
+		return err
+	}
+	err = l.driver.Delete(ctx, gcLockPath)
+	if errors.As(err, &driver.PathNotFoundError{}) {
+		return nil
+	}
+	return err
+}
+
+func (l *GCLock) read(ctx context.Context) (gcLockRecord, error) {
+	var record gcLockRecord
+	content, err := l.driver.GetContent(ctx, gcLockPath)
+	if err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return record, nil
+		}
+		return record, fmt.Errorf("reading the garbage collection lock: %w", err)
+	}
+	if err := json.Unmarshal(content, &record); err != nil {
+		// a corrupt lock is overwritten
+		return gcLockRecord{}, nil
+	}
+	return record, nil
+}
+
+func (l *GCLock) write(ctx context.Context) error {
+	content, err := json.Marshal(gcLockRecord{Holder: l.holder, Expires: time.Now().Add(l.ttl)})
+	if err != nil {
+		return err
+	}
+	if err := l.driver.PutContent(ctx, gcLockPath, content); err != nil {
+		return fmt.Errorf("writing the garbage collection lock: %w", err)
+	}
+	return nil
+}
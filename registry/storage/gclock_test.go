@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestGCLock(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	a := NewGCLock(d, "a", time.Hour)
+	b := NewGCLock(d, "b", time.Hour)
+	a.settle, b.settle = 0, 0
+
+	if ok, err := a.Acquire(ctx); err != nil || !ok {
+		t.Fatalf("a did not acquire the free lock: %v, %v", ok, err)
+	}
+	if ok, err := b.Acquire(ctx); err != nil || ok {
+		t.Fatalf("b acquired the lock held by a: %v, %v", ok, err)
+	}
+	if held, err := a.Held(ctx); err != nil || !held {
+		t.Fatalf("a does not hold the lock: %v, %v", held, err)
+	}
+	if held, err := b.Held(ctx); err != nil || held {
+		t.Fatalf("b holds the lock of a: %v, %v", held, err)
+	}
+	// renewal
+	if ok, err := a.Acquire(ctx); err != nil || !ok {
+		t.Fatalf("a did not renew the lock: %v, %v", ok, err)
+	}
+
+	// releasing a lock held by another registry is a no-op
+	if err := b.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.Acquire(ctx); err != nil || ok {
+		t.Fatalf("b acquired the lock held by a: %v, %v", ok, err)
+	}
+
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.Acquire(ctx); err != nil || !ok {
+		t.Fatalf("b did not acquire the released lock: %v, %v", ok, err)
+	}
+
+	// an expired lock is acquired by another registry
+	expiring := NewGCLock(d, "expiring", -time.Second)
+	expiring.settle = 0
+	if err := b.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := expiring.Acquire(ctx); err != nil || !ok {
+		t.Fatalf("expiring did not acquire the free lock: %v, %v", ok, err)
+	}
+	if ok, err := a.Acquire(ctx); err != nil || !ok {
+		t.Fatalf("a did not acquire the expired lock: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// Kinds of the content listed by a GCReport.
+const (
+	GCReportManifest = "manifest"
+	GCReportLayer    = "layer"
+	GCReportBlob     = "blob"
+)
+
+// GCReport lists the content eligible for deletion by a garbage collection,
+// for operators to review it and feed reclamation tooling.
+type GCReport struct {
+	// Entries lists the manifests and layer links eligible for deletion,
+	// by repository, and the blobs eligible for deletion.
+	Entries []GCReportEntry `json:"entries"`
+	// Repositories sums the entries by repository.
+	Repositories []GCRepositoryReport `json:"repositories"`
+	// Blobs is the number of blobs eligible for deletion.
+	Blobs int `json:"blobs"`
+	// Bytes is the size of the blobs eligible for deletion, which is the
+	// storage reclaimed.
+	Bytes int64 `json:"bytes"`
+}
+
+// GCReportEntry is content eligible for deletion.
+type GCReportEntry struct {
+	// Kind is GCReportManifest, GCReportLayer or GCReportBlob.
+	Kind string `json:"kind"`
+	// Repository is the repository of the manifests and layer links, empty
+	// for blobs.
+	Repository string        `json:"repository,omitempty"`
+	Digest     digest.Digest `json:"digest"`
+	// Size is the size of the blob of the content, zero if it is missing.
+	Size int64 `json:"size"`
+}
+
+// GCRepositoryReport sums the content of a repository eligible for deletion.
+type GCRepositoryReport struct {
+	Name      string `json:"name"`
+	Manifests int    `json:"manifests"`
+	Layers    int    `json:"layers"`
+	// Bytes is the size of the blobs of the manifests and layers, which are
+	// only reclaimed if no other repository references them.
+	Bytes int64 `json:"bytes"`
+}
+
+// add adds the content dgst of the repository to the report.
+func (r *GCReport) add(ctx context.Context, storageDriver driver.StorageDriver, kind, repository string, dgst digest.Digest) error {
+	size, err := blobSize(ctx, storageDriver, dgst)
+	if err != nil {
+		return err
+	}
+	r.Entries = append(r.Entries, GCReportEntry{Kind: kind, Repository: repository, Digest: dgst, Size: size})
+	return nil
+}
+
+// finish sorts the entries and sums them.
+func (r *GCReport) finish() {
+	sort.SliceStable(r.Entries, func(i, j int) bool {
+		a, b := r.Entries[i], r.Entries[j]
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		if a.Kind != b.Kind {
+			return a.Kind > b.Kind
+		}
+		return a.Digest < b.Digest
+	})
+
+	if r.Entries == nil {
+		r.Entries = []GCReportEntry{}
+	}
+	r.Repositories = []GCRepositoryReport{}
+	r.Blobs, r.Bytes = 0, 0
+	for _, entry := range r.Entries {
+		if entry.Kind == GCReportBlob {
+			r.Blobs++
+			r.Bytes += entry.Size
+			continue
+		}
+		if n := len(r.Repositories); n == 0 || r.Repositories[n-1].Name != entry.Repository {
+			r.Repositories = append(r.Repositories, GCRepositoryReport{Name: entry.Repository})
+		}
+		repository := &r.Repositories[len(r.Repositories)-1]
+		if entry.Kind == GCReportManifest {
+			repository.Manifests++
+		} else {
+			repository.Layers++
+		}
+		repository.Bytes += entry.Size
+	}
+}
+
+// WriteJSON writes the report as a JSON document.
+func (r *GCReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes the entries of the report as CSV records, with a header.
+func (r *GCReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"kind", "repository", "digest", "size"}); err != nil {
+		return err
+	}
+	for _, entry := range r.Entries {
+		if err := cw.Write([]string{entry.Kind, entry.Repository, entry.Digest.String(), strconv.FormatInt(entry.Size, 10)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// gcStatusPath is the path of the status of the last scheduled garbage
+// collection, next to the lock electing the registry running it.
+var gcStatusPath = path.Join(storagePathRoot, storagePathVersion, "_gc", "status")
+
+// GCStatus is the status of the last scheduled garbage collection. It is
+// stored in the storage backend by the registry running the collection, so
+// that all the registries sharing the backend report it.
+type GCStatus struct {
+	// Holder is the registry which ran the collection.
+	Holder string `json:"holder"`
+	// Started and Finished are the times the collection started and
+	// finished.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Error is the error the collection failed with, empty if it succeeded.
+	Error string `json:"error,omitempty"`
+	// LastSuccess is the time the last successful collection finished, zero
+	// if none did.
+	LastSuccess time.Time `json:"lastSuccess"`
+	// DryRun is true if the collection did not delete content.
+	DryRun bool `json:"dryRun"`
+	// Progress is the last progress of the mark and sweep phases.
+	Mark  GCProgress `json:"mark"`
+	Sweep GCProgress `json:"sweep"`
+}
+
+// ReadGCStatus returns the status of the last scheduled garbage collection
+// stored in the storage backend of storageDriver, which is zero if no
+// collection ran.
+func ReadGCStatus(ctx context.Context, storageDriver driver.StorageDriver) (GCStatus, error) {
+	var status GCStatus
+	content, err := storageDriver.GetContent(ctx, gcStatusPath)
+	if err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return status, nil
+		}
+		return status, fmt.Errorf("reading the garbage collection status: %w", err)
+	}
+	if err := json.Unmarshal(content, &status); err != nil {
+		return status, fmt.Errorf("decoding the garbage collection status: %w", err)
+	}
+	return status, nil
+}
+
+// WriteGCStatus stores the status of the last scheduled garbage collection
+// in the storage backend of storageDriver.
+func WriteGCStatus(ctx context.Context, storageDriver driver.StorageDriver, status GCStatus) error {
+	content, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if err := storageDriver.PutContent(ctx, gcStatusPath, content); err != nil {
+		return fmt.Errorf("writing the garbage collection status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxInlineBlobSize caps the size of the blobs stored inline in links, which
+// are always read whole.
+const maxInlineBlobSize = 1 << 20
+
+// A link storing a blob inline holds the digest of the blob, a newline and
+// the content of the blob. Links of blobs kept in the blob store only hold
+// the digest.
+
+// linkInline links the path to the provided digest, storing the content of
+// the blob after it.
+func (bs *blobStore) linkInline(ctx context.Context, path string, dgst digest.Digest, content []byte) error {
+	p := make([]byte, 0, len(dgst)+1+len(content))
+	p = append(p, dgst...)
+	p = append(p, '\n')
+	p = append(p, content...)
+	return bs.driver.PutContent(ctx, path, p)
+}
+
+// readInlineLink returns the digest linked at path, along with the content of
+// the blob if it is stored inline.
+func (bs *blobStore) readInlineLink(ctx context.Context, path string) (digest.Digest, []byte, bool, error) {
+	p, err := bs.driver.GetContent(ctx, path)
+	if err != nil {
+		return "", nil, false, err
+	}
+	return parseLink(p)
+}
+
+// parseLink parses the content of a link.
+func parseLink(p []byte) (digest.Digest, []byte, bool, error) {
+	target, content, inline := bytes.Cut(p, []byte{'\n'})
+	linked, err := digest.Parse(string(target))
+	if err != nil {
+		return "", nil, false, err
+	}
+	return linked, content, inline, nil
+}
+
+// inlineFirst reports whether the link of a blob of the given size is read
+// for its inline content before the blob store. The links of the larger
+// blobs are only read once the blob store does not find them, so that the
+// blobs stored inline remain readable when the threshold is lowered.
+func (lbs *linkedBlobStore) inlineFirst(size int64) bool {
+	return lbs.inlineThreshold > 0 && size <= lbs.inlineThreshold
+}
+
+// inlineContent returns the content of the blob stored inline in the link of
+// dgst, if it is stored inline.
+func (lbs *linkedBlobStore) inlineContent(ctx context.Context, dgst digest.Digest) ([]byte, bool, error) {
+	blobLinkPath, err := lbs.linkPath(lbs.repository.Named().Name(), dgst)
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, content, inline, err := lbs.blobStore.readInlineLink(ctx, blobLinkPath)
+	if err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return nil, false, distribution.ErrBlobUnknown
+		}
+		return nil, false, err
+	}
+	return content, inline, nil
+}
+
+// linkInlineBlob links the blob into the repository, storing its content
+// inline in the links instead of in the blob store.
+func (lbs *linkedBlobStore) linkInlineBlob(ctx context.Context, canonical v1.Descriptor, content []byte, aliases ...digest.Digest) error {
+	return lbs.writeLinks(ctx, canonical, func(path string) error {
+		return lbs.blobStore.linkInline(ctx, path, canonical.Digest, content)
+	}, aliases...)
+}
+
+// mountInline links the blob into the repository with the content stored
+// inline in the link of the source repository, if the blob is stored inline
+// there. It reports whether the blob was mounted.
+func (lbs *linkedBlobStore) mountInline(ctx context.Context, sourceRepo reference.Named, desc v1.Descriptor) (bool, error) {
+	if desc.Size > maxInlineBlobSize {
+		return false, nil
+	}
+
+	sourceLinkPath, err := lbs.linkPath(sourceRepo.Name(), desc.Digest)
+	if err != nil {
+		return false, err
+	}
+	_, content, inline, err := lbs.blobStore.readInlineLink(ctx, sourceLinkPath)
+	if err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !inline {
+		return false, nil
+	}
+	return true, lbs.linkInlineBlob(ctx, desc, content)
+}
+
+// inlineReader reads the content of a blob stored inline.
+type inlineReader struct {
+	*bytes.Reader
+}
+
+func (inlineReader) Close() error {
+	return nil
+}
+
+// serveInlineBlob serves the content of a blob stored inline, which is never
+// redirected to the storage backend.
+func serveInlineBlob(w http.ResponseWriter, r *http.Request, desc v1.Descriptor, content []byte) {
+	setBlobHeaders(w, desc)
+	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, bytes.NewReader(content))
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -34,6 +35,10 @@ type linkedBlobStore struct {
 	deleteEnabled          bool
 	resumableDigestEnabled bool
 
+	// inlineThreshold is the size up to which the content of the blobs is
+	// stored inline in their links, zero if no blob is stored inline.
+	inlineThreshold int64
+
 	// linkPath allows one to control the repository blob link set to which
 	// the blob store dispatches. This is required because manifest and layer
 	// blobs have not yet been fully merged. At some point, this functionality
@@ -56,7 +61,14 @@ func (lbs *linkedBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte
 		return nil, err
 	}
 
-	return lbs.blobStore.Get(ctx, canonical.Digest)
+	var p []byte
+	err = lbs.withInline(ctx, dgst, canonical.Size, func() (err error) {
+		p, err = lbs.blobStore.Get(ctx, canonical.Digest)
+		return err
+	}, func(content []byte) {
+		p = content
+	})
+	return p, err
 }
 
 func (lbs *linkedBlobStore) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
@@ -65,7 +77,14 @@ func (lbs *linkedBlobStore) Open(ctx context.Context, dgst digest.Digest) (io.Re
 		return nil, err
 	}
 
-	return lbs.blobStore.Open(ctx, canonical.Digest)
+	var rsc io.ReadSeekCloser
+	err = lbs.withInline(ctx, dgst, canonical.Size, func() (err error) {
+		rsc, err = lbs.blobStore.Open(ctx, canonical.Digest)
+		return err
+	}, func(content []byte) {
+		rsc = inlineReader{bytes.NewReader(content)}
+	})
+	return rsc, err
 }
 
 func (lbs *linkedBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
@@ -79,11 +98,54 @@ func (lbs *linkedBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter
 		w.Header().Set("Content-Type", canonical.MediaType)
 	}
 
-	return lbs.blobServer.ServeBlob(ctx, w, r, canonical.Digest)
+	return lbs.withInline(ctx, dgst, canonical.Size, func() error {
+		return lbs.blobServer.ServeBlob(ctx, w, r, canonical.Digest)
+	}, func(content []byte) {
+		serveInlineBlob(w, r, canonical, content)
+	})
+}
+
+// withInline calls inlined with the content of the blob stored inline in the
+// link of dgst, or global to use the blob store otherwise. The link is read
+// first for the blobs below the inline threshold, and only once global does
+// not find the blob for the larger ones.
+func (lbs *linkedBlobStore) withInline(ctx context.Context, dgst digest.Digest, size int64, global func() error, inlined func(content []byte)) error {
+	if lbs.inlineFirst(size) {
+		content, inline, err := lbs.inlineContent(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		if inline {
+			inlined(content)
+			return nil
+		}
+		return global()
+	}
+
+	err := global()
+	if err == distribution.ErrBlobUnknown && size <= maxInlineBlobSize {
+		if content, inline, inlineErr := lbs.inlineContent(ctx, dgst); inlineErr == nil && inline {
+			inlined(content)
+			return nil
+		}
+	}
+	return err
 }
 
 func (lbs *linkedBlobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.Descriptor, error) {
 	dgst := digest.FromBytes(p)
+	if lbs.inlineFirst(int64(len(p))) {
+		desc := v1.Descriptor{
+			Size:      int64(len(p)),
+			MediaType: "application/octet-stream",
+			Digest:    dgst,
+		}
+		if err := lbs.blobAccessController.SetDescriptor(ctx, dgst, desc); err != nil {
+			return v1.Descriptor{}, err
+		}
+		return desc, lbs.linkInlineBlob(ctx, desc, p)
+	}
+
 	// Place the data in the blob store first.
 	desc, err := lbs.blobStore.Put(ctx, mediaType, p)
 	if err != nil {
@@ -225,6 +287,15 @@ func (lbs *linkedBlobStore) Delete(ctx context.Context, dgst digest.Digest) erro
 		return err
 	}
 
+	if _, manifests := lbs.linkDirectoryPathSpec.(manifestRevisionsPathSpec); manifests {
+		if err := NewVacuum(ctx, lbs.driver).removePullStats(lbs.repository.Named().Name(), dgst); err != nil {
+			return err
+		}
+	}
+
+	if lbs.countsLayers() {
+		return lbs.registry.refCounter.unlinked(ctx, lbs.repository.Named().Name(), dgst)
+	}
 	return nil
 }
 
@@ -297,12 +368,27 @@ func (lbs *linkedBlobStore) mount(ctx context.Context, sourceRepo reference.Name
 		MediaType: "application/octet-stream",
 		Digest:    dgst,
 	}
+
+	// blobs stored inline in the source repository are copied inline
+	if mounted, err := lbs.mountInline(ctx, sourceRepo, desc); err != nil || mounted {
+		return desc, err
+	}
 	return desc, lbs.linkBlob(ctx, desc)
 }
 
 // newBlobUpload allocates a new upload controller with the given state.
 func (lbs *linkedBlobStore) newBlobUpload(ctx context.Context, uuid, path string, startedAt time.Time, append bool) (distribution.BlobWriter, error) {
-	fw, err := lbs.driver.Writer(ctx, path, append)
+	var (
+		fw  driver.FileWriter
+		err error
+	)
+	if append {
+		// Drivers natively appending to files resume the upload without
+		// copying the content uploaded so far.
+		fw, err = driver.Append(ctx, lbs.driver, path)
+	} else {
+		fw, err = lbs.driver.Writer(ctx, path, false)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -325,8 +411,21 @@ func (lbs *linkedBlobStore) newBlobUpload(ctx context.Context, uuid, path string
 // linkBlob links a valid, written blob into the registry under the named
 // repository for the upload controller.
 func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical v1.Descriptor, aliases ...digest.Digest) error {
+	return lbs.writeLinks(ctx, canonical, func(path string) error {
+		return lbs.blobStore.link(ctx, path, canonical.Digest)
+	}, aliases...)
+}
+
+// writeLinks calls link with the path of every link of the blob into the
+// repository.
+func (lbs *linkedBlobStore) writeLinks(ctx context.Context, canonical v1.Descriptor, link func(path string) error, aliases ...digest.Digest) error {
 	dgsts := append([]digest.Digest{canonical.Digest}, aliases...)
 
+	name := lbs.repository.Named().Name()
+	_, unlock := lbs.registry.gcBarrier.lockRepository(ctx, name)
+	defer unlock()
+	lbs.registry.gcBarrier.record(dgsts...)
+
 	// TODO(stevvooe): Need to write out mediatype for only canonical hash
 	// since we don't care about the aliases. They are generally unused except
 	// for tarsum but those versions don't care about mediatype.
@@ -340,19 +439,29 @@ func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical v1.Descripto
 		}
 		seenDigests[dgst] = struct{}{}
 
-		blobLinkPath, err := lbs.linkPath(lbs.repository.Named().Name(), dgst)
+		blobLinkPath, err := lbs.linkPath(name, dgst)
 		if err != nil {
 			return err
 		}
 
-		if err := lbs.blobStore.link(ctx, blobLinkPath, canonical.Digest); err != nil {
+		if err := link(blobLinkPath); err != nil {
 			return err
 		}
 	}
 
+	if lbs.countsLayers() {
+		return lbs.registry.refCounter.linked(ctx, name, canonical.Digest)
+	}
 	return nil
 }
 
+// countsLayers reports whether the links of the blob store are layer links
+// whose reference counts are maintained.
+func (lbs *linkedBlobStore) countsLayers() bool {
+	_, layers := lbs.linkDirectoryPathSpec.(layersPathSpec)
+	return layers && lbs.registry.refCounter != nil
+}
+
 type linkedBlobStatter struct {
 	*blobStore
 	repository distribution.Repository
@@ -372,7 +481,7 @@ func (lbs *linkedBlobStatter) Stat(ctx context.Context, dgst digest.Digest) (v1.
 		return v1.Descriptor{}, err
 	}
 
-	target, err := lbs.blobStore.readlink(ctx, blobLinkPath)
+	target, content, inline, err := lbs.blobStore.readInlineLink(ctx, blobLinkPath)
 	if err != nil {
 		switch err := err.(type) {
 		case driver.PathNotFoundError:
@@ -387,6 +496,14 @@ func (lbs *linkedBlobStatter) Stat(ctx context.Context, dgst digest.Digest) (v1.
 		dcontext.GetLogger(ctx).Warnf("looking up blob with canonical target: %v -> %v", dgst, target)
 	}
 
+	if inline {
+		return v1.Descriptor{
+			Size:      int64(len(content)),
+			MediaType: "application/octet-stream",
+			Digest:    target,
+		}, nil
+	}
+
 	// TODO(stevvooe): Look up repository local mediatype and replace that on
 	// the returned descriptor.
 
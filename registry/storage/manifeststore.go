@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/distribution/distribution/v3"
@@ -134,6 +135,20 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 func (ms *manifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Put")
 
+	ctx, unlock := ms.repository.gcBarrier.lockRepository(ctx, ms.repository.Named().Name())
+	defer unlock()
+	if err := ms.recordReferences(manifest); err != nil {
+		return "", err
+	}
+	done, err := ms.countReferences(ctx, manifest)
+	if err != nil {
+		return "", err
+	}
+	dgst, err := ms.put(ctx, manifest)
+	return dgst, done(err)
+}
+
+func (ms *manifestStore) put(ctx context.Context, manifest distribution.Manifest) (digest.Digest, error) {
 	switch manifest.(type) {
 	case *schema2.DeserializedManifest:
 		return ms.schema2Handler.Put(ctx, manifest, ms.skipDependencyVerification)
@@ -148,10 +163,83 @@ func (ms *manifestStore) Put(ctx context.Context, manifest distribution.Manifest
 	return "", fmt.Errorf("unrecognized manifest type %T", manifest)
 }
 
+// recordReferences records the manifest and its references with the garbage
+// collection barrier, before they are checked.
+func (ms *manifestStore) recordReferences(manifest distribution.Manifest) error {
+	if ms.repository.gcBarrier == nil {
+		return nil
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return err
+	}
+	dgsts := []digest.Digest{digest.FromBytes(payload)}
+	for _, desc := range manifest.References() {
+		dgsts = append(dgsts, desc.Digest)
+	}
+	ms.repository.gcBarrier.record(dgsts...)
+	return nil
+}
+
+// countReferences increments the reference counts of the blobs of a manifest
+// new to the repository before it is put, so that they are not collected
+// while it is. The returned function, called with the error of the put,
+// decrements them back if the put failed.
+func (ms *manifestStore) countReferences(ctx context.Context, manifest distribution.Manifest) (func(error) error, error) {
+	rc := ms.repository.refCounter
+	if rc == nil {
+		return func(err error) error { return err }, nil
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, err
+	}
+	dgst := digest.FromBytes(payload)
+	unlock := rc.lockManifest(ms.repository.Named().Name(), dgst)
+	if _, err := ms.blobStore.Stat(ctx, dgst); err == nil {
+		return func(err error) error {
+			unlock()
+			return err
+		}, nil
+	} else if !errors.Is(err, distribution.ErrBlobUnknown) {
+		unlock()
+		return nil, err
+	}
+
+	dgsts := manifestBlobs(dgst, manifest)
+	if err := rc.add(ctx, 1, dgsts...); err != nil {
+		unlock()
+		return nil, err
+	}
+	return func(err error) error {
+		defer unlock()
+		if err != nil {
+			if rerr := rc.add(ctx, -1, dgsts...); rerr != nil {
+				dcontext.GetLogger(ctx).Errorf("failed to restore the reference counts of manifest %s: %v", dgst, rerr)
+			}
+		}
+		return err
+	}, nil
+}
+
 // Delete removes the revision of the specified manifest.
 func (ms *manifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Delete")
-	return ms.blobStore.Delete(ctx, dgst)
+	rc := ms.repository.refCounter
+	if rc == nil {
+		return ms.blobStore.Delete(ctx, dgst)
+	}
+
+	unlock := rc.lockManifest(ms.repository.Named().Name(), dgst)
+	defer unlock()
+	dgsts := []digest.Digest{dgst}
+	if manifest, err := ms.Get(ctx, dgst); err == nil {
+		dgsts = manifestBlobs(dgst, manifest)
+	}
+	if err := ms.blobStore.Delete(ctx, dgst); err != nil {
+		return err
+	}
+	return rc.add(ctx, -1, dgsts...)
 }
 
 func (ms *manifestStore) Enumerate(ctx context.Context, ingester func(digest.Digest) error) error {
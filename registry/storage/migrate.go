@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"golang.org/x/sync/errgroup"
+)
+
+// migrateContentSize is the size up to which files are copied whole rather
+// than streamed.
+const migrateContentSize = 1 << 20
+
+// Phases of a migration.
+const (
+	MigrateBlobs        = "blobs"
+	MigrateRepositories = "repositories"
+	MigrateOther        = "other"
+	MigrateVerify       = "verify"
+)
+
+// MigrateOpts contains options for Migrate.
+type MigrateOpts struct {
+	// Concurrency is the number of files copied at once, 1 if zero.
+	Concurrency int
+	// Verify verifies the destination once copied: that its blobs match
+	// their digest and that Fsck finds no inconsistencies.
+	Verify bool
+	// Progress, if set, is called with the progress of the migration after
+	// every file copied or skipped.
+	Progress func(MigrateProgress)
+}
+
+// MigrateProgress is the progress of a migration.
+type MigrateProgress struct {
+	// Phase is MigrateBlobs, MigrateRepositories, MigrateOther or
+	// MigrateVerify.
+	Phase string `json:"phase"`
+	// Files and Bytes are the number and size of the files copied, Skipped
+	// the number of files already copied by a previous migration.
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+	Skipped int   `json:"skipped"`
+}
+
+func (p MigrateProgress) String() string {
+	return fmt.Sprintf("%s: %d files copied, %d bytes, %d files skipped", p.Phase, p.Files, p.Bytes, p.Skipped)
+}
+
+// MigrateReport is the result of a migration.
+type MigrateReport struct {
+	MigrateProgress
+	// Corrupt lists the blobs of the destination which do not match their
+	// digest, and Issues the inconsistencies of the destination, if it was
+	// verified.
+	Corrupt []CorruptBlob `json:"corrupt"`
+	Issues  []FsckIssue   `json:"issues"`
+}
+
+// Migrate copies the storage of a registry from a storage driver to another,
+// such as from the filesystem to S3. The blobs are copied first, then the
+// repositories, so that the links of the destination resolve as they are
+// copied, then the rest of the storage. The uploads in progress and the state
+// of the garbage collection are not copied.
+//
+// A migration is resumed by running it again: the blobs already in the
+// destination with the size of the source, and the other files already in
+// the destination with the content of the source, are skipped.
+func Migrate(ctx context.Context, from, to driver.StorageDriver, opts MigrateOpts) (*MigrateReport, error) {
+	log := dcontext.GetLogger(ctx)
+	m := &migration{from: from, to: to, opts: opts}
+
+	blobsPath, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	repositoriesPath, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	root := path.Join(storagePathRoot, storagePathVersion)
+
+	err = m.copyTree(ctx, MigrateBlobs, blobsPath, nil)
+	if err == nil {
+		err = m.copyTree(ctx, MigrateRepositories, repositoriesPath, func(p string) bool {
+			return path.Base(p) == "_uploads"
+		})
+	}
+	if err == nil {
+		err = m.copyTree(ctx, MigrateOther, root, func(p string) bool {
+			return p == blobsPath || p == repositoriesPath || p == path.Dir(gcStatusPath)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("migrated %d files, %d bytes, %d files skipped", m.progress.Files, m.progress.Bytes, m.progress.Skipped)
+
+	report := &MigrateReport{MigrateProgress: m.progress}
+	if !opts.Verify {
+		return report, nil
+	}
+
+	report.Phase = MigrateVerify
+	if opts.Progress != nil {
+		opts.Progress(report.MigrateProgress)
+	}
+	scrubber, err := NewScrubber(to, ScrubConfig{})
+	if err != nil {
+		return nil, err
+	}
+	// the destination has no blob store if the source had none
+	if report.Corrupt, err = scrubber.Scrub(ctx); err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return nil, fmt.Errorf("failed to verify the blobs: %v", err)
+	}
+	registry, err := NewRegistry(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	fsck, err := Fsck(ctx, to, registry, FsckOpts{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the destination: %v", err)
+	}
+	report.Issues = fsck.Issues
+	return report, nil
+}
+
+// migration is the state of a migration.
+type migration struct {
+	from, to driver.StorageDriver
+	opts     MigrateOpts
+
+	mu       sync.Mutex
+	progress MigrateProgress
+}
+
+// copyTree copies the files under root, skipping the directories for which
+// skip returns true.
+func (m *migration) copyTree(ctx context.Context, phase, root string, skip func(string) bool) error {
+	m.mu.Lock()
+	m.progress.Phase = phase
+	m.mu.Unlock()
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(m.opts.Concurrency, 1))
+	err := m.from.Walk(gctx, root, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() {
+			if skip != nil && skip(fileInfo.Path()) {
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+		g.Go(func() error {
+			copied, err := m.copyFile(gctx, fileInfo, phase == MigrateBlobs)
+			if err != nil {
+				return fmt.Errorf("failed to copy %s: %w", fileInfo.Path(), err)
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if copied {
+				m.progress.Files++
+				m.progress.Bytes += fileInfo.Size()
+			} else {
+				m.progress.Skipped++
+			}
+			if m.opts.Progress != nil {
+				m.opts.Progress(m.progress)
+			}
+			return nil
+		})
+		return nil
+	})
+	if waitErr := g.Wait(); waitErr != nil {
+		return waitErr
+	}
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return err
+	}
+	return nil
+}
+
+// copyFile copies the file unless the destination already holds it, which is
+// checked by size only for blobs, whose content is addressed by their path.
+func (m *migration) copyFile(ctx context.Context, fileInfo driver.FileInfo, blob bool) (bool, error) {
+	p := fileInfo.Path()
+	var existingSize int64 = -1
+	dst, err := m.to.Stat(ctx, p)
+	switch {
+	case errors.As(err, &driver.PathNotFoundError{}):
+	case err != nil:
+		return false, err
+	case dst.Size() == fileInfo.Size() && blob:
+		return false, nil
+	default:
+		existingSize = dst.Size()
+	}
+
+	if fileInfo.Size() <= migrateContentSize {
+		content, err := m.from.GetContent(ctx, p)
+		if err != nil {
+			return false, err
+		}
+		if existingSize == int64(len(content)) {
+			existing, err := m.to.GetContent(ctx, p)
+			if err == nil && bytes.Equal(existing, content) {
+				return false, nil
+			}
+		}
+		return true, m.to.PutContent(ctx, p, content)
+	}
+
+	r, err := m.from.Reader(ctx, p, 0)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	w, err := m.to.Writer(ctx, p, false)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Cancel(ctx)
+		return false, err
+	}
+	if err := w.Commit(ctx); err != nil {
+		_ = w.Cancel(ctx)
+		return false, err
+	}
+	return true, w.Close()
+}
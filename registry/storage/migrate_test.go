@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := dcontext.Background()
+	from := inmemory.New()
+	registry := createRegistry(t, from)
+	images := tagImages(t, makeRepository(t, registry, "a/app"), "1")
+	tagImages(t, makeRepository(t, registry, "b"), "latest")
+	if err := WriteGCStatus(ctx, from, GCStatus{Holder: "source"}); err != nil {
+		t.Fatal(err)
+	}
+
+	to := inmemory.New()
+	var progressed bool
+	report, err := Migrate(ctx, from, to, MigrateOpts{
+		Concurrency: 4,
+		Verify:      true,
+		Progress:    func(MigrateProgress) { progressed = true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files == 0 || report.Skipped != 0 || !progressed {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if len(report.Corrupt) != 0 || len(report.Issues) != 0 {
+		t.Fatalf("unexpected inconsistencies of the destination: %+v, %+v", report.Corrupt, report.Issues)
+	}
+
+	// the destination serves the repositories of the source
+	migrated := createRegistry(t, to)
+	repo := makeRepository(t, migrated, "a/app")
+	desc, err := repo.Tags(ctx).Get(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != images["1"].manifestDigest {
+		t.Fatalf("unexpected revision of migrated tag: %s", desc.Digest)
+	}
+	if _, err := makeManifestService(t, repo).Get(ctx, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := ReadGCStatus(ctx, to); err != nil || status.Holder != "" {
+		t.Fatalf("the garbage collection status was migrated: %+v, %v", status, err)
+	}
+
+	// a migration interrupted while copying a blob is resumed
+	layer := getAnyKey(images["1"].layers)
+	blobPath, err := pathFor(blobDataPathSpec{digest: layer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := to.PutContent(ctx, blobPath, []byte("trunc")); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := Migrate(ctx, from, to, MigrateOpts{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Files != 1 || resumed.Skipped != report.Files-1 {
+		t.Fatalf("unexpected report of resumed migration: %+v, first migration: %+v", resumed, report)
+	}
+	if len(resumed.Corrupt) != 0 || len(resumed.Issues) != 0 {
+		t.Fatalf("unexpected inconsistencies of the destination: %+v, %+v", resumed.Corrupt, resumed.Issues)
+	}
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ExportRepositoryLayout writes the manifests and blobs of repository to
+// the directory dir as an OCI image layout, created if missing. The index of
+// the layout lists the manifests of the repository, annotated with the name
+// of their tags. Blobs already in the layout are not written again, so that
+// several repositories can be exported to the same layout.
+func ExportRepositoryLayout(ctx context.Context, repository distribution.Repository, dir string) error {
+	return exportLayout(ctx, repository, &dirLayoutWriter{dir: dir})
+}
+
+// ExportRepositoryLayoutArchive writes the manifests and blobs of repository
+// to w as a tar archive of an OCI image layout.
+func ExportRepositoryLayoutArchive(ctx context.Context, repository distribution.Repository, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := exportLayout(ctx, repository, &tarLayoutWriter{tw: tw}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// layoutWriter writes the files of an OCI image layout.
+type layoutWriter interface {
+	writeFile(name string, size int64, r io.Reader) error
+}
+
+func exportLayout(ctx context.Context, repository distribution.Repository, lw layoutWriter) error {
+	export, err := newRepositoryExport(ctx, repository)
+	if err != nil {
+		return err
+	}
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := lw.writeFile(v1.ImageLayoutFile, int64(len(layout)), bytes.NewReader(layout)); err != nil {
+		return err
+	}
+	err = export.write(ctx, func(dgst digest.Digest, size int64, r io.Reader) error {
+		return lw.writeFile(layoutBlobPath(dgst), size, r)
+	})
+	if err != nil {
+		return err
+	}
+	// the index is written last, once the layout is complete
+	index, err := json.Marshal(export.index)
+	if err != nil {
+		return err
+	}
+	return lw.writeFile(v1.ImageIndexFile, int64(len(index)), bytes.NewReader(index))
+}
+
+// layoutBlobPath returns the path of a blob in an OCI image layout.
+func layoutBlobPath(dgst digest.Digest) string {
+	return path.Join(v1.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+type dirLayoutWriter struct {
+	dir string
+}
+
+func (w *dirLayoutWriter) writeFile(name string, size int64, r io.Reader) error {
+	p := filepath.Join(w.dir, filepath.FromSlash(name))
+	if strings.HasPrefix(name, v1.ImageBlobsDir+"/") {
+		if fi, err := os.Stat(p); err == nil && fi.Size() == size {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-"+filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+type tarLayoutWriter struct {
+	tw *tar.Writer
+}
+
+func (w *tarLayoutWriter) writeFile(name string, size int64, r io.Reader) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w.tw, r, size); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// ImportRepositoryLayout imports the manifests, blobs and tags of the OCI
+// image layout in the directory dir into repository. The manifests of the
+// index of the layout are tagged with the name they are annotated with,
+// either a tag or a reference with a tag.
+func ImportRepositoryLayout(ctx context.Context, repository distribution.Repository, dir string) error {
+	return importLayout(ctx, repository, os.DirFS(dir))
+}
+
+// ImportRepositoryLayoutArchive imports the manifests, blobs and tags of a
+// tar archive of an OCI image layout, of the given size, into repository.
+func ImportRepositoryLayoutArchive(ctx context.Context, repository distribution.Repository, r io.ReaderAt, size int64) error {
+	fsys, err := newTarFS(r, size)
+	if err != nil {
+		return err
+	}
+	return importLayout(ctx, repository, fsys)
+}
+
+func importLayout(ctx context.Context, repository distribution.Repository, fsys fs.FS) error {
+	open := func(dgst digest.Digest) (io.ReadCloser, int64, error) {
+		if err := dgst.Validate(); err != nil {
+			return nil, 0, err
+		}
+		f, err := fsys.Open(layoutBlobPath(dgst))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, 0, distribution.ErrBlobUnknown
+		} else if err != nil {
+			return nil, 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, 0, err
+		}
+		return f, fi.Size(), nil
+	}
+
+	p, err := readLayoutFile(fsys, v1.ImageLayoutFile)
+	if err != nil {
+		return fmt.Errorf("not an OCI image layout: %v", err)
+	}
+	var layout v1.ImageLayout
+	if err := json.Unmarshal(p, &layout); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", v1.ImageLayoutFile, err)
+	}
+	if layout.Version != v1.ImageLayoutVersion {
+		return fmt.Errorf("unsupported image layout version %q", layout.Version)
+	}
+
+	p, err = readLayoutFile(fsys, v1.ImageIndexFile)
+	if err != nil {
+		return err
+	}
+	var index v1.Index
+	if err := json.Unmarshal(p, &index); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", v1.ImageIndexFile, err)
+	}
+	// the media type of the index is optional in image layouts
+	if index.MediaType != "" && index.MediaType != v1.MediaTypeImageIndex {
+		return fmt.Errorf("unexpected index media type %q", index.MediaType)
+	}
+	for i, desc := range index.Manifests {
+		name, ok := desc.Annotations[v1.AnnotationRefName]
+		if !ok {
+			continue
+		}
+		tag, err := layoutTag(name)
+		if err != nil {
+			return err
+		}
+		index.Manifests[i].Annotations = map[string]string{v1.AnnotationRefName: tag}
+	}
+	return importIndex(ctx, repository, index, open)
+}
+
+// layoutTag returns the tag of the name a manifest of an image layout is
+// annotated with.
+func layoutTag(name string) (string, error) {
+	if reference.TagRegexp.FindString(name) == name {
+		return name, nil
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference name %q: %v", name, err)
+	}
+	tagged, ok := named.(reference.Tagged)
+	if !ok {
+		return "", fmt.Errorf("reference name %q has no tag", name)
+	}
+	return tagged.Tag(), nil
+}
+
+// readLayoutFile reads a file of the image layout, bounded as an index.
+func readLayoutFile(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := io.ReadAll(io.LimitReader(f, maxIndexSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(p) > maxIndexSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, maxIndexSize)
+	}
+	return p, nil
+}
+
+// tarFS serves the regular files of a tar archive, read in place.
+type tarFS struct {
+	r     io.ReaderAt
+	files map[string]*tarFile
+}
+
+type tarFile struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+func newTarFS(r io.ReaderAt, size int64) (*tarFS, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	fsys := &tarFS{r: r, files: make(map[string]*tarFile)}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fsys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// the tar reader stops at the start of the content of the file
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		fsys.files[path.Clean(strings.TrimPrefix(hdr.Name, "./"))] = &tarFile{hdr: hdr, offset: offset}
+	}
+}
+
+func (fsys *tarFS) Open(name string) (fs.File, error) {
+	f, ok := fsys.files[name]
+	if !ok || !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &openTarFile{
+		SectionReader: io.NewSectionReader(fsys.r, f.offset, f.hdr.Size),
+		info:          f.hdr.FileInfo(),
+	}, nil
+}
+
+type openTarFile struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *openTarFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *openTarFile) Close() error {
+	return nil
+}
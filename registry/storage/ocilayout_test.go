@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestExportImportRepositoryLayout(t *testing.T) {
+	ctx := dcontext.Background()
+	source := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, source, "export/layout")
+
+	image1 := uploadRandomOCIImage(t, repo)
+	image2 := uploadRandomSchema2Image(t, repo)
+	manifestList, err := testutil.MakeManifestList(source.BlobStatter(), []digest.Digest{image1.manifestDigest, image2.manifestDigest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listDigest, err := makeManifestService(t, repo).Put(ctx, manifestList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]digest.Digest{"latest": image1.manifestDigest, "list": listDigest}
+	for tag, dgst := range tags {
+		if err := repo.Tags(ctx).Tag(ctx, tag, v1.Descriptor{Digest: dgst}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "layout")
+	if err := ExportRepositoryLayout(ctx, repo, dir); err != nil {
+		t.Fatalf("unexpected error exporting to a directory: %v", err)
+	}
+	// exporting again over the layout is a no-op
+	if err := ExportRepositoryLayout(ctx, repo, dir); err != nil {
+		t.Fatalf("unexpected error exporting again: %v", err)
+	}
+	for dgst := range image1.layers {
+		if _, err := os.Stat(filepath.Join(dir, "blobs", "sha256", dgst.Encoded())); err != nil {
+			t.Errorf("layer %s not exported: %v", dgst, err)
+		}
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "layout.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := ExportRepositoryLayoutArchive(ctx, repo, f); err != nil {
+		t.Fatalf("unexpected error exporting to an archive: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, importLayout := range map[string]func(distribution.Repository) error{
+		"directory": func(r distribution.Repository) error {
+			return ImportRepositoryLayout(ctx, r, dir)
+		},
+		"archive": func(r distribution.Repository) error {
+			return ImportRepositoryLayoutArchive(ctx, r, f, fi.Size())
+		},
+	} {
+		imported := makeRepository(t, createRegistry(t, inmemory.New()), "import/layout")
+		if err := importLayout(imported); err != nil {
+			t.Fatalf("unexpected error importing the %s: %v", name, err)
+		}
+
+		manifests := allManifests(t, makeManifestService(t, imported))
+		if len(manifests) != 3 {
+			t.Errorf("unexpected number of manifests imported from the %s: %d", name, len(manifests))
+		}
+		for tag, dgst := range tags {
+			desc, err := imported.Tags(ctx).Get(ctx, tag)
+			if err != nil {
+				t.Fatalf("unexpected error getting tag %s imported from the %s: %v", tag, name, err)
+			}
+			if desc.Digest != dgst {
+				t.Errorf("tag %s imported from the %s as %s instead of %s", tag, name, desc.Digest, dgst)
+			}
+		}
+		for _, im := range []image{image1, image2} {
+			for dgst := range im.layers {
+				if _, err := imported.Blobs(ctx).Stat(ctx, dgst); err != nil {
+					t.Errorf("layer %s not imported from the %s: %v", dgst, name, err)
+				}
+			}
+		}
+	}
+
+	if err := ImportRepositoryLayout(ctx, repo, t.TempDir()); err == nil {
+		t.Error("expected an error importing a directory which is not an image layout")
+	}
+}
+
+func TestLayoutTag(t *testing.T) {
+	for name, expected := range map[string]string{
+		"latest":                         "latest",
+		"v1.0":                           "v1.0",
+		"example.com/team/app:1.2":       "1.2",
+		"docker.io/library/alpine:3.20":  "3.20",
+		"alpine:edge":                    "edge",
+		"example.com/team/app":           "",
+		"example.com/team/app:not valid": "",
+	} {
+		tag, err := layoutTag(name)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("expected an error for %q, got tag %q", name, tag)
+			}
+			continue
+		}
+		if err != nil || tag != expected {
+			t.Errorf("unexpected tag of %q: %q, %v", name, tag, err)
+		}
+	}
+}
@@ -29,6 +29,12 @@ const (
 //	│       └── <split directory content addressable storage>
 //	└── repositories
 //	    └── <name>
+//	        ├── _deltas
+//	        │   └── <target algorithm>
+//	        │       └── <target hex digest>
+//	        │           └── <base algorithm>
+//	        │               └── <base hex digest>
+//	        │                   └── link
 //	        ├── _layers
 //	        │   └── <layer links to blob store>
 //	        ├── _manifests
@@ -43,6 +49,10 @@ const (
 //	        │               └── <algorithm>
 //	        │                   └── <hex digest>
 //	        │                       └── link
+//	        ├── _stats
+//	        │   └── <algorithm>
+//	        │       └── <hex digest>
+//	        │           └── pulls
 //	        └── _uploads
 //	            └── <id>
 //	                ├── data
@@ -107,6 +117,15 @@ const (
 //	uploadDataPathSpec:             <root>/v2/repositories/<name>/_uploads/<id>/data
 //	uploadStartedAtPathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/startedat
 //	uploadHashStatePathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/hashstates/<algorithm>/<offset>
+//	uploadChunkPathSpec:            <root>/v2/repositories/<name>/_uploads/<id>/chunks/<offset>
+//
+//	Deltas:
+//
+//	deltaLinkPathSpec:              <root>/v2/repositories/<name>/_deltas/<algorithm>/<hex digest>/<base algorithm>/<base hex digest>/link
+//
+//	Pull statistics:
+//
+//	pullStatsPathSpec:              <root>/v2/repositories/<name>/_stats/<algorithm>/<hex digest>/pulls
 //
 //	Blob Store:
 //
@@ -248,6 +267,34 @@ func pathFor(spec pathSpec) (string, error) {
 			offset = "" // Limit to the prefix for listing offsets.
 		}
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "hashstates", string(v.alg), offset)...), nil
+	case uploadChunkPathSpec:
+		offset := fmt.Sprintf("%d", v.offset)
+		if v.list {
+			offset = "" // Limit to the prefix for listing chunks.
+		}
+		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "chunks", offset)...), nil
+	case pullStatsPathSpec:
+		components, err := digestPathComponents(v.digest, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(path.Join(append(append(repoPrefix, v.name, "_stats"), components...)...), "pulls"), nil
+	case deltaLinkPathSpec:
+		components, err := digestPathComponents(v.target, false)
+		if err != nil {
+			return "", err
+		}
+		deltaPathComponents := append(append(repoPrefix, v.name, "_deltas"), components...)
+		if v.list {
+			return path.Join(deltaPathComponents...), nil
+		}
+
+		baseComponents, err := digestPathComponents(v.base, false)
+		if err != nil {
+			return "", err
+		}
+		return path.Join(path.Join(append(deltaPathComponents, baseComponents...)...), "link"), nil
 	case repositoriesRootPathSpec:
 		return path.Join(repoPrefix...), nil
 	default:
@@ -445,6 +492,42 @@ type uploadHashStatePathSpec struct {
 
 func (uploadHashStatePathSpec) pathSpec() {}
 
+// uploadChunkPathSpec defines the path parameters of the file that stores a
+// chunk of an upload received out of order, starting at a byte offset beyond
+// the data of the upload. If `list` is set, then the path mapper will
+// generate a list prefix for all the chunks of the upload.
+type uploadChunkPathSpec struct {
+	name   string
+	id     string
+	offset int64
+	list   bool
+}
+
+func (uploadChunkPathSpec) pathSpec() {}
+
+// pullStatsPathSpec describes the path of the file holding the aggregated
+// pull statistics for a piece of content (manifest or layer) within a
+// repository. The contents of the file are a JSON encoded PullRecord.
+type pullStatsPathSpec struct {
+	name   string
+	digest digest.Digest
+}
+
+func (pullStatsPathSpec) pathSpec() {}
+
+// deltaLinkPathSpec describes the path of the link to the delta rebuilding
+// the target blob from the base blob within a repository. If `list` is set,
+// then the path mapper will generate a list prefix for the deltas of the
+// target, whose base is ignored.
+type deltaLinkPathSpec struct {
+	name   string
+	target digest.Digest
+	base   digest.Digest
+	list   bool
+}
+
+func (deltaLinkPathSpec) pathSpec() {}
+
 // repositoriesRootPathSpec returns the root of repositories
 type repositoriesRootPathSpec struct{}
 
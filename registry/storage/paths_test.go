@@ -25,6 +25,29 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/link",
 		},
+		{
+			spec: pullStatsPathSpec{
+				name:   "foo/bar",
+				digest: "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_stats/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/pulls",
+		},
+		{
+			spec: deltaLinkPathSpec{
+				name:   "foo/bar",
+				target: "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+				base:   "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_deltas/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/sha256/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/link",
+		},
+		{
+			spec: deltaLinkPathSpec{
+				name:   "foo/bar",
+				target: "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+				list:   true,
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_deltas/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+		},
 		{
 			spec: manifestTagsPathSpec{
 				name: "foo/bar",
@@ -83,6 +106,14 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_uploads/asdf-asdf-asdf-adsf/startedat",
 		},
+		{
+			spec: uploadChunkPathSpec{
+				name:   "foo/bar",
+				id:     "asdf-asdf-asdf-adsf",
+				offset: 1024,
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_uploads/asdf-asdf-asdf-adsf/chunks/1024",
+		},
 		{
 			spec:     layersPathSpec{name: "foo/bar"},
 			expected: "/docker/registry/v2/repositories/foo/bar/_layers",
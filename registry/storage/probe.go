@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/uuid"
+)
+
+// probeContent is the content of the probe objects.
+var probeContent = []byte("distribution storage probe\n")
+
+// ProbeDriver checks that the storage driver behaves as the registry expects,
+// by writing, reading, stating, listing, moving and deleting probe objects,
+// and by fetching their content from the redirect URL of the driver when
+// redirect is set. It catches misconfigured backends, such as S3 compatible
+// services lacking some semantics of S3, before they corrupt pushes. The
+// probe objects are deleted whether or not the checks succeed.
+func ProbeDriver(ctx context.Context, d driver.StorageDriver, redirect bool) (err error) {
+	dir := path.Join(storagePathRoot, storagePathVersion, "_probe", uuid.NewString())
+	defer func() {
+		if deleteErr := d.Delete(ctx, dir); deleteErr != nil && !errors.As(deleteErr, &driver.PathNotFoundError{}) && err == nil {
+			err = fmt.Errorf("storage probe: deleting %s: %w", dir, deleteErr)
+		}
+	}()
+
+	step := func(name string, err error) error {
+		if err != nil {
+			return fmt.Errorf("storage probe: %s: %w", name, err)
+		}
+		return nil
+	}
+
+	content := path.Join(dir, "content")
+	if err := d.PutContent(ctx, content, probeContent); err != nil {
+		return step("putting content", err)
+	}
+	if err := checkContent(ctx, d, content, probeContent); err != nil {
+		return step("getting content", err)
+	}
+
+	// uploads are written in several requests, resuming the writer
+	upload := path.Join(dir, "upload")
+	if err := probeWriter(ctx, d, upload); err != nil {
+		return step("writing an upload", err)
+	}
+
+	rc, err := d.Reader(ctx, upload, int64(len(probeContent)))
+	if err != nil {
+		return step("reading from an offset", err)
+	}
+	p, err := io.ReadAll(rc)
+	rc.Close()
+	if err == nil && !bytes.Equal(p, probeContent) {
+		err = fmt.Errorf("read %q, expected %q", p, probeContent)
+	}
+	if err != nil {
+		return step("reading from an offset", err)
+	}
+
+	if fi, err := d.Stat(ctx, content); err != nil {
+		return step("stating a file", err)
+	} else if fi.IsDir() || fi.Size() != int64(len(probeContent)) {
+		return step("stating a file", fmt.Errorf("got a size of %d and directory %t, expected a file of %d bytes", fi.Size(), fi.IsDir(), len(probeContent)))
+	}
+	if fi, err := d.Stat(ctx, dir); err != nil {
+		return step("stating a directory", err)
+	} else if !fi.IsDir() {
+		return step("stating a directory", fmt.Errorf("%s is not a directory", dir))
+	}
+
+	entries, err := d.List(ctx, dir)
+	if err != nil {
+		return step("listing a directory", err)
+	}
+	sort.Strings(entries)
+	if len(entries) != 2 || entries[0] != content || entries[1] != upload {
+		return step("listing a directory", fmt.Errorf("listed %v, expected %v", entries, []string{content, upload}))
+	}
+
+	moved := path.Join(dir, "moved", "data")
+	if err := d.Move(ctx, upload, moved); err != nil {
+		return step("moving a file", err)
+	}
+	if err := checkContent(ctx, d, moved, append(append([]byte{}, probeContent...), probeContent...)); err != nil {
+		return step("moving a file", err)
+	}
+	if _, err := d.Stat(ctx, upload); !errors.As(err, &driver.PathNotFoundError{}) {
+		return step("moving a file", fmt.Errorf("the source of the move is still found: %v", err))
+	}
+
+	if redirect {
+		if err := probeRedirect(ctx, d, content); err != nil {
+			return step("redirecting to content", err)
+		}
+	}
+
+	if err := d.Delete(ctx, dir); err != nil {
+		return step("deleting a directory", err)
+	}
+	if _, err := d.Stat(ctx, content); !errors.As(err, &driver.PathNotFoundError{}) {
+		return step("deleting a directory", fmt.Errorf("deleted content is still found: %v", err))
+	}
+	return nil
+}
+
+// checkContent checks that the content at path is expected.
+func checkContent(ctx context.Context, d driver.StorageDriver, path string, expected []byte) error {
+	p, err := d.GetContent(ctx, path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(p, expected) {
+		return fmt.Errorf("got %q, expected %q", p, expected)
+	}
+	return nil
+}
+
+// probeWriter writes the probe content twice to path, closing the writer in
+// between and resuming it, as uploads in several chunks are.
+func probeWriter(ctx context.Context, d driver.StorageDriver, path string) error {
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(probeContent); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	w, err = d.Writer(ctx, path, true)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if w.Size() != int64(len(probeContent)) {
+		return fmt.Errorf("resumed a writer of %d bytes, expected %d", w.Size(), len(probeContent))
+	}
+	if _, err := w.Write(probeContent); err != nil {
+		return err
+	}
+	if err := w.Commit(ctx); err != nil {
+		return err
+	}
+	return checkContent(ctx, d, path, append(append([]byte{}, probeContent...), probeContent...))
+}
+
+// probeRedirect fetches the content at path from its redirect URL, if the
+// driver redirects to it.
+func probeRedirect(ctx context.Context, d driver.StorageDriver, path string) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return err
+	}
+	redirectURL, err := d.RedirectURL(r, path)
+	if err != nil || redirectURL == "" {
+		return err
+	}
+
+	r, err = http.NewRequestWithContext(ctx, http.MethodGet, redirectURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching the redirect URL returned %s", resp.Status)
+	}
+	p, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(p, probeContent) {
+		return fmt.Errorf("the redirect URL returned %q, expected %q", p, probeContent)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// copyingDriver copies files instead of moving them, as some S3 compatible
+// services lacking deletes do.
+type copyingDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d copyingDriver) Move(ctx context.Context, sourcePath, destPath string) error {
+	p, err := d.GetContent(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	return d.PutContent(ctx, destPath, p)
+}
+
+// redirectingDriver redirects to url.
+type redirectingDriver struct {
+	storagedriver.StorageDriver
+	url string
+}
+
+func (d redirectingDriver) RedirectURL(*http.Request, string) (string, error) {
+	return d.url, nil
+}
+
+func TestProbeDriver(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	if err := ProbeDriver(ctx, d, true); err != nil {
+		t.Fatalf("unexpected error probing driver: %v", err)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("other content"))
+	}))
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name     string
+		driver   storagedriver.StorageDriver
+		redirect bool
+		err      string
+	}{
+		{"move", copyingDriver{d}, true, "storage probe: moving a file: the source of the move is still found"},
+		{"redirect", redirectingDriver{d, s.URL}, true, `storage probe: redirecting to content: the redirect URL returned "other content"`},
+		{"redirect disabled", redirectingDriver{d, s.URL}, false, ""},
+	} {
+		err := ProbeDriver(ctx, tc.driver, tc.redirect)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.err)) {
+			t.Errorf("%s: unexpected error %v, expected %q", tc.name, err, tc.err)
+		}
+		// the probe objects are deleted
+		if entries, err := d.List(ctx, "/docker/registry/v2/_probe"); err == nil && len(entries) != 0 {
+			t.Errorf("%s: unexpected entries %v left", tc.name, entries)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v2"
+)
+
+// PrunePolicy selects the tags of the repositories it applies to which are
+// deleted by Prune.
+type PrunePolicy struct {
+	// Repositories is the path.Match pattern of the names of the
+	// repositories the policy applies to, for instance "team/*".
+	Repositories string `yaml:"repositories"`
+	// KeepLast keeps the newest KeepLast tags of a repository, by the time
+	// they were last pushed. It is disabled when zero.
+	KeepLast int `yaml:"keeplast"`
+	// OlderThan deletes the tags last pushed longer than OlderThan ago, if
+	// not kept by KeepLast. It is disabled when zero, in which case all the
+	// tags not kept by KeepLast are deleted.
+	OlderThan time.Duration `yaml:"olderthan"`
+	// Keep lists the path.Match patterns of the tags which are always kept,
+	// for instance "latest" or "v*". They do not count towards KeepLast.
+	Keep []string `yaml:"keep"`
+	// Tags lists the regular expressions of the tags the policy prunes, for
+	// instance "pr-.*". The expressions match whole tags. The policy prunes
+	// all the tags if empty.
+	Tags []string `yaml:"tags"`
+	// Exclude lists the regular expressions of the tags which are always
+	// kept, for instance "release-.*". They do not count towards KeepLast.
+	Exclude []string `yaml:"exclude"`
+
+	tags    []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// pruneFile is the YAML representation of a file of prune policies.
+type pruneFile struct {
+	Policies []PrunePolicy `yaml:"policies"`
+}
+
+// ParsePrunePolicies parses a YAML file of prune policies.
+func ParsePrunePolicies(rd io.Reader) ([]PrunePolicy, error) {
+	p, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	var f pruneFile
+	if err := yaml.UnmarshalStrict(p, &f); err != nil {
+		return nil, err
+	}
+
+	for i := range f.Policies {
+		if err := f.Policies[i].validate(); err != nil {
+			return nil, fmt.Errorf("policy %d: %v", i, err)
+		}
+	}
+	return f.Policies, nil
+}
+
+// validate checks the policy and compiles its regular expressions.
+func (p *PrunePolicy) validate() error {
+	if p.Repositories == "" {
+		return errors.New("repositories must be set to a repository name pattern")
+	}
+	if _, err := path.Match(p.Repositories, ""); err != nil {
+		return fmt.Errorf("invalid repositories pattern %q: %v", p.Repositories, err)
+	}
+	for _, keep := range p.Keep {
+		if _, err := path.Match(keep, ""); err != nil {
+			return fmt.Errorf("invalid keep pattern %q: %v", keep, err)
+		}
+	}
+	var err error
+	if p.tags, err = compileTagPatterns(p.Tags); err != nil {
+		return err
+	}
+	if p.exclude, err = compileTagPatterns(p.Exclude); err != nil {
+		return err
+	}
+	if p.KeepLast < 0 || p.OlderThan < 0 {
+		return errors.New("keeplast and olderthan must not be negative")
+	}
+	if p.KeepLast == 0 && p.OlderThan == 0 {
+		return errors.New("keeplast or olderthan must be set")
+	}
+	return nil
+}
+
+// compileTagPatterns compiles regular expressions matching whole tags.
+func compileTagPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag pattern %q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// matches reports whether the policy applies to the named repository.
+func (p PrunePolicy) matches(name string) bool {
+	matched, _ := path.Match(p.Repositories, name)
+	return matched
+}
+
+// kept reports whether the tag is always kept, either because it is not
+// selected by the policy or because it is explicitly kept.
+func (p PrunePolicy) kept(tag string) bool {
+	for _, keep := range p.Keep {
+		if matched, _ := path.Match(keep, tag); matched {
+			return true
+		}
+	}
+	for _, re := range p.exclude {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	if len(p.tags) == 0 {
+		return false
+	}
+	for _, re := range p.tags {
+		if re.MatchString(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// PruneOpts contains options for Prune.
+type PruneOpts struct {
+	// Policies are the policies applied. The first policy matching a
+	// repository applies to it, and repositories no policy matches are not
+	// pruned.
+	Policies []PrunePolicy
+	// DryRun selects the tags without deleting them, printing the tags of
+	// the repositories pruned as a diff of the tags deleted.
+	DryRun bool
+
+	// OnDelete, if set, is called for every tag deleted, once all the tags
+	// of its repository are.
+	OnDelete func(ctx context.Context, tag PrunedTag)
+}
+
+// PrunedTag is a tag deleted by Prune.
+type PrunedTag struct {
+	Repository string
+	Tag        string
+	Descriptor v1.Descriptor
+	// Pushed is the time the tag was last pushed.
+	Pushed time.Time
+}
+
+// Prune deletes the tags selected by the policies, and returns them. The
+// tags of a repository are deleted at once: if deleting one fails, the ones
+// already deleted are restored. The manifests and blobs of the deleted tags
+// are reclaimed by the next garbage collection.
+func Prune(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts PruneOpts) ([]PrunedTag, error) {
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, errors.New("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	policies := make([]PrunePolicy, len(opts.Policies))
+	for i, policy := range opts.Policies {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("policy %d: %v", i, err)
+		}
+		policies[i] = policy
+	}
+
+	var pruned []PrunedTag
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		for _, policy := range policies {
+			if !policy.matches(repoName) {
+				continue
+			}
+			tags, err := pruneRepository(ctx, storageDriver, registry, repoName, policy, opts)
+			if err != nil {
+				return fmt.Errorf("failed to prune repository %s: %v", repoName, err)
+			}
+			pruned = append(pruned, tags...)
+			return nil
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+// pruneRepository deletes the tags of the named repository selected by the
+// policy.
+func pruneRepository(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, repoName string, policy PrunePolicy, opts PruneOpts) ([]PrunedTag, error) {
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct repository: %v", err)
+	}
+	tagService := repository.Tags(ctx)
+
+	allTags, err := tagService.All(ctx)
+	if err != nil {
+		if errors.As(err, &distribution.ErrRepositoryUnknown{}) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve tags: %v", err)
+	}
+
+	var candidates []PrunedTag
+	for _, tag := range allTags {
+		if policy.kept(tag) {
+			continue
+		}
+		desc, err := tagService.Get(ctx, tag)
+		if err != nil {
+			if errors.As(err, &distribution.ErrTagUnknown{}) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to retrieve tag %s: %v", tag, err)
+		}
+		linkPath, err := pathFor(manifestTagCurrentPathSpec{name: repoName, tag: tag})
+		if err != nil {
+			return nil, err
+		}
+		fi, err := storageDriver.Stat(ctx, linkPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat tag %s: %v", tag, err)
+		}
+		candidates = append(candidates, PrunedTag{Repository: repoName, Tag: tag, Descriptor: desc, Pushed: fi.ModTime()})
+	}
+
+	// newest first
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Pushed.After(candidates[j].Pushed)
+	})
+	candidates = candidates[min(policy.KeepLast, len(candidates)):]
+	cutoff := time.Now().Add(-policy.OlderThan)
+	var selected []PrunedTag
+	for _, candidate := range candidates {
+		if policy.OlderThan > 0 && candidate.Pushed.After(cutoff) {
+			continue
+		}
+		selected = append(selected, candidate)
+	}
+	if opts.DryRun {
+		emitPruneDiff(repoName, allTags, selected)
+	}
+	if opts.DryRun || len(selected) == 0 {
+		return selected, nil
+	}
+
+	var deleted []PrunedTag
+	for _, tag := range selected {
+		// a tag pushed again since it was selected is kept
+		desc, err := tagService.Get(ctx, tag.Tag)
+		if err == nil {
+			if desc.Digest != tag.Descriptor.Digest {
+				continue
+			}
+			err = tagService.Untag(ctx, tag.Tag)
+		}
+		if errors.As(err, &distribution.ErrTagUnknown{}) {
+			continue
+		}
+		if err != nil {
+			return nil, restoreTags(ctx, tagService, deleted, fmt.Errorf("failed to delete tag %s: %v", tag.Tag, err))
+		}
+		deleted = append(deleted, tag)
+	}
+	for _, tag := range deleted {
+		emit("%s: deleted tag %s pushed %s", repoName, tag.Tag, tag.Pushed.Format(time.RFC3339))
+	}
+
+	if opts.OnDelete != nil {
+		for _, tag := range deleted {
+			opts.OnDelete(ctx, tag)
+		}
+	}
+	return deleted, nil
+}
+
+// emitPruneDiff prints the tags of a repository as a diff of the tags
+// selected for deletion, if any.
+func emitPruneDiff(repoName string, allTags []string, selected []PrunedTag) {
+	if len(selected) == 0 {
+		return
+	}
+	pushed := make(map[string]time.Time, len(selected))
+	for _, tag := range selected {
+		pushed[tag.Tag] = tag.Pushed
+	}
+	sort.Strings(allTags)
+
+	emit("--- %s", repoName)
+	emit("+++ %s", repoName)
+	for _, tag := range allTags {
+		if t, ok := pushed[tag]; ok {
+			emit("-%s (pushed %s)", tag, t.Format(time.RFC3339))
+		} else {
+			emit(" %s", tag)
+		}
+	}
+}
+
+// restoreTags tags the deleted tags again after a failure, returning the
+// failure along with the errors restoring them.
+func restoreTags(ctx context.Context, tagService distribution.TagService, deleted []PrunedTag, err error) error {
+	for _, tag := range deleted {
+		if tagErr := tagService.Tag(ctx, tag.Tag, tag.Descriptor); tagErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to restore tag %s: %v", tag.Tag, tagErr))
+		}
+	}
+	return err
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePrunePolicies(t *testing.T) {
+	policies, err := ParsePrunePolicies(strings.NewReader(`
+policies:
+  - repositories: team/*
+    keeplast: 3
+    olderthan: 720h
+    keep: [latest, v*]
+  - repositories: "*"
+    olderthan: 24h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 {
+		t.Fatalf("unexpected policies: %+v", policies)
+	}
+	if p := policies[0]; p.Repositories != "team/*" || p.KeepLast != 3 || p.OlderThan != 720*time.Hour || len(p.Keep) != 2 {
+		t.Errorf("unexpected policy: %+v", p)
+	}
+
+	for _, invalid := range []string{
+		"policies:\n  - keeplast: 1\n",
+		"policies:\n  - repositories: a\n",
+		"policies:\n  - repositories: \"[\"\n    keeplast: 1\n",
+		"policies:\n  - repositories: a\n    keeplast: 1\n    keep: [\"[\"]\n",
+		"policies:\n  - repositories: a\n    keeplast: -1\n",
+		"policies:\n  - repositories: a\n    keeplast: 1\n    tags: [\"(\"]\n",
+		"policies:\n  - repositories: a\n    keeplast: 1\n    exclude: [\"(\"]\n",
+		"policies:\n  - repositories: a\n    keeplast: 1\n    unknown: 1\n",
+	} {
+		if _, err := ParsePrunePolicies(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+// tagImages uploads an image per tag to the repository, in order.
+func tagImages(t *testing.T, repository distribution.Repository, tags ...string) map[string]image {
+	ctx := dcontext.Background()
+	images := make(map[string]image)
+	for _, tag := range tags {
+		im := uploadRandomOCIImage(t, repository)
+		if err := repository.Tags(ctx).Tag(ctx, tag, v1.Descriptor{Digest: im.manifestDigest}); err != nil {
+			t.Fatalf("failed to tag %s: %v", tag, err)
+		}
+		images[tag] = im
+		// tags are ordered by the modification time of their links
+		time.Sleep(10 * time.Millisecond)
+	}
+	return images
+}
+
+func prunedNames(tags []PrunedTag) []string {
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Repository+":"+tag.Tag)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPrune(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+
+	team := makeRepository(t, registry, "team/app")
+	tagImages(t, team, "latest", "1", "2", "3", "4")
+	other := makeRepository(t, registry, "other")
+	tagImages(t, other, "old")
+	time.Sleep(time.Second)
+	tagImages(t, other, "new")
+
+	policies := []PrunePolicy{
+		{Repositories: "team/*", KeepLast: 2, Keep: []string{"latest"}},
+		{Repositories: "*", OlderThan: 500 * time.Millisecond},
+	}
+
+	dryRun, err := Prune(ctx, inmemoryDriver, registry, PruneOpts{Policies: policies, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"other:old", "team/app:1", "team/app:2"}
+	if names := prunedNames(dryRun); strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected tags eligible for deletion: %v != %v", names, expected)
+	}
+	if tags, err := team.Tags(ctx).All(ctx); err != nil || len(tags) != 5 {
+		t.Fatalf("dry run deleted tags: %v, %v", tags, err)
+	}
+
+	var events []PrunedTag
+	pruned, err := Prune(ctx, inmemoryDriver, registry, PruneOpts{
+		Policies: policies,
+		OnDelete: func(ctx context.Context, tag PrunedTag) {
+			events = append(events, tag)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := prunedNames(pruned); strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected deleted tags: %v != %v", names, expected)
+	}
+	if names := prunedNames(events); strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected tag delete events: %v != %v", names, expected)
+	}
+
+	tags, err := team.Tags(ctx).All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tags)
+	if strings.Join(tags, ",") != "3,4,latest" {
+		t.Errorf("unexpected remaining tags: %v", tags)
+	}
+	tags, err = other.Tags(ctx).All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "new" {
+		t.Errorf("unexpected remaining tags: %v", tags)
+	}
+}
+
+func TestPruneTagPatterns(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "patterns")
+	tagImages(t, repo, "pr-1", "sha-abc", "release-1", "pr-2", "latest", "xpr-3")
+
+	pruned, err := Prune(ctx, inmemoryDriver, registry, PruneOpts{
+		Policies: []PrunePolicy{{
+			Repositories: "*",
+			KeepLast:     1,
+			Tags:         []string{"pr-.*", "sha-.*", "release-.*"},
+			Exclude:      []string{"release-.*"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pr-2 is the newest tag selected, and is kept
+	if names := prunedNames(pruned); strings.Join(names, ",") != "patterns:pr-1,patterns:sha-abc" {
+		t.Fatalf("unexpected deleted tags: %v", names)
+	}
+
+	if _, err := Prune(ctx, inmemoryDriver, registry, PruneOpts{
+		Policies: []PrunePolicy{{Repositories: "*", KeepLast: 1, Tags: []string{"("}}},
+	}); err == nil {
+		t.Fatal("expected an error pruning with an invalid tag pattern")
+	}
+}
+
+func TestPruneKeepsRepushedTag(t *testing.T) {
+	ctx := dcontext.Background()
+	d := &statHookDriver{StorageDriver: inmemory.New()}
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "repushed")
+	tagImages(t, repo, "a", "b", "c", "d")
+
+	// a is pushed again once selected, before it is deleted
+	var repushed image
+	linkPath, err := pathFor(manifestTagCurrentPathSpec{name: "repushed", tag: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.path = linkPath
+	d.hook = func() {
+		repushed = tagImages(t, repo, "a")["a"]
+	}
+
+	pruned, err := Prune(ctx, d, registry, PruneOpts{
+		Policies: []PrunePolicy{{Repositories: "*", KeepLast: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := prunedNames(pruned); strings.Join(names, ",") != "repushed:b,repushed:c" {
+		t.Fatalf("unexpected deleted tags: %v", names)
+	}
+	if desc, err := repo.Tags(ctx).Get(ctx, "a"); err != nil || desc.Digest != repushed.manifestDigest {
+		t.Fatalf("repushed tag was deleted: %v, %v", desc, err)
+	}
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// PullRecord holds the aggregated pull activity of a piece of content
+// (a manifest or a layer) within a repository.
+type PullRecord struct {
+	// Count is the number of times the content has been pulled.
+	Count int64 `json:"count"`
+
+	// LastPulled is the time of the most recent pull.
+	LastPulled time.Time `json:"lastpulled"`
+}
+
+// merge folds other into the record, summing the counts and keeping the
+// most recent pull time.
+func (r PullRecord) merge(other PullRecord) PullRecord {
+	r.Count += other.Count
+	if other.LastPulled.After(r.LastPulled) {
+		r.LastPulled = other.LastPulled
+	}
+	return r
+}
+
+type pullKey struct {
+	name   string
+	digest digest.Digest
+}
+
+// PullStats records pulls of repository content and persists the aggregated
+// counters in the storage backend, next to the repository they describe, so
+// that offline tools such as the garbage collector can take usage into
+// account.
+//
+// Pulls are accumulated in memory and written out by Flush. Flushing is a
+// read-modify-write of a small file per piece of content: when several
+// registry instances share a backend, concurrent flushes of the same
+// content may lose increments, but the last pulled time is only ever moved
+// forward.
+type PullStats struct {
+	driver driver.StorageDriver
+
+	mu      sync.Mutex
+	pending map[pullKey]PullRecord
+}
+
+// NewPullStats returns a PullStats which persists its records through the
+// given storage driver.
+func NewPullStats(driver driver.StorageDriver) *PullStats {
+	return &PullStats{
+		driver:  driver,
+		pending: make(map[pullKey]PullRecord),
+	}
+}
+
+// RecordPull records a single pull of dgst from the named repository. The
+// pull is kept in memory until the next call to Flush.
+func (ps *PullStats) RecordPull(name string, dgst digest.Digest) {
+	key := pullKey{name: name, digest: dgst}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.pending[key] = ps.pending[key].merge(PullRecord{Count: 1, LastPulled: time.Now().UTC()})
+}
+
+// Get returns the pull record of dgst in the named repository, including
+// pulls which have not been flushed yet. Content which has never been
+// pulled yields a zero PullRecord.
+func (ps *PullStats) Get(ctx context.Context, name string, dgst digest.Digest) (PullRecord, error) {
+	record, err := ps.read(ctx, name, dgst)
+	if err != nil {
+		return PullRecord{}, err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return record.merge(ps.pending[pullKey{name: name, digest: dgst}]), nil
+}
+
+// Flush writes all pending pulls to the storage backend. Records which fail
+// to be written are kept and retried on the next flush.
+func (ps *PullStats) Flush(ctx context.Context) error {
+	ps.mu.Lock()
+	pending := ps.pending
+	ps.pending = make(map[pullKey]PullRecord)
+	ps.mu.Unlock()
+
+	var firstErr error
+	for key, record := range pending {
+		if err := ps.write(ctx, key, record); err != nil {
+			dcontext.GetLogger(ctx).Errorf("failed to flush pull statistics of %s@%s: %v", key.name, key.digest, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			ps.mu.Lock()
+			ps.pending[key] = ps.pending[key].merge(record)
+			ps.mu.Unlock()
+		}
+	}
+
+	return firstErr
+}
+
+func (ps *PullStats) read(ctx context.Context, name string, dgst digest.Digest) (PullRecord, error) {
+	statsPath, err := pathFor(pullStatsPathSpec{name: name, digest: dgst})
+	if err != nil {
+		return PullRecord{}, err
+	}
+
+	content, err := ps.driver.GetContent(ctx, statsPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return PullRecord{}, nil
+		}
+		return PullRecord{}, err
+	}
+
+	var record PullRecord
+	if err := json.Unmarshal(content, &record); err != nil {
+		// A corrupt record must not prevent the content from being
+		// pulled or collected: start counting afresh.
+		dcontext.GetLogger(ctx).Warnf("discarding unreadable pull statistics %s: %v", statsPath, err)
+		return PullRecord{}, nil
+	}
+
+	return record, nil
+}
+
+func (ps *PullStats) write(ctx context.Context, key pullKey, record PullRecord) error {
+	stored, err := ps.read(ctx, key.name, key.digest)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(stored.merge(record))
+	if err != nil {
+		return err
+	}
+
+	statsPath, err := pathFor(pullStatsPathSpec(key))
+	if err != nil {
+		return err
+	}
+
+	return ps.driver.PutContent(ctx, statsPath, content)
+}
+
+// lastActivity returns the most recent of the last pull of dgst in the
+// named repository and the time the content was linked into it, as
+// reported by the modification time of linkPath. This keeps recently
+// pushed, but not yet pulled, content from being considered stale.
+func (ps *PullStats) lastActivity(ctx context.Context, name string, dgst digest.Digest, linkPath string) (time.Time, error) {
+	record, err := ps.Get(ctx, name, dgst)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	fi, err := ps.driver.Stat(ctx, linkPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return record.LastPulled, nil
+		}
+		return time.Time{}, err
+	}
+
+	if fi.ModTime().After(record.LastPulled) {
+		return fi.ModTime(), nil
+	}
+	return record.LastPulled, nil
+}
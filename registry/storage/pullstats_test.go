@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPullStatsFlush(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	dgst := digest.FromString("pulled")
+
+	stats := NewPullStats(d)
+	stats.RecordPull("foo/bar", dgst)
+	stats.RecordPull("foo/bar", dgst)
+
+	record, err := stats.Get(ctx, "foo/bar", dgst)
+	if err != nil {
+		t.Fatalf("unexpected error getting pending record: %v", err)
+	}
+	if record.Count != 2 {
+		t.Fatalf("expected 2 pending pulls, got %d", record.Count)
+	}
+
+	if err := stats.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+
+	stats.RecordPull("foo/bar", dgst)
+	if err := stats.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+
+	// a fresh instance only sees what has been persisted
+	record, err = NewPullStats(d).Get(ctx, "foo/bar", dgst)
+	if err != nil {
+		t.Fatalf("unexpected error getting record: %v", err)
+	}
+	if record.Count != 3 {
+		t.Fatalf("expected 3 persisted pulls, got %d", record.Count)
+	}
+	if record.LastPulled.IsZero() {
+		t.Fatal("expected last pulled time to be set")
+	}
+
+	record, err = NewPullStats(d).Get(ctx, "foo/bar", digest.FromString("never pulled"))
+	if err != nil {
+		t.Fatalf("unexpected error getting record: %v", err)
+	}
+	if record.Count != 0 || !record.LastPulled.IsZero() {
+		t.Fatalf("expected empty record for content never pulled, got %#v", record)
+	}
+}
+
+func TestGCRemoveTagsNotPulled(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "pullstats")
+
+	pulled := uploadRandomSchema2Image(t, repo)
+	stale := uploadRandomSchema2Image(t, repo)
+
+	if err := repo.Tags(ctx).Tag(ctx, "pulled", v1.Descriptor{Digest: pulled.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, "stale", v1.Descriptor{Digest: stale.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	const notPulledFor = 100 * time.Millisecond
+	time.Sleep(2 * notPulledFor)
+
+	stats := NewPullStats(inmemoryDriver)
+	stats.RecordPull("pullstats", pulled.manifestDigest)
+	if err := stats.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush pull statistics: %v", err)
+	}
+
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		RemoveUntagged:         true,
+		PullStats:              NewPullStats(inmemoryDriver),
+		RemoveTagsNotPulledFor: notPulledFor,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	tags, err := repo.Tags(ctx).All(ctx)
+	if err != nil {
+		t.Fatalf("failed to list tags: %v", err)
+	}
+	if len(tags) != 1 || tags[0] != "pulled" {
+		t.Fatalf("expected only the pulled tag to remain, got %v", tags)
+	}
+
+	manifests := allManifests(t, makeManifestService(t, repo))
+	if _, ok := manifests[pulled.manifestDigest]; !ok {
+		t.Fatal("expected pulled manifest to be kept")
+	}
+	if _, ok := manifests[stale.manifestDigest]; ok {
+		t.Fatal("expected stale manifest to be removed")
+	}
+
+	record, err := NewPullStats(inmemoryDriver).Get(ctx, "pullstats", stale.manifestDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting record: %v", err)
+	}
+	if record.Count != 0 {
+		t.Fatalf("expected pull statistics of removed manifest to be removed, got %#v", record)
+	}
+}
+
+func TestPullStatsRemovedWithManifest(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "pullstats")
+	image := uploadRandomSchema2Image(t, repo)
+
+	stats := NewPullStats(inmemoryDriver)
+	stats.RecordPull("pullstats", image.manifestDigest)
+	if err := stats.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush pull statistics: %v", err)
+	}
+
+	if err := makeManifestService(t, repo).Delete(ctx, image.manifestDigest); err != nil {
+		t.Fatalf("failed to delete manifest: %v", err)
+	}
+
+	record, err := NewPullStats(inmemoryDriver).Get(ctx, "pullstats", image.manifestDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting record: %v", err)
+	}
+	if record.Count != 0 {
+		t.Fatalf("expected pull statistics of deleted manifest to be removed, got %#v", record)
+	}
+}
@@ -2,20 +2,39 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"math/rand/v2"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
 	storageDriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	// purgedUploadsCount is the number of uploads purged, or which would
+	// have been in dry-run mode.
+	purgedUploadsCount = prometheus.StorageNamespace.NewLabeledCounter("purged_uploads", "The number of uploads purged", "driver", "dryrun")
+	// purgedUploadBytesCount is the number of bytes of the uploads purged.
+	purgedUploadBytesCount = prometheus.StorageNamespace.NewLabeledCounter("purged_upload_bytes", "The number of bytes of the uploads purged", "driver", "dryrun")
+)
+
 // uploadData stored the location of temporary files created during a layer upload
 // along with the date the upload was started
 type uploadData struct {
 	containingDir string
 	startedAt     time.Time
+	// repository is the name of the repository of the upload.
+	repository string
+	// size is the size of the files of the upload.
+	size int64
+	// modTime is the time the files of the upload were last written.
+	modTime time.Time
 }
 
 func newUploadData() uploadData {
@@ -31,10 +50,21 @@ func newUploadData() uploadData {
 // encountered are returned
 func PurgeUploads(ctx context.Context, driver storageDriver.StorageDriver, olderThan time.Time, actuallyDelete bool) ([]string, []error) {
 	logrus.Infof("PurgeUploads starting: olderThan=%s, actuallyDelete=%t", olderThan, actuallyDelete)
+	deleted, errors := purgeUploads(ctx, driver, func(ud uploadData) (time.Time, bool) {
+		return olderThan, ud.startedAt.Before(olderThan)
+	}, actuallyDelete)
+	logrus.Infof("Purge uploads finished.  Num deleted=%d, num errors=%d", len(deleted), len(errors))
+	return deleted, errors
+}
+
+// purgeUploads deletes the upload directories for which expired returns
+// true, along with the purge date they are older than.
+func purgeUploads(ctx context.Context, driver storageDriver.StorageDriver, expired func(uploadData) (time.Time, bool), actuallyDelete bool) ([]string, []error) {
 	uploadData, errors := getOutstandingUploads(ctx, driver)
+	dryRun := strconv.FormatBool(!actuallyDelete)
 	var deleted []string
 	for _, uploadData := range uploadData {
-		if uploadData.startedAt.Before(olderThan) {
+		if olderThan, ok := expired(uploadData); ok {
 			var err error
 			logrus.Infof("Upload files in %s have older date (%s) than purge date (%s).  Removing upload directory.",
 				uploadData.containingDir, uploadData.startedAt, olderThan)
@@ -43,16 +73,115 @@ func PurgeUploads(ctx context.Context, driver storageDriver.StorageDriver, older
 			}
 			if err == nil {
 				deleted = append(deleted, uploadData.containingDir)
+				purgedUploadsCount.WithValues(driver.Name(), dryRun).Inc(1)
+				purgedUploadBytesCount.WithValues(driver.Name(), dryRun).Inc(float64(uploadData.size))
 			} else {
 				errors = append(errors, err)
 			}
 		}
 	}
+	return deleted, errors
+}
 
-	logrus.Infof("Purge uploads finished.  Num deleted=%d, num errors=%d", len(deleted), len(errors))
+// UploadPurgeConfig configures the uploads purged by an UploadPurger.
+type UploadPurgeConfig struct {
+	// Age is the age beyond which uploads are purged.
+	Age time.Duration
+	// RepositoryAges override Age for the repositories they match, the first
+	// matching one applying.
+	RepositoryAges []RepositoryUploadAge
+	// SafetyWindow protects the uploads written to within it from being
+	// purged, whatever their age.
+	SafetyWindow time.Duration
+	// DryRun only logs and counts the uploads which would be purged.
+	DryRun bool
+}
+
+// RepositoryUploadAge is the age beyond which the uploads of the
+// repositories whose name matches Pattern, in the syntax of path.Match, are
+// purged.
+type RepositoryUploadAge struct {
+	Pattern string
+	Age     time.Duration
+}
+
+// UploadPurger periodically purges the uploads of a storage driver which
+// were abandoned by their clients.
+type UploadPurger struct {
+	driver storageDriver.StorageDriver
+	config UploadPurgeConfig
+	now    func() time.Time
+}
+
+// NewUploadPurger returns an UploadPurger of the uploads of driver.
+func NewUploadPurger(driver storageDriver.StorageDriver, config UploadPurgeConfig) (*UploadPurger, error) {
+	for _, ra := range config.RepositoryAges {
+		if _, err := path.Match(ra.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %w", ra.Pattern, err)
+		}
+	}
+	return &UploadPurger{
+		driver: driver,
+		config: config,
+		now:    time.Now,
+	}, nil
+}
+
+// age returns the age beyond which the uploads of the named repository are
+// purged.
+func (up *UploadPurger) age(name string) time.Duration {
+	for _, ra := range up.config.RepositoryAges {
+		if matched, _ := path.Match(ra.Pattern, name); matched {
+			return ra.Age
+		}
+	}
+	return up.config.Age
+}
+
+// Purge deletes the uploads older than their age, unless they were written
+// to within the safety window. The upload directories deleted and the errors
+// encountered are returned.
+func (up *UploadPurger) Purge(ctx context.Context) ([]string, []error) {
+	now := up.now()
+	log := dcontext.GetLogger(ctx)
+	log.Infof("purging uploads older than %s, dryrun=%t", up.config.Age, up.config.DryRun)
+
+	deleted, errors := purgeUploads(ctx, up.driver, func(ud uploadData) (time.Time, bool) {
+		olderThan := now.Add(-up.age(ud.repository))
+		if !ud.startedAt.Before(olderThan) {
+			return olderThan, false
+		}
+		if ud.modTime.After(now.Add(-up.config.SafetyWindow)) {
+			log.Infof("upload files in %s were written within the safety window, not purging them", ud.containingDir)
+			return olderThan, false
+		}
+		return olderThan, true
+	}, !up.config.DryRun)
+
+	log.Infof("purged %d uploads, %d errors", len(deleted), len(errors))
 	return deleted, errors
 }
 
+// Run purges the uploads every interval until ctx is done, starting after a
+// random delay of up to an hour so that the registries sharing a storage
+// backend do not purge it at once.
+func (up *UploadPurger) Run(ctx context.Context, interval time.Duration) {
+	jitter := time.Duration(rand.Int64N(int64(time.Hour)))
+	dcontext.GetLogger(ctx).Infof("starting upload purge in %s", jitter.Round(time.Second))
+
+	timer := time.NewTimer(jitter)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			up.Purge(ctx)
+			timer.Reset(interval)
+		}
+	}
+}
+
 // getOutstandingUploads walks the upload directory, collecting files
 // which could be eligible for deletion.  The only reliable way to
 // classify the age of a file is with the date stored in the startedAt
@@ -91,6 +220,13 @@ func getOutstandingUploads(ctx context.Context, driver storageDriver.StorageDriv
 		}
 		if isContainingDir {
 			ud.containingDir = filePath
+			ud.repository = strings.TrimPrefix(path.Dir(path.Dir(filePath)), root+"/")
+		}
+		if !fileInfo.IsDir() {
+			ud.size += fileInfo.Size()
+			if fileInfo.ModTime().After(ud.modTime) {
+				ud.modTime = fileInfo.ModTime()
+			}
 		}
 		if file == "startedat" {
 			if t, err := readStartedAtFile(ctx, driver, filePath); err == nil {
@@ -163,3 +163,88 @@ func TestPurgeMissingStartedAt(t *testing.T) {
 		t.Errorf("Files unexpectedly deleted: %s", deleted)
 	}
 }
+
+func TestUploadPurgerRepositoryAges(t *testing.T) {
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	fs, ctx := testUploadFS(t, 2, "test-repo", twoHoursAgo)
+	addUploads(ctx, t, fs, uuid.NewString(), "ci/test-repo", twoHoursAgo)
+
+	purger, err := NewUploadPurger(fs, UploadPurgeConfig{
+		Age: 24 * time.Hour,
+		RepositoryAges: []RepositoryUploadAge{
+			{Pattern: "ci/*", Age: time.Hour},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating purger: %v", err)
+	}
+	deleted, errs := purger.Purge(ctx)
+	if len(errs) != 0 {
+		t.Error("Unexpected errors", errs)
+	}
+	if len(deleted) != 1 || !strings.Contains(deleted[0], "/ci/test-repo/_uploads/") {
+		t.Errorf("unexpected uploads deleted: %v", deleted)
+	}
+}
+
+func TestUploadPurgerSafetyWindow(t *testing.T) {
+	// the uploads started two hours ago were written to just now
+	fs, ctx := testUploadFS(t, 3, "test-repo", time.Now().Add(-2*time.Hour))
+
+	purger, err := NewUploadPurger(fs, UploadPurgeConfig{
+		Age:          time.Hour,
+		SafetyWindow: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating purger: %v", err)
+	}
+	deleted, errs := purger.Purge(ctx)
+	if len(errs) != 0 {
+		t.Error("Unexpected errors", errs)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("uploads written within the safety window deleted: %v", deleted)
+	}
+
+	purger.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	deleted, errs = purger.Purge(ctx)
+	if len(errs) != 0 {
+		t.Error("Unexpected errors", errs)
+	}
+	if len(deleted) != 3 {
+		t.Errorf("unexpected number of uploads deleted: %d != 3", len(deleted))
+	}
+}
+
+func TestUploadPurgerDryRun(t *testing.T) {
+	fs, ctx := testUploadFS(t, 2, "test-repo", time.Now().Add(-2*time.Hour))
+
+	purger, err := NewUploadPurger(fs, UploadPurgeConfig{
+		Age:    time.Hour,
+		DryRun: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating purger: %v", err)
+	}
+	deleted, errs := purger.Purge(ctx)
+	if len(errs) != 0 {
+		t.Error("Unexpected errors", errs)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("unexpected number of uploads reported: %d != 2", len(deleted))
+	}
+	uploads, _ := getOutstandingUploads(ctx, fs)
+	if len(uploads) != 2 {
+		t.Errorf("uploads deleted in dry-run mode: %d left", len(uploads))
+	}
+}
+
+func TestUploadPurgerInvalidPattern(t *testing.T) {
+	_, err := NewUploadPurger(inmemory.New(), UploadPurgeConfig{
+		Age:            time.Hour,
+		RepositoryAges: []RepositoryUploadAge{{Pattern: "[", Age: time.Hour}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for an invalid repository pattern")
+	}
+}
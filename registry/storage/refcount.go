@@ -0,0 +1,488 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// refCountStripes is the number of locks the blobs, and the manifests of the
+// repositories, are spread over.
+const refCountStripes = 64
+
+// refCountsPath is the root of the reference counts of the blobs. The count
+// of a blob is stored under counts, and the blobs whose count is zero are
+// indexed under zero.
+var refCountsPath = path.Join(storagePathRoot, storagePathVersion, "_refcounts")
+
+// refCountsBuiltPath is the path of the time the counts were last rebuilt.
+var refCountsBuiltPath = path.Join(refCountsPath, "built")
+
+// ErrRefCountsNotBuilt is returned when collecting the garbage by reference
+// counts which were never rebuilt, and may miss the references of the
+// manifests pushed before they were maintained.
+var ErrRefCountsNotBuilt = errors.New("the reference counts were never rebuilt")
+
+// RefCount is the reference count of a blob.
+type RefCount struct {
+	// Count is the number of manifests referencing the blob over all the
+	// repositories, a manifest referencing its own blob.
+	Count int64 `json:"count"`
+	// Repositories lists the repositories the blob is linked into as a
+	// layer.
+	Repositories []string `json:"repositories,omitempty"`
+	// ZeroSince is the time the count dropped to zero, or the blob was last
+	// linked into a repository while unreferenced. It is zero while the blob
+	// is referenced.
+	ZeroSince time.Time `json:"zeroSince"`
+}
+
+// RefCounter maintains the reference counts of the blobs of a registry in
+// its storage backend, as manifests are pushed and deleted, so that the
+// garbage collection deletes the blobs whose count dropped to zero instead of
+// marking the whole registry, see GCOpts.RefCounter. The blobs whose count is
+// zero are indexed apart, for the collection to find them without walking
+// the repositories.
+//
+// Updating a count is a read-modify-write of a small file per blob,
+// serialized within the process: when several registry instances share a
+// backend, concurrent pushes of the same content may lose updates, which
+// RebuildRefCounts recovers from. Blobs with no count, such as the blobs
+// pushed before the counts were maintained, are never collected by counts.
+type RefCounter struct {
+	driver driver.StorageDriver
+
+	blobLocks     [refCountStripes]sync.Mutex
+	manifestLocks [refCountStripes]sync.Mutex
+}
+
+// NewRefCounter returns a RefCounter storing the counts through the given
+// storage driver.
+func NewRefCounter(driver driver.StorageDriver) *RefCounter {
+	return &RefCounter{driver: driver}
+}
+
+// ReferenceCounting returns a functional option for NewRegistry. The pushes
+// and deletions of manifests, and the links of layers, of the registry
+// update the reference counts of counter.
+func ReferenceCounting(counter *RefCounter) RegistryOption {
+	return func(registry *registry) error {
+		registry.refCounter = counter
+		return nil
+	}
+}
+
+func refCountPath(dgst digest.Digest) string {
+	return path.Join(refCountsPath, "counts", dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded())
+}
+
+func zeroRefCountPath(dgst digest.Digest) string {
+	return path.Join(refCountsPath, "zero", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// Get returns the reference count of the blob dgst, and whether it has one.
+func (rc *RefCounter) Get(ctx context.Context, dgst digest.Digest) (RefCount, bool, error) {
+	if err := dgst.Validate(); err != nil {
+		return RefCount{}, false, err
+	}
+	return rc.read(ctx, dgst)
+}
+
+func (rc *RefCounter) read(ctx context.Context, dgst digest.Digest) (RefCount, bool, error) {
+	var count RefCount
+	content, err := rc.driver.GetContent(ctx, refCountPath(dgst))
+	if err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return count, false, nil
+		}
+		return count, false, err
+	}
+	if err := json.Unmarshal(content, &count); err != nil {
+		return count, false, fmt.Errorf("decoding the reference count of %s: %w", dgst, err)
+	}
+	return count, true, nil
+}
+
+// write stores the count of the blob, indexing it if it dropped to zero and
+// removing it from the index if it no longer is.
+func (rc *RefCounter) write(ctx context.Context, dgst digest.Digest, count RefCount, previous *RefCount) error {
+	content, err := json.Marshal(count)
+	if err != nil {
+		return err
+	}
+	if err := rc.driver.PutContent(ctx, refCountPath(dgst), content); err != nil {
+		return err
+	}
+	switch {
+	case count.Count == 0 && (previous == nil || previous.Count > 0):
+		return rc.driver.PutContent(ctx, zeroRefCountPath(dgst), []byte{})
+	case count.Count > 0 && previous != nil && previous.Count == 0:
+		return rc.deleteZero(ctx, dgst)
+	}
+	return nil
+}
+
+func (rc *RefCounter) deleteZero(ctx context.Context, dgst digest.Digest) error {
+	err := rc.driver.Delete(ctx, zeroRefCountPath(dgst))
+	if errors.As(err, &driver.PathNotFoundError{}) {
+		return nil
+	}
+	return err
+}
+
+// update applies f to the count of the blob dgst, holding its lock. Unless
+// create is set, blobs with no count are left uncounted: the blobs pushed
+// before the counts were maintained must not appear unreferenced.
+func (rc *RefCounter) update(ctx context.Context, dgst digest.Digest, create bool, f func(*RefCount)) error {
+	lock := rc.lock(rc.blobLocks[:], string(dgst))
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, ok, err := rc.read(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	if !ok && !create {
+		return nil
+	}
+	var previous *RefCount
+	if ok {
+		p := count
+		previous = &p
+	}
+	f(&count)
+	return rc.write(ctx, dgst, count, previous)
+}
+
+// add adds delta to the counts of the blobs.
+func (rc *RefCounter) add(ctx context.Context, delta int64, dgsts ...digest.Digest) error {
+	now := time.Now().UTC()
+	for _, dgst := range dgsts {
+		err := rc.update(ctx, dgst, delta > 0, func(count *RefCount) {
+			count.Count = max(count.Count+delta, 0)
+			if count.Count > 0 {
+				count.ZeroSince = time.Time{}
+			} else {
+				count.ZeroSince = now
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("updating the reference count of %s: %w", dgst, err)
+		}
+	}
+	return nil
+}
+
+// linked records that the blob dgst was linked into the named repository as
+// a layer. Linking an unreferenced blob restarts its grace period, as it may
+// be referenced by a manifest soon.
+func (rc *RefCounter) linked(ctx context.Context, name string, dgst digest.Digest) error {
+	err := rc.update(ctx, dgst, true, func(count *RefCount) {
+		i := sort.SearchStrings(count.Repositories, name)
+		if i == len(count.Repositories) || count.Repositories[i] != name {
+			count.Repositories = append(count.Repositories, "")
+			copy(count.Repositories[i+1:], count.Repositories[i:])
+			count.Repositories[i] = name
+		}
+		if count.Count == 0 {
+			count.ZeroSince = time.Now().UTC()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("updating the reference count of %s: %w", dgst, err)
+	}
+	return nil
+}
+
+// unlinked records that the blob dgst is no longer linked into the named
+// repository as a layer.
+func (rc *RefCounter) unlinked(ctx context.Context, name string, dgst digest.Digest) error {
+	err := rc.update(ctx, dgst, false, func(count *RefCount) {
+		i := sort.SearchStrings(count.Repositories, name)
+		if i < len(count.Repositories) && count.Repositories[i] == name {
+			count.Repositories = append(count.Repositories[:i], count.Repositories[i+1:]...)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("updating the reference count of %s: %w", dgst, err)
+	}
+	return nil
+}
+
+// lockManifest holds the lock of the manifest dgst of the named repository,
+// so that a manifest pushed or deleted concurrently is counted once.
+func (rc *RefCounter) lockManifest(name string, dgst digest.Digest) func() {
+	lock := rc.lock(rc.manifestLocks[:], name+"@"+string(dgst))
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (rc *RefCounter) lock(locks []sync.Mutex, key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &locks[h.Sum32()%uint32(len(locks))]
+}
+
+// manifestBlobs returns the blobs a manifest references, its own first, each
+// once.
+func manifestBlobs(dgst digest.Digest, manifest distribution.Manifest) []digest.Digest {
+	dgsts := []digest.Digest{dgst}
+	seen := map[digest.Digest]struct{}{dgst: {}}
+	for _, desc := range manifest.References() {
+		if _, ok := seen[desc.Digest]; ok {
+			continue
+		}
+		seen[desc.Digest] = struct{}{}
+		dgsts = append(dgsts, desc.Digest)
+	}
+	return dgsts
+}
+
+// collect deletes the blob dgst, along with its layer links, if its count is
+// still zero and dropped to zero before cutoff, reporting whether it did.
+func (rc *RefCounter) collect(ctx context.Context, dgst digest.Digest, cutoff time.Time) (bool, error) {
+	lock := rc.lock(rc.blobLocks[:], string(dgst))
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, ok, err := rc.read(ctx, dgst)
+	if err != nil {
+		return false, err
+	}
+	if !ok || count.Count > 0 {
+		// the index is stale
+		return false, rc.deleteZero(ctx, dgst)
+	}
+	if count.ZeroSince.After(cutoff) {
+		return false, nil
+	}
+
+	vacuum := NewVacuum(ctx, rc.driver)
+	for _, name := range count.Repositories {
+		if err := vacuum.RemoveLayers(name, []digest.Digest{dgst}); err != nil {
+			return false, err
+		}
+	}
+	if err := vacuum.RemoveBlobs([]digest.Digest{dgst}); err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return false, err
+	}
+	if err := rc.driver.Delete(ctx, refCountPath(dgst)); err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return false, err
+	}
+	return true, rc.deleteZero(ctx, dgst)
+}
+
+// unreferenced returns the blobs indexed as unreferenced.
+func (rc *RefCounter) unreferenced(ctx context.Context) ([]digest.Digest, error) {
+	var dgsts []digest.Digest
+	err := rc.driver.Walk(ctx, path.Join(refCountsPath, "zero"), func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() {
+			return nil
+		}
+		p := fileInfo.Path()
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(p))), path.Base(p))
+		if err := dgst.Validate(); err != nil {
+			dcontext.GetLogger(ctx).Warnf("ignoring invalid reference count index entry %s: %v", p, err)
+			return nil
+		}
+		dgsts = append(dgsts, dgst)
+		return nil
+	})
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return nil, err
+	}
+	return dgsts, nil
+}
+
+// sweepUnreferenced is the garbage collection by reference counts: it
+// deletes the blobs whose count dropped to zero before the grace period,
+// along with their layer links.
+func sweepUnreferenced(ctx context.Context, storageDriver driver.StorageDriver, opts GCOpts) error {
+	if opts.RemoveUntagged || opts.RemoveTagsNotPulledFor > 0 || opts.Repository != "" {
+		return errors.New("the collection by reference counts does not delete manifests nor collect single repositories")
+	}
+	rc := opts.RefCounter
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	if _, err := storageDriver.Stat(ctx, refCountsBuiltPath); err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return ErrRefCountsNotBuilt
+		}
+		return err
+	}
+
+	if opts.Report != nil {
+		*opts.Report = GCReport{}
+		defer opts.Report.finish()
+	}
+	candidates, err := rc.unreferenced(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the unreferenced blobs: %v", err)
+	}
+	var eligible []digest.Digest
+	for _, dgst := range candidates {
+		count, ok, err := rc.read(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		if !ok || count.Count > 0 {
+			continue
+		}
+		if count.ZeroSince.After(cutoff) {
+			emit("keeping recent blob %s", dgst)
+			continue
+		}
+		emit("blob eligible for deletion: %s", dgst)
+		eligible = append(eligible, dgst)
+		if opts.Report != nil {
+			if err := opts.Report.add(ctx, storageDriver, GCReportBlob, "", dgst); err != nil {
+				return fmt.Errorf("failed to report blob %s: %v", dgst, err)
+			}
+			for _, name := range count.Repositories {
+				if err := opts.Report.add(ctx, storageDriver, GCReportLayer, name, dgst); err != nil {
+					return fmt.Errorf("failed to report layer %s: %v", dgst, err)
+				}
+			}
+		}
+	}
+	emit("\n%d blobs unreferenced, %d blobs eligible for deletion", len(candidates), len(eligible))
+	if opts.DryRun {
+		return nil
+	}
+	if opts.BeforeSweep != nil {
+		if err := opts.BeforeSweep(ctx); err != nil {
+			return fmt.Errorf("not sweeping: %v", err)
+		}
+	}
+
+	progress := GCProgress{Phase: "sweep", Eligible: len(eligible)}
+	driverName := storageDriver.Name()
+	for _, dgst := range eligible {
+		size, err := blobSize(ctx, storageDriver, dgst)
+		if err != nil {
+			return err
+		}
+		deleted, err := rc.collect(ctx, dgst, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+		}
+		if !deleted {
+			continue
+		}
+		gcDeletedBlobsCount.WithValues(driverName).Inc(1)
+		gcDeletedBytesCount.WithValues(driverName).Inc(float64(size))
+		progress.Deleted++
+		progress.Bytes += size
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	return nil
+}
+
+// RebuildRefCounts recomputes the reference counts of the blobs of a registry
+// from its manifests and layer links, replacing the counts stored through
+// counter. The blobs of the blob store referenced by no manifest are counted
+// as unreferenced from now. The counts must be rebuilt once before the
+// garbage is collected by counts, and the registry must not serve writes
+// while they are.
+func RebuildRefCounts(ctx context.Context, counter *RefCounter, registry distribution.Namespace) error {
+	log := dcontext.GetLogger(ctx)
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return errors.New("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	counts := make(map[digest.Digest]*RefCount)
+	count := func(dgst digest.Digest) *RefCount {
+		c, ok := counts[dgst]
+		if !ok {
+			c = &RefCount{}
+			counts[dgst] = c
+		}
+		return c
+	}
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+		manifestService, err := repository.Manifests(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to construct manifest service: %v", err)
+		}
+		err = manifestService.(distribution.ManifestEnumerator).Enumerate(ctx, func(dgst digest.Digest) error {
+			manifest, err := manifestService.Get(ctx, dgst)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve manifest %s of %s: %v", dgst, repoName, err)
+			}
+			for _, d := range manifestBlobs(dgst, manifest) {
+				count(d).Count++
+			}
+			return nil
+		})
+		if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+			return err
+		}
+		err = repository.Blobs(ctx).(distribution.ManifestEnumerator).Enumerate(ctx, func(dgst digest.Digest) error {
+			c := count(dgst)
+			c.Repositories = append(c.Repositories, repoName)
+			return nil
+		})
+		if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+			return err
+		}
+		return nil
+	})
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return fmt.Errorf("failed to count the references: %v", err)
+	}
+	blobs := &blobStore{driver: counter.driver}
+	err = blobs.Enumerate(ctx, func(dgst digest.Digest) error {
+		count(dgst)
+		return nil
+	})
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return fmt.Errorf("failed to enumerate blobs: %v", err)
+	}
+
+	if err := counter.driver.Delete(ctx, refCountsPath); err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return err
+	}
+	now := time.Now().UTC()
+	var unreferenced int
+	for dgst, c := range counts {
+		sort.Strings(c.Repositories)
+		if c.Count == 0 {
+			c.ZeroSince = now
+			unreferenced++
+		}
+		if err := counter.write(ctx, dgst, *c, nil); err != nil {
+			return fmt.Errorf("failed to write the reference count of %s: %v", dgst, err)
+		}
+	}
+	built, err := now.MarshalText()
+	if err != nil {
+		return err
+	}
+	if err := counter.driver.PutContent(ctx, refCountsBuiltPath, built); err != nil {
+		return err
+	}
+	log.Infof("rebuilt the reference counts of %d blobs, %d unreferenced", len(counts), unreferenced)
+	return nil
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestRefCounts(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	counter := NewRefCounter(d)
+	registry := createRegistry(t, d, ReferenceCounting(counter))
+
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{RefCounter: counter}); !errors.Is(err, ErrRefCountsNotBuilt) {
+		t.Fatalf("expected ErrRefCountsNotBuilt, got %v", err)
+	}
+	if err := RebuildRefCounts(ctx, counter, registry); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := makeRepository(t, registry, "counted")
+	kept := uploadRandomOCIImage(t, repo)
+	deleted := uploadRandomOCIImage(t, repo)
+	other := makeRepository(t, registry, "other")
+	// links the empty config into the other repository
+	uploadRandomOCIImage(t, other)
+	// pushing the manifest again to the repository does not count it twice
+	reuploadImage(t, repo, kept)
+	reuploadImage(t, other, kept)
+
+	expectCount := func(dgst digest.Digest, expected int64) {
+		t.Helper()
+		count, ok, err := counter.Get(ctx, dgst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || count.Count != expected {
+			t.Errorf("unexpected reference count of %s: %+v, %t != %d", dgst, count, ok, expected)
+		}
+	}
+	expectCount(kept.manifestDigest, 2)
+	for dgst := range kept.layers {
+		expectCount(dgst, 2)
+	}
+	for dgst := range deleted.layers {
+		expectCount(dgst, 1)
+	}
+
+	if err := makeManifestService(t, repo).Delete(ctx, deleted.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(deleted.manifestDigest, 0)
+	for dgst := range deleted.layers {
+		expectCount(dgst, 0)
+	}
+
+	// the unreferenced blobs are kept within the grace period
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{RefCounter: counter, GracePeriod: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	for dgst := range deleted.layers {
+		if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Errorf("layer %s collected within the grace period: %v", dgst, err)
+		}
+	}
+
+	var report GCReport
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{RefCounter: counter, Report: &report}); err != nil {
+		t.Fatal(err)
+	}
+	if report.Blobs != len(deleted.layers)+1 {
+		t.Errorf("unexpected number of blobs collected: %d", report.Blobs)
+	}
+	for dgst := range deleted.layers {
+		if _, err := repo.Blobs(ctx).Stat(ctx, dgst); !errors.Is(err, distribution.ErrBlobUnknown) {
+			t.Errorf("layer %s not collected: %v", dgst, err)
+		}
+		if _, ok, err := counter.Get(ctx, dgst); ok || err != nil {
+			t.Errorf("reference count of %s not removed: %v", dgst, err)
+		}
+	}
+	for dgst := range kept.layers {
+		if _, err := other.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Errorf("referenced layer %s collected: %v", dgst, err)
+		}
+	}
+	if _, err := makeManifestService(t, repo).Get(ctx, kept.manifestDigest); err != nil {
+		t.Errorf("referenced manifest collected: %v", err)
+	}
+}
+
+func TestRefCountsFailedPut(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	counter := NewRefCounter(d)
+	registry := createRegistry(t, d, ReferenceCounting(counter))
+	repo := makeRepository(t, registry, "failed")
+
+	layers, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missing digest.Digest
+	for dgst := range layers {
+		missing = dgst
+	}
+	manifest, err := testutil.MakeOCIManifest(repo, []digest.Digest{missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := makeManifestService(t, repo).Put(ctx, manifest); err == nil {
+		t.Fatal("expected an error putting a manifest referencing a missing layer")
+	}
+	count, _, err := counter.Get(ctx, missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Count != 0 {
+		t.Errorf("reference count of a failed put not restored: %+v", count)
+	}
+}
+
+func TestRebuildRefCounts(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "rebuilt")
+	im := uploadRandomOCIImage(t, repo)
+	mounted := makeRepository(t, registry, "mounted")
+	uploadRandomOCIImage(t, mounted)
+	reuploadImage(t, mounted, im)
+
+	// an unreferenced blob of the blob store
+	unreferenced := []byte("unreferenced")
+	dataPath, err := pathFor(blobDataPathSpec{digest: digest.FromBytes(unreferenced)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, dataPath, unreferenced); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := NewRefCounter(d)
+	if err := RebuildRefCounts(ctx, counter, registry); err != nil {
+		t.Fatal(err)
+	}
+	for dgst := range im.layers {
+		count, ok, err := counter.Get(ctx, dgst)
+		if err != nil || !ok {
+			t.Fatalf("no reference count of %s: %v", dgst, err)
+		}
+		if count.Count != 2 || len(count.Repositories) != 2 || !count.ZeroSince.IsZero() {
+			t.Errorf("unexpected reference count of %s: %+v", dgst, count)
+		}
+	}
+	dgsts, err := counter.unreferenced(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dgsts) != 1 || dgsts[0] != digest.FromBytes(unreferenced) {
+		t.Errorf("unexpected unreferenced blobs: %v", dgsts)
+	}
+}
+
+// reuploadImage uploads an image already uploaded, rewinding its layers.
+func reuploadImage(t *testing.T, repository distribution.Repository, im image) {
+	for _, layer := range im.layers {
+		if _, err := layer.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uploadImage(t, repository, im)
+}
@@ -2,8 +2,11 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"path"
 	"regexp"
 	"runtime"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache"
@@ -25,8 +28,12 @@ type registry struct {
 	deleteEnabled                bool
 	tagLookupConcurrencyLimit    int
 	resumableDigestEnabled       bool
+	inlineBlobThreshold          int64
+	redirectRules                []RedirectRule
 	blobDescriptorServiceFactory distribution.BlobDescriptorServiceFactory
 	driver                       storagedriver.StorageDriver
+	gcBarrier                    *GCBarrier
+	refCounter                   *RefCounter
 
 	// Validation
 	manifestURLs         manifestURLs
@@ -63,6 +70,48 @@ func EnableRedirect(registry *registry) error {
 	return nil
 }
 
+// RedirectExpiry returns a functional option for NewRegistry. It sets the
+// time the redirect URLs of blobs remain valid, for the drivers signing them.
+func RedirectExpiry(expiry time.Duration) RegistryOption {
+	return func(registry *registry) error {
+		if expiry < 0 {
+			return fmt.Errorf("redirect expiry must not be negative: %s", expiry)
+		}
+		registry.blobServer.redirectExpiry = expiry
+		return nil
+	}
+}
+
+// RedirectRule decides the redirects of the blobs of the repositories whose
+// name matches Pattern, with the syntax of path.Match.
+type RedirectRule struct {
+	Pattern string
+	// Disable serves the blobs of the repositories through the registry.
+	Disable bool
+	// Expiry is the time the redirect URLs remain valid, the one of the
+	// registry if zero.
+	Expiry time.Duration
+}
+
+// RedirectRules returns a functional option for NewRegistry. The first rule
+// whose pattern matches the name of a repository overrides whether its blobs
+// are redirected, so that some repositories can be served through the
+// registry, for auditing, while others are redirected to the storage backend.
+func RedirectRules(rules ...RedirectRule) RegistryOption {
+	return func(registry *registry) error {
+		for _, rule := range rules {
+			if _, err := path.Match(rule.Pattern, ""); err != nil {
+				return fmt.Errorf("invalid redirect repository pattern %q: %w", rule.Pattern, err)
+			}
+			if rule.Expiry < 0 {
+				return fmt.Errorf("redirect expiry of %q must not be negative: %s", rule.Pattern, rule.Expiry)
+			}
+		}
+		registry.redirectRules = rules
+		return nil
+	}
+}
+
 func TagLookupConcurrencyLimit(concurrencyLimit int) RegistryOption {
 	return func(registry *registry) error {
 		registry.tagLookupConcurrencyLimit = concurrencyLimit
@@ -84,6 +133,21 @@ func DisableDigestResumption(registry *registry) error {
 	return nil
 }
 
+// InlineBlobThreshold returns a functional option for NewRegistry. The
+// content of the blobs of at most threshold bytes pushed to repositories is
+// stored inline in their links instead of in the blob store, sparing the
+// objects and requests of the storage backend for small blobs such as image
+// configurations. The threshold is at most 1 MiB.
+func InlineBlobThreshold(threshold int64) RegistryOption {
+	return func(registry *registry) error {
+		if threshold < 0 || threshold > maxInlineBlobSize {
+			return fmt.Errorf("inline blob threshold must be between 0 and %d bytes: %d", maxInlineBlobSize, threshold)
+		}
+		registry.inlineBlobThreshold = threshold
+		return nil
+	}
+}
+
 // ManifestURLsAllowRegexp is a functional option for NewRegistry.
 func ManifestURLsAllowRegexp(r *regexp.Regexp) RegistryOption {
 	return func(registry *registry) error {
@@ -267,6 +331,7 @@ func (repo *repository) Manifests(ctx context.Context, options ...distribution.M
 
 	blobStore := &linkedBlobStore{
 		ctx:                  ctx,
+		registry:             repo.registry,
 		blobStore:            repo.blobStore,
 		repository:           repo,
 		deleteEnabled:        repo.registry.deleteEnabled,
@@ -321,6 +386,23 @@ func (repo *repository) Manifests(ctx context.Context, options ...distribution.M
 // Blobs returns an instance of the BlobStore. Instantiation is cheap and
 // may be context sensitive in the future. The instance should be used similar
 // to a request local.
+// repositoryBlobServer returns the blob server of the repository, applying the
+// first redirect rule matching its name.
+func (repo *repository) repositoryBlobServer() *blobServer {
+	for _, rule := range repo.redirectRules {
+		if ok, _ := path.Match(rule.Pattern, repo.name.Name()); !ok {
+			continue
+		}
+		bs := *repo.blobServer
+		bs.redirect = !rule.Disable
+		if rule.Expiry > 0 {
+			bs.redirectExpiry = rule.Expiry
+		}
+		return &bs
+	}
+	return repo.blobServer
+}
+
 func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 	var statter distribution.BlobDescriptorService = &linkedBlobStatter{
 		blobStore:  repo.blobStore,
@@ -339,7 +421,7 @@ func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 	return &linkedBlobStore{
 		registry:             repo.registry,
 		blobStore:            repo.blobStore,
-		blobServer:           repo.blobServer,
+		blobServer:           repo.repositoryBlobServer(),
 		blobAccessController: statter,
 		repository:           repo,
 		ctx:                  ctx,
@@ -350,5 +432,6 @@ func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 		linkDirectoryPathSpec:  layersPathSpec{name: repo.name.Name()},
 		deleteEnabled:          repo.registry.deleteEnabled,
 		resumableDigestEnabled: repo.resumableDigestEnabled,
+		inlineThreshold:        repo.inlineBlobThreshold,
 	}
 }
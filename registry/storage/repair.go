@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// Repair actions.
+const (
+	// RepairRemoved is the removal of a dangling or invalid link, or of a
+	// dangling tag.
+	RepairRemoved = "removed"
+	// RepairRecreated is the re-creation of a tag index entry from the
+	// current revision of the tag.
+	RepairRecreated = "recreated"
+	// RepairQuarantined is the quarantine of an unparseable manifest.
+	RepairQuarantined = "quarantined"
+)
+
+// RepairOpts contains options for Repair.
+type RepairOpts struct {
+	// Repository, if set, restricts the repair to the named repository.
+	Repository string
+	// DryRun returns the repairs without applying them.
+	DryRun bool
+}
+
+// RepairAction is the repair of an issue found by Fsck.
+type RepairAction struct {
+	Issue FsckIssue `json:"issue"`
+	// Action is RepairRemoved, RepairRecreated or RepairQuarantined.
+	Action string `json:"action"`
+	// Path is the path removed, re-created or quarantined.
+	Path string `json:"path"`
+}
+
+// Repair checks the storage of a registry with Fsck and repairs the issues
+// which do not need content missing from the storage: it removes the invalid
+// links, the links to blobs missing from the blob store and the dangling
+// tags, re-creates the missing tag index entries from the current revision of
+// the tags, and moves the unparseable manifests to quarantine, out of the
+// blob store, removing their revision links. It returns the repairs, along
+// with the issues left, such as missing references, some of which may only
+// appear once the repairs are applied. The registry must not serve writes
+// while repairing its storage.
+func Repair(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts RepairOpts) ([]RepairAction, []FsckIssue, error) {
+	report, err := Fsck(ctx, storageDriver, registry, FsckOpts{Repository: opts.Repository})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log := dcontext.GetLogger(ctx)
+	var (
+		actions []RepairAction
+		left    []FsckIssue
+	)
+	for _, issue := range report.Issues {
+		action, err := repairAction(issue)
+		if err != nil {
+			return actions, left, err
+		}
+		if action == nil {
+			left = append(left, issue)
+			continue
+		}
+		if !opts.DryRun {
+			if err := applyRepair(ctx, storageDriver, *action); err != nil {
+				return actions, left, fmt.Errorf("failed to repair %s: %v", issue.Path, err)
+			}
+			log.Infof("%s %s: %s", action.Action, action.Path, issue.Message)
+		}
+		actions = append(actions, *action)
+	}
+	return actions, left, nil
+}
+
+// repairAction returns the repair of the issue, nil if it cannot be repaired.
+func repairAction(issue FsckIssue) (*RepairAction, error) {
+	action := &RepairAction{Issue: issue}
+	switch {
+	case issue.Category == FsckDanglingTag, issue.Category == FsckInvalidLink && issue.Tag != "":
+		tagPath, err := pathFor(manifestTagPathSpec{name: issue.Repository, tag: issue.Tag})
+		if err != nil {
+			return nil, err
+		}
+		action.Action, action.Path = RepairRemoved, tagPath
+	case issue.Category == FsckInvalidLink, issue.Category == FsckMissingBlob:
+		// the directory of the link only holds the link
+		action.Action, action.Path = RepairRemoved, path.Dir(issue.Path)
+	case issue.Category == FsckMissingTagIndex:
+		indexPath, err := pathFor(manifestTagIndexEntryLinkPathSpec{name: issue.Repository, tag: issue.Tag, revision: issue.Digest})
+		if err != nil {
+			return nil, err
+		}
+		action.Action, action.Path = RepairRecreated, indexPath
+	case issue.Category == FsckInvalidManifest:
+		action.Action, action.Path = RepairQuarantined, quarantinePath(issue.Digest)
+	default:
+		return nil, nil
+	}
+	return action, nil
+}
+
+// applyRepair applies the repair.
+func applyRepair(ctx context.Context, storageDriver driver.StorageDriver, action RepairAction) error {
+	switch action.Action {
+	case RepairRemoved:
+		err := storageDriver.Delete(ctx, action.Path)
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return nil
+		}
+		return err
+	case RepairRecreated:
+		return storageDriver.PutContent(ctx, action.Path, []byte(action.Issue.Digest))
+	case RepairQuarantined:
+		blobPath, err := pathFor(blobDataPathSpec{digest: action.Issue.Digest})
+		if err != nil {
+			return err
+		}
+		// the blob is already quarantined if another repository linked it
+		if err := storageDriver.Move(ctx, blobPath, action.Path); err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+			return err
+		}
+		err = storageDriver.Delete(ctx, path.Dir(action.Issue.Path))
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("unknown repair action %q", action.Action)
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestRepair(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+
+	repo := makeRepository(t, registry, "broken")
+	images := tagImages(t, repo, "missing-blob", "missing-reference", "invalid-link", "missing-tag-index")
+	expected := corruptRepository(t, d, "broken", images)
+
+	actions, left, err := Repair(ctx, d, registry, RepairOpts{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 5 || len(left) != 1 {
+		t.Fatalf("unexpected repairs: %+v, issues left: %+v", actions, left)
+	}
+	report, err := Fsck(ctx, d, registry, FsckOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 6 {
+		t.Fatalf("dry run repaired issues: %+v", report.Issues)
+	}
+
+	actions, left, err = Repair(ctx, d, registry, RepairOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byCategory := make(map[FsckCategory]string)
+	for _, action := range actions {
+		byCategory[action.Issue.Category] = action.Action
+	}
+	for category, action := range map[FsckCategory]string{
+		FsckMissingBlob:     RepairRemoved,
+		FsckInvalidLink:     RepairRemoved,
+		FsckDanglingTag:     RepairRemoved,
+		FsckMissingTagIndex: RepairRecreated,
+		FsckInvalidManifest: RepairQuarantined,
+	} {
+		if byCategory[category] != action {
+			t.Errorf("unexpected repair of %s: %q != %q", category, byCategory[category], action)
+		}
+	}
+	if len(left) != 1 || left[0].Category != FsckMissingReference {
+		t.Fatalf("unexpected issues left: %+v", left)
+	}
+
+	// the layers whose links were removed are now missing references
+	report, err = Fsck(ctx, d, registry, FsckOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		if issue.Category != FsckMissingReference {
+			t.Errorf("unexpected issue after repair: %+v", issue)
+		}
+	}
+	if n := report.Count(FsckMissingReference); n != 3 {
+		t.Errorf("unexpected missing references after repair: %+v", report.Issues)
+	}
+
+	if _, err := d.Stat(ctx, quarantinePath(expected[FsckInvalidManifest])); err != nil {
+		t.Errorf("unparseable manifest was not quarantined: %v", err)
+	}
+	desc, err := repo.Tags(ctx).Get(ctx, "missing-tag-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != expected[FsckMissingTagIndex] {
+		t.Errorf("unexpected revision of repaired tag: %s", desc.Digest)
+	}
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// scrubbedBlobsCount is the number of blobs whose content was verified.
+	scrubbedBlobsCount = prometheus.StorageNamespace.NewLabeledCounter("scrubbed_blobs", "The number of blobs verified by the scrubber", "driver")
+	// scrubbedBytesCount is the number of bytes read by the scrubber.
+	scrubbedBytesCount = prometheus.StorageNamespace.NewLabeledCounter("scrubbed_bytes", "The number of bytes verified by the scrubber", "driver")
+	// corruptBlobsCount is the number of blobs found corrupt by the scrubber.
+	corruptBlobsCount = prometheus.StorageNamespace.NewLabeledCounter("corrupt_blobs", "The number of blobs whose content does not match their digest", "driver", "quarantined")
+)
+
+// maxScrubBurst caps the bytes read at once by a rate limited scrubber.
+const maxScrubBurst = 1 << 20
+
+// quarantinePath returns the path the data of the corrupt blob identified by
+// dgst is moved to, out of the blob store.
+func quarantinePath(dgst digest.Digest) string {
+	return path.Join(storagePathRoot, storagePathVersion, "_quarantine", dgst.Algorithm().String(), dgst.Encoded(), "data")
+}
+
+// ScrubConfig configures a Scrubber.
+type ScrubConfig struct {
+	// Quarantine moves the data of the corrupt blobs out of the blob store,
+	// so that they are no longer served and can be pushed again.
+	Quarantine bool
+	// RateLimit is the number of bytes read per second, unlimited if zero.
+	RateLimit int64
+	// OnCorrupt, if set, is called for every corrupt blob found.
+	OnCorrupt func(ctx context.Context, blob CorruptBlob)
+}
+
+// CorruptBlob describes a blob whose content does not match its digest.
+type CorruptBlob struct {
+	// Digest is the digest of the blob.
+	Digest digest.Digest
+	// Size is the size of the content read.
+	Size int64
+	// Computed is the digest of the content read.
+	Computed digest.Digest
+	// Quarantined is true if the data of the blob was moved out of the blob
+	// store.
+	Quarantined bool
+}
+
+// Scrubber re-reads the blobs of the blob store and verifies that their
+// content still matches their digest, catching the corruption of content at
+// rest before clients pull it.
+type Scrubber struct {
+	driver  driver.StorageDriver
+	config  ScrubConfig
+	limiter *rate.Limiter
+}
+
+// NewScrubber returns a Scrubber of the blobs stored by driver.
+func NewScrubber(driver driver.StorageDriver, config ScrubConfig) (*Scrubber, error) {
+	if config.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid scrub rate limit %d", config.RateLimit)
+	}
+
+	s := &Scrubber{driver: driver, config: config}
+	if config.RateLimit > 0 {
+		s.limiter = rate.NewLimiter(rate.Limit(config.RateLimit), int(min(config.RateLimit, maxScrubBurst)))
+	}
+	return s, nil
+}
+
+// Scrub verifies every blob of the blob store, returning the corrupt ones.
+// Blobs which cannot be read are logged and skipped.
+func (s *Scrubber) Scrub(ctx context.Context) ([]CorruptBlob, error) {
+	log := dcontext.GetLogger(ctx)
+	log.Infof("scrubbing blobs, quarantine=%t", s.config.Quarantine)
+
+	var (
+		scrubbed int
+		corrupt  []CorruptBlob
+	)
+	blobs := &blobStore{driver: s.driver}
+	err := blobs.Enumerate(ctx, func(dgst digest.Digest) error {
+		blob, err := s.scrubBlob(ctx, dgst)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Errorf("error scrubbing blob %s: %v", dgst, err)
+			return nil
+		}
+		scrubbed++
+		if blob != nil {
+			corrupt = append(corrupt, *blob)
+		}
+		return nil
+	})
+
+	log.Infof("scrubbed %d blobs, %d corrupt", scrubbed, len(corrupt))
+	return corrupt, err
+}
+
+// scrubBlob verifies the blob identified by dgst, returning its description
+// if it is corrupt.
+func (s *Scrubber) scrubBlob(ctx context.Context, dgst digest.Digest) (*CorruptBlob, error) {
+	if !dgst.Algorithm().Available() {
+		return nil, fmt.Errorf("unsupported digest algorithm %q", dgst.Algorithm())
+	}
+
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := s.driver.Reader(ctx, blobPath, 0)
+	if err != nil {
+		if errors.As(err, &driver.PathNotFoundError{}) {
+			// deleted since it was enumerated
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if s.limiter != nil {
+		r = &rateLimitedReader{ctx: ctx, reader: rc, limiter: s.limiter}
+	}
+	digester := dgst.Algorithm().Digester()
+	n, err := io.Copy(digester.Hash(), r)
+	scrubbedBytesCount.WithValues(s.driver.Name()).Inc(float64(n))
+	if err != nil {
+		return nil, err
+	}
+	scrubbedBlobsCount.WithValues(s.driver.Name()).Inc(1)
+
+	computed := digester.Digest()
+	if computed == dgst {
+		return nil, nil
+	}
+
+	blob := &CorruptBlob{Digest: dgst, Size: n, Computed: computed}
+	log := dcontext.GetLoggerWithFields(ctx, map[interface{}]interface{}{"digest": dgst, "computed": computed})
+	log.Errorf("blob content does not match its digest")
+	if s.config.Quarantine {
+		if err := s.driver.Move(ctx, blobPath, quarantinePath(dgst)); err != nil {
+			log.Errorf("error quarantining corrupt blob: %v", err)
+		} else {
+			blob.Quarantined = true
+			log.Warnf("quarantined corrupt blob to %s", quarantinePath(dgst))
+		}
+	}
+	corruptBlobsCount.WithValues(s.driver.Name(), strconv.FormatBool(blob.Quarantined)).Inc(1)
+
+	if s.config.OnCorrupt != nil {
+		s.config.OnCorrupt(ctx, *blob)
+	}
+	return blob, nil
+}
+
+// Run scrubs the blobs every interval until ctx is done, starting after a
+// random delay of up to an hour so that the registries sharing a storage
+// backend do not read it at once.
+func (s *Scrubber) Run(ctx context.Context, interval time.Duration) {
+	jitter := time.Duration(rand.Int64N(int64(time.Hour)))
+	dcontext.GetLogger(ctx).Infof("starting blob scrubbing in %s", jitter.Round(time.Second))
+
+	timer := time.NewTimer(jitter)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			// errors are logged by Scrub and retried on the next run
+			_, _ = s.Scrub(ctx)
+			timer.Reset(interval)
+		}
+	}
+}
+
+// rateLimitedReader limits the bytes read per second with its limiter.
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+func (rl *rateLimitedReader) Read(p []byte) (int, error) {
+	if burst := rl.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := rl.reader.Read(p)
+	if n > 0 {
+		if err := rl.limiter.WaitN(rl.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// putScrubBlob stores content in the blob store as the blob identified by
+// dgst, which may not be its digest.
+func putScrubBlob(ctx context.Context, t *testing.T, d driver.StorageDriver, dgst digest.Digest, content string) {
+	p, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, p, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubber(t *testing.T) {
+	ctx := context.Background()
+
+	for _, quarantine := range []bool{false, true} {
+		d := inmemory.New()
+		healthy := digest.FromString("healthy")
+		corrupt := digest.FromString("corrupt")
+		putScrubBlob(ctx, t, d, healthy, "healthy")
+		putScrubBlob(ctx, t, d, corrupt, "bit rot")
+
+		var reported []CorruptBlob
+		scrubber, err := NewScrubber(d, ScrubConfig{
+			Quarantine: quarantine,
+			RateLimit:  64,
+			OnCorrupt: func(ctx context.Context, blob CorruptBlob) {
+				reported = append(reported, blob)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := scrubber.Scrub(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := CorruptBlob{Digest: corrupt, Size: 7, Computed: digest.FromString("bit rot"), Quarantined: quarantine}
+		if len(found) != 1 || found[0] != expected {
+			t.Fatalf("unexpected corrupt blobs, quarantine=%t: %+v", quarantine, found)
+		}
+		if len(reported) != 1 || reported[0] != expected {
+			t.Fatalf("unexpected reported blobs, quarantine=%t: %+v", quarantine, reported)
+		}
+
+		statter := &blobStatter{driver: d}
+		if _, err := statter.Stat(ctx, healthy); err != nil {
+			t.Fatalf("healthy blob not found: %v", err)
+		}
+		_, err = statter.Stat(ctx, corrupt)
+		if quarantine != (err != nil) {
+			t.Fatalf("unexpected stat of corrupt blob, quarantine=%t: %v", quarantine, err)
+		}
+		if quarantine {
+			content, err := d.GetContent(ctx, quarantinePath(corrupt))
+			if err != nil || string(content) != "bit rot" {
+				t.Fatalf("corrupt blob not quarantined: %q, %v", content, err)
+			}
+
+			// quarantined blobs are not scrubbed again
+			found, err := scrubber.Scrub(ctx)
+			if err != nil || len(found) != 0 {
+				t.Fatalf("unexpected corrupt blobs after quarantine: %+v, %v", found, err)
+			}
+		}
+	}
+}
+
+func TestScrubberInvalidRateLimit(t *testing.T) {
+	if _, err := NewScrubber(inmemory.New(), ScrubConfig{RateLimit: -1}); err == nil {
+		t.Fatal("expected an error for a negative rate limit")
+	}
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// sharedSecretPath is the path of the secret shared by the registries using
+// the same storage backend.
+var sharedSecretPath = path.Join(storagePathRoot, storagePathVersion, "_secret")
+
+// SharedSecret returns the secret shared by the registries using the same
+// storage backend, generating and storing it if none is stored yet, so that
+// registries behind a load balancer can verify what the others sign, such as
+// the state of blob uploads, without sharing a configured secret. Registries
+// starting at the same time may each store a secret: the one stored last is
+// returned by the calls which follow.
+func SharedSecret(ctx context.Context, d driver.StorageDriver) (string, error) {
+	secret, err := d.GetContent(ctx, sharedSecretPath)
+	if err == nil {
+		return string(secret), nil
+	}
+	if !errors.As(err, &driver.PathNotFoundError{}) {
+		return "", fmt.Errorf("reading the shared secret: %w", err)
+	}
+
+	var secretBytes [32]byte
+	if _, err := rand.Read(secretBytes[:]); err != nil {
+		return "", err
+	}
+	if err := d.PutContent(ctx, sharedSecretPath, []byte(hex.EncodeToString(secretBytes[:]))); err != nil {
+		return "", fmt.Errorf("storing the shared secret: %w", err)
+	}
+	// read the secret back, in case another registry stored it concurrently
+	secret, err = d.GetContent(ctx, sharedSecretPath)
+	if err != nil {
+		return "", fmt.Errorf("reading the shared secret: %w", err)
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestSharedSecret(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	secret, err := SharedSecret(ctx, d)
+	if err != nil {
+		t.Fatalf("unexpected error generating the shared secret: %v", err)
+	}
+	if len(secret) != 64 {
+		t.Fatalf("unexpected secret %q", secret)
+	}
+
+	// the registries sharing the storage backend share the secret
+	shared, err := SharedSecret(ctx, d)
+	if err != nil {
+		t.Fatalf("unexpected error loading the shared secret: %v", err)
+	}
+	if shared != secret {
+		t.Fatalf("loaded secret %q, expected %q", shared, secret)
+	}
+
+	other, err := SharedSecret(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("unexpected error generating the shared secret: %v", err)
+	}
+	if other == secret {
+		t.Fatal("expected the secrets of different storage backends to differ")
+	}
+}
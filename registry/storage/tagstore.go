@@ -123,6 +123,7 @@ func (ts *tagStore) Untag(ctx context.Context, tag string) error {
 // managed via the same code path.
 func (ts *tagStore) linkedBlobStore(ctx context.Context, tag string) *linkedBlobStore {
 	return &linkedBlobStore{
+		registry:   ts.repository.registry,
 		blobStore:  ts.blobStore,
 		repository: ts.repository,
 		ctx:        ctx,
@@ -206,6 +207,7 @@ func (ts *tagStore) ManifestDigests(ctx context.Context, tag string) ([]digest.D
 		})
 	}
 	lbs := &linkedBlobStore{
+		registry:  ts.repository.registry,
 		blobStore: ts.blobStore,
 		blobAccessController: &linkedBlobStatter{
 			blobStore:  ts.blobStore,
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"path"
 
 	"github.com/distribution/distribution/v3/internal/dcontext"
@@ -50,6 +51,35 @@ func (v Vacuum) RemoveBlob(dgst string) error {
 	return nil
 }
 
+// RemoveBlobs removes blobs from the filesystem, deleting their data in bulk
+// if the storage driver supports it
+func (v Vacuum) RemoveBlobs(dgsts []digest.Digest) error {
+	if deleter, ok := v.driver.(driver.BulkDeleter); ok {
+		// the data is the only file stored in the directory of a blob
+		paths := make([]string, 0, len(dgsts))
+		for _, dgst := range dgsts {
+			blobDataPath, err := pathFor(blobDataPathSpec{digest: dgst})
+			if err != nil {
+				return err
+			}
+			paths = append(paths, blobDataPath)
+		}
+
+		dcontext.GetLogger(v.ctx).Infof("Deleting %d blobs", len(paths))
+		err := deleter.DeleteFiles(v.ctx, paths)
+		if !errors.As(err, &driver.ErrUnsupportedMethod{}) {
+			return err
+		}
+	}
+
+	for _, dgst := range dgsts {
+		if err := v.RemoveBlob(string(dgst)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // RemoveManifest removes a manifest from the filesystem
 func (v Vacuum) RemoveManifest(name string, dgst digest.Digest, tags []string) error {
 	// remove a tag manifest reference, in case of not found continue to next one
@@ -81,7 +111,11 @@ func (v Vacuum) RemoveManifest(name string, dgst digest.Digest, tags []string) e
 		return err
 	}
 	dcontext.GetLogger(v.ctx).Infof("deleting manifest: %s", manifestPath)
-	return v.driver.Delete(v.ctx, manifestPath)
+	if err := v.driver.Delete(v.ctx, manifestPath); err != nil {
+		return err
+	}
+
+	return v.removePullStats(name, dgst)
 }
 
 // RemoveRepository removes a repository directory from the
@@ -115,3 +149,34 @@ func (v Vacuum) RemoveLayer(repoName string, dgst digest.Digest) error {
 
 	return nil
 }
+
+// RemoveLayers removes the layer link paths of a repository from the
+// storage, deleting them in bulk if the storage driver supports it
+func (v Vacuum) RemoveLayers(repoName string, dgsts []digest.Digest) error {
+	paths := make([]string, 0, len(dgsts))
+	for _, dgst := range dgsts {
+		layerLinkPath, err := pathFor(layerLinkPathSpec{name: repoName, digest: dgst})
+		if err != nil {
+			return err
+		}
+		paths = append(paths, layerLinkPath)
+	}
+
+	dcontext.GetLogger(v.ctx).Infof("Deleting %d layer link paths of repo %s", len(dgsts), repoName)
+	return driver.DeleteFiles(v.ctx, v.driver, paths)
+}
+
+// removePullStats removes the pull statistics recorded for a manifest which
+// is no longer linked into the repository.
+func (v Vacuum) removePullStats(repoName string, dgst digest.Digest) error {
+	statsPath, err := pathFor(pullStatsPathSpec{name: repoName, digest: dgst})
+	if err != nil {
+		return err
+	}
+
+	err = v.driver.Delete(v.ctx, statsPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+package registrytest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Blob is content stored in a repository.
+type Blob struct {
+	MediaType string
+	Content   []byte
+}
+
+// Descriptor returns the descriptor of the blob.
+func (b Blob) Descriptor() v1.Descriptor {
+	return v1.Descriptor{
+		MediaType: b.MediaType,
+		Digest:    digest.FromBytes(b.Content),
+		Size:      int64(len(b.Content)),
+	}
+}
+
+// Digest returns the digest of the blob content.
+func (b Blob) Digest() digest.Digest {
+	return digest.FromBytes(b.Content)
+}
+
+// NewBlob returns a blob of the given size and media type, with content
+// derived from seed. Equal seeds give equal content.
+func NewBlob(seed string, size int, mediaType string) Blob {
+	content := make([]byte, 0, size+sha256.Size)
+	var counter [8]byte
+	for i := uint64(0); len(content) < size; i++ {
+		binary.BigEndian.PutUint64(counter[:], i)
+		sum := sha256.Sum256(append([]byte(seed), counter[:]...))
+		content = append(content, sum[:]...)
+	}
+	return Blob{MediaType: mediaType, Content: content[:size]}
+}
+
+// Manifest is a manifest ready to be pushed.
+type Manifest interface {
+	// Payload returns the media type and serialized form of the manifest.
+	Payload() (mediaType string, payload []byte, err error)
+}
+
+// Image is a single platform image, in the OCI or Docker schema 2 format.
+type Image struct {
+	// MediaType is the media type of the image manifest, either
+	// v1.MediaTypeImageManifest or schema2.MediaTypeManifest.
+	MediaType string
+
+	// Platform is the platform the image runs on.
+	Platform v1.Platform
+
+	Config Blob
+	Layers []Blob
+
+	// Annotations are set on OCI image manifests.
+	Annotations map[string]string
+}
+
+// NewImage returns an OCI image for linux/amd64 with the given number of
+// layers, whose content is derived from seed.
+func NewImage(seed string, layers int) Image {
+	return newImage(seed, layers, v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, v1.MediaTypeImageLayerGzip)
+}
+
+// NewSchema2Image returns a Docker schema 2 image for linux/amd64 with the
+// given number of layers, whose content is derived from seed.
+func NewSchema2Image(seed string, layers int) Image {
+	return newImage(seed, layers, schema2.MediaTypeManifest, schema2.MediaTypeImageConfig, schema2.MediaTypeLayer)
+}
+
+func newImage(seed string, layers int, mediaType, configType, layerType string) Image {
+	img := Image{
+		MediaType: mediaType,
+		Platform:  v1.Platform{Architecture: "amd64", OS: "linux"},
+	}
+	for i := 0; i < layers; i++ {
+		img.Layers = append(img.Layers, NewBlob(fmt.Sprintf("%s/layer/%d", seed, i), 1024*(i+1), layerType))
+	}
+	img.Config = img.config(configType)
+	return img
+}
+
+// WithPlatform returns a copy of the image for the given platform.
+func (img Image) WithPlatform(platform v1.Platform) Image {
+	img.Platform = platform
+	img.Config = img.config(img.Config.MediaType)
+	return img
+}
+
+// config builds the image configuration matching the image platform and
+// layers.
+func (img Image) config(mediaType string) Blob {
+	diffIDs := make([]digest.Digest, 0, len(img.Layers))
+	for _, layer := range img.Layers {
+		diffIDs = append(diffIDs, layer.Digest())
+	}
+	config, err := json.Marshal(v1.Image{
+		Platform: img.Platform,
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return Blob{MediaType: mediaType, Content: config}
+}
+
+// Blobs returns the config and layers of the image.
+func (img Image) Blobs() []Blob {
+	return append([]Blob{img.Config}, img.Layers...)
+}
+
+// Payload implements Manifest.
+func (img Image) Payload() (string, []byte, error) {
+	layers := make([]v1.Descriptor, 0, len(img.Layers))
+	for _, layer := range img.Layers {
+		layers = append(layers, layer.Descriptor())
+	}
+
+	switch img.MediaType {
+	case schema2.MediaTypeManifest:
+		m, err := schema2.FromStruct(schema2.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: schema2.MediaTypeManifest,
+			Config:    img.Config.Descriptor(),
+			Layers:    layers,
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		return m.Payload()
+	case v1.MediaTypeImageManifest:
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   v1.MediaTypeImageManifest,
+			Config:      img.Config.Descriptor(),
+			Layers:      layers,
+			Annotations: img.Annotations,
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		return m.Payload()
+	default:
+		return "", nil, fmt.Errorf("unsupported image media type %q", img.MediaType)
+	}
+}
+
+// Index is a multi platform image, as an OCI image index or a Docker
+// manifest list.
+type Index struct {
+	// MediaType is the media type of the index, either v1.MediaTypeImageIndex
+	// or manifestlist.MediaTypeManifestList.
+	MediaType string
+
+	Manifests []Image
+
+	// Annotations are set on OCI image indexes.
+	Annotations map[string]string
+}
+
+// NewIndex returns an OCI image index of the images.
+func NewIndex(images ...Image) Index {
+	return Index{MediaType: v1.MediaTypeImageIndex, Manifests: images}
+}
+
+// NewManifestList returns a Docker manifest list of the images.
+func NewManifestList(images ...Image) Index {
+	return Index{MediaType: manifestlist.MediaTypeManifestList, Manifests: images}
+}
+
+// Payload implements Manifest.
+func (idx Index) Payload() (string, []byte, error) {
+	descriptors := make([]v1.Descriptor, 0, len(idx.Manifests))
+	for _, img := range idx.Manifests {
+		desc, err := ManifestDescriptor(img)
+		if err != nil {
+			return "", nil, err
+		}
+		platform := img.Platform
+		desc.Platform = &platform
+		descriptors = append(descriptors, desc)
+	}
+
+	switch idx.MediaType {
+	case manifestlist.MediaTypeManifestList:
+		manifests := make([]manifestlist.ManifestDescriptor, 0, len(descriptors))
+		for _, desc := range descriptors {
+			manifests = append(manifests, manifestlist.ManifestDescriptor{
+				Descriptor: v1.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size},
+				Platform: manifestlist.PlatformSpec{
+					Architecture: desc.Platform.Architecture,
+					OS:           desc.Platform.OS,
+					OSVersion:    desc.Platform.OSVersion,
+					OSFeatures:   desc.Platform.OSFeatures,
+					Variant:      desc.Platform.Variant,
+				},
+			})
+		}
+		m, err := manifestlist.FromDescriptors(manifests)
+		if err != nil {
+			return "", nil, err
+		}
+		return m.Payload()
+	case v1.MediaTypeImageIndex:
+		m, err := ocischema.FromDescriptors(descriptors, idx.Annotations)
+		if err != nil {
+			return "", nil, err
+		}
+		return m.Payload()
+	default:
+		return "", nil, fmt.Errorf("unsupported index media type %q", idx.MediaType)
+	}
+}
+
+// ManifestDescriptor returns the descriptor of a manifest.
+func ManifestDescriptor(m Manifest) (v1.Descriptor, error) {
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+	}, nil
+}
@@ -0,0 +1,158 @@
+// Package registrytest provides an in-memory registry, seeded with
+// deterministic repositories, manifests and blobs, for integration tests of
+// programs talking to a registry.
+//
+//	reg := registrytest.New(t)
+//	img := registrytest.NewImage("app", 2)
+//	dgst := reg.PushImage(t, "library/app", "latest", img)
+//	// point the client under test at reg.URL
+package registrytest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/embed"
+	"github.com/opencontainers/go-digest"
+)
+
+// Registry is a registry served over HTTP by a test server.
+type Registry struct {
+	// URL is the base URL of the registry, of the form http://ipaddr:port
+	// with no trailing slash.
+	URL string
+
+	// Client is an HTTP client for the registry.
+	Client *http.Client
+}
+
+// New starts an in-memory registry built with the embed options, which is
+// stopped when the test completes.
+func New(t testing.TB, options ...embed.Option) *Registry {
+	t.Helper()
+
+	reg, err := embed.New(context.Background(), nil, options...)
+	if err != nil {
+		t.Fatalf("registrytest: %v", err)
+	}
+	server := httptest.NewServer(reg.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		if err := reg.Shutdown(context.Background()); err != nil {
+			t.Errorf("registrytest: %v", err)
+		}
+	})
+
+	return &Registry{
+		URL:    server.URL,
+		Client: server.Client(),
+	}
+}
+
+// Host returns the host and port of the registry, as used in image
+// references.
+func (r *Registry) Host() string {
+	u, _ := url.Parse(r.URL)
+	return u.Host
+}
+
+// PushBlob uploads a blob to a repository.
+func (r *Registry) PushBlob(t testing.TB, repo string, blob Blob) {
+	t.Helper()
+
+	resp := r.do(t, http.MethodPost, "/v2/"+repo+"/blobs/uploads/", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("registrytest: starting upload to %s: unexpected status %s", repo, resp.Status)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("registrytest: starting upload to %s: %v", repo, err)
+	}
+
+	q := location.Query()
+	q.Set("digest", blob.Digest().String())
+	location.RawQuery = q.Encode()
+	resp = r.do(t, http.MethodPut, location.String(), "application/octet-stream", blob.Content)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("registrytest: uploading %s to %s: unexpected status %s", blob.Digest(), repo, resp.Status)
+	}
+}
+
+// PushManifest uploads a manifest to a repository, under reference, which is
+// either a tag or empty to push by digest. Blobs and manifests the manifest
+// references must have been pushed first.
+func (r *Registry) PushManifest(t testing.TB, repo, reference string, m Manifest) digest.Digest {
+	t.Helper()
+
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		t.Fatalf("registrytest: %v", err)
+	}
+	dgst := digest.FromBytes(payload)
+	if reference == "" {
+		reference = dgst.String()
+	}
+
+	resp := r.do(t, http.MethodPut, "/v2/"+repo+"/manifests/"+reference, mediaType, payload)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("registrytest: pushing manifest %s:%s: unexpected status %s", repo, reference, resp.Status)
+	}
+	return dgst
+}
+
+// PushImage uploads an image and its blobs to a repository, tagged with tag
+// unless empty, and returns the digest of its manifest.
+func (r *Registry) PushImage(t testing.TB, repo, tag string, img Image) digest.Digest {
+	t.Helper()
+
+	for _, blob := range img.Blobs() {
+		r.PushBlob(t, repo, blob)
+	}
+	return r.PushManifest(t, repo, tag, img)
+}
+
+// PushIndex uploads an index and its images to a repository, tagged with
+// tag unless empty, and returns the digest of the index.
+func (r *Registry) PushIndex(t testing.TB, repo, tag string, idx Index) digest.Digest {
+	t.Helper()
+
+	for _, img := range idx.Manifests {
+		r.PushImage(t, repo, "", img)
+	}
+	return r.PushManifest(t, repo, tag, idx)
+}
+
+func (r *Registry) do(t testing.TB, method, location, contentType string, body []byte) *http.Response {
+	t.Helper()
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatalf("registrytest: %v", err)
+	}
+	u, err = u.Parse(location)
+	if err != nil {
+		t.Fatalf("registrytest: %v", err)
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("registrytest: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		t.Fatalf("registrytest: %s %s: %v", method, u.Path, err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("registrytest: reading response to %s %s: %v", method, u.Path, err)
+	}
+	return resp
+}
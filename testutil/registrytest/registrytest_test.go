@@ -0,0 +1,67 @@
+package registrytest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPush(t *testing.T) {
+	reg := New(t)
+
+	img := NewImage("app", 2)
+	if again := NewImage("app", 2); string(again.Layers[1].Content) != string(img.Layers[1].Content) {
+		t.Fatal("expected content to be deterministic")
+	}
+	dgst := reg.PushImage(t, "library/app", "latest", img)
+
+	arm := NewSchema2Image("app", 1).WithPlatform(v1.Platform{Architecture: "arm64", OS: "linux"})
+	idx := NewManifestList(NewSchema2Image("app", 1), arm)
+	idxDigest := reg.PushIndex(t, "library/app", "multi", idx)
+	ociDigest := reg.PushIndex(t, "library/app", "oci", NewIndex(NewImage("other", 1), img))
+
+	for _, tc := range []struct {
+		reference string
+		mediaType string
+		digest    string
+	}{
+		{"latest", v1.MediaTypeImageManifest, dgst.String()},
+		{dgst.String(), v1.MediaTypeImageManifest, dgst.String()},
+		{"multi", manifestlist.MediaTypeManifestList, idxDigest.String()},
+		{"oci", v1.MediaTypeImageIndex, ociDigest.String()},
+	} {
+		req, err := http.NewRequest(http.MethodGet, reg.URL+"/v2/library/app/manifests/"+tc.reference, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", tc.mediaType)
+		resp, err := reg.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status fetching %s: %s", tc.reference, resp.Status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != tc.mediaType {
+			t.Errorf("unexpected content type for %s: %s", tc.reference, ct)
+		}
+		if d := resp.Header.Get("Docker-Content-Digest"); d != tc.digest {
+			t.Errorf("unexpected digest for %s: %s", tc.reference, d)
+		}
+	}
+
+	resp, err := reg.Client.Head(reg.URL + "/v2/library/app/blobs/" + img.Layers[0].Digest().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status fetching layer: %s", resp.Status)
+	}
+}